@@ -0,0 +1,301 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/spf13/cobra"
+)
+
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Inspect and control a running node",
+	Long:  `Talk to the admin API of a running node (see the --admin and --admin-token flags)`,
+}
+
+var adminStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show node status",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "GET", "/admin/status")
+	},
+}
+
+var adminPeersCmd = &cobra.Command{
+	Use:   "peers",
+	Short: "List known peers",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "GET", "/admin/peers")
+	},
+}
+
+var adminSeedsCmd = &cobra.Command{
+	Use:   "seeds",
+	Short: "List known seeds",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "GET", "/admin/seeds")
+	},
+}
+
+var adminSubscriptionsCmd = &cobra.Command{
+	Use:   "subscriptions",
+	Short: "Show the node's subscription filter",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "GET", "/admin/subscriptions")
+	},
+}
+
+var adminSubscribeCmd = &cobra.Command{
+	Use:   "subscribe id",
+	Short: "Subscribe to an entity, or a topic such as Tag:value=golang",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "POST", subscriptionPath(cmd, args[0]))
+	},
+}
+
+var adminUnsubscribeCmd = &cobra.Command{
+	Use:   "unsubscribe id",
+	Short: "Unsubscribe from an entity or topic",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "DELETE", subscriptionPath(cmd, args[0]))
+	},
+}
+
+// subscriptionPath returns the admin path for an entity ID, or a topic if the
+// topic flag is set
+func subscriptionPath(cmd *cobra.Command, arg string) string {
+	if topic, _ := cmd.Flags().GetBool("topic"); topic {
+		return "/admin/topics/" + url.PathEscape(arg)
+	}
+	return "/admin/subscriptions/" + url.PathEscape(arg)
+}
+
+var adminPingCmd = &cobra.Command{
+	Use:   "ping [host:port]",
+	Short: "Ping all peers, or just the one given",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "/admin/ping"
+		if len(args) > 0 {
+			path += "?addr=" + url.QueryEscape(args[0])
+		}
+		return adminRequest(cmd, "POST", path)
+	},
+}
+
+var adminDropCmd = &cobra.Command{
+	Use:   "drop host:port",
+	Short: "Drop a peer",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "DELETE", "/admin/peers/"+url.PathEscape(args[0]))
+	},
+}
+
+var adminResyncCmd = &cobra.Command{
+	Use:   "resync",
+	Short: "Refresh seeds and rejoin the network",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "POST", "/admin/resync")
+	},
+}
+
+var adminBlocksCmd = &cobra.Command{
+	Use:   "blocks",
+	Short: "List blocked and muted identities",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "GET", "/admin/blocks")
+	},
+}
+
+var adminBlockCmd = &cobra.Command{
+	Use:   "block identity",
+	Short: "Block (or mute) an identity",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mute, err := cmd.Flags().GetBool("mute")
+		if err != nil {
+			return fmt.Errorf("no mute flag: %w", err)
+		}
+
+		by, err := cmd.Flags().GetString("by")
+		if err != nil {
+			return fmt.Errorf("no by flag: %w", err)
+		}
+
+		purge, err := cmd.Flags().GetBool("purge")
+		if err != nil {
+			return fmt.Errorf("no purge flag: %w", err)
+		}
+
+		q := url.Values{}
+		q.Set("mode", model.BlockModeBlock)
+		if mute {
+			q.Set("mode", model.BlockModeMute)
+		}
+		if by != "" {
+			q.Set("by", by)
+		}
+
+		err = adminRequest(cmd, "POST", "/admin/blocks/"+url.PathEscape(args[0])+"?"+q.Encode())
+		if err != nil || !purge {
+			return err
+		}
+
+		return adminRequest(cmd, "POST", "/admin/blocks/"+url.PathEscape(args[0])+"/purge")
+	},
+}
+
+var adminUnblockCmd = &cobra.Command{
+	Use:   "unblock identity",
+	Short: "Remove a block or mute",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "DELETE", "/admin/blocks/"+url.PathEscape(args[0]))
+	},
+}
+
+var adminPurgeCmd = &cobra.Command{
+	Use:   "purge identity",
+	Short: "Delete everything an identity owns from the local graph",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "POST", "/admin/blocks/"+url.PathEscape(args[0])+"/purge")
+	},
+}
+
+var adminHandleCmd = &cobra.Command{
+	Use:   "handle handle",
+	Short: "Resolve a handle to the identities claiming it",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, "GET", "/admin/handles/"+url.PathEscape(args[0]))
+	},
+}
+
+func adminRequest(cmd *cobra.Command, method, path string) error {
+	cmd.SilenceUsage = true
+
+	addr, err := cmd.Flags().GetString("admin")
+	if err != nil {
+		return fmt.Errorf("no admin address: %w", err)
+	}
+	if addr == "" {
+		return errors.New("admin address required")
+	}
+
+	token, err := cmd.Flags().GetString("admin-token")
+	if err != nil {
+		return fmt.Errorf("no admin token: %w", err)
+	}
+
+	client, baseURL := localClient(addr)
+	req, err := http.NewRequestWithContext(cmd.Context(), method, baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	if token != "" {
+		req.Header.Add(node.HeaderAuthorization, "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin request failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if len(body) == 0 {
+		fmt.Fprintln(os.Stdout, "ok")
+		return nil
+	}
+
+	buf := bytes.Buffer{}
+	err = json.Indent(&buf, body, "", "  ")
+	if err != nil {
+		buf.Reset()
+		buf.Write(body)
+	}
+	fmt.Fprintln(os.Stdout, buf.String())
+
+	return nil
+}
+
+// localClient returns a client for a node's admin or application API and the
+// URL to prefix request paths with. Addresses with the unix: prefix are
+// sockets.
+func localClient(addr string) (*http.Client, string) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if socketPath, ok := strings.CutPrefix(addr, node.AdminSocketPrefix); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		addr = "localhost"
+	}
+	return client, "http://" + addr
+}
+
+func init() {
+	adminCmd.AddCommand(adminStatusCmd)
+	adminCmd.AddCommand(adminPeersCmd)
+	adminCmd.AddCommand(adminSeedsCmd)
+	adminCmd.AddCommand(adminSubscriptionsCmd)
+	adminCmd.AddCommand(adminSubscribeCmd)
+	adminCmd.AddCommand(adminUnsubscribeCmd)
+	adminCmd.AddCommand(adminPingCmd)
+	adminCmd.AddCommand(adminDropCmd)
+	adminCmd.AddCommand(adminResyncCmd)
+	adminCmd.AddCommand(adminBlocksCmd)
+	adminCmd.AddCommand(adminBlockCmd)
+	adminCmd.AddCommand(adminUnblockCmd)
+	adminCmd.AddCommand(adminPurgeCmd)
+	adminCmd.AddCommand(adminHandleCmd)
+
+	adminSubscribeCmd.Flags().Bool("topic", false, "Subscribe to a label or Label:key=value topic rather than an entity")
+	adminUnsubscribeCmd.Flags().Bool("topic", false, "Unsubscribe from a topic rather than an entity")
+	adminBlockCmd.Flags().Bool("mute", false, "Accept the identity's actions but don't pass them on")
+	adminBlockCmd.Flags().String("by", "", "Local identity the block is on behalf of")
+	adminBlockCmd.Flags().Bool("purge", false, "Also delete the identity's existing data")
+	baseCmd.AddCommand(adminCmd)
+}
@@ -17,16 +17,19 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
-	"fmt"
 	"log/slog"
 	"os"
 
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/logging"
+	"github.com/jdudmesh/propolis/internal/secrets"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var cfgFile string
 var logger *slog.Logger
+var loggers *logging.Loggers
 
 // baseCmd represents the base command when called without any subcommands
 var baseCmd = &cobra.Command{
@@ -36,12 +39,21 @@ var baseCmd = &cobra.Command{
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		err := readConfig(cmd)
+		if err != nil {
+			cmd.SilenceUsage = true
+		}
+		return err
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
-func Execute(l *slog.Logger) {
-	logger = l // TODO: yuk, don't do this
+func Execute(l *logging.Loggers) {
+	loggers = l
+	logger = l.Logger("") // TODO: yuk, don't do this
+	ast.SetLogger(l.Logger(logging.ModuleAST))
 	err := baseCmd.Execute()
 	if err != nil {
 		os.Exit(1)
@@ -50,39 +62,43 @@ func Execute(l *slog.Logger) {
 
 func init() {
 
-	baseCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./propolis.yaml)")
-	baseCmd.PersistentFlags().String("host", "0.0.0.0", "Peer listen address")
+	baseCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "Config file (default is ./propolis.yaml if it exists)")
+	baseCmd.PersistentFlags().String("log-level", "debug", "Log level: debug, info, warn or error")
+	baseCmd.PersistentFlags().String("log-format", logging.FormatText, "Log format: text or json")
+	baseCmd.PersistentFlags().String("host", "0.0.0.0", "Peer listen address (use :: for dual stack IPv4/IPv6)")
 	baseCmd.PersistentFlags().Int("port", 9090, "Peer listen port")
 	baseCmd.PersistentFlags().String("ndb", "file:./data/node.db?mode=rwc&_secure_delete=true", "Node DB connection string")
 	baseCmd.PersistentFlags().String("gdb", "file:./data/graph.db?mode=rwc&_secure_delete=true", "Graph DB connection string")
+	baseCmd.PersistentFlags().String("idb", "file:./data/identity.db?mode=rwc&_secure_delete=true", "Identity DB connection string")
 	baseCmd.PersistentFlags().StringArray("seed", []string{}, "host:port spec for seed")
 	baseCmd.PersistentFlags().Bool("mem", false, "Use in memory databases")
-
-	viper.BindPFlag("host", baseCmd.Flags().Lookup("host"))
-	viper.BindPFlag("port", baseCmd.Flags().Lookup("port"))
-	viper.BindPFlag("db", baseCmd.Flags().Lookup("db"))
-	viper.BindPFlag("seed", baseCmd.Flags().Lookup("seed"))
-
-	cobra.OnInitialize(initConfig)
+	baseCmd.PersistentFlags().StringArray("advertise", []string{}, "Additional host:port specs other nodes can reach this node on")
+	baseCmd.PersistentFlags().String("admin", "", "Admin/metrics listen address e.g. 127.0.0.1:9190 or unix:./data/admin.sock (disabled if empty)")
+	baseCmd.PersistentFlags().String("admin-token", "", "Bearer token for the admin API (required when admin listens on TCP)")
+	baseCmd.PersistentFlags().Bool("diagnostics", false, "Serve pprof profiles and expvar on the admin API at /debug/pprof/ and /debug/vars")
+	baseCmd.PersistentFlags().String("api", "", "Application API listen address e.g. unix:./data/api.sock (disabled if empty)")
+	baseCmd.PersistentFlags().String("api-token", "", "Bearer token for the application API (required when it listens on TCP)")
+	baseCmd.PersistentFlags().String("bolt", "", "Listen address for Neo4j drivers e.g. 127.0.0.1:7687, logging in with the api token (disabled if empty)")
+	baseCmd.PersistentFlags().String("client", "", "Listen address for client publishes and queries e.g. 0.0.0.0:9095, leaving the node's port to other nodes (disabled if empty)")
+	baseCmd.PersistentFlags().String("dashboard", "", "Web dashboard listen address e.g. 127.0.0.1:9191, logging in with the admin token (disabled if empty)")
+	baseCmd.PersistentFlags().Bool("graphql", false, "Serve a read only GraphQL view of the graph at /api/graphql on the application API")
+	baseCmd.PersistentFlags().String("db-key-file", "", "File holding the base64 database encryption key (default is $PROPOLIS_DB_KEY)")
+	baseCmd.PersistentFlags().Bool("verify-handles", false, "Verify user@domain handles using the domain's webfinger")
+	baseCmd.PersistentFlags().Int("certificate-quorum", 2, "Number of nodes which must agree on an unknown identity's certificate")
+	baseCmd.PersistentFlags().Int("dedupe-cache-size", 10000, "Number of recently seen action IDs kept in memory to reject duplicates")
+	baseCmd.PersistentFlags().Int("dispatch-workers", 16, "Number of actions which can be sent to peers at once")
+	baseCmd.PersistentFlags().StringArray("seed-domain", []string{}, "Domain to look up _propolis._udp SRV records for seeds")
+	baseCmd.PersistentFlags().StringArray("bootstrap-url", []string{}, "URL serving a JSON list of seeds")
+	baseCmd.PersistentFlags().Bool("tcp", true, "Listen on TCP as a fallback for networks which block UDP")
+	baseCmd.PersistentFlags().StringArray("capability", []string{}, "Capability replacing the node type's defaults: accepts-joins, stores-graph, relays or serves-queries")
 }
 
-// initConfig reads in config file and ENV variables if set.
-func initConfig() {
-	viper.SetDefault("host", "0.0.0.0")
-	viper.SetDefault("port", "9090")
-
-	if cfgFile != "" {
-		viper.SetConfigFile(cfgFile)
-	} else {
-		viper.AddConfigPath(".")
-		viper.SetConfigType("yaml")
-		viper.SetConfigName("propolis")
-	}
-
-	viper.AutomaticEnv() // read in environment variables that match
-
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+// databaseKey returns the key provider for the database encryption key, nil to
+// fall back to the environment
+func databaseKey() secrets.KeyProvider {
+	keyFile := viper.GetString("db_key_file")
+	if keyFile == "" {
+		return nil
 	}
+	return secrets.FileKeyProvider(keyFile)
 }
@@ -18,10 +18,8 @@ package cmd
 
 import (
 	"fmt"
-	"sync"
 
 	"github.com/jdudmesh/propolis/internal/bloom"
-	"github.com/jdudmesh/propolis/internal/graph"
 	"github.com/jdudmesh/propolis/internal/node"
 	"github.com/spf13/cobra"
 )
@@ -29,67 +27,30 @@ import (
 var cacheCmd = &cobra.Command{
 	Use:   "cache",
 	Short: "Propolis cache server",
-	Long:  `Run propolis in cache mode`,
+	Long: `Run propolis in cache mode. SIGHUP reloads the log level, moderation
+policies, quotas, statement limits and seeds from the config file.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		host, err := cmd.Flags().GetString("host")
-		if err != nil {
-			return fmt.Errorf("no host: %w", err)
-		}
+		cmd.SilenceUsage = true
 
-		port, err := cmd.Flags().GetInt("port")
-		if err != nil {
-			return fmt.Errorf("no port: %w", err)
-		}
-
-		nodeDatabaseURL, err := cmd.Flags().GetString("ndb")
-		if err != nil {
-			return fmt.Errorf("no db: %w", err)
-		}
-
-		graphDatabaseURL, err := cmd.Flags().GetString("gdb")
-		if err != nil {
-			return fmt.Errorf("no db: %w", err)
-		}
-
-		seeds, err := cmd.Flags().GetStringArray("seed")
-		if err != nil {
-			return fmt.Errorf("no seeds specified: %w", err)
-		}
-
-		config := node.Config{
-			Config: graph.Config{
-				Logger:           logger,
-				GraphDatabaseURL: graphDatabaseURL,
-			},
-			Type:            node.NodeTypeCache,
-			Host:            host,
-			Port:            port,
-			NodeDatabaseURL: nodeDatabaseURL,
-			Seeds:           seeds,
-		}
-
-		filter := bloom.New()
-		h, err := node.New(config, filter)
-		if err != nil {
-			return fmt.Errorf("creating peer: %w", err)
-		}
-
-		wg := sync.WaitGroup{}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err = h.Run()
+		return runNode(cmd, node.NodeTypeCache, func(config *nodeConfig) (runningNode, error) {
+			h, err := node.New(config.Config, bloom.New())
 			if err != nil {
-				err = fmt.Errorf("starting cache: %w", err)
+				return nil, fmt.Errorf("creating cache: %w", err)
 			}
-		}()
 
-		wg.Wait()
+			// the cache subscribes to the entities it replicates
+			if len(config.Replicate) > 0 {
+				h.Subscribe(config.Replicate...)
+			}
 
-		return err
+			return h, nil
+		})
 	},
 }
 
 func init() {
+	runFlags(cacheCmd.Flags())
 	baseCmd.AddCommand(cacheCmd)
+
+	cacheCmd.Flags().StringArray("replicate", []string{}, "Entity ID to replicate and serve to peers")
 }
@@ -0,0 +1,274 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/jdudmesh/propolis/internal/logging"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// EnvConfigPrefix prefixes the environment variables which set config keys,
+// e.g. PROPOLIS_ADMIN_TOKEN sets admin_token
+const EnvConfigPrefix = "PROPOLIS"
+
+const defaultConfigFile = "propolis.yaml"
+
+// configFlags maps the top level config file keys to the flags which override
+// them. Keys without a flag can only be set in the file or the environment.
+var configFlags = map[string]string{
+	"host":                 "host",
+	"port":                 "port",
+	"public_address":       "public",
+	"seeds":                "seed",
+	"advertise":            "advertise",
+	"address_quorum":       "",
+	"tcp":                  "tcp",
+	"capabilities":         "capability",
+	"memory":               "mem",
+	"node_db":              "ndb",
+	"graph_db":             "gdb",
+	"identity_db":          "idb",
+	"db_key_file":          "db-key-file",
+	"admin_address":        "admin",
+	"admin_token":          "admin-token",
+	"diagnostics":          "diagnostics",
+	"api_address":          "api",
+	"api_token":            "api-token",
+	"graphql":              "graphql",
+	"bolt_address":         "bolt",
+	"client_address":       "client",
+	"dashboard_address":    "dashboard",
+	"verify_handles":       "verify-handles",
+	"certificate_quorum":   "certificate-quorum",
+	"certificate_sources":  "",
+	"key_rotation_grace":   "",
+	"min_manifest_version": "",
+	"dedupe_cache_size":    "dedupe-cache-size",
+	"dispatch_workers":     "dispatch-workers",
+	"peer_queue_size":      "",
+	"seed_domains":         "seed-domain",
+	"bootstrap_urls":       "bootstrap-url",
+	"replicate":            "replicate",
+	"log_level":            "log-level",
+	"log_levels":           "",
+	"log_format":           "log-format",
+	"pid_file":             "pid-file",
+	"log_file":             "log-file",
+}
+
+// nodeConfig is the config file schema shared by every node type: the node's
+// config plus the settings the commands use to build it
+type nodeConfig struct {
+	node.Config `mapstructure:",squash"`
+	// Memory replaces the node and graph databases with in memory ones
+	Memory bool `mapstructure:"memory"`
+	// IdentityDatabaseURL is the identity store the application API publishes
+	// from
+	IdentityDatabaseURL string `mapstructure:"identity_db"`
+	// DatabaseKeyFile holds the base64 database encryption key
+	DatabaseKeyFile string `mapstructure:"db_key_file"`
+	// Replicate are the entity IDs a cache subscribes to
+	Replicate []string `mapstructure:"replicate"`
+	// LogLevel is the minimum level logged: debug, info, warn or error
+	LogLevel string `mapstructure:"log_level"`
+	// LogFormat is text or json
+	LogFormat string `mapstructure:"log_format"`
+	// PIDFile is written with the node's process ID while it runs
+	PIDFile string `mapstructure:"pid_file"`
+	// LogFile is appended to by a node running with --daemon
+	LogFile string `mapstructure:"log_file"`
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the node configuration",
+}
+
+var configCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the configuration without starting a node",
+	Long: `Read the config file, PROPOLIS_* environment variables and flags as a node
+would and report every problem found with them.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		nodeTypeName, err := cmd.Flags().GetString("type")
+		if err != nil {
+			return fmt.Errorf("no node type: %w", err)
+		}
+
+		var nodeType node.NodeType
+		switch nodeTypeName {
+		case node.NodeTypeSeed.String():
+			nodeType = node.NodeTypeSeed
+		case node.NodeTypePeer.String():
+			nodeType = node.NodeTypePeer
+		case node.NodeTypeCache.String():
+			nodeType = node.NodeTypeCache
+		default:
+			return fmt.Errorf("unknown node type %q, use seed, peer or cache", nodeTypeName)
+		}
+
+		_, err = loadNodeConfig(nodeType)
+		if err != nil {
+			return err
+		}
+
+		source := "no config file"
+		if viper.ConfigFileUsed() != "" {
+			source = viper.ConfigFileUsed()
+		}
+		fmt.Printf("%s config ok (%s)\n", nodeType, source)
+		return nil
+	},
+}
+
+// readConfig reads the config file, if there is one, and binds the config
+// keys to the environment and the command's flags, which take precedence
+func readConfig(cmd *cobra.Command) error {
+	viper.SetEnvPrefix(EnvConfigPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+
+	for key, name := range configFlags {
+		err := viper.BindEnv(key)
+		if err != nil {
+			return fmt.Errorf("binding %s: %w", key, err)
+		}
+		if f := cmd.Flags().Lookup(name); f != nil {
+			err = viper.BindPFlag(key, f)
+			if err != nil {
+				return fmt.Errorf("binding %s: %w", key, err)
+			}
+		}
+	}
+
+	// viper's search would also match the propolis binary itself, so only the
+	// default file name is looked for
+	path := cfgFile
+	if path == "" {
+		_, err := os.Stat(defaultConfigFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		path = defaultConfigFile
+	}
+	viper.SetConfigFile(path)
+
+	err := viper.ReadInConfig()
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	return nil
+}
+
+// loadNodeConfig decodes the config for a node of the given type and
+// validates it, rejecting unknown keys
+func loadNodeConfig(nodeType node.NodeType) (*nodeConfig, error) {
+	config := &nodeConfig{}
+	metadata := mapstructure.Metadata{}
+	err := viper.Unmarshal(config, func(dc *mapstructure.DecoderConfig) {
+		dc.Metadata = &metadata
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	config.Type = nodeType
+	config.Logger = logger
+	config.Loggers = loggers
+	if config.Memory {
+		config.NodeDatabaseURL = fmt.Sprintf("file:node%d.db?mode=memory&cache=shared&_secure_delete=true", config.Port)
+		config.GraphDatabaseURL = fmt.Sprintf("file:graph%d.db?mode=memory&cache=shared&_secure_delete=true", config.Port)
+		for name, ns := range config.Namespaces {
+			ns.GraphDatabaseURL = fmt.Sprintf("file:graph%d-%s.db?mode=memory&cache=shared&_secure_delete=true", config.Port, name)
+			config.Namespaces[name] = ns
+		}
+	}
+
+	// unknown keys are usually typos so they are reported with everything else
+	problems := []string{}
+	for _, key := range metadata.Unused {
+		problems = append(problems, key+": unknown key")
+	}
+
+	_, err = logging.ParseLevel(config.LogLevel)
+	if err != nil {
+		problems = append(problems, "log_level: "+err.Error())
+	}
+	if config.LogFormat != "" && config.LogFormat != logging.FormatText && config.LogFormat != logging.FormatJSON {
+		problems = append(problems, fmt.Sprintf("log_format: %q should be %s or %s", config.LogFormat, logging.FormatText, logging.FormatJSON))
+	}
+
+	var configErr *node.ConfigError
+	err = config.Validate()
+	if errors.As(err, &configErr) {
+		problems = append(problems, configErr.Problems...)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return nil, &node.ConfigError{Problems: problems}
+	}
+
+	return config, nil
+}
+
+// startNodeConfig loads the config for a node which is about to start,
+// opening the identity store if the application API is enabled
+func startNodeConfig(cmd *cobra.Command, nodeType node.NodeType) (*nodeConfig, error) {
+	config, err := loadNodeConfig(nodeType)
+	if err != nil {
+		return nil, err
+	}
+
+	config.DatabaseKey = databaseKey()
+
+	// the level and format were checked by loadNodeConfig
+	level, _ := logging.ParseLevel(config.LogLevel)
+	loggers.SetDefaultLevel(level)
+	handler, _ := logging.NewHandler(os.Stdout, config.LogFormat)
+	loggers.SetHandler(handler)
+
+	if config.APIAddress != "" || config.BoltAddress != "" {
+		config.Identities, err = identityService(cmd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+func init() {
+	configCheckCmd.Flags().String("type", node.NodeTypePeer.String(), "Node type to check the config for: seed, peer or cache")
+	configCmd.AddCommand(configCheckCmd)
+	baseCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,42 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jdudmesh/propolis/internal/secrets"
+	"github.com/spf13/cobra"
+)
+
+var dbKeyCmd = &cobra.Command{
+	Use:   "dbkey",
+	Short: "Generate a database encryption key",
+	Long:  `Generate a random key for encrypting key material and certificates at rest. Supply it with PROPOLIS_DB_KEY or --db-key-file.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	},
+}
+
+func init() {
+	baseCmd.AddCommand(dbKeyCmd)
+}
@@ -0,0 +1,296 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/bloom"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/logging"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/jdudmesh/propolis/internal/secrets"
+	"github.com/spf13/cobra"
+)
+
+const devHost = "127.0.0.1"
+
+var devCmd = &cobra.Command{
+	Use:   "dev",
+	Short: "Tools for developing propolis",
+}
+
+var devUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Run a local network of nodes in one process",
+	Long: `Run a seed, peers and caches on the loopback interface with in memory
+databases until interrupted. The peers and caches join the seed and every
+node's log is written to stdout, prefixed with the node's name. Use the seed's
+address with --seed to publish to and query the network.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		peers, err := cmd.Flags().GetInt("peers")
+		if err != nil {
+			return fmt.Errorf("no peer count: %w", err)
+		}
+
+		caches, err := cmd.Flags().GetInt("caches")
+		if err != nil {
+			return fmt.Errorf("no cache count: %w", err)
+		}
+
+		replicate, err := cmd.Flags().GetStringArray("replicate")
+		if err != nil {
+			return fmt.Errorf("no entities to replicate: %w", err)
+		}
+
+		port, err := cmd.Flags().GetInt("base-port")
+		if err != nil {
+			return fmt.Errorf("no base port: %w", err)
+		}
+
+		if peers < 0 || caches < 0 {
+			return errors.New("--peers and --caches must not be negative")
+		}
+		if port < 1 || port+peers+caches > 65535 {
+			return fmt.Errorf("--base-port %d leaves no room for %d nodes", port, 1+peers+caches)
+		}
+
+		level, err := logging.ParseLevel(cmd.Flag("log-level").Value.String())
+		if err != nil {
+			return fmt.Errorf("log level: %w", err)
+		}
+		loggers.SetDefaultLevel(level)
+
+		// the databases only live as long as the process so the key is thrown
+		// away with them
+		key := make([]byte, secrets.KeySize)
+		_, err = rand.Read(key)
+		if err != nil {
+			return fmt.Errorf("generating database key: %w", err)
+		}
+
+		network := &devNetwork{
+			key:  func(ctx context.Context) ([]byte, error) { return key, nil },
+			done: make(chan error, 1+peers+caches),
+		}
+		defer network.Close()
+
+		seedAddr := net.JoinHostPort(devHost, strconv.Itoa(port))
+		err = network.start(cmd.Context(), "seed", node.NodeTypeSeed, port, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		// nodes which can't reach the seed when they start never join
+		err = waitForListener(cmd.Context(), seedAddr, 10*time.Second)
+		if err != nil {
+			return fmt.Errorf("waiting for seed: %w", err)
+		}
+
+		for i := 1; i <= peers; i++ {
+			port++
+			err = network.start(cmd.Context(), fmt.Sprintf("peer%d", i), node.NodeTypePeer, port, []string{seedAddr}, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := 1; i <= caches; i++ {
+			port++
+			err = network.start(cmd.Context(), fmt.Sprintf("cache%d", i), node.NodeTypeCache, port, []string{seedAddr}, replicate)
+			if err != nil {
+				return err
+			}
+		}
+
+		network.print(os.Stderr)
+		fmt.Fprintf(os.Stderr, "\npropolis publish --seed %s \"MERGE (:Post{text:'hello'})\"\n", seedAddr)
+		fmt.Fprintf(os.Stderr, "propolis query --seed %s \"MATCH (p:Post)\"\n\n", seedAddr)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		select {
+		case s := <-signals:
+			logger.Info("stopping network", "signal", s)
+			return nil
+		case err = <-network.done:
+			return err
+		}
+	},
+}
+
+// devNode is a node running in a dev network
+type devNode struct {
+	name     string
+	nodeType node.NodeType
+	addr     string
+	node     runningNode
+}
+
+// devNetwork runs nodes in this process and stops them together
+type devNetwork struct {
+	key   secrets.KeyProvider
+	nodes []*devNode
+	wg    sync.WaitGroup
+	done  chan error
+}
+
+// start creates a node with in memory databases, subscribed to the given
+// entities, and runs it, reporting an error on done if it stops by itself
+func (d *devNetwork) start(ctx context.Context, name string, nodeType node.NodeType, port int, seeds, subscriptions []string) error {
+	config := node.Config{
+		Config: graph.Config{
+			Logger:           devLogger(name),
+			GraphDatabaseURL: fmt.Sprintf("file:dev-%s-graph.db?mode=memory&cache=shared&_secure_delete=true", name),
+		},
+		Type:            nodeType,
+		Host:            devHost,
+		Port:            port,
+		Seeds:           seeds,
+		NodeDatabaseURL: fmt.Sprintf("file:dev-%s-node.db?mode=memory&cache=shared&_secure_delete=true", name),
+		EnableTCP:       true,
+		DatabaseKey:     d.key,
+	}
+
+	err := config.Validate()
+	if err != nil {
+		return fmt.Errorf("configuring %s: %w", name, err)
+	}
+
+	h, err := node.New(config, bloom.New())
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", name, err)
+	}
+
+	if len(subscriptions) > 0 {
+		h.Subscribe(subscriptions...)
+	}
+
+	n := &devNode{
+		name:     name,
+		nodeType: nodeType,
+		addr:     net.JoinHostPort(devHost, strconv.Itoa(port)),
+		node:     h,
+	}
+	d.nodes = append(d.nodes, n)
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		err := h.Run(ctx)
+		if err != nil {
+			d.done <- fmt.Errorf("running %s: %w", name, err)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops the nodes, the seed last, and waits for them to finish
+func (d *devNetwork) Close() error {
+	errs := []error{}
+	for i := len(d.nodes) - 1; i >= 0; i-- {
+		err := d.nodes[i].node.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %w", d.nodes[i].name, err))
+		}
+	}
+	d.wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (d *devNetwork) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tADDRESS")
+	for _, n := range d.nodes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", n.name, n.nodeType, n.addr)
+	}
+	tw.Flush()
+}
+
+// devLogger logs to stdout at the command's level with each line prefixed by
+// the node's name
+func devLogger(name string) *slog.Logger {
+	w := &prefixWriter{prefix: []byte(fmt.Sprintf("%-8s| ", name)), w: os.Stdout}
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: loggers}))
+}
+
+// prefixWriter prefixes each write, which slog makes one per record
+type prefixWriter struct {
+	prefix []byte
+	w      io.Writer
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	line := make([]byte, 0, len(p.prefix)+len(data))
+	line = append(line, p.prefix...)
+	line = append(line, data...)
+
+	_, err := p.w.Write(line)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// waitForListener waits until a node's TCP listener completes a TLS handshake.
+// Nodes use self signed certificates so the certificate isn't verified.
+func waitForListener(ctx context.Context, addr string, timeout time.Duration) error {
+	ctx, cancelFn := context.WithTimeout(ctx, timeout)
+	defer cancelFn()
+
+	dialer := tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true}}
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func init() {
+	devUpCmd.Flags().Int("peers", 3, "Number of peers to run")
+	devUpCmd.Flags().Int("caches", 1, "Number of caches to run")
+	devUpCmd.Flags().StringArray("replicate", []string{}, "Entity ID for the caches to replicate and serve to peers")
+	devUpCmd.Flags().Int("base-port", 9400, "Port for the seed, the other nodes use the ports after it")
+	devCmd.AddCommand(devUpCmd)
+	baseCmd.AddCommand(devCmd)
+}
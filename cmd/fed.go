@@ -17,81 +17,103 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jdudmesh/propolis/internal/activitypub"
+	"github.com/jdudmesh/propolis/pkg/client"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var fedCmd = &cobra.Command{
 	Use:   "fed",
 	Short: "Propolis ActivityPub integration",
-	Long:  `Run an ActivityPub server`,
-	Run: func(cmd *cobra.Command, args []string) {
-		// host, err := cmd.Flags().GetString("host")
-		// if err != nil {
-		// 	panic(err)
-		// }
-
-		// port, err := cmd.Flags().GetInt("port")
-		// if err != nil {
-		// 	panic(err)
-		// }
-
-		// migrationsDir, err := cmd.Flags().GetString("migrations")
-		// if err != nil {
-		// 	panic(err)
-		// }
-
-		// dbConn, err := cmd.Flags().GetString("db")
-		// if err != nil {
-		// 	panic(err)
-		// }
-
-		// stateStore, err := datastore.NewInternalState(dbConn, migrationsDir, []string{}, []string{})
-		// if err != nil {
-		// 	logger.Error("store init", "error", err)
-		// 	panic("unable to init state store")
-		// }
-
-		// h, err := activitypub.NewServer(host, port, stateStore, logger)
-		// if err != nil {
-		// 	logger.Error("creating peer", "error", err)
-		// 	return
-		// }
-
-		// ctx, cancelFn := context.WithCancelCause(context.Background())
-		// defer cancelFn(errors.New("deferred"))
-
-		// wg := sync.WaitGroup{}
-		// wg.Add(1)
-		// go func() {
-		// 	defer wg.Done()
-		// 	err := h.Run(ctx)
-		// 	if err != nil {
-		// 		logger.Error("starting ActivityPub node", "error", err)
-		// 		panic("unable to start node")
-		// 	}
-		// }()
-
-		// go func() {
-		// 	sigint := make(chan os.Signal, 1)
-		// 	signal.Notify(sigint, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-		// 	for s := range sigint {
-		// 		switch s {
-		// 		case syscall.SIGHUP:
-		// 			logger.Info("sighup: reloading")
-		// 			err := h.Reload()
-		// 			if err != nil {
-		// 				logger.Error("reloading", "error", err)
-		// 			}
-		// 		case syscall.SIGINT, syscall.SIGTERM:
-		// 			cancelFn(errors.New("received term signal, exiting"))
-		// 		}
-		// 	}
-		// }()
-
-		// wg.Wait()
+	Long: `Run an ActivityPub server so fediverse servers can discover local identities.
+Serves webfinger for acct:user@domain, where domain is the host of --url, and
+an actor document for each identity at <url>/user/<username>.
+
+With --seed, Post nodes the local identities publish to the network are added
+to their outboxes and delivered to their followers' inboxes, signed with the
+identity's key. Follows are recorded in the graph as
+(:Identity)-[:FOLLOWS]->(:Identity) relations, and decide who receives posts.
+SIGHUP reloads.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		baseURL, err := cmd.Flags().GetString("url")
+		if err != nil {
+			return fmt.Errorf("no url: %w", err)
+		}
+		if baseURL == "" {
+			return errors.New("no url: set the public url of the server with --url")
+		}
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		databaseURL, err := cmd.Flags().GetString("fdb")
+		if err != nil {
+			return fmt.Errorf("no fed db: %w", err)
+		}
+
+		db, err := activitypub.NewStore(databaseURL)
+		if err != nil {
+			return fmt.Errorf("opening fed store: %w", err)
+		}
+		defer db.Close()
+
+		ctx, cancelFn := context.WithCancel(context.Background())
+		defer cancelFn()
+
+		var network activitypub.Network
+		if seeds := viper.GetStringSlice("seeds"); len(seeds) > 0 {
+			c, err := client.Options{Logger: logger}.Connect(ctx, seeds...)
+			if err != nil {
+				return fmt.Errorf("connecting to network: %w", err)
+			}
+			defer c.Close()
+			network = c
+		} else {
+			logger.Warn("no seeds, posts won't be published to the fediverse")
+		}
+
+		h, err := activitypub.NewServer(viper.GetString("host"), viper.GetInt("port"), baseURL, svc, db, network, logger)
+		if err != nil {
+			return fmt.Errorf("creating activitypub server: %w", err)
+		}
+
+		go func() {
+			sigint := make(chan os.Signal, 1)
+			signal.Notify(sigint, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+			for s := range sigint {
+				switch s {
+				case syscall.SIGHUP:
+					logger.Info("sighup: reloading")
+					err := h.Reload()
+					if err != nil {
+						logger.Error("reloading", "error", err)
+					}
+				case syscall.SIGINT, syscall.SIGTERM:
+					logger.Info("received term signal, exiting")
+					cancelFn()
+				}
+			}
+		}()
+
+		return h.Run(ctx)
 	},
 }
 
 func init() {
 	baseCmd.AddCommand(fedCmd)
+	fedCmd.Flags().String("url", "", "Public URL of the server e.g. https://example.com")
+	fedCmd.Flags().String("fdb", "file:./data/fed.db?mode=rwc&_secure_delete=true", "ActivityPub DB connection string")
+	keystoreFlags(fedCmd.Flags())
 }
@@ -0,0 +1,752 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/logging"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/jdudmesh/propolis/internal/secrets"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// EnvPassphrase is the environment variable holding the passphrase for
+// identity bundles if --passphrase-file isn't given
+const EnvPassphrase = "PROPOLIS_PASSPHRASE"
+
+// EnvKeystorePassphrase is the environment variable holding the passphrase
+// which unlocks the identity keystore
+const EnvKeystorePassphrase = "PROPOLIS_KEYSTORE_PASSPHRASE"
+
+const keychainService = "propolis"
+
+type identityManager interface {
+	GetPrimaryIdentity() (*identity.Identity, error)
+	GetIdentity(identifier string) (*identity.Identity, error)
+	ListIdentities() ([]*identity.Identity, error)
+	SetPrimaryIdentity(identifier string) error
+	UpdateProfile(identifier, handle, bio string, publish func(id *identity.Identity) error) (*identity.Identity, error)
+	ExportIdentity(identifier string, passphrase []byte) ([]byte, error)
+	ImportIdentity(data, passphrase []byte, isPrimary bool) (*identity.Identity, error)
+	CreateIdentity(handle, bio string, isPrimary bool) (*identity.Identity, error)
+	CreateIdentityWithSigner(handle, bio string, isPrimary bool, signerURI string) (*identity.Identity, error)
+	Delegate(id *identity.Identity, publicKey ed25519.PublicKey, labels, entities []string, ttl time.Duration) (*identity.Delegation, error)
+	Invite(id *identity.Identity, nodeKey ed25519.PublicKey, ttl time.Duration) (*identity.Invitation, error)
+	SetPassphrase(passphrase []byte) error
+	SetUnlocker(unlocker secrets.PassphraseProvider)
+}
+
+var identityCmd = &cobra.Command{
+	Use:   "identity",
+	Short: "Manage local identities",
+	Long:  `Create, list and publish identities, and export and import them so they can be moved between machines`,
+}
+
+var identityCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a new identity",
+	Long: `Create a new identity. With --signer the private key stays in an external signer:
+  ssh-agent:               the agent at $SSH_AUTH_SOCK (first ed25519 key)
+  ssh-agent:/path/to/sock  a specific agent, e.g. yubikey-agent
+  https://kms/keys/abc     a remote signing service`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		handle, err := cmd.Flags().GetString("handle")
+		if err != nil {
+			return fmt.Errorf("no handle: %w", err)
+		}
+
+		bio, err := cmd.Flags().GetString("bio")
+		if err != nil {
+			return fmt.Errorf("no bio: %w", err)
+		}
+
+		isPrimary, err := cmd.Flags().GetBool("primary")
+		if err != nil {
+			return fmt.Errorf("no primary flag: %w", err)
+		}
+
+		signerURI, err := cmd.Flags().GetString("signer")
+		if err != nil {
+			return fmt.Errorf("no signer: %w", err)
+		}
+
+		var id *identity.Identity
+		if signerURI == "" {
+			id, err = svc.CreateIdentity(handle, bio, isPrimary)
+		} else {
+			id, err = svc.CreateIdentityWithSigner(handle, bio, isPrimary, signerURI)
+		}
+		if err != nil {
+			return fmt.Errorf("creating identity: %w", err)
+		}
+
+		fmt.Printf("created %s (%s)\nfingerprint %s\n", id.Identifier, id.Handle, id.Fingerprint())
+		return nil
+	},
+}
+
+var identityListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List local identities",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		ids, err := svc.ListIdentities()
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "PRIMARY\tID\tHANDLE\tCREATED\tFINGERPRINT")
+		for _, id := range ids {
+			primary := ""
+			if id.IsPrimary {
+				primary = "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", primary, id.Identifier, id.Handle, id.CreatedAt.Format(time.DateTime), id.Fingerprint())
+		}
+		return tw.Flush()
+	},
+}
+
+var identityShowCmd = &cobra.Command{
+	Use:   "show [id]",
+	Short: "Show an identity and its fingerprint (default is the primary identity)",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		var id *identity.Identity
+		if len(args) == 0 {
+			id, err = svc.GetPrimaryIdentity()
+		} else {
+			id, err = svc.GetIdentity(args[0])
+		}
+		if err != nil {
+			return fmt.Errorf("fetching identity: %w", err)
+		}
+
+		cert, err := x509.ParseCertificate(id.CertificateData)
+		if err != nil {
+			return fmt.Errorf("parsing certificate: %w", err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "ID\t%s\n", id.Identifier)
+		fmt.Fprintf(tw, "Handle\t%s\n", id.Handle)
+		fmt.Fprintf(tw, "Bio\t%s\n", id.Bio)
+		fmt.Fprintf(tw, "Primary\t%t\n", id.IsPrimary)
+		fmt.Fprintf(tw, "Created\t%s\n", id.CreatedAt.Format(time.DateTime))
+		fmt.Fprintf(tw, "Valid\t%s to %s\n", cert.NotBefore.Format(time.DateTime), cert.NotAfter.Format(time.DateTime))
+		fmt.Fprintf(tw, "Serial\t%s\n", cert.SerialNumber)
+		fmt.Fprintf(tw, "Fingerprint\t%s\n", id.Fingerprint())
+		for _, key := range id.Keys {
+			if key.Type == identity.KeyTypeSignerURI {
+				fmt.Fprintf(tw, "Signer\t%s\n", key.Data)
+			}
+		}
+		err = tw.Flush()
+		if err != nil {
+			return err
+		}
+
+		showPEM, err := cmd.Flags().GetBool("pem")
+		if err != nil {
+			return fmt.Errorf("no pem: %w", err)
+		}
+		if showPEM {
+			return pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE", Bytes: id.CertificateData})
+		}
+		return nil
+	},
+}
+
+var identityPrimaryCmd = &cobra.Command{
+	Use:   "primary <id>",
+	Short: "Make an identity the primary identity",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		err = svc.SetPrimaryIdentity(args[0])
+		if err != nil {
+			return fmt.Errorf("setting primary identity: %w", err)
+		}
+
+		fmt.Printf("%s is now the primary identity\n", args[0])
+		return nil
+	},
+}
+
+var identityPublishCmd = &cobra.Command{
+	Use:   "publish",
+	Short: "Publish an identity's handle, bio and certificate to the network",
+	Long: `Publish an identity's record, signed by the identity, so that nodes can verify
+its actions without asking other nodes for its certificate. Publishes through a
+local node's application API (--api) or a network's peers (--seed).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		identifier, err := cmd.Flags().GetString("id")
+		if err != nil {
+			return fmt.Errorf("no id: %w", err)
+		}
+
+		var id *identity.Identity
+		if identifier == "" {
+			id, err = svc.GetPrimaryIdentity()
+		} else {
+			id, err = svc.GetIdentity(identifier)
+		}
+		if err != nil {
+			return fmt.Errorf("fetching identity: %w", err)
+		}
+
+		stmt, err := node.IdentityStatement(id)
+		if err != nil {
+			return err
+		}
+
+		backend, err := connectBackendAs(cmd, id.Identifier)
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+
+		actionID, err := backend.Publish(cmd.Context(), stmt)
+		if err != nil {
+			return fmt.Errorf("publishing identity: %w", err)
+		}
+
+		fmt.Printf("published %s (%s) as %s\n", id.Identifier, id.Handle, actionID)
+		return nil
+	},
+}
+
+var identityUpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Change an identity's handle or bio and publish them to the network",
+	Long: `Change an identity's handle or bio, leaving whichever isn't given as it is, and
+publish the identity's record again. Nodes keep the latest profile an identity
+publishes whatever order updates reach them in. If publishing fails the change
+is kept and identity publish sends it again. Publishes through a local node's
+application API (--api) or a network's peers (--seed).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		identifier, err := cmd.Flags().GetString("id")
+		if err != nil {
+			return fmt.Errorf("no id: %w", err)
+		}
+
+		var id *identity.Identity
+		if identifier == "" {
+			id, err = svc.GetPrimaryIdentity()
+		} else {
+			id, err = svc.GetIdentity(identifier)
+		}
+		if err != nil {
+			return fmt.Errorf("fetching identity: %w", err)
+		}
+
+		handle, bio := id.Handle, id.Bio
+		if cmd.Flags().Changed("handle") {
+			handle, _ = cmd.Flags().GetString("handle")
+		}
+		if cmd.Flags().Changed("bio") {
+			bio, _ = cmd.Flags().GetString("bio")
+		}
+		if handle == "" {
+			return errors.New("an identity needs a handle")
+		}
+
+		// the statement is checked before anything is changed
+		updated := *id
+		updated.Handle, updated.Bio = handle, bio
+		_, err = node.IdentityStatement(&updated)
+		if err != nil {
+			return err
+		}
+
+		backend, err := connectBackendAs(cmd, id.Identifier)
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+
+		var actionID string
+		id, err = svc.UpdateProfile(id.Identifier, handle, bio, func(id *identity.Identity) error {
+			stmt, err := node.IdentityStatement(id)
+			if err != nil {
+				return err
+			}
+			actionID, err = backend.Publish(cmd.Context(), stmt)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("updated %s (%s) as %s\n", id.Identifier, id.Handle, actionID)
+		return nil
+	},
+}
+
+var identityExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export an identity to a passphrase protected bundle",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		identifier, err := cmd.Flags().GetString("id")
+		if err != nil {
+			return fmt.Errorf("no id: %w", err)
+		}
+
+		if identifier == "" {
+			id, err := svc.GetPrimaryIdentity()
+			if err != nil {
+				return err
+			}
+			identifier = id.Identifier
+		}
+
+		passphrase, err := bundlePassphrase(cmd)
+		if err != nil {
+			return err
+		}
+
+		data, err := svc.ExportIdentity(identifier, passphrase)
+		if err != nil {
+			return fmt.Errorf("exporting identity: %w", err)
+		}
+
+		out, err := cmd.Flags().GetString("out")
+		if err != nil {
+			return fmt.Errorf("no output file: %w", err)
+		}
+
+		if out == "" || out == "-" {
+			_, err = os.Stdout.Write(append(data, '\n'))
+			return err
+		}
+
+		return os.WriteFile(out, data, 0600)
+	},
+}
+
+var identityDelegateCmd = &cobra.Command{
+	Use:   "delegate",
+	Short: "Authorize another key to publish for an identity",
+	Long: `Mint a short-lived token authorizing another key, e.g. a bot or mobile device,
+to publish statements for an identity which only touch the given labels or
+entities. Without --key a new key pair is generated and its private key printed
+along with the token.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		identifier, err := cmd.Flags().GetString("id")
+		if err != nil {
+			return fmt.Errorf("no id: %w", err)
+		}
+
+		var id *identity.Identity
+		if identifier == "" {
+			id, err = svc.GetPrimaryIdentity()
+		} else {
+			id, err = svc.GetIdentity(identifier)
+		}
+		if err != nil {
+			return fmt.Errorf("fetching identity: %w", err)
+		}
+
+		key, err := cmd.Flags().GetString("key")
+		if err != nil {
+			return fmt.Errorf("no key: %w", err)
+		}
+
+		labels, err := cmd.Flags().GetStringArray("label")
+		if err != nil {
+			return fmt.Errorf("no labels: %w", err)
+		}
+
+		entities, err := cmd.Flags().GetStringArray("entity")
+		if err != nil {
+			return fmt.Errorf("no entities: %w", err)
+		}
+
+		ttl, err := cmd.Flags().GetDuration("ttl")
+		if err != nil {
+			return fmt.Errorf("no ttl: %w", err)
+		}
+
+		var publicKey ed25519.PublicKey
+		var privateKey ed25519.PrivateKey
+		if key == "" {
+			publicKey, privateKey, err = ed25519.GenerateKey(nil)
+			if err != nil {
+				return fmt.Errorf("generating key: %w", err)
+			}
+		} else {
+			publicKey, err = base64.StdEncoding.DecodeString(key)
+			if err != nil || len(publicKey) != ed25519.PublicKeySize {
+				return errors.New("key must be a base64 encoded ed25519 public key")
+			}
+		}
+
+		d, err := svc.Delegate(id, publicKey, labels, entities, ttl)
+		if err != nil {
+			return fmt.Errorf("delegating: %w", err)
+		}
+
+		token, err := d.Encode()
+		if err != nil {
+			return err
+		}
+
+		if privateKey != nil {
+			fmt.Printf("key %s\n", base64.StdEncoding.EncodeToString(privateKey.Seed()))
+		}
+		fmt.Printf("token %s\nexpires %s\n", token, d.ExpiresAt.Format(time.DateTime))
+		return nil
+	},
+}
+
+var identityInviteCmd = &cobra.Command{
+	Use:   "invite [node key]",
+	Short: "Invite a node to join seeds which accept the identity's invitations",
+	Long: `Mint a token inviting the node with the given key, shown as nodeKey by
+"admin status" on the node, to join seeds which list the identity's
+certificate as an inviter. The token goes in the node's invitation file.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		identifier, err := cmd.Flags().GetString("id")
+		if err != nil {
+			return fmt.Errorf("no id: %w", err)
+		}
+
+		var id *identity.Identity
+		if identifier == "" {
+			id, err = svc.GetPrimaryIdentity()
+		} else {
+			id, err = svc.GetIdentity(identifier)
+		}
+		if err != nil {
+			return fmt.Errorf("fetching identity: %w", err)
+		}
+
+		ttl, err := cmd.Flags().GetDuration("ttl")
+		if err != nil {
+			return fmt.Errorf("no ttl: %w", err)
+		}
+
+		nodeKey, err := base64.StdEncoding.DecodeString(args[0])
+		if err != nil || len(nodeKey) != ed25519.PublicKeySize {
+			return errors.New("node key must be a base64 encoded ed25519 public key")
+		}
+
+		inv, err := svc.Invite(id, nodeKey, ttl)
+		if err != nil {
+			return fmt.Errorf("inviting: %w", err)
+		}
+
+		token, err := inv.Encode()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("token %s\nexpires %s\n", token, inv.ExpiresAt.Format(time.DateTime))
+		return nil
+	},
+}
+
+var identityImportCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Import an identity from a bundle (reads stdin if no file is given)",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		var data []byte
+		if len(args) == 0 || args[0] == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(args[0])
+		}
+		if err != nil {
+			return fmt.Errorf("reading bundle: %w", err)
+		}
+
+		passphrase, err := bundlePassphrase(cmd)
+		if err != nil {
+			return err
+		}
+
+		isPrimary, err := cmd.Flags().GetBool("primary")
+		if err != nil {
+			return fmt.Errorf("no primary flag: %w", err)
+		}
+
+		id, err := svc.ImportIdentity(data, passphrase, isPrimary)
+		if err != nil {
+			return fmt.Errorf("importing identity: %w", err)
+		}
+
+		fmt.Printf("imported %s (%s)\nfingerprint %s\n", id.Identifier, id.Handle, id.Fingerprint())
+		return nil
+	},
+}
+
+var identityPassphraseCmd = &cobra.Command{
+	Use:   "passphrase",
+	Short: "Protect private keys with a passphrase",
+	Long:  `Set, change or remove the passphrase protecting private keys. If one is already set the keystore is unlocked first (see --keystore-passphrase-file and --keychain).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		svc, err := identityService(cmd)
+		if err != nil {
+			return err
+		}
+
+		remove, err := cmd.Flags().GetBool("remove")
+		if err != nil {
+			return fmt.Errorf("no remove flag: %w", err)
+		}
+
+		newPassphraseFile, err := cmd.Flags().GetString("new-passphrase-file")
+		if err != nil {
+			return fmt.Errorf("no new passphrase file: %w", err)
+		}
+
+		var passphrase []byte
+		switch {
+		case remove:
+		case newPassphraseFile != "":
+			passphrase, err = secrets.FilePassphrase(newPassphraseFile)(cmd.Context())
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("use --new-passphrase-file or --remove")
+		}
+
+		err = svc.SetPassphrase(passphrase)
+		if err != nil {
+			return fmt.Errorf("setting passphrase: %w", err)
+		}
+
+		return nil
+	},
+}
+
+// keystoreUnlocker returns where the keystore passphrase comes from: a file,
+// the OS keychain or the environment
+func keystoreUnlocker(cmd *cobra.Command) (secrets.PassphraseProvider, error) {
+	passphraseFile, err := cmd.Flags().GetString("keystore-passphrase-file")
+	if err != nil {
+		return nil, fmt.Errorf("no keystore passphrase file: %w", err)
+	}
+
+	useKeychain, err := cmd.Flags().GetBool("keychain")
+	if err != nil {
+		return nil, fmt.Errorf("no keychain flag: %w", err)
+	}
+
+	switch {
+	case passphraseFile != "":
+		return secrets.FilePassphrase(passphraseFile), nil
+	case useKeychain:
+		return secrets.KeychainPassphrase(keychainService, "keystore"), nil
+	default:
+		return secrets.EnvPassphrase(EnvKeystorePassphrase), nil
+	}
+}
+
+// keystoreFlags adds the flags read by keystoreUnlocker to commands which
+// open the identity store
+func keystoreFlags(flags *pflag.FlagSet) {
+	flags.String("keystore-passphrase-file", "", "File holding the keystore passphrase (default is $"+EnvKeystorePassphrase+")")
+	flags.Bool("keychain", false, "Read the keystore passphrase from the OS keychain (service "+keychainService+", account keystore)")
+}
+
+// identityService opens the identity store, encrypting key material with the
+// database key if there is one
+func identityService(cmd *cobra.Command) (identityManager, error) {
+	databaseURL := viper.GetString("identity_db")
+	if databaseURL == "" {
+		return nil, errors.New("no identity db: set identity_db or use --idb")
+	}
+
+	keyProvider := databaseKey()
+	if keyProvider == nil {
+		keyProvider = secrets.EnvKeyProvider(secrets.EnvKey)
+	}
+
+	sealer, err := secrets.FromProvider(context.Background(), keyProvider)
+	if err != nil {
+		return nil, fmt.Errorf("creating sealer: %w", err)
+	}
+
+	store, err := identity.NewStoreWithSealer(databaseURL, sealer)
+	if err != nil {
+		return nil, fmt.Errorf("opening identity store: %w", err)
+	}
+
+	unlocker, err := keystoreUnlocker(cmd)
+	if err != nil {
+		return nil, err
+	}
+	store.SetUnlocker(unlocker)
+
+	svc, err := identity.NewService(store)
+	if err != nil {
+		return nil, err
+	}
+	svc.SetLogger(loggers.Logger(logging.ModuleIdentity))
+	return svc, nil
+}
+
+func bundlePassphrase(cmd *cobra.Command) ([]byte, error) {
+	passphraseFile, err := cmd.Flags().GetString("passphrase-file")
+	if err != nil {
+		return nil, fmt.Errorf("no passphrase file: %w", err)
+	}
+
+	passphrase := os.Getenv(EnvPassphrase)
+	if passphraseFile != "" {
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase file: %w", err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+
+	if passphrase == "" {
+		return nil, fmt.Errorf("no passphrase: use --passphrase-file or set %s", EnvPassphrase)
+	}
+
+	return []byte(passphrase), nil
+}
+
+func init() {
+	identityCmd.PersistentFlags().String("passphrase-file", "", "File holding the bundle passphrase (default is $"+EnvPassphrase+")")
+	keystoreFlags(identityCmd.PersistentFlags())
+	identityPassphraseCmd.Flags().String("new-passphrase-file", "", "File holding the new keystore passphrase")
+	identityPassphraseCmd.Flags().Bool("remove", false, "Remove the keystore passphrase")
+	identityCreateCmd.Flags().String("handle", "", "Handle for the identity")
+	identityCreateCmd.Flags().String("bio", "", "Bio for the identity")
+	identityCreateCmd.Flags().Bool("primary", true, "Make the new identity the primary identity")
+	identityCreateCmd.Flags().String("signer", "", "URI of an external signer holding the private key")
+	identityExportCmd.Flags().String("id", "", "Identity to export (default is the primary identity)")
+	identityPublishCmd.Flags().String("id", "", "Identity to publish (default is the primary identity)")
+	identityUpdateCmd.Flags().String("id", "", "Identity to update (default is the primary identity)")
+	identityUpdateCmd.Flags().String("handle", "", "New handle for the identity")
+	identityUpdateCmd.Flags().String("bio", "", "New bio for the identity")
+	identityDelegateCmd.Flags().String("id", "", "Identity to delegate for (default is the primary identity)")
+	identityDelegateCmd.Flags().String("key", "", "Base64 encoded ed25519 public key to delegate to (default is a new key)")
+	identityDelegateCmd.Flags().StringArray("label", nil, "Label the key may publish statements on (repeatable)")
+	identityDelegateCmd.Flags().StringArray("entity", nil, "Entity ID the key may publish statements on (repeatable)")
+	identityDelegateCmd.Flags().Duration("ttl", 24*time.Hour, "How long the delegation is valid for")
+	identityInviteCmd.Flags().String("id", "", "Identity to invite as (default is the primary identity)")
+	identityInviteCmd.Flags().Duration("ttl", 7*24*time.Hour, "How long the invitation is valid for")
+	identityShowCmd.Flags().Bool("pem", false, "Print the identity's certificate, e.g. for a seed's inviters")
+	identityExportCmd.Flags().StringP("out", "o", "", "File to write the bundle to (default is stdout)")
+	identityImportCmd.Flags().Bool("primary", true, "Make the imported identity the primary identity")
+
+	identityCmd.AddCommand(identityCreateCmd)
+	identityCmd.AddCommand(identityListCmd)
+	identityCmd.AddCommand(identityShowCmd)
+	identityCmd.AddCommand(identityPrimaryCmd)
+	identityCmd.AddCommand(identityPublishCmd)
+	identityCmd.AddCommand(identityUpdateCmd)
+	identityCmd.AddCommand(identityDelegateCmd)
+	identityCmd.AddCommand(identityInviteCmd)
+	identityCmd.AddCommand(identityExportCmd)
+	identityCmd.AddCommand(identityImportCmd)
+	identityCmd.AddCommand(identityPassphraseCmd)
+	baseCmd.AddCommand(identityCmd)
+}
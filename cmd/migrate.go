@@ -0,0 +1,231 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/migration"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/spf13/cobra"
+)
+
+// migrationTarget is a database the migrate commands work on
+type migrationTarget struct {
+	name       string
+	url        string
+	migrations *migration.Migrations
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Show and change the schema versions of the node's databases",
+	Long: `The node, graph (and each namespace's graph) and identity databases are
+migrated to the latest schema when a node opens them, and a node refuses to
+open one migrated by a later version of propolis or left part way by a failed
+migration. Before going back to an earlier version, migrate its databases down
+to the versions it knows with this one. Stop the node first.
+
+The databases are named node, graph, graph:<namespace> and identity.`,
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status [database]",
+	Short: "Show the schema version of each database, or just the one given",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		targets, err := migrationTargets(args)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "DATABASE\tVERSION\tLATEST\tSTATE")
+		for _, target := range targets {
+			err = withMigrationTarget(target, func(db *sql.DB) error {
+				status, err := target.migrations.Status(db)
+				if err != nil {
+					return err
+				}
+				state := "ok"
+				switch {
+				case status.Dirty:
+					state = "dirty"
+				case status.Version > status.Latest:
+					state = "too new"
+				case status.Version < status.Latest:
+					state = "behind"
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", target.name, status.Version, status.Latest, state)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return tw.Flush()
+	},
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up [database]",
+	Short: "Migrate each database, or just the one given, to the latest schema",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		targets, err := migrationTargets(args)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			err = withMigrationTarget(target, target.migrations.Up)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s migrated\n", target.name)
+		}
+		return nil
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down database version",
+	Short: "Migrate a database down to an earlier schema version, 0 to remove it",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		version, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid version %q: %w", args[1], err)
+		}
+		targets, err := migrationTargets(args[:1])
+		if err != nil {
+			return err
+		}
+		target := targets[0]
+
+		return withMigrationTarget(target, func(db *sql.DB) error {
+			status, err := target.migrations.Status(db)
+			if err != nil {
+				return err
+			}
+			if uint(version) > status.Version {
+				return fmt.Errorf("%s is at version %d, use migrate up to go forward", target.name, status.Version)
+			}
+			err = target.migrations.Migrate(db, uint(version))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s migrated from version %d to %d\n", target.name, status.Version, version)
+			return nil
+		})
+	},
+}
+
+var migrateForceCmd = &cobra.Command{
+	Use:   "force database version",
+	Short: "Record a database's schema version without migrating it",
+	Long: `Record a database's schema version without running any migrations, to clear
+the dirty state a failed migration leaves once the schema has been repaired by
+hand to match the version.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		version, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid version %q: %w", args[1], err)
+		}
+		targets, err := migrationTargets(args[:1])
+		if err != nil {
+			return err
+		}
+		target := targets[0]
+
+		return withMigrationTarget(target, func(db *sql.DB) error {
+			return target.migrations.Force(db, uint(version))
+		})
+	},
+}
+
+// migrationTargets are the databases in the config, or the one named
+func migrationTargets(names []string) ([]migrationTarget, error) {
+	config, err := loadNodeConfig(node.NodeTypePeer)
+	if err != nil {
+		return nil, err
+	}
+	if config.Memory {
+		return nil, errors.New("the node's databases are in memory, they are migrated when it starts")
+	}
+
+	targets := []migrationTarget{}
+	if config.NodeDatabaseURL != node.MemoryDatabaseURL {
+		targets = append(targets, migrationTarget{"node", config.NodeDatabaseURL, node.Migrations})
+	}
+	targets = append(targets, migrationTarget{"graph", config.GraphDatabaseURL, graph.Migrations})
+	namespaces := []string{}
+	for name := range config.Namespaces {
+		namespaces = append(namespaces, name)
+	}
+	slices.Sort(namespaces)
+	for _, name := range namespaces {
+		targets = append(targets, migrationTarget{"graph:" + name, config.Namespaces[name].GraphDatabaseURL, graph.Migrations})
+	}
+	if config.IdentityDatabaseURL != "" {
+		targets = append(targets, migrationTarget{"identity", config.IdentityDatabaseURL, identity.Migrations})
+	}
+
+	if len(names) == 0 {
+		return targets, nil
+	}
+	for _, target := range targets {
+		if target.name == names[0] {
+			return []migrationTarget{target}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown database %q", names[0])
+}
+
+// withMigrationTarget opens the target's database and calls fn with it
+func withMigrationTarget(target migrationTarget, fn func(db *sql.DB) error) error {
+	db, err := sql.Open("sqlite3", target.url)
+	if err != nil {
+		return fmt.Errorf("opening %s database: %w", target.name, err)
+	}
+	defer db.Close()
+	return fn(db)
+}
+
+func init() {
+	migrateCmd.AddCommand(migrateStatusCmd)
+	migrateCmd.AddCommand(migrateUpCmd)
+	migrateCmd.AddCommand(migrateDownCmd)
+	migrateCmd.AddCommand(migrateForceCmd)
+	baseCmd.AddCommand(migrateCmd)
+}
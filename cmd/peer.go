@@ -18,13 +18,8 @@ package cmd
 
 import (
 	"fmt"
-	"os"
-	"os/signal"
-	"sync"
-	"syscall"
 
 	"github.com/jdudmesh/propolis/internal/bloom"
-	"github.com/jdudmesh/propolis/internal/graph"
 	"github.com/jdudmesh/propolis/internal/node"
 	"github.com/spf13/cobra"
 )
@@ -32,87 +27,23 @@ import (
 var peerCmd = &cobra.Command{
 	Use:   "peer",
 	Short: "Propolis peer server",
-	Long:  `Run propolis in peer mode`,
+	Long: `Run propolis in peer mode. SIGHUP reloads the log level, moderation
+policies, quotas, statement limits and seeds from the config file.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		host, err := cmd.Flags().GetString("host")
-		if err != nil {
-			return fmt.Errorf("no host: %w", err)
-		}
+		cmd.SilenceUsage = true
 
-		port, err := cmd.Flags().GetInt("port")
-		if err != nil {
-			return fmt.Errorf("no port: %w", err)
-		}
-
-		isMemory, err := cmd.Flags().GetBool("mem")
-		if err != nil {
-			return fmt.Errorf("no memory flag: %w", err)
-		}
-
-		var nodeDatabaseURL, graphDatabaseURL string
-		if isMemory {
-			nodeDatabaseURL = fmt.Sprintf("file:node%d.db?mode=memory&cache=shared&_secure_delete=true", port)
-			graphDatabaseURL = fmt.Sprintf("file:graph%d.db?mode=memory&cache=shared&_secure_delete=true", port)
-		} else {
-			nodeDatabaseURL, err = cmd.Flags().GetString("ndb")
-			if err != nil {
-				return fmt.Errorf("no db: %w", err)
-			}
-			graphDatabaseURL, err = cmd.Flags().GetString("gdb")
+		return runNode(cmd, node.NodeTypePeer, func(config *nodeConfig) (runningNode, error) {
+			h, err := node.New(config.Config, bloom.New())
 			if err != nil {
-				return fmt.Errorf("no db: %w", err)
+				return nil, fmt.Errorf("creating peer: %w", err)
 			}
-		}
-
-		seeds, err := cmd.Flags().GetStringArray("seed")
-		if err != nil {
-			return fmt.Errorf("no seeds specified: %w", err)
-		}
-
-		config := node.Config{
-			Config: graph.Config{
-				Logger:           logger,
-				GraphDatabaseURL: graphDatabaseURL,
-			},
-			Type:            node.NodeTypePeer,
-			Host:            host,
-			Port:            port,
-			NodeDatabaseURL: nodeDatabaseURL,
-			Seeds:           seeds,
-		}
-
-		filter := bloom.New()
-
-		h, err := node.New(config, filter)
-		if err != nil {
-			return fmt.Errorf("creating peer: %w", err)
-		}
-
-		wg := sync.WaitGroup{}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err = h.Run()
-			if err != nil {
-				err = fmt.Errorf("starting peer: %w", err)
-			}
-		}()
-
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-		s := <-sigint
-		logger.Info("stopping server", "signal", s)
-		err = h.Close()
-		if err != nil {
-			logger.Error("shutting down main server", "error", err)
-		}
-
-		wg.Wait()
 
-		return err
+			return h, nil
+		})
 	},
 }
 
 func init() {
+	runFlags(peerCmd.Flags())
 	baseCmd.AddCommand(peerCmd)
 }
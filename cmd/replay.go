@@ -0,0 +1,165 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/spf13/cobra"
+)
+
+// errStateDiverged is returned by replay when the graphs don't match
+var errStateDiverged = errors.New("replayed graph differs from the live graph")
+
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Replay the action journal into a fresh graph and compare it with the live one",
+	Long: `Re-execute the actions in the node's journal (journal.path in the config, or
+--journal) against an empty graph and compare the result with the node's graph
+(graph_db, the namespace's graph_db with --namespace, or --graph-db). Node and
+relation IDs and timestamps are left out of the comparison as they differ
+every time, what was written and by which action must match. The entities
+found in only one of the graphs are printed and the command fails if there are
+any, which points to executor behaviour that isn't deterministic.
+
+The comparison only holds if the journal has every action the graph has seen,
+so it must have been kept since the graph was created without retention or
+checkpoints compacting it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		config, err := loadNodeConfig(node.NodeTypePeer)
+		if err != nil {
+			return err
+		}
+
+		namespace, err := cmd.Flags().GetString("namespace")
+		if err != nil {
+			return fmt.Errorf("no namespace: %w", err)
+		}
+		liveURL := config.GraphDatabaseURL
+		if namespace != "" {
+			ns, ok := config.Namespaces[namespace]
+			if !ok {
+				return fmt.Errorf("%w: %s", node.ErrUnknownNamespace, namespace)
+			}
+			liveURL = ns.GraphDatabaseURL
+		}
+		if cmd.Flags().Changed("graph-db") {
+			liveURL, _ = cmd.Flags().GetString("graph-db")
+		} else if config.Memory {
+			return errors.New("the node's graph is in memory, use --graph-db to compare with a copy of it")
+		}
+
+		if cmd.Flags().Changed("journal") {
+			config.Journal.Path, _ = cmd.Flags().GetString("journal")
+		}
+		if config.Journal.Path == "" {
+			return errors.New("no journal, set journal.path in the config or use --journal")
+		}
+
+		out, err := cmd.Flags().GetString("out")
+		if err != nil {
+			return fmt.Errorf("no out: %w", err)
+		}
+		replayURL := "file:replay.db?mode=memory&cache=shared"
+		if out != "" {
+			_, err = os.Stat(out)
+			if err == nil {
+				return fmt.Errorf("%s already exists", out)
+			}
+			replayURL = "file:" + out
+		}
+
+		limit, err := cmd.Flags().GetInt("diff")
+		if err != nil {
+			return fmt.Errorf("no diff limit: %w", err)
+		}
+
+		graphConfig := config.Config.Config
+		graphConfig.Logger = logger
+		graphConfig.GraphDatabaseURL = replayURL
+		replayed, err := graph.New(graphConfig)
+		if err != nil {
+			return fmt.Errorf("creating replay graph: %w", err)
+		}
+		defer replayed.Close()
+
+		report, err := node.ReplayJournal(config.Config, namespace, replayed)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("replayed %d actions, %d failed, %d private skipped, %d evicted\n",
+			report.Executed, report.Failed, report.Skipped, report.Evicted)
+
+		graphConfig.GraphDatabaseURL = liveURL
+		live, err := graph.New(graphConfig)
+		if err != nil {
+			return fmt.Errorf("opening live graph: %w", err)
+		}
+		defer live.Close()
+
+		liveState, err := live.State()
+		if err != nil {
+			return fmt.Errorf("reading live graph: %w", err)
+		}
+		replayState, err := replayed.State()
+		if err != nil {
+			return fmt.Errorf("reading replayed graph: %w", err)
+		}
+
+		fmt.Printf("live     %s (%d nodes, %d relations)\n", liveState.Hash, len(liveState.Nodes), len(liveState.Relations))
+		fmt.Printf("replayed %s (%d nodes, %d relations)\n", replayState.Hash, len(replayState.Nodes), len(replayState.Relations))
+		if liveState.Hash == replayState.Hash {
+			return nil
+		}
+
+		missing, extra := liveState.Diff(replayState)
+		printDiff("only in the live graph", missing, limit)
+		printDiff("only in the replayed graph", extra, limit)
+		return errStateDiverged
+	},
+}
+
+// printDiff prints up to limit of the entities, 0 for all of them
+func printDiff(title string, entities []string, limit int) {
+	if len(entities) == 0 {
+		return
+	}
+
+	fmt.Printf("\n%s (%d):\n", title, len(entities))
+	for i, e := range entities {
+		if limit > 0 && i == limit {
+			fmt.Printf("  ... %d more\n", len(entities)-limit)
+			return
+		}
+		fmt.Println("  " + e)
+	}
+}
+
+func init() {
+	replayCmd.Flags().String("journal", "", "Journal to replay, default journal.path from the config")
+	replayCmd.Flags().String("graph-db", "", "Graph database to compare with, default the node's")
+	replayCmd.Flags().String("namespace", "", "Namespace whose actions are replayed, default the default graph")
+	replayCmd.Flags().String("out", "", "File to keep the replayed graph in, default in memory")
+	replayCmd.Flags().Int("diff", 20, "Most differing entities printed from each graph, 0 for all")
+	baseCmd.AddCommand(replayCmd)
+}
@@ -0,0 +1,238 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jdudmesh/propolis/internal/logging"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// daemonEnv is set in the environment of a node started by --daemon so it
+// doesn't daemonize again
+const daemonEnv = "_PROPOLIS_DAEMONIZED"
+
+// runningNode is a node which can be run until it is closed
+type runningNode interface {
+	Run(ctx context.Context) error
+	Close() error
+	Reload(config node.Config) error
+}
+
+// runNode creates and runs a node until it stops or is interrupted or
+// terminated. SIGHUP re-reads the config and applies the settings which can
+// change while the node runs. With --daemon the command is first restarted in
+// the background.
+func runNode(cmd *cobra.Command, nodeType node.NodeType, newNode func(config *nodeConfig) (runningNode, error)) error {
+	// check the config before going into the background so problems are seen
+	config, err := loadNodeConfig(nodeType)
+	if err != nil {
+		return err
+	}
+
+	daemon, err := cmd.Flags().GetBool("daemon")
+	if err != nil {
+		return fmt.Errorf("no daemon flag: %w", err)
+	}
+	if daemon && os.Getenv(daemonEnv) == "" {
+		return daemonize(nodeType, config.LogFile)
+	}
+
+	config, err = startNodeConfig(cmd, nodeType)
+	if err != nil {
+		return err
+	}
+
+	h, err := newNode(config)
+	if err != nil {
+		return err
+	}
+
+	if config.PIDFile != "" {
+		err = writePIDFile(config.PIDFile)
+		if err != nil {
+			h.Close()
+			return err
+		}
+		defer os.Remove(config.PIDFile)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Run(cmd.Context())
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case err = <-done:
+			// the node stopped by itself so it can't be running
+			h.Close()
+			if err != nil {
+				return fmt.Errorf("running %s: %w", nodeType, err)
+			}
+			return nil
+
+		case s := <-signals:
+			if s == syscall.SIGHUP {
+				logger.Info("reloading config", "signal", s)
+				err = reloadNode(h, nodeType)
+				if err != nil {
+					logger.Error("reloading config", "error", err)
+				}
+				continue
+			}
+
+			logger.Info("stopping server", "signal", s)
+			err = h.Close()
+			if err != nil {
+				logger.Error("shutting down main server", "error", err)
+			}
+
+			err = <-done
+			if err != nil {
+				return fmt.Errorf("running %s: %w", nodeType, err)
+			}
+			return nil
+		}
+	}
+}
+
+// reloadNode re-reads the config file and passes the config to the node. The
+// running node is left as it was if the config has problems.
+func reloadNode(h runningNode, nodeType node.NodeType) error {
+	if viper.ConfigFileUsed() != "" {
+		err := viper.ReadInConfig()
+		if err != nil {
+			return fmt.Errorf("reading config file: %w", err)
+		}
+	}
+
+	config, err := loadNodeConfig(nodeType)
+	if err != nil {
+		return err
+	}
+
+	err = h.Reload(config.Config)
+	if err != nil {
+		return err
+	}
+
+	// the level was checked by loadNodeConfig
+	level, _ := logging.ParseLevel(config.LogLevel)
+	loggers.SetDefaultLevel(level)
+
+	return nil
+}
+
+// daemonize restarts the command in a new session with its output appended to
+// the log file, or discarded if there isn't one
+func daemonize(nodeType node.NodeType, logFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("finding executable: %w", err)
+	}
+
+	if logFile == "" {
+		logFile = os.DevNull
+	}
+	out, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	defer out.Close()
+
+	attr, err := detachedProcAttr()
+	if err != nil {
+		return err
+	}
+
+	child := exec.Command(exe, os.Args[1:]...)
+	child.Env = append(os.Environ(), daemonEnv+"=1")
+	child.Stdout = out
+	child.Stderr = out
+	child.SysProcAttr = attr
+
+	err = child.Start()
+	if err != nil {
+		return fmt.Errorf("starting daemon: %w", err)
+	}
+
+	fmt.Printf("%s running in the background with process ID %d\n", nodeType, child.Process.Pid)
+	return child.Process.Release()
+}
+
+// writePIDFile writes the process ID to a file, refusing to overwrite the
+// file of a process which is still running
+func writePIDFile(path string) error {
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("reading PID file: %w", err)
+	default:
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processRunning(pid) {
+			return fmt.Errorf("already running with process ID %d (%s)", pid, path)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("creating PID file directory: %w", err)
+	}
+
+	err = os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("writing PID file: %w", err)
+	}
+	return nil
+}
+
+// processRunning reports whether there is a process with the ID which can be
+// signalled
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// runFlags adds the flags shared by the commands which run a node
+func runFlags(flags *pflag.FlagSet) {
+	keystoreFlags(flags)
+	flags.Bool("daemon", false, "Run in the background, appending output to --log-file")
+	flags.String("pid-file", "", "File to write the process ID to while running")
+	flags.String("log-file", "", "File the output is appended to when running with --daemon (default is to discard it)")
+}
@@ -17,109 +17,300 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
-	"os/signal"
-	"sync"
-	"syscall"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"text/template"
 
 	"github.com/jdudmesh/propolis/internal/bloom"
 	"github.com/jdudmesh/propolis/internal/graph"
 	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/jdudmesh/propolis/internal/secrets"
 	"github.com/spf13/cobra"
 )
 
 var seedCmd = &cobra.Command{
 	Use:   "seed",
 	Short: "Propolis seed server",
-	Long:  `Run propolis in seed mode`,
+	Long: `Run propolis in seed mode. SIGHUP reloads the log level, moderation
+policies, quotas, statement limits and seeds from the config file.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		host, err := cmd.Flags().GetString("host")
+		cmd.SilenceUsage = true
+
+		return runNode(cmd, node.NodeTypeSeed, func(config *nodeConfig) (runningNode, error) {
+			h, err := node.New(config.Config, bloom.New())
+			if err != nil {
+				return nil, fmt.Errorf("creating seed: %w", err)
+			}
+
+			return h, nil
+		})
+	},
+}
+
+var seedInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Provision a seed ready to run",
+	Long: `Create a seed's data directory, database key and databases, and write a
+config file with production defaults. With --systemd a unit file which
+runs the seed is written too.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		dir, err := cmd.Flags().GetString("dir")
 		if err != nil {
-			return fmt.Errorf("no host: %w", err)
+			return fmt.Errorf("no directory: %w", err)
+		}
+		dir, err = filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("resolving directory: %w", err)
 		}
 
-		port, err := cmd.Flags().GetInt("port")
+		publicAddr, err := cmd.Flags().GetString("public")
 		if err != nil {
-			return fmt.Errorf("no port: %w", err)
+			return fmt.Errorf("no public address: %w", err)
+		}
+		if publicAddr == "" {
+			return errors.New("use --public to give the host:port other nodes reach this seed on")
 		}
 
-		isMemory, err := cmd.Flags().GetBool("mem")
+		force, err := cmd.Flags().GetBool("force")
 		if err != nil {
-			return fmt.Errorf("no memory flag: %w", err)
+			return fmt.Errorf("no force flag: %w", err)
 		}
 
-		publicAddr, err := cmd.Flags().GetString("public")
+		unitPath, err := cmd.Flags().GetString("systemd")
 		if err != nil {
-			return fmt.Errorf("no public address: %w", err)
+			return fmt.Errorf("no systemd unit path: %w", err)
 		}
 
-		var nodeDatabaseURL, graphDatabaseURL string
-		if isMemory {
-			nodeDatabaseURL = fmt.Sprintf("file:node%d.db?mode=memory&cache=shared&_secure_delete=true", port)
-			graphDatabaseURL = fmt.Sprintf("file:graph%d.db?mode=memory&cache=shared&_secure_delete=true", port)
-		} else {
-			nodeDatabaseURL, err = cmd.Flags().GetString("ndb")
-			if err != nil {
-				return fmt.Errorf("no db: %w", err)
-			}
-			graphDatabaseURL, err = cmd.Flags().GetString("gdb")
-			if err != nil {
-				return fmt.Errorf("no db: %w", err)
-			}
+		host, err := cmd.Flags().GetString("host")
+		if err != nil {
+			return fmt.Errorf("no host: %w", err)
 		}
 
-		seeds, err := cmd.Flags().GetStringArray("seed")
+		port, err := cmd.Flags().GetInt("port")
 		if err != nil {
-			return fmt.Errorf("no seeds specified: %w", err)
+			return fmt.Errorf("no port: %w", err)
 		}
 
-		config := node.Config{
-			Config: graph.Config{
-				Logger:           logger,
-				GraphDatabaseURL: graphDatabaseURL,
+		dataDir := filepath.Join(dir, "data")
+		configPath := filepath.Join(dir, "propolis.yaml")
+		keyPath := filepath.Join(dataDir, "db.key")
+
+		_, err = os.Stat(configPath)
+		if err == nil && !force {
+			return fmt.Errorf("%s already exists, use --force to replace it", configPath)
+		}
+
+		seed := seedSettings{
+			Config: node.Config{
+				Config: graph.Config{
+					Logger:           logger,
+					GraphDatabaseURL: "file:" + filepath.Join(dataDir, "graph.db") + "?mode=rwc&_secure_delete=true",
+				},
+				Type:            node.NodeTypeSeed,
+				Host:            host,
+				Port:            port,
+				PublicAddress:   publicAddr,
+				NodeDatabaseURL: "file:" + filepath.Join(dataDir, "node.db") + "?mode=rwc&_secure_delete=true",
+				EnableTCP:       true,
+				AdminAddress:    "unix:" + filepath.Join(dataDir, "admin.sock"),
+				DatabaseKey:     secrets.FileKeyProvider(keyPath),
 			},
-			Type:            node.NodeTypeSeed,
-			Host:            host,
-			Port:            port,
-			PublicAddress:   publicAddr,
-			NodeDatabaseURL: nodeDatabaseURL,
-			Seeds:           seeds,
+			DatabaseKeyFile: keyPath,
 		}
 
-		filter := bloom.New()
+		err = seed.Validate()
+		if err != nil {
+			return err
+		}
 
-		h, err := node.New(config, filter)
+		err = os.MkdirAll(dataDir, 0700)
 		if err != nil {
-			return fmt.Errorf("creating peer: %w", err)
+			return fmt.Errorf("creating data directory: %w", err)
 		}
 
-		wg := sync.WaitGroup{}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err = h.Run()
-			if err != nil {
-				err = fmt.Errorf("startting peer: %w", err)
-			}
-		}()
+		err = writeKeyFile(keyPath)
+		if err != nil {
+			return err
+		}
 
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-		s := <-sigint
-		logger.Info("stopping server", "signal", s)
+		// creating the node migrates its databases
+		h, err := node.New(seed.Config, bloom.New())
+		if err != nil {
+			return fmt.Errorf("creating databases: %w", err)
+		}
 		err = h.Close()
 		if err != nil {
-			logger.Error("shutting down main server", "error", err)
+			return fmt.Errorf("closing node: %w", err)
 		}
 
-		wg.Wait()
+		err = writeTemplate(configPath, 0600, seedConfigTemplate, seed)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s\n", configPath)
 
-		return err
+		if unitPath != "" {
+			err = writeSeedUnit(unitPath, dir, configPath)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("wrote %s\n", unitPath)
+		}
+
+		fmt.Printf("start the seed with: propolis seed --config %s\n", configPath)
+		return nil
 	},
 }
 
+// seedSettings are the values written to a new seed's config file
+type seedSettings struct {
+	node.Config
+	DatabaseKeyFile string
+}
+
+const seedConfigTemplate = `# written by propolis seed init, see propolis config check
+host: {{ quote .Host }}
+port: {{ .Port }}
+public_address: {{ quote .PublicAddress }}
+tcp: true
+log_level: info
+
+node_db: {{ quote .NodeDatabaseURL }}
+graph_db: {{ quote .GraphDatabaseURL }}
+db_key_file: {{ quote .DatabaseKeyFile }}
+
+# the admin socket is only accessible to the user running the seed
+admin_address: {{ quote .AdminAddress }}
+
+quotas:
+  actions_per_hour: 600
+  max_bytes_per_identity: 10485760
+  action_ttl: 720h
+  gc_interval: 1m
+
+limits:
+  max_length: 16384
+  max_depth: 4
+  max_entities: 8
+  max_labels: 16
+  max_attributes: 64
+
+clock:
+  max_skew: 5m
+  max_age: 24h
+
+liveness:
+  ping_interval: 1m
+  jitter: 0.2
+  max_missed_pings: 3
+
+breaker:
+  failures: 3
+  cooldown: 30s
+  max_cooldown: 10m
+`
+
+const seedUnitTemplate = `[Unit]
+Description=Propolis seed
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+{{- if .User }}
+User={{ .User }}
+{{- end }}
+WorkingDirectory={{ .Dir }}
+ExecStart={{ .Executable }} seed --config {{ .Config }}
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=5
+LimitNOFILE=65536
+NoNewPrivileges=true
+PrivateTmp=true
+ProtectSystem=strict
+ProtectHome=read-only
+ReadWritePaths={{ .Dir }}
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// writeTemplate renders a template to a new file
+func writeTemplate(path string, perm os.FileMode, text string, data any) error {
+	tmpl, err := template.New(filepath.Base(path)).Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(text)
+	if err != nil {
+		return fmt.Errorf("parsing template: %w", err)
+	}
+
+	buf := bytes.Buffer{}
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return fmt.Errorf("rendering %s: %w", path, err)
+	}
+
+	err = os.WriteFile(path, buf.Bytes(), perm)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// writeKeyFile generates a database key unless the file already holds one
+func writeKeyFile(path string) error {
+	_, err := os.Stat(path)
+	if err == nil {
+		return nil
+	}
+
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path, []byte(key+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("writing database key: %w", err)
+	}
+
+	return nil
+}
+
+// writeSeedUnit writes a systemd unit which runs the seed as the current user
+func writeSeedUnit(path, dir, configPath string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("finding executable: %w", err)
+	}
+
+	username := ""
+	if u, err := user.Current(); err == nil && u.Uid != "0" {
+		username = u.Username
+	}
+
+	return writeTemplate(path, 0644, seedUnitTemplate, map[string]string{
+		"User":       username,
+		"Dir":        dir,
+		"Executable": executable,
+		"Config":     configPath,
+	})
+}
+
 func init() {
+	runFlags(seedCmd.Flags())
 	seedCmd.Flags().String("public", "127.0.0.1:9000", "Public IP address")
+	seedInitCmd.Flags().String("dir", ".", "Directory to provision the seed in")
+	seedInitCmd.Flags().String("public", "", "host:port other nodes reach the seed on")
+	seedInitCmd.Flags().String("systemd", "", "Path to write a systemd unit to, e.g. /etc/systemd/system/propolis-seed.service")
+	seedInitCmd.Flags().Bool("force", false, "Replace an existing config file")
+	seedCmd.AddCommand(seedInitCmd)
 	baseCmd.AddCommand(seedCmd)
 }
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jdudmesh/propolis/internal/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeedInit(t *testing.T) {
+	loggers = logging.New(slog.NewTextHandler(io.Discard, nil), slog.LevelError)
+	logger = loggers.Logger("")
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "propolis.yaml")
+
+	baseCmd.SetArgs([]string{"seed", "init", "--dir", dir, "--public", "seed.example.com:9000", "--port", "9000"})
+	require.NoError(t, baseCmd.Execute())
+
+	// the seed has no use for an identity
+	_, err := os.Stat(filepath.Join(dir, "data", "identity.db"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// the config written is one a seed can run with
+	baseCmd.SetArgs([]string{"config", "check", "--type", "seed", "--config", configPath})
+	require.NoError(t, baseCmd.Execute())
+}
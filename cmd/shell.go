@@ -0,0 +1,258 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+const (
+	shellPrompt         = "propolis> "
+	shellContinuePrompt = "      ... "
+	shellHelp           = `Statements end with ; and can span several lines. MATCH statements are
+queried and their results shown as a table, others are signed and published.
+
+  :help    show this help
+  :quit    leave the shell (or press Ctrl-D)
+`
+)
+
+var shellCmd = &cobra.Command{
+	Use:   "shell",
+	Short: "Interactive statement shell",
+	Long: `Run statements against a node interactively. Connects to a local node's
+application API with --api, or to a network through its seeds with --seed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		backend, err := connectBackend(cmd)
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+
+		s := &shell{
+			backend:  backend,
+			keywords: ast.Keywords(),
+			labels:   map[string]struct{}{},
+		}
+
+		fd := int(os.Stdin.Fd())
+		if !term.IsTerminal(fd) {
+			return s.run(cmd.Context(), &scannerReader{bufio.NewScanner(os.Stdin)}, os.Stdout)
+		}
+
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("setting terminal mode: %w", err)
+		}
+		defer term.Restore(fd, state)
+
+		t := term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}, shellPrompt)
+		t.AutoCompleteCallback = s.complete
+		if width, height, err := term.GetSize(fd); err == nil {
+			t.SetSize(width, height)
+		}
+
+		return s.run(cmd.Context(), t, t)
+	},
+}
+
+// lineReader is satisfied by term.Terminal and, when input isn't a terminal,
+// scannerReader
+type lineReader interface {
+	ReadLine() (string, error)
+	SetPrompt(prompt string)
+}
+
+type scannerReader struct {
+	scanner *bufio.Scanner
+}
+
+func (r *scannerReader) ReadLine() (string, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return r.scanner.Text(), nil
+}
+
+func (r *scannerReader) SetPrompt(string) {}
+
+type shell struct {
+	backend  nodeBackend
+	keywords []string
+	// labels seen in this session's statements, for completion
+	labels map[string]struct{}
+}
+
+// run reads statements until the input ends, buffering lines until they end
+// with a semicolon which isn't inside a quoted string
+func (s *shell) run(ctx context.Context, r lineReader, w io.Writer) error {
+	lines := []string{}
+	for {
+		line, err := r.ReadLine()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading input: %w", err)
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if len(lines) == 0 {
+			switch {
+			case trimmed == "":
+				continue
+			case trimmed == ":quit" || trimmed == ":exit":
+				return nil
+			case trimmed == ":help":
+				fmt.Fprint(w, shellHelp)
+				continue
+			case strings.HasPrefix(trimmed, ":"):
+				fmt.Fprintf(w, "unknown command %s, try :help\n", trimmed)
+				continue
+			}
+		}
+
+		lines = append(lines, line)
+		stmts, rest := scanStatements(strings.Join(lines, "\n"))
+		if len(stmts) == 0 || strings.TrimSpace(rest) != "" {
+			r.SetPrompt(shellContinuePrompt)
+			continue
+		}
+		lines = lines[:0]
+		r.SetPrompt(shellPrompt)
+
+		for _, stmt := range stmts {
+			stmt = strings.TrimSpace(stmt)
+			if stmt == "" {
+				continue
+			}
+			err = s.execute(ctx, w, stmt)
+			if err != nil {
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		}
+	}
+}
+
+// execute queries MATCH statements and publishes everything else
+func (s *shell) execute(ctx context.Context, w io.Writer, stmt string) error {
+	cmd, err := parseStatement(stmt)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range ast.Topics(cmd) {
+		if !strings.Contains(t, ":") {
+			s.labels[t] = struct{}{}
+		}
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelFn()
+
+	if cmd.Type() != ast.EntityTypeMatchCmd {
+		id, err := s.backend.Publish(ctx, stmt)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "published %s\n", id)
+		return nil
+	}
+
+	res, err := s.backend.Query(ctx, stmt)
+	if err != nil {
+		return err
+	}
+	printResults(w, res)
+	return nil
+}
+
+// complete fills in the keyword, or label after a colon, being typed when tab
+// is pressed, as far as the candidates agree
+func (s *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	start := pos
+	for start > 0 && isWordByte(line[start-1]) {
+		start--
+	}
+	word := line[start:pos]
+
+	candidates, fold := s.keywords, true
+	if start > 0 && line[start-1] == ':' {
+		candidates, fold = slices.Sorted(maps.Keys(s.labels)), false
+	} else if word == "" {
+		return "", 0, false
+	}
+
+	matches := []string{}
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) || (fold && strings.HasPrefix(c, strings.ToUpper(word))) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+
+	completion := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, completion) {
+			completion = completion[:len(completion)-1]
+		}
+	}
+	if len(matches) == 1 && fold {
+		completion += " "
+	}
+	if len(completion) < len(word) {
+		return "", 0, false
+	}
+
+	return line[:start] + completion + line[pos:], start + len(completion), true
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
+
+func init() {
+	statementFlags(shellCmd.Flags())
+	baseCmd.AddCommand(shellCmd)
+}
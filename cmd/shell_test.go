@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jdudmesh/propolis/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingBackend records the statements published through it
+type recordingBackend struct {
+	published []string
+}
+
+func (b *recordingBackend) Query(ctx context.Context, stmt string) (client.Results, error) {
+	return client.Results{}, nil
+}
+
+func (b *recordingBackend) Visualize(ctx context.Context, stmt, format string) ([]byte, error) {
+	return nil, nil
+}
+
+func (b *recordingBackend) Publish(ctx context.Context, stmt string) (string, error) {
+	b.published = append(b.published, stmt)
+	return "id", nil
+}
+
+func (b *recordingBackend) Close() error {
+	return nil
+}
+
+func TestShellRun(t *testing.T) {
+	input := strings.Join([]string{
+		`MERGE (p:Post{id:'1'});`,
+		// a semicolon ending a line inside a string doesn't end the statement
+		`MERGE (p:Post{id:'2', text:'first;`,
+		`second'});`,
+		`MERGE (p:Post{id:'3', text:'it\'s;`,
+		`done'}); MERGE (p:Post{id:'4'});`,
+		`MERGE (p:Post{id:'5'})`,
+	}, "\n")
+
+	backend := &recordingBackend{}
+	s := &shell{backend: backend, labels: map[string]struct{}{}}
+	out := &strings.Builder{}
+	require.NoError(t, s.run(context.Background(), &scannerReader{bufio.NewScanner(strings.NewReader(input))}, out))
+
+	assert.Empty(t, strings.TrimSpace(strings.ReplaceAll(out.String(), "published id\n", "")))
+	assert.Equal(t, []string{
+		`MERGE (p:Post{id:'1'})`,
+		"MERGE (p:Post{id:'2', text:'first;\nsecond'})",
+		"MERGE (p:Post{id:'3', text:'it\\'s;\ndone'})",
+		`MERGE (p:Post{id:'4'})`,
+	}, backend.published)
+}
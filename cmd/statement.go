@@ -0,0 +1,514 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/jdudmesh/propolis/pkg/client"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+var queryCmd = &cobra.Command{
+	Use:   "query [statement]",
+	Short: "Run MATCH statements and print the results",
+	Long: `Run MATCH statements on a local node's application API (--api) or a
+network's caches (--seed). Statements are taken from the arguments, --file or
+stdin and are separated by semicolons.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		stmts, output, err := statementInput(cmd, args)
+		if err != nil {
+			return err
+		}
+
+		for _, stmt := range stmts {
+			parsed, err := parseStatement(stmt)
+			if err != nil {
+				return err
+			}
+			if parsed.Type() != ast.EntityTypeMatchCmd {
+				return fmt.Errorf("%s: %w", strings.TrimSpace(stmt), node.ErrNotQuery)
+			}
+		}
+
+		backend, err := connectBackend(cmd)
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+
+		for _, stmt := range stmts {
+			res, err := backend.Query(cmd.Context(), stmt)
+			if err != nil {
+				return fmt.Errorf("querying: %w", err)
+			}
+
+			if output == outputJSON {
+				err = json.NewEncoder(os.Stdout).Encode(res)
+				if err != nil {
+					return fmt.Errorf("writing results: %w", err)
+				}
+				continue
+			}
+			printResults(os.Stdout, res)
+		}
+
+		return nil
+	},
+}
+
+var publishCmd = &cobra.Command{
+	Use:   "publish [statement]",
+	Short: "Sign and publish statements",
+	Long: `Sign statements with a local identity and publish them through a local
+node's application API (--api) or a network's peers (--seed). Statements are
+taken from the arguments, --file or stdin and are separated by semicolons. The
+ID of each published action is printed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		stmts, output, err := statementInput(cmd, args)
+		if err != nil {
+			return err
+		}
+
+		// check everything before publishing anything
+		for _, stmt := range stmts {
+			_, err := parseStatement(stmt)
+			if err != nil {
+				return err
+			}
+		}
+
+		backend, err := connectBackend(cmd)
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+
+		for _, stmt := range stmts {
+			id, err := backend.Publish(cmd.Context(), stmt)
+			if err != nil {
+				return fmt.Errorf("publishing: %w", err)
+			}
+
+			if output == outputJSON {
+				err = json.NewEncoder(os.Stdout).Encode(node.APIPublishResponse{ID: id})
+				if err != nil {
+					return fmt.Errorf("writing result: %w", err)
+				}
+				continue
+			}
+			fmt.Fprintln(os.Stdout, id)
+		}
+
+		return nil
+	},
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export [statement]",
+	Short: "Render a MATCH statement's results for visualisation",
+	Long: `Render the nodes and relations matched by a MATCH statement as Graphviz DOT
+(--format dot) or the nodes and links JSON used by D3's force layout (--format
+d3). The statement is run on a local node's application API (--api) or a
+network's caches (--seed) and taken from the arguments, --file or stdin.
+
+  propolis export --seed 127.0.0.1:9000 "MATCH (p:Person)-[r]->(q)" | dot -Tsvg > graph.svg`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			return fmt.Errorf("no format: %w", err)
+		}
+		if format != node.VisualFormatDOT && format != node.VisualFormatD3 {
+			return fmt.Errorf("unknown format %q, use %s or %s", format, node.VisualFormatDOT, node.VisualFormatD3)
+		}
+
+		stmts, err := readStatements(cmd, args)
+		if err != nil {
+			return err
+		}
+		if len(stmts) > 1 {
+			return errors.New("export renders a single statement")
+		}
+
+		parsed, err := parseStatement(stmts[0])
+		if err != nil {
+			return err
+		}
+		if parsed.Type() != ast.EntityTypeMatchCmd {
+			return fmt.Errorf("%s: %w", strings.TrimSpace(stmts[0]), node.ErrNotQuery)
+		}
+
+		backend, err := connectBackend(cmd)
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+
+		data, err := backend.Visualize(cmd.Context(), stmts[0], format)
+		if err != nil {
+			return fmt.Errorf("exporting: %w", err)
+		}
+
+		if !bytes.HasSuffix(data, []byte("\n")) {
+			data = append(data, '\n')
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	},
+}
+
+// statementInput reads the statements for a command from its arguments, the
+// file named by --file or, failing those, stdin, and the output format
+func statementInput(cmd *cobra.Command, args []string) ([]string, string, error) {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return nil, "", fmt.Errorf("no output format: %w", err)
+	}
+	if output != outputTable && output != outputJSON {
+		return nil, "", fmt.Errorf("unknown output format %q, use table or json", output)
+	}
+
+	stmts, err := readStatements(cmd, args)
+	if err != nil {
+		return nil, "", err
+	}
+	return stmts, output, nil
+}
+
+// readStatements reads statements from the arguments, the file named by
+// --file or stdin
+func readStatements(cmd *cobra.Command, args []string) ([]string, error) {
+	file, err := cmd.Flags().GetString("file")
+	if err != nil {
+		return nil, fmt.Errorf("no file: %w", err)
+	}
+
+	var input string
+	switch {
+	case len(args) > 0 && file != "":
+		return nil, errors.New("give a statement or --file, not both")
+	case len(args) > 0:
+		input = strings.Join(args, " ")
+	case file != "" && file != "-":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading statements: %w", err)
+		}
+		input = string(data)
+	default:
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("reading statements: %w", err)
+		}
+		input = string(data)
+	}
+
+	stmts := splitStatements(input)
+	if len(stmts) == 0 {
+		return nil, errors.New("no statements")
+	}
+	return stmts, nil
+}
+
+// splitStatements splits input on the semicolons which aren't inside quoted
+// strings, dropping empty statements
+func splitStatements(input string) []string {
+	stmts, rest := scanStatements(input)
+	return slices.DeleteFunc(append(stmts, rest), func(s string) bool {
+		return strings.TrimSpace(s) == ""
+	})
+}
+
+// scanStatements returns the statements ended by semicolons which aren't
+// inside quoted strings and what follows the last of them. A backslash in a
+// quoted string escapes the character after it as it does when parsing.
+func scanStatements(input string) ([]string, string) {
+	stmts := []string{}
+	start := 0
+	var quote rune
+	escaped := false
+	for i, r := range input {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ';':
+			stmts = append(stmts, input[start:i])
+			start = i + 1
+		}
+	}
+	return stmts, input[start:]
+}
+
+// parseStatement checks a statement's syntax before it is sent
+func parseStatement(stmt string) (ast.Command, error) {
+	parser, err := ast.Parse(stmt)
+	if err != nil {
+		return nil, fmt.Errorf("syntax error: %w", err)
+	}
+	if parser.Command() == nil {
+		return nil, errors.New("syntax error: no statement")
+	}
+	return parser.Command(), nil
+}
+
+// nodeBackend runs statements on a local node or a network
+type nodeBackend interface {
+	Query(ctx context.Context, stmt string) (client.Results, error)
+	Visualize(ctx context.Context, stmt, format string) ([]byte, error)
+	Publish(ctx context.Context, stmt string) (string, error)
+	Close() error
+}
+
+// connectBackend uses the local node's application API if there is one,
+// otherwise the network's seeds. Statements are published as the identity
+// given by --identity, or the primary identity.
+func connectBackend(cmd *cobra.Command) (nodeBackend, error) {
+	identifier, err := cmd.Flags().GetString("identity")
+	if err != nil {
+		return nil, fmt.Errorf("no identity: %w", err)
+	}
+
+	return connectBackendAs(cmd, identifier)
+}
+
+// connectBackendAs connects like connectBackend, publishing as the given
+// identity
+func connectBackendAs(cmd *cobra.Command, identifier string) (nodeBackend, error) {
+	apiAddr, err := cmd.Flags().GetString("api")
+	if err != nil {
+		return nil, fmt.Errorf("no api address: %w", err)
+	}
+
+	apiToken, err := cmd.Flags().GetString("api-token")
+	if err != nil {
+		return nil, fmt.Errorf("no api token: %w", err)
+	}
+
+	if apiAddr != "" {
+		c, baseURL := localClient(apiAddr)
+		return &apiBackend{client: c, baseURL: baseURL, token: apiToken, identity: identifier}, nil
+	}
+
+	seeds, err := cmd.Flags().GetStringArray("seed")
+	if err != nil {
+		return nil, fmt.Errorf("no seeds: %w", err)
+	}
+	if len(seeds) == 0 {
+		return nil, errors.New("use --api to connect to a local node or --seed to connect to a network")
+	}
+
+	ctx, cancelFn := context.WithTimeout(cmd.Context(), 30*time.Second)
+	defer cancelFn()
+	c, err := client.Connect(ctx, seeds...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting: %w", err)
+	}
+
+	return &remoteBackend{client: c, cmd: cmd, identifier: identifier}, nil
+}
+
+// apiBackend uses a local node's application API, which signs with the
+// node's identities
+type apiBackend struct {
+	client   *http.Client
+	baseURL  string
+	token    string
+	identity string
+}
+
+func (b *apiBackend) post(ctx context.Context, path string, body, v any) error {
+	data, err := b.postRaw(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// postRaw sends a JSON request and returns the response body as is
+func (b *apiBackend) postRaw(ctx context.Context, path string, body any) ([]byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set(node.HeaderContentType, node.ContentTypeJSON)
+	if b.token != "" {
+		req.Header.Set(node.HeaderAuthorization, "Bearer "+b.token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return data, nil
+}
+
+func (b *apiBackend) Query(ctx context.Context, stmt string) (client.Results, error) {
+	res := client.Results{}
+	err := b.post(ctx, "/api/query", node.APIQueryRequest{Statement: stmt}, &res)
+	return res, err
+}
+
+func (b *apiBackend) Visualize(ctx context.Context, stmt, format string) ([]byte, error) {
+	return b.postRaw(ctx, "/api/visualize", node.APIVisualizeRequest{Statement: stmt, Format: format})
+}
+
+func (b *apiBackend) Publish(ctx context.Context, stmt string) (string, error) {
+	res := node.APIPublishResponse{}
+	err := b.post(ctx, "/api/publish", node.APIPublishRequest{Statement: stmt, Identity: b.identity}, &res)
+	return res.ID, err
+}
+
+func (b *apiBackend) Close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
+
+// remoteBackend queries a network's caches and publishes to its peers as an
+// identity from the local identity store, which is opened on the first
+// publish
+type remoteBackend struct {
+	client     *client.Client
+	cmd        *cobra.Command
+	identifier string
+	identity   *identity.Identity
+}
+
+func (b *remoteBackend) Query(ctx context.Context, stmt string) (client.Results, error) {
+	return b.client.Query(ctx, stmt)
+}
+
+func (b *remoteBackend) Visualize(ctx context.Context, stmt, format string) ([]byte, error) {
+	return b.client.Visualize(ctx, stmt, format)
+}
+
+func (b *remoteBackend) Publish(ctx context.Context, stmt string) (string, error) {
+	if b.identity == nil {
+		svc, err := identityService(b.cmd)
+		if err != nil {
+			return "", err
+		}
+		if b.identifier == "" {
+			b.identity, err = svc.GetPrimaryIdentity()
+		} else {
+			b.identity, err = svc.GetIdentity(b.identifier)
+		}
+		if err != nil {
+			return "", fmt.Errorf("fetching identity: %w", err)
+		}
+	}
+	return b.client.Publish(ctx, b.identity, stmt)
+}
+
+func (b *remoteBackend) Close() error {
+	return b.client.Close()
+}
+
+// printResults writes a row for each entity, grouped by the identifier it
+// was bound to
+func printResults(w io.Writer, res client.Results) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tKIND\tID\tLABELS\tOWNER\tCREATED\tLEFT\tRIGHT")
+
+	rows := 0
+	for _, name := range slices.Sorted(maps.Keys(res)) {
+		for _, e := range res[name] {
+			kind, left, right := "node", "-", "-"
+			if e.IsRelation() {
+				kind, left, right = "relation", e.LeftNodeID, e.RightNodeID
+			}
+			labels := "-"
+			if len(e.Labels) > 0 {
+				labels = ":" + strings.Join(e.Labels, ":")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", name, kind, e.ID, labels, e.OwnerID, e.CreatedAt.Format(time.DateTime), left, right)
+			rows++
+		}
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "(%d rows)\n", rows)
+}
+
+// statementFlags adds the flags shared by the commands which send statements
+func statementFlags(flags *pflag.FlagSet) {
+	flags.String("identity", "", "Identity to publish as (default is the primary identity)")
+	keystoreFlags(flags)
+}
+
+func init() {
+	for _, c := range []*cobra.Command{queryCmd, publishCmd} {
+		statementFlags(c.Flags())
+		c.Flags().StringP("file", "f", "", "File to read statements from, - for stdin")
+		c.Flags().StringP("output", "o", outputTable, "Output format, table or json")
+		baseCmd.AddCommand(c)
+	}
+
+	statementFlags(exportCmd.Flags())
+	exportCmd.Flags().StringP("file", "f", "", "File to read the statement from, - for stdin")
+	exportCmd.Flags().String("format", node.VisualFormatDOT, "Output format, dot or d3")
+	baseCmd.AddCommand(exportCmd)
+}
@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := map[string][]string{
+		"MATCH (n); MATCH (m)":                       {"MATCH (n)", " MATCH (m)"},
+		"MATCH (n);\n;  ;":                           {"MATCH (n)"},
+		`MERGE (p:Post{text:'a;b'}); MATCH (n)`:      {`MERGE (p:Post{text:'a;b'})`, " MATCH (n)"},
+		`MERGE (p:Post{text:"it's;"})`:               {`MERGE (p:Post{text:"it's;"})`},
+		`MERGE (p:Post{text:'it\'s;'}); MATCH (n)`:   {`MERGE (p:Post{text:'it\'s;'})`, " MATCH (n)"},
+		`MERGE (p:Post{text:'a\\'}); MATCH (n)`:      {`MERGE (p:Post{text:'a\\'})`, " MATCH (n)"},
+		`MERGE (p:Post{text:"say \"hi;\""});`:        {`MERGE (p:Post{text:"say \"hi;\""})`},
+		`MERGE (p:Post{text:'unterminated;}); MATCH`: {`MERGE (p:Post{text:'unterminated;}); MATCH`},
+	}
+
+	for input, expected := range tests {
+		assert.Equal(t, expected, splitStatements(input), input)
+	}
+}
@@ -0,0 +1,386 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package activitypub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const (
+	// maxBodySize limits the activities and actor documents read from remote
+	// servers
+	maxBodySize = 1048576
+
+	// relationFollows links a remote actor's Identity node to the local
+	// identity it follows, relationUnfollowed records it undoing the follow.
+	// Whichever was most recently merged decides whether it follows.
+	relationFollows    = "FOLLOWS"
+	relationUnfollowed = "UNFOLLOWED"
+)
+
+var (
+	errUnknownActor = errors.New("unknown actor")
+	errBadActivity  = errors.New("bad activity")
+)
+
+// incomingActivity is an activity posted to an inbox. Its object is either an
+// ID or an embedded object.
+type incomingActivity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (a *incomingActivity) objectID() string {
+	id := ""
+	if json.Unmarshal(a.Object, &id) == nil {
+		return id
+	}
+	obj, _ := a.embedded()
+	if obj == nil {
+		return ""
+	}
+	return obj.ID
+}
+
+func (a *incomingActivity) embedded() (*incomingActivity, bool) {
+	obj := &incomingActivity{}
+	if json.Unmarshal(a.Object, obj) != nil {
+		return nil, false
+	}
+	return obj, true
+}
+
+// inboxHandler accepts activities from remote servers. Follow and Undo of a
+// Follow are acted on, anything else is accepted and ignored.
+func (s *server) inboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxBodySize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	activity := &incomingActivity{}
+	err = json.Unmarshal(body, activity)
+	if err != nil || activity.ID == "" || activity.Actor == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	actor, err := s.verifyRequest(r.Context(), r, body)
+	if err != nil {
+		s.logger.Info("rejecting activity", "activity", activity.ID, "actor", activity.Actor, "reason", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if actor.ID != activity.Actor {
+		s.logger.Info("rejecting activity", "activity", activity.ID, "actor", activity.Actor, "reason", "signed by another actor")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		err = s.follow(r.Context(), actor, activity, body)
+	case "Undo":
+		err = s.undo(r.Context(), actor, activity)
+	}
+	switch {
+	case errors.Is(err, errUnknownActor):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, errBadActivity):
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case err != nil:
+		s.logger.Error("handling activity", "error", err, "activity", activity.ID, "type", activity.Type)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// follow records the remote actor following a local identity in the follow
+// graph and accepts the follow
+func (s *server) follow(ctx context.Context, remote *Actor, activity *incomingActivity, body []byte) error {
+	id, err := s.actorIdentity(activity.objectID())
+	if err != nil {
+		return err
+	}
+
+	if !validActorURL(remote.ID) || !validActorURL(remote.Inbox) {
+		return fmt.Errorf("%w: bad actor or inbox url", errBadActivity)
+	}
+
+	follower, err := s.db.GetFollower(id.Identifier, remote.ID)
+	if err != nil {
+		return err
+	}
+	if follower == nil {
+		follower = &Follower{
+			Identity:  id.Identifier,
+			Actor:     remote.ID,
+			CreatedAt: time.Now().UTC(),
+		}
+	}
+	follower.Inbox = remote.Inbox
+	follower.FollowID = activity.ID
+	follower.Following = true
+
+	err = s.db.PutFollower(follower)
+	if err != nil {
+		return err
+	}
+
+	err = s.publishFollow(ctx, id, remote.ID, relationFollows)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	accept := &Activity{
+		Context:   "https://www.w3.org/ns/activitystreams",
+		ID:        s.baseURL + "/activities/" + model.NewID(),
+		Type:      "Accept",
+		Actor:     s.actorURL(s.username(id)),
+		Published: now,
+		Object:    json.RawMessage(body),
+	}
+	data, err := json.Marshal(accept)
+	if err != nil {
+		return fmt.Errorf("marshalling accept: %w", err)
+	}
+
+	_, err = s.db.PutActivity(&ActivityRecord{
+		ID:        accept.ID,
+		CreatedAt: now,
+		Identity:  id.Identifier,
+		ActionID:  activity.ID,
+		Type:      accept.Type,
+		Data:      string(data),
+	}, []string{remote.Inbox})
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("followed", "identity", id.Identifier, "follower", remote.ID)
+	s.wakeDeliveries()
+	return nil
+}
+
+// undo records the remote actor no longer following a local identity if the
+// activity undoes a follow
+func (s *server) undo(ctx context.Context, remote *Actor, activity *incomingActivity) error {
+	follower, err := s.undoneFollow(remote, activity)
+	if err != nil {
+		return err
+	}
+	if follower == nil || !follower.Following {
+		return nil
+	}
+
+	id, err := s.localIdentity(follower.Identity)
+	if err != nil {
+		return err
+	}
+	if id == nil {
+		return errUnknownActor
+	}
+
+	follower.Following = false
+	err = s.db.PutFollower(follower)
+	if err != nil {
+		return err
+	}
+
+	err = s.publishFollow(ctx, id, remote.ID, relationUnfollowed)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("unfollowed", "identity", id.Identifier, "follower", remote.ID)
+	return nil
+}
+
+// undoneFollow returns the follow an Undo activity refers to, nil if it isn't
+// one. The follow is found by its ID, or for an embedded Follow with a
+// different ID, by the identity it followed.
+func (s *server) undoneFollow(remote *Actor, activity *incomingActivity) (*Follower, error) {
+	obj, embedded := activity.embedded()
+	if embedded && obj.Type != "Follow" {
+		return nil, nil
+	}
+
+	follower, err := s.db.GetFollowerByFollowID(remote.ID, activity.objectID())
+	if err != nil || follower != nil || !embedded {
+		return follower, err
+	}
+
+	id, err := s.actorIdentity(obj.objectID())
+	if err != nil {
+		return nil, err
+	}
+	return s.db.GetFollower(id.Identifier, remote.ID)
+}
+
+// actorIdentity returns the local identity with the actor URL
+func (s *server) actorIdentity(actorURL string) (*identity.Identity, error) {
+	username, ok := s.resourceUsername(actorURL)
+	if !ok {
+		return nil, errUnknownActor
+	}
+
+	id, err := s.findIdentity(username)
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		return nil, errUnknownActor
+	}
+	return id, nil
+}
+
+// followers returns the remote actors following the identity according to the
+// follow graph. The local record is used if the graph can't be queried.
+func (s *server) followers(id *identity.Identity) ([]*Follower, error) {
+	known, err := s.db.ListFollowers(id.Identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	followers := []*Follower{}
+	for _, f := range known {
+		following := f.Following
+		if s.network != nil {
+			following, err = s.graphFollows(ctx, id, f.Actor)
+			if err != nil {
+				s.logger.Warn("querying follow graph", "error", err, "identity", id.Identifier, "follower", f.Actor)
+				following = f.Following
+			}
+		}
+		if following {
+			followers = append(followers, f)
+		}
+	}
+
+	return followers, nil
+}
+
+// graphFollows reports whether the follow graph has the remote actor following
+// the identity
+func (s *server) graphFollows(ctx context.Context, id *identity.Identity, remote string) (bool, error) {
+	followed, err := s.latestRelation(ctx, id, remote, relationFollows)
+	if err != nil {
+		return false, err
+	}
+	unfollowed, err := s.latestRelation(ctx, id, remote, relationUnfollowed)
+	if err != nil {
+		return false, err
+	}
+	return !followed.IsZero() && followed.After(unfollowed), nil
+}
+
+// latestRelation returns when a relation from the remote actor to the identity
+// was last merged, the zero time if it never was
+func (s *server) latestRelation(ctx context.Context, id *identity.Identity, remote, label string) (time.Time, error) {
+	res, err := s.network.Query(ctx, s.followStatement("MATCH", id, remote, label))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	latest := time.Time{}
+	for _, r := range res["r"] {
+		t := r.CreatedAt
+		if r.UpdatedAt != nil {
+			t = *r.UpdatedAt
+		}
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest, nil
+}
+
+// publishFollow merges a relation between the remote actor and the identity,
+// signed by the identity
+func (s *server) publishFollow(ctx context.Context, id *identity.Identity, remote, label string) error {
+	if s.network == nil {
+		return nil
+	}
+
+	signer, err := s.identities.GetIdentity(id.Identifier)
+	if err != nil {
+		return fmt.Errorf("fetching identity: %w", err)
+	}
+
+	_, err = s.network.Publish(ctx, signer, s.followStatement("MERGE", signer, remote, label))
+	if err != nil {
+		return fmt.Errorf("publishing %s: %w", strings.ToLower(label), err)
+	}
+	return nil
+}
+
+// followStatement is the statement for a relation from a remote actor to a
+// local identity. Nodes belong to the identity which merged them so the
+// remote actor's node records the identity as well as its actor URL, giving
+// each identity its own node for an actor.
+func (s *server) followStatement(command string, id *identity.Identity, remote, label string) string {
+	return fmt.Sprintf("%s (:Identity{actor:'%s', recordedBy:'%s'})-[r:%s]->(:Identity{actor:'%s'})",
+		command, remote, id.Identifier, label, s.actorURL(s.username(id)))
+}
+
+// validActorURL reports whether a remote URL is http(s) and safe to quote in
+// a statement
+func validActorURL(s string) bool {
+	if strings.ContainsAny(s, `'"\`) {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+func (s *server) wakeDeliveries() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
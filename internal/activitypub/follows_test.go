@@ -0,0 +1,227 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/pkg/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNetwork answers a MATCH with the most recent MERGE of the same pattern
+type fakeNetwork struct {
+	mu        sync.Mutex
+	published []string
+}
+
+func (n *fakeNetwork) Subscribe(ctx context.Context, patterns []string, handler func(client.Action)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (n *fakeNetwork) Publish(ctx context.Context, id *identity.Identity, stmt string) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.published = append(n.published, stmt)
+	return "action", nil
+}
+
+func (n *fakeNetwork) Query(ctx context.Context, stmt string) (client.Results, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	res := client.Results{"r": {}}
+	merge := "MERGE" + strings.TrimPrefix(stmt, "MATCH")
+	for i, p := range n.published {
+		if p == merge {
+			res["r"] = []*client.Entity{{CreatedAt: time.Unix(int64(i), 0)}}
+		}
+	}
+	return res, nil
+}
+
+type remoteActor struct {
+	server  *httptest.Server
+	key     ed25519.PrivateKey
+	mu      sync.Mutex
+	inboxed []map[string]any
+}
+
+func newRemoteActor(t *testing.T) *remoteActor {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	assert.NoError(t, err)
+
+	a := &remoteActor{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/carol", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&Actor{
+			ID:    a.url(),
+			Type:  "Person",
+			Inbox: a.url() + "/inbox",
+			PublicKey: PublicKey{
+				ID:           a.url() + "#main-key",
+				Owner:        a.url(),
+				PublicKeyPem: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			},
+		})
+	})
+	mux.HandleFunc("POST /users/carol/inbox", func(w http.ResponseWriter, r *http.Request) {
+		v := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&v)
+		a.mu.Lock()
+		a.inboxed = append(a.inboxed, v)
+		a.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	a.server = httptest.NewServer(mux)
+	t.Cleanup(a.server.Close)
+	return a
+}
+
+func (a *remoteActor) url() string {
+	return a.server.URL + "/users/carol"
+}
+
+// post signs and posts an activity to the server's inbox
+func (a *remoteActor) post(s *server, activity map[string]any) int {
+	body, _ := json.Marshal(activity)
+	req := httptest.NewRequest(http.MethodPost, "/inbox/alice", bytes.NewReader(body))
+	signRequest(req, body, a.url()+"#main-key", a.key, time.Now())
+
+	w := httptest.NewRecorder()
+	s.newmux().ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestFollow(t *testing.T) {
+	assert := assert.New(t)
+	s, id := newTestServer(t)
+	network := &fakeNetwork{}
+	s.network = network
+	remote := newRemoteActor(t)
+
+	follow := map[string]any{
+		"id":     remote.url() + "/follows/1",
+		"type":   "Follow",
+		"actor":  remote.url(),
+		"object": "https://example.com/user/alice",
+	}
+	assert.Equal(http.StatusAccepted, remote.post(s, follow))
+
+	follower, err := s.db.GetFollower(id.Identifier, remote.url())
+	assert.NoError(err)
+	assert.True(follower.Following)
+	assert.Equal(remote.url()+"/inbox", follower.Inbox)
+	assert.Equal([]string{
+		"MERGE (:Identity{actor:'" + remote.url() + "', recordedBy:'" + id.Identifier + "'})-[r:FOLLOWS]->(:Identity{actor:'https://example.com/user/alice'})",
+	}, network.published)
+
+	// the follow is accepted
+	s.deliverDue(context.Background())
+	assert.Len(remote.inboxed, 1)
+	assert.Equal("Accept", remote.inboxed[0]["type"])
+	assert.Equal(follow["id"], remote.inboxed[0]["object"].(map[string]any)["id"])
+
+	// and the follower is sent posts
+	s.publishAction(client.Action{ID: "action1", Identity: id.Identifier, Statement: "MERGE (:Post{text:'hello'})", ReceivedAt: time.Now()})
+	s.deliverDue(context.Background())
+	assert.Len(remote.inboxed, 2)
+	assert.Equal("Create", remote.inboxed[1]["type"])
+
+	assert.Equal(http.StatusAccepted, remote.post(s, map[string]any{
+		"id":     remote.url() + "/undo/1",
+		"type":   "Undo",
+		"actor":  remote.url(),
+		"object": follow,
+	}))
+	assert.Len(network.published, 2)
+	assert.Contains(network.published[1], "-[r:UNFOLLOWED]->")
+
+	follower, err = s.db.GetFollower(id.Identifier, remote.url())
+	assert.NoError(err)
+	assert.False(follower.Following)
+
+	// once unfollowed it isn't sent posts
+	s.publishAction(client.Action{ID: "action2", Identity: id.Identifier, Statement: "MERGE (:Post{text:'goodbye'})", ReceivedAt: time.Now()})
+	s.deliverDue(context.Background())
+	assert.Len(remote.inboxed, 2)
+}
+
+func TestFollowUsesGraph(t *testing.T) {
+	assert := assert.New(t)
+	s, id := newTestServer(t)
+	network := &fakeNetwork{}
+	s.network = network
+	remote := newRemoteActor(t)
+
+	// the local record says following but the graph has no follow
+	assert.NoError(s.db.PutFollower(&Follower{
+		Identity:  id.Identifier,
+		Actor:     remote.url(),
+		Inbox:     remote.url() + "/inbox",
+		CreatedAt: time.Now(),
+		Following: true,
+	}))
+
+	followers, err := s.followers(id)
+	assert.NoError(err)
+	assert.Empty(followers)
+
+	network.published = append(network.published, s.followStatement("MERGE", id, remote.url(), relationFollows))
+	followers, err = s.followers(id)
+	assert.NoError(err)
+	assert.Len(followers, 1)
+}
+
+func TestInboxRejectsUnsigned(t *testing.T) {
+	assert := assert.New(t)
+	s, _ := newTestServer(t)
+	remote := newRemoteActor(t)
+
+	follow := map[string]any{
+		"id":     remote.url() + "/follows/1",
+		"type":   "Follow",
+		"actor":  remote.url(),
+		"object": "https://example.com/user/alice",
+	}
+	body, _ := json.Marshal(follow)
+
+	w := httptest.NewRecorder()
+	s.newmux().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/inbox/alice", bytes.NewReader(body)))
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	// signed for a different body
+	req := httptest.NewRequest(http.MethodPost, "/inbox/alice", bytes.NewReader(body))
+	signRequest(req, []byte("{}"), remote.url()+"#main-key", remote.key, time.Now())
+	w = httptest.NewRecorder()
+	s.newmux().ServeHTTP(w, req)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	// signed by someone other than the actor
+	follow["actor"] = "https://elsewhere.example/users/mallory"
+	body, _ = json.Marshal(follow)
+	req = httptest.NewRequest(http.MethodPost, "/inbox/alice", bytes.NewReader(body))
+	signRequest(req, body, remote.url()+"#main-key", remote.key, time.Now())
+	w = httptest.NewRecorder()
+	s.newmux().ServeHTTP(w, req)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	// following an unknown user
+	follow["actor"] = remote.url()
+	follow["object"] = "https://example.com/user/nobody"
+	assert.Equal(http.StatusNotFound, remote.post(s, follow))
+}
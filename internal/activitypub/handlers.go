@@ -16,11 +16,217 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 */
 package activitypub
 
-import "net/http"
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/node"
+)
+
+const (
+	ContentTypeActivity = "application/activity+json"
+	ContentTypeJRD      = "application/jrd+json"
+)
+
+var actorContext = []any{
+	"https://www.w3.org/ns/activitystreams",
+	"https://w3id.org/security/v1",
+}
+
+func (s *server) writeJSON(w http.ResponseWriter, contentType string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Error("marshalling response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// webfingerHandler resolves acct:user@domain, or an actor URL, to the user's
+// actor document. The identity is listed as an alias so propolis nodes can
+// verify the handle.
+func (s *server) webfingerHandler(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	if resource == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	username, ok := s.resourceUsername(resource)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id, err := s.findIdentity(username)
+	if err != nil {
+		s.logger.Error("finding identity", "error", err, "resource", resource)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if id == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	username = s.username(id)
+	actorURL := s.actorURL(username)
+	s.writeJSON(w, ContentTypeJRD, &WebfingerResponse{
+		Subject: "acct:" + username + "@" + s.domain,
+		Aliases: []string{actorURL, node.WebfingerIdentityPrefix + id.Identifier},
+		Links: []WebfingerLink{{
+			Rel:  "self",
+			Type: ContentTypeActivity,
+			Href: actorURL,
+		}},
+	})
+}
+
+// userInfoHandler returns the actor document for a local identity
+func (s *server) userInfoHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	id, err := s.findIdentity(username)
+	if err != nil {
+		s.logger.Error("finding identity", "error", err, "username", username)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if id == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	actor, err := s.actor(id)
+	if err != nil {
+		s.logger.Error("creating actor", "error", err, "identity", id.Identifier)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeJSON(w, ContentTypeActivity, actor)
+}
 
-func webfingerHandler(w http.ResponseWriter, r *http.Request)    {}
-func globalInboxHandler(w http.ResponseWriter, r *http.Request)  {}
-func userInboxHandler(w http.ResponseWriter, r *http.Request)    {}
-func userInfoHandler(w http.ResponseWriter, r *http.Request)     {}
 func globalOutboxHandler(w http.ResponseWriter, r *http.Request) {}
-func userOutboxHandler(w http.ResponseWriter, r *http.Request)   {}
+
+// resourceUsername extracts the username from a webfinger resource on this
+// server's domain
+func (s *server) resourceUsername(resource string) (string, bool) {
+	if acct, ok := strings.CutPrefix(resource, "acct:"); ok {
+		user, domain, ok := strings.Cut(strings.TrimPrefix(acct, "@"), "@")
+		if !ok || user == "" || !strings.EqualFold(domain, s.domain) {
+			return "", false
+		}
+		return user, true
+	}
+
+	user, ok := strings.CutPrefix(resource, s.actorURL(""))
+	if !ok || user == "" || strings.Contains(user, "/") {
+		return "", false
+	}
+	return user, true
+}
+
+// findIdentity returns the local identity known by username, or by its
+// identifier, or nil if there isn't one
+func (s *server) findIdentity(username string) (*identity.Identity, error) {
+	ids, err := s.identities.ListIdentities()
+	if err != nil {
+		return nil, fmt.Errorf("listing identities: %w", err)
+	}
+
+	for _, id := range ids {
+		if id.Identifier == username || s.username(id) == strings.ToLower(username) {
+			return id, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// username is the name an identity is known by on this server: the user part
+// of its handle if the handle has no domain or is on this server's domain,
+// otherwise its identifier
+func (s *server) username(id *identity.Identity) string {
+	user, domain, hasDomain := strings.Cut(node.NormalizeHandle(id.Handle), "@")
+	if (!hasDomain || strings.EqualFold(domain, s.domain)) && validUsername(user) {
+		return user
+	}
+	return id.Identifier
+}
+
+func validUsername(user string) bool {
+	if user == "" {
+		return false
+	}
+	for _, c := range user {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *server) actorURL(username string) string {
+	return s.baseURL + "/user/" + username
+}
+
+func (s *server) actor(id *identity.Identity) (*Actor, error) {
+	publicKey, err := publicKeyPEM(id)
+	if err != nil {
+		return nil, err
+	}
+
+	username := s.username(id)
+	actorURL := s.actorURL(username)
+
+	name := id.Handle
+	if name == "" {
+		name = id.Identifier
+	}
+
+	return &Actor{
+		Context:           actorContext,
+		ID:                actorURL,
+		Type:              "Person",
+		PreferredUsername: username,
+		Name:              name,
+		Summary:           id.Bio,
+		URL:               actorURL,
+		Inbox:             s.baseURL + "/inbox/" + username,
+		Outbox:            s.baseURL + "/outbox/" + username,
+		Published:         id.CreatedAt.UTC(),
+		PublicKey: PublicKey{
+			ID:           actorURL + "#main-key",
+			Owner:        actorURL,
+			PublicKeyPem: publicKey,
+		},
+	}, nil
+}
+
+// publicKeyPEM returns the identity's public key from its certificate
+func publicKeyPEM(id *identity.Identity) (string, error) {
+	cert := id.Certificate
+	if cert == nil {
+		var err error
+		cert, err = x509.ParseCertificate(id.CertificateData)
+		if err != nil {
+			return "", fmt.Errorf("parsing certificate: %w", err)
+		}
+	}
+
+	data, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("marshalling public key: %w", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: data})), nil
+}
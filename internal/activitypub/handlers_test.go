@@ -0,0 +1,110 @@
+package activitypub
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) (*server, *identity.Identity) {
+	db, err := NewStore("file:" + t.Name() + "-fed.db?mode=memory&cache=shared")
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	store, err := identity.NewStore("file:" + t.Name() + ".db?mode=memory&cache=shared")
+	assert.NoError(t, err)
+
+	svc, err := identity.NewService(store)
+	assert.NoError(t, err)
+
+	id, err := svc.CreateIdentity("Alice@Example.com", "hello from propolis", true)
+	assert.NoError(t, err)
+
+	_, err = svc.CreateIdentity("bob@elsewhere.net", "", false)
+	assert.NoError(t, err)
+
+	s, err := NewServer("127.0.0.1", 0, "https://example.com/", svc, db, nil, slog.Default())
+	assert.NoError(t, err)
+
+	return s, id
+}
+
+func get(s *server, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.newmux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestWebfinger(t *testing.T) {
+	assert := assert.New(t)
+	s, id := newTestServer(t)
+
+	w := get(s, "/.well-known/webfinger?resource="+url.QueryEscape("acct:alice@example.com"))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(ContentTypeJRD, w.Header().Get("Content-Type"))
+
+	jrd := WebfingerResponse{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &jrd))
+	assert.Equal("acct:alice@example.com", jrd.Subject)
+	assert.Contains(jrd.Aliases, "propolis:"+id.Identifier)
+	assert.Equal([]WebfingerLink{{Rel: "self", Type: ContentTypeActivity, Href: "https://example.com/user/alice"}}, jrd.Links)
+
+	w = get(s, "/.well-known/webfinger?resource="+url.QueryEscape("https://example.com/user/alice"))
+	assert.Equal(http.StatusOK, w.Code)
+
+	w = get(s, "/.well-known/webfinger")
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = get(s, "/.well-known/webfinger?resource="+url.QueryEscape("acct:alice@elsewhere.net"))
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	w = get(s, "/.well-known/webfinger?resource="+url.QueryEscape("acct:carol@example.com"))
+	assert.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestActor(t *testing.T) {
+	assert := assert.New(t)
+	s, id := newTestServer(t)
+
+	w := get(s, "/user/alice")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(ContentTypeActivity, w.Header().Get("Content-Type"))
+
+	actor := Actor{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &actor))
+	assert.Equal("https://example.com/user/alice", actor.ID)
+	assert.Equal("Person", actor.Type)
+	assert.Equal("alice", actor.PreferredUsername)
+	assert.Equal("Alice@Example.com", actor.Name)
+	assert.Equal("hello from propolis", actor.Summary)
+	assert.Equal("https://example.com/inbox/alice", actor.Inbox)
+	assert.Equal("https://example.com/user/alice#main-key", actor.PublicKey.ID)
+	assert.Contains(actor.PublicKey.PublicKeyPem, "-----BEGIN PUBLIC KEY-----")
+
+	// identities are also reachable by identifier
+	w = get(s, "/user/"+id.Identifier)
+	assert.Equal(http.StatusOK, w.Code)
+
+	w = get(s, "/user/nobody")
+	assert.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestRemoteHandleUsesIdentifier(t *testing.T) {
+	assert := assert.New(t)
+	s, _ := newTestServer(t)
+
+	ids, err := s.identities.ListIdentities()
+	assert.NoError(err)
+
+	for _, id := range ids {
+		if id.Handle == "bob@elsewhere.net" {
+			assert.Equal(id.Identifier, s.username(id))
+		}
+	}
+}
@@ -57,3 +57,113 @@ type User struct {
 	PrivateKey     string     `db:"private_key" json:"-"`
 	PublicKey      string     `db:"public_key" json:"publicKey"`
 }
+
+// Actor is the ActivityStreams document describing a user, as fetched by
+// fediverse servers from the URL webfinger points them to
+type Actor struct {
+	Context           any       `json:"@context"`
+	ID                string    `json:"id"`
+	Type              string    `json:"type"`
+	PreferredUsername string    `json:"preferredUsername"`
+	Name              string    `json:"name"`
+	Summary           string    `json:"summary,omitempty"`
+	URL               string    `json:"url"`
+	Inbox             string    `json:"inbox"`
+	Outbox            string    `json:"outbox"`
+	Published         time.Time `json:"published"`
+	PublicKey         PublicKey `json:"publicKey"`
+}
+
+type PublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+// WebfingerResponse is a JSON resource descriptor (RFC 7033)
+type WebfingerResponse struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []WebfingerLink `json:"links"`
+}
+
+type WebfingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+// Activity is an ActivityStreams activity published in a user's outbox
+type Activity struct {
+	Context   any       `json:"@context,omitempty"`
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Actor     string    `json:"actor"`
+	Published time.Time `json:"published"`
+	To        []string  `json:"to,omitempty"`
+	Object    any       `json:"object"`
+}
+
+// Note is the ActivityStreams object a Post node is published as
+type Note struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	AttributedTo string    `json:"attributedTo"`
+	Content      string    `json:"content"`
+	Published    time.Time `json:"published"`
+	To           []string  `json:"to,omitempty"`
+}
+
+type OrderedCollection struct {
+	Context      string `json:"@context"`
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	TotalItems   int    `json:"totalItems"`
+	OrderedItems []any  `json:"orderedItems"`
+}
+
+// ActivityRecord is an activity sent by a local identity as stored. ActionID
+// is the network action a Create was made from, or the remote activity a
+// response such as Accept answers, so each is only sent once. Data is the
+// activity's JSON.
+type ActivityRecord struct {
+	ID        string    `db:"id"`
+	CreatedAt time.Time `db:"created_at"`
+	Identity  string    `db:"identity"`
+	ActionID  string    `db:"action_id"`
+	Type      string    `db:"type"`
+	Data      string    `db:"data"`
+}
+
+// Follower is a remote actor which has followed a local identity. It is the
+// address book for deliveries, whether the actor still follows the identity
+// is decided by the follow graph. Following is the local record of that for
+// when the network can't be reached.
+type Follower struct {
+	Identity  string    `db:"identity"`
+	Actor     string    `db:"actor"`
+	Inbox     string    `db:"inbox"`
+	CreatedAt time.Time `db:"created_at"`
+	FollowID  string    `db:"follow_id"`
+	Following bool      `db:"following"`
+}
+
+type DeliveryStatus int
+
+const (
+	DeliveryStatusPending DeliveryStatus = iota
+	DeliveryStatusDelivered
+	DeliveryStatusFailed
+)
+
+// Delivery is the state of sending an activity to a follower's inbox
+type Delivery struct {
+	ActivityID    string         `db:"activity_id"`
+	Inbox         string         `db:"inbox"`
+	CreatedAt     time.Time      `db:"created_at"`
+	Status        DeliveryStatus `db:"status"`
+	Attempts      int            `db:"attempts"`
+	NextAttemptAt time.Time      `db:"next_attempt_at"`
+	DeliveredAt   *time.Time     `db:"delivered_at"`
+	LastError     string         `db:"last_error"`
+}
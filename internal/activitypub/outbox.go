@@ -0,0 +1,363 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/pkg/client"
+)
+
+const (
+	// postLabel labels the nodes published as notes
+	postLabel = "Post"
+
+	publicAddress = "https://www.w3.org/ns/activitystreams#Public"
+
+	outboxPageSize      = 20
+	deliveryInterval    = 30 * time.Second
+	deliveryBatchSize   = 100
+	deliveryBackoff     = time.Minute
+	maxDeliveryAttempts = 8
+)
+
+// subscribe turns the local identities' Post nodes into outbox activities as
+// they are published to the network
+func (s *server) subscribe(ctx context.Context) {
+	err := s.network.Subscribe(ctx, []string{postLabel}, s.publishAction)
+	if err != nil && ctx.Err() == nil {
+		s.logger.Error("subscribing to posts", "error", err)
+	}
+}
+
+// publishAction adds a Create activity for a Post node published by a local
+// identity to its outbox and queues its delivery to each follower
+func (s *server) publishAction(action client.Action) {
+	id, err := s.localIdentity(action.Identity)
+	if err != nil {
+		s.logger.Error("finding identity", "error", err, "identity", action.Identity)
+		return
+	}
+	if id == nil {
+		return
+	}
+
+	content, ok := postContent(action.Statement)
+	if !ok {
+		return
+	}
+
+	published := action.ReceivedAt
+	if action.CreatedAt != nil {
+		published = *action.CreatedAt
+	}
+	published = published.UTC()
+
+	actorURL := s.actorURL(s.username(id))
+	activityURL := s.baseURL + "/activities/" + action.ID
+	data, err := json.Marshal(&Activity{
+		Context:   "https://www.w3.org/ns/activitystreams",
+		ID:        activityURL,
+		Type:      "Create",
+		Actor:     actorURL,
+		Published: published,
+		To:        []string{publicAddress},
+		Object: &Note{
+			ID:           s.baseURL + "/notes/" + action.ID,
+			Type:         "Note",
+			AttributedTo: actorURL,
+			Content:      "<p>" + html.EscapeString(content) + "</p>",
+			Published:    published,
+			To:           []string{publicAddress},
+		},
+	})
+	if err != nil {
+		s.logger.Error("marshalling activity", "error", err, "action", action.ID)
+		return
+	}
+
+	followers, err := s.followers(id)
+	if err != nil {
+		s.logger.Error("listing followers", "error", err, "identity", id.Identifier)
+		return
+	}
+	inboxes := []string{}
+	for _, f := range followers {
+		inboxes = append(inboxes, f.Inbox)
+	}
+	slices.Sort(inboxes)
+	inboxes = slices.Compact(inboxes)
+
+	added, err := s.db.PutActivity(&ActivityRecord{
+		ID:        activityURL,
+		CreatedAt: published,
+		Identity:  id.Identifier,
+		ActionID:  action.ID,
+		Type:      "Create",
+		Data:      string(data),
+	}, inboxes)
+	if err != nil {
+		s.logger.Error("storing activity", "error", err, "action", action.ID)
+		return
+	}
+	if !added {
+		return
+	}
+
+	s.logger.Info("published activity", "activity", activityURL, "followers", len(inboxes))
+	s.wakeDeliveries()
+}
+
+// postContent returns the text of a MERGE of a Post node
+func postContent(stmt string) (string, bool) {
+	parser, err := ast.Parse(stmt)
+	if err != nil || parser.Command() == nil || parser.Command().Type() != ast.EntityTypeMergeCmd {
+		return "", false
+	}
+
+	e := parser.Command().Entity()
+	if e == nil || e.Type() != ast.EntityTypeNode || !slices.Contains(e.Labels(), postLabel) {
+		return "", false
+	}
+
+	for _, k := range []string{"text", "content"} {
+		if v, ok := e.Attribute(k); ok && v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// localIdentity returns the local identity with the identifier, nil if there
+// isn't one
+func (s *server) localIdentity(identifier string) (*identity.Identity, error) {
+	ids, err := s.identities.ListIdentities()
+	if err != nil {
+		return nil, fmt.Errorf("listing identities: %w", err)
+	}
+	for _, id := range ids {
+		if id.Identifier == identifier {
+			return id, nil
+		}
+	}
+	return nil, nil
+}
+
+// runDeliveries sends due deliveries until the context is done, retrying
+// failures with exponential backoff
+func (s *server) runDeliveries(ctx context.Context) {
+	ticker := time.NewTicker(deliveryInterval)
+	defer ticker.Stop()
+
+	for {
+		s.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *server) deliverDue(ctx context.Context) {
+	deliveries, err := s.db.DueDeliveries(time.Now().UTC(), deliveryBatchSize)
+	if err != nil {
+		s.logger.Error("fetching deliveries", "error", err)
+		return
+	}
+
+	for _, d := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+
+		err := s.deliver(ctx, d)
+		now := time.Now().UTC()
+		d.Attempts++
+		switch {
+		case err == nil:
+			d.Status = DeliveryStatusDelivered
+			d.DeliveredAt = &now
+			d.LastError = ""
+			s.logger.Debug("delivered activity", "activity", d.ActivityID, "inbox", d.Inbox)
+		case d.Attempts >= maxDeliveryAttempts:
+			d.Status = DeliveryStatusFailed
+			d.LastError = err.Error()
+			s.logger.Warn("giving up delivering activity", "activity", d.ActivityID, "inbox", d.Inbox, "error", err)
+		default:
+			d.NextAttemptAt = now.Add(deliveryBackoff << (d.Attempts - 1))
+			d.LastError = err.Error()
+			s.logger.Info("delivering activity", "activity", d.ActivityID, "inbox", d.Inbox, "error", err, "retry", d.NextAttemptAt)
+		}
+
+		err = s.db.UpdateDelivery(d)
+		if err != nil {
+			s.logger.Error("updating delivery", "error", err, "activity", d.ActivityID, "inbox", d.Inbox)
+		}
+	}
+}
+
+// deliver posts an activity to an inbox, signed with its author's key
+func (s *server) deliver(ctx context.Context, d *Delivery) error {
+	activity, err := s.db.GetActivity(d.ActivityID)
+	if err != nil {
+		return err
+	}
+	if activity == nil {
+		return fmt.Errorf("activity not found")
+	}
+
+	id, err := s.identities.GetIdentity(activity.Identity)
+	if err != nil {
+		return fmt.Errorf("fetching identity: %w", err)
+	}
+
+	key, err := identity.CryptoSigner(id)
+	if err != nil {
+		return fmt.Errorf("opening signer: %w", err)
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
+	defer cancelFn()
+
+	body := []byte(activity.Data)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Inbox, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", ContentTypeActivity)
+	req.Header.Set("Accept", ContentTypeActivity)
+
+	err = signRequest(req, body, s.actorURL(s.username(id))+"#main-key", key, time.Now())
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting activity: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("inbox answered %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// userOutboxHandler returns a user's most recent activities
+func (s *server) userOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	id, err := s.findIdentity(username)
+	if err != nil {
+		s.logger.Error("finding identity", "error", err, "username", username)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if id == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	count, err := s.db.CountActivities(id.Identifier)
+	if err != nil {
+		s.logger.Error("counting activities", "error", err, "identity", id.Identifier)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	activities, err := s.db.ListActivities(id.Identifier, outboxPageSize)
+	if err != nil {
+		s.logger.Error("listing activities", "error", err, "identity", id.Identifier)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]any, len(activities))
+	for i, a := range activities {
+		items[i] = json.RawMessage(a.Data)
+	}
+
+	s.writeJSON(w, ContentTypeActivity, &OrderedCollection{
+		Context:      "https://www.w3.org/ns/activitystreams",
+		ID:           s.baseURL + "/outbox/" + s.username(id),
+		Type:         "OrderedCollection",
+		TotalItems:   count,
+		OrderedItems: items,
+	})
+}
+
+// activityHandler returns an outbox activity
+func (s *server) activityHandler(w http.ResponseWriter, r *http.Request) {
+	activity, ok := s.requestedActivity(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Add("Content-Type", ContentTypeActivity)
+	w.Write([]byte(activity.Data))
+}
+
+// noteHandler returns the note created by an outbox activity
+func (s *server) noteHandler(w http.ResponseWriter, r *http.Request) {
+	activity, ok := s.requestedActivity(w, r)
+	if !ok {
+		return
+	}
+
+	v := struct {
+		Object json.RawMessage `json:"object"`
+	}{}
+	err := json.Unmarshal([]byte(activity.Data), &v)
+	if err != nil {
+		s.logger.Error("decoding activity", "error", err, "activity", activity.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", ContentTypeActivity)
+	w.Write(v.Object)
+}
+
+// requestedActivity fetches the activity for the request's action ID, writing
+// the error response if there isn't one
+func (s *server) requestedActivity(w http.ResponseWriter, r *http.Request) (*ActivityRecord, bool) {
+	activity, err := s.db.GetActivity(s.baseURL + "/activities/" + r.PathValue("id"))
+	if err != nil {
+		s.logger.Error("fetching activity", "error", err, "id", r.PathValue("id"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	if activity == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	return activity, true
+}
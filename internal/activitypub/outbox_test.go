@@ -0,0 +1,140 @@
+package activitypub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/pkg/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishAction(t *testing.T) {
+	assert := assert.New(t)
+	s, id := newTestServer(t)
+
+	var received *http.Request
+	var body []byte
+	inbox := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer inbox.Close()
+
+	assert.NoError(s.db.PutFollower(&Follower{
+		Identity:  id.Identifier,
+		Actor:     "https://remote.example/users/carol",
+		Inbox:     inbox.URL + "/users/carol/inbox",
+		CreatedAt: time.Now().UTC(),
+		Following: true,
+	}))
+
+	action := client.Action{
+		ID:         "action1",
+		Identity:   id.Identifier,
+		Statement:  "MERGE (:Post{text:'hello <world>'})",
+		ReceivedAt: time.Now().UTC(),
+	}
+	s.publishAction(action)
+	s.publishAction(action)
+
+	// only Post nodes by local identities are published
+	s.publishAction(client.Action{ID: "action2", Identity: id.Identifier, Statement: "MERGE (:Tag{text:'hello'})"})
+	s.publishAction(client.Action{ID: "action3", Identity: "someoneelse", Statement: "MERGE (:Post{text:'hello'})"})
+
+	w := get(s, "/outbox/alice")
+	assert.Equal(http.StatusOK, w.Code)
+	outbox := struct {
+		TotalItems   int        `json:"totalItems"`
+		OrderedItems []Activity `json:"orderedItems"`
+	}{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &outbox))
+	assert.Equal(1, outbox.TotalItems)
+	assert.Equal("https://example.com/activities/action1", outbox.OrderedItems[0].ID)
+	assert.Equal("Create", outbox.OrderedItems[0].Type)
+
+	w = get(s, "/notes/action1")
+	assert.Equal(http.StatusOK, w.Code)
+	note := Note{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &note))
+	assert.Equal("<p>hello &lt;world&gt;</p>", note.Content)
+	assert.Equal("https://example.com/user/alice", note.AttributedTo)
+
+	s.deliverDue(context.Background())
+	assert.NotNil(received)
+	assert.Equal("/users/carol/inbox", received.URL.Path)
+	assert.Equal(ContentTypeActivity, received.Header.Get("Content-Type"))
+
+	digest := sha256.Sum256(body)
+	assert.Equal("SHA-256="+base64.StdEncoding.EncodeToString(digest[:]), received.Header.Get("Digest"))
+
+	sigHeader := received.Header.Get("Signature")
+	assert.Contains(sigHeader, `keyId="https://example.com/user/alice#main-key"`)
+	sig, err := base64.StdEncoding.DecodeString(regexp.MustCompile(`signature="([^"]+)"`).FindStringSubmatch(sigHeader)[1])
+	assert.NoError(err)
+
+	cert, err := x509.ParseCertificate(id.CertificateData)
+	assert.NoError(err)
+	signed := strings.Join([]string{
+		"(request-target): post /users/carol/inbox",
+		"host: " + received.Host,
+		"date: " + received.Header.Get("Date"),
+		"digest: " + received.Header.Get("Digest"),
+	}, "\n")
+	assert.True(ed25519.Verify(cert.PublicKey.(ed25519.PublicKey), []byte(signed), sig))
+
+	d, err := s.db.(*datastore).GetDelivery("https://example.com/activities/action1", inbox.URL+"/users/carol/inbox")
+	assert.NoError(err)
+	assert.Equal(DeliveryStatusDelivered, d.Status)
+	assert.Equal(1, d.Attempts)
+	assert.NotNil(d.DeliveredAt)
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	assert := assert.New(t)
+	s, id := newTestServer(t)
+
+	inbox := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer inbox.Close()
+
+	assert.NoError(s.db.PutFollower(&Follower{
+		Identity:  id.Identifier,
+		Actor:     "https://remote.example/users/carol",
+		Inbox:     inbox.URL,
+		CreatedAt: time.Now().UTC(),
+		Following: true,
+	}))
+
+	s.publishAction(client.Action{
+		ID:         "action1",
+		Identity:   id.Identifier,
+		Statement:  "MERGE (:Post{text:'hello'})",
+		ReceivedAt: time.Now().UTC(),
+	})
+	s.deliverDue(context.Background())
+
+	d, err := s.db.(*datastore).GetDelivery("https://example.com/activities/action1", inbox.URL)
+	assert.NoError(err)
+	assert.Equal(DeliveryStatusPending, d.Status)
+	assert.Equal(1, d.Attempts)
+	assert.Equal("inbox answered 503", d.LastError)
+	assert.True(d.NextAttemptAt.After(time.Now()))
+
+	// not due again until the backoff has passed
+	due, err := s.db.(*datastore).DueDeliveries(time.Now().UTC(), 10)
+	assert.NoError(err)
+	assert.Empty(due)
+}
@@ -18,15 +18,17 @@ package activitypub
 
 import "net/http"
 
-func newmux() *http.ServeMux {
+func (s *server) newmux() *http.ServeMux {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/.well-known/webfinger", webfingerHandler)
-	mux.HandleFunc("/inbox", globalInboxHandler)
-	mux.HandleFunc("/inbox/{username}", userInboxHandler)
-	mux.HandleFunc("/user/{username}", userInfoHandler)
+	mux.HandleFunc("/.well-known/webfinger", s.webfingerHandler)
+	mux.HandleFunc("/inbox", s.inboxHandler)
+	mux.HandleFunc("/inbox/{username}", s.inboxHandler)
+	mux.HandleFunc("/user/{username}", s.userInfoHandler)
 	mux.HandleFunc("/outbox", globalOutboxHandler)
-	mux.HandleFunc("/outbox/{username}", userOutboxHandler)
+	mux.HandleFunc("/outbox/{username}", s.userOutboxHandler)
+	mux.HandleFunc("/activities/{id}", s.activityHandler)
+	mux.HandleFunc("/notes/{id}", s.noteHandler)
 
 	return mux
 }
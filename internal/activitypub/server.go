@@ -18,33 +18,90 @@ package activitypub
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/pkg/client"
 )
 
-type store interface{}
+type identityStore interface {
+	ListIdentities() ([]*identity.Identity, error)
+	GetIdentity(identifier string) (*identity.Identity, error)
+}
+
+type store interface {
+	PutActivity(activity *ActivityRecord, inboxes []string) (bool, error)
+	GetActivity(id string) (*ActivityRecord, error)
+	ListActivities(identity string, limit int) ([]*ActivityRecord, error)
+	CountActivities(identity string) (int, error)
+	PutFollower(follower *Follower) error
+	GetFollower(identity, actor string) (*Follower, error)
+	GetFollowerByFollowID(actor, followID string) (*Follower, error)
+	ListFollowers(identity string) ([]*Follower, error)
+	DueDeliveries(now time.Time, limit int) ([]*Delivery, error)
+	UpdateDelivery(delivery *Delivery) error
+}
+
+// Network is the propolis network the server reads local identities' posts
+// from and records follows in, e.g. a client
+type Network interface {
+	Subscribe(ctx context.Context, patterns []string, handler func(client.Action)) error
+	Publish(ctx context.Context, id *identity.Identity, stmt string) (string, error)
+	Query(ctx context.Context, stmt string) (client.Results, error)
+}
 
 type server struct {
 	host       string
 	port       int
+	baseURL    string
+	domain     string
+	identities identityStore
 	db         store
+	network    Network
+	client     *http.Client
+	// wake starts a round of deliveries before the next tick
+	wake       chan struct{}
 	logger     *slog.Logger
 	httpServer http.Server
 }
 
-func NewServer(host string, port int, db store, logger *slog.Logger) (*server, error) {
+// NewServer creates an ActivityPub server for the local identities. baseURL is
+// the public URL the server is reached on e.g. https://example.com, and its
+// host is the domain users' acct: addresses are on. Post nodes the identities
+// publish are read from the network, if there is one, and delivered to their
+// followers, and follows are recorded in its graph.
+func NewServer(host string, port int, baseURL string, identities identityStore, db store, network Network, logger *slog.Logger) (*server, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing base url: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, errors.New("base url must be an absolute http(s) url")
+	}
+
 	return &server{
-		host:   host,
-		port:   port,
-		db:     db,
-		logger: logger,
+		host:       host,
+		port:       port,
+		baseURL:    strings.TrimSuffix(u.String(), "/"),
+		domain:     strings.ToLower(u.Host),
+		identities: identities,
+		db:         db,
+		network:    network,
+		client:     &http.Client{Timeout: defaultTimeout},
+		wake:       make(chan struct{}, 1),
+		logger:     logger,
 	}, nil
 }
 
 func (s *server) Run(ctx context.Context) error {
 	addr := fmt.Sprintf("%s:%d", s.host, s.port)
-	mux := newmux()
+	mux := s.newmux()
 
 	srv := http.Server{
 		Addr:    addr,
@@ -54,11 +111,16 @@ func (s *server) Run(ctx context.Context) error {
 	go func() {
 		s.logger.Info("starting activitypub server")
 		err := srv.ListenAndServe()
-		if err != nil {
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			s.logger.Error("fed server", "error", err)
 		}
 	}()
 
+	if s.network != nil {
+		go s.subscribe(ctx)
+	}
+	go s.runDeliveries(ctx)
+
 	<-ctx.Done()
 	srv.Close()
 
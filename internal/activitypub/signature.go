@@ -0,0 +1,191 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package activitypub
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxClockSkew is how far a signed request's Date can be from now
+const maxClockSkew = 12 * time.Hour
+
+var (
+	ErrNotSigned    = errors.New("request not signed")
+	ErrBadSignature = errors.New("bad signature")
+)
+
+var signatureParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// signedHeaders are the headers covered by delivery signatures, as expected by
+// the common fediverse servers
+var signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// signRequest adds Date and Digest headers to a request and signs it as
+// described by draft-cavage-http-signatures. The key is the identity's
+// ed25519 key, so the algorithm is hs2019.
+func signRequest(req *http.Request, body []byte, keyID string, key crypto.Signer, now time.Time) error {
+	digest := sha256.Sum256(body)
+	req.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+
+	sig, err := key.Sign(rand.Reader, []byte(signingString(req, signedHeaders)), crypto.Hash(0))
+	if err != nil {
+		return fmt.Errorf("signing request: %w", err)
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="hs2019",headers="%s",signature="%s"`,
+		keyID, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(sig)))
+
+	return nil
+}
+
+func signingString(req *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		var value string
+		switch h {
+		case "(request-target)":
+			value = strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		default:
+			value = req.Header.Get(h)
+		}
+		lines[i] = h + ": " + value
+	}
+	return strings.Join(lines, "\n")
+}
+
+// verifyRequest checks a request's signature and digest against the key
+// published by the signing actor, which is returned
+func (s *server) verifyRequest(ctx context.Context, req *http.Request, body []byte) (*Actor, error) {
+	params := map[string]string{}
+	for _, m := range signatureParam.FindAllStringSubmatch(req.Header.Get("Signature"), -1) {
+		params[m[1]] = m[2]
+	}
+	if params["keyId"] == "" || params["signature"] == "" {
+		return nil, ErrNotSigned
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	for _, h := range []string{"(request-target)", "date", "digest"} {
+		if !slices.Contains(headers, h) {
+			return nil, fmt.Errorf("%w: %s not signed", ErrBadSignature, h)
+		}
+	}
+
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil || time.Since(date).Abs() > maxClockSkew {
+		return nil, fmt.Errorf("%w: bad date", ErrBadSignature)
+	}
+
+	digest := sha256.Sum256(body)
+	if req.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]) {
+		return nil, fmt.Errorf("%w: digest doesn't match", ErrBadSignature)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding signature", ErrBadSignature)
+	}
+
+	keyURL, _, _ := strings.Cut(params["keyId"], "#")
+	actor, err := s.fetchActor(ctx, keyURL)
+	if err != nil {
+		return nil, err
+	}
+	if actor.PublicKey.ID != params["keyId"] || actor.PublicKey.Owner != actor.ID {
+		return nil, fmt.Errorf("%w: key not published by actor", ErrBadSignature)
+	}
+
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, fmt.Errorf("%w: no public key", ErrBadSignature)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing public key: %w", ErrBadSignature, err)
+	}
+
+	signed := []byte(signingString(req, headers))
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		hashed := sha256.Sum256(signed)
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, signed, sig) {
+			err = errors.New("ed25519 verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported key type %T", publicKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadSignature, err)
+	}
+
+	return actor, nil
+}
+
+// fetchActor fetches a remote actor document
+func (s *server) fetchActor(ctx context.Context, actorURL string) (*Actor, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
+	defer cancelFn()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, actorURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating actor request: %w", err)
+	}
+	req.Header.Set("Accept", ContentTypeActivity)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching actor: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching actor: %d", resp.StatusCode)
+	}
+
+	actor := &Actor{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(actor)
+	if err != nil {
+		return nil, fmt.Errorf("decoding actor: %w", err)
+	}
+
+	return actor, nil
+}
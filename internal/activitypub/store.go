@@ -0,0 +1,292 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package activitypub
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	"github.com/jdudmesh/propolis/pkg/migrate/v4/source/reflect"
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultTimeout = 10 * time.Second
+
+type datastore struct {
+	db *sqlx.DB
+}
+
+// NewStore opens the store holding outbox activities, followers and the
+// state of deliveries to their inboxes
+func NewStore(databaseURL string) (*datastore, error) {
+	db, err := sqlx.Connect("sqlite3", databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to database: %w", err)
+	}
+
+	err = createSchema(db)
+	if err != nil {
+		return nil, fmt.Errorf("creating schema: %w", err)
+	}
+
+	return &datastore{db: db}, nil
+}
+
+func createSchema(db *sqlx.DB) error {
+	driver, err := sqlite3.WithInstance(db.DB, &sqlite3.Config{})
+	if err != nil {
+		return fmt.Errorf("creating driver: %w", err)
+	}
+
+	schema := &struct {
+		Activity_up       string
+		Follower_up       string
+		Delivery_up       string
+		ActivityType_up   string
+		FollowerFollow_up string
+	}{
+		Activity_up: `create table activity (
+			id text not null primary key,
+			created_at datetime not null,
+			identity text not null,
+			action_id text not null unique,
+			data text not null
+		);
+		create index activity_identity on activity (identity, created_at);`,
+
+		Follower_up: `create table follower (
+			identity text not null,
+			actor text not null,
+			inbox text not null,
+			created_at datetime not null,
+			primary key (identity, actor)
+		);`,
+
+		Delivery_up: `create table delivery (
+			activity_id text not null,
+			inbox text not null,
+			created_at datetime not null,
+			status int not null default 0,
+			attempts int not null default 0,
+			next_attempt_at datetime not null,
+			delivered_at datetime null,
+			last_error text not null default '',
+			primary key (activity_id, inbox)
+		);
+		create index delivery_due on delivery (status, next_attempt_at);`,
+
+		ActivityType_up: `alter table activity add column type text not null default 'Create';`,
+
+		FollowerFollow_up: `alter table follower add column follow_id text not null default '';
+		alter table follower add column following int not null default 1;`,
+	}
+
+	source, err := reflect.New(schema)
+	if err != nil {
+		return fmt.Errorf("creating migration source driver: %w", err)
+	}
+
+	m, err := migrate.NewWithInstance("reflect", source, "sqlite3", driver)
+	if err != nil {
+		return fmt.Errorf("creating migration: %w", err)
+	}
+
+	err = m.Up()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *datastore) Close() error {
+	return s.db.Close()
+}
+
+// PutActivity stores an outbox activity along with a pending delivery to each
+// inbox. It returns false, and stores nothing, if there is already an activity
+// for the action.
+func (s *datastore) PutActivity(activity *ActivityRecord, inboxes []string) (bool, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("put activity (begin): %w", err)
+	}
+
+	res, err := tx.NamedExecContext(ctx, `
+		insert into activity (id, created_at, identity, action_id, type, data)
+		values (:id, :created_at, :identity, :action_id, :type, :data)
+		on conflict do nothing;
+	`, activity)
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("put activity: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("put activity (rows affected): %w", err)
+	}
+	if n == 0 {
+		return false, tx.Rollback()
+	}
+
+	for _, inbox := range inboxes {
+		_, err = tx.ExecContext(ctx, `
+			insert into delivery (activity_id, inbox, created_at, next_attempt_at)
+			values (?, ?, ?, ?)
+			on conflict do nothing;
+		`, activity.ID, inbox, activity.CreatedAt, activity.CreatedAt)
+		if err != nil {
+			tx.Rollback()
+			return false, fmt.Errorf("put activity (delivery): %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("put activity (commit): %w", err)
+	}
+
+	return true, nil
+}
+
+// GetActivity returns the activity with the ID, nil if there isn't one
+func (s *datastore) GetActivity(id string) (*ActivityRecord, error) {
+	activity := &ActivityRecord{}
+	err := s.db.Get(activity, "select * from activity where id = ?;", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching activity: %w", err)
+	}
+	return activity, nil
+}
+
+// ListActivities returns an identity's most recent Create activities, newest
+// first. Responses such as Accept aren't listed.
+func (s *datastore) ListActivities(identity string, limit int) ([]*ActivityRecord, error) {
+	activities := []*ActivityRecord{}
+	err := s.db.Select(&activities, "select * from activity where identity = ? and type = 'Create' order by created_at desc limit ?;", identity, limit)
+	if err != nil {
+		return nil, fmt.Errorf("listing activities: %w", err)
+	}
+	return activities, nil
+}
+
+func (s *datastore) CountActivities(identity string) (int, error) {
+	count := 0
+	err := s.db.Get(&count, "select count(*) from activity where identity = ? and type = 'Create';", identity)
+	if err != nil {
+		return 0, fmt.Errorf("counting activities: %w", err)
+	}
+	return count, nil
+}
+
+func (s *datastore) PutFollower(follower *Follower) error {
+	_, err := s.db.NamedExec(`
+		insert into follower (identity, actor, inbox, created_at, follow_id, following)
+		values (:identity, :actor, :inbox, :created_at, :follow_id, :following)
+		on conflict(identity, actor) do update
+		set inbox = :inbox, follow_id = :follow_id, following = :following;
+	`, follower)
+	if err != nil {
+		return fmt.Errorf("put follower: %w", err)
+	}
+	return nil
+}
+
+// GetFollower returns the remote actor's follow of the identity, nil if it
+// has never followed it
+func (s *datastore) GetFollower(identity, actor string) (*Follower, error) {
+	return s.getFollower("select * from follower where identity = ? and actor = ?;", identity, actor)
+}
+
+// GetFollowerByFollowID returns the follow the remote actor made with the
+// Follow activity, nil if there isn't one
+func (s *datastore) GetFollowerByFollowID(actor, followID string) (*Follower, error) {
+	return s.getFollower("select * from follower where actor = ? and follow_id = ?;", actor, followID)
+}
+
+func (s *datastore) getFollower(query string, args ...any) (*Follower, error) {
+	follower := &Follower{}
+	err := s.db.Get(follower, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching follower: %w", err)
+	}
+	return follower, nil
+}
+
+// ListFollowers returns every remote actor which has followed the identity,
+// including those which have since unfollowed it
+func (s *datastore) ListFollowers(identity string) ([]*Follower, error) {
+	followers := []*Follower{}
+	err := s.db.Select(&followers, "select * from follower where identity = ? order by created_at;", identity)
+	if err != nil {
+		return nil, fmt.Errorf("listing followers: %w", err)
+	}
+	return followers, nil
+}
+
+// DueDeliveries returns pending deliveries whose next attempt is due, oldest
+// first
+func (s *datastore) DueDeliveries(now time.Time, limit int) ([]*Delivery, error) {
+	deliveries := []*Delivery{}
+	err := s.db.Select(&deliveries, `
+		select * from delivery
+		where status = ? and next_attempt_at <= ?
+		order by next_attempt_at limit ?;
+	`, DeliveryStatusPending, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("fetching due deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+func (s *datastore) GetDelivery(activityID, inbox string) (*Delivery, error) {
+	delivery := &Delivery{}
+	err := s.db.Get(delivery, "select * from delivery where activity_id = ? and inbox = ?;", activityID, inbox)
+	if err != nil {
+		return nil, fmt.Errorf("fetching delivery: %w", err)
+	}
+	return delivery, nil
+}
+
+func (s *datastore) UpdateDelivery(delivery *Delivery) error {
+	_, err := s.db.NamedExec(`
+		update delivery
+		set status = :status, attempts = :attempts, next_attempt_at = :next_attempt_at,
+			delivered_at = :delivered_at, last_error = :last_error
+		where activity_id = :activity_id and inbox = :inbox;
+	`, delivery)
+	if err != nil {
+		return fmt.Errorf("update delivery: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package ast
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Format writes a command in canonical form: keywords in upper case, no
+// optional whitespace, labels and attributes sorted and string values single
+// quoted where that doesn't change them. Statements which parse to the same
+// command format the same, and the result parses back to that command.
+func Format(cmd Command) string {
+	if cmd == nil {
+		return ""
+	}
+
+	sb := &strings.Builder{}
+	switch cmd.Type() {
+	case EntityTypeMergeCmd:
+		sb.WriteString("MERGE ")
+	case EntityTypeMatchCmd:
+		sb.WriteString("MATCH ")
+	}
+	formatEntity(sb, cmd.Entity())
+
+	if where := cmd.Where(); where != nil {
+		sb.WriteString(" WHERE ")
+		formatCondition(sb, where, ConditionTypeOr)
+	}
+
+	if since := cmd.Since(); !since.IsZero() {
+		sb.WriteString(" SINCE '")
+		sb.WriteString(since.UTC().Format(time.RFC3339Nano))
+		sb.WriteString("'")
+	}
+
+	return sb.String()
+}
+
+func formatEntity(sb *strings.Builder, e Entity) {
+	if e == nil {
+		return
+	}
+
+	r, ok := e.(Relation)
+	if !ok {
+		sb.WriteString("(")
+		formatPattern(sb, e)
+		sb.WriteString(")")
+		return
+	}
+
+	formatEntity(sb, r.Left())
+	if r.Direction() == RelationDirLeft {
+		sb.WriteString("<")
+	}
+	sb.WriteString("-[")
+	formatPattern(sb, r)
+	sb.WriteString("]-")
+	if r.Direction() == RelationDirRight {
+		sb.WriteString(">")
+	}
+	formatEntity(sb, r.Right())
+}
+
+// formatPattern writes the identifier, labels and attributes inside an
+// entity's brackets
+func formatPattern(sb *strings.Builder, e Entity) {
+	sb.WriteString(e.Identifier())
+
+	labels := slices.Clone(e.Labels())
+	slices.Sort(labels)
+	for _, label := range labels {
+		sb.WriteString(":")
+		sb.WriteString(label)
+	}
+
+	attributes := e.Attributes()
+	if len(attributes) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	sb.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(k)
+		sb.WriteString(":")
+		formatValue(sb, attributes[k])
+	}
+	sb.WriteString("}")
+}
+
+// formatValue writes strings with Quote so however a value was quoted and
+// escaped it is formatted the same way
+func formatValue(sb *strings.Builder, a Attribute) {
+	if a.Type() != AttributeDataTypeString {
+		sb.WriteString(a.Value())
+		return
+	}
+	sb.WriteString(Quote(a.Value()))
+}
+
+// escapable are the characters a backslash escapes in a quoted string
+const escapable = `'"\\`
+
+// Quote returns s as a single quoted string. Single quotes are escaped, as
+// are backslashes which would otherwise escape what follows them.
+func Quote(s string) string {
+	sb := strings.Builder{}
+	sb.WriteString("'")
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\'' || (c == '\\' && (i+1 == len(s) || strings.IndexByte(escapable, s[i+1]) >= 0)) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(c)
+	}
+	sb.WriteString("'")
+	return sb.String()
+}
+
+// unquote returns the value of a quoted string. A backslash escapes a quote
+// or another backslash, before anything else it is kept as it is so values
+// such as JSON can be written without doubling their escapes.
+func unquote(s string) string {
+	s = s[1 : len(s)-1]
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	sb := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(escapable, s[i+1]) >= 0 {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// formatCondition writes a WHERE condition. AND binds tighter than OR, so an
+// OR is bracketed inside an AND and anything combined is bracketed after NOT.
+func formatCondition(sb *strings.Builder, c Condition, parent ConditionType) {
+	switch c.Type() {
+	case ConditionTypeAnd, ConditionTypeOr:
+		bracket := parent == ConditionTypeNot || (parent == ConditionTypeAnd && c.Type() == ConditionTypeOr)
+		if bracket {
+			sb.WriteString("(")
+		}
+		for i, o := range c.Operands() {
+			if i > 0 && c.Type() == ConditionTypeAnd {
+				sb.WriteString(" AND ")
+			} else if i > 0 {
+				sb.WriteString(" OR ")
+			}
+			formatCondition(sb, o, c.Type())
+		}
+		if bracket {
+			sb.WriteString(")")
+		}
+	case ConditionTypeNot:
+		sb.WriteString("NOT ")
+		formatCondition(sb, c.Operands()[0], ConditionTypeNot)
+	case ConditionTypeLabel:
+		sb.WriteString(c.Identifier())
+		sb.WriteString(":")
+		sb.WriteString(c.Label())
+	default:
+		sb.WriteString(c.Identifier())
+		sb.WriteString(".")
+		sb.WriteString(c.Key())
+		switch c.Type() {
+		case ConditionTypeCompare:
+			sb.WriteString(c.Operator())
+			formatValue(sb, c.Values()[0])
+		case ConditionTypeIn:
+			sb.WriteString(" IN [")
+			for i, v := range c.Values() {
+				if i > 0 {
+					sb.WriteString(",")
+				}
+				formatValue(sb, v)
+			}
+			sb.WriteString("]")
+		case ConditionTypeIsNull:
+			sb.WriteString(" IS NULL")
+		case ConditionTypeIsNotNull:
+			sb.WriteString(" IS NOT NULL")
+		}
+	}
+}
@@ -18,6 +18,7 @@ package ast
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 	"unicode/utf8"
 )
@@ -70,6 +71,16 @@ const (
 	itemAttribSeparator
 	itemAttribIdentifier
 	itemAttribValue
+	itemWhereIdentifier // identifier, attribute key or label in a WHERE clause
+	itemWhereDot
+	itemWhereLabelStart
+	itemWhereOperator
+	itemWhereValue
+	itemWhereGroupStart
+	itemWhereGroupEnd
+	itemWhereListStart
+	itemWhereListEnd
+	itemWhereListSeparator
 
 	itemKeyword // keywords follow
 	itemMatch
@@ -83,6 +94,10 @@ const (
 	itemUnsubscribe
 	itemOr
 	itemAnd
+	itemNot
+	itemIn
+	itemIs
+	itemNull
 )
 
 // item represents a token or text string returned from the scanner.
@@ -104,6 +119,20 @@ var keywords = map[string]itemType{
 	"unsubscribe": itemUnsubscribe,
 	"or":          itemOr,
 	"and":         itemAnd,
+	"not":         itemNot,
+	"in":          itemIn,
+	"is":          itemIs,
+	"null":        itemNull,
+}
+
+// Keywords returns the statement keywords in upper case, sorted
+func Keywords() []string {
+	kws := make([]string, 0, len(keywords))
+	for kw := range keywords {
+		kws = append(kws, strings.ToUpper(kw))
+	}
+	slices.Sort(kws)
+	return kws
 }
 
 const eof = -1
@@ -134,15 +163,18 @@ type lexer struct {
 	input string // the string being scanned
 	pos   int    // current position in the input
 	start int    // start position of this item
+	width int    // width of the last rune read, zero at the end of the input
 	items []item // item to return to parser
 }
 
 // next returns the next rune in the input.
 func (l *lexer) next() rune {
 	if int(l.pos) >= len(l.input) {
+		l.width = 0
 		return eof
 	}
 	r, w := utf8.DecodeRuneInString(l.input[l.pos:])
+	l.width = w
 	l.pos += w
 	return r
 }
@@ -154,10 +186,9 @@ func (l *lexer) peek() rune {
 	return r
 }
 
-// backup steps back one rune.
+// backup steps back one rune. It can only be called once per call of next.
 func (l *lexer) backup() {
-	_, w := utf8.DecodeLastRuneInString(l.input[:l.pos])
-	l.pos -= w
+	l.pos -= l.width
 }
 
 // thisItem returns the item at the current input point with the specified type
@@ -221,10 +252,12 @@ func (l *lexer) lexQuotedRun() {
 	for {
 		n := l.next()
 		switch {
+		case n == eof:
+			return
 		case n == quoteChar && !isEscapeSeq:
 			return
 		case n == '\\':
-			isEscapeSeq = true
+			isEscapeSeq = !isEscapeSeq
 		default:
 			isEscapeSeq = false
 		}
@@ -312,6 +345,9 @@ func lexKeyword(l *lexer) stateFn {
 	if t, ok := keywords[kw]; ok {
 		i.typ = t
 		l.emitItem(i)
+		if t == itemWhere {
+			return lexWhere
+		}
 		return lexClause
 	}
 	l.errorf("unknow keyword: %s (%d)", i.val, l.pos)
@@ -513,7 +549,7 @@ func lexRelationDirLeftStart(l *lexer) stateFn {
 	l.ignore()
 
 	r1 := l.next()
-	if r1 != '-' {
+	if r1 != '<' {
 		l.errorf("syntax error: %s (%d)", l.input[l.start:l.pos], l.pos)
 	}
 
@@ -683,3 +719,85 @@ func lexRelationAttribValue(l *lexer) stateFn {
 
 	return lexRelationAttrib
 }
+
+// whereOperators are the comparisons allowed in a WHERE clause
+var whereOperators = []string{"=", "<>", "!=", "<", "<=", ">", ">="}
+
+// lexWhere lexes a WHERE clause up to SINCE or the end of the statement
+func lexWhere(l *lexer) stateFn {
+	l.acceptRun(spaces)
+	l.ignore()
+
+	if l.pos >= len(l.input) {
+		return lexEOF
+	}
+
+	n := l.peek()
+	switch {
+	case n == '(':
+		l.next()
+		l.emit(itemWhereGroupStart)
+	case n == ')':
+		l.next()
+		l.emit(itemWhereGroupEnd)
+	case n == '[':
+		l.next()
+		l.emit(itemWhereListStart)
+	case n == ']':
+		l.next()
+		l.emit(itemWhereListEnd)
+	case n == ',':
+		l.next()
+		l.emit(itemWhereListSeparator)
+	case n == '.':
+		l.next()
+		l.emit(itemWhereDot)
+	case n == ':':
+		l.next()
+		l.emit(itemWhereLabelStart)
+	case strings.ContainsRune("=<>!", n):
+		l.acceptRun("=<>!")
+		if !slices.Contains(whereOperators, l.input[l.start:l.pos]) {
+			return l.errorf("unknown operator: %s (%d)", l.input[l.start:l.pos], l.start)
+		}
+		l.emit(itemWhereOperator)
+	case strings.ContainsRune(quotes, n):
+		l.lexQuotedRun()
+		if l.width == 0 {
+			return l.errorf("unterminated string (%d)", l.start)
+		}
+		l.emit(itemWhereValue)
+	case n == '-' || strings.ContainsRune(numeric, n):
+		l.accept("-")
+		l.acceptRun(numeric)
+		l.emit(itemWhereValue)
+	case strings.ContainsRune(alpha, n):
+		return lexWhereWord
+	default:
+		return l.errorf("syntax error: %s (%d)", string(n), l.pos)
+	}
+
+	return lexWhere
+}
+
+// lexWhereWord lexes a keyword or a name. Words after a dot or colon are
+// always attribute keys or labels so they can be keywords too.
+func lexWhereWord(l *lexer) stateFn {
+	l.acceptRun(alphanumeric)
+	i := l.thisItem(itemWhereIdentifier)
+
+	isName := false
+	if len(l.items) > 0 {
+		last := l.items[len(l.items)-1].typ
+		isName = last == itemWhereDot || last == itemWhereLabelStart
+	}
+	if t, ok := keywords[strings.ToLower(i.val)]; ok && !isName {
+		i.typ = t
+	}
+	l.emitItem(i)
+
+	if i.typ == itemSince {
+		return lexClause
+	}
+	return lexWhere
+}
@@ -31,3 +31,188 @@ func TestLexer(t *testing.T) {
 	assert.NoError(err)
 	assert.NotNil(p)
 }
+
+func TestParseRelationDirAndQuotes(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := Parse(`MERGE (p:Post {id: "123456", text: 'hello'})<-[:LIKED]-(i:Identity)`)
+	if !assert.NoError(err) {
+		return
+	}
+
+	r, ok := p.Command().Entity().(Relation)
+	if !assert.True(ok) {
+		return
+	}
+	assert.Equal(RelationDirLeft, r.Direction())
+
+	// both quote styles give string values without the quotes
+	for k, v := range map[string]string{"id": "123456", "text": "hello"} {
+		a := r.Left().Attributes()[k]
+		assert.Equal(AttributeDataTypeString, a.Type())
+		assert.Equal(v, a.Value())
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := Parse(`MERGE (i:Identity:Person {id: '987654'})-[:POSTED]->(p:Post {id: "123456", uri: 'ipfs://xyz', count: 1})`)
+	assert.NoError(err)
+
+	c := Measure(p.Command())
+	assert.Equal(2, c.Depth)
+	assert.Equal(3, c.Entities)
+	assert.Equal(4, c.Labels)
+	assert.Equal(4, c.Attributes)
+
+	p, err = Parse(`MATCH (p:Post {id: '123456'})`)
+	assert.NoError(err)
+
+	c = Measure(p.Command())
+	assert.Equal(1, c.Depth)
+	assert.Equal(1, c.Entities)
+	assert.Equal(1, c.Labels)
+	assert.Equal(1, c.Attributes)
+}
+
+func TestTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := Parse(`MERGE (i:Person {id: '987654'})-[:TAGGED]->(t:Tag {value: 'golang'})`)
+	assert.NoError(err)
+
+	assert.Equal([]string{
+		"Person",
+		"Person:id=987654",
+		"TAGGED",
+		"Tag",
+		"Tag:value=golang",
+	}, Topics(p.Command()))
+	assert.Empty(Topics(nil))
+}
+
+func TestKeywords(t *testing.T) {
+	assert := assert.New(t)
+
+	kws := Keywords()
+	assert.Contains(kws, "MATCH")
+	assert.Contains(kws, "MERGE")
+	assert.IsIncreasing(kws)
+}
+
+func TestFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	formats := map[string]string{
+		`MERGE (i:Person:Identity {id: '987654'})-[:POSTED]->(p:Post {uri: 'ipfs://xyz', count: 1})`:                     `MERGE (i:Identity:Person{id:'987654'})-[:POSTED]->(p:Post{count:1,uri:'ipfs://xyz'})`,
+		`merge (p:Post{text:"it's"})<-[r:LIKED {at: 2}]-(i:Identity)`:                                                    `MERGE (p:Post{text:'it\'s'})<-[r:LIKED{at:2}]-(i:Identity)`,
+		`MATCH (p:Post {id: "123"}) SINCE '2024-05-01T10:00:00+01:00'`:                                                   `MATCH (p:Post{id:'123'}) SINCE '2024-05-01T09:00:00Z'`,
+		`match (a)-[r]->(b) where r.ip != "10.0.0.1" and (a:Person or not b.n in [1, 'x']) since '2024-05-01T09:00:00Z'`: `MATCH (a)-[r]->(b) WHERE r.ip<>'10.0.0.1' AND (a:Person OR NOT b.n IN [1,'x']) SINCE '2024-05-01T09:00:00Z'`,
+	}
+
+	for stmt, expected := range formats {
+		p, err := Parse(stmt)
+		if !assert.NoError(err) {
+			continue
+		}
+		formatted := Format(p.Command())
+		assert.Equal(expected, formatted)
+
+		// the canonical form is stable
+		p, err = Parse(formatted)
+		if assert.NoError(err) {
+			assert.Equal(formatted, Format(p.Command()))
+		}
+	}
+
+	spaced, err := Parse("MERGE   (p:Post  { text : 'hello' ,id:'1' } )")
+	assert.NoError(err)
+	quoted, err := Parse(`MERGE (p:Post{id:"1",text:"hello"})`)
+	assert.NoError(err)
+	assert.Equal(Format(spaced.Command()), Format(quoted.Command()))
+	assert.Empty(Format(nil))
+
+	// however a string is quoted and escaped it has one canonical form
+	same := []string{
+		`MERGE (p:Post{text:'it\'s \\o/'})`,
+		`MERGE (p:Post{text:"it's \\o/"})`,
+		`MERGE (p:Post{text:"it\'s \o/"})`,
+	}
+	for _, stmt := range same {
+		p, err := Parse(stmt)
+		if !assert.NoError(err, stmt) {
+			continue
+		}
+		assert.Equal(`it's \o/`, p.Command().Entity().Attributes()["text"].Value(), stmt)
+		assert.Equal(`MERGE (p:Post{text:'it\'s \o/'})`, Format(p.Command()), stmt)
+	}
+
+	// backslashes before anything else are kept as they are, so values such
+	// as JSON are unchanged
+	for value, quoted := range map[string]string{
+		`"a\nb"`:   `'"a\nb"'`,
+		`a\`:       `'a\\'`,
+		`a\'b`:     `'a\\\'b'`,
+		`say "hi"`: `'say "hi"'`,
+	} {
+		assert.Equal(quoted, Quote(value))
+		p, err := Parse("MERGE (p:Post{text:" + quoted + "})")
+		if assert.NoError(err, quoted) {
+			assert.Equal(value, p.Command().Entity().Attributes()["text"].Value())
+		}
+	}
+}
+
+func TestWhere(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := Parse(`MATCH (a:Host)-[r:CONNECTED]->(b) WHERE r.ipAddress = '10.0.0.1' AND NOT r:BLOCKED OR b.port IN [22, 80] OR r.at IS NOT NULL`)
+	assert.NoError(err)
+
+	w := p.Command().Where()
+	if !assert.NotNil(w) {
+		return
+	}
+	assert.Equal(ConditionTypeOr, w.Type())
+	assert.Len(w.Operands(), 3)
+
+	and := w.Operands()[0]
+	assert.Equal(ConditionTypeAnd, and.Type())
+	cmp := and.Operands()[0]
+	assert.Equal(ConditionTypeCompare, cmp.Type())
+	assert.Equal("r", cmp.Identifier())
+	assert.Equal("ipAddress", cmp.Key())
+	assert.Equal("=", cmp.Operator())
+	assert.Equal("10.0.0.1", cmp.Values()[0].Value())
+	assert.Equal(AttributeDataTypeString, cmp.Values()[0].Type())
+	not := and.Operands()[1]
+	assert.Equal(ConditionTypeNot, not.Type())
+	assert.Equal(ConditionTypeLabel, not.Operands()[0].Type())
+	assert.Equal("BLOCKED", not.Operands()[0].Label())
+
+	in := w.Operands()[1]
+	assert.Equal(ConditionTypeIn, in.Type())
+	assert.Len(in.Values(), 2)
+	assert.Equal(AttributeDataTypeNumber, in.Values()[1].Type())
+	assert.Equal(ConditionTypeIsNotNull, w.Operands()[2].Type())
+
+	// keywords can be attribute keys and labels
+	p, err = Parse(`MATCH (n) WHERE n.in IS NULL AND n:Null`)
+	assert.NoError(err)
+	assert.Equal("in", p.Command().Where().Operands()[0].Key())
+
+	for _, stmt := range []string{
+		`MATCH (n) WHERE m.x = 1`,
+		`MATCH (n) WHERE n.x`,
+		`MATCH (n) WHERE n.x == 1`,
+		`MATCH (n) WHERE (n.x = 1`,
+		`MATCH (n) WHERE n.x IN [1 2]`,
+		`MATCH (n) WHERE n.x = 1 n.y = 2`,
+		`MERGE (n) WHERE n.x = 1`,
+		`MATCH (n) WHERE n.x = 'unterminated`,
+	} {
+		_, err = Parse(stmt)
+		assert.Error(err, stmt)
+	}
+}
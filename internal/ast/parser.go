@@ -18,8 +18,23 @@ package ast
 
 import (
 	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
 )
 
+var logger atomic.Pointer[slog.Logger]
+
+func init() {
+	logger.Store(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// SetLogger sets the logger syntax errors are reported to at debug level.
+// Nothing is logged by default.
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
 type parser struct {
 	lexer *lexer
 	start int
@@ -28,6 +43,14 @@ type parser struct {
 }
 
 func Parse(stmt string) (*parser, error) {
+	p, err := parse(stmt)
+	if err != nil {
+		logger.Load().Debug("syntax error", "error", err, "length", len(stmt))
+	}
+	return p, err
+}
+
+func parse(stmt string) (*parser, error) {
 	p := &parser{
 		lexer: lex(stmt),
 	}
@@ -60,6 +83,19 @@ func Parse(stmt string) (*parser, error) {
 				}
 				m.since = s
 			}
+		case itemWhere:
+			m, ok := p.cmd.(*matchCmd)
+			if !ok || m.entity == nil {
+				return nil, fmt.Errorf("syntax error: where not acceptable")
+			}
+			if m.where != nil {
+				return nil, fmt.Errorf("syntax error: where repeated")
+			}
+			w, err := p.where(p.Identifiers())
+			if err != nil {
+				return nil, err
+			}
+			m.where = w
 		case itemEOF:
 			return p, nil
 		}
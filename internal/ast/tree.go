@@ -19,6 +19,7 @@ package ast
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 )
 
@@ -58,6 +59,7 @@ type Command interface {
 	Type() EntityType
 	Entity() Entity
 	Since() time.Time
+	Where() Condition
 }
 
 type parseable interface {
@@ -76,6 +78,7 @@ type mergeCmd struct {
 type matchCmd struct {
 	entityClause
 	since *sinceClause
+	where Condition
 }
 
 type sinceClause struct {
@@ -169,17 +172,7 @@ func (e *entity) parseAttr(p *parser) error {
 			if attribKey == "" {
 				return fmt.Errorf("unexpected input: %s (%d)", i.val, i.pos)
 			}
-			dataType := AttributeDataTypeNumber
-			attribValue := i.val
-			if attribValue[0] == '\'' && attribValue[len(attribValue)-1] == '\'' {
-				dataType = AttributeDataTypeString
-				attribValue = attribValue[1 : len(attribValue)-1]
-			}
-			e.attributes[attribKey] = &attribute{
-				key:   attribKey,
-				value: attribValue,
-				typ:   dataType,
-			}
+			e.attributes[attribKey] = valueAttribute(attribKey, i.val)
 			attribKey = ""
 		case itemEOF:
 			return ErrUnexpectedEndOfInput
@@ -263,17 +256,25 @@ func (m *mergeCmd) Since() time.Time {
 	return time.Time{}
 }
 
+func (m *mergeCmd) Where() Condition {
+	return nil
+}
+
 func (m *matchCmd) Type() EntityType {
 	return EntityTypeMatchCmd
 }
 
 func (m *matchCmd) Since() time.Time {
 	if m.since == nil {
-
+		return time.Time{}
 	}
 	return m.since.value
 }
 
+func (m *matchCmd) Where() Condition {
+	return m.where
+}
+
 func (n *node) Type() EntityType {
 	return EntityTypeNode
 }
@@ -410,3 +411,70 @@ func (s *sinceClause) parse(p *parser) error {
 	s.value = t
 	return nil
 }
+
+// Complexity summarises the size of a command's tree
+type Complexity struct {
+	Depth      int
+	Entities   int
+	Labels     int
+	Attributes int
+}
+
+// Measure walks the command's entities and returns its complexity
+func Measure(cmd Command) Complexity {
+	c := Complexity{}
+	if cmd == nil {
+		return c
+	}
+	c.Depth = measureEntity(cmd.Entity(), &c)
+	return c
+}
+
+func measureEntity(e Entity, c *Complexity) int {
+	if e == nil {
+		return 0
+	}
+
+	c.Entities++
+	c.Labels += len(e.Labels())
+	c.Attributes += len(e.Attributes())
+
+	r, ok := e.(Relation)
+	if !ok {
+		return 1
+	}
+
+	return 1 + max(measureEntity(r.Left(), c), measureEntity(r.Right(), c))
+}
+
+// Topics returns the topics a command's entities can be subscribed to by:
+// each label on its own and each label with each of the entity's attributes,
+// as Label:key=value. A label's topic covers every entity with that label.
+func Topics(cmd Command) []string {
+	if cmd == nil {
+		return nil
+	}
+
+	topics := []string{}
+	entityTopics(cmd.Entity(), &topics)
+	slices.Sort(topics)
+	return slices.Compact(topics)
+}
+
+func entityTopics(e Entity, topics *[]string) {
+	if e == nil {
+		return
+	}
+
+	for _, label := range e.Labels() {
+		*topics = append(*topics, label)
+		for k, a := range e.Attributes() {
+			*topics = append(*topics, fmt.Sprintf("%s:%s=%s", label, k, a.Value()))
+		}
+	}
+
+	if r, ok := e.(Relation); ok {
+		entityTopics(r.Left(), topics)
+		entityTopics(r.Right(), topics)
+	}
+}
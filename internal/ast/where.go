@@ -0,0 +1,311 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package ast
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type ConditionType int
+
+const (
+	ConditionTypeAnd ConditionType = iota
+	ConditionTypeOr
+	ConditionTypeNot
+	ConditionTypeCompare
+	ConditionTypeIn
+	ConditionTypeIsNull
+	ConditionTypeIsNotNull
+	ConditionTypeLabel
+)
+
+// Condition is a predicate in a MATCH's WHERE clause. And, Or and Not combine
+// their operands, the others test an attribute or label of the node or
+// relation bound to an identifier. A missing attribute fails every
+// comparison, including <>, and only passes IS NULL.
+type Condition interface {
+	Type() ConditionType
+	Operands() []Condition
+	Identifier() string
+	Key() string
+	Operator() string
+	Values() []Attribute
+	Label() string
+}
+
+type condition struct {
+	typ        ConditionType
+	operands   []Condition
+	identifier string
+	key        string
+	operator   string
+	values     []Attribute
+	label      string
+}
+
+func (c *condition) Type() ConditionType {
+	return c.typ
+}
+
+func (c *condition) Operands() []Condition {
+	return c.operands
+}
+
+func (c *condition) Identifier() string {
+	return c.identifier
+}
+
+func (c *condition) Key() string {
+	return c.key
+}
+
+// Operator is the comparison, with != written as <>
+func (c *condition) Operator() string {
+	return c.operator
+}
+
+func (c *condition) Values() []Attribute {
+	return c.values
+}
+
+func (c *condition) Label() string {
+	return c.label
+}
+
+func (p *parser) peek() item {
+	if p.pos >= len(p.lexer.items) {
+		return item{
+			typ: itemEOF,
+		}
+	}
+	return p.lexer.items[p.pos]
+}
+
+// where parses a WHERE clause, which ends at SINCE or the end of the
+// statement. Conditions can only use the identifiers bound by the pattern.
+func (p *parser) where(identifiers []string) (Condition, error) {
+	c, err := p.orCondition()
+	if err != nil {
+		return nil, err
+	}
+
+	switch i := p.peek(); i.typ {
+	case itemEOF, itemSince:
+	default:
+		return nil, fmt.Errorf("unexpected token: %s (%d)", i.val, i.pos)
+	}
+
+	err = checkIdentifiers(c, identifiers)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func checkIdentifiers(c Condition, identifiers []string) error {
+	for _, o := range c.Operands() {
+		err := checkIdentifiers(o, identifiers)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Identifier() != "" && !slices.Contains(identifiers, c.Identifier()) {
+		return fmt.Errorf("unknown identifier in where: %s", c.Identifier())
+	}
+	return nil
+}
+
+func (p *parser) orCondition() (Condition, error) {
+	return p.combine(ConditionTypeOr, itemOr, p.andCondition)
+}
+
+func (p *parser) andCondition() (Condition, error) {
+	return p.combine(ConditionTypeAnd, itemAnd, p.notCondition)
+}
+
+// combine parses one or more operands separated by the keyword
+func (p *parser) combine(typ ConditionType, keyword itemType, operand func() (Condition, error)) (Condition, error) {
+	operands := []Condition{}
+	for {
+		c, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, c)
+
+		if p.peek().typ != keyword {
+			break
+		}
+		p.pop()
+	}
+
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return &condition{typ: typ, operands: operands}, nil
+}
+
+func (p *parser) notCondition() (Condition, error) {
+	if p.peek().typ != itemNot {
+		return p.primaryCondition()
+	}
+	p.pop()
+
+	c, err := p.notCondition()
+	if err != nil {
+		return nil, err
+	}
+	return &condition{typ: ConditionTypeNot, operands: []Condition{c}}, nil
+}
+
+func (p *parser) primaryCondition() (Condition, error) {
+	i := p.pop()
+	switch i.typ {
+	case itemWhereGroupStart:
+		c, err := p.orCondition()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(itemWhereGroupEnd)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case itemWhereIdentifier:
+		return p.predicate(i.val)
+	case itemEOF:
+		return nil, ErrUnexpectedEndOfInput
+	case itemError:
+		return nil, fmt.Errorf("%s", i.val)
+	default:
+		return nil, fmt.Errorf("unexpected token: %s (%d)", i.val, i.pos)
+	}
+}
+
+// predicate parses the test following an identifier: labels as n:Label,
+// which can be chained, or an attribute as n.key compared to a value, IN a
+// list of values or IS [NOT] NULL
+func (p *parser) predicate(identifier string) (Condition, error) {
+	i := p.pop()
+	if i.typ == itemWhereLabelStart {
+		labels := []Condition{}
+		for {
+			l, err := p.expect(itemWhereIdentifier)
+			if err != nil {
+				return nil, err
+			}
+			labels = append(labels, &condition{typ: ConditionTypeLabel, identifier: identifier, label: l.val})
+			if p.peek().typ != itemWhereLabelStart {
+				break
+			}
+			p.pop()
+		}
+		if len(labels) == 1 {
+			return labels[0], nil
+		}
+		return &condition{typ: ConditionTypeAnd, operands: labels}, nil
+	}
+
+	if i.typ != itemWhereDot {
+		return nil, fmt.Errorf("expected an attribute or label after %s (%d)", identifier, i.pos)
+	}
+	k, err := p.expect(itemWhereIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	c := &condition{identifier: identifier, key: k.val}
+
+	i = p.pop()
+	switch i.typ {
+	case itemWhereOperator:
+		v, err := p.expect(itemWhereValue)
+		if err != nil {
+			return nil, err
+		}
+		c.typ = ConditionTypeCompare
+		c.operator = i.val
+		if c.operator == "!=" {
+			c.operator = "<>"
+		}
+		c.values = []Attribute{valueAttribute(c.key, v.val)}
+	case itemIn:
+		_, err := p.expect(itemWhereListStart)
+		if err != nil {
+			return nil, err
+		}
+		c.typ = ConditionTypeIn
+		c.values = []Attribute{}
+		if p.peek().typ == itemWhereListEnd {
+			p.pop()
+			break
+		}
+		for {
+			v, err := p.expect(itemWhereValue)
+			if err != nil {
+				return nil, err
+			}
+			c.values = append(c.values, valueAttribute(c.key, v.val))
+			s := p.pop()
+			if s.typ == itemWhereListEnd {
+				break
+			}
+			if s.typ != itemWhereListSeparator {
+				return nil, fmt.Errorf("unexpected token in list: %s (%d)", s.val, s.pos)
+			}
+		}
+	case itemIs:
+		c.typ = ConditionTypeIsNull
+		if p.peek().typ == itemNot {
+			p.pop()
+			c.typ = ConditionTypeIsNotNull
+		}
+		_, err := p.expect(itemNull)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("expected a comparison, IN or IS after %s.%s (%d)", identifier, c.key, i.pos)
+	}
+
+	return c, nil
+}
+
+// expect pops the next item, which must be of the given type
+func (p *parser) expect(typ itemType) (item, error) {
+	i := p.pop()
+	switch i.typ {
+	case typ:
+		return i, nil
+	case itemEOF:
+		return i, ErrUnexpectedEndOfInput
+	case itemError:
+		return i, fmt.Errorf("%s", i.val)
+	default:
+		return i, fmt.Errorf("unexpected token: %s (%d)", i.val, i.pos)
+	}
+}
+
+// valueAttribute reads a value as written in a statement: quoted values are
+// strings, anything else a number
+func valueAttribute(key, value string) *attribute {
+	if len(value) > 1 && strings.ContainsRune(quotes, rune(value[0])) && value[len(value)-1] == value[0] {
+		return &attribute{key: key, value: unquote(value), typ: AttributeDataTypeString}
+	}
+	return &attribute{key: key, value: value, typ: AttributeDataTypeNumber}
+}
@@ -0,0 +1,323 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand/v2"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/btcsuite/btcutil/base58"
+)
+
+const (
+	// bucketSlots is the number of fingerprints held in each bucket
+	bucketSlots = 4
+	// cuckooLoad is the share of slots a cuckoo filter is sized to fill
+	cuckooLoad = 0.95
+	// maxKicks is how many fingerprints are moved to make room for a new one
+	// before it is put in the stash
+	maxKicks = 500
+
+	// MinBuckets is the fewest buckets a cuckoo filter has
+	MinBuckets = 16
+	// MaxBuckets is the most buckets a cuckoo filter has, enough for its
+	// encoding to stay under MaxEncodedLen
+	MaxBuckets = 1 << 12
+	// MaxCuckooCapacity is the most values a cuckoo filter is sized for
+	MaxCuckooCapacity = MaxBuckets * bucketSlots * 95 / 100
+)
+
+// cuckooEntry is a fingerprint and the bucket it is in
+type cuckooEntry struct {
+	index uint
+	fp    uint16
+}
+
+// Cuckoo is a cuckoo filter. It stores a 16 bit fingerprint of each value in
+// one of two buckets, so values can be deleted and the false positive rate is
+// lower than a bloom filter's of about the same size. Fingerprints which
+// can't be placed are kept in a stash rather than lost.
+type Cuckoo struct {
+	buckets [][bucketSlots]uint16
+	stash   []cuckooEntry
+}
+
+// NewCuckoo returns a cuckoo filter with room for capacity values. The
+// number of buckets is a power of two so that filters of different sizes can
+// be compared.
+func NewCuckoo(capacity uint) *Cuckoo {
+	n := uint(math.Ceil(float64(capacity) / (bucketSlots * cuckooLoad)))
+	n = min(max(n, MinBuckets), MaxBuckets)
+	return &Cuckoo{
+		buckets: make([][bucketSlots]uint16, 1<<bits.Len(n-1)),
+	}
+}
+
+// Type returns TypeCuckoo
+func (c *Cuckoo) Type() Type {
+	return TypeCuckoo
+}
+
+// Buckets returns the number of buckets in the filter
+func (c *Cuckoo) Buckets() uint {
+	return uint(len(c.buckets))
+}
+
+func (c *Cuckoo) mask() uint {
+	return uint(len(c.buckets)) - 1
+}
+
+// fingerprint returns the value's fingerprint, which is never zero as that
+// marks an empty slot, and its first bucket
+func (c *Cuckoo) fingerprint(val []byte) (uint16, uint) {
+	h := xxhash.Checksum64(val)
+	fp := uint16(h >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+	return fp, uint(h) & c.mask()
+}
+
+// altIndex returns a fingerprint's other bucket. It works in both directions
+// and the result reduced to a smaller power of two is the alternate index in
+// a filter of that size.
+func altIndex(i uint, fp uint16, mask uint) uint {
+	return (i ^ uint(fp)*0x5bd1e995) & mask
+}
+
+func (c *Cuckoo) insert(i uint, fp uint16) bool {
+	b := &c.buckets[i]
+	for s := range b {
+		if b[s] == 0 {
+			b[s] = fp
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cuckoo) Set(val []byte) {
+	fp, i := c.fingerprint(val)
+
+	j := altIndex(i, fp, c.mask())
+	if c.insert(i, fp) || c.insert(j, fp) {
+		return
+	}
+
+	if rand.IntN(2) == 1 {
+		i = j
+	}
+	for range maxKicks {
+		s := rand.IntN(bucketSlots)
+		fp, c.buckets[i][s] = c.buckets[i][s], fp
+		i = altIndex(i, fp, c.mask())
+		if c.insert(i, fp) {
+			return
+		}
+	}
+	c.stash = append(c.stash, cuckooEntry{index: i, fp: fp})
+}
+
+// contains reports whether the fingerprint is in either of its buckets, where
+// i is either of them
+func (c *Cuckoo) contains(i uint, fp uint16) bool {
+	j := altIndex(i, fp, c.mask())
+	for s := range bucketSlots {
+		if c.buckets[i][s] == fp || c.buckets[j][s] == fp {
+			return true
+		}
+	}
+	for _, e := range c.stash {
+		if e.fp == fp && (e.index == i || e.index == j) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cuckoo) Intersects(val []byte) bool {
+	fp, i := c.fingerprint(val)
+	return c.contains(i, fp)
+}
+
+func (c *Cuckoo) IntersectsAny(val ...[]byte) bool {
+	for _, v := range val {
+		if c.Intersects(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete removes a value which was added to the filter. Deleting a value
+// which wasn't added can remove another with the same fingerprint.
+func (c *Cuckoo) Delete(val []byte) bool {
+	fp, i := c.fingerprint(val)
+	for _, b := range []uint{i, altIndex(i, fp, c.mask())} {
+		for s := range bucketSlots {
+			if c.buckets[b][s] == fp {
+				c.buckets[b][s] = 0
+				return true
+			}
+		}
+	}
+	for k, e := range c.stash {
+		if e.fp == fp && (e.index == i || e.index == altIndex(i, fp, c.mask())) {
+			c.stash = append(c.stash[:k], c.stash[k+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Overlaps returns true if the two filters appear to share any values
+func (c *Cuckoo) Overlaps(other Membership) bool {
+	return c.Overlap(other) > 0
+}
+
+// Overlap returns the number of fingerprints in the smaller filter which are
+// also in the larger one, looked up with the smaller filter's bucket mask.
+// Cuckoo filters can only be compared with each other.
+func (c *Cuckoo) Overlap(m Membership) uint {
+	other, ok := m.(*Cuckoo)
+	if !ok {
+		return 0
+	}
+
+	small, large := c, other
+	if len(small.buckets) > len(large.buckets) {
+		small, large = large, small
+	}
+
+	// a fingerprint's buckets in the larger filter reduce to its buckets in
+	// the smaller one
+	folded := map[cuckooEntry]struct{}{}
+	large.each(func(i uint, fp uint16) {
+		folded[cuckooEntry{index: i & small.mask(), fp: fp}] = struct{}{}
+	})
+
+	count := uint(0)
+	small.each(func(i uint, fp uint16) {
+		_, ok := folded[cuckooEntry{index: i, fp: fp}]
+		if !ok {
+			_, ok = folded[cuckooEntry{index: altIndex(i, fp, small.mask()), fp: fp}]
+		}
+		if ok {
+			count++
+		}
+	})
+	return count
+}
+
+// each calls fn with every fingerprint and the bucket it is in
+func (c *Cuckoo) each(fn func(i uint, fp uint16)) {
+	for i, b := range c.buckets {
+		for _, fp := range b {
+			if fp != 0 {
+				fn(uint(i), fp)
+			}
+		}
+	}
+	for _, e := range c.stash {
+		fn(e.index, e.fp)
+	}
+}
+
+// EstimateFPR returns the expected false positive rate once n values have
+// been added to the filter. Each lookup compares the fingerprint with the
+// occupied slots of two buckets.
+func (c *Cuckoo) EstimateFPR(n int) float64 {
+	if n <= 0 {
+		return 0
+	}
+	load := min(float64(n)/float64(len(c.buckets)*bucketSlots), 1)
+	compared := 2 * bucketSlots * load
+	return 1 - math.Pow(1-1/float64(math.MaxUint16), compared)
+}
+
+// EstimateCount returns the number of fingerprints in the filter, which is
+// exact unless values were added more than once
+func (c *Cuckoo) EstimateCount() int {
+	count := 0
+	c.each(func(uint, uint16) {
+		count++
+	})
+	return count
+}
+
+// String encodes the filter as the number of buckets, the bucket contents
+// and then the stash
+func (c *Cuckoo) String() string {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(c.buckets))))
+	for _, b := range c.buckets {
+		for _, fp := range b {
+			buf.Write(binary.BigEndian.AppendUint16(nil, fp))
+		}
+	}
+	buf.Write(binary.AppendUvarint(nil, uint64(len(c.stash))))
+	for _, e := range c.stash {
+		buf.Write(binary.AppendUvarint(nil, uint64(e.index)))
+		buf.Write(binary.BigEndian.AppendUint16(nil, e.fp))
+	}
+	return base58.CheckEncode(buf.Bytes(), base58VerCuckoo)
+}
+
+// Parse decodes a filter made by String
+func (c *Cuckoo) Parse(value string) error {
+	buf, v, err := decode(value)
+	if err != nil {
+		return err
+	}
+	if v != base58VerCuckoo {
+		return fmt.Errorf("invalid encoding version: %d", v)
+	}
+	return c.read(buf)
+}
+
+func (c *Cuckoo) read(buf *bytes.Buffer) error {
+	n, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return fmt.Errorf("reading filter buckets: %w", ErrTruncated)
+	}
+	if n < MinBuckets || n > MaxBuckets || bits.OnesCount64(n) != 1 {
+		return fmt.Errorf("%d buckets: %w", n, ErrInvalidParams)
+	}
+	if buf.Len() < int(n)*bucketSlots*2 {
+		return fmt.Errorf("reading filter buckets: %w", ErrTruncated)
+	}
+
+	parsed := &Cuckoo{buckets: make([][bucketSlots]uint16, n)}
+	for i := range parsed.buckets {
+		for s := range bucketSlots {
+			parsed.buckets[i][s] = binary.BigEndian.Uint16(buf.Next(2))
+		}
+	}
+
+	stashLen, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return fmt.Errorf("reading filter stash: %w", ErrTruncated)
+	}
+	if stashLen > uint64(buf.Len()) {
+		return fmt.Errorf("stash of %d: %w", stashLen, ErrTruncated)
+	}
+	for range stashLen {
+		index, err := binary.ReadUvarint(buf)
+		if err != nil || buf.Len() < 2 {
+			return fmt.Errorf("reading filter stash: %w", ErrTruncated)
+		}
+		if index >= n {
+			return fmt.Errorf("stash index %d: %w", index, ErrInvalidParams)
+		}
+		parsed.stash = append(parsed.stash, cuckooEntry{index: uint(index), fp: binary.BigEndian.Uint16(buf.Next(2))})
+	}
+	if buf.Len() > 0 {
+		return fmt.Errorf("%d trailing bytes: %w", buf.Len(), ErrOversized)
+	}
+
+	*c = *parsed
+	return nil
+}
@@ -0,0 +1,103 @@
+package bloom
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCuckoo(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCuckoo(1000)
+	assert.Equal(uint(512), c.Buckets())
+	for i := range 1000 {
+		c.Set([]byte(fmt.Sprintf("id-%d", i)))
+	}
+	for i := range 1000 {
+		assert.True(c.Intersects([]byte(fmt.Sprintf("id-%d", i))))
+	}
+	assert.Equal(1000, c.EstimateCount())
+	assert.Less(c.EstimateFPR(1000), 0.001)
+
+	falsePositives := 0
+	for i := range 10000 {
+		if c.Intersects([]byte(fmt.Sprintf("other-%d", i))) {
+			falsePositives++
+		}
+	}
+	assert.Less(falsePositives, 20)
+
+	assert.True(c.Delete([]byte("id-1")))
+	assert.False(c.Intersects([]byte("id-1")))
+	assert.True(c.Intersects([]byte("id-2")))
+	assert.Equal(999, c.EstimateCount())
+}
+
+func TestCuckooOverfull(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCuckoo(0)
+	for i := range 200 {
+		c.Set([]byte(fmt.Sprintf("id-%d", i)))
+	}
+	assert.NotEmpty(c.stash)
+	for i := range 200 {
+		assert.True(c.Intersects([]byte(fmt.Sprintf("id-%d", i))))
+	}
+
+	m, err := Decode(c.String())
+	assert.NoError(err)
+	assert.Equal(TypeCuckoo, m.Type())
+	assert.True(m.Intersects([]byte("id-199")))
+}
+
+func TestCuckooEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCuckoo(100)
+	c.Set([]byte("hello"))
+
+	m, err := ReadFilter(strings.NewReader(c.String() + "\n"))
+	assert.NoError(err)
+	assert.True(m.Intersects([]byte("hello")))
+	assert.False(m.Intersects([]byte("world")))
+
+	f, err := Decode(New().String())
+	assert.NoError(err)
+	assert.Equal(TypeBloom, f.Type())
+
+	assert.Error(New().Parse(c.String()))
+	assert.Error(NewCuckoo(0).Parse(New().String()))
+
+	_, err = Decode(base58.CheckEncode([]byte{16}, base58VerCuckoo))
+	assert.ErrorIs(err, ErrTruncated)
+	_, err = Decode(base58.CheckEncode([]byte{3}, base58VerCuckoo))
+	assert.ErrorIs(err, ErrInvalidParams)
+}
+
+func TestCuckooOverlap(t *testing.T) {
+	assert := assert.New(t)
+
+	c1 := NewCuckoo(100)
+	c2 := NewCuckoo(2000)
+	assert.Greater(c2.Buckets(), c1.Buckets())
+	for i := range 100 {
+		c1.Set([]byte(fmt.Sprintf("a-%d", i)))
+		c2.Set([]byte(fmt.Sprintf("b-%d", i)))
+	}
+	assert.False(c1.Overlaps(c2))
+
+	c2.Set([]byte("a-1"))
+	c2.Set([]byte("a-2"))
+	assert.Equal(uint(2), c1.Overlap(c2))
+	assert.Equal(uint(2), c2.Overlap(c1))
+
+	b := New()
+	b.Set([]byte("a-1"))
+	assert.False(c1.Overlaps(b))
+	assert.False(b.Overlaps(c1))
+}
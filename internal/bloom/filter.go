@@ -2,68 +2,358 @@ package bloom
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strings"
 
 	"github.com/OneOfOne/xxhash"
 	"github.com/bits-and-blooms/bitset"
 	"github.com/btcsuite/btcutil/base58"
 )
 
+// FilterLen is the size in bits of the default filter, which uses a single
+// hash function. It is the only size older nodes understand.
 const FilterLen = 256
-const base58Ver = 1
+
+const (
+	// MaxFilterLen is the largest filter, in bits
+	MaxFilterLen = 1 << 18
+	// MaxHashes is the most hash functions a filter can use
+	MaxHashes = 16
+	// MaxEncodedLen is the longest encoded filter
+	MaxEncodedLen = MaxFilterLen / 4
+	// DefaultFPR is the false positive rate filters are sized for
+	DefaultFPR = 0.01
+)
+
+const (
+	base58Ver       = 1
+	base58VerParams = 2
+	base58VerCuckoo = 3
+)
+
+// Type names a kind of filter so that nodes can say which they understand
+type Type string
+
+const (
+	TypeBloom  Type = "bloom"
+	TypeCuckoo Type = "cuckoo"
+)
+
+// Types are the filter types this package can decode
+var Types = []Type{TypeBloom, TypeCuckoo}
+
+// Membership is the interface shared by bloom and cuckoo filters. Values
+// which were added always intersect, others may do so falsely.
+type Membership interface {
+	Type() Type
+	Set(val []byte)
+	Intersects(val []byte) bool
+	IntersectsAny(val ...[]byte) bool
+	// Overlap estimates how many values two filters have in common. Filters
+	// of different types can't be compared and have no overlap.
+	Overlap(other Membership) uint
+	Overlaps(other Membership) bool
+	EstimateFPR(n int) float64
+	EstimateCount() int
+	String() string
+}
+
+var (
+	ErrInvalidParams = errors.New("invalid filter parameters")
+	ErrTruncated     = errors.New("truncated filter")
+	ErrOversized     = errors.New("oversized filter")
+)
 
 type Filter struct {
-	value bitset.BitSet
+	value  bitset.BitSet
+	size   uint
+	hashes uint
 }
 
+// New returns a filter with the default size and a single hash function
 func New() *Filter {
 	return &Filter{
-		value: bitset.BitSet{},
+		value:  bitset.BitSet{},
+		size:   FilterLen,
+		hashes: 1,
 	}
 }
 
-func (f *Filter) pos(val []byte) uint {
-	h := xxhash.New32()
-	h.Write(val)
-	return uint(h.Sum32() % FilterLen)
+// NewWithParams returns a filter with the given number of bits and hash
+// functions. The size is rounded up to a power of two so that filters of
+// different sizes can be compared.
+func NewWithParams(size, hashes uint) *Filter {
+	size = min(max(size, FilterLen), MaxFilterLen)
+	hashes = min(max(hashes, 1), MaxHashes)
+	return &Filter{
+		value:  bitset.BitSet{},
+		size:   1 << bits.Len(size-1),
+		hashes: hashes,
+	}
 }
 
-func (f *Filter) Set(val []byte) {
-	f.value.Set(f.pos(val))
+// NewForCount returns a filter sized to hold count values with the given
+// false positive rate. The number of hash functions depends only on the rate
+// so filters sized for different counts stay comparable.
+func NewForCount(count uint, fpr float64) *Filter {
+	if count == 0 {
+		return New()
+	}
+	hashes := HashesForFPR(fpr)
+	return NewWithParams(uint(math.Ceil(float64(count*hashes)/math.Ln2)), hashes)
+}
+
+// HashesForFPR returns the number of hash functions which give the lowest
+// size for the false positive rate
+func HashesForFPR(fpr float64) uint {
+	if fpr <= 0 || fpr >= 1 {
+		fpr = DefaultFPR
+	}
+	return min(uint(math.Ceil(-math.Log2(fpr))), MaxHashes)
+}
+
+// Type returns TypeBloom
+func (f *Filter) Type() Type {
+	return TypeBloom
 }
 
-func (f *Filter) Unset(val []byte) {
-	f.value.Clear(f.pos(val))
+// Size returns the number of bits in the filter
+func (f *Filter) Size() uint {
+	return f.size
+}
+
+// Hashes returns the number of hash functions the filter uses
+func (f *Filter) Hashes() uint {
+	return f.hashes
+}
+
+// EstimateFPR returns the expected false positive rate once n values have
+// been added to the filter
+func (f *Filter) EstimateFPR(n int) float64 {
+	if n <= 0 {
+		return 0
+	}
+	k, m := float64(f.hashes), float64(f.size)
+	return math.Pow(1-math.Exp(-k*float64(n)/m), k)
+}
+
+// EstimateCount returns the approximate number of values added to the filter,
+// judged by how many of its bits are set. A full filter returns math.MaxInt.
+func (f *Filter) EstimateCount() int {
+	set := float64(f.value.Count())
+	k, m := float64(f.hashes), float64(f.size)
+	if set >= m {
+		return math.MaxInt
+	}
+	return int(math.Round(-m / k * math.Log(1-set/m)))
+}
+
+// positions uses double hashing to derive the filter's bits for a value. The
+// first position is the same as the original single hash filter.
+func (f *Filter) positions(val []byte) []uint {
+	h1 := uint64(xxhash.Checksum32S(val, 0))
+	h2 := uint64(xxhash.Checksum32S(val, 1))
+
+	pos := make([]uint, f.hashes)
+	for i := range pos {
+		pos[i] = uint((h1 + uint64(i)*h2) % uint64(f.size))
+	}
+	return pos
+}
+
+func (f *Filter) Set(val []byte) {
+	for _, p := range f.positions(val) {
+		f.value.Set(p)
+	}
 }
 
 func (f *Filter) Intersects(val []byte) bool {
-	return f.value.Test(f.pos(val))
+	for _, p := range f.positions(val) {
+		if !f.value.Test(p) {
+			return false
+		}
+	}
+	return true
 }
 
 func (f *Filter) IntersectsAny(val ...[]byte) bool {
 	for _, v := range val {
-		if f.value.Test(f.pos(v)) {
+		if f.Intersects(v) {
 			return true
 		}
 	}
 	return false
 }
 
+// Overlaps returns true if the two filters have any bits in common
+func (f *Filter) Overlaps(other Membership) bool {
+	return f.Overlap(other) > 0
+}
+
+// Overlap returns the number of bits the two filters have in common. The
+// larger filter is folded down to the size of the smaller one. Filters using
+// different numbers of hash functions can't be compared and have no overlap.
+func (f *Filter) Overlap(m Membership) uint {
+	other, ok := m.(*Filter)
+	if !ok || f.hashes != other.hashes {
+		return 0
+	}
+	a, b := f.value.Clone(), other.value.Clone()
+	switch {
+	case f.size > other.size:
+		a = fold(a, other.size)
+	case f.size < other.size:
+		b = fold(b, f.size)
+	}
+	return a.IntersectionCardinality(b)
+}
+
+func fold(b *bitset.BitSet, size uint) *bitset.BitSet {
+	folded := bitset.New(size)
+	for i, ok := b.NextSet(0); ok; i, ok = b.NextSet(i + 1) {
+		folded.Set(i % size)
+	}
+	return folded
+}
+
+// String encodes the filter. Default filters keep the original encoding so
+// that older nodes can read them.
 func (f *Filter) String() string {
 	buf := bytes.NewBuffer(nil)
+	if f.size == FilterLen && f.hashes == 1 {
+		f.value.WriteTo(buf)
+		return base58.CheckEncode(buf.Bytes(), base58Ver)
+	}
+
+	buf.Write(binary.AppendUvarint(nil, uint64(f.size)))
+	buf.Write(binary.AppendUvarint(nil, uint64(f.hashes)))
 	f.value.WriteTo(buf)
-	return base58.CheckEncode(buf.Bytes(), base58Ver)
+	return base58.CheckEncode(buf.Bytes(), base58VerParams)
 }
 
+// Parse decodes a filter made by String. The base58 version byte says how the
+// filter is encoded: version 1 is the default filter, version 2 declares its
+// size and number of hash functions before the bits. The bits must fit the
+// declared size exactly.
 func (f *Filter) Parse(value string) error {
-	b, v, err := base58.CheckDecode(value)
+	buf, v, err := decode(value)
+	if err != nil {
+		return err
+	}
+	return f.read(buf, v)
+}
+
+func (f *Filter) read(buf *bytes.Buffer, v byte) error {
+	var err error
+	size, hashes := uint64(FilterLen), uint64(1)
+	switch v {
+	case base58Ver:
+	case base58VerParams:
+		size, err = binary.ReadUvarint(buf)
+		if err != nil {
+			return fmt.Errorf("reading filter size: %w", ErrTruncated)
+		}
+		hashes, err = binary.ReadUvarint(buf)
+		if err != nil {
+			return fmt.Errorf("reading filter hashes: %w", ErrTruncated)
+		}
+		if size < FilterLen || size > MaxFilterLen || bits.OnesCount64(size) != 1 || hashes < 1 || hashes > MaxHashes {
+			return fmt.Errorf("size %d, hashes %d: %w", size, hashes, ErrInvalidParams)
+		}
+	default:
+		return fmt.Errorf("invalid encoding version: %d", v)
+	}
+
+	set := bitset.BitSet{}
+	err = readBits(buf, &set, size)
 	if err != nil {
-		return fmt.Errorf("invalid filter value: %w", err)
+		return err
+	}
+
+	f.value = set
+	f.size = uint(size)
+	f.hashes = uint(hashes)
+	return nil
+}
+
+// readBits checks the encoded bitset's declared length against the filter's
+// size and the data remaining before decoding it
+func readBits(buf *bytes.Buffer, value *bitset.BitSet, size uint64) error {
+	if buf.Len() < 8 {
+		return fmt.Errorf("reading filter length: %w", ErrTruncated)
 	}
-	if v != base58Ver {
-		return fmt.Errorf("invalid encoding version: %w", err)
+
+	length := binary.BigEndian.Uint64(buf.Bytes())
+	if length > size {
+		return fmt.Errorf("length %d is over size %d: %w", length, size, ErrOversized)
+	}
+
+	expected := 8 + 8*int((length+63)/64)
+	switch {
+	case buf.Len() < expected:
+		return fmt.Errorf("reading filter bits: %w", ErrTruncated)
+	case buf.Len() > expected:
+		return fmt.Errorf("%d trailing bytes: %w", buf.Len()-expected, ErrOversized)
+	}
+
+	_, err := value.ReadFrom(buf)
+	if err != nil {
+		return fmt.Errorf("reading filter bits: %w", err)
 	}
-	buf := bytes.NewBuffer(b)
-	f.value.ReadFrom(buf)
 	return nil
 }
+
+func decode(value string) (*bytes.Buffer, byte, error) {
+	if len(value) > MaxEncodedLen {
+		return nil, 0, ErrOversized
+	}
+
+	b, v, err := base58.CheckDecode(value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid filter value: %w", err)
+	}
+	return bytes.NewBuffer(b), v, nil
+}
+
+// Decode parses a filter of any type made by String
+func Decode(value string) (Membership, error) {
+	buf, v, err := decode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == base58VerCuckoo {
+		c := &Cuckoo{}
+		err = c.read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	f := New()
+	err = f.read(buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ReadFilter reads an encoded filter of any type, such as a request body,
+// failing with ErrOversized rather than reading more than MaxEncodedLen bytes
+func ReadFilter(r io.Reader) (Membership, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxEncodedLen+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading filter: %w", err)
+	}
+	if len(data) > MaxEncodedLen {
+		return nil, ErrOversized
+	}
+
+	return Decode(strings.TrimSpace(string(data)))
+}
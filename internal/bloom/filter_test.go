@@ -1,8 +1,14 @@
 package bloom
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
 	"testing"
 
+	"github.com/bits-and-blooms/bitset"
+	"github.com/btcsuite/btcutil/base58"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,3 +28,117 @@ func TestFilter(t *testing.T) {
 	assert.NoError(err)
 	assert.True(f2.Intersects([]byte("hello")))
 }
+
+func TestOverlaps(t *testing.T) {
+	assert := assert.New(t)
+
+	f1 := New()
+	f1.Set([]byte("hello"))
+
+	f2 := New()
+	assert.False(f1.Overlaps(f2))
+
+	f2.Set([]byte("hello"))
+	assert.True(f1.Overlaps(f2))
+	assert.True(f2.Overlaps(f1))
+	assert.Equal(uint(1), f1.Overlap(f2))
+}
+
+func TestFilterParams(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewForCount(1000, DefaultFPR)
+	assert.Equal(uint(7), f.Hashes())
+	assert.Equal(uint(16384), f.Size())
+
+	for i := range 1000 {
+		f.Set([]byte(fmt.Sprintf("id-%d", i)))
+	}
+
+	f2 := New()
+	err := f2.Parse(f.String())
+	assert.NoError(err)
+	assert.Equal(f.Size(), f2.Size())
+	assert.Equal(f.Hashes(), f2.Hashes())
+	assert.True(f2.Intersects([]byte("id-999")))
+
+	falsePositives := 0
+	for i := range 10000 {
+		if f2.Intersects([]byte(fmt.Sprintf("other-%d", i))) {
+			falsePositives++
+		}
+	}
+	assert.Less(falsePositives, 200)
+}
+
+func TestOverlapSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	f1 := NewWithParams(256, 3)
+	f1.Set([]byte("hello"))
+
+	f2 := NewWithParams(4096, 3)
+	f2.Set([]byte("hello"))
+	assert.True(f1.Overlaps(f2))
+	assert.True(f2.Overlaps(f1))
+
+	f3 := NewWithParams(4096, 4)
+	f3.Set([]byte("hello"))
+	assert.False(f1.Overlaps(f3))
+}
+
+func TestParseErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewWithParams(1024, 3)
+	f.Set([]byte("hello"))
+	b, v, err := base58.CheckDecode(f.String())
+	assert.NoError(err)
+
+	err = New().Parse(base58.CheckEncode(b[:len(b)-8], v))
+	assert.ErrorIs(err, ErrTruncated)
+
+	err = New().Parse(base58.CheckEncode(append(b, 0, 0, 0, 0, 0, 0, 0, 0), v))
+	assert.ErrorIs(err, ErrOversized)
+
+	err = New().Parse(base58.CheckEncode([]byte{0x03, 0x01}, v))
+	assert.ErrorIs(err, ErrInvalidParams)
+
+	// a default filter declaring more bits than it has room for
+	big := bitset.New(FilterLen * 2)
+	big.Set(FilterLen + 1)
+	buf := bytes.NewBuffer(nil)
+	big.WriteTo(buf)
+	err = New().Parse(base58.CheckEncode(buf.Bytes(), base58Ver))
+	assert.ErrorIs(err, ErrOversized)
+
+	assert.Error(New().Parse("not a filter"))
+
+	_, err = ReadFilter(strings.NewReader(strings.Repeat("1", MaxEncodedLen+1)))
+	assert.ErrorIs(err, ErrOversized)
+
+	f2, err := ReadFilter(strings.NewReader(f.String() + "\n"))
+	assert.NoError(err)
+	assert.True(f2.Intersects([]byte("hello")))
+}
+
+func TestEstimates(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewForCount(1000, DefaultFPR)
+	assert.Zero(f.EstimateFPR(0))
+	assert.InDelta(DefaultFPR, f.EstimateFPR(1000), DefaultFPR)
+	assert.Greater(f.EstimateFPR(10000), f.EstimateFPR(1000))
+
+	assert.Zero(f.EstimateCount())
+	for i := range 1000 {
+		f.Set([]byte(fmt.Sprintf("value%d", i)))
+	}
+	assert.InDelta(1000, f.EstimateCount(), 50)
+
+	full := New()
+	for i := range uint(FilterLen) {
+		full.value.Set(i)
+	}
+	assert.Equal(math.MaxInt, full.EstimateCount())
+}
@@ -0,0 +1,340 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// Structure is a PackStream structure, the tagged records used for messages
+// and graph types
+type Structure struct {
+	Tag    byte
+	Fields []any
+}
+
+var errUnpack = errors.New("invalid packstream")
+
+// pack encodes a value as PackStream. Supported values are nil, bools,
+// integers, floats, strings, byte slices, lists, string keyed maps and
+// Structures.
+func pack(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xC0)
+	case bool:
+		if v {
+			buf.WriteByte(0xC3)
+		} else {
+			buf.WriteByte(0xC2)
+		}
+	case int:
+		packInt(buf, int64(v))
+	case int32:
+		packInt(buf, int64(v))
+	case int64:
+		packInt(buf, v)
+	case uint32:
+		packInt(buf, int64(v))
+	case float64:
+		buf.WriteByte(0xC1)
+		binary.Write(buf, binary.BigEndian, v)
+	case float32:
+		buf.WriteByte(0xC1)
+		binary.Write(buf, binary.BigEndian, float64(v))
+	case string:
+		packHeader(buf, len(v), 0x80, 0xD0)
+		buf.WriteString(v)
+	case []byte:
+		switch {
+		case len(v) <= math.MaxUint8:
+			buf.Write([]byte{0xCC, byte(len(v))})
+		case len(v) <= math.MaxUint16:
+			buf.WriteByte(0xCD)
+			binary.Write(buf, binary.BigEndian, uint16(len(v)))
+		default:
+			buf.WriteByte(0xCE)
+			binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		}
+		buf.Write(v)
+	case []string:
+		packHeader(buf, len(v), 0x90, 0xD4)
+		for _, s := range v {
+			pack(buf, s)
+		}
+	case []any:
+		packHeader(buf, len(v), 0x90, 0xD4)
+		for _, item := range v {
+			err := pack(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		packHeader(buf, len(v), 0xA0, 0xD8)
+		// sorted so the encoding is stable
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			pack(buf, k)
+			err := pack(buf, v[k])
+			if err != nil {
+				return err
+			}
+		}
+	case *Structure:
+		if len(v.Fields) > 15 {
+			return fmt.Errorf("structure has %d fields", len(v.Fields))
+		}
+		buf.Write([]byte{0xB0 + byte(len(v.Fields)), v.Tag})
+		for _, f := range v.Fields {
+			err := pack(buf, f)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("can't pack %T", v)
+	}
+	return nil
+}
+
+func packInt(buf *bytes.Buffer, v int64) {
+	switch {
+	case v >= -16 && v <= 127:
+		buf.WriteByte(byte(int8(v)))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		buf.Write([]byte{0xC8, byte(int8(v))})
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		buf.WriteByte(0xC9)
+		binary.Write(buf, binary.BigEndian, int16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		buf.WriteByte(0xCA)
+		binary.Write(buf, binary.BigEndian, int32(v))
+	default:
+		buf.WriteByte(0xCB)
+		binary.Write(buf, binary.BigEndian, v)
+	}
+}
+
+// packHeader writes the marker and size of a string, list or map. The 8, 16
+// and 32 bit size markers follow on from large.
+func packHeader(buf *bytes.Buffer, size int, tiny, large byte) {
+	switch {
+	case size < 16:
+		buf.WriteByte(tiny + byte(size))
+	case size <= math.MaxUint8:
+		buf.Write([]byte{large, byte(size)})
+	case size <= math.MaxUint16:
+		buf.WriteByte(large + 1)
+		binary.Write(buf, binary.BigEndian, uint16(size))
+	default:
+		buf.WriteByte(large + 2)
+		binary.Write(buf, binary.BigEndian, uint32(size))
+	}
+}
+
+// unpack decodes one PackStream value. Integers are returned as int64,
+// lists as []any and maps as map[string]any.
+func unpack(r *bytes.Reader) (any, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, errUnpack
+	}
+
+	switch {
+	case marker < 0x80:
+		return int64(marker), nil
+	case marker >= 0xF0:
+		return int64(int8(marker)), nil
+	case marker >= 0x80 && marker <= 0x8F:
+		return unpackString(r, int(marker&0x0F))
+	case marker >= 0x90 && marker <= 0x9F:
+		return unpackList(r, int(marker&0x0F))
+	case marker >= 0xA0 && marker <= 0xAF:
+		return unpackMap(r, int(marker&0x0F))
+	case marker >= 0xB0 && marker <= 0xBF:
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, errUnpack
+		}
+		s := &Structure{Tag: tag, Fields: make([]any, marker&0x0F)}
+		for i := range s.Fields {
+			s.Fields[i], err = unpack(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+
+	switch marker {
+	case 0xC0:
+		return nil, nil
+	case 0xC1:
+		var f float64
+		err := binary.Read(r, binary.BigEndian, &f)
+		if err != nil {
+			return nil, errUnpack
+		}
+		return f, nil
+	case 0xC2:
+		return false, nil
+	case 0xC3:
+		return true, nil
+	case 0xC8:
+		var i int8
+		err = binary.Read(r, binary.BigEndian, &i)
+		return int64(i), wrapUnpack(err)
+	case 0xC9:
+		var i int16
+		err = binary.Read(r, binary.BigEndian, &i)
+		return int64(i), wrapUnpack(err)
+	case 0xCA:
+		var i int32
+		err = binary.Read(r, binary.BigEndian, &i)
+		return int64(i), wrapUnpack(err)
+	case 0xCB:
+		var i int64
+		err = binary.Read(r, binary.BigEndian, &i)
+		return i, wrapUnpack(err)
+	case 0xCC, 0xCD, 0xCE:
+		size, err := unpackSize(r, marker-0xCC)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size)
+		_, err = io.ReadFull(r, b)
+		return b, wrapUnpack(err)
+	case 0xD0, 0xD1, 0xD2:
+		size, err := unpackSize(r, marker-0xD0)
+		if err != nil {
+			return nil, err
+		}
+		return unpackString(r, size)
+	case 0xD4, 0xD5, 0xD6:
+		size, err := unpackSize(r, marker-0xD4)
+		if err != nil {
+			return nil, err
+		}
+		return unpackList(r, size)
+	case 0xD8, 0xD9, 0xDA:
+		size, err := unpackSize(r, marker-0xD8)
+		if err != nil {
+			return nil, err
+		}
+		return unpackMap(r, size)
+	}
+
+	return nil, fmt.Errorf("%w: unknown marker %#x", errUnpack, marker)
+}
+
+func wrapUnpack(err error) error {
+	if err != nil {
+		return errUnpack
+	}
+	return nil
+}
+
+// unpackSize reads an 8, 16 or 32 bit size for width 0, 1 or 2
+func unpackSize(r *bytes.Reader, width byte) (int, error) {
+	var size int
+	switch width {
+	case 0:
+		var s uint8
+		err := binary.Read(r, binary.BigEndian, &s)
+		size = int(s)
+		if err != nil {
+			return 0, errUnpack
+		}
+	case 1:
+		var s uint16
+		err := binary.Read(r, binary.BigEndian, &s)
+		size = int(s)
+		if err != nil {
+			return 0, errUnpack
+		}
+	default:
+		var s uint32
+		err := binary.Read(r, binary.BigEndian, &s)
+		size = int(s)
+		if err != nil {
+			return 0, errUnpack
+		}
+	}
+
+	// nothing can be bigger than what's left of the message
+	if size > r.Len() {
+		return 0, errUnpack
+	}
+	return size, nil
+}
+
+func unpackString(r *bytes.Reader, size int) (string, error) {
+	if size > r.Len() {
+		return "", errUnpack
+	}
+	b := make([]byte, size)
+	_, err := io.ReadFull(r, b)
+	return string(b), wrapUnpack(err)
+}
+
+func unpackList(r *bytes.Reader, size int) ([]any, error) {
+	if size > r.Len() {
+		return nil, errUnpack
+	}
+	list := make([]any, size)
+	for i := range list {
+		v, err := unpack(r)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+func unpackMap(r *bytes.Reader, size int) (map[string]any, error) {
+	if size > r.Len() {
+		return nil, errUnpack
+	}
+	m := make(map[string]any, size)
+	for range size {
+		k, err := unpack(r)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: map key is %T", errUnpack, k)
+		}
+		m[key], err = unpack(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
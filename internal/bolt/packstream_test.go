@@ -0,0 +1,44 @@
+package bolt
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	values := []any{
+		nil, true, false,
+		int64(0), int64(-16), int64(-17), int64(127), int64(128), int64(-129),
+		int64(math.MaxInt16 + 1), int64(math.MaxInt32 + 1), int64(math.MinInt64),
+		1.5, "", "hello", strings.Repeat("x", 300), []byte{1, 2, 3},
+		[]any{int64(1), "two", []any{}},
+		map[string]any{"a": int64(1), "b": map[string]any{"c": nil}},
+		&Structure{Tag: 0x10, Fields: []any{"MATCH (n)", map[string]any{}}},
+	}
+
+	for _, v := range values {
+		buf := &bytes.Buffer{}
+		assert.NoError(pack(buf, v))
+		got, err := unpack(bytes.NewReader(buf.Bytes()))
+		assert.NoError(err)
+		assert.Equal(v, got)
+	}
+}
+
+func TestPackEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(pack(buf, map[string]any{"n": int64(-1)}))
+	assert.Equal([]byte{0xA1, 0x81, 'n', 0xFF}, buf.Bytes())
+
+	// sizes larger than what's left are rejected rather than allocated
+	_, err := unpack(bytes.NewReader([]byte{0xD6, 0xFF, 0xFF, 0xFF, 0xFF}))
+	assert.ErrorIs(err, errUnpack)
+}
@@ -0,0 +1,610 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package bolt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// request messages
+const (
+	msgHello     byte = 0x01
+	msgGoodbye   byte = 0x02
+	msgReset     byte = 0x0F
+	msgRun       byte = 0x10
+	msgBegin     byte = 0x11
+	msgCommit    byte = 0x12
+	msgRollback  byte = 0x13
+	msgDiscard   byte = 0x2F
+	msgPull      byte = 0x3F
+	msgTelemetry byte = 0x54
+	msgRoute     byte = 0x66
+	msgLogon     byte = 0x6A
+	msgLogoff    byte = 0x6B
+)
+
+// response messages
+const (
+	msgSuccess byte = 0x70
+	msgRecord  byte = 0x71
+	msgIgnored byte = 0x7E
+	msgFailure byte = 0x7F
+)
+
+// graph structures
+const (
+	tagNode         byte = 0x4E
+	tagRelationship byte = 0x52
+)
+
+const (
+	// ServerAgent is sent to clients, which expect it to start Neo4j/
+	ServerAgent = "Neo4j/5.0.0 (propolis)"
+
+	maxMessageSize = 16 * 1024 * 1024
+	routingTTL     = 300
+	databaseName   = "neo4j"
+)
+
+var handshakeMagic = []byte{0x60, 0x60, 0xB0, 0x17}
+
+// Error is returned by backends to send a failure with a Neo4j status code
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Neo4j status codes used in failures
+const (
+	CodeSyntaxError    = "Neo.ClientError.Statement.SyntaxError"
+	CodeArgumentError  = "Neo.ClientError.Statement.ArgumentError"
+	CodeUnauthorized   = "Neo.ClientError.Security.Unauthorized"
+	CodeForbidden      = "Neo.ClientError.Security.Forbidden"
+	CodeInvalidRequest = "Neo.ClientError.Request.Invalid"
+	CodeRollbackFailed = "Neo.ClientError.Transaction.TransactionRollbackFailed"
+	CodeUnknownError   = "Neo.DatabaseError.General.UnknownError"
+)
+
+// Backend runs the statements sent by clients
+type Backend interface {
+	// Authenticate checks the auth token sent by a client, returning the user
+	// statements are run as
+	Authenticate(scheme, principal, credentials string) (string, error)
+	// Run runs a statement for a user
+	Run(ctx context.Context, user, query string, params map[string]any) (*Result, error)
+}
+
+// Result is the outcome of a statement. Values in records can be anything
+// PackStream encodes as well as *Node and *Relationship.
+type Result struct {
+	Fields  []string
+	Records [][]any
+	// Write is set for statements which changed the graph
+	Write bool
+}
+
+// Node is a graph node. ID is the legacy integer ID and ElementID the
+// string ID used from Bolt 5.
+type Node struct {
+	ID         int64
+	ElementID  string
+	Labels     []string
+	Properties map[string]any
+}
+
+type Relationship struct {
+	ID             int64
+	ElementID      string
+	StartID        int64
+	StartElementID string
+	EndID          int64
+	EndElementID   string
+	Type           string
+	Properties     map[string]any
+}
+
+type version struct {
+	major, minor byte
+}
+
+// supported versions, newest first
+var versions = []version{{5, 4}, {5, 3}, {5, 2}, {5, 1}, {5, 0}, {4, 4}}
+
+type server struct {
+	backend  Backend
+	logger   *slog.Logger
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	nextID   atomic.Int64
+}
+
+// NewServer creates a Bolt server which lets Neo4j drivers run statements
+// against the backend
+func NewServer(backend Backend, logger *slog.Logger) *server {
+	return &server{
+		backend: backend,
+		logger:  logger,
+		conns:   map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts connections until the server is closed
+func (s *server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("accepting connection: %w", err)
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+
+			c := &connection{
+				server: s,
+				conn:   conn,
+				reader: bufio.NewReader(conn),
+				id:     "bolt-" + strconv.FormatInt(s.nextID.Add(1), 10),
+			}
+			err := c.serve()
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Debug("bolt connection closed", "error", err, "remote", conn.RemoteAddr())
+			}
+		}()
+	}
+}
+
+// Close stops accepting connections and closes those open
+func (s *server) Close() error {
+	s.mu.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+type connection struct {
+	server  *server
+	conn    net.Conn
+	reader  *bufio.Reader
+	id      string
+	version version
+	user    string
+	authed  bool
+	failed  bool
+	inTx    bool
+	txWrite bool
+	result  *Result
+	cursor  int
+}
+
+func (c *connection) serve() error {
+	err := c.handshake()
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+
+		if msg.Tag == msgGoodbye {
+			return nil
+		}
+
+		err = c.handle(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handshake agrees the protocol version. Clients propose four versions as
+// [reserved, range, minor, major] where range is how many minor versions
+// below the one given are also acceptable.
+func (c *connection) handshake() error {
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+
+	buf := make([]byte, 20)
+	_, err := io.ReadFull(c.reader, buf)
+	if err != nil {
+		return fmt.Errorf("reading handshake: %w", err)
+	}
+	if !bytes.Equal(buf[:4], handshakeMagic) {
+		return errors.New("not a bolt client")
+	}
+
+	for i := 4; i < 20; i += 4 {
+		rng, minor, major := buf[i+1], buf[i+2], buf[i+3]
+		for _, v := range versions {
+			if v.major == major && v.minor <= minor && int(v.minor) >= int(minor)-int(rng) {
+				c.version = v
+				_, err := c.conn.Write([]byte{0, 0, v.minor, v.major})
+				return err
+			}
+		}
+	}
+
+	c.conn.Write([]byte{0, 0, 0, 0})
+	return errors.New("no supported protocol version")
+}
+
+// readMessage reads a chunked message. Each chunk has a 16 bit size and the
+// message ends with an empty chunk, empty messages are keep alives.
+func (c *connection) readMessage() (*Structure, error) {
+	msg := []byte{}
+	for {
+		var size uint16
+		err := binary.Read(c.reader, binary.BigEndian, &size)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			if len(msg) == 0 {
+				continue
+			}
+			break
+		}
+		if len(msg)+int(size) > maxMessageSize {
+			return nil, errors.New("message too large")
+		}
+		chunk := make([]byte, size)
+		_, err = io.ReadFull(c.reader, chunk)
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, chunk...)
+	}
+
+	v, err := unpack(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	s, ok := v.(*Structure)
+	if !ok {
+		return nil, fmt.Errorf("%w: message is %T", errUnpack, v)
+	}
+	return s, nil
+}
+
+func (c *connection) writeMessage(tag byte, fields ...any) error {
+	buf := &bytes.Buffer{}
+	err := pack(buf, &Structure{Tag: tag, Fields: c.encode(fields).([]any)})
+	if err != nil {
+		return err
+	}
+
+	out := &bytes.Buffer{}
+	data := buf.Bytes()
+	for len(data) > 0 {
+		n := min(len(data), 0xFFFF)
+		binary.Write(out, binary.BigEndian, uint16(n))
+		out.Write(data[:n])
+		data = data[n:]
+	}
+	out.Write([]byte{0, 0})
+
+	_, err = c.conn.Write(out.Bytes())
+	return err
+}
+
+// encode turns graph values into the structures for the agreed version
+func (c *connection) encode(v any) any {
+	switch v := v.(type) {
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = c.encode(item)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			out[k] = c.encode(item)
+		}
+		return out
+	case *Node:
+		fields := []any{v.ID, v.Labels, properties(v.Properties)}
+		if c.version.major >= 5 {
+			fields = append(fields, v.ElementID)
+		}
+		return &Structure{Tag: tagNode, Fields: fields}
+	case *Relationship:
+		fields := []any{v.ID, v.StartID, v.EndID, v.Type, properties(v.Properties)}
+		if c.version.major >= 5 {
+			fields = append(fields, v.ElementID, v.StartElementID, v.EndElementID)
+		}
+		return &Structure{Tag: tagRelationship, Fields: fields}
+	}
+	return v
+}
+
+func properties(p map[string]any) map[string]any {
+	if p == nil {
+		return map[string]any{}
+	}
+	return p
+}
+
+func (c *connection) success(metadata map[string]any) error {
+	return c.writeMessage(msgSuccess, metadata)
+}
+
+// fail sends a failure, after which everything but RESET is ignored
+func (c *connection) fail(err error) error {
+	c.failed = true
+	c.result = nil
+
+	boltErr := &Error{}
+	if !errors.As(err, &boltErr) {
+		c.server.logger.Error("running bolt request", "error", err)
+		boltErr = &Error{Code: CodeUnknownError, Message: err.Error()}
+	}
+	return c.writeMessage(msgFailure, map[string]any{
+		"code":    boltErr.Code,
+		"message": boltErr.Message,
+	})
+}
+
+func (c *connection) handle(msg *Structure) error {
+	if msg.Tag == msgReset {
+		c.failed = false
+		c.result = nil
+		c.inTx = false
+		c.txWrite = false
+		return c.success(map[string]any{})
+	}
+
+	if c.failed {
+		return c.writeMessage(msgIgnored)
+	}
+
+	switch msg.Tag {
+	case msgHello:
+		extra := mapField(msg, 0)
+		// auth moved to LOGON in 5.1
+		if c.version.major < 5 || (c.version.major == 5 && c.version.minor == 0) {
+			err := c.authenticate(extra)
+			if err != nil {
+				c.fail(err)
+				return err
+			}
+		}
+		return c.success(map[string]any{
+			"server":        ServerAgent,
+			"connection_id": c.id,
+			"hints":         map[string]any{},
+		})
+	case msgLogon:
+		err := c.authenticate(mapField(msg, 0))
+		if err != nil {
+			c.fail(err)
+			return err
+		}
+		return c.success(map[string]any{})
+	case msgLogoff:
+		c.authed = false
+		c.user = ""
+		return c.success(map[string]any{})
+	}
+
+	if !c.authed {
+		return c.fail(&Error{Code: CodeUnauthorized, Message: "not authenticated"})
+	}
+
+	switch msg.Tag {
+	case msgRun:
+		return c.run(msg)
+	case msgPull:
+		return c.pull(mapField(msg, 0), false)
+	case msgDiscard:
+		return c.pull(mapField(msg, 0), true)
+	case msgBegin:
+		c.inTx = true
+		c.txWrite = false
+		return c.success(map[string]any{})
+	case msgCommit:
+		c.inTx = false
+		return c.success(map[string]any{"bookmark": "propolis:" + c.id})
+	case msgRollback:
+		// statements take effect as they run so a transaction which wrote
+		// can't be rolled back
+		wrote := c.txWrite
+		c.inTx = false
+		c.txWrite = false
+		if wrote {
+			return c.fail(&Error{
+				Code:    CodeRollbackFailed,
+				Message: "statements are published as they run and can't be rolled back",
+			})
+		}
+		return c.success(map[string]any{})
+	case msgRoute:
+		return c.route()
+	case msgTelemetry:
+		return c.success(map[string]any{})
+	}
+
+	return c.fail(&Error{
+		Code:    CodeInvalidRequest,
+		Message: fmt.Sprintf("unsupported message %#x", msg.Tag),
+	})
+}
+
+func mapField(msg *Structure, i int) map[string]any {
+	if i >= len(msg.Fields) {
+		return map[string]any{}
+	}
+	m, _ := msg.Fields[i].(map[string]any)
+	if m == nil {
+		return map[string]any{}
+	}
+	return m
+}
+
+func (c *connection) authenticate(auth map[string]any) error {
+	scheme, _ := auth["scheme"].(string)
+	principal, _ := auth["principal"].(string)
+	credentials, _ := auth["credentials"].(string)
+
+	user, err := c.server.backend.Authenticate(scheme, principal, credentials)
+	if err != nil {
+		return err
+	}
+	c.user = user
+	c.authed = true
+	return nil
+}
+
+func (c *connection) run(msg *Structure) error {
+	if len(msg.Fields) < 1 {
+		return c.fail(&Error{Code: CodeInvalidRequest, Message: "RUN without a statement"})
+	}
+	query, _ := msg.Fields[0].(string)
+	params := mapField(msg, 1)
+
+	res, err := c.server.backend.Run(context.Background(), c.user, query, params)
+	if err != nil {
+		return c.fail(err)
+	}
+	if res.Fields == nil {
+		res.Fields = []string{}
+	}
+
+	c.result = res
+	c.cursor = 0
+	if res.Write && c.inTx {
+		c.txWrite = true
+	}
+
+	metadata := map[string]any{
+		"fields":  res.Fields,
+		"t_first": int64(0),
+	}
+	if c.inTx {
+		metadata["qid"] = int64(0)
+	}
+	return c.success(metadata)
+}
+
+// pull streams up to n records of the last result, or skips them if discard
+// is set. n of -1 means all of them.
+func (c *connection) pull(extra map[string]any, discard bool) error {
+	if c.result == nil {
+		return c.fail(&Error{Code: CodeInvalidRequest, Message: "no result to pull"})
+	}
+
+	n, ok := extra["n"].(int64)
+	if !ok || n < 0 {
+		n = int64(len(c.result.Records))
+	}
+
+	end := min(c.cursor+int(n), len(c.result.Records))
+	if !discard {
+		for _, record := range c.result.Records[c.cursor:end] {
+			err := c.writeMessage(msgRecord, record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	c.cursor = end
+
+	if c.cursor < len(c.result.Records) && !discard {
+		return c.success(map[string]any{"has_more": true})
+	}
+
+	typ := "r"
+	if c.result.Write {
+		typ = "w"
+	}
+	c.result = nil
+
+	metadata := map[string]any{
+		"type":   typ,
+		"t_last": int64(0),
+		"db":     databaseName,
+	}
+	if !c.inTx {
+		metadata["bookmark"] = "propolis:" + c.id
+	}
+	return c.success(metadata)
+}
+
+// route tells routing drivers to send everything to this server
+func (c *connection) route() error {
+	addr := c.conn.LocalAddr().String()
+	servers := []any{}
+	for _, role := range []string{"ROUTE", "READ", "WRITE"} {
+		servers = append(servers, map[string]any{
+			"addresses": []any{addr},
+			"role":      role,
+		})
+	}
+	return c.success(map[string]any{
+		"rt": map[string]any{
+			"ttl":     int64(routingTTL),
+			"db":      databaseName,
+			"servers": servers,
+		},
+	})
+}
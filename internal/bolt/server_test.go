@@ -0,0 +1,170 @@
+package bolt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBackend struct {
+	queries []string
+}
+
+func (b *fakeBackend) Authenticate(scheme, principal, credentials string) (string, error) {
+	if credentials != "secret" {
+		return "", &Error{Code: CodeUnauthorized, Message: "bad credentials"}
+	}
+	return principal, nil
+}
+
+func (b *fakeBackend) Run(ctx context.Context, user, query string, params map[string]any) (*Result, error) {
+	b.queries = append(b.queries, query)
+	if query == "bad" {
+		return nil, &Error{Code: CodeSyntaxError, Message: "syntax error"}
+	}
+	return &Result{
+		Fields: []string{"n"},
+		Records: [][]any{
+			{&Node{ID: 1, ElementID: "a", Labels: []string{"Post"}, Properties: map[string]any{"text": "hello"}}},
+			{&Node{ID: 2, ElementID: "b", Labels: []string{"Post"}}},
+		},
+	}, nil
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	// the reader buffers ahead so is kept between messages
+	reader *connection
+}
+
+func dial(t *testing.T, backend Backend, proposal ...byte) (*testClient, []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	s := NewServer(backend, slog.Default())
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+
+	hs := append([]byte{}, handshakeMagic...)
+	hs = append(hs, proposal...)
+	hs = append(hs, make([]byte, 20-len(hs))...)
+	conn.Write(hs)
+
+	agreed := make([]byte, 4)
+	_, err = io.ReadFull(conn, agreed)
+	assert.NoError(t, err)
+	return &testClient{t: t, conn: conn, reader: &connection{reader: bufio.NewReader(conn)}}, agreed
+}
+
+func (c *testClient) send(tag byte, fields ...any) {
+	buf := &bytes.Buffer{}
+	assert.NoError(c.t, pack(buf, &Structure{Tag: tag, Fields: fields}))
+	msg := binary.BigEndian.AppendUint16(nil, uint16(buf.Len()))
+	msg = append(msg, buf.Bytes()...)
+	msg = append(msg, 0, 0)
+	c.conn.Write(msg)
+}
+
+func (c *testClient) receive() *Structure {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := c.reader.readMessage()
+	assert.NoError(c.t, err)
+	return msg
+}
+
+func TestHandshake(t *testing.T) {
+	// 5.6 down to 5.2 is offered so 5.4 is agreed
+	_, agreed := dial(t, &fakeBackend{}, 0, 4, 6, 5)
+	assert.Equal(t, []byte{0, 0, 4, 5}, agreed)
+
+	_, agreed = dial(t, &fakeBackend{}, 0, 0, 4, 4)
+	assert.Equal(t, []byte{0, 0, 4, 4}, agreed)
+
+	_, agreed = dial(t, &fakeBackend{}, 0, 0, 0, 3)
+	assert.Equal(t, []byte{0, 0, 0, 0}, agreed)
+}
+
+func TestSession(t *testing.T) {
+	assert := assert.New(t)
+	backend := &fakeBackend{}
+	c, _ := dial(t, backend, 0, 0, 4, 5)
+
+	c.send(msgHello, map[string]any{"user_agent": "test"})
+	assert.Equal(msgSuccess, c.receive().Tag)
+
+	// nothing runs before logging on
+	c.send(msgRun, "MATCH (n)", map[string]any{}, map[string]any{})
+	assert.Equal(msgFailure, c.receive().Tag)
+	c.send(msgReset)
+	assert.Equal(msgSuccess, c.receive().Tag)
+
+	c.send(msgLogon, map[string]any{"scheme": "basic", "principal": "neo4j", "credentials": "secret"})
+	assert.Equal(msgSuccess, c.receive().Tag)
+
+	c.send(msgRun, "MATCH (n)", map[string]any{}, map[string]any{})
+	msg := c.receive()
+	assert.Equal(msgSuccess, msg.Tag)
+	assert.Equal([]any{"n"}, msg.Fields[0].(map[string]any)["fields"])
+
+	c.send(msgPull, map[string]any{"n": int64(1)})
+	msg = c.receive()
+	assert.Equal(msgRecord, msg.Tag)
+	node := msg.Fields[0].([]any)[0].(*Structure)
+	assert.Equal(tagNode, node.Tag)
+	assert.Equal([]any{int64(1), []any{"Post"}, map[string]any{"text": "hello"}, "a"}, node.Fields)
+	msg = c.receive()
+	assert.Equal(true, msg.Fields[0].(map[string]any)["has_more"])
+
+	c.send(msgPull, map[string]any{"n": int64(-1)})
+	assert.Equal(msgRecord, c.receive().Tag)
+	msg = c.receive()
+	assert.Equal(msgSuccess, msg.Tag)
+	assert.Equal("r", msg.Fields[0].(map[string]any)["type"])
+
+	// after a failure messages are ignored until a reset
+	c.send(msgRun, "bad", map[string]any{}, map[string]any{})
+	msg = c.receive()
+	assert.Equal(msgFailure, msg.Tag)
+	assert.Equal(CodeSyntaxError, msg.Fields[0].(map[string]any)["code"])
+	c.send(msgPull, map[string]any{"n": int64(-1)})
+	assert.Equal(msgIgnored, c.receive().Tag)
+	c.send(msgReset)
+	assert.Equal(msgSuccess, c.receive().Tag)
+
+	assert.Equal([]string{"MATCH (n)", "bad"}, backend.queries)
+}
+
+func TestBolt44Structures(t *testing.T) {
+	assert := assert.New(t)
+	c, _ := dial(t, &fakeBackend{}, 0, 0, 4, 4)
+
+	// 4.4 sends credentials with hello
+	c.send(msgHello, map[string]any{"scheme": "basic", "principal": "neo4j", "credentials": "secret"})
+	assert.Equal(msgSuccess, c.receive().Tag)
+
+	c.send(msgRun, "MATCH (n)", map[string]any{}, map[string]any{})
+	c.receive()
+	c.send(msgPull, map[string]any{"n": int64(1)})
+	node := c.receive().Fields[0].([]any)[0].(*Structure)
+	assert.Len(node.Fields, 3)
+}
+
+func TestBadCredentials(t *testing.T) {
+	c, _ := dial(t, &fakeBackend{}, 0, 0, 4, 4)
+	c.send(msgHello, map[string]any{"scheme": "basic", "principal": "neo4j", "credentials": "wrong"})
+	msg := c.receive()
+	assert.Equal(t, msgFailure, msg.Tag)
+	assert.Equal(t, CodeUnauthorized, msg.Fields[0].(map[string]any)["code"])
+}
@@ -0,0 +1,311 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+// Package chaos wraps node transports to inject faults: latency, dropped
+// requests and responses, duplicate deliveries and reordering. It is for
+// integration tests and the simulator, where it checks that deduplication,
+// retries and anti-entropy cope with an unreliable network, and isn't used by
+// nodes outside of tests. The faults are chosen from a seed so runs are
+// repeatable.
+package chaos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/node"
+)
+
+var (
+	ErrDropped      = errors.New("request dropped by fault injection")
+	ErrResponseLost = errors.New("response lost by fault injection")
+)
+
+// Config is the faults injected into a transport's requests. Each chance is
+// from 0 to 1 and is taken independently for every request.
+type Config struct {
+	// Seed makes the faults repeatable
+	Seed int64
+	// Latency is added to each request
+	Latency time.Duration
+	// Jitter is the most that is randomly added to Latency
+	Jitter time.Duration
+	// Drop is the chance a request is lost before it is delivered
+	Drop float64
+	// DropResponse is the chance the response is lost after the request was
+	// delivered, so the receiver acted on a request the sender thinks failed
+	DropResponse float64
+	// Duplicate is the chance a request is delivered twice
+	Duplicate float64
+	// Reorder is the chance a request is held back for ReorderDelay so that
+	// requests sent after it overtake it. The sender is answered straight
+	// away with 202 Accepted, as for a message still in flight, so it is
+	// meant for one way requests such as /publish; limit it with Paths.
+	Reorder float64
+	// ReorderDelay is how long reordered requests are held back
+	ReorderDelay time.Duration
+	// Paths limits the faults to requests whose path starts with one of
+	// these, all requests when empty
+	Paths []string
+}
+
+// Stats counts the faults a transport injected
+type Stats struct {
+	Requests      int
+	Dropped       int
+	ResponsesLost int
+	Duplicated    int
+	Reordered     int
+}
+
+// Transport injects faults into the requests sent through another transport.
+// Requests it receives are passed on untouched.
+type Transport struct {
+	node.Transport
+
+	mu     sync.Mutex
+	config Config
+	rng    *rand.Rand
+	stats  Stats
+	wg     sync.WaitGroup
+}
+
+// Wrap injects the configured faults into the requests sent through t
+func Wrap(t node.Transport, config Config) *Transport {
+	return &Transport{
+		Transport: t,
+		config:    config,
+		rng:       rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+// Factory wraps every transport factory creates, with the config for the
+// node's address
+func Factory(factory node.TransportFactory, config Config) node.TransportFactory {
+	return func(addr string) ([]node.Transport, error) {
+		transports, err := factory(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		wrapped := make([]node.Transport, 0, len(transports))
+		for _, t := range transports {
+			wrapped = append(wrapped, Wrap(t, config.ForAddr(addr)))
+		}
+		return wrapped, nil
+	}
+}
+
+// ForAddr returns the config with the seed mixed with a node's address, so
+// that nodes sharing a config don't fail in step
+func (c Config) ForAddr(addr string) Config {
+	h := fnv.New64a()
+	h.Write([]byte(addr))
+	c.Seed ^= int64(h.Sum64())
+	return c
+}
+
+// SetConfig changes the faults injected from the next request. The random
+// source carries on from where it was.
+func (t *Transport) SetConfig(config Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config = config
+}
+
+// Stats returns the faults injected so far
+func (t *Transport) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// fate is what happens to one request
+type fate struct {
+	delay        time.Duration
+	drop         bool
+	dropResponse bool
+	duplicate    bool
+	reorder      bool
+	reorderDelay time.Duration
+}
+
+// decide draws the fate of a request, false if it is left alone
+func (t *Transport) decide(req *http.Request) (fate, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.config
+	if len(c.Paths) > 0 && !hasPrefix(req.URL.Path, c.Paths) {
+		return fate{}, false
+	}
+
+	// every choice is drawn for every request so that changing one chance
+	// doesn't change the others' outcomes
+	f := fate{delay: c.Latency, reorderDelay: c.ReorderDelay}
+	jitter := t.rng.Float64()
+	f.drop = t.rng.Float64() < c.Drop
+	f.dropResponse = t.rng.Float64() < c.DropResponse
+	f.duplicate = t.rng.Float64() < c.Duplicate
+	f.reorder = t.rng.Float64() < c.Reorder
+	if c.Jitter > 0 {
+		f.delay += time.Duration(jitter * float64(c.Jitter))
+	}
+
+	// a dropped request suffers nothing else, and nobody waits for the
+	// response of a reordered one
+	switch {
+	case f.drop:
+		f = fate{delay: f.delay, drop: true}
+	case f.reorder:
+		f.dropResponse = false
+	}
+
+	t.stats.Requests++
+	if f.drop {
+		t.stats.Dropped++
+	}
+	if f.reorder {
+		t.stats.Reordered++
+	}
+	if f.duplicate {
+		t.stats.Duplicated++
+	}
+	return f, true
+}
+
+func hasPrefix(path string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, ok := t.decide(req)
+	if !ok {
+		return t.Transport.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	err := sleep(ctx, f.delay)
+	if err != nil {
+		return nil, err
+	}
+	if f.drop {
+		return nil, fmt.Errorf("%s: %w", req.URL.Host, ErrDropped)
+	}
+
+	// the body is read once so the request can be sent more than once
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %w", err)
+		}
+	}
+
+	if f.reorder {
+		// the request outlives the sender's context, as it would on the wire
+		held := cloneRequest(context.WithoutCancel(ctx), req, body)
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			time.Sleep(f.reorderDelay)
+			resp, err := t.send(held, body, f.duplicate)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return &http.Response{
+			Status:     http.StatusText(http.StatusAccepted),
+			StatusCode: http.StatusAccepted,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+
+	resp, err := t.send(cloneRequest(ctx, req, body), body, f.duplicate)
+	if err != nil {
+		return nil, err
+	}
+	if f.dropResponse {
+		resp.Body.Close()
+		t.mu.Lock()
+		t.stats.ResponsesLost++
+		t.mu.Unlock()
+		return nil, fmt.Errorf("%s: %w", req.URL.Host, ErrResponseLost)
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// send delivers a request, twice if it is duplicated, and returns the last
+// response
+func (t *Transport) send(req *http.Request, body []byte, duplicate bool) (*http.Response, error) {
+	if duplicate {
+		resp, err := t.Transport.RoundTrip(cloneRequest(req.Context(), req, body))
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// Close waits for reordered requests to be delivered before closing the
+// transport
+func (t *Transport) Close() error {
+	t.wg.Wait()
+	return t.Transport.Close()
+}
+
+func cloneRequest(ctx context.Context, req *http.Request, body []byte) *http.Request {
+	r := req.Clone(ctx)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return r
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
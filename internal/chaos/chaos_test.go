@@ -0,0 +1,123 @@
+package chaos
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a transport which answers every request itself and remembers
+// the bodies it received, in order
+type recorder struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (r *recorder) Name() string                      { return "recorder" }
+func (r *recorder) Listen(handler http.Handler) error { return nil }
+func (r *recorder) CloseIdleConnections()             {}
+func (r *recorder) Close() error                      { return nil }
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.bodies = append(r.bodies, string(body))
+	r.mu.Unlock()
+
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(http.StatusOK)
+	return rec.Result(), nil
+}
+
+func (r *recorder) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.bodies...)
+}
+
+func post(t *testing.T, transport http.RoundTripper, path, body string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", "https://10.0.0.2:9000"+path, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestFaults(t *testing.T) {
+	assert := assert.New(t)
+
+	// dropped requests never arrive
+	r := &recorder{}
+	tr := Wrap(r, Config{Drop: 1})
+	_, err := post(t, tr, "/publish", "a")
+	assert.ErrorIs(err, ErrDropped)
+	assert.Empty(r.received())
+
+	// lost responses fail requests which arrived
+	r = &recorder{}
+	tr = Wrap(r, Config{DropResponse: 1})
+	_, err = post(t, tr, "/publish", "a")
+	assert.ErrorIs(err, ErrResponseLost)
+	assert.Equal([]string{"a"}, r.received())
+
+	// duplicates arrive twice
+	r = &recorder{}
+	tr = Wrap(r, Config{Duplicate: 1})
+	resp, err := post(t, tr, "/publish", "a")
+	require.NoError(t, err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal([]string{"a", "a"}, r.received())
+
+	// a held back request is overtaken by the next
+	r = &recorder{}
+	tr = Wrap(r, Config{Reorder: 1, ReorderDelay: 50 * time.Millisecond})
+	resp, err = post(t, tr, "/publish", "first")
+	require.NoError(t, err)
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+	tr.SetConfig(Config{})
+	_, err = post(t, tr, "/publish", "second")
+	require.NoError(t, err)
+	assert.NoError(tr.Close())
+	assert.Equal([]string{"second", "first"}, r.received())
+	assert.Equal(Stats{Requests: 2, Reordered: 1}, tr.Stats())
+
+	// only the listed paths suffer
+	r = &recorder{}
+	tr = Wrap(r, Config{Drop: 1, Paths: []string{"/publish"}})
+	_, err = post(t, tr, "/ping", "a")
+	assert.NoError(err)
+	assert.Equal(Stats{}, tr.Stats())
+}
+
+func TestFaultsAreRepeatable(t *testing.T) {
+	assert := assert.New(t)
+
+	outcomes := func(seed int64) []bool {
+		tr := Wrap(&recorder{}, Config{Seed: seed, Drop: 0.5})
+		dropped := []bool{}
+		for range 64 {
+			_, err := post(t, tr, "/publish", "a")
+			dropped = append(dropped, errors.Is(err, ErrDropped))
+		}
+		return dropped
+	}
+
+	first := outcomes(42)
+	assert.Equal(first, outcomes(42))
+	assert.NotEqual(first, outcomes(43))
+	assert.Contains(first, true)
+	assert.Contains(first, false)
+}
@@ -0,0 +1,40 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package graph
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// checkpointTimeout allows for copying a large graph
+const checkpointTimeout = 10 * time.Minute
+
+// Checkpoint writes a consistent copy of the graph database to a new file.
+// The copy is an ordinary database which New can open, the file must not
+// already exist.
+func (e *executor) Checkpoint(path string) error {
+	ctx, cancelFn := context.WithTimeout(context.Background(), checkpointTimeout)
+	defer cancelFn()
+
+	_, err := e.store.db.ExecContext(ctx, "vacuum into ?", path)
+	if err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	return nil
+}
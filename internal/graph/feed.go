@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package graph
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// FeedQuery selects the newest nodes with a label which belong to one of the
+// owners or match one of the topics, either themselves or through a node
+// they are related to. Topics are a label or Label:key=value, as subscribed
+// to. A query with no owners or topics follows nothing so returns nothing.
+type FeedQuery struct {
+	Label  string
+	Owners []string
+	Topics []string
+	// Before continues from the last node of the previous page
+	Before *FeedCursor
+	Limit  int
+}
+
+// FeedCursor is the position of a node in a feed, newest first
+type FeedCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// Feed returns a page of the nodes selected by the query, newest first
+func (e *executor) Feed(q FeedQuery) ([]*NodeRecord, error) {
+	if len(q.Owners) == 0 && len(q.Topics) == 0 {
+		return []*NodeRecord{}, nil
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	query := strings.Builder{}
+	query.WriteString(`select n.* from nodes n where exists (select 1 from node_labels l where l.node_id = n.id and l.label = ?)`)
+	args := []any{q.Label}
+
+	follows := []string{}
+	for _, owner := range q.Owners {
+		follows = append(follows, `n.owner_id = ?`)
+		args = append(args, owner)
+	}
+	for _, topic := range q.Topics {
+		self, sargs := topicCondition("n.id", topic)
+		right, rargs := topicCondition("r.right_node_id", topic)
+		left, largs := topicCondition("r.left_node_id", topic)
+		follows = append(follows, `(`+self+` or exists (
+			select 1 from relations r
+			where (r.left_node_id = n.id and `+right+`)
+			or (r.right_node_id = n.id and `+left+`)))`)
+		args = append(args, sargs...)
+		args = append(args, rargs...)
+		args = append(args, largs...)
+	}
+	query.WriteString(` and (` + strings.Join(follows, ` or `) + `)`)
+
+	if q.Before != nil {
+		query.WriteString(` and (n.created_at < ? or (n.created_at = ? and n.id < ?))`)
+		args = append(args, q.Before.CreatedAt, q.Before.CreatedAt, q.Before.ID)
+	}
+
+	query.WriteString(` order by n.created_at desc, n.id desc limit ?`)
+	args = append(args, q.Limit)
+
+	return e.nodeRecords(ctx, e.store.db, query.String(), args...)
+}
+
+// topicCondition returns a condition on a node ID column matching nodes with
+// the topic's label and, if it has one, attribute value
+func topicCondition(column, topic string) (string, []any) {
+	label, attr, ok := strings.Cut(topic, ":")
+	cond := `exists (select 1 from node_labels tl where tl.node_id = ` + column + ` and tl.label = ?)`
+	if !ok {
+		return cond, []any{label}
+	}
+
+	key, value, _ := strings.Cut(attr, "=")
+	cond += ` and exists (select 1 from node_attributes ta where ta.node_id = ` + column + ` and ta.attr_name = ? and ta.attr_value = ?)`
+	return cond, []any{label, key, value}
+}
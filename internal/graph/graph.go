@@ -37,13 +37,22 @@ var (
 )
 
 type Config struct {
-	GraphDatabaseURL string
-	Logger           *slog.Logger
+	GraphDatabaseURL string `mapstructure:"graph_db"`
+	// SchemaValidation checks MERGEs against the label schemas declared in
+	// the graph, logging those which violate them with warn and refusing
+	// them with reject. Empty turns checking off.
+	SchemaValidation string `mapstructure:"schema_validation"`
+	// SchemaOwners are the identities whose schemas are used, anyone's if
+	// empty
+	SchemaOwners []string     `mapstructure:"schema_owners"`
+	Logger       *slog.Logger `mapstructure:"-"`
 }
 
 type executor struct {
-	store  *store
-	logger *slog.Logger
+	store            *store
+	logger           *slog.Logger
+	schemaValidation string
+	schemaOwners     []string
 }
 
 func New(config Config) (*executor, error) {
@@ -53,11 +62,18 @@ func New(config Config) (*executor, error) {
 	}
 
 	return &executor{
-		logger: config.Logger,
-		store:  s,
+		logger:           config.Logger,
+		store:            s,
+		schemaValidation: config.SchemaValidation,
+		schemaOwners:     config.SchemaOwners,
 	}, nil
 }
 
+// Close closes the graph database
+func (e *executor) Close() error {
+	return e.store.Close()
+}
+
 func (e *executor) Execute(action Action) (any, error) {
 	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
 	defer cancelFn()
@@ -67,30 +83,194 @@ func (e *executor) Execute(action Action) (any, error) {
 		return nil, fmt.Errorf("creating tx: %w", err)
 	}
 
+	res, err := e.execute(action, newPreparedTx(tx))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("commiting changes: %w", err)
+	}
+
+	return res, nil
+}
+
+// execute runs an action's command in a transaction, leaving the caller to
+// commit or roll it back
+func (e *executor) execute(action Action, tx *preparedTx) (any, error) {
 	var res any
+	var err error
 	switch action.Command.Type() {
 	case ast.EntityTypeMergeCmd:
+		err = e.validateMerge(action, tx.Tx)
+		if err != nil {
+			return nil, err
+		}
 		res, err = e.finaliseMergeCmd(action.Command, action.Identity, action.ID, tx)
+		if err == nil {
+			err = e.refreshViews(touchedEntities(res), tx.Tx)
+		}
 	case ast.EntityTypeMatchCmd:
-		res, err = e.finaliseMatchCmd(action.Command, action.Identity, tx)
+		res, err = e.finaliseMatchCmd(action.Command, action.Readable, tx.Tx)
 	default:
 		return nil, fmt.Errorf("unknown command: %v", action.Command)
 	}
 
 	if err != nil {
-		tx.Rollback()
 		return nil, fmt.Errorf("finalising node: %w", err)
 	}
 
+	return res, nil
+}
+
+// PurgeIdentity deletes all nodes and relations owned by the given identity,
+// along with any relations which reference its nodes. It returns the number of
+// nodes and relations removed.
+func (e *executor) PurgeIdentity(identity string) (int, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	tx, err := e.store.CreateTx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("creating tx: %w", err)
+	}
+
+	relations := `select id from relations
+		where owner_id = ?
+		or left_node_id in (select id from nodes where owner_id = ?)
+		or right_node_id in (select id from nodes where owner_id = ?)`
+
+	stmts := []struct {
+		sql   string
+		args  []any
+		count bool
+	}{
+		{`delete from relation_labels where relation_id in (` + relations + `)`, []any{identity, identity, identity}, false},
+		{`delete from relation_attributes where relation_id in (` + relations + `)`, []any{identity, identity, identity}, false},
+		{`delete from relations where id in (` + relations + `)`, []any{identity, identity, identity}, true},
+		{`delete from node_labels where node_id in (select id from nodes where owner_id = ?)`, []any{identity}, false},
+		{`delete from node_attributes where node_id in (select id from nodes where owner_id = ?)`, []any{identity}, false},
+		{`delete from nodes where owner_id = ?`, []any{identity}, true},
+	}
+
+	count := 0
+	for _, stmt := range stmts {
+		res, err := tx.Exec(stmt.sql, stmt.args...)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("purging identity: %w", err)
+		}
+		if stmt.count {
+			n, err := res.RowsAffected()
+			if err != nil {
+				tx.Rollback()
+				return 0, fmt.Errorf("counting purged entities: %w", err)
+			}
+			count += int(n)
+		}
+	}
+
+	err = e.rebuildViews(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = recountStats(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
 	err = tx.Commit()
 	if err != nil {
-		return nil, fmt.Errorf("commiting changes: %w", err)
+		return 0, fmt.Errorf("commiting changes: %w", err)
 	}
 
-	return res, nil
+	return count, nil
 }
 
-func (e *executor) finaliseNode(n ast.Entity, ownerID, actionID string, tx *sqlx.Tx) (*Node, error) {
+// PurgeActions deletes the graph entities last written by any of the given
+// actions, along with any relations which reference deleted nodes. Entities
+// which have since been updated by other actions are left alone. It returns
+// the number of nodes and relations removed.
+func (e *executor) PurgeActions(actionIDs []string) (int, error) {
+	if len(actionIDs) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	tx, err := e.store.CreateTx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("creating tx: %w", err)
+	}
+
+	nodes := `select id from nodes where last_action_id in (?)`
+	relations := `select id from relations
+		where last_action_id in (?)
+		or left_node_id in (` + nodes + `)
+		or right_node_id in (` + nodes + `)`
+
+	stmts := []struct {
+		sql   string
+		args  []any
+		count bool
+	}{
+		{`delete from relation_labels where last_action_id in (?) or relation_id in (` + relations + `)`, []any{actionIDs, actionIDs, actionIDs, actionIDs}, false},
+		{`delete from relation_attributes where last_action_id in (?) or relation_id in (` + relations + `)`, []any{actionIDs, actionIDs, actionIDs, actionIDs}, false},
+		{`delete from relations where id in (` + relations + `)`, []any{actionIDs, actionIDs, actionIDs}, true},
+		{`delete from node_labels where last_action_id in (?) or node_id in (` + nodes + `)`, []any{actionIDs, actionIDs}, false},
+		{`delete from node_attributes where last_action_id in (?) or node_id in (` + nodes + `)`, []any{actionIDs, actionIDs}, false},
+		{`delete from nodes where last_action_id in (?)`, []any{actionIDs}, true},
+	}
+
+	count := 0
+	for _, stmt := range stmts {
+		query, args, err := sqlx.In(stmt.sql, stmt.args...)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("building purge query: %w", err)
+		}
+		res, err := tx.Exec(tx.Rebind(query), args...)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("purging actions: %w", err)
+		}
+		if stmt.count {
+			n, err := res.RowsAffected()
+			if err != nil {
+				tx.Rollback()
+				return 0, fmt.Errorf("counting purged entities: %w", err)
+			}
+			count += int(n)
+		}
+	}
+
+	err = e.rebuildViews(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = recountStats(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("commiting changes: %w", err)
+	}
+
+	return count, nil
+}
+
+func (e *executor) finaliseNode(n ast.Entity, ownerID, actionID string, tx *preparedTx) (*Node, error) {
 	now := time.Now().UTC()
 
 	node, err := e.findNode(n, tx)
@@ -100,54 +280,77 @@ func (e *executor) finaliseNode(n ast.Entity, ownerID, actionID string, tx *sqlx
 		}
 	}
 
-	if node == nil {
+	upsert := func() error {
+		node.LastActionID = actionID
+		_, err := tx.namedExec(`
+			insert into nodes(id, created_at, owner_id, last_action_id)
+			values(:id, :created_at, :owner_id, :last_action_id)
+			on conflict(id) do update
+			set updated_at = :updated_at, last_action_id = :last_action_id`, node)
+		if err != nil {
+			return fmt.Errorf("upserting node: %w", err)
+		}
+		return nil
+	}
+
+	// new nodes are written first so their labels and attributes can refer
+	// to them, existing ones only if the labels or attributes changed
+	existing := node != nil
+	if !existing {
 		node = &Node{
 			ID:        model.NewID(),
 			CreatedAt: now,
 			OwnerID:   ownerID,
 		}
-	} else {
-		if node.OwnerID != ownerID {
-			return nil, ErrUnauthorized
+		// an id names the node, so later merges with it change this one
+		// rather than creating another
+		if id, ok := n.Attribute("id"); ok && id != "" {
+			node.ID = id
 		}
-		node.UpdatedAt = &now
-	}
-
-	node.LastActionID = actionID
-
-	_, err = tx.NamedExec(`
-		insert into nodes(id, created_at, owner_id, last_action_id)
-		values(:id, :created_at, :owner_id, :last_action_id)
-		on conflict(id) do update
-		set updated_at = :updated_at, last_action_id = :last_action_id`, node)
-	if err != nil {
-		return nil, fmt.Errorf("upserting node: %w", err)
+		err = upsert()
+		if err != nil {
+			return nil, err
+		}
+	} else if node.OwnerID != ownerID {
+		return nil, ErrUnauthorized
 	}
 
-	node.labels, err = e.finaliseNodeLabels(node.ID, n, ownerID, actionID, tx)
+	var labelsChanged, attrsChanged bool
+	node.labels, labelsChanged, err = e.finaliseNodeLabels(node.ID, n, ownerID, actionID, tx)
 	if err != nil {
 		return nil, fmt.Errorf("finalising labels: %w", err)
 	}
 
-	node.attributes, err = e.finaliseNodeAttributes(node.ID, n, ownerID, actionID, tx)
+	node.attributes, attrsChanged, err = e.finaliseNodeAttributes(node.ID, n, ownerID, actionID, tx)
 	if err != nil {
 		return nil, fmt.Errorf("finalising attrs: %w", err)
 	}
 
+	if existing {
+		node.Unchanged = !labelsChanged && !attrsChanged
+		if !node.Unchanged {
+			node.UpdatedAt = &now
+			err = upsert()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return node, nil
 }
 
-func (e *executor) finaliseNodeLabels(nodeID string, n ast.Entity, ownerID, actionID string, tx *sqlx.Tx) ([]*NodeLabel, error) {
+func (e *executor) finaliseNodeLabels(nodeID string, n ast.Entity, ownerID, actionID string, tx *preparedTx) ([]*NodeLabel, bool, error) {
 	now := time.Now().UTC()
 	labels := []*NodeLabel{}
 
 	if len(n.Labels()) == 0 {
-		return labels, nil
+		return labels, false, nil
 	}
 
-	err := tx.Select(&labels, "select * from node_labels where node_id = ?", nodeID)
+	err := tx.selectAll(&labels, "select * from node_labels where node_id = ?", nodeID)
 	if err != nil {
-		return nil, fmt.Errorf("querying labels: %w", err)
+		return nil, false, fmt.Errorf("querying labels: %w", err)
 	}
 
 	existing := map[string]*NodeLabel{}
@@ -155,38 +358,46 @@ func (e *executor) finaliseNodeLabels(nodeID string, n ast.Entity, ownerID, acti
 		existing[v.Label] = v
 	}
 
+	changed := false
 	for _, l := range n.Labels() {
-		label := existing[l]
-		if label == nil {
-			label = &NodeLabel{
-				ID:        model.NewID(),
-				CreatedAt: now,
-				NodeID:    nodeID,
-				Label:     l,
-			}
-			labels = append(labels, label)
-		} else {
-			label.UpdatedAt = &now
+		// labels have no value, so only new ones are written
+		if _, ok := existing[l]; ok {
+			delete(existing, l)
+			continue
 		}
 
-		label.LastActionID = actionID
+		label := &NodeLabel{
+			ID:           model.NewID(),
+			CreatedAt:    now,
+			LastActionID: actionID,
+			NodeID:       nodeID,
+			Label:        l,
+		}
+		labels = append(labels, label)
+		changed = true
 
-		_, err = tx.NamedExec(`
+		_, err = tx.namedExec(`
 			insert into node_labels(id, created_at, last_action_id, node_id, label)
-			values(:id, :created_at, :last_action_id, :node_id, :label)
-			on conflict(id) do update
-			set updated_at = :updated_at, last_action_id = :last_action_id`, label)
+			values(:id, :created_at, :last_action_id, :node_id, :label)`, label)
+		if err != nil {
+			return nil, false, fmt.Errorf("inserting label: %w", err)
+		}
+		err = countStat(tx, statEntityNode, statKindLabel, l, 1)
 		if err != nil {
-			return nil, fmt.Errorf("inserting label: %w", err)
+			return nil, false, err
 		}
-		delete(existing, l)
 	}
 
 	for _, label := range existing {
-		_, err = tx.Exec("delete from node_labels where id = ?", label.ID)
+		_, err = tx.exec("delete from node_labels where id = ?", label.ID)
+		if err != nil {
+			return nil, false, fmt.Errorf("deleting label: %w", err)
+		}
+		err = countStat(tx, statEntityNode, statKindLabel, label.Label, -1)
 		if err != nil {
-			return nil, fmt.Errorf("deleting label: %w", err)
+			return nil, false, err
 		}
+		changed = true
 	}
 
 	labels2 := make([]*NodeLabel, 0, len(labels))
@@ -197,20 +408,20 @@ func (e *executor) finaliseNodeLabels(nodeID string, n ast.Entity, ownerID, acti
 		labels2 = append(labels2, l)
 	}
 
-	return labels2, nil
+	return labels2, changed, nil
 }
 
-func (e *executor) finaliseNodeAttributes(nodeID string, n ast.Entity, ownerID, actionID string, tx *sqlx.Tx) ([]*NodeAttribute, error) {
+func (e *executor) finaliseNodeAttributes(nodeID string, n ast.Entity, ownerID, actionID string, tx *preparedTx) ([]*NodeAttribute, bool, error) {
 	now := time.Now().UTC()
 	attrs := []*NodeAttribute{}
 
 	if len(n.Attributes()) == 0 {
-		return attrs, nil
+		return attrs, false, nil
 	}
 
-	err := tx.Select(&attrs, "select * from node_attributes where node_id = ?", nodeID)
+	err := tx.selectAll(&attrs, "select * from node_attributes where node_id = ?", nodeID)
 	if err != nil {
-		return nil, fmt.Errorf("querying attrs: %w", err)
+		return nil, false, fmt.Errorf("querying attrs: %w", err)
 	}
 
 	existing := map[string]*NodeAttribute{}
@@ -218,9 +429,16 @@ func (e *executor) finaliseNodeAttributes(nodeID string, n ast.Entity, ownerID,
 		existing[a.Name] = a
 	}
 
+	changed := false
 	for _, a := range n.Attributes() {
 		attr := existing[a.Key()]
-		if attr == nil {
+		delete(existing, a.Key())
+		if attr != nil && attr.Value == a.Value() && attr.Type == a.Type() {
+			continue
+		}
+
+		isNew := attr == nil
+		if isNew {
 			attr = &NodeAttribute{
 				ID:        model.NewID(),
 				CreatedAt: now,
@@ -233,24 +451,36 @@ func (e *executor) finaliseNodeAttributes(nodeID string, n ast.Entity, ownerID,
 		}
 
 		attr.LastActionID = actionID
-
 		attr.Value = a.Value()
-		_, err = tx.NamedExec(`
+		attr.Type = a.Type()
+		changed = true
+
+		_, err = tx.namedExec(`
 			insert into node_attributes(id, created_at, last_action_id, node_id, attr_name, attr_value, data_type)
 			values(:id, :created_at, :last_action_id, :node_id, :attr_name, :attr_value, :data_type)
 			on conflict(id) do update
-			set updated_at = :updated_at, last_action_id = :last_action_id, attr_value = :attr_value`, &attr)
+			set updated_at = :updated_at, last_action_id = :last_action_id, attr_value = :attr_value, data_type = :data_type`, &attr)
 		if err != nil {
-			return nil, fmt.Errorf("inserting attr: %w", err)
+			return nil, false, fmt.Errorf("inserting attr: %w", err)
+		}
+		if isNew {
+			err = countStat(tx, statEntityNode, statKindAttribute, a.Key(), 1)
+			if err != nil {
+				return nil, false, err
+			}
 		}
-		delete(existing, a.Key())
 	}
 
-	for _, id := range existing {
-		_, err = tx.Exec("delete from node_attributes where id = ?", id)
+	for _, attr := range existing {
+		_, err = tx.exec("delete from node_attributes where id = ?", attr.ID)
+		if err != nil {
+			return nil, false, fmt.Errorf("deleting attr: %w", err)
+		}
+		err = countStat(tx, statEntityNode, statKindAttribute, attr.Name, -1)
 		if err != nil {
-			return nil, fmt.Errorf("deleting attr: %w", err)
+			return nil, false, err
 		}
+		changed = true
 	}
 
 	attrs2 := make([]*NodeAttribute, 0, len(attrs))
@@ -261,10 +491,10 @@ func (e *executor) finaliseNodeAttributes(nodeID string, n ast.Entity, ownerID,
 		attrs2 = append(attrs2, a)
 	}
 
-	return attrs2, nil
+	return attrs2, changed, nil
 }
 
-func (e *executor) finaliseRelation(r ast.Relation, ownerID, actionID string, tx *sqlx.Tx) (*Relation, error) {
+func (e *executor) finaliseRelation(r ast.Relation, ownerID, actionID string, tx *preparedTx) (*Relation, error) {
 	now := time.Now().UTC()
 
 	left, err := e.finaliseNode(r.Left(), ownerID, actionID, tx)
@@ -284,7 +514,27 @@ func (e *executor) finaliseRelation(r ast.Relation, ownerID, actionID string, tx
 		}
 	}
 
-	if rel == nil {
+	upsert := func() error {
+		rel.LastActionID = actionID
+		_, err := tx.namedExec(`
+			insert into relations(id, created_at, owner_id, last_action_id, left_node_id, right_node_id, direction)
+			values(:id, :created_at, :owner_id, :last_action_id, :left_node_id, :right_node_id, :direction)
+			on conflict(id) do update set
+			updated_at = :updated_at,
+			last_action_id = :last_action_id,
+			left_node_id = :left_node_id,
+			right_node_id = :right_node_id,
+			direction = :direction`, rel)
+		if err != nil {
+			return fmt.Errorf("upserting relation: %w", err)
+		}
+		return nil
+	}
+
+	// as with nodes, existing relations are only written if they changed
+	existing := rel != nil
+	relChanged := !existing
+	if !existing {
 		rel = &Relation{
 			ID:        model.NewID(),
 			CreatedAt: now,
@@ -294,54 +544,56 @@ func (e *executor) finaliseRelation(r ast.Relation, ownerID, actionID string, tx
 		if rel.OwnerID != ownerID {
 			return nil, ErrUnauthorized
 		}
-		rel.UpdatedAt = &now
+		relChanged = rel.Direction != r.Direction() || rel.LeftNodeID != left.ID || rel.RightNodeID != right.ID
 	}
 
-	rel.LastActionID = actionID
 	rel.Direction = r.Direction()
 	rel.LeftNodeID = left.ID
 	rel.RightNodeID = right.ID
 	rel.leftNode = left
 	rel.rightNode = right
 
-	_, err = tx.NamedExec(`
-		insert into relations(id, created_at, owner_id, last_action_id, left_node_id, right_node_id, direction)
-		values(:id, :created_at, :owner_id, :last_action_id, :left_node_id, :right_node_id, :direction)
-		on conflict(id) do update set
-		updated_at = :updated_at,
-		last_action_id = :last_action_id,
-		left_node_id = :left_node_id,
-		right_node_id = :right_node_id,
-		direction = :direction`, rel)
-
-	if err != nil {
-		return nil, fmt.Errorf("upserting relation: %w", err)
+	if !existing {
+		err = upsert()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	rel.labels, err = e.finaliseRelationLabels(rel.ID, r, ownerID, actionID, tx)
+	var labelsChanged, attrsChanged bool
+	rel.labels, labelsChanged, err = e.finaliseRelationLabels(rel.ID, r, ownerID, actionID, tx)
 	if err != nil {
 		return nil, fmt.Errorf("finalising labels: %w", err)
 	}
 
-	rel.attributes, err = e.finaliseRelationAttributes(rel.ID, r, ownerID, actionID, tx)
+	rel.attributes, attrsChanged, err = e.finaliseRelationAttributes(rel.ID, r, ownerID, actionID, tx)
 	if err != nil {
 		return nil, fmt.Errorf("finalising attrs: %w", err)
 	}
 
+	if existing && (relChanged || labelsChanged || attrsChanged) {
+		rel.UpdatedAt = &now
+		err = upsert()
+		if err != nil {
+			return nil, err
+		}
+	}
+	rel.Unchanged = existing && !relChanged && !labelsChanged && !attrsChanged && left.Unchanged && right.Unchanged
+
 	return rel, nil
 }
 
-func (e *executor) finaliseRelationLabels(relationID string, r ast.Relation, ownerID, actionID string, tx *sqlx.Tx) ([]*RelationLabel, error) {
+func (e *executor) finaliseRelationLabels(relationID string, r ast.Relation, ownerID, actionID string, tx *preparedTx) ([]*RelationLabel, bool, error) {
 	now := time.Now().UTC()
 	labels := []*RelationLabel{}
 
 	if len(r.Labels()) == 0 {
-		return labels, nil
+		return labels, false, nil
 	}
 
-	err := tx.Select(&labels, "select * from relation_labels where relation_id = ?", relationID)
+	err := tx.selectAll(&labels, "select * from relation_labels where relation_id = ?", relationID)
 	if err != nil {
-		return nil, fmt.Errorf("querying labels: %w", err)
+		return nil, false, fmt.Errorf("querying labels: %w", err)
 	}
 
 	existing := map[string]*RelationLabel{}
@@ -349,38 +601,46 @@ func (e *executor) finaliseRelationLabels(relationID string, r ast.Relation, own
 		existing[v.Label] = v
 	}
 
+	changed := false
 	for _, l := range r.Labels() {
-		label := existing[l]
-		if label == nil {
-			label = &RelationLabel{
-				ID:         model.NewID(),
-				CreatedAt:  now,
-				RelationID: relationID,
-				Label:      l,
-			}
-			labels = append(labels, label)
-		} else {
-			label.UpdatedAt = &now
+		// labels have no value, so only new ones are written
+		if _, ok := existing[l]; ok {
+			delete(existing, l)
+			continue
 		}
 
-		label.LastActionID = actionID
+		label := &RelationLabel{
+			ID:           model.NewID(),
+			CreatedAt:    now,
+			LastActionID: actionID,
+			RelationID:   relationID,
+			Label:        l,
+		}
+		labels = append(labels, label)
+		changed = true
 
-		_, err = tx.NamedExec(`
+		_, err = tx.namedExec(`
 			insert into relation_labels(id, created_at, last_action_id, relation_id, label)
-			values(:id, :created_at, :last_action_id, :relation_id, :label)
-			on conflict(id) do update
-			set updated_at = :updated_at, last_action_id = :last_action_id`, label)
+			values(:id, :created_at, :last_action_id, :relation_id, :label)`, label)
+		if err != nil {
+			return nil, false, fmt.Errorf("inserting label: %w", err)
+		}
+		err = countStat(tx, statEntityRelation, statKindLabel, l, 1)
 		if err != nil {
-			return nil, fmt.Errorf("inserting label: %w", err)
+			return nil, false, err
 		}
-		delete(existing, l)
 	}
 
 	for _, label := range existing {
-		_, err = tx.Exec("delete from relation_labels where id = ?", label.ID)
+		_, err = tx.exec("delete from relation_labels where id = ?", label.ID)
 		if err != nil {
-			return nil, fmt.Errorf("deleting label: %w", err)
+			return nil, false, fmt.Errorf("deleting label: %w", err)
 		}
+		err = countStat(tx, statEntityRelation, statKindLabel, label.Label, -1)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
 	}
 
 	labels2 := make([]*RelationLabel, 0, len(labels))
@@ -391,20 +651,20 @@ func (e *executor) finaliseRelationLabels(relationID string, r ast.Relation, own
 		labels2 = append(labels2, l)
 	}
 
-	return labels2, nil
+	return labels2, changed, nil
 }
 
-func (e *executor) finaliseRelationAttributes(relationID string, r ast.Relation, ownerID, actionID string, tx *sqlx.Tx) ([]*RelationAttribute, error) {
+func (e *executor) finaliseRelationAttributes(relationID string, r ast.Relation, ownerID, actionID string, tx *preparedTx) ([]*RelationAttribute, bool, error) {
 	now := time.Now().UTC()
 	attrs := []*RelationAttribute{}
 
 	if len(r.Attributes()) == 0 {
-		return attrs, nil
+		return attrs, false, nil
 	}
 
-	err := tx.Select(&attrs, "select * from relation_attributes where relation_id = ?", relationID)
+	err := tx.selectAll(&attrs, "select * from relation_attributes where relation_id = ?", relationID)
 	if err != nil {
-		return nil, fmt.Errorf("querying attrs: %w", err)
+		return nil, false, fmt.Errorf("querying attrs: %w", err)
 	}
 
 	existing := map[string]*RelationAttribute{}
@@ -412,9 +672,16 @@ func (e *executor) finaliseRelationAttributes(relationID string, r ast.Relation,
 		existing[a.Name] = a
 	}
 
+	changed := false
 	for _, a := range r.Attributes() {
 		attr := existing[a.Key()]
-		if attr == nil {
+		delete(existing, a.Key())
+		if attr != nil && attr.Value == a.Value() && attr.Type == a.Type() {
+			continue
+		}
+
+		isNew := attr == nil
+		if isNew {
 			attr = &RelationAttribute{
 				ID:         model.NewID(),
 				CreatedAt:  now,
@@ -428,23 +695,35 @@ func (e *executor) finaliseRelationAttributes(relationID string, r ast.Relation,
 
 		attr.LastActionID = actionID
 		attr.Value = a.Value()
+		attr.Type = a.Type()
+		changed = true
 
-		_, err = tx.NamedExec(`
+		_, err = tx.namedExec(`
 			insert into relation_attributes(id, created_at, last_action_id, relation_id, attr_name, attr_value, data_type)
 			values(:id, :created_at, :last_action_id, :relation_id, :attr_name, :attr_value, :data_type)
 			on conflict(id) do update
-			set updated_at = :updated_at, last_action_id = :last_action_id, attr_value = :attr_value`, &attr)
+			set updated_at = :updated_at, last_action_id = :last_action_id, attr_value = :attr_value, data_type = :data_type`, &attr)
 		if err != nil {
-			return nil, fmt.Errorf("inserting attr: %w", err)
+			return nil, false, fmt.Errorf("inserting attr: %w", err)
+		}
+		if isNew {
+			err = countStat(tx, statEntityRelation, statKindAttribute, a.Key(), 1)
+			if err != nil {
+				return nil, false, err
+			}
 		}
-		delete(existing, a.Key())
 	}
 
-	for _, id := range existing {
-		_, err = tx.Exec("delete from relation_attributes where id = ?", id)
+	for _, attr := range existing {
+		_, err = tx.exec("delete from relation_attributes where id = ?", attr.ID)
+		if err != nil {
+			return nil, false, fmt.Errorf("deleting attr: %w", err)
+		}
+		err = countStat(tx, statEntityRelation, statKindAttribute, attr.Name, -1)
 		if err != nil {
-			return nil, fmt.Errorf("deleting attr: %w", err)
+			return nil, false, err
 		}
+		changed = true
 	}
 
 	attrs2 := make([]*RelationAttribute, 0, len(attrs))
@@ -455,10 +734,10 @@ func (e *executor) finaliseRelationAttributes(relationID string, r ast.Relation,
 		attrs2 = append(attrs2, a)
 	}
 
-	return attrs2, nil
+	return attrs2, changed, nil
 }
 
-func (e *executor) finaliseMergeCmd(cmd ast.Command, ownerID, actionID string, tx *sqlx.Tx) (any, error) {
+func (e *executor) finaliseMergeCmd(cmd ast.Command, ownerID, actionID string, tx *preparedTx) (any, error) {
 	switch cmd.Entity().Type() {
 	case ast.EntityTypeNode:
 		return e.finaliseNode(cmd.Entity(), ownerID, actionID, tx)
@@ -469,19 +748,18 @@ func (e *executor) finaliseMergeCmd(cmd ast.Command, ownerID, actionID string, t
 	}
 }
 
-func (e *executor) finaliseMatchCmd(cmd ast.Command, identity string, tx *sqlx.Tx) (*SearchResults, error) {
-	// TODO check identity has permission to match
+func (e *executor) finaliseMatchCmd(cmd ast.Command, readable ReadFilter, tx *sqlx.Tx) (*SearchResults, error) {
 	switch cmd.Entity().Type() {
 	case ast.EntityTypeNode:
-		return e.searchNodes(cmd.Entity(), cmd.Since(), tx)
+		return e.searchNodes(cmd.Entity(), cmd.Since(), cmd.Where(), readable, tx)
 	case ast.EntityTypeRelation:
-		return e.searchRelations(cmd.Entity().(ast.Relation), cmd.Since(), tx)
+		return e.searchRelations(cmd.Entity().(ast.Relation), cmd.Since(), cmd.Where(), readable, tx)
 	default:
 		return nil, fmt.Errorf("unexpected entity: %v", cmd.Entity())
 	}
 }
 
-func (e *executor) findNode(n ast.Entity, tx *sqlx.Tx) (*Node, error) {
+func (e *executor) findNode(n ast.Entity, tx *preparedTx) (*Node, error) {
 	args := []any{}
 	query := strings.Builder{}
 	query.WriteString("select n.* from nodes n\n")
@@ -522,7 +800,7 @@ func (e *executor) findNode(n ast.Entity, tx *sqlx.Tx) (*Node, error) {
 	}
 
 	res.attributes = []*NodeAttribute{}
-	err = tx.Select(&res.attributes, "select * from node_attributes where node_id = ?", res.ID)
+	err = tx.selectAll(&res.attributes, "select * from node_attributes where node_id = ?", res.ID)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("fetching node: %w", err)
@@ -530,7 +808,7 @@ func (e *executor) findNode(n ast.Entity, tx *sqlx.Tx) (*Node, error) {
 	}
 
 	res.labels = []*NodeLabel{}
-	err = tx.Select(&res.labels, "select * from node_labels where node_id = ?", res.ID)
+	err = tx.selectAll(&res.labels, "select * from node_labels where node_id = ?", res.ID)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("fetching node: %w", err)
@@ -540,7 +818,7 @@ func (e *executor) findNode(n ast.Entity, tx *sqlx.Tx) (*Node, error) {
 	return res, nil
 }
 
-func (e *executor) findRelation(r ast.Relation, leftNodeId, rightNodeId string, tx *sqlx.Tx) (*Relation, error) {
+func (e *executor) findRelation(r ast.Relation, leftNodeId, rightNodeId string, tx *preparedTx) (*Relation, error) {
 	args := []any{}
 	query := strings.Builder{}
 	query.WriteString("select r.* from relations r\n")
@@ -582,7 +860,7 @@ func (e *executor) findRelation(r ast.Relation, leftNodeId, rightNodeId string,
 		return nil, ErrNotFound
 	}
 	res.attributes = []*RelationAttribute{}
-	err = tx.Select(&res.attributes, "select * from relation_attributes where relation_id = ?", res.ID)
+	err = tx.selectAll(&res.attributes, "select * from relation_attributes where relation_id = ?", res.ID)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("fetching relation: %w", err)
@@ -590,7 +868,7 @@ func (e *executor) findRelation(r ast.Relation, leftNodeId, rightNodeId string,
 	}
 
 	res.labels = []*RelationLabel{}
-	err = tx.Select(&res.labels, "select * from relation_labels where relation_id = ?", res.ID)
+	err = tx.selectAll(&res.labels, "select * from relation_labels where relation_id = ?", res.ID)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("fetching relation: %w", err)
@@ -600,12 +878,36 @@ func (e *executor) findRelation(r ast.Relation, leftNodeId, rightNodeId string,
 	return res, nil
 }
 
-func (e *executor) searchNodes(clause ast.Entity, since time.Time, tx *sqlx.Tx) (*SearchResults, error) {
-	subquery, args, err := e.buildNodeClause("n_", clause)
+func (e *executor) searchNodes(clause ast.Entity, since time.Time, where ast.Condition, readable ReadFilter, tx *sqlx.Tx) (*SearchResults, error) {
+	est, err := estimate(tx, clause)
 	if err != nil {
 		return nil, err
 	}
 
+	query, args, idents, err := e.nodeSearchQuery(clause, since, where, est)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.NamedQuery(query, args)
+	if err != nil {
+		return nil, fmt.Errorf("executing search: %w", err)
+	}
+	defer rows.Close()
+
+	return e.extractResults(idents, rows, readable, tx)
+}
+
+// nodeSearchQuery builds the query for a node MATCH. It selects a null
+// rel_id and the matching node's id as left_node_id, the results are bound
+// to the identifiers it returns. Rows are restricted to those meeting the
+// WHERE condition if there is one.
+func (e *executor) nodeSearchQuery(clause ast.Entity, since time.Time, where ast.Condition, est estimates) (string, map[string]any, []string, error) {
+	subquery, args, err := e.buildNodeClause("n_", clause, since, est)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
 	if !since.IsZero() {
 		args["since"] = since
 	}
@@ -615,24 +917,53 @@ func (e *executor) searchNodes(clause ast.Entity, since time.Time, tx *sqlx.Tx)
 	query.WriteString(subquery)
 	query.WriteString(")\n")
 
-	query.WriteString("select rel_id null, id left_node_id, null right_node_id from n ")
+	query.WriteString("select null rel_id, id left_node_id from n ")
 	if !since.IsZero() {
-		query.WriteString("where n_since > :since")
+		query.WriteString("where updated_at > :since")
 	}
 
-	rows, err := tx.NamedQuery(query.String(), args)
+	sql, err := applyWhere(query.String(), where, map[string]whereColumn{
+		clause.Identifier(): {"left_node_id", "node"},
+	}, args)
 	if err != nil {
-		return nil, fmt.Errorf("executing search: %w", err)
+		return "", nil, nil, err
 	}
-	defer rows.Close()
 
+	// the first column is always the (empty) relation
 	idents := []string{
 		clause.Identifier(),
+		clause.Identifier(),
 	}
-	return e.extractResults(idents, rows, tx)
+	return sql, args, idents, nil
 }
 
-func (e *executor) searchRelations(clause ast.Relation, since time.Time, tx *sqlx.Tx) (*SearchResults, error) {
+func (e *executor) searchRelations(clause ast.Relation, since time.Time, where ast.Condition, readable ReadFilter, tx *sqlx.Tx) (*SearchResults, error) {
+	est, err := estimate(tx, clause)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args, idents, err := e.relationSearchQuery(clause, since, where, est)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.NamedQuery(query, args)
+	if err != nil {
+		return nil, fmt.Errorf("executing search: %w", err)
+	}
+	defer rows.Close()
+
+	return e.extractResults(idents, rows, readable, tx)
+}
+
+// relationSearchQuery builds the query for a relation MATCH. It selects the
+// id of each matching relation and the ids of the nodes matching the left and
+// right of the pattern, which are the relation's own ends swapped when it is
+// stored the other way round. The results are bound to the identifiers it
+// returns. Rows are restricted to those
+// meeting the WHERE condition if there is one.
+func (e *executor) relationSearchQuery(clause ast.Relation, since time.Time, where ast.Condition, est estimates) (string, map[string]any, []string, error) {
 	queries := map[string]string{}
 	args := map[string]any{
 		"direction_l":   ast.RelationDirLeft,
@@ -644,23 +975,23 @@ func (e *executor) searchRelations(clause ast.Relation, since time.Time, tx *sql
 		args["since"] = since
 	}
 
-	left, aleft, err := e.buildNodeClause("l_", clause.(ast.Relation).Left())
+	left, aleft, err := e.buildNodeClause("l_", clause.(ast.Relation).Left(), since, est)
 	if err != nil {
-		return nil, err
+		return "", nil, nil, err
 	}
 	queries["lnode"] = left
 	maps.Insert(args, maps.All(aleft))
 
-	right, aright, err := e.buildNodeClause("r_", clause.(ast.Relation).Right())
+	right, aright, err := e.buildNodeClause("r_", clause.(ast.Relation).Right(), since, est)
 	if err != nil {
-		return nil, err
+		return "", nil, nil, err
 	}
 	queries["rnode"] = right
 	maps.Insert(args, maps.All(aright))
 
-	rel, arel, err := e.buildRelationClause("rel_", clause.(ast.Relation))
+	rel, arel, err := e.buildRelationClause("rel_", clause.(ast.Relation), est)
 	if err != nil {
-		return nil, err
+		return "", nil, nil, err
 	}
 	queries["rel"] = rel
 	maps.Insert(args, maps.All(arel))
@@ -687,18 +1018,18 @@ func (e *executor) searchRelations(clause ast.Relation, since time.Time, tx *sql
 		on rel.left_node_id = lnode.id
 		inner join rnode
 		on rel.right_node_id = rnode.id
-		where rel.direction = :direction_r
+		where rel.direction = :direction_l
 		union
-		select rel.id, rel.left_node_id, rel.right_node_id from rel
+		select rel.id, rel.right_node_id left_node_id, rel.left_node_id right_node_id from rel
 		inner join lnode
 		on rel.left_node_id = rnode.id
 		inner join rnode
 		on rel.right_node_id = lnode.id
-		where rel.direction = :direction_l
+		where rel.direction = :direction_r
 	`)
 	case ast.RelationDirRight:
 		query.WriteString(`
-		select rel.id, rel.left_node_id, rel.right_node_id from rel
+		select rel.id, rel.right_node_id left_node_id, rel.left_node_id right_node_id from rel
 		inner join lnode
 		on rel.left_node_id = rnode.id
 		inner join rnode
@@ -720,7 +1051,7 @@ func (e *executor) searchRelations(clause ast.Relation, since time.Time, tx *sql
 		inner join rnode
 		on rel.right_node_id = rnode.id
 		union
-		select rel.id, rel.left_node_id, rel.right_node_id from rel
+		select rel.id, rel.right_node_id left_node_id, rel.left_node_id right_node_id from rel
 		inner join lnode
 		on rel.left_node_id = rnode.id
 		inner join rnode
@@ -732,85 +1063,166 @@ func (e *executor) searchRelations(clause ast.Relation, since time.Time, tx *sql
 		query.WriteString(" and rel.updated_at > :since or lnode.updated_at > :since or rnode.updated_at > :since")
 	}
 
-	fmt.Println(query.String())
-
-	rows, err := tx.NamedQuery(query.String(), args)
+	// the relation's columns are bound to the identifiers as its results are
+	columns := map[string]whereColumn{}
+	for ident, col := range map[string]whereColumn{
+		clause.Right().Identifier(): {"right_node_id", "node"},
+		clause.Left().Identifier():  {"left_node_id", "node"},
+		clause.Identifier():         {"id", "relation"},
+	} {
+		if ident != "" {
+			columns[ident] = col
+		}
+	}
+	sql, err := applyWhere(query.String(), where, columns, args)
 	if err != nil {
-		return nil, fmt.Errorf("executing search: %w", err)
+		return "", nil, nil, err
 	}
-	defer rows.Close()
 
 	idents := []string{
 		clause.Identifier(),
 		clause.Left().Identifier(),
 		clause.Right().Identifier(),
 	}
-	return e.extractResults(idents, rows, tx)
+	return sql, args, idents, nil
 }
 
-func (e *executor) extractResults(idents []string, rows *sqlx.Rows, tx *sqlx.Tx) (*SearchResults, error) {
+// extractResults binds the nodes and relation of each row of a search to the
+// identifiers, with their labels and attributes, and makes a path of each.
+// The first column holds the relation, the others nodes. Rows including an
+// entity the read filter rejects are left out so that the bindings stay
+// lined up.
+func (e *executor) extractResults(idents []string, rows *sqlx.Rows, readable ReadFilter, tx *sqlx.Tx) (*SearchResults, error) {
 	results := &SearchResults{
-		data: map[string][]any{},
+		data:  map[string][]any{},
+		paths: []*Path{},
 	}
 	for _, i := range idents {
 		results.data[i] = []any{}
 	}
 
-	cols, _ := rows.Columns()
+	// the IDs are all read first so the entities can be loaded in batches
+	matches := [][]sql.NullString{}
+	relationIDs, nodeIDs := []string{}, []string{}
 	for rows.Next() {
-		vals := make([]interface{}, len(cols))
-		ptrs := make([]interface{}, len(cols))
-		for id := range cols {
-			ptrs[id] = &vals[id]
+		ids := make([]sql.NullString, len(idents))
+		ptrs := make([]any, len(idents))
+		for i := range ids {
+			ptrs[i] = &ids[i]
 		}
 
 		err := rows.Scan(ptrs...)
 		if err != nil {
 			return nil, fmt.Errorf("scanning search results: %w", err)
 		}
+		for i, id := range ids {
+			switch {
+			case !id.Valid:
+			case i == 0:
+				relationIDs = append(relationIDs, id.String)
+			default:
+				nodeIDs = append(nodeIDs, id.String)
+			}
+		}
+		matches = append(matches, ids)
+	}
+	err := rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading search results: %w", err)
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	relations, err := e.relationRecordsByID(ctx, tx, relationIDs)
+	if err != nil {
+		return nil, fmt.Errorf("fetching search results: %w", err)
+	}
+	nodes, err := e.nodeRecordsByID(ctx, tx, nodeIDs)
+	if err != nil {
+		return nil, fmt.Errorf("fetching search results: %w", err)
+	}
 
-		for i, e := range ptrs {
-			entityID := *(e.(*interface{}))
-			if entityID == nil {
+	for _, ids := range matches {
+		matched := make([]any, len(ids))
+		isReadable := true
+		for i, id := range ids {
+			if !id.Valid {
 				continue
 			}
+
+			var ownerID string
+			var labels []string
 			if i == 0 {
-				err := results.appendEntity(entityID.(string), idents[i], &Relation{}, tx)
-				if err != nil {
-					return nil, fmt.Errorf("fetching relation: %w", err)
+				r, ok := relations[id.String]
+				if !ok {
+					return nil, fmt.Errorf("fetching search results: relation %s: %w", id.String, ErrNotFound)
 				}
+				matched[i], ownerID, labels = r, r.OwnerID, r.Labels
 			} else {
-				err := results.appendEntity(entityID.(string), idents[i], &Node{}, tx)
-				if err != nil {
-					return nil, fmt.Errorf("fetching relation: %w", err)
+				n, ok := nodes[id.String]
+				if !ok {
+					return nil, fmt.Errorf("fetching search results: node %s: %w", id.String, ErrNotFound)
 				}
+				matched[i], ownerID, labels = n, n.OwnerID, n.Labels
+			}
+
+			if readable != nil && !readable(ownerID, labels) {
+				isReadable = false
+				break
+			}
+		}
+		if !isReadable {
+			continue
+		}
+
+		for i, m := range matched {
+			if m != nil {
+				results.data[idents[i]] = append(results.data[idents[i]], m)
 			}
 		}
+		results.paths = append(results.paths, matchPath(matched))
 	}
 
 	return results, nil
 }
 
-func (s *SearchResults) appendEntity(entityID, ident string, target any, tx *sqlx.Tx) error {
-	var err error
-	switch target.(type) {
-	case *Relation:
-		err = tx.Get(target, "select * from relations where id = ?", entityID)
-	case *Node:
-		err = tx.Get(target, "select * from nodes where id = ?", entityID)
-	default:
-		return errors.New("unknown target type")
+// matchPath makes the path of a row of search results, its nodes in the
+// order of the columns and the relation in the first column between them
+func matchPath(matched []any) *Path {
+	nodes := []*NodeRecord{}
+	for _, m := range matched[1:] {
+		if n, ok := m.(*NodeRecord); ok {
+			nodes = append(nodes, n)
+		}
 	}
-	if target != nil {
-		s.data[ident] = append(s.data[ident], target)
+	relations := []*RelationRecord{}
+	if r, ok := matched[0].(*RelationRecord); ok {
+		relations = append(relations, r)
 	}
-	return err
+	return newPath(nodes, relations)
 }
 
-func (e *executor) buildNodeClause(prefix string, n ast.Entity) (string, map[string]any, error) {
+// buildNodeClause builds a query for the ids of the nodes matching a pattern,
+// and when they were last updated if there is a SINCE to check. Labels and
+// attributes are joined from the least common to the most.
+func (e *executor) buildNodeClause(prefix string, n ast.Entity, since time.Time, est estimates) (string, map[string]any, error) {
 	query := strings.Builder{}
 	args := map[string]any{}
 
+	// label-only patterns intersect the sets of nodes with each label from
+	// the label index, the nodes are only read when the results are fetched
+	if len(n.Attributes()) == 0 && len(n.Labels()) > 0 && since.IsZero() {
+		for i, l := range est.labels(statEntityNode, n.Labels()) {
+			if i > 0 {
+				query.WriteString("\nintersect\n")
+			}
+			query.WriteString(fmt.Sprintf("select node_id id from node_labels where label = :%slabel%d", prefix, i))
+			args[fmt.Sprintf("%slabel%d", prefix, i)] = l
+		}
+		return query.String(), args, nil
+	}
+
 	query.WriteString("select n.id, coalesce(n.updated_at, n.created_at) updated_at from nodes n\n")
 	if val, ok := n.Attribute("id"); ok {
 		query.WriteString(fmt.Sprintf("where n.id = :%sid", prefix))
@@ -819,29 +1231,31 @@ func (e *executor) buildNodeClause(prefix string, n ast.Entity) (string, map[str
 	}
 
 	i := 0
-	for _, v := range n.Attributes() {
+	for _, v := range est.attributes(statEntityNode, n.Attributes()) {
 		query.WriteString(fmt.Sprintf(`
-			inner join (select * from node_attributes where attr_name = :%sattr_name and attr_value = :%sattr_value) na%d
+			inner join (select * from node_attributes where attr_name = :%sattr_name%d and attr_value = :%sattr_value%d) na%d
 			on n.id = na%d.node_id
-		`, prefix, prefix, i, i))
-		args[fmt.Sprintf("%sattr_name", prefix)] = v.Key()
-		args[fmt.Sprintf("%sattr_value", prefix)] = v.Value()
+		`, prefix, i, prefix, i, i, i))
+		args[fmt.Sprintf("%sattr_name%d", prefix, i)] = v.Key()
+		args[fmt.Sprintf("%sattr_value%d", prefix, i)] = v.Value()
 		i++
 	}
 
-	for _, l := range n.Labels() {
+	for _, l := range est.labels(statEntityNode, n.Labels()) {
 		query.WriteString(fmt.Sprintf(`
-			inner join (select * from node_labels where label = :%slabel) nl%d
+			inner join (select * from node_labels where label = :%slabel%d) nl%d
 			on n.id = nl%d.node_id
-		`, prefix, i, i))
-		args[fmt.Sprintf("%slabel", prefix)] = l
+		`, prefix, i, i, i))
+		args[fmt.Sprintf("%slabel%d", prefix, i)] = l
 		i++
 	}
 
 	return query.String(), args, nil
 }
 
-func (e *executor) buildRelationClause(prefix string, r ast.Relation) (string, map[string]any, error) {
+// buildRelationClause builds a query for the relations matching a pattern.
+// Labels and attributes are joined from the least common to the most.
+func (e *executor) buildRelationClause(prefix string, r ast.Relation, est estimates) (string, map[string]any, error) {
 	query := strings.Builder{}
 	args := map[string]any{}
 
@@ -853,21 +1267,21 @@ func (e *executor) buildRelationClause(prefix string, r ast.Relation) (string, m
 	}
 
 	i := 0
-	for _, v := range r.Attributes() {
+	for _, v := range est.attributes(statEntityRelation, r.Attributes()) {
 		query.WriteString(fmt.Sprintf(`
-			inner join (select * from relation_attributes where attr_name = :%sattr_name and attr_value = :%sattr_value) ra%d
+			inner join (select * from relation_attributes where attr_name = :%sattr_name%d and attr_value = :%sattr_value%d) ra%d
 			on r.id = ra%d.relation_id
-		`, prefix, prefix, i, i))
-		args[fmt.Sprintf("%sattr_name", prefix)] = v.Key()
-		args[fmt.Sprintf("%sattr_value", prefix)] = v.Value()
+		`, prefix, i, prefix, i, i, i))
+		args[fmt.Sprintf("%sattr_name%d", prefix, i)] = v.Key()
+		args[fmt.Sprintf("%sattr_value%d", prefix, i)] = v.Value()
 		i++
 	}
 
-	for _, l := range r.Labels() {
+	for _, l := range est.labels(statEntityRelation, r.Labels()) {
 		query.WriteString(fmt.Sprintf(`
-			inner join (select * from relation_labels where label = :%slabel) rl%d
-			on r.id = rl%d.relation_id`, prefix, i, i))
-		args[fmt.Sprintf("%slabel", prefix)] = l
+			inner join (select * from relation_labels where label = :%slabel%d) rl%d
+			on r.id = rl%d.relation_id`, prefix, i, i, i))
+		args[fmt.Sprintf("%slabel%d", prefix, i)] = l
 		i++
 	}
 
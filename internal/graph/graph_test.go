@@ -18,7 +18,10 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 */
 
 import (
+	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -104,8 +107,9 @@ func TestExecutorSearch(t *testing.T) {
 	assert.NotNil(e)
 
 	action := Action{
-		ID:      "12345.67890",
-		Command: p.Command(),
+		ID:       "12345.67890",
+		Identity: "11111111",
+		Command:  p.Command(),
 	}
 	_, err = e.Execute(action)
 	assert.NoError(err)
@@ -131,4 +135,837 @@ func TestExecutorSearch(t *testing.T) {
 		assert.NotNil(res)
 	})
 
+	t.Run("find nodes", func(t *testing.T) {
+		p, err := ast.Parse(`MATCH (p:Post {uri: 'ipfs://xyz', test: 'hello\tworld'})`)
+		assert.NoError(err)
+
+		res, err := e.Execute(Action{Command: p.Command()})
+		assert.NoError(err)
+
+		data, err := json.Marshal(res)
+		assert.NoError(err)
+		assert.Contains(string(data), `"p":[{"ID"`)
+	})
+}
+
+func TestExecutorPurgeIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := ast.Parse(`MERGE (i:Identity:Person {name: 'spammer'})-[:posted]->(p:Post {uri: 'ipfs://spam'})`)
+	assert.NoError(err)
+
+	e, err := New(config)
+	assert.NoError(err)
+
+	_, err = e.Execute(Action{
+		ID:       "22222222.1",
+		Identity: "22222222",
+		Command:  p.Command(),
+	})
+	assert.NoError(err)
+
+	count, err := e.PurgeIdentity("22222222")
+	assert.NoError(err)
+	assert.Equal(3, count)
+
+	count, err = e.PurgeIdentity("22222222")
+	assert.NoError(err)
+	assert.Equal(0, count)
+}
+
+func TestExecutorPurgeActions(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := ast.Parse(`MERGE (i:Identity:Person {name: 'ephemeral'})-[:posted]->(p:Post {uri: 'ipfs://ephemeral'})`)
+	assert.NoError(err)
+
+	e, err := New(config)
+	assert.NoError(err)
+
+	_, err = e.Execute(Action{
+		ID:       "33333333.1",
+		Identity: "33333333",
+		Command:  p.Command(),
+	})
+	assert.NoError(err)
+
+	count, err := e.PurgeActions([]string{"33333333.1"})
+	assert.NoError(err)
+	assert.Equal(3, count)
+
+	count, err = e.PurgeActions(nil)
+	assert.NoError(err)
+	assert.Equal(0, count)
+}
+
+func TestExecutorRead(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-read.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	for i, stmt := range []string{
+		`MERGE (i:Person {name: 'ann'})-[:posted{via:'web'}]->(p:Post {uri: 'ipfs://1', count: 1})`,
+		`MERGE (i:Person {name: 'ann'})-[:posted]->(p:Post {uri: 'ipfs://2', count: 'two'})`,
+		`MERGE (j:Person {name: 'bob'})-[:follows]->(i:Person {name: 'ann'})`,
+	} {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err)
+		_, err = e.Execute(Action{ID: fmt.Sprintf("read.%d", i), Identity: "44444444", Command: p.Command()})
+		assert.NoError(err)
+	}
+
+	schema, err := e.Schema()
+	assert.NoError(err)
+	assert.Equal([]AttributeInfo{
+		{Name: "count", Type: ast.AttributeDataTypeString},
+		{Name: "uri", Type: ast.AttributeDataTypeString},
+	}, schema.NodeLabels["Post"])
+	assert.Equal([]AttributeInfo{{Name: "via", Type: ast.AttributeDataTypeString}}, schema.RelationLabels["posted"])
+	assert.Empty(schema.RelationLabels["follows"])
+
+	posts, err := e.ListNodes(NodeQuery{Label: "Post", Limit: 10})
+	assert.NoError(err)
+	assert.Len(posts, 2)
+	assert.Equal(1.0, posts[0].Attributes["count"])
+	assert.Equal("two", posts[1].Attributes["count"])
+
+	posts, err = e.ListNodes(NodeQuery{Label: "Post", Attributes: map[string]string{"uri": "ipfs://2"}, Limit: 10})
+	assert.NoError(err)
+	assert.Len(posts, 1)
+
+	people, err := e.ListNodes(NodeQuery{Label: "Person", Attributes: map[string]string{"name": "ann"}, Limit: 1})
+	assert.NoError(err)
+	assert.Len(people, 1)
+	assert.Equal([]string{"Person"}, people[0].Labels)
+
+	out, err := e.ListRelations(RelationQuery{NodeID: people[0].ID, Direction: ast.RelationDirRight, Limit: 10})
+	assert.NoError(err)
+	assert.Len(out, 2)
+
+	in, err := e.ListRelations(RelationQuery{NodeID: people[0].ID, Direction: ast.RelationDirLeft, Limit: 10})
+	assert.NoError(err)
+	assert.Len(in, 1)
+	assert.Equal([]string{"follows"}, in[0].Labels)
+
+	page, err := e.ListRelations(RelationQuery{NodeID: people[0].ID, Label: "posted", Offset: 1, Limit: 10})
+	assert.NoError(err)
+	assert.Len(page, 1)
+
+	node, err := e.GetNode(posts[0].ID)
+	assert.NoError(err)
+	assert.Equal("ipfs://2", node.Attributes["uri"])
+
+	_, err = e.GetNode("nope")
+	assert.ErrorIs(err, ErrNotFound)
+
+	rel, err := e.GetRelation(in[0].ID)
+	assert.NoError(err)
+	assert.Equal(people[0].ID, rel.RightNodeID)
+	assert.Equal(ast.RelationDirRight, rel.Direction)
+
+	// matches are bound to records with their labels and attributes
+	p, err := ast.Parse(`MATCH (i:Person)-[r:posted]->(p:Post)`)
+	assert.NoError(err)
+	res, err := e.Execute(Action{Command: p.Command()})
+	assert.NoError(err)
+	matches := res.(*SearchResults)
+	assert.Equal([]string{"i", "p", "r"}, matches.Identifiers())
+	assert.Equal(2, matches.Len())
+	assert.Nil(matches.Nodes("r"))
+	assert.Len(matches.Relations("r"), 2)
+	for i, post := range matches.Nodes("p") {
+		assert.Equal([]string{"Post"}, post.Labels)
+		assert.Contains(post.Attributes, "uri")
+		assert.Equal("ann", matches.Nodes("i")[i].Attributes["name"])
+		assert.Equal([]string{"posted"}, matches.Relations("r")[i].Labels)
+		assert.Equal("44444444", matches.Relations("r")[i].OwnerID)
+	}
+
+	// paths follow the pattern, whichever way round the relation is stored
+	p, err = ast.Parse(`MATCH (p:Post)<-[r:posted]-(i:Person)`)
+	assert.NoError(err)
+	res, err = e.Execute(Action{Command: p.Command()})
+	assert.NoError(err)
+	matches = res.(*SearchResults)
+	assert.Len(matches.Paths(), 2)
+	for i, path := range matches.Paths() {
+		assert.Len(path.Nodes, 2)
+		assert.Equal([]string{"Post"}, path.Nodes[0].Labels)
+		assert.Equal("ann", path.Nodes[1].Attributes["name"])
+		assert.Len(path.Relations, 1)
+		assert.Equal(ast.RelationDirLeft, path.Relations[0].Direction)
+		assert.Equal(matches.Nodes("p")[i], path.Nodes[0])
+		assert.Equal(matches.Relations("r")[i], path.Relations[0].Relation)
+	}
+
+	p, err = ast.Parse(`MATCH (i:Person {name: 'bob'})`)
+	assert.NoError(err)
+	res, err = e.Execute(Action{Command: p.Command()})
+	assert.NoError(err)
+	matches = res.(*SearchResults)
+	assert.Len(matches.Paths(), 1)
+	assert.Len(matches.Paths()[0].Nodes, 1)
+	assert.Empty(matches.Paths()[0].Relations)
+}
+
+func TestView(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-view.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	for i, stmt := range []string{
+		`MERGE (j:Person {name: 'bob'})-[:follows]->(i:Person {name: 'ann'})`,
+		`MERGE (i:Person {name: 'ann'})-[:knows]-(p:Person {name: 'cat'})`,
+	} {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err)
+		_, err = e.Execute(Action{ID: fmt.Sprintf("view.%d", i), Identity: "55555555", Command: p.Command()})
+		assert.NoError(err)
+	}
+
+	p, err := ast.Parse(`MATCH (a:Person {name: 'ann'})-[r]-(b)`)
+	assert.NoError(err)
+	res, err := e.Execute(Action{Command: p.Command()})
+	assert.NoError(err)
+
+	view, err := NewView(res.(*SearchResults), e)
+	assert.NoError(err)
+	assert.Len(view.Nodes, 3)
+	assert.Len(view.Links, 2)
+
+	names := map[string]string{}
+	for _, node := range view.Nodes {
+		names[node.ID] = node.Attributes["name"].(string)
+		assert.Equal([]string{"Person"}, node.Labels)
+	}
+	for _, link := range view.Links {
+		assert.Equal([]string{"r"}, link.Bindings)
+		switch link.Labels[0] {
+		case "follows":
+			assert.True(link.Directed)
+			assert.Equal("bob", names[link.Source])
+			assert.Equal("ann", names[link.Target])
+		case "knows":
+			assert.False(link.Directed)
+		default:
+			t.Errorf("unexpected link %v", link.Labels)
+		}
+	}
+
+	data, err := json.Marshal(view)
+	assert.NoError(err)
+	assert.Contains(string(data), `"source"`)
+
+	dot := &strings.Builder{}
+	assert.NoError(view.WriteDOT(dot))
+	assert.True(strings.HasPrefix(dot.String(), "digraph propolis {\n"))
+	assert.Contains(dot.String(), `[label="follows"];`)
+	assert.Contains(dot.String(), `[label="knows", dir=none];`)
+	assert.Contains(dot.String(), `label=":Person\nname: ann"`)
+}
+
+func TestExecutorReadFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-acl.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	for i, stmt := range []string{
+		`MERGE (i:Person {name: 'ann'})-[:sent]->(m:Message {text: 'secret'})`,
+		`MERGE (i:Person {name: 'ann'})-[:posted]->(p:Post {text: 'public'})`,
+	} {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err)
+		_, err = e.Execute(Action{ID: fmt.Sprintf("acl.%d", i), Identity: "66666666", Command: p.Command()})
+		assert.NoError(err)
+	}
+
+	hideMessages := func(ownerID string, labels []string) bool {
+		for _, l := range labels {
+			if l == "Message" {
+				return false
+			}
+		}
+		return true
+	}
+
+	p, err := ast.Parse(`MATCH (a:Person {name: 'ann'})-[r]->(b)`)
+	assert.NoError(err)
+	res, err := e.Execute(Action{Command: p.Command()})
+	assert.NoError(err)
+	assert.Len(res.(*SearchResults).Bindings()["b"], 2)
+
+	res, err = e.Execute(Action{Command: p.Command(), Readable: hideMessages})
+	assert.NoError(err)
+	bindings := res.(*SearchResults).Bindings()
+	assert.Len(bindings["a"], 1)
+	assert.Len(bindings["r"], 1)
+	assert.Len(bindings["b"], 1)
+
+	p, err = ast.Parse(`MATCH (m:Message)`)
+	assert.NoError(err)
+	res, err = e.Execute(Action{Command: p.Command(), Readable: hideMessages})
+	assert.NoError(err)
+	assert.Empty(res.(*SearchResults).Bindings()["m"])
+}
+
+func TestExecutorSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{
+		GraphDatabaseURL: "file::graph-schema.db?mode=memory&cache=shared",
+		SchemaValidation: SchemaValidationReject,
+		SchemaOwners:     []string{"77777777"},
+		Logger:           logger,
+	})
+	assert.NoError(err)
+
+	merge := func(identity, stmt string) error {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err)
+		_, err = e.Execute(Action{ID: identity + ".1", Identity: identity, Command: p.Command()})
+		return err
+	}
+
+	declared := &LabelSchema{
+		Label: "Post",
+		Attributes: map[string]AttributeSchema{
+			"uri":   {Type: ast.AttributeDataTypeString, Required: true},
+			"likes": {Type: ast.AttributeDataTypeNumber},
+		},
+	}
+	assert.Equal("MERGE (:Schema {label: 'Post', likes: 'number', uri: 'string!'})", declared.Statement())
+	assert.ErrorIs(merge("77777777", "MERGE (:Schema {label: 'Post', uri: 'text'})"), ErrSchemaViolation)
+	assert.NoError(merge("77777777", declared.Statement()))
+	// schemas from other identities are ignored
+	assert.NoError(merge("88888888", "MERGE (:Schema {label: 'Post', uri: 'number'})"))
+
+	schemas, err := e.DeclaredSchemas()
+	assert.NoError(err)
+	assert.Len(schemas, 1)
+	assert.Equal("77777777", schemas[0].OwnerID)
+	assert.Equal(declared.Attributes, schemas[0].Attributes)
+
+	assert.NoError(merge("99999999", "MERGE (:Post {uri: 'ipfs://1', likes: 2})"))
+	assert.NoError(merge("99999999", "MERGE (:Person {name: 'ann'})-[:posted]->(:Post {uri: 'ipfs://2'})"))
+	assert.ErrorIs(merge("99999999", "MERGE (:Post {likes: 2})"), ErrSchemaViolation)
+	assert.ErrorIs(merge("99999999", "MERGE (:Post {uri: 'ipfs://3', likes: 'many'})"), ErrSchemaViolation)
+	assert.ErrorIs(merge("99999999", "MERGE (:Person {name: 'bob'})-[:posted]->(:Post {uri: 'ipfs://4', title: 'hi'})"), ErrSchemaViolation)
+
+	p, err := ast.Parse("MATCH (p:Post)")
+	assert.NoError(err)
+	res, err := e.Execute(Action{Command: p.Command()})
+	assert.NoError(err)
+	assert.Len(res.(*SearchResults).Bindings()["p"], 2)
+}
+
+func TestExecutorViews(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-views.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	merge := func(identity, id, stmt string) {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err)
+		_, err = e.Execute(Action{ID: id, Identity: identity, Command: p.Command()})
+		assert.NoError(err)
+	}
+	count := func(name, ident string) int {
+		res, err := e.QueryView(name, nil)
+		assert.NoError(err)
+		return len(res.Bindings()[ident])
+	}
+
+	merge("10101010", "views.1", `MERGE (a:Person {name: 'ann'})-[:posted]->(p:Post {uri: 'ipfs://1'})`)
+
+	assert.ErrorIs(e.RegisterView("recent", "MATCH (p:Post) SINCE '2024-01-01T00:00:00Z'"), ErrBadView)
+	assert.ErrorIs(e.RegisterView("merge", "MERGE (p:Post)"), ErrBadView)
+	assert.NoError(e.RegisterView("posts", "MATCH (p:Post)"))
+	assert.NoError(e.RegisterView("timeline", "MATCH (a:Person)-[r:posted]->(p:Post)"))
+	assert.NoError(e.RegisterView("live", "MATCH (p:Post {state: 'live'})"))
+	assert.Equal(1, count("posts", "p"))
+	assert.Equal(0, count("live", "p"))
+	assert.Equal(1, count("timeline", "r"))
+
+	// new entities are added to the views as they are merged
+	merge("10101010", "views.2", `MERGE (a:Person {name: 'ann'})-[:posted]->(p:Post {uri: 'ipfs://2', state: 'live'})`)
+	merge("20202020", "views.3", `MERGE (b:Person {name: 'bob'})-[:follows]->(a:Person {name: 'cat'})`)
+	assert.Equal(2, count("posts", "p"))
+	assert.Equal(2, count("timeline", "r"))
+	assert.Equal(2, count("timeline", "a"))
+	assert.Equal(1, count("live", "p"))
+
+	// and taken out when they no longer match
+	live, err := e.QueryView("live", nil)
+	assert.NoError(err)
+	liveID := live.Nodes("p")[0].ID
+	merge("10101010", "views.4", `MERGE (p:Post {id: '`+liveID+`', uri: 'ipfs://2', state: 'archived'})`)
+	assert.Equal(0, count("live", "p"))
+	assert.Equal(2, count("posts", "p"))
+
+	_, err = e.PurgeIdentity("10101010")
+	assert.NoError(err)
+	assert.Equal(0, count("posts", "p"))
+	assert.Equal(0, count("timeline", "r"))
+
+	views, err := e.RegisteredViews()
+	assert.NoError(err)
+	assert.Len(views, 3)
+	assert.NoError(e.DropView("posts"))
+	assert.ErrorIs(e.DropView("posts"), ErrNotFound)
+	_, err = e.QueryView("posts", nil)
+	assert.ErrorIs(err, ErrNotFound)
+}
+
+func TestExecutorFeed(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-feed.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	merge := func(identity, id, stmt string) {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err)
+		_, err = e.Execute(Action{ID: id, Identity: identity, Command: p.Command()})
+		assert.NoError(err)
+	}
+	feed := func(q FeedQuery) []string {
+		if q.Limit == 0 {
+			q.Limit = 10
+		}
+		res, err := e.Feed(q)
+		assert.NoError(err)
+		uris := []string{}
+		for _, n := range res {
+			uris = append(uris, n.Attributes["uri"].(string))
+		}
+		return uris
+	}
+
+	merge("10101010", "feed.1", `MERGE (p:Post {uri: 'ipfs://1'})-[:tagged]->(t:Tag {value: 'go'})`)
+	merge("20202020", "feed.2", `MERGE (p:Post {uri: 'ipfs://2'})`)
+	merge("20202020", "feed.3", `MERGE (p:Post {uri: 'ipfs://3'})-[:tagged]->(t:Tag {value: 'rust'})`)
+	merge("30303030", "feed.4", `MERGE (p:Post {uri: 'ipfs://4', lang: 'en'})`)
+
+	assert.Empty(feed(FeedQuery{Label: "Post"}))
+	assert.Equal([]string{"ipfs://3", "ipfs://2"}, feed(FeedQuery{Label: "Post", Owners: []string{"20202020"}}))
+	assert.Equal([]string{"ipfs://1"}, feed(FeedQuery{Label: "Post", Topics: []string{"Tag:value=go"}}))
+	assert.Equal([]string{"ipfs://3", "ipfs://1"}, feed(FeedQuery{Label: "Post", Topics: []string{"Tag"}}))
+	assert.Equal([]string{"ipfs://4", "ipfs://1"}, feed(FeedQuery{Label: "Post", Owners: []string{"10101010"}, Topics: []string{"Post:lang=en"}}))
+	assert.Empty(feed(FeedQuery{Label: "Tag", Topics: []string{"Post:lang=en"}}))
+
+	// pages continue from the last node of the one before
+	everyone := []string{"10101010", "20202020", "30303030"}
+	page, err := e.Feed(FeedQuery{Label: "Post", Owners: everyone, Limit: 2})
+	assert.NoError(err)
+	assert.Len(page, 2)
+	last := page[len(page)-1]
+	assert.Equal([]string{"ipfs://2", "ipfs://1"}, feed(FeedQuery{
+		Label:  "Post",
+		Owners: everyone,
+		Before: &FeedCursor{CreatedAt: last.CreatedAt, ID: last.ID},
+	}))
+}
+
+func TestExecutorWhere(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-where.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	for i, stmt := range []string{
+		`MERGE (a:Host {name: 'alpha'})-[r:CONNECTED {ipAddress: '10.0.0.1', port: 22}]->(b:Host {name: 'beta'})`,
+		`MERGE (a:Host {name: 'alpha'})-[r:CONNECTED:BLOCKED {ipAddress: '10.0.0.2', port: 80}]->(c:Host {name: 'gamma', zone: 'dmz'})`,
+		`MERGE (b:Host {name: 'beta'})-[r:CONNECTED {port: 443}]->(c:Host {name: 'gamma', zone: 'dmz'})`,
+	} {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err)
+		_, err = e.Execute(Action{ID: fmt.Sprintf("where.%d", i), Identity: "10101010", Command: p.Command()})
+		assert.NoError(err)
+	}
+
+	count := func(stmt, ident string) int {
+		p, err := ast.Parse(stmt)
+		if !assert.NoError(err, stmt) {
+			return -1
+		}
+		res, err := e.Execute(Action{Command: p.Command()})
+		if !assert.NoError(err, stmt) {
+			return -1
+		}
+		return len(res.(*SearchResults).Bindings()[ident])
+	}
+
+	for stmt, expected := range map[string]int{
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE r.ipAddress = '10.0.0.1'`:              1,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE r.ipAddress <> '10.0.0.1'`:             1,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE NOT r.ipAddress = '10.0.0.1'`:          2,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE r:BLOCKED`:                             1,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE NOT r:BLOCKED`:                         2,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE r:CONNECTED:BLOCKED`:                   1,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE r.port IN [22, 443]`:                   2,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE r.port IN []`:                          0,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE r.port >= 80`:                          2,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE r.port < 100 AND NOT r:BLOCKED`:        1,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE r.ipAddress IS NULL`:                   1,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE r.ipAddress IS NOT NULL`:               2,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE b.zone = 'dmz' OR r.port = 22`:         3,
+		`MATCH (a)-[r:CONNECTED]->(b) WHERE a.name = 'beta' AND b.zone IS NULL`:    0,
+		`MATCH (h:Host) WHERE h.zone IS NULL`:                                      2,
+		`MATCH (h:Host) WHERE h.name IN ['alpha', 'gamma'] AND NOT h.zone = 'dmz'`: 1,
+	} {
+		ident := "r"
+		if strings.HasPrefix(stmt, "MATCH (h") {
+			ident = "h"
+		}
+		assert.Equal(expected, count(stmt, ident), stmt)
+	}
+}
+
+func TestExecutorUnitOfWork(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{
+		GraphDatabaseURL: "file::graph-unit.db?mode=memory&cache=shared",
+		SchemaValidation: SchemaValidationReject,
+		Logger:           logger,
+	})
+	assert.NoError(err)
+
+	action := func(stmt string) Action {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err, stmt)
+		return Action{ID: stmt, Identity: "55555555", Command: p.Command()}
+	}
+	posts := func(execute func(Action) (any, error)) int {
+		res, err := execute(action("MATCH (p:Post)"))
+		if !assert.NoError(err) {
+			return -1
+		}
+		return res.(*SearchResults).Len()
+	}
+
+	_, err = e.Execute(action("MERGE (:Schema {label: 'Post', uri: 'string!'})"))
+	assert.NoError(err)
+
+	uow, err := e.Begin()
+	assert.NoError(err)
+	_, err = uow.Execute(action("MERGE (:Post {uri: 'ipfs://1'})"))
+	assert.NoError(err)
+	// a failed statement leaves the rest of the unit of work in place
+	_, err = uow.Execute(action("MERGE (:Post {likes: 2})"))
+	assert.ErrorIs(err, ErrSchemaViolation)
+	_, err = uow.Execute(action("MERGE (:Post {uri: 'ipfs://2'})"))
+	assert.NoError(err)
+	assert.Equal(2, posts(uow.Execute))
+	assert.NoError(uow.Commit())
+	assert.Equal(2, posts(e.Execute))
+
+	uow, err = e.Begin()
+	assert.NoError(err)
+	_, err = uow.Execute(action("MERGE (:Post {uri: 'ipfs://4'})"))
+	assert.NoError(err)
+	assert.NoError(uow.Rollback())
+	assert.Equal(2, posts(e.Execute))
+}
+
+func TestExecutorMergeUnchanged(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-unchanged.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	merge := func(id, stmt string) any {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err, stmt)
+		res, err := e.Execute(Action{ID: id, Identity: "66666666", Command: p.Command()})
+		assert.NoError(err, stmt)
+		return res
+	}
+
+	first := merge("unchanged.1", `MERGE (p:Post {uri: 'ipfs://1', likes: 2})`).(*Node)
+	assert.False(first.Unchanged)
+
+	again := merge("unchanged.2", `MERGE (p:Post {uri: 'ipfs://1', likes: 2})`).(*Node)
+	assert.True(again.Unchanged)
+	assert.Equal(first.ID, again.ID)
+	assert.Nil(again.UpdatedAt)
+	assert.Equal("unchanged.1", again.LastActionID)
+
+	relabelled := merge("unchanged.3", fmt.Sprintf(`MERGE (p:Post:Pinned {id: '%s', uri: 'ipfs://1', likes: 2})`, first.ID)).(*Node)
+	assert.Equal(first.ID, relabelled.ID)
+	assert.False(relabelled.Unchanged)
+	assert.NotNil(relabelled.UpdatedAt)
+	assert.Equal("unchanged.3", relabelled.LastActionID)
+
+	record, err := e.GetNode(first.ID)
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"Post", "Pinned"}, record.Labels)
+	assert.Equal("unchanged.3", record.LastActionID)
+
+	stmt := `MERGE (a:Person {name: 'ann'})-[r:likes {weight: 1}]->(p:Post {uri: 'ipfs://1', likes: 2})`
+	rel := merge("unchanged.4", stmt).(*Relation)
+	assert.False(rel.Unchanged)
+	rel = merge("unchanged.5", stmt).(*Relation)
+	assert.True(rel.Unchanged)
+	assert.Nil(rel.UpdatedAt)
+
+	rel = merge("unchanged.6", `MERGE (a:Person {name: 'ann'})<-[r:likes {weight: 1}]-(p:Post {uri: 'ipfs://1', likes: 2})`).(*Relation)
+	assert.False(rel.Unchanged)
+	assert.NotNil(rel.UpdatedAt)
+	assert.Equal(ast.RelationDirLeft, rel.Direction)
+}
+
+func TestExecutorMergeByID(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-merge-id.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	merge := func(id, owner, stmt string) (any, error) {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err, stmt)
+		return e.Execute(Action{ID: id, Identity: owner, Command: p.Command()})
+	}
+
+	// the id names the node so changing its attributes updates it
+	res, err := merge("by-id.1", "77777777", `MERGE (:Identity {id: '77777777', handle: 'ann'})`)
+	assert.NoError(err)
+	assert.Equal("77777777", res.(*Node).ID)
+	res, err = merge("by-id.2", "77777777", `MERGE (:Identity {id: '77777777', handle: 'anne'})`)
+	assert.NoError(err)
+	assert.Equal("77777777", res.(*Node).ID)
+	assert.False(res.(*Node).Unchanged)
+
+	record, err := e.GetNode("77777777")
+	assert.NoError(err)
+	assert.Equal("anne", record.Attributes["handle"])
+	assert.Equal("by-id.2", record.LastActionID)
+
+	_, err = merge("by-id.3", "88888888", `MERGE (:Identity {id: '77777777', handle: 'bob'})`)
+	assert.ErrorIs(err, ErrUnauthorized)
+}
+
+func TestExecutorLabelOnlyMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-labels.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	for i, stmt := range []string{
+		`MERGE (a:Person:Author {name: 'ann'})`,
+		`MERGE (b:Person {name: 'bob'})`,
+		`MERGE (c:Author {name: 'cat'})`,
+		`MERGE (a:Person:Author {name: 'ann'})-[:wrote]->(p:Post {uri: 'ipfs://1'})`,
+		`MERGE (b:Person {name: 'bob'})-[:wrote]->(p:Post {uri: 'ipfs://2'})`,
+	} {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err)
+		_, err = e.Execute(Action{ID: fmt.Sprintf("labels.%d", i), Identity: "12121212", Command: p.Command()})
+		assert.NoError(err)
+	}
+
+	match := func(stmt, ident string) []string {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err, stmt)
+		res, err := e.Execute(Action{Command: p.Command()})
+		if !assert.NoError(err, stmt) {
+			return nil
+		}
+		names := []string{}
+		for _, n := range res.(*SearchResults).Nodes(ident) {
+			names = append(names, n.Attributes["name"].(string))
+		}
+		return names
+	}
+
+	assert.ElementsMatch([]string{"ann", "bob"}, match(`MATCH (n:Person)`, "n"))
+	assert.ElementsMatch([]string{"ann"}, match(`MATCH (n:Person:Author)`, "n"))
+	assert.ElementsMatch([]string{"ann", "cat"}, match(`MATCH (n:Author)`, "n"))
+	assert.Empty(match(`MATCH (n:Editor)`, "n"))
+	assert.ElementsMatch([]string{"ann"}, match(`MATCH (a:Author)-[r:wrote]->(p:Post)`, "a"))
+	assert.ElementsMatch([]string{"ann", "bob"}, match(`MATCH (a:Person)-[r:wrote]->(p:Post)`, "a"))
+}
+
+func TestExecutorStats(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-stats.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	merge := func(identity, stmt string) any {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err, stmt)
+		res, err := e.Execute(Action{ID: stmt, Identity: identity, Command: p.Command()})
+		assert.NoError(err, stmt)
+		return res
+	}
+
+	ann := merge("13131313", `MERGE (a:Person:Author {name: 'ann'})`).(*Node)
+	merge("13131313", `MERGE (a:Person:Author {name: 'ann'})-[:wrote:published {via: 'web'}]->(p:Post {uri: 'ipfs://1'})`)
+	merge("13131313", `MERGE (a:Person:Author {name: 'ann'})-[:wrote {via: 'app'}]->(p:Post {uri: 'ipfs://2'})`)
+	merge("14141414", `MERGE (b:Person {name: 'bob'})`)
+
+	stats, err := e.Stats()
+	assert.NoError(err)
+	assert.Equal(map[string]int64{"Person": 2, "Author": 1, "Post": 2}, stats.NodeLabels)
+	assert.Equal(map[string]int64{"name": 2, "uri": 2}, stats.NodeAttributes)
+	assert.Equal(map[string]int64{"wrote": 2, "published": 1}, stats.RelationLabels)
+	assert.Equal(map[string]int64{"via": 2}, stats.RelationAttributes)
+
+	// relations match on every label, whichever order they are joined in
+	p, err := ast.Parse(`MATCH (a:Author)-[r:wrote:published]->(p:Post)`)
+	assert.NoError(err)
+	res, err := e.Execute(Action{Command: p.Command()})
+	assert.NoError(err)
+	assert.Equal(1, res.(*SearchResults).Len())
+
+	merge("13131313", fmt.Sprintf(`MERGE (a:Person {id: '%s', name: 'ann'})`, ann.ID))
+	stats, err = e.Stats()
+	assert.NoError(err)
+	assert.Equal(map[string]int64{"Person": 2, "Post": 2}, stats.NodeLabels)
+	assert.Equal(map[string]int64{"id": 1, "name": 2, "uri": 2}, stats.NodeAttributes)
+
+	_, err = e.PurgeIdentity("13131313")
+	assert.NoError(err)
+	stats, err = e.Stats()
+	assert.NoError(err)
+	assert.Equal(map[string]int64{"Person": 1}, stats.NodeLabels)
+	assert.Equal(map[string]int64{"name": 1}, stats.NodeAttributes)
+	assert.Empty(stats.RelationLabels)
+}
+
+func TestExecutorCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-checkpoint.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	p, err := ast.Parse(`MERGE (a:Person {name: 'ann'})-[:knows]->(b:Person {name: 'bob'})`)
+	assert.NoError(err)
+	_, err = e.Execute(Action{ID: "1", Identity: "13131313", Command: p.Command()})
+	assert.NoError(err)
+
+	path := filepath.Join(t.TempDir(), "checkpoint.db")
+	assert.NoError(e.Checkpoint(path))
+	assert.Error(e.Checkpoint(path), "an existing file isn't overwritten")
+
+	// later changes aren't in the checkpoint
+	p, err = ast.Parse(`MERGE (c:Person {name: 'cat'})`)
+	assert.NoError(err)
+	_, err = e.Execute(Action{ID: "2", Identity: "13131313", Command: p.Command()})
+	assert.NoError(err)
+
+	c, err := New(Config{GraphDatabaseURL: "file:" + path, Logger: logger})
+	assert.NoError(err)
+	defer c.Close()
+
+	p, err = ast.Parse(`MATCH (a:Person)-[r:knows]->(b:Person)`)
+	assert.NoError(err)
+	res, err := c.Execute(Action{Command: p.Command()})
+	assert.NoError(err)
+	assert.Equal(1, res.(*SearchResults).Len())
+
+	stats, err := c.Stats()
+	assert.NoError(err)
+	assert.Equal(map[string]int64{"Person": 2}, stats.NodeLabels)
+}
+
+func TestExecutorState(t *testing.T) {
+	assert := assert.New(t)
+
+	stmts := []string{
+		`MERGE (a:Person:Author {name: 'ann'})-[:wrote {via: 'web'}]->(p:Post {uri: 'ipfs://1'})`,
+		`MERGE (b:Person {name: 'bob', age: 42})<-[:follows]-(a:Person:Author {name: 'ann'})`,
+	}
+
+	states := []*State{}
+	for _, name := range []string{"graph-state-1.db", "graph-state-2.db"} {
+		e, err := New(Config{GraphDatabaseURL: "file::" + name + "?mode=memory&cache=shared", Logger: logger})
+		assert.NoError(err)
+
+		for i, stmt := range stmts {
+			p, err := ast.Parse(stmt)
+			assert.NoError(err)
+			_, err = e.Execute(Action{ID: fmt.Sprintf("action-%d", i), Identity: "13131313", Command: p.Command()})
+			assert.NoError(err)
+		}
+
+		state, err := e.State()
+		assert.NoError(err)
+		states = append(states, state)
+
+		// the second graph goes on to diverge
+		p, err := ast.Parse(`MERGE (c:Person {name: 'cat'})`)
+		assert.NoError(err)
+		_, err = e.Execute(Action{ID: "action-2", Identity: "14141414", Command: p.Command()})
+		assert.NoError(err)
+	}
+
+	// the node IDs differ but the content is the same
+	assert.Equal(states[0].Hash, states[1].Hash)
+	assert.Len(states[0].Nodes, 3)
+	assert.Len(states[0].Relations, 2)
+	assert.Contains(states[0].Nodes, `(:Author:Person {name: "ann"/1} owner=13131313 action=action-0)`)
+
+	missing, extra := states[0].Diff(states[1])
+	assert.Empty(missing)
+	assert.Empty(extra)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-state-2.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+	state, err := e.State()
+	assert.NoError(err)
+	assert.NotEqual(states[0].Hash, state.Hash)
+
+	missing, extra = states[0].Diff(state)
+	assert.Empty(missing)
+	assert.Equal([]string{`(:Person {name: "cat"/1} owner=14141414 action=action-2)`}, extra)
+}
+
+func TestExecutorTopicState(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := New(Config{GraphDatabaseURL: "file::graph-topic-state.db?mode=memory&cache=shared", Logger: logger})
+	assert.NoError(err)
+
+	for i, stmt := range []string{
+		`MERGE (a:Person {name: 'ann'})-[:wrote]->(p:Post {uri: 'ipfs://1'})`,
+		`MERGE (b:Person {name: 'bob', age: 42})`,
+	} {
+		p, err := ast.Parse(stmt)
+		assert.NoError(err)
+		_, err = e.Execute(Action{ID: fmt.Sprintf("action-%d", i), Identity: "13131313", Command: p.Command()})
+		assert.NoError(err)
+	}
+
+	// relations attached to the topic's nodes are reached with the nodes at
+	// their other end
+	state, err := e.TopicState("Post")
+	assert.NoError(err)
+	assert.Equal([]string{`(:Post {uri: "ipfs://1"/1} owner=13131313 action=action-0)`}, state.Nodes)
+	assert.Equal([]string{`(:Person {name: "ann"/1} owner=13131313 action=action-0)-[:wrote {} owner=13131313 action=action-0]->(:Post {uri: "ipfs://1"/1} owner=13131313 action=action-0)`}, state.Relations)
+
+	state, err = e.TopicState("wrote")
+	assert.NoError(err)
+	assert.Empty(state.Nodes)
+	assert.Len(state.Relations, 1)
+
+	state, err = e.TopicState("Person:age=42")
+	assert.NoError(err)
+	assert.Equal([]string{`(:Person {age: "42"/0, name: "bob"/1} owner=13131313 action=action-1)`}, state.Nodes)
+	assert.Empty(state.Relations)
+
+	person, err := e.TopicState("Person")
+	assert.NoError(err)
+	assert.Len(person.Nodes, 2)
+	assert.NotEqual(person.Hash, state.Hash)
+
+	state, err = e.TopicState("Missing")
+	assert.NoError(err)
+	assert.Empty(state.Nodes)
+	assert.Empty(state.Relations)
 }
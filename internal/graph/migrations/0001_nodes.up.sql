@@ -0,0 +1,7 @@
+create table nodes (
+	id text not null primary key,
+	created_at datetime not null,
+	updated_at datetime null,
+	owner_id text not null,
+	last_action_id text not null
+);
@@ -0,0 +1 @@
+drop index idx_nodes_attributes_attr_name;
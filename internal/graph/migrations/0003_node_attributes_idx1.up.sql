@@ -0,0 +1 @@
+create index idx_nodes_attributes_attr_name on node_attributes(attr_name);
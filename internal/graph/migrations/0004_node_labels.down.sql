@@ -0,0 +1 @@
+drop table node_labels;
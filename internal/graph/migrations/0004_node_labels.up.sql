@@ -0,0 +1,9 @@
+create table node_labels (
+	id text not null primary key,
+	created_at datetime not null,
+	updated_at datetime null,
+	last_action_id text not null,
+	node_id text not null,
+	label text not null,
+	foreign key(node_id) references nodes(id)
+);
@@ -0,0 +1 @@
+drop index idx_node_labels_label;
@@ -0,0 +1 @@
+create index idx_node_labels_label on node_labels(label);
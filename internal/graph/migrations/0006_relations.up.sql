@@ -0,0 +1,12 @@
+create table relations (
+	id text not null primary key,
+	created_at datetime not null,
+	updated_at datetime null,
+	owner_id text not null,
+	last_action_id text not null,
+	left_node_id text not null,
+	right_node_id text not null,
+	direction int not null,
+	foreign key(left_node_id) references nodes(id),
+	foreign key(right_node_id) references nodes(id)
+);
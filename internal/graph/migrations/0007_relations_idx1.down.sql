@@ -0,0 +1 @@
+drop index idx_relations_direction;
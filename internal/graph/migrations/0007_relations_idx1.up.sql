@@ -0,0 +1 @@
+create index idx_relations_direction on relations(direction);
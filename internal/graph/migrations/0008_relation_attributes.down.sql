@@ -0,0 +1 @@
+drop table relation_attributes;
@@ -0,0 +1,11 @@
+create table relation_attributes (
+	id text not null primary key,
+	created_at datetime not null,
+	updated_at datetime null,
+	last_action_id text not null,
+	relation_id text not null,
+	attr_name text not null,
+	attr_value text not null,
+	data_type int not null,
+	foreign key(relation_id) references relations(id)
+);
@@ -0,0 +1 @@
+drop index idx_relation_attributes_attr_name;
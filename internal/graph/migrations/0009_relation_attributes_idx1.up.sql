@@ -0,0 +1 @@
+create index idx_relation_attributes_attr_name on relation_attributes(attr_name);
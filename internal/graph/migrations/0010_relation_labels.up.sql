@@ -0,0 +1,9 @@
+create table relation_labels(
+	id text not null primary key,
+	created_at datetime not null,
+	updated_at datetime null,
+	last_action_id text not null,
+	relation_id text not null,
+	label text not null,
+	foreign key(relation_id) references relations(id)
+);
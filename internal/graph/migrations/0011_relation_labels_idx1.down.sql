@@ -0,0 +1 @@
+drop index relation_labels_label;
@@ -0,0 +1 @@
+create index relation_labels_label on relation_labels(label);
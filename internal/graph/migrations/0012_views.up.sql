@@ -0,0 +1,5 @@
+create table views (
+	name text not null primary key,
+	statement text not null,
+	created_at datetime not null
+);
@@ -0,0 +1 @@
+drop table view_rows;
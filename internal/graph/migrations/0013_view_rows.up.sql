@@ -0,0 +1,8 @@
+create table view_rows (
+	view_name text not null,
+	rel_id text null,
+	left_node_id text not null,
+	right_node_id text null,
+	created_at datetime not null,
+	foreign key(view_name) references views(name)
+);
@@ -0,0 +1 @@
+drop index idx_view_rows_view_name;
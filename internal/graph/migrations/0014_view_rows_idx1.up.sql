@@ -0,0 +1 @@
+create index idx_view_rows_view_name on view_rows(view_name);
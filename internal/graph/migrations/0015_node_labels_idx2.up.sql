@@ -0,0 +1,2 @@
+-- cover label lookups so label-only matches never read the tables
+create index idx_node_labels_label_node_id on node_labels(label, node_id);
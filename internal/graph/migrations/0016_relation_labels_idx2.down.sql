@@ -0,0 +1 @@
+drop index idx_relation_labels_label_relation_id;
@@ -0,0 +1 @@
+create index idx_relation_labels_label_relation_id on relation_labels(label, relation_id);
@@ -0,0 +1,7 @@
+create table stats (
+	entity text not null,
+	kind text not null,
+	name text not null,
+	count int not null,
+	primary key(entity, kind, name)
+);
@@ -0,0 +1,8 @@
+insert into stats(entity, kind, name, count)
+select 'node', 'label', label, count(*) from node_labels group by label
+union all
+select 'node', 'attribute', attr_name, count(*) from node_attributes group by attr_name
+union all
+select 'relation', 'label', label, count(*) from relation_labels group by label
+union all
+select 'relation', 'attribute', attr_name, count(*) from relation_attributes group by attr_name;
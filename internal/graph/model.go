@@ -18,6 +18,9 @@ package graph
 
 import (
 	"crypto/x509"
+	"encoding/json"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/jdudmesh/propolis/internal/ast"
@@ -32,10 +35,27 @@ type Action struct {
 	Identity         string            `db:"identity"`
 	ReceivedBy       string            `db:"received_by"`
 	EncodedSignature string            `db:"encoded_sig"`
+	ExpiresAt        *time.Time        `db:"expires_at"`
+	KeyID            string            `db:"key_id"`
+	ManifestVersion  int               `db:"manifest_version"`
+	CreatedAt        *time.Time        `db:"created_at"`
+	TTL              int               `db:"ttl"`
+	Namespace        string            `db:"namespace"`
+	Delegation       string            `db:"delegation"`
+	EntityIDs        []string          `db:"-"`
+	Topics           []string          `db:"-"`
 	Certificate      *x509.Certificate `db:"-"`
 	Command          ast.Command       `db:"-"`
+	// Readable, if set, limits what a MATCH returns to the entities it
+	// accepts
+	Readable ReadFilter `db:"-"`
 }
 
+// ReadFilter reports whether a query may see an entity with the given owner
+// and labels. A match including an entity it rejects is left out of the
+// results.
+type ReadFilter func(ownerID string, labels []string) bool
+
 type Node struct {
 	ID           string           `db:"id"`
 	CreatedAt    time.Time        `db:"created_at"`
@@ -45,6 +65,9 @@ type Node struct {
 	labels       []*NodeLabel     `db:"-"`
 	attributes   []*NodeAttribute `db:"-"`
 	Relations    []*Relation      `db:"-"`
+	// Unchanged is set when a MERGE found the node with the labels and
+	// attributes it gave, so nothing was written
+	Unchanged bool `db:"-"`
 }
 
 type NodeAttribute struct {
@@ -80,6 +103,9 @@ type Relation struct {
 	attributes   []*RelationAttribute `db:"-"`
 	leftNode     *Node                `db:"-"`
 	rightNode    *Node                `db:"-"`
+	// Unchanged is set when a MERGE found the relation and both its nodes as
+	// it gave them, so nothing was written
+	Unchanged bool `db:"-"`
 }
 
 type RelationAttribute struct {
@@ -102,6 +128,102 @@ type RelationLabel struct {
 	Label        string     `db:"label"`
 }
 
+// SearchResults are the nodes and relations a MATCH bound to each identifier
+// in its pattern, with their labels and attributes. For relation matches the
+// bindings line up, the nth entries of each are from the same match.
 type SearchResults struct {
-	data map[string][]any
+	data  map[string][]any
+	paths []*Path
+}
+
+// Bindings returns the nodes and relations bound to each identifier in the
+// match clause, as *NodeRecord and *RelationRecord
+func (s *SearchResults) Bindings() map[string][]any {
+	return s.data
+}
+
+// Identifiers returns the identifiers in the match clause, sorted
+func (s *SearchResults) Identifiers() []string {
+	return slices.Sorted(maps.Keys(s.data))
+}
+
+// Len returns the number of matches
+func (s *SearchResults) Len() int {
+	n := 0
+	for _, bound := range s.data {
+		n = max(n, len(bound))
+	}
+	return n
+}
+
+// Nodes returns the nodes bound to an identifier, nil if it is bound to
+// relations or isn't in the match clause
+func (s *SearchResults) Nodes(ident string) []*NodeRecord {
+	return boundTo[*NodeRecord](s.data[ident])
+}
+
+// Relations returns the relations bound to an identifier, nil if it is bound
+// to nodes or isn't in the match clause
+func (s *SearchResults) Relations(ident string) []*RelationRecord {
+	return boundTo[*RelationRecord](s.data[ident])
+}
+
+// Paths returns each match as a path through the graph. A match of a single
+// node is a path with no relations.
+func (s *SearchResults) Paths() []*Path {
+	return s.paths
+}
+
+func boundTo[T any](bound []any) []T {
+	res := make([]T, 0, len(bound))
+	for _, b := range bound {
+		t, ok := b.(T)
+		if !ok {
+			return nil
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// Path is the traversal a MATCH made: its nodes in the order the pattern
+// lists them and the relations between each consecutive pair
+type Path struct {
+	Nodes     []*NodeRecord   `json:"nodes"`
+	Relations []*PathRelation `json:"relations"`
+}
+
+// PathRelation is a relation in a path. Direction is relative to the path
+// rather than to how the relation is stored: RelationDirRight if it points
+// from the node before it to the node after it, RelationDirLeft if it points
+// back and RelationDirNeutral if it is undirected.
+type PathRelation struct {
+	Relation  *RelationRecord `json:"relation"`
+	Direction ast.RelationDir `json:"direction"`
+}
+
+func newPath(nodes []*NodeRecord, relations []*RelationRecord) *Path {
+	path := &Path{
+		Nodes:     nodes,
+		Relations: make([]*PathRelation, 0, len(relations)),
+	}
+	for i, r := range relations {
+		dir := r.Direction
+		if i < len(nodes) && r.LeftNodeID != nodes[i].ID {
+			switch dir {
+			case ast.RelationDirLeft:
+				dir = ast.RelationDirRight
+			case ast.RelationDirRight:
+				dir = ast.RelationDirLeft
+			}
+		}
+		path.Relations = append(path.Relations, &PathRelation{Relation: r, Direction: dir})
+	}
+	return path
+}
+
+// MarshalJSON encodes the results as a map of the identifiers in the match
+// clause to the nodes or relations bound to them
+func (s *SearchResults) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.data)
 }
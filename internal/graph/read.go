@@ -0,0 +1,412 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package graph
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jmoiron/sqlx"
+)
+
+// Schema summarises the labels seen in the graph and the attributes of the
+// nodes and relations which have them. It is used to generate typed read
+// APIs over the graph.
+type Schema struct {
+	NodeLabels     map[string][]AttributeInfo
+	RelationLabels map[string][]AttributeInfo
+}
+
+// AttributeInfo describes an attribute seen on a label. Its type is number
+// only if every value seen is a number.
+type AttributeInfo struct {
+	Name string
+	Type ast.AttributeDataType
+}
+
+// NodeRecord is a node with its labels and attributes. Number attributes are
+// float64s, everything else strings.
+type NodeRecord struct {
+	ID           string
+	CreatedAt    time.Time
+	UpdatedAt    *time.Time
+	OwnerID      string
+	LastActionID string
+	Labels       []string
+	Attributes   map[string]any
+}
+
+// RelationRecord is a relation with its labels and attributes
+type RelationRecord struct {
+	ID           string
+	CreatedAt    time.Time
+	UpdatedAt    *time.Time
+	OwnerID      string
+	LastActionID string
+	LeftNodeID   string
+	RightNodeID  string
+	Direction    ast.RelationDir
+	Labels       []string
+	Attributes   map[string]any
+}
+
+// NodeQuery selects nodes with a label, optionally filtered by attribute
+// values, in the order they were created
+type NodeQuery struct {
+	Label      string
+	Attributes map[string]string
+	Offset     int
+	Limit      int
+}
+
+// RelationQuery selects the relations of a node. Direction is
+// RelationDirRight for relations pointing away from the node,
+// RelationDirLeft for those pointing to it and RelationDirNeutral for all of
+// them. Label is optional.
+type RelationQuery struct {
+	NodeID    string
+	Label     string
+	Direction ast.RelationDir
+	Offset    int
+	Limit     int
+}
+
+// Schema returns the labels in the graph and the attributes used with them
+func (e *executor) Schema() (*Schema, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	nodeLabels, err := e.labelAttributes(ctx, "node")
+	if err != nil {
+		return nil, fmt.Errorf("reading node labels: %w", err)
+	}
+
+	relationLabels, err := e.labelAttributes(ctx, "relation")
+	if err != nil {
+		return nil, fmt.Errorf("reading relation labels: %w", err)
+	}
+
+	return &Schema{
+		NodeLabels:     nodeLabels,
+		RelationLabels: relationLabels,
+	}, nil
+}
+
+// labelAttributes lists the attributes of each label for nodes or relations.
+// The table names are fixed so are safe to build into the query.
+func (e *executor) labelAttributes(ctx context.Context, entity string) (map[string][]AttributeInfo, error) {
+	rows := []struct {
+		Label    string  `db:"label"`
+		Name     *string `db:"attr_name"`
+		DataType *int    `db:"data_type"`
+	}{}
+
+	err := e.store.db.SelectContext(ctx, &rows, fmt.Sprintf(`
+		select l.label, a.attr_name, max(a.data_type) data_type
+		from %[1]s_labels l
+		left join %[1]s_attributes a on a.%[1]s_id = l.%[1]s_id
+		group by l.label, a.attr_name
+		order by l.label, a.attr_name`, entity))
+	if err != nil {
+		return nil, err
+	}
+
+	// strings sort after numbers so the max is only a number if all are
+	labels := map[string][]AttributeInfo{}
+	for _, row := range rows {
+		if _, ok := labels[row.Label]; !ok {
+			labels[row.Label] = []AttributeInfo{}
+		}
+		if row.Name == nil {
+			continue
+		}
+		labels[row.Label] = append(labels[row.Label], AttributeInfo{
+			Name: *row.Name,
+			Type: ast.AttributeDataType(*row.DataType),
+		})
+	}
+
+	return labels, nil
+}
+
+// GetNode returns a node by ID or ErrNotFound
+func (e *executor) GetNode(id string) (*NodeRecord, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	nodes, err := e.nodeRecords(ctx, e.store.db, `select * from nodes where id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, ErrNotFound
+	}
+	return nodes[0], nil
+}
+
+// GetRelation returns a relation by ID or ErrNotFound
+func (e *executor) GetRelation(id string) (*RelationRecord, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	relations, err := e.relationRecords(ctx, e.store.db, `select * from relations where id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(relations) == 0 {
+		return nil, ErrNotFound
+	}
+	return relations[0], nil
+}
+
+// ListNodes returns a page of the nodes matching the query
+func (e *executor) ListNodes(q NodeQuery) ([]*NodeRecord, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	query := strings.Builder{}
+	query.WriteString(`select n.* from nodes n where exists (select 1 from node_labels l where l.node_id = n.id and l.label = ?)`)
+	args := []any{q.Label}
+
+	names := make([]string, 0, len(q.Attributes))
+	for name := range q.Attributes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		query.WriteString(` and exists (select 1 from node_attributes a where a.node_id = n.id and a.attr_name = ? and a.attr_value = ?)`)
+		args = append(args, name, q.Attributes[name])
+	}
+
+	query.WriteString(` order by n.created_at, n.id limit ? offset ?`)
+	args = append(args, q.Limit, q.Offset)
+
+	return e.nodeRecords(ctx, e.store.db, query.String(), args...)
+}
+
+// ListRelations returns a page of the relations of a node
+func (e *executor) ListRelations(q RelationQuery) ([]*RelationRecord, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	// undirected relations count as both outgoing and incoming
+	var where string
+	var args []any
+	switch q.Direction {
+	case ast.RelationDirRight:
+		where = `((r.left_node_id = ? and r.direction != ?) or (r.right_node_id = ? and r.direction != ?))`
+		args = []any{q.NodeID, ast.RelationDirLeft, q.NodeID, ast.RelationDirRight}
+	case ast.RelationDirLeft:
+		where = `((r.right_node_id = ? and r.direction != ?) or (r.left_node_id = ? and r.direction != ?))`
+		args = []any{q.NodeID, ast.RelationDirLeft, q.NodeID, ast.RelationDirRight}
+	default:
+		where = `(r.left_node_id = ? or r.right_node_id = ?)`
+		args = []any{q.NodeID, q.NodeID}
+	}
+
+	query := `select r.* from relations r where ` + where
+	if q.Label != "" {
+		query += ` and exists (select 1 from relation_labels l where l.relation_id = r.id and l.label = ?)`
+		args = append(args, q.Label)
+	}
+	query += ` order by r.created_at, r.id limit ? offset ?`
+	args = append(args, q.Limit, q.Offset)
+
+	return e.relationRecords(ctx, e.store.db, query, args...)
+}
+
+// maxBatch is the most IDs put in one IN list, well under SQLite's limit on
+// query parameters
+const maxBatch = 500
+
+// nodeRecordsByID loads the nodes with the given IDs, keyed by ID. IDs can
+// be repeated, each node is loaded once.
+func (e *executor) nodeRecordsByID(ctx context.Context, q sqlx.QueryerContext, ids []string) (map[string]*NodeRecord, error) {
+	records := map[string]*NodeRecord{}
+	for batch := range slices.Chunk(uniqueIDs(ids), maxBatch) {
+		query, args, err := sqlx.In(`select * from nodes where id in (?)`, batch)
+		if err != nil {
+			return nil, fmt.Errorf("building node query: %w", err)
+		}
+		nodes, err := e.nodeRecords(ctx, q, e.store.db.Rebind(query), args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nodes {
+			records[n.ID] = n
+		}
+	}
+	return records, nil
+}
+
+// relationRecordsByID loads the relations with the given IDs, keyed by ID
+func (e *executor) relationRecordsByID(ctx context.Context, q sqlx.QueryerContext, ids []string) (map[string]*RelationRecord, error) {
+	records := map[string]*RelationRecord{}
+	for batch := range slices.Chunk(uniqueIDs(ids), maxBatch) {
+		query, args, err := sqlx.In(`select * from relations where id in (?)`, batch)
+		if err != nil {
+			return nil, fmt.Errorf("building relation query: %w", err)
+		}
+		relations, err := e.relationRecords(ctx, q, e.store.db.Rebind(query), args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range relations {
+			records[r.ID] = r
+		}
+	}
+	return records, nil
+}
+
+func uniqueIDs(ids []string) []string {
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+func (e *executor) relationRecords(ctx context.Context, q sqlx.QueryerContext, query string, args ...any) ([]*RelationRecord, error) {
+	relations := []*Relation{}
+	err := sqlx.SelectContext(ctx, q, &relations, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing relations: %w", err)
+	}
+
+	records := make([]*RelationRecord, len(relations))
+	ids := make([]string, len(relations))
+	for i, r := range relations {
+		ids[i] = r.ID
+		records[i] = &RelationRecord{
+			ID:           r.ID,
+			CreatedAt:    r.CreatedAt,
+			UpdatedAt:    r.UpdatedAt,
+			OwnerID:      r.OwnerID,
+			LastActionID: r.LastActionID,
+			LeftNodeID:   r.LeftNodeID,
+			RightNodeID:  r.RightNodeID,
+			Direction:    r.Direction,
+			Attributes:   map[string]any{},
+		}
+	}
+
+	err = e.fillRecords(ctx, q, "relation", ids, func(i int, label string) {
+		records[i].Labels = append(records[i].Labels, label)
+	}, func(i int, name string, value any) {
+		records[i].Attributes[name] = value
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (e *executor) nodeRecords(ctx context.Context, q sqlx.QueryerContext, query string, args ...any) ([]*NodeRecord, error) {
+	nodes := []*Node{}
+	err := sqlx.SelectContext(ctx, q, &nodes, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %w", err)
+	}
+
+	records := make([]*NodeRecord, len(nodes))
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.ID
+		records[i] = &NodeRecord{
+			ID:           n.ID,
+			CreatedAt:    n.CreatedAt,
+			UpdatedAt:    n.UpdatedAt,
+			OwnerID:      n.OwnerID,
+			LastActionID: n.LastActionID,
+			Attributes:   map[string]any{},
+		}
+	}
+
+	err = e.fillRecords(ctx, q, "node", ids, func(i int, label string) {
+		records[i].Labels = append(records[i].Labels, label)
+	}, func(i int, name string, value any) {
+		records[i].Attributes[name] = value
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// fillRecords loads the labels and attributes of a page of nodes or
+// relations, calling back with the index of the entity each belongs to
+func (e *executor) fillRecords(ctx context.Context, q sqlx.QueryerContext, entity string, ids []string, label func(int, string), attribute func(int, string, any)) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(ids))
+	for i, id := range ids {
+		index[id] = i
+	}
+
+	labels := []struct {
+		EntityID string `db:"entity_id"`
+		Label    string `db:"label"`
+	}{}
+	query, args, err := sqlx.In(fmt.Sprintf(`select %[1]s_id entity_id, label from %[1]s_labels where %[1]s_id in (?) order by label`, entity), ids)
+	if err != nil {
+		return fmt.Errorf("building label query: %w", err)
+	}
+	err = sqlx.SelectContext(ctx, q, &labels, e.store.db.Rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("reading labels: %w", err)
+	}
+	for _, l := range labels {
+		label(index[l.EntityID], l.Label)
+	}
+
+	attributes := []struct {
+		EntityID string                `db:"entity_id"`
+		Name     string                `db:"attr_name"`
+		Value    string                `db:"attr_value"`
+		Type     ast.AttributeDataType `db:"data_type"`
+	}{}
+	query, args, err = sqlx.In(fmt.Sprintf(`select %[1]s_id entity_id, attr_name, attr_value, data_type from %[1]s_attributes where %[1]s_id in (?)`, entity), ids)
+	if err != nil {
+		return fmt.Errorf("building attribute query: %w", err)
+	}
+	err = sqlx.SelectContext(ctx, q, &attributes, e.store.db.Rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("reading attributes: %w", err)
+	}
+	for _, a := range attributes {
+		attribute(index[a.EntityID], a.Name, attributeValue(a.Value, a.Type))
+	}
+
+	return nil
+}
+
+func attributeValue(value string, typ ast.AttributeDataType) any {
+	if typ == ast.AttributeDataTypeNumber {
+		f, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			return f
+		}
+	}
+	return value
+}
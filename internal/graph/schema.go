@@ -0,0 +1,290 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jmoiron/sqlx"
+)
+
+// Label schemas are declared in the graph itself by MERGEing a node labelled
+// Schema. Its label attribute names the label it describes and each of its
+// other attributes gives the type of an attribute of that label, string or
+// number, ending in ! if every MERGE must set it:
+//
+//	MERGE (:Schema {label: 'Post', uri: 'string!', likes: 'number'})
+//
+// MERGEs match nodes on all their attributes so changing a schema declares a
+// new one, the most recently declared schema for a label is used.
+
+const (
+	// SchemaLabel labels the nodes declaring label schemas
+	SchemaLabel = "Schema"
+	// SchemaLabelAttribute is the attribute of a schema node naming the
+	// label it describes
+	SchemaLabelAttribute = "label"
+
+	// SchemaValidationWarn logs MERGEs which violate a declared schema
+	SchemaValidationWarn = "warn"
+	// SchemaValidationReject refuses to execute MERGEs which violate a
+	// declared schema
+	SchemaValidationReject = "reject"
+)
+
+var ErrSchemaViolation = errors.New("schema violation")
+
+// LabelSchema is the declared schema of a label
+type LabelSchema struct {
+	Label      string
+	OwnerID    string
+	Attributes map[string]AttributeSchema
+}
+
+// AttributeSchema is the declared type of an attribute
+type AttributeSchema struct {
+	Type     ast.AttributeDataType
+	Required bool
+}
+
+// ParseAttributeSchema parses an attribute's declared type, e.g. string!
+func ParseAttributeSchema(s string) (AttributeSchema, error) {
+	a := AttributeSchema{}
+	s, a.Required = strings.CutSuffix(s, "!")
+	switch s {
+	case "string":
+		a.Type = ast.AttributeDataTypeString
+	case "number":
+		a.Type = ast.AttributeDataTypeNumber
+	default:
+		return a, fmt.Errorf("%w: unknown type %q, use string or number", ErrSchemaViolation, s)
+	}
+	return a, nil
+}
+
+func (a AttributeSchema) String() string {
+	s := "string"
+	if a.Type == ast.AttributeDataTypeNumber {
+		s = "number"
+	}
+	if a.Required {
+		s += "!"
+	}
+	return s
+}
+
+// Statement returns the MERGE statement declaring the schema. The label and
+// attribute names must be identifiers.
+func (s *LabelSchema) Statement() string {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "MERGE (:%s {%s: '%s'", SchemaLabel, SchemaLabelAttribute, s.Label)
+	for _, name := range slices.Sorted(maps.Keys(s.Attributes)) {
+		fmt.Fprintf(&sb, ", %s: '%s'", name, s.Attributes[name])
+	}
+	sb.WriteString("})")
+	return sb.String()
+}
+
+// schemaFromAttributes builds a schema from the attributes of a schema node
+func schemaFromAttributes(ownerID string, attrs map[string]string) (*LabelSchema, error) {
+	s := &LabelSchema{
+		Label:      attrs[SchemaLabelAttribute],
+		OwnerID:    ownerID,
+		Attributes: map[string]AttributeSchema{},
+	}
+	if s.Label == "" {
+		return nil, fmt.Errorf("%w: schemas need a %s attribute", ErrSchemaViolation, SchemaLabelAttribute)
+	}
+	for name, value := range attrs {
+		if name == SchemaLabelAttribute {
+			continue
+		}
+		a, err := ParseAttributeSchema(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", s.Label, name, err)
+		}
+		s.Attributes[name] = a
+	}
+	return s, nil
+}
+
+// DeclaredSchemas returns the schema used for each label which has one
+func (e *executor) DeclaredSchemas() ([]*LabelSchema, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	tx, err := e.store.CreateTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	labels := []string{}
+	err = tx.Select(&labels, `
+		select distinct a.attr_value from node_attributes a
+		inner join node_labels l on l.node_id = a.node_id and l.label = ?
+		where a.attr_name = ?
+		order by a.attr_value`, SchemaLabel, SchemaLabelAttribute)
+	if err != nil {
+		return nil, fmt.Errorf("listing schemas: %w", err)
+	}
+
+	schemas := []*LabelSchema{}
+	for _, label := range labels {
+		s, err := e.declaredSchema(label, tx)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			schemas = append(schemas, s)
+		}
+	}
+	return schemas, nil
+}
+
+// declaredSchema returns the latest valid schema for a label from the
+// trusted schema owners, nil if there isn't one
+func (e *executor) declaredSchema(label string, tx *sqlx.Tx) (*LabelSchema, error) {
+	query := `
+		select n.id, n.owner_id from nodes n
+		inner join node_labels l on l.node_id = n.id and l.label = ?
+		inner join node_attributes a on a.node_id = n.id and a.attr_name = ? and a.attr_value = ?`
+	args := []any{SchemaLabel, SchemaLabelAttribute, label}
+	if len(e.schemaOwners) > 0 {
+		in, inArgs, err := sqlx.In(" where n.owner_id in (?)", e.schemaOwners)
+		if err != nil {
+			return nil, err
+		}
+		query += in
+		args = append(args, inArgs...)
+	}
+	query += " order by coalesce(n.updated_at, n.created_at) desc"
+
+	nodes := []struct {
+		ID      string `db:"id"`
+		OwnerID string `db:"owner_id"`
+	}{}
+	err := tx.Select(&nodes, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching schemas: %w", err)
+	}
+
+	for _, n := range nodes {
+		rows := []*NodeAttribute{}
+		err = tx.Select(&rows, "select * from node_attributes where node_id = ?", n.ID)
+		if err != nil {
+			return nil, fmt.Errorf("fetching schema attributes: %w", err)
+		}
+		attrs := map[string]string{}
+		for _, r := range rows {
+			attrs[r.Name] = r.Value
+		}
+
+		s, err := schemaFromAttributes(n.OwnerID, attrs)
+		if err != nil {
+			// declared before validation was turned on
+			continue
+		}
+		return s, nil
+	}
+	return nil, nil
+}
+
+// checkSchemas checks the entities a MERGE touches against the schemas of
+// their labels and, for schema nodes, that the schema they declare is valid
+func (e *executor) checkSchemas(entity ast.Entity, tx *sqlx.Tx) error {
+	if r, ok := entity.(ast.Relation); ok {
+		for _, node := range []ast.Entity{r.Left(), r.Right()} {
+			err := e.checkSchemas(node, tx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if slices.Contains(entity.Labels(), SchemaLabel) {
+		attrs := map[string]string{}
+		for _, a := range entity.Attributes() {
+			attrs[a.Key()] = a.Value()
+		}
+		_, err := schemaFromAttributes("", attrs)
+		return err
+	}
+
+	schemas := []*LabelSchema{}
+	for _, label := range entity.Labels() {
+		s, err := e.declaredSchema(label, tx)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			schemas = append(schemas, s)
+		}
+	}
+	if len(schemas) == 0 {
+		return nil
+	}
+
+	// an entity with several labels can have the attributes of any of them
+	set := map[string]bool{}
+	for _, a := range entity.Attributes() {
+		set[a.Key()] = true
+		if !slices.ContainsFunc(schemas, func(s *LabelSchema) bool {
+			declared, ok := s.Attributes[a.Key()]
+			return ok && declared.Type == a.Type()
+		}) {
+			return fmt.Errorf("%w: %s isn't a declared %s attribute of %s", ErrSchemaViolation, a.Key(), typeName(a.Type()), strings.Join(entity.Labels(), ":"))
+		}
+	}
+	for _, s := range schemas {
+		for name, declared := range s.Attributes {
+			if declared.Required && !set[name] {
+				return fmt.Errorf("%w: %s.%s is required", ErrSchemaViolation, s.Label, name)
+			}
+		}
+	}
+	return nil
+}
+
+func typeName(t ast.AttributeDataType) string {
+	return strings.TrimSuffix(AttributeSchema{Type: t}.String(), "!")
+}
+
+// validateMerge checks a MERGE against the declared schemas, returning an
+// error only if violations are rejected
+func (e *executor) validateMerge(action Action, tx *sqlx.Tx) error {
+	if e.schemaValidation == "" {
+		return nil
+	}
+
+	err := e.checkSchemas(action.Command.Entity(), tx)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrSchemaViolation) && e.schemaValidation == SchemaValidationWarn:
+		e.logger.Warn("statement violates schema", "error", err, "id", action.ID)
+		return nil
+	default:
+		return err
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package graph
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jmoiron/sqlx"
+)
+
+// State describes the content of the graph without the IDs and timestamps
+// which differ between nodes, so that the graphs of nodes which executed the
+// same actions can be compared
+type State struct {
+	// Hash covers every node and relation
+	Hash string
+	// Nodes and Relations describe each entity, sorted
+	Nodes     []string
+	Relations []string
+}
+
+// Diff returns the entities only in this state and those only in the other
+func (s *State) Diff(other *State) (missing, extra []string) {
+	missing, extra = diffSorted(s.Nodes, other.Nodes)
+	m, e := diffSorted(s.Relations, other.Relations)
+	return append(missing, m...), append(extra, e...)
+}
+
+// diffSorted compares two sorted lists, which may repeat entries
+func diffSorted(a, b []string) (onlyA, onlyB []string) {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch strings.Compare(a[i], b[j]) {
+		case 0:
+			i++
+			j++
+		case -1:
+			onlyA = append(onlyA, a[i])
+			i++
+		default:
+			onlyB = append(onlyB, b[j])
+			j++
+		}
+	}
+	return append(onlyA, a[i:]...), append(onlyB, b[j:]...)
+}
+
+type stateEntity struct {
+	ID           string `db:"id"`
+	OwnerID      string `db:"owner_id"`
+	LastActionID string `db:"last_action_id"`
+	LeftNodeID   string `db:"left_node_id"`
+	RightNodeID  string `db:"right_node_id"`
+	Direction    int    `db:"direction"`
+	labels       []string
+	attributes   []string
+}
+
+type stateRow struct {
+	EntityID string `db:"entity_id"`
+	Name     string `db:"name"`
+	Value    string `db:"value"`
+	DataType int    `db:"data_type"`
+}
+
+// stateTables are where an entity type and its labels and attributes are kept
+type stateTables struct {
+	entities   string
+	columns    string
+	labels     string
+	attributes string
+	idColumn   string
+}
+
+var (
+	nodeStateTables     = stateTables{"nodes", "id, owner_id, last_action_id", "node_labels", "node_attributes", "node_id"}
+	relationStateTables = stateTables{"relations", "id, owner_id, last_action_id, left_node_id, right_node_id, direction", "relation_labels", "relation_attributes", "relation_id"}
+)
+
+// State reads the whole graph into a description of its content
+func (e *executor) State() (*State, error) {
+	return e.state("select id from nodes", nil, "select id from relations", nil)
+}
+
+// TopicState describes the part of the graph a topic subscription reaches,
+// the nodes with the topic's label, and attribute if it has one, and the
+// relations with it or attached to those nodes. Topics are Label or
+// Label:name=value.
+func (e *executor) TopicState(topic string) (*State, error) {
+	label, attribute, hasAttribute := strings.Cut(topic, ":")
+	name, value, _ := strings.Cut(attribute, "=")
+
+	scope := func(t stateTables) (string, []any) {
+		if !hasAttribute {
+			return fmt.Sprintf("select %s from %s where label = ?", t.idColumn, t.labels), []any{label}
+		}
+		return fmt.Sprintf("select %[1]s from %[2]s where label = ? intersect select %[1]s from %[3]s where attr_name = ? and attr_value = ?", t.idColumn, t.labels, t.attributes),
+			[]any{label, name, value}
+	}
+
+	nodeScope, nodeArgs := scope(nodeStateTables)
+	relationScope, relationArgs := scope(relationStateTables)
+	relationScope = fmt.Sprintf("select id from relations where id in (%[1]s) or left_node_id in (%[2]s) or right_node_id in (%[2]s)", relationScope, nodeScope)
+	relationArgs = slices.Concat(relationArgs, nodeArgs, nodeArgs)
+
+	return e.state(nodeScope, nodeArgs, relationScope, relationArgs)
+}
+
+// state describes the nodes and relations whose IDs the scopes select.
+// Relations are described with their nodes, which needn't be in scope.
+func (e *executor) state(nodeScope string, nodeArgs []any, relationScope string, relationArgs []any) (*State, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	tx, err := e.store.CreateTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	ids := []string{}
+	err = tx.SelectContext(ctx, &ids, nodeScope, nodeArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("reading nodes: %w", err)
+	}
+
+	relations, err := readStateEntities(ctx, tx, relationStateTables, relationScope, relationArgs)
+	if err != nil {
+		return nil, fmt.Errorf("reading relations: %w", err)
+	}
+
+	endpoints := fmt.Sprintf("%[1]s union select left_node_id from relations where id in (%[2]s) union select right_node_id from relations where id in (%[2]s)", nodeScope, relationScope)
+	nodes, err := readStateEntities(ctx, tx, nodeStateTables, endpoints, slices.Concat(nodeArgs, relationArgs, relationArgs))
+	if err != nil {
+		return nil, fmt.Errorf("reading nodes: %w", err)
+	}
+
+	state := &State{
+		Nodes:     make([]string, 0, len(ids)),
+		Relations: make([]string, 0, len(relations)),
+	}
+	described := make(map[string]string, len(nodes))
+	for id, n := range nodes {
+		described[id] = describeEntity("(", ")", n)
+	}
+	for _, id := range ids {
+		state.Nodes = append(state.Nodes, described[id])
+	}
+	for _, r := range relations {
+		left, right := "-", "->"
+		if ast.RelationDir(r.Direction) == ast.RelationDirLeft {
+			left, right = "<-", "-"
+		}
+		d := described[r.LeftNodeID] + describeEntity(left+"[", "]"+right, r) + described[r.RightNodeID]
+		state.Relations = append(state.Relations, d)
+	}
+	slices.Sort(state.Nodes)
+	slices.Sort(state.Relations)
+
+	h := sha256.New()
+	for _, d := range state.Nodes {
+		h.Write([]byte(d))
+		h.Write([]byte{0})
+	}
+	for _, d := range state.Relations {
+		h.Write([]byte(d))
+		h.Write([]byte{0})
+	}
+	state.Hash = hex.EncodeToString(h.Sum(nil))
+
+	return state, nil
+}
+
+// readStateEntities reads the nodes or relations whose IDs the scope selects
+// with their labels and attributes, by ID
+func readStateEntities(ctx context.Context, tx *sqlx.Tx, t stateTables, scope string, args []any) (map[string]*stateEntity, error) {
+	rows := []*stateEntity{}
+	err := tx.SelectContext(ctx, &rows, fmt.Sprintf("select %s from %s where id in (%s)", t.columns, t.entities, scope), args...)
+	if err != nil {
+		return nil, err
+	}
+	entities := make(map[string]*stateEntity, len(rows))
+	for _, row := range rows {
+		entities[row.ID] = row
+	}
+
+	labels := []*stateRow{}
+	err = tx.SelectContext(ctx, &labels, fmt.Sprintf("select %[1]s entity_id, label name from %[2]s where %[1]s in (%[3]s)", t.idColumn, t.labels, scope), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range labels {
+		if e, ok := entities[l.EntityID]; ok {
+			e.labels = append(e.labels, l.Name)
+		}
+	}
+
+	attributes := []*stateRow{}
+	err = tx.SelectContext(ctx, &attributes, fmt.Sprintf("select %[1]s entity_id, attr_name name, attr_value value, data_type from %[2]s where %[1]s in (%[3]s)", t.idColumn, t.attributes, scope), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attributes {
+		if e, ok := entities[a.EntityID]; ok {
+			e.attributes = append(e.attributes, fmt.Sprintf("%s: %q/%d", a.Name, a.Value, a.DataType))
+		}
+	}
+
+	return entities, nil
+}
+
+// describeEntity writes an entity's labels and attributes in sorted order,
+// followed by its owner and the action which last wrote it
+func describeEntity(open, close string, e *stateEntity) string {
+	slices.Sort(e.labels)
+	slices.Sort(e.attributes)
+
+	sb := strings.Builder{}
+	sb.WriteString(open)
+	for _, l := range e.labels {
+		sb.WriteString(":" + l)
+	}
+	sb.WriteString(" {" + strings.Join(e.attributes, ", ") + "}")
+	sb.WriteString(" owner=" + e.OwnerID)
+	sb.WriteString(" action=" + e.LastActionID)
+	sb.WriteString(close)
+	return sb.String()
+}
@@ -0,0 +1,192 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package graph
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jmoiron/sqlx"
+)
+
+// The stats table counts the nodes and relations with each label and
+// attribute name. MERGEs adjust the counts as they add and remove labels and
+// attributes, purges delete rows in bulk so recount them. The counts are used
+// to estimate how many rows each join in a MATCH will produce so that the
+// most selective is made first.
+
+const (
+	statEntityNode     = "node"
+	statEntityRelation = "relation"
+	statKindLabel      = "label"
+	statKindAttribute  = "attribute"
+)
+
+// countStatsQuery fills the stats table from the graph, as the 0018
+// migration did when the table was created
+const countStatsQuery = `
+	insert into stats(entity, kind, name, count)
+	select 'node', 'label', label, count(*) from node_labels group by label
+	union all
+	select 'node', 'attribute', attr_name, count(*) from node_attributes group by attr_name
+	union all
+	select 'relation', 'label', label, count(*) from relation_labels group by label
+	union all
+	select 'relation', 'attribute', attr_name, count(*) from relation_attributes group by attr_name`
+
+// Stats are the approximate number of nodes and relations with each label
+// and attribute
+type Stats struct {
+	NodeLabels         map[string]int64
+	NodeAttributes     map[string]int64
+	RelationLabels     map[string]int64
+	RelationAttributes map[string]int64
+}
+
+type stat struct {
+	Entity string `db:"entity"`
+	Kind   string `db:"kind"`
+	Name   string `db:"name"`
+	Count  int64  `db:"count"`
+}
+
+// Stats returns the counts of labels and attributes in the graph
+func (e *executor) Stats() (*Stats, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	rows := []*stat{}
+	err := e.store.db.SelectContext(ctx, &rows, "select entity, kind, name, count from stats where count > 0")
+	if err != nil {
+		return nil, fmt.Errorf("reading stats: %w", err)
+	}
+
+	stats := &Stats{
+		NodeLabels:         map[string]int64{},
+		NodeAttributes:     map[string]int64{},
+		RelationLabels:     map[string]int64{},
+		RelationAttributes: map[string]int64{},
+	}
+	for _, row := range rows {
+		switch {
+		case row.Entity == statEntityNode && row.Kind == statKindLabel:
+			stats.NodeLabels[row.Name] = row.Count
+		case row.Entity == statEntityNode && row.Kind == statKindAttribute:
+			stats.NodeAttributes[row.Name] = row.Count
+		case row.Entity == statEntityRelation && row.Kind == statKindLabel:
+			stats.RelationLabels[row.Name] = row.Count
+		case row.Entity == statEntityRelation && row.Kind == statKindAttribute:
+			stats.RelationAttributes[row.Name] = row.Count
+		}
+	}
+	return stats, nil
+}
+
+// countStat adds delta to the count of a label or attribute
+func countStat(tx *preparedTx, entity, kind, name string, delta int64) error {
+	_, err := tx.exec(`
+		insert into stats(entity, kind, name, count)
+		values(?, ?, ?, max(0, ?))
+		on conflict(entity, kind, name) do update
+		set count = max(0, count + ?)`, entity, kind, name, delta, delta)
+	if err != nil {
+		return fmt.Errorf("counting %s %s: %w", entity, kind, err)
+	}
+	return nil
+}
+
+// recountStats refills the stats table after entities are deleted in bulk
+func recountStats(tx *sqlx.Tx) error {
+	_, err := tx.Exec("delete from stats")
+	if err != nil {
+		return fmt.Errorf("clearing stats: %w", err)
+	}
+	_, err = tx.Exec(countStatsQuery)
+	if err != nil {
+		return fmt.Errorf("counting stats: %w", err)
+	}
+	return nil
+}
+
+type statKey struct {
+	entity, kind, name string
+}
+
+// estimates are the counts of the labels and attributes in a pattern
+type estimates map[statKey]int64
+
+// estimate reads the counts of the labels and attributes of the nodes and
+// relation in a pattern
+func estimate(tx *sqlx.Tx, pattern ast.Entity) (estimates, error) {
+	entities := []ast.Entity{pattern}
+	if r, ok := pattern.(ast.Relation); ok {
+		entities = append(entities, r.Left(), r.Right())
+	}
+
+	names := []string{}
+	for _, entity := range entities {
+		names = append(names, entity.Labels()...)
+		names = slices.AppendSeq(names, maps.Keys(entity.Attributes()))
+	}
+	est := estimates{}
+	if len(names) == 0 {
+		return est, nil
+	}
+
+	query, args, err := sqlx.In("select entity, kind, name, count from stats where name in (?)", names)
+	if err != nil {
+		return nil, fmt.Errorf("building estimate query: %w", err)
+	}
+	rows := []*stat{}
+	err = tx.Select(&rows, tx.Rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("reading stats: %w", err)
+	}
+	for _, row := range rows {
+		est[statKey{row.Entity, row.Kind, row.Name}] = row.Count
+	}
+	return est, nil
+}
+
+// labels returns labels ordered from the fewest entities to the most
+func (est estimates) labels(entity string, labels []string) []string {
+	return est.order(entity, statKindLabel, labels)
+}
+
+// attributes returns attributes ordered from the fewest entities to the most
+func (est estimates) attributes(entity string, attrs map[string]ast.Attribute) []ast.Attribute {
+	res := []ast.Attribute{}
+	for _, name := range est.order(entity, statKindAttribute, slices.Collect(maps.Keys(attrs))) {
+		res = append(res, attrs[name])
+	}
+	return res
+}
+
+func (est estimates) order(entity, kind string, names []string) []string {
+	res := slices.Clone(names)
+	slices.SortFunc(res, func(a, b string) int {
+		return cmp.Or(
+			cmp.Compare(est[statKey{entity, kind, a}], est[statKey{entity, kind, b}]),
+			cmp.Compare(a, b),
+		)
+	})
+	return res
+}
@@ -2,16 +2,21 @@ package graph
 
 import (
 	"context"
-	"errors"
+	"database/sql"
+	"embed"
 	"fmt"
 	"time"
 
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/sqlite3"
-	"github.com/jdudmesh/propolis/pkg/migrate/v4/source/reflect"
+	"github.com/jdudmesh/propolis/internal/migration"
 	"github.com/jmoiron/sqlx"
 )
 
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migrations are the versions of the graph database schema
+var Migrations = migration.New("graph", migrationFiles, "migrations")
+
 // TODO: change timeout for production
 const defaultTimeout = 86400 * time.Second
 
@@ -25,7 +30,7 @@ func newStore(databaseURL string) (*store, error) {
 		return nil, fmt.Errorf("connecting to database: %w", err)
 	}
 
-	err = createSchema(db)
+	err = Migrations.Up(db.DB)
 	if err != nil {
 		return nil, fmt.Errorf("creating schema: %w", err)
 	}
@@ -37,119 +42,75 @@ func newStore(databaseURL string) (*store, error) {
 	return s, nil
 }
 
-func createSchema(db *sqlx.DB) error {
-	driver, err := sqlite3.WithInstance(db.DB, &sqlite3.Config{})
-	if err != nil {
-		return fmt.Errorf("creating driver: %w", err)
-	}
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+func (s *store) CreateTx(ctx context.Context) (*sqlx.Tx, error) {
+	return s.db.BeginTxx(ctx, nil)
+}
 
-	schema := &struct {
-		Nodes_up                  string
-		NodeAttributes_up         string
-		NodeAttributesIdx1_up     string
-		NodeLabels_up             string
-		NodeLabelsIdx1_up         string
-		Relations_up              string
-		RelationsIdx1_up          string
-		RelationAttributes_up     string
-		RelationAttributesIdx1_up string
-		RelationLabels_up         string
-		RelationLabelsIdx1_up     string
-	}{
-		Nodes_up: `create table nodes (
-			id text not null primary key,
-			created_at datetime not null,
-			updated_at datetime null,
-			owner_id text not null,
-			last_action_id text not null
-		);`,
-
-		NodeAttributes_up: `create table node_attributes (
-			id text not null primary key,
-			created_at datetime not null,
-			updated_at datetime null,
-			last_action_id text not null,
-			node_id text not null,
-			attr_name text not null,
-			attr_value text not null,
-			data_type int not null,
-			foreign key(node_id) references nodes(id)
-		);`,
-
-		NodeAttributesIdx1_up: `create index idx_nodes_attributes_attr_name on node_attributes(attr_name);`,
-
-		NodeLabels_up: `create table node_labels (
-			id text not null primary key,
-			created_at datetime not null,
-			updated_at datetime null,
-			last_action_id text not null,
-			node_id text not null,
-			label text not null,
-			foreign key(node_id) references nodes(id)
-		);`,
-
-		NodeLabelsIdx1_up: `create index idx_node_labels_label on node_labels(label);`,
-
-		Relations_up: `create table relations (
-			id text not null primary key,
-			created_at datetime not null,
-			updated_at datetime null,
-			owner_id text not null,
-			last_action_id text not null,
-			left_node_id text not null,
-			right_node_id text not null,
-			direction int not null,
-			foreign key(left_node_id) references nodes(id),
-			foreign key(right_node_id) references nodes(id)
-		);`,
-
-		RelationsIdx1_up: `create index idx_relations_direction on relations(direction);`,
-
-		RelationAttributes_up: `create table relation_attributes (
-			id text not null primary key,
-			created_at datetime not null,
-			updated_at datetime null,
-			last_action_id text not null,
-			relation_id text not null,
-			attr_name text not null,
-			attr_value text not null,
-			data_type int not null,
-			foreign key(relation_id) references relations(id)
-		);`,
-
-		RelationAttributesIdx1_up: `create index idx_relation_attributes_attr_name on relation_attributes(attr_name);`,
-
-		RelationLabels_up: `create table relation_labels(
-			id text not null primary key,
-			created_at datetime not null,
-			updated_at datetime null,
-			last_action_id text not null,
-			relation_id text not null,
-			label text not null,
-			foreign key(relation_id) references relations(id)
-		);`,
-
-		RelationLabelsIdx1_up: `create index relation_labels_label on relation_labels(label);`,
+// preparedTx is a transaction which prepares the statements it executes the
+// first time they are used and reuses them after, so that MERGEs of entities
+// with many labels and attributes don't parse the same SQL over and over. The
+// statements are closed when the transaction ends.
+type preparedTx struct {
+	*sqlx.Tx
+	named map[string]*sqlx.NamedStmt
+	stmts map[string]*sqlx.Stmt
+}
+
+func newPreparedTx(tx *sqlx.Tx) *preparedTx {
+	return &preparedTx{
+		Tx:    tx,
+		named: map[string]*sqlx.NamedStmt{},
+		stmts: map[string]*sqlx.Stmt{},
 	}
+}
 
-	source, err := reflect.New(schema)
-	if err != nil {
-		return fmt.Errorf("creating migration source driver: %w", err)
+// namedExec executes a query with named parameters
+func (t *preparedTx) namedExec(query string, arg any) (sql.Result, error) {
+	stmt, ok := t.named[query]
+	if !ok {
+		var err error
+		stmt, err = t.PrepareNamed(query)
+		if err != nil {
+			return nil, fmt.Errorf("preparing statement: %w", err)
+		}
+		t.named[query] = stmt
 	}
+	return stmt.Exec(arg)
+}
 
-	m, err := migrate.NewWithInstance("reflect", source, "sqlite3", driver)
+// exec executes a query with positional parameters
+func (t *preparedTx) exec(query string, args ...any) (sql.Result, error) {
+	stmt, err := t.prepare(query)
 	if err != nil {
-		return fmt.Errorf("creating migration: %w", err)
+		return nil, err
 	}
+	return stmt.Exec(args...)
+}
 
-	err = m.Up()
-	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+// selectAll runs a query with positional parameters, scanning the rows into
+// dest
+func (t *preparedTx) selectAll(dest any, query string, args ...any) error {
+	stmt, err := t.prepare(query)
+	if err != nil {
 		return err
 	}
-
-	return nil
+	return stmt.Select(dest, args...)
 }
 
-func (s *store) CreateTx(ctx context.Context) (*sqlx.Tx, error) {
-	return s.db.BeginTxx(ctx, nil)
+func (t *preparedTx) prepare(query string) (*sqlx.Stmt, error) {
+	stmt, ok := t.stmts[query]
+	if ok {
+		return stmt, nil
+	}
+
+	stmt, err := t.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("preparing statement: %w", err)
+	}
+	t.stmts[query] = stmt
+	return stmt, nil
 }
@@ -0,0 +1,106 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// UnitOfWork runs several actions in one transaction, so a batch of them
+// costs one commit rather than one each. Each action runs under its own
+// savepoint, so one which fails is rolled back by itself and leaves the others
+// in place. Nothing is visible to the rest of the graph until the unit of work
+// is committed. It is not safe for concurrent use and must be committed or
+// rolled back.
+type UnitOfWork interface {
+	// Execute runs an action. If it fails its changes are rolled back and the
+	// unit of work can carry on.
+	Execute(action Action) (any, error)
+	Commit() error
+	Rollback() error
+}
+
+type unitOfWork struct {
+	executor   *executor
+	tx         *preparedTx
+	cancelFn   context.CancelFunc
+	statements int
+}
+
+// Begin starts a unit of work
+func (e *executor) Begin() (UnitOfWork, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+
+	tx, err := e.store.CreateTx(ctx)
+	if err != nil {
+		cancelFn()
+		return nil, fmt.Errorf("creating tx: %w", err)
+	}
+
+	return &unitOfWork{
+		executor: e,
+		tx:       newPreparedTx(tx),
+		cancelFn: cancelFn,
+	}, nil
+}
+
+func (u *unitOfWork) Execute(action Action) (any, error) {
+	name := fmt.Sprintf("statement_%d", u.statements)
+	u.statements++
+
+	_, err := u.tx.Exec("savepoint " + name)
+	if err != nil {
+		return nil, fmt.Errorf("setting savepoint: %w", err)
+	}
+
+	res, err := u.executor.execute(action, u.tx)
+	if err != nil {
+		_, rerr := u.tx.Exec("rollback to " + name)
+		if rerr != nil {
+			return nil, errors.Join(err, fmt.Errorf("rolling back statement: %w", rerr))
+		}
+	}
+
+	_, rerr := u.tx.Exec("release " + name)
+	if rerr != nil {
+		return nil, errors.Join(err, fmt.Errorf("releasing savepoint: %w", rerr))
+	}
+
+	return res, err
+}
+
+func (u *unitOfWork) Commit() error {
+	defer u.cancelFn()
+
+	err := u.tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commiting changes: %w", err)
+	}
+	return nil
+}
+
+func (u *unitOfWork) Rollback() error {
+	defer u.cancelFn()
+
+	err := u.tx.Rollback()
+	if err != nil {
+		return fmt.Errorf("rolling back changes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+)
+
+// RecordReader looks up nodes and relations with their labels and
+// attributes
+type RecordReader interface {
+	GetNode(id string) (*NodeRecord, error)
+	GetRelation(id string) (*RelationRecord, error)
+}
+
+// View is the neighbourhood matched by a MATCH statement laid out for
+// visualisation. It marshals to the nodes and links JSON used by D3's force
+// layout and renders as Graphviz DOT with WriteDOT.
+type View struct {
+	Nodes []*ViewNode `json:"nodes"`
+	Links []*ViewLink `json:"links"`
+}
+
+// ViewNode is a node in a view. Bindings are the identifiers in the match
+// clause the node was bound to, empty for the ends of matched relations which
+// weren't bound.
+type ViewNode struct {
+	ID         string         `json:"id"`
+	Labels     []string       `json:"labels"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Bindings   []string       `json:"bindings,omitempty"`
+}
+
+// ViewLink is a relation in a view, pointing from Source to Target unless it
+// isn't Directed
+type ViewLink struct {
+	ID         string         `json:"id"`
+	Source     string         `json:"source"`
+	Target     string         `json:"target"`
+	Directed   bool           `json:"directed"`
+	Labels     []string       `json:"labels"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Bindings   []string       `json:"bindings,omitempty"`
+}
+
+// NewView builds the view of a MATCH statement's results. Both ends of every
+// relation are included, those which weren't bound are read from records.
+func NewView(res *SearchResults, records RecordReader) (*View, error) {
+	v := &View{
+		Nodes: []*ViewNode{},
+		Links: []*ViewLink{},
+	}
+	nodes := map[string]*ViewNode{}
+	links := map[string]*ViewLink{}
+
+	addNode := func(id string, rec *NodeRecord) (*ViewNode, error) {
+		if node, ok := nodes[id]; ok {
+			return node, nil
+		}
+		if rec == nil {
+			var err error
+			rec, err = records.GetNode(id)
+			if err != nil {
+				return nil, fmt.Errorf("reading node %s: %w", id, err)
+			}
+		}
+		node := &ViewNode{
+			ID:         rec.ID,
+			Labels:     rec.Labels,
+			Attributes: rec.Attributes,
+		}
+		nodes[id] = node
+		v.Nodes = append(v.Nodes, node)
+		return node, nil
+	}
+
+	bindings := res.Bindings()
+	for _, ident := range slices.Sorted(maps.Keys(bindings)) {
+		for _, entity := range bindings[ident] {
+			switch entity := entity.(type) {
+			case *NodeRecord:
+				node, err := addNode(entity.ID, entity)
+				if err != nil {
+					return nil, err
+				}
+				node.Bindings = appendBinding(node.Bindings, ident)
+			case *RelationRecord:
+				link, ok := links[entity.ID]
+				if !ok {
+					rec := entity
+					for _, id := range []string{rec.LeftNodeID, rec.RightNodeID} {
+						_, err := addNode(id, nil)
+						if err != nil {
+							return nil, err
+						}
+					}
+
+					link = &ViewLink{
+						ID:         rec.ID,
+						Source:     rec.LeftNodeID,
+						Target:     rec.RightNodeID,
+						Directed:   rec.Direction != ast.RelationDirNeutral,
+						Labels:     rec.Labels,
+						Attributes: rec.Attributes,
+					}
+					if rec.Direction == ast.RelationDirLeft {
+						link.Source, link.Target = rec.RightNodeID, rec.LeftNodeID
+					}
+					links[entity.ID] = link
+					v.Links = append(v.Links, link)
+				}
+				link.Bindings = appendBinding(link.Bindings, ident)
+			default:
+				return nil, errors.New("unknown entity type in results")
+			}
+		}
+	}
+
+	return v, nil
+}
+
+func appendBinding(bindings []string, ident string) []string {
+	if ident == "" || slices.Contains(bindings, ident) {
+		return bindings
+	}
+	return append(bindings, ident)
+}
+
+// WriteDOT renders the view as a Graphviz digraph. Nodes are labelled with
+// their labels and attributes, links with their labels.
+func (v *View) WriteDOT(w io.Writer) error {
+	b := &strings.Builder{}
+	b.WriteString("digraph propolis {\n")
+	b.WriteString("\tnode [shape=box];\n")
+
+	for _, node := range v.Nodes {
+		lines := []string{}
+		if len(node.Labels) > 0 {
+			lines = append(lines, ":"+strings.Join(node.Labels, ":"))
+		}
+		for _, name := range slices.Sorted(maps.Keys(node.Attributes)) {
+			lines = append(lines, fmt.Sprintf("%s: %v", name, node.Attributes[name]))
+		}
+		if len(lines) == 0 {
+			lines = append(lines, node.ID)
+		}
+		fmt.Fprintf(b, "\t%s [label=%s];\n", dotQuote(node.ID), dotQuote(strings.Join(lines, "\n")))
+	}
+
+	for _, link := range v.Links {
+		attrs := "label=" + dotQuote(strings.Join(link.Labels, ":"))
+		if !link.Directed {
+			attrs += ", dir=none"
+		}
+		fmt.Fprintf(b, "\t%s -> %s [%s];\n", dotQuote(link.Source), dotQuote(link.Target), attrs)
+	}
+
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotQuote quotes a DOT ID, escaping newlines so labels span lines
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
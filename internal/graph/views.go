@@ -0,0 +1,319 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package graph
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jmoiron/sqlx"
+)
+
+// Registered views are MATCH statements whose results are kept in the
+// view_rows table. Each MERGE only re-runs a view's query for the rows
+// involving the nodes and relation it touched, so reading a view costs the
+// same however much of the graph it had to search. Purges are rare and
+// rebuild every view.
+
+var ErrBadView = errors.New("views must be a MATCH without SINCE")
+
+// RegisteredView is a named MATCH statement whose results are maintained as
+// the graph changes
+type RegisteredView struct {
+	Name      string    `db:"name"`
+	Statement string    `db:"statement"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// parseView parses a view's statement, which must be a MATCH without SINCE
+// as its results can't depend on when it is read
+func parseView(stmt string) (ast.Command, error) {
+	p, err := ast.Parse(stmt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadView, err)
+	}
+	cmd := p.Command()
+	if cmd == nil || cmd.Type() != ast.EntityTypeMatchCmd || !cmd.Since().IsZero() {
+		return nil, ErrBadView
+	}
+	return cmd, nil
+}
+
+// RegisterView creates or replaces a view and fills it from the graph
+func (e *executor) RegisterView(name, stmt string) error {
+	_, err := parseView(stmt)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	tx, err := e.store.CreateTx(ctx)
+	if err != nil {
+		return fmt.Errorf("creating tx: %w", err)
+	}
+
+	view := &RegisteredView{
+		Name:      name,
+		Statement: stmt,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = tx.NamedExec(`
+		insert into views(name, statement, created_at)
+		values(:name, :statement, :created_at)
+		on conflict(name) do update
+		set statement = :statement, created_at = :created_at`, view)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("saving view: %w", err)
+	}
+
+	err = e.materializeView(view, nil, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commiting changes: %w", err)
+	}
+	return nil
+}
+
+// DropView deletes a view and its rows
+func (e *executor) DropView(name string) error {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	tx, err := e.store.CreateTx(ctx)
+	if err != nil {
+		return fmt.Errorf("creating tx: %w", err)
+	}
+
+	_, err = tx.Exec("delete from view_rows where view_name = ?", name)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("deleting view rows: %w", err)
+	}
+	res, err := tx.Exec("delete from views where name = ?", name)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("deleting view: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commiting changes: %w", err)
+	}
+	return nil
+}
+
+// RegisteredViews lists the views by name
+func (e *executor) RegisteredViews() ([]*RegisteredView, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	views := []*RegisteredView{}
+	err := e.store.db.SelectContext(ctx, &views, "select name, statement, created_at from views order by name")
+	if err != nil {
+		return nil, fmt.Errorf("listing views: %w", err)
+	}
+	return views, nil
+}
+
+// QueryView returns a view's current results, only those the read filter
+// accepts if it is set
+func (e *executor) QueryView(name string, readable ReadFilter) (*SearchResults, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	tx, err := e.store.CreateTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	view := &RegisteredView{}
+	err = tx.Get(view, "select name, statement, created_at from views where name = ?", name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching view: %w", err)
+	}
+
+	cmd, err := parseView(view.Statement)
+	if err != nil {
+		return nil, err
+	}
+
+	// the rows have the same columns as the view's search query
+	var idents []string
+	columns := "rel_id, left_node_id"
+	switch entity := cmd.Entity().(type) {
+	case ast.Relation:
+		idents = []string{entity.Identifier(), entity.Left().Identifier(), entity.Right().Identifier()}
+		columns += ", right_node_id"
+	default:
+		idents = []string{entity.Identifier(), entity.Identifier()}
+	}
+
+	rows, err := tx.Queryx("select "+columns+" from view_rows where view_name = ? order by created_at, rowid", name)
+	if err != nil {
+		return nil, fmt.Errorf("reading view: %w", err)
+	}
+	defer rows.Close()
+
+	return e.extractResults(idents, rows, readable, tx)
+}
+
+// refreshViews updates the rows of every view involving the entities a MERGE
+// touched
+func (e *executor) refreshViews(touched []string, tx *sqlx.Tx) error {
+	views := []*RegisteredView{}
+	err := tx.Select(&views, "select name, statement, created_at from views")
+	if err != nil {
+		return fmt.Errorf("listing views: %w", err)
+	}
+
+	for _, view := range views {
+		err = e.materializeView(view, touched, tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildViews refills every view from the graph
+func (e *executor) rebuildViews(tx *sqlx.Tx) error {
+	views := []*RegisteredView{}
+	err := tx.Select(&views, "select name, statement, created_at from views")
+	if err != nil {
+		return fmt.Errorf("listing views: %w", err)
+	}
+
+	for _, view := range views {
+		err = e.materializeView(view, nil, tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// materializeView replaces a view's rows involving the touched entities with
+// the results of its query for them, all of its rows if touched is nil
+func (e *executor) materializeView(view *RegisteredView, touched []string, tx *sqlx.Tx) error {
+	if touched != nil && len(touched) == 0 {
+		return nil
+	}
+
+	cmd, err := parseView(view.Statement)
+	if err != nil {
+		return err
+	}
+
+	est, err := estimate(tx, cmd.Entity())
+	if err != nil {
+		return err
+	}
+
+	// the columns of the search query holding entity IDs and the view_rows
+	// columns they are stored in
+	var query, columns string
+	var args map[string]any
+	idColumns := [][2]string{{"left_node_id", "left_node_id"}}
+	switch entity := cmd.Entity().(type) {
+	case ast.Relation:
+		query, args, _, err = e.relationSearchQuery(entity, time.Time{}, cmd.Where(), est)
+		columns = "id, left_node_id, right_node_id"
+		idColumns = [][2]string{{"id", "rel_id"}, {"left_node_id", "left_node_id"}, {"right_node_id", "right_node_id"}}
+	default:
+		query, args, _, err = e.nodeSearchQuery(entity, time.Time{}, cmd.Where(), est)
+		columns = "null, left_node_id, null"
+	}
+	if err != nil {
+		return fmt.Errorf("building view query: %w", err)
+	}
+
+	// named parameters restrict both the delete and the search to the
+	// touched entities
+	searchWhere, rowsWhere := "", ""
+	deleteArgs := map[string]any{"view_name": view.Name}
+	if touched != nil {
+		params := make([]string, len(touched))
+		for i, id := range touched {
+			name := fmt.Sprintf("touched_%d", i)
+			params[i] = ":" + name
+			args[name] = id
+			deleteArgs[name] = id
+		}
+		in := " in (" + strings.Join(params, ", ") + ")"
+		search, rows := []string{}, []string{}
+		for _, c := range idColumns {
+			search = append(search, c[0]+in)
+			rows = append(rows, c[1]+in)
+		}
+		searchWhere = " where " + strings.Join(search, " or ")
+		rowsWhere = " and (" + strings.Join(rows, " or ") + ")"
+	}
+
+	_, err = tx.NamedExec("delete from view_rows where view_name = :view_name"+rowsWhere, deleteArgs)
+	if err != nil {
+		return fmt.Errorf("clearing view %s: %w", view.Name, err)
+	}
+
+	args["view_name"] = view.Name
+	args["view_now"] = time.Now().UTC()
+	_, err = tx.NamedExec(`
+		insert into view_rows(view_name, rel_id, left_node_id, right_node_id, created_at)
+		select :view_name, `+columns+`, :view_now from (`+query+`)`+searchWhere, args)
+	if err != nil {
+		return fmt.Errorf("filling view %s: %w", view.Name, err)
+	}
+	return nil
+}
+
+// touchedEntities returns the IDs of the nodes and relation a MERGE wrote
+func touchedEntities(res any) []string {
+	switch res := res.(type) {
+	case *Node:
+		if res.Unchanged {
+			return []string{}
+		}
+		return []string{res.ID}
+	case *Relation:
+		if res.Unchanged {
+			return []string{}
+		}
+		return []string{res.ID, res.LeftNodeID, res.RightNodeID}
+	default:
+		return []string{}
+	}
+}
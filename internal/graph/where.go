@@ -0,0 +1,137 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package graph
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+)
+
+// whereColumn is the search query column holding the ID of the node or
+// relation bound to an identifier
+type whereColumn struct {
+	column string
+	entity string
+}
+
+// whereBuilder translates a WHERE condition into SQL on the columns of a
+// search query, adding its values to the query's named parameters
+type whereBuilder struct {
+	columns map[string]whereColumn
+	args    map[string]any
+	count   int
+}
+
+// applyWhere restricts a search query's rows to those meeting the condition
+func applyWhere(query string, cond ast.Condition, columns map[string]whereColumn, args map[string]any) (string, error) {
+	if cond == nil {
+		return query, nil
+	}
+
+	b := &whereBuilder{columns: columns, args: args}
+	sql, err := b.build(cond)
+	if err != nil {
+		return "", err
+	}
+	return "select * from (" + query + ") m where " + sql, nil
+}
+
+func (b *whereBuilder) arg(v any) string {
+	name := fmt.Sprintf("where_%d", b.count)
+	b.count++
+	b.args[name] = v
+	return ":" + name
+}
+
+func (b *whereBuilder) build(c ast.Condition) (string, error) {
+	switch c.Type() {
+	case ast.ConditionTypeAnd, ast.ConditionTypeOr:
+		operands := make([]string, len(c.Operands()))
+		for i, o := range c.Operands() {
+			sql, err := b.build(o)
+			if err != nil {
+				return "", err
+			}
+			operands[i] = sql
+		}
+		sep := " and "
+		if c.Type() == ast.ConditionTypeOr {
+			sep = " or "
+		}
+		return "(" + strings.Join(operands, sep) + ")", nil
+	case ast.ConditionTypeNot:
+		sql, err := b.build(c.Operands()[0])
+		if err != nil {
+			return "", err
+		}
+		return "not " + sql, nil
+	}
+
+	col, ok := b.columns[c.Identifier()]
+	if !ok {
+		return "", fmt.Errorf("unknown identifier in where: %s", c.Identifier())
+	}
+	owner := fmt.Sprintf("%[1]s_id = m.%[2]s", col.entity, col.column)
+
+	switch c.Type() {
+	case ast.ConditionTypeLabel:
+		return fmt.Sprintf("exists (select 1 from %s_labels where %s and label = %s)", col.entity, owner, b.arg(c.Label())), nil
+	case ast.ConditionTypeIsNull, ast.ConditionTypeIsNotNull:
+		sql := fmt.Sprintf("exists (select 1 from %s_attributes where %s and attr_name = %s)", col.entity, owner, b.arg(c.Key()))
+		if c.Type() == ast.ConditionTypeIsNull {
+			sql = "not " + sql
+		}
+		return sql, nil
+	case ast.ConditionTypeCompare, ast.ConditionTypeIn:
+		operator := c.Operator()
+		if c.Type() == ast.ConditionTypeIn {
+			operator = "="
+		}
+		// an empty IN list matches nothing
+		tests := []string{"0"}
+		for i, v := range c.Values() {
+			test, err := b.compare(operator, v)
+			if err != nil {
+				return "", err
+			}
+			if i == 0 {
+				tests = tests[:0]
+			}
+			tests = append(tests, test)
+		}
+		return fmt.Sprintf("exists (select 1 from %s_attributes where %s and attr_name = %s and (%s))", col.entity, owner, b.arg(c.Key()), strings.Join(tests, " or ")), nil
+	default:
+		return "", fmt.Errorf("unexpected condition: %v", c.Type())
+	}
+}
+
+// compare tests an attribute's value. Numbers only compare with number
+// attributes, by value, strings compare as text.
+func (b *whereBuilder) compare(operator string, v ast.Attribute) (string, error) {
+	if v.Type() != ast.AttributeDataTypeNumber {
+		return fmt.Sprintf("attr_value %s %s", operator, b.arg(v.Value())), nil
+	}
+
+	f, err := strconv.ParseFloat(v.Value(), 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid number in where: %s", v.Value())
+	}
+	return fmt.Sprintf("(data_type = %s and cast(attr_value as real) %s %s)", b.arg(ast.AttributeDataTypeNumber), operator, b.arg(f)), nil
+}
@@ -0,0 +1,212 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package identity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/secrets"
+)
+
+// BundleVersion is the current version of the export format
+const BundleVersion = 1
+
+var (
+	ErrBadPassphrase     = errors.New("wrong passphrase or corrupt bundle")
+	ErrUnsupportedBundle = errors.New("unsupported identity bundle")
+	ErrIdentityExists    = errors.New("identity already exists")
+)
+
+// bundle is the envelope written by Export. The KDF parameters travel with it
+// so they can be changed without breaking old bundles.
+type bundle struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	secrets.KDFParams
+	Data []byte `json:"data"`
+}
+
+// bundleIdentity is the sealed content of a version 1 bundle
+type bundleIdentity struct {
+	Identifier  string      `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Handle      string      `json:"handle"`
+	Bio         string      `json:"bio"`
+	Certificate []byte      `json:"certificate"`
+	Keys        []bundleKey `json:"keys"`
+}
+
+type bundleKey struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Type      KeyType   `json:"type"`
+	Data      []byte    `json:"data"`
+}
+
+// Export returns the identity's keys, certificate and profile encrypted with
+// a key derived from the passphrase
+func Export(id *Identity, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase: %w", ErrBadPassphrase)
+	}
+
+	content := bundleIdentity{
+		Identifier:  id.Identifier,
+		CreatedAt:   id.CreatedAt,
+		Handle:      id.Handle,
+		Bio:         id.Bio,
+		Certificate: id.CertificateData,
+		Keys:        make([]bundleKey, 0, len(id.Keys)),
+	}
+	for _, key := range id.Keys {
+		content.Keys = append(content.Keys, bundleKey{
+			ID:        key.ID,
+			CreatedAt: key.CreatedAt,
+			Type:      key.Type,
+			Data:      key.Data,
+		})
+	}
+
+	plaintext, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling identity: %w", err)
+	}
+
+	params, err := secrets.NewKDFParams()
+	if err != nil {
+		return nil, err
+	}
+
+	b := bundle{
+		Version:   BundleVersion,
+		KDF:       secrets.KDFArgon2id,
+		KDFParams: params,
+	}
+
+	sealer, err := secrets.FromPassphrase(passphrase, b.KDFParams)
+	if err != nil {
+		return nil, fmt.Errorf("creating sealer: %w", err)
+	}
+
+	b.Data, err = sealer.Seal(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("sealing identity: %w", err)
+	}
+
+	return json.MarshalIndent(b, "", "  ")
+}
+
+// Import decrypts a bundle written by Export and checks that its keys match
+// its certificate
+func Import(data, passphrase []byte) (*Identity, error) {
+	b := bundle{}
+	err := json.Unmarshal(data, &b)
+	if err != nil {
+		return nil, fmt.Errorf("reading bundle: %w", ErrUnsupportedBundle)
+	}
+
+	if b.Version != BundleVersion || b.KDF != secrets.KDFArgon2id {
+		return nil, fmt.Errorf("version %d, kdf %s: %w", b.Version, b.KDF, ErrUnsupportedBundle)
+	}
+
+	sealer, err := secrets.FromPassphrase(passphrase, b.KDFParams)
+	if errors.Is(err, secrets.ErrBadKDFParameters) {
+		return nil, ErrUnsupportedBundle
+	}
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	// Open passes through data which isn't sealed, treat that as corrupt
+	plaintext, err := sealer.Open(b.Data)
+	if err != nil || bytes.Equal(plaintext, b.Data) {
+		return nil, ErrBadPassphrase
+	}
+
+	content := bundleIdentity{}
+	err = json.Unmarshal(plaintext, &content)
+	if err != nil {
+		return nil, fmt.Errorf("reading identity: %w", err)
+	}
+
+	id := &Identity{
+		Identifier:      content.Identifier,
+		CreatedAt:       content.CreatedAt,
+		Handle:          content.Handle,
+		Bio:             content.Bio,
+		CertificateData: content.Certificate,
+		Keys:            []*KeyItem{},
+	}
+	for _, key := range content.Keys {
+		id.Keys = append(id.Keys, &KeyItem{
+			ID:        key.ID,
+			CreatedAt: key.CreatedAt,
+			OwnerID:   id.Identifier,
+			Type:      key.Type,
+			Data:      key.Data,
+		})
+	}
+
+	id.Certificate, err = x509.ParseCertificate(id.CertificateData)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	err = checkKeys(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// checkKeys makes sure the identity's private key belongs to its certificate,
+// or that it has an external signer
+func checkKeys(id *Identity) error {
+	if id.Certificate.Subject.CommonName != id.Identifier {
+		return fmt.Errorf("certificate is for %s: %w", id.Certificate.Subject.CommonName, ErrUnauthorized)
+	}
+
+	publicKey, ok := id.Certificate.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return ErrUnsupportedPublicKey
+	}
+
+	for _, key := range id.Keys {
+		switch key.Type {
+		case KeyTypeED25519PrivateKey:
+			if len(key.Data) != ed25519.PrivateKeySize {
+				return fmt.Errorf("bad private key: %w", ErrUnauthorized)
+			}
+			if ed25519.PrivateKey(key.Data).Public().(ed25519.PublicKey).Equal(publicKey) {
+				return nil
+			}
+		case KeyTypeSignerURI:
+			// the key is held externally, the signer is checked when it's
+			// opened
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no private key for certificate: %w", ErrUnauthorized)
+}
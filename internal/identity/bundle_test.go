@@ -0,0 +1,54 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore("file:export.db?mode=memory&cache=shared")
+	assert.NoError(err)
+
+	svc, err := NewService(store)
+	assert.NoError(err)
+
+	id, err := svc.CreateIdentity("test user", "this is who I am", true)
+	assert.NoError(err)
+
+	data, err := svc.ExportIdentity(id.Identifier, []byte("correct horse"))
+	assert.NoError(err)
+	assert.NotContains(string(data), "test user")
+
+	_, err = Import(data, []byte("wrong horse"))
+	assert.ErrorIs(err, ErrBadPassphrase)
+
+	_, err = svc.ImportIdentity(data, []byte("correct horse"), true)
+	assert.ErrorIs(err, ErrIdentityExists)
+
+	store2, err := NewStore("file:import.db?mode=memory&cache=shared")
+	assert.NoError(err)
+
+	svc2, err := NewService(store2)
+	assert.NoError(err)
+
+	existing, err := svc2.CreateIdentity("someone else", "", true)
+	assert.NoError(err)
+
+	imported, err := svc2.ImportIdentity(data, []byte("correct horse"), true)
+	assert.NoError(err)
+	assert.Equal(id.Identifier, imported.Identifier)
+	assert.Equal("this is who I am", imported.Bio)
+
+	primary, err := svc2.GetPrimaryIdentity()
+	assert.NoError(err)
+	assert.Equal(id.Identifier, primary.Identifier)
+	assert.Equal(id.CertificateData, primary.CertificateData)
+	assert.Len(primary.Keys, 2)
+
+	other, err := store2.GetIdentity(existing.Identifier)
+	assert.NoError(err)
+	assert.False(other.IsPrimary)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MaxDelegationLifetime is the longest a delegation can be valid for. Longer
+// delegations aren't made or accepted, delegates must be given new ones.
+const MaxDelegationLifetime = 30 * 24 * time.Hour
+
+var (
+	ErrDelegationExpired = errors.New("delegation expired")
+	ErrDelegationScope   = errors.New("statement is outside the delegation's scope")
+	ErrBadDelegation     = errors.New("bad delegation")
+)
+
+// Delegation lets another key, such as a bot's or a phone's, publish as an
+// identity without holding the identity's own key. It only covers statements
+// whose entities all have one of its entity IDs or only its labels, and is
+// signed with the identity's key.
+type Delegation struct {
+	Identifier string    `json:"identifier"`
+	PublicKey  []byte    `json:"publicKey"`
+	Labels     []string  `json:"labels,omitempty"`
+	Entities   []string  `json:"entities,omitempty"`
+	IssuedAt   time.Time `json:"issuedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Signature  string    `json:"signature"`
+}
+
+// Delegate returns a delegation to the public key for statements on the
+// given labels and entity IDs, valid for ttl
+func (s *identityService) Delegate(id *Identity, publicKey ed25519.PublicKey, labels, entities []string, ttl time.Duration) (*Delegation, error) {
+	if len(labels) == 0 && len(entities) == 0 {
+		return nil, fmt.Errorf("no labels or entities: %w", ErrBadDelegation)
+	}
+	if ttl <= 0 || ttl > MaxDelegationLifetime {
+		return nil, fmt.Errorf("lifetime must be up to %s: %w", MaxDelegationLifetime, ErrBadDelegation)
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, ErrUnsupportedPublicKey
+	}
+
+	now := time.Now().UTC()
+	delegation := &Delegation{
+		Identifier: id.Identifier,
+		PublicKey:  publicKey,
+		Labels:     labels,
+		Entities:   entities,
+		IssuedAt:   now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	signer, err := NewSigner(id)
+	if err != nil {
+		return nil, fmt.Errorf("creating signer: %w", err)
+	}
+	delegation.add(signer)
+	delegation.Signature, err = signer.Sign()
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("delegated", "identity", id.Identifier, "labels", labels, "entities", entities, "expires", delegation.ExpiresAt)
+	return delegation, nil
+}
+
+// VerifyDelegation checks that the delegation was signed with the key of the
+// identity's certificate and is valid at the given time
+func VerifyDelegation(d *Delegation, cert *x509.Certificate, now time.Time) error {
+	if cert.Subject.CommonName != d.Identifier {
+		return ErrUnauthorized
+	}
+	if len(d.Labels) == 0 && len(d.Entities) == 0 {
+		return ErrBadDelegation
+	}
+	if d.ExpiresAt.Sub(d.IssuedAt) > MaxDelegationLifetime || now.After(d.ExpiresAt) {
+		return ErrDelegationExpired
+	}
+
+	v, err := NewVerifier(cert)
+	if err != nil {
+		return err
+	}
+	d.add(v)
+
+	return v.Verify(d.Signature)
+}
+
+// Covers reports whether an entity with the given labels and ID, empty if it
+// has none, is within the delegation's scope
+func (d *Delegation) Covers(labels []string, entityID string) bool {
+	if entityID != "" && slices.Contains(d.Entities, entityID) {
+		return true
+	}
+	if len(labels) == 0 {
+		return false
+	}
+	for _, label := range labels {
+		if !slices.Contains(d.Labels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewVerifier returns a verifier for signatures made by the delegate's key
+func (d *Delegation) NewVerifier() (*verifier, error) {
+	if len(d.PublicKey) != ed25519.PublicKeySize {
+		return nil, ErrUnsupportedPublicKey
+	}
+	return &verifier{
+		publicKey: ed25519.PublicKey(d.PublicKey),
+		hash:      sha256.New(),
+	}, nil
+}
+
+// Encode returns the delegation as a token for the delegate to send with its
+// actions
+func (d *Delegation) Encode() (string, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return "", fmt.Errorf("encoding delegation: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// ParseDelegation decodes a token made by Encode
+func ParseDelegation(token string) (*Delegation, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrBadDelegation
+	}
+	d := &Delegation{}
+	err = json.Unmarshal(data, d)
+	if err != nil {
+		return nil, ErrBadDelegation
+	}
+	return d, nil
+}
+
+// NewDelegateSigner returns a Signer for a delegate's key
+func NewDelegateSigner(key ed25519.PrivateKey) Signer {
+	return &signer{
+		key:  key,
+		hash: sha256.New(),
+	}
+}
+
+func (d *Delegation) add(h interface{ Add([]byte) }) {
+	h.Add([]byte(d.Identifier))
+	h.Add(d.PublicKey)
+	h.Add([]byte(strings.Join(d.Labels, ",")))
+	h.Add([]byte(strings.Join(d.Entities, ",")))
+	h.Add([]byte(d.IssuedAt.Format(time.RFC3339Nano)))
+	h.Add([]byte(d.ExpiresAt.Format(time.RFC3339Nano)))
+}
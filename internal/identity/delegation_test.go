@@ -0,0 +1,66 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelegate(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore("file:delegation.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+
+	svc, err := NewService(store)
+	require.NoError(t, err)
+
+	id, err := svc.CreateIdentity("test user", "", true)
+	require.NoError(t, err)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	_, err = svc.Delegate(id, publicKey, nil, nil, time.Hour)
+	assert.ErrorIs(err, ErrBadDelegation)
+	_, err = svc.Delegate(id, publicKey, []string{"Post"}, nil, MaxDelegationLifetime+time.Hour)
+	assert.ErrorIs(err, ErrBadDelegation)
+
+	delegation, err := svc.Delegate(id, publicKey, []string{"Post"}, []string{"profile"}, time.Hour)
+	require.NoError(t, err)
+
+	token, err := delegation.Encode()
+	require.NoError(t, err)
+	parsed, err := ParseDelegation(token)
+	require.NoError(t, err)
+
+	now := time.Now()
+	assert.NoError(VerifyDelegation(parsed, id.Certificate, now))
+	assert.ErrorIs(VerifyDelegation(parsed, id.Certificate, now.Add(2*time.Hour)), ErrDelegationExpired)
+
+	assert.True(parsed.Covers([]string{"Post"}, ""))
+	assert.True(parsed.Covers([]string{"Person"}, "profile"))
+	assert.False(parsed.Covers([]string{"Post", "Person"}, ""))
+	assert.False(parsed.Covers(nil, "other"))
+
+	// the delegate signs with its own key
+	signer := NewDelegateSigner(privateKey)
+	signer.Add([]byte("statement"))
+	sig, err := signer.Sign()
+	require.NoError(t, err)
+	v, err := parsed.NewVerifier()
+	require.NoError(t, err)
+	v.Add([]byte("statement"))
+	assert.NoError(v.Verify(sig))
+
+	// widening the scope breaks the identity's signature
+	parsed.Labels = append(parsed.Labels, "Identity")
+	assert.ErrorIs(VerifyDelegation(parsed, id.Certificate, now), ErrUnauthorized)
+
+	_, err = ParseDelegation("not a token")
+	assert.ErrorIs(err, ErrBadDelegation)
+}
@@ -1,6 +1,8 @@
 package identity
 
 import (
+	"context"
+	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
@@ -10,33 +12,69 @@ import (
 	"errors"
 	"fmt"
 	"hash"
+	"io"
+	"log/slog"
 	"math/big"
+	"slices"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/jdudmesh/propolis/internal/secrets"
 )
 
+// CertificateLifetime is how long new certificates are valid for. Identities
+// must rotate their keys before their certificate expires.
+const CertificateLifetime = 365 * 24 * time.Hour
+
+// MaxReasonLength is the longest reason an identity can be revoked with
+const MaxReasonLength = 1024
+
 var (
 	ErrUnsupportedPublicKey = errors.New("unsupported public key")
 	ErrUnauthorized         = errors.New("unauthorized")
 	ErrBadSignature         = errors.New("bad signature")
+	ErrCertificateExpired   = errors.New("certificate expired")
+	ErrRevoked              = errors.New("identity revoked")
+	ErrSignerMismatch       = errors.New("signer key doesn't match certificate")
+	ErrExternalSigner       = errors.New("identity's key is held by an external signer")
+	ErrKeyNotRotated        = errors.New("new key is the same as the old one")
+	ErrBadReason            = errors.New("bad revocation reason")
 )
 
 type identityStore interface {
 	GetPrimaryIdentity() (*Identity, error)
+	GetIdentity(identifier string) (*Identity, error)
+	ListIdentities() ([]*Identity, error)
+	SetPrimaryIdentity(identifier string) error
+	UpdateProfile(identifier, handle, bio string, updatedAt time.Time) error
 	PutIdentity(id *Identity) error
+	RotateKeys(id *Identity, retiredAt time.Time) error
+	Unlock(passphrase []byte) error
+	SetPassphrase(passphrase []byte) error
+	SetUnlocker(unlocker secrets.PassphraseProvider)
 }
 
 type identityService struct {
-	store identityStore
+	store  identityStore
+	logger *slog.Logger
 }
 
 func NewService(store identityStore) (*identityService, error) {
 	return &identityService{
-		store: store,
+		store:  store,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
 	}, nil
 }
 
+// SetLogger sets where changes to local identities are logged, nowhere by
+// default
+func (s *identityService) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
 func (s *identityService) GetPrimaryIdentity() (*Identity, error) {
 	i, err := s.store.GetPrimaryIdentity()
 	if err != nil {
@@ -48,6 +86,55 @@ func (s *identityService) GetPrimaryIdentity() (*Identity, error) {
 	return i, nil
 }
 
+// GetIdentity returns a local identity with its current keys
+func (s *identityService) GetIdentity(identifier string) (*Identity, error) {
+	return s.store.GetIdentity(identifier)
+}
+
+// ListIdentities returns the local identities, primary first. Their keys
+// aren't loaded.
+func (s *identityService) ListIdentities() ([]*Identity, error) {
+	return s.store.ListIdentities()
+}
+
+// SetPrimaryIdentity makes an identity the one used when none is given
+func (s *identityService) SetPrimaryIdentity(identifier string) error {
+	return s.store.SetPrimaryIdentity(identifier)
+}
+
+// UpdateProfile changes an identity's handle and bio and calls publish with
+// the updated identity, which should sign and publish its identity statement
+// so other nodes see the change. Nodes keep the profile updated last, by the
+// time in the statement, whatever order updates reach them in. The change is
+// kept if publishing fails, publishing the identity again retries it.
+func (s *identityService) UpdateProfile(identifier, handle, bio string, publish func(id *Identity) error) (*Identity, error) {
+	id, err := s.store.GetIdentity(identifier)
+	if err != nil {
+		return nil, fmt.Errorf("fetching identity: %w", err)
+	}
+	id.Certificate, err = x509.ParseCertificate(id.CertificateData)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	now := time.Now().UTC()
+	err = s.store.UpdateProfile(id.Identifier, handle, bio, now)
+	if err != nil {
+		return nil, fmt.Errorf("updating profile: %w", err)
+	}
+	id.Handle = handle
+	id.Bio = bio
+	id.UpdatedAt = &now
+
+	s.logger.Info("updated profile", "identity", id.Identifier, "handle", id.Handle)
+
+	err = publish(id)
+	if err != nil {
+		return id, fmt.Errorf("publishing profile: %w", err)
+	}
+	return id, nil
+}
+
 func (s *identityService) CreateIdentity(handle, bio string, isPrimary bool) (*Identity, error) {
 	id := &Identity{
 		Identifier: model.NewID(),
@@ -58,7 +145,7 @@ func (s *identityService) CreateIdentity(handle, bio string, isPrimary bool) (*I
 		Keys:       []*KeyItem{},
 	}
 
-	err := s.createCredentials(id)
+	err := s.createCredentials(id, big.NewInt(1), id.CreatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("creating credentials: %w", err)
 	}
@@ -68,38 +155,321 @@ func (s *identityService) CreateIdentity(handle, bio string, isPrimary bool) (*I
 		return nil, fmt.Errorf("storing credentials: %w", err)
 	}
 
+	s.logger.Info("created identity", "identity", id.Identifier, "handle", id.Handle)
 	return id, nil
 }
 
-func (s *identityService) createCredentials(id *Identity) error {
-	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+// CreateIdentityWithSigner creates an identity whose private key is held
+// elsewhere, e.g. in an SSH agent or a KMS. signerURI is stored so the key can
+// be found again (see OpenSigner).
+func (s *identityService) CreateIdentityWithSigner(handle, bio string, isPrimary bool, signerURI string) (*Identity, error) {
+	key, err := OpenSigner(context.Background(), signerURI, nil)
 	if err != nil {
-		return fmt.Errorf("generating new key: %s", err)
+		return nil, fmt.Errorf("opening signer: %w", err)
 	}
 
-	template := x509.Certificate{
-		Subject: pkix.Name{
-			CommonName: id.Identifier,
-		},
-		SerialNumber: big.NewInt(1),
+	id := &Identity{
+		Identifier: model.NewID(),
+		CreatedAt:  time.Now().UTC(),
+		Handle:     handle,
+		Bio:        bio,
+		IsPrimary:  isPrimary,
 	}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey, privateKey)
+	err = signerCredentials(id, key, signerURI, big.NewInt(1), id.CreatedAt)
 	if err != nil {
-		return fmt.Errorf("generating certificate: %w", err)
+		return nil, fmt.Errorf("creating credentials: %w", err)
 	}
 
-	id.CertificateData = certDER
+	err = s.store.PutIdentity(id)
+	if err != nil {
+		return nil, fmt.Errorf("storing credentials: %w", err)
+	}
 
-	cert, err := x509.ParseCertificate(certDER)
+	s.logger.Info("created identity", "identity", id.Identifier, "handle", id.Handle)
+	return id, nil
+}
+
+// Unlock unlocks the keystore if private keys are protected by a passphrase
+func (s *identityService) Unlock(passphrase []byte) error {
+	return s.store.Unlock(passphrase)
+}
+
+// SetUnlocker sets where the keystore passphrase comes from the first time
+// key material is needed, e.g. secrets.KeychainPassphrase
+func (s *identityService) SetUnlocker(unlocker secrets.PassphraseProvider) {
+	s.store.SetUnlocker(unlocker)
+}
+
+// SetPassphrase protects private keys with a passphrase, or removes the
+// protection if it is empty
+func (s *identityService) SetPassphrase(passphrase []byte) error {
+	return s.store.SetPassphrase(passphrase)
+}
+
+// ExportIdentity returns a passphrase protected bundle holding the identity's
+// current keys, certificate and profile
+func (s *identityService) ExportIdentity(identifier string, passphrase []byte) ([]byte, error) {
+	id, err := s.store.GetIdentity(identifier)
 	if err != nil {
-		return fmt.Errorf("parsing certificate: %w", err)
+		return nil, fmt.Errorf("fetching identity: %w", err)
+	}
+	return Export(id, passphrase)
+}
+
+// ImportIdentity stores an identity exported from another machine
+func (s *identityService) ImportIdentity(data, passphrase []byte, isPrimary bool) (*Identity, error) {
+	id, err := Import(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.store.GetIdentity(id.Identifier)
+	if err == nil {
+		return nil, ErrIdentityExists
+	}
+	if !errors.Is(err, model.ErrNotFound) {
+		return nil, fmt.Errorf("checking identity: %w", err)
+	}
+
+	id.IsPrimary = isPrimary
+	err = s.store.PutIdentity(id)
+	if err != nil {
+		return nil, fmt.Errorf("storing identity: %w", err)
+	}
+
+	s.logger.Info("imported identity", "identity", id.Identifier, "handle", id.Handle)
+	return id, nil
+}
+
+// RotateKeys replaces the identity's key pair and certificate. The returned
+// rotation is signed with the old key and must be published so that peers
+// accept the new certificate. id is updated in place to use the new keys.
+// Identities whose key is held by an external signer must be rotated to
+// another key held by a signer with RotateKeysWithSigner.
+func (s *identityService) RotateKeys(id *Identity) (*Rotation, error) {
+	if hasExternalSigner(id) {
+		return nil, ErrExternalSigner
+	}
+	return s.rotateKeys(id, s.createCredentials)
+}
+
+// RotateKeysWithSigner replaces the identity's key pair and certificate with
+// a key held by the external signer at signerURI, as RotateKeys
+func (s *identityService) RotateKeysWithSigner(id *Identity, signerURI string) (*Rotation, error) {
+	key, err := OpenSigner(context.Background(), signerURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening signer: %w", err)
+	}
+
+	return s.rotateKeys(id, func(next *Identity, serial *big.Int, createdAt time.Time) error {
+		return signerCredentials(next, key, signerURI, serial, createdAt)
+	})
+}
+
+func (s *identityService) rotateKeys(id *Identity, credentials func(next *Identity, serial *big.Int, createdAt time.Time) error) (*Rotation, error) {
+	prevCert := id.Certificate
+	if prevCert == nil {
+		var err error
+		prevCert, err = x509.ParseCertificate(id.CertificateData)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate: %w", err)
+		}
+	}
+
+	now := time.Now().UTC()
+
+	prev := *id
+	prev.Certificate = prevCert
+	prev.Keys = slices.Clone(id.Keys)
+
+	next := *id
+	next.UpdatedAt = &now
+	next.Keys = []*KeyItem{}
+	next.KeySigner = nil
+
+	serial := new(big.Int).Add(prevCert.SerialNumber, big.NewInt(1))
+	err := credentials(&next, serial, now)
+	if err != nil {
+		return nil, fmt.Errorf("creating credentials: %w", err)
+	}
+	if key, ok := next.Certificate.PublicKey.(ed25519.PublicKey); ok && key.Equal(prevCert.PublicKey) {
+		return nil, ErrKeyNotRotated
+	}
+
+	rotation := &Rotation{
+		Identifier:          id.Identifier,
+		RotatedAt:           now,
+		PreviousCertificate: prev.CertificateData,
+		Certificate:         next.CertificateData,
+		Previous:            &prev,
+	}
+
+	signer, err := NewSigner(&prev)
+	if err != nil {
+		return nil, fmt.Errorf("creating signer: %w", err)
+	}
+	rotation.add(signer)
+	rotation.Signature, err = signer.Sign()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.RotateKeys(&next, now)
+	if err != nil {
+		return nil, fmt.Errorf("storing credentials: %w", err)
+	}
+
+	*id = next
+
+	s.logger.Info("rotated keys", "identity", id.Identifier)
+	return rotation, nil
+}
+
+// VerifyRotation checks that the rotation was signed by the previous key and
+// returns the new certificate
+func VerifyRotation(r *Rotation) (*x509.Certificate, error) {
+	prevCert, err := x509.ParseCertificate(r.PreviousCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing previous certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(r.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	if prevCert.Subject.CommonName != r.Identifier || cert.Subject.CommonName != r.Identifier {
+		return nil, ErrUnauthorized
+	}
+
+	v, err := NewVerifier(prevCert)
+	if err != nil {
+		return nil, err
+	}
+	r.add(v)
+
+	err = v.Verify(r.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// Revoke returns a revocation for the identity signed with its current key.
+// It must be published for peers to stop accepting the identity's actions.
+// The reason is signed as it is so one which can't be shown as a single line
+// of text is rejected.
+func (s *identityService) Revoke(id *Identity, reason string) (*Revocation, error) {
+	err := checkReason(reason)
+	if err != nil {
+		return nil, err
+	}
+
+	revocation := &Revocation{
+		Identifier:  id.Identifier,
+		RevokedAt:   time.Now().UTC(),
+		Reason:      reason,
+		Certificate: id.CertificateData,
+	}
+
+	signer, err := NewSigner(id)
+	if err != nil {
+		return nil, fmt.Errorf("creating signer: %w", err)
+	}
+	revocation.add(signer)
+	revocation.Signature, err = signer.Sign()
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("revoked identity", "identity", id.Identifier)
+	return revocation, nil
+}
+
+// VerifyRevocation checks that the revocation was signed with the key of its
+// certificate and that the certificate belongs to the identity
+func VerifyRevocation(r *Revocation) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(r.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	if cert.Subject.CommonName != r.Identifier {
+		return nil, ErrUnauthorized
+	}
+
+	v, err := NewVerifier(cert)
+	if err != nil {
+		return nil, err
+	}
+	r.add(v)
+
+	err = v.Verify(r.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// checkReason returns ErrBadReason for revocation reasons which are too long,
+// aren't UTF-8 or contain control characters
+func checkReason(reason string) error {
+	if len(reason) > MaxReasonLength {
+		return fmt.Errorf("longer than %d bytes: %w", MaxReasonLength, ErrBadReason)
+	}
+	if !utf8.ValidString(reason) {
+		return fmt.Errorf("not UTF-8: %w", ErrBadReason)
+	}
+	if strings.ContainsFunc(reason, unicode.IsControl) {
+		return fmt.Errorf("contains control characters: %w", ErrBadReason)
+	}
+	return nil
+}
+
+func (r *Revocation) add(h interface{ Add([]byte) }) {
+	h.Add([]byte(r.Identifier))
+	h.Add([]byte(r.RevokedAt.Format(time.RFC3339Nano)))
+	h.Add([]byte(r.Reason))
+	h.Add(r.Certificate)
+}
+
+// CheckValidity returns ErrCertificateExpired if the certificate has expired.
+// Certificates issued before expiry was added have no NotAfter and never
+// expire.
+func CheckValidity(cert *x509.Certificate, now time.Time) error {
+	if cert.NotAfter.Year() <= 1 {
+		return nil
+	}
+	if now.After(cert.NotAfter) {
+		return ErrCertificateExpired
+	}
+	return nil
+}
+
+func (r *Rotation) add(h interface{ Add([]byte) }) {
+	h.Add([]byte(r.Identifier))
+	h.Add([]byte(r.RotatedAt.Format(time.RFC3339Nano)))
+	h.Add(r.PreviousCertificate)
+	h.Add(r.Certificate)
+}
+
+func (s *identityService) createCredentials(id *Identity, serial *big.Int, createdAt time.Time) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating new key: %s", err)
+	}
+
+	err = issueCertificate(id, privateKey, serial, createdAt)
+	if err != nil {
+		return err
 	}
-	id.Certificate = cert
 
 	pubKeyItem := &KeyItem{
 		ID:        model.NewID(),
-		CreatedAt: id.CreatedAt,
+		CreatedAt: createdAt,
 		OwnerID:   id.Identifier,
 		Type:      KeyTypeED25519PublicKey,
 		Data:      publicKey,
@@ -107,7 +477,7 @@ func (s *identityService) createCredentials(id *Identity) error {
 
 	privKeyItem := &KeyItem{
 		ID:        model.NewID(),
-		CreatedAt: id.CreatedAt,
+		CreatedAt: createdAt,
 		OwnerID:   id.Identifier,
 		Type:      KeyTypeED25519PrivateKey,
 		Data:      privateKey,
@@ -118,9 +488,88 @@ func (s *identityService) createCredentials(id *Identity) error {
 	return nil
 }
 
+// signerCredentials issues the identity's certificate for a key held by an
+// external signer. Only the public key and the signer's URI are kept.
+func signerCredentials(id *Identity, key crypto.Signer, signerURI string, serial *big.Int, createdAt time.Time) error {
+	publicKey, ok := key.Public().(ed25519.PublicKey)
+	if !ok {
+		return ErrUnsupportedPublicKey
+	}
+
+	err := issueCertificate(id, key, serial, createdAt)
+	if err != nil {
+		return err
+	}
+
+	id.KeySigner = key
+	id.Keys = append(id.Keys,
+		&KeyItem{
+			ID:        model.NewID(),
+			CreatedAt: createdAt,
+			OwnerID:   id.Identifier,
+			Type:      KeyTypeED25519PublicKey,
+			Data:      publicKey,
+		},
+		&KeyItem{
+			ID:        model.NewID(),
+			CreatedAt: createdAt,
+			OwnerID:   id.Identifier,
+			Type:      KeyTypeSignerURI,
+			Data:      []byte(signerURI),
+		},
+	)
+
+	return nil
+}
+
+// hasExternalSigner reports whether the identity's private key is held
+// outside the process
+func hasExternalSigner(id *Identity) bool {
+	if id.KeySigner != nil {
+		return true
+	}
+	return slices.ContainsFunc(id.Keys, func(key *KeyItem) bool {
+		return key.Type == KeyTypeSignerURI
+	})
+}
+
+// issueCertificate creates the identity's self-signed certificate. key can be
+// held outside the process, e.g. in an SSH agent.
+func issueCertificate(id *Identity, key crypto.Signer, serial *big.Int, createdAt time.Time) error {
+	template := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: id.Identifier,
+		},
+		SerialNumber: serial,
+		NotBefore:    createdAt,
+		NotAfter:     createdAt.Add(CertificateLifetime),
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("generating certificate: %w", err)
+	}
+
+	id.CertificateData = certDER
+
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return fmt.Errorf("parsing certificate: %w", err)
+	}
+	id.Certificate = cert
+
+	return nil
+}
+
+// Signer hashes the data added to it and signs the digest
+type Signer interface {
+	Add(data []byte)
+	Sign() (string, error)
+}
+
 type signer struct {
-	privateKey ed25519.PrivateKey
-	hash       hash.Hash
+	key  crypto.Signer
+	hash hash.Hash
 }
 
 type verifier struct {
@@ -128,36 +577,85 @@ type verifier struct {
 	hash      hash.Hash
 }
 
-func NewSigner(id *Identity) (*signer, error) {
-	var privateKey ed25519.PrivateKey
-	for _, key := range id.Keys {
-		if key.Type == KeyTypeED25519PrivateKey {
-			privateKey = key.Data
-			break
+// NewSigner returns a Signer for the identity. The key is the identity's
+// KeySigner if set, otherwise its private key or the external signer its
+// keys point to (see OpenSigner).
+func NewSigner(id *Identity) (Signer, error) {
+	key := id.KeySigner
+	if key == nil {
+		var err error
+		key, err = keySigner(id)
+		if err != nil {
+			return nil, err
 		}
 	}
-	if privateKey == nil {
-		return nil, fmt.Errorf("private key not found")
+
+	if id.Certificate != nil {
+		publicKey, ok := key.Public().(ed25519.PublicKey)
+		if !ok {
+			return nil, ErrUnsupportedPublicKey
+		}
+		if !publicKey.Equal(id.Certificate.PublicKey) {
+			return nil, ErrSignerMismatch
+		}
 	}
 
 	return &signer{
-		privateKey: privateKey,
-		hash:       sha256.New(),
+		key:  key,
+		hash: sha256.New(),
 	}, nil
 }
 
+// CryptoSigner returns the identity's private key, or the external signer
+// holding it, for protocols which sign in their own format
+func CryptoSigner(id *Identity) (crypto.Signer, error) {
+	if id.KeySigner != nil {
+		return id.KeySigner, nil
+	}
+	return keySigner(id)
+}
+
+func keySigner(id *Identity) (crypto.Signer, error) {
+	var publicKey ed25519.PublicKey
+	signerURI := ""
+	for _, key := range id.Keys {
+		switch key.Type {
+		case KeyTypeED25519PrivateKey:
+			return ed25519.PrivateKey(key.Data), nil
+		case KeyTypeED25519PublicKey:
+			publicKey = key.Data
+		case KeyTypeSignerURI:
+			signerURI = string(key.Data)
+		}
+	}
+
+	if signerURI == "" {
+		return nil, fmt.Errorf("private key not found")
+	}
+
+	return OpenSigner(context.Background(), signerURI, publicKey)
+}
+
 func (s *signer) Add(data []byte) {
 	s.hash.Write(data)
 }
 
-func (s *signer) Sign() string {
-	sig := ed25519.Sign(s.privateKey, s.hash.Sum(nil))
-	return base64.StdEncoding.EncodeToString(sig)
+func (s *signer) Sign() (string, error) {
+	sig, err := s.key.Sign(rand.Reader, s.hash.Sum(nil), crypto.Hash(0))
+	if err != nil {
+		return "", fmt.Errorf("signing: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
 }
 
 func NewVerifier(cert *x509.Certificate) (*verifier, error) {
+	publicKey, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, ErrUnsupportedPublicKey
+	}
+
 	return &verifier{
-		publicKey: cert.PublicKey.(ed25519.PublicKey),
+		publicKey: publicKey,
 		hash:      sha256.New(),
 	}, nil
 }
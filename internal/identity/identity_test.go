@@ -1,8 +1,12 @@
 package identity
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/jdudmesh/propolis/internal/model"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,3 +28,123 @@ func TestCreateIdentity(t *testing.T) {
 	assert.NoError(err)
 	assert.NotNil(id)
 }
+
+func TestRotateKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore("file:rotation.db?mode=memory&cache=shared")
+	assert.NoError(err)
+
+	svc, err := NewService(store)
+	assert.NoError(err)
+
+	id, err := svc.CreateIdentity("test user", "this is who I am", true)
+	assert.NoError(err)
+	prevCert := id.CertificateData
+
+	rotation, err := svc.RotateKeys(id)
+	assert.NoError(err)
+	assert.Equal(prevCert, rotation.PreviousCertificate)
+	assert.Equal(id.CertificateData, rotation.Certificate)
+	assert.NotEqual(prevCert, id.CertificateData)
+	assert.Equal(int64(2), id.Certificate.SerialNumber.Int64())
+
+	cert, err := VerifyRotation(rotation)
+	assert.NoError(err)
+	assert.Equal(id.Identifier, cert.Subject.CommonName)
+
+	// only the new keys are used for signing
+	stored, err := store.GetPrimaryIdentity()
+	assert.NoError(err)
+	assert.Equal(id.CertificateData, stored.CertificateData)
+	assert.Len(stored.Keys, 2)
+
+	signer, err := NewSigner(stored)
+	assert.NoError(err)
+	signer.Add([]byte("data"))
+	sig, err := signer.Sign()
+	assert.NoError(err)
+
+	v, err := NewVerifier(cert)
+	assert.NoError(err)
+	v.Add([]byte("data"))
+	assert.NoError(v.Verify(sig))
+
+	// a rotation must be signed by the previous key
+	rotation.Signature = sig
+	_, err = VerifyRotation(rotation)
+	assert.ErrorIs(err, ErrUnauthorized)
+}
+
+func TestRevoke(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore("file:revocation.db?mode=memory&cache=shared")
+	assert.NoError(err)
+
+	svc, err := NewService(store)
+	assert.NoError(err)
+
+	id, err := svc.CreateIdentity("test user", "this is who I am", true)
+	assert.NoError(err)
+	assert.NoError(CheckValidity(id.Certificate, time.Now()))
+	assert.ErrorIs(CheckValidity(id.Certificate, time.Now().Add(CertificateLifetime+time.Hour)), ErrCertificateExpired)
+
+	for _, reason := range []string{"line\nbreak", "bad \xff", strings.Repeat("x", MaxReasonLength+1)} {
+		_, err = svc.Revoke(id, reason)
+		assert.ErrorIs(err, ErrBadReason)
+	}
+
+	revocation, err := svc.Revoke(id, "key 'lost'")
+	assert.NoError(err)
+	assert.Equal("key 'lost'", revocation.Reason)
+
+	cert, err := VerifyRevocation(revocation)
+	assert.NoError(err)
+	assert.Equal(id.Identifier, cert.Subject.CommonName)
+
+	revocation.Reason = "changed"
+	_, err = VerifyRevocation(revocation)
+	assert.ErrorIs(err, ErrUnauthorized)
+}
+
+func TestUpdateProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore("file:profile.db?mode=memory&cache=shared")
+	assert.NoError(err)
+
+	svc, err := NewService(store)
+	assert.NoError(err)
+
+	id, err := svc.CreateIdentity("test user", "this is who I am", true)
+	assert.NoError(err)
+
+	var published *Identity
+	updated, err := svc.UpdateProfile(id.Identifier, "new name", "still me", func(id *Identity) error {
+		published = id
+		return nil
+	})
+	assert.NoError(err)
+	assert.Same(updated, published)
+	assert.Equal("new name", updated.Handle)
+	assert.NotNil(updated.UpdatedAt)
+
+	stored, err := store.GetIdentity(id.Identifier)
+	assert.NoError(err)
+	assert.Equal("new name", stored.Handle)
+	assert.Equal("still me", stored.Bio)
+	assert.Equal(id.CertificateData, stored.CertificateData)
+
+	// the change is kept when publishing fails
+	_, err = svc.UpdateProfile(id.Identifier, "offline", "", func(id *Identity) error {
+		return errors.New("no peers")
+	})
+	assert.Error(err)
+	stored, err = store.GetIdentity(id.Identifier)
+	assert.NoError(err)
+	assert.Equal("offline", stored.Handle)
+
+	_, err = svc.UpdateProfile("unknown", "x", "", func(id *Identity) error { return nil })
+	assert.ErrorIs(err, model.ErrNotFound)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxInvitationLifetime is the longest an invitation can be valid for
+const MaxInvitationLifetime = 30 * 24 * time.Hour
+
+var (
+	ErrInvitationExpired = errors.New("invitation expired")
+	ErrBadInvitation     = errors.New("bad invitation")
+)
+
+// Invitation lets a node join seeds which only accept invited nodes. It names
+// the key the node signs its control messages with, so it can't be passed on
+// to other nodes, and is signed with the inviting identity's key.
+type Invitation struct {
+	Identifier string    `json:"identifier"`
+	NodeKey    []byte    `json:"nodeKey"`
+	IssuedAt   time.Time `json:"issuedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Signature  string    `json:"signature"`
+}
+
+// Invite returns an invitation for the node with the given key, valid for ttl
+func (s *identityService) Invite(id *Identity, nodeKey ed25519.PublicKey, ttl time.Duration) (*Invitation, error) {
+	if ttl <= 0 || ttl > MaxInvitationLifetime {
+		return nil, fmt.Errorf("lifetime must be up to %s: %w", MaxInvitationLifetime, ErrBadInvitation)
+	}
+	if len(nodeKey) != ed25519.PublicKeySize {
+		return nil, ErrUnsupportedPublicKey
+	}
+
+	now := time.Now().UTC()
+	invitation := &Invitation{
+		Identifier: id.Identifier,
+		NodeKey:    nodeKey,
+		IssuedAt:   now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	signer, err := NewSigner(id)
+	if err != nil {
+		return nil, fmt.Errorf("creating signer: %w", err)
+	}
+	invitation.add(signer)
+	invitation.Signature, err = signer.Sign()
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("invited", "identity", id.Identifier, "expires", invitation.ExpiresAt)
+	return invitation, nil
+}
+
+// VerifyInvitation checks that the invitation was signed with the key of the
+// identity's certificate and is valid at the given time
+func VerifyInvitation(inv *Invitation, cert *x509.Certificate, now time.Time) error {
+	if cert.Subject.CommonName != inv.Identifier {
+		return ErrUnauthorized
+	}
+	if len(inv.NodeKey) != ed25519.PublicKeySize {
+		return ErrBadInvitation
+	}
+	if inv.ExpiresAt.Sub(inv.IssuedAt) > MaxInvitationLifetime || now.After(inv.ExpiresAt) {
+		return ErrInvitationExpired
+	}
+
+	v, err := NewVerifier(cert)
+	if err != nil {
+		return err
+	}
+	inv.add(v)
+
+	return v.Verify(inv.Signature)
+}
+
+// Encode returns the invitation as a token for the node to send when it joins
+func (inv *Invitation) Encode() (string, error) {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return "", fmt.Errorf("encoding invitation: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// ParseInvitation decodes a token made by Encode
+func ParseInvitation(token string) (*Invitation, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrBadInvitation
+	}
+	inv := &Invitation{}
+	err = json.Unmarshal(data, inv)
+	if err != nil {
+		return nil, ErrBadInvitation
+	}
+	return inv, nil
+}
+
+func (inv *Invitation) add(h interface{ Add([]byte) }) {
+	h.Add([]byte("invitation"))
+	h.Add([]byte(inv.Identifier))
+	h.Add(inv.NodeKey)
+	h.Add([]byte(inv.IssuedAt.Format(time.RFC3339Nano)))
+	h.Add([]byte(inv.ExpiresAt.Format(time.RFC3339Nano)))
+}
@@ -0,0 +1,56 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvite(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore("file:invitation.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+
+	svc, err := NewService(store)
+	require.NoError(t, err)
+
+	id, err := svc.CreateIdentity("test user", "", true)
+	require.NoError(t, err)
+	other, err := svc.CreateIdentity("other user", "", false)
+	require.NoError(t, err)
+
+	nodeKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	_, err = svc.Invite(id, nodeKey, MaxInvitationLifetime+time.Hour)
+	assert.ErrorIs(err, ErrBadInvitation)
+	_, err = svc.Invite(id, nodeKey[:8], time.Hour)
+	assert.ErrorIs(err, ErrUnsupportedPublicKey)
+
+	invitation, err := svc.Invite(id, nodeKey, time.Hour)
+	require.NoError(t, err)
+
+	token, err := invitation.Encode()
+	require.NoError(t, err)
+	parsed, err := ParseInvitation(token)
+	require.NoError(t, err)
+
+	now := time.Now()
+	assert.NoError(VerifyInvitation(parsed, id.Certificate, now))
+	assert.ErrorIs(VerifyInvitation(parsed, id.Certificate, now.Add(2*time.Hour)), ErrInvitationExpired)
+	assert.ErrorIs(VerifyInvitation(parsed, other.Certificate, now), ErrUnauthorized)
+
+	// the invitation can't be moved to another node
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	parsed.NodeKey = otherKey
+	assert.ErrorIs(VerifyInvitation(parsed, id.Certificate, now), ErrUnauthorized)
+
+	_, err = ParseInvitation("not a token")
+	assert.ErrorIs(err, ErrBadInvitation)
+}
@@ -0,0 +1,311 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package identity
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/secrets"
+)
+
+// Private keys can be protected with a passphrase. They are wrapped with a key
+// derived from it (argon2id) before the database key is applied, so a copy of
+// the database and the database key isn't enough to sign. The store starts
+// locked and is unlocked explicitly or, if an unlocker is set, the first time
+// key material is needed.
+
+var ErrLocked = errors.New("keystore is locked")
+
+// keystoreCheck is sealed with the passphrase key so a wrong passphrase can be
+// detected without touching the keys
+var keystoreCheck = []byte("propolis-keystore")
+
+// wrapped keys are marked so they can be told apart from unprotected keys and
+// aren't mistaken for values sealed with the database key
+var wrappedPrefix = []byte("pk1:")
+
+type keystoreParams struct {
+	KDF string `db:"kdf"`
+	secrets.KDFParams
+	Check []byte `db:"check_value"`
+}
+
+// SetUnlocker sets where the passphrase comes from when a locked keystore is
+// first used
+func (s *store) SetUnlocker(unlocker secrets.PassphraseProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unlocker = unlocker
+}
+
+// IsProtected reports whether private keys are protected by a passphrase
+func (s *store) IsProtected() (bool, error) {
+	params, err := s.keystoreParams()
+	if err != nil {
+		return false, err
+	}
+	return params != nil, nil
+}
+
+// Unlock derives the keystore key from the passphrase
+func (s *store) Unlock(passphrase []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unlock(passphrase)
+}
+
+// Lock forgets the keystore key
+func (s *store) Lock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keystore = nil
+}
+
+func (s *store) unlock(passphrase []byte) error {
+	params, err := s.keystoreParams()
+	if err != nil {
+		return err
+	}
+	if params == nil {
+		return nil
+	}
+
+	sealer, err := secrets.FromPassphrase(passphrase, params.KDFParams)
+	if err != nil {
+		return fmt.Errorf("deriving keystore key: %w", err)
+	}
+
+	check, err := sealer.Open(params.Check)
+	if err != nil || !bytes.Equal(check, keystoreCheck) {
+		return ErrBadPassphrase
+	}
+
+	s.keystore = sealer
+	return nil
+}
+
+// SetPassphrase protects private keys with a new passphrase, rewrapping any
+// existing keys. An empty passphrase removes the protection. The store must be
+// unlocked if it is already protected.
+func (s *store) SetPassphrase(passphrase []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.keystoreSealer()
+	if err != nil {
+		return err
+	}
+
+	var next secrets.Sealer
+	var params keystoreParams
+	if len(passphrase) > 0 {
+		params.KDF = secrets.KDFArgon2id
+		params.KDFParams, err = secrets.NewKDFParams()
+		if err != nil {
+			return err
+		}
+		next, err = secrets.FromPassphrase(passphrase, params.KDFParams)
+		if err != nil {
+			return fmt.Errorf("deriving keystore key: %w", err)
+		}
+		params.Check, err = next.Seal(keystoreCheck)
+		if err != nil {
+			return fmt.Errorf("sealing check value: %w", err)
+		}
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("set passphrase (begin): %w", err)
+	}
+
+	keys := []*KeyItem{}
+	err = tx.SelectContext(ctx, &keys, "select * from keys")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("set passphrase (fetching keys): %w", err)
+	}
+
+	for _, key := range keys {
+		if !key.Type.IsPrivate() {
+			continue
+		}
+
+		data, err := s.sealer.Open(key.Data)
+		if err == nil {
+			data, err = unwrapKey(current, data)
+		}
+		if err == nil {
+			data, err = wrapKey(next, data)
+		}
+		if err == nil {
+			data, err = s.sealer.Seal(data)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("set passphrase (rewrapping key): %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "update keys set data = ? where id = ?", data, key.ID)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("set passphrase (update key): %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "delete from keystore")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("set passphrase (delete): %w", err)
+	}
+
+	if next != nil {
+		_, err = tx.ExecContext(ctx, `insert into keystore (id, created_at, kdf, salt, time, memory, threads, check_value)
+			values (1, ?, ?, ?, ?, ?, ?, ?)`,
+			time.Now().UTC(), params.KDF, params.Salt, params.Time, params.Memory, params.Threads, params.Check)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("set passphrase (insert): %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("set passphrase (commit): %w", err)
+	}
+
+	s.keystore = next
+
+	return nil
+}
+
+func (s *store) keystoreParams() (*keystoreParams, error) {
+	params := &keystoreParams{}
+	err := s.db.Get(params, "select kdf, salt, time, memory, threads, check_value from keystore where id = 1")
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("fetching keystore: %w", err)
+	}
+	if params.KDF != secrets.KDFArgon2id {
+		return nil, fmt.Errorf("keystore kdf %s: %w", params.KDF, secrets.ErrBadKDFParameters)
+	}
+	return params, nil
+}
+
+// keystoreSealer returns the sealer for private keys, nil if they aren't
+// protected. If the keystore is locked it tries the unlocker. The caller must
+// hold s.mu.
+func (s *store) keystoreSealer() (secrets.Sealer, error) {
+	if s.keystore != nil {
+		return s.keystore, nil
+	}
+
+	params, err := s.keystoreParams()
+	if err != nil || params == nil {
+		return nil, err
+	}
+
+	if s.unlocker == nil {
+		return nil, ErrLocked
+	}
+
+	passphrase, err := s.unlocker(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLocked, err)
+	}
+
+	err = s.unlock(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.keystore, nil
+}
+
+// sealKey wraps private keys with the keystore key then applies the database
+// key
+func (s *store) sealKey(key *KeyItem) ([]byte, error) {
+	data := key.Data
+	if key.Type.IsPrivate() {
+		s.mu.Lock()
+		sealer, err := s.keystoreSealer()
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		data, err = wrapKey(sealer, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.sealer.Seal(data)
+}
+
+func (s *store) openKey(key *KeyItem) ([]byte, error) {
+	data, err := s.sealer.Open(key.Data)
+	if err != nil || !key.Type.IsPrivate() || !bytes.HasPrefix(data, wrappedPrefix) {
+		return data, err
+	}
+
+	s.mu.Lock()
+	sealer, err := s.keystoreSealer()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapKey(sealer, data)
+}
+
+func wrapKey(sealer secrets.Sealer, data []byte) ([]byte, error) {
+	if sealer == nil {
+		return data, nil
+	}
+
+	sealed, err := sealer.Seal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, wrappedPrefix...), sealed...), nil
+}
+
+func unwrapKey(sealer secrets.Sealer, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, wrappedPrefix) {
+		return data, nil
+	}
+	if sealer == nil {
+		return nil, ErrLocked
+	}
+
+	data, err := sealer.Open(data[len(wrappedPrefix):])
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	return data, nil
+}
@@ -0,0 +1,60 @@
+package identity
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeystore(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore("file:keystore.db?mode=memory&cache=shared")
+	assert.NoError(err)
+
+	svc, err := NewService(store)
+	assert.NoError(err)
+
+	id, err := svc.CreateIdentity("test user", "", true)
+	assert.NoError(err)
+
+	err = svc.SetPassphrase([]byte("correct horse"))
+	assert.NoError(err)
+
+	var raw []byte
+	err = store.db.Get(&raw, "select data from keys where owner_id = ? and key_type = ?", id.Identifier, KeyTypeED25519PrivateKey)
+	assert.NoError(err)
+	assert.NotContains(string(raw), string(id.Keys[1].Data))
+
+	store.Lock()
+	_, err = store.GetPrimaryIdentity()
+	assert.ErrorIs(err, ErrLocked)
+
+	assert.ErrorIs(svc.Unlock([]byte("wrong horse")), ErrBadPassphrase)
+
+	// unlocked on first use
+	svc.SetUnlocker(func(ctx context.Context) ([]byte, error) {
+		return []byte("correct horse"), nil
+	})
+	id2, err := store.GetPrimaryIdentity()
+	assert.NoError(err)
+	assert.Equal(id.Keys[1].Data, id2.Keys[1].Data)
+
+	// rotated keys are protected too
+	_, err = svc.RotateKeys(id2)
+	assert.NoError(err)
+	store.Lock()
+	svc.SetUnlocker(nil)
+	assert.NoError(svc.Unlock([]byte("correct horse")))
+	id3, err := store.GetPrimaryIdentity()
+	assert.NoError(err)
+	assert.Equal(id2.Keys, id3.Keys)
+
+	// removing the passphrase unwraps the keys
+	assert.NoError(svc.SetPassphrase(nil))
+	store.Lock()
+	id4, err := store.GetPrimaryIdentity()
+	assert.NoError(err)
+	assert.Equal(id3.Keys[1].Data, id4.Keys[1].Data)
+}
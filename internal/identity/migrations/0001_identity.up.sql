@@ -0,0 +1,9 @@
+create table identity (
+	id text not null primary key,
+	created_at datetime not null,
+	updated_at datetime null,
+	handle text not null,
+	bio text not null default '',
+	is_primary int not null default 0,
+	certificate blob not null
+);
@@ -0,0 +1,8 @@
+create table keys (
+	id text not null primary key,
+	created_at datetime not null,
+	updated_at datetime null,
+	owner_id text not null,
+	key_type int not null,
+	data blob not null
+);
@@ -0,0 +1 @@
+alter table keys drop column retired_at;
@@ -0,0 +1 @@
+alter table keys add column retired_at datetime null;
@@ -0,0 +1,10 @@
+create table keystore (
+	id int not null primary key,
+	created_at datetime not null,
+	kdf text not null,
+	salt blob not null,
+	time int not null,
+	memory int not null,
+	threads int not null,
+	check_value blob not null
+);
@@ -1,7 +1,11 @@
 package identity
 
 import (
+	"crypto"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
+	"strings"
 	"time"
 )
 
@@ -15,6 +19,20 @@ type Identity struct {
 	IsPrimary       bool              `db:"is_primary"`
 	Keys            []*KeyItem        `db:"-"`
 	Certificate     *x509.Certificate `db:"-"`
+	// KeySigner signs with a key held outside the process, overriding the
+	// identity's keys
+	KeySigner crypto.Signer `db:"-"`
+}
+
+// Fingerprint is the SHA-256 hash of the identity's certificate, in colon
+// separated hex, so people can check they have the same identity
+func (i *Identity) Fingerprint() string {
+	sum := sha256.Sum256(i.CertificateData)
+	pairs := make([]string, len(sum))
+	for n, b := range sum {
+		pairs[n] = hex.EncodeToString([]byte{b})
+	}
+	return strings.ToUpper(strings.Join(pairs, ":"))
 }
 
 type KeyType int
@@ -25,8 +43,14 @@ const (
 	KeyTypeECDSAPrivateKey
 	KeyTypeED25519PublicKey
 	KeyTypeED25519PrivateKey
+	// KeyTypeSignerURI locates a private key held outside the process
+	KeyTypeSignerURI
 )
 
+func (t KeyType) IsPrivate() bool {
+	return t == KeyTypeECDSAPrivateKey || t == KeyTypeED25519PrivateKey
+}
+
 type KeyItem struct {
 	ID        string     `db:"id"`
 	CreatedAt time.Time  `db:"created_at"`
@@ -34,8 +58,33 @@ type KeyItem struct {
 	OwnerID   string     `db:"owner_id"`
 	Type      KeyType    `db:"key_type"`
 	Data      []byte     `db:"data"`
+	RetiredAt *time.Time `db:"retired_at"`
+}
+
+// Rotation records the replacement of an identity's key pair. It is signed with
+// the previous key so peers which trust the old certificate can trust the new
+// one.
+type Rotation struct {
+	Identifier          string
+	RotatedAt           time.Time
+	PreviousCertificate []byte
+	Certificate         []byte
+	Signature           string
+	// Previous is the identity as it was before the rotation. The rotation
+	// must be published with the old key as peers don't know the new one yet.
+	Previous *Identity
 }
 
 func (i Identity) Sign(string) (string, error) {
 	return "", nil
 }
+
+// Revocation withdraws an identity. It is signed with the identity's own key
+// so that only the holder can revoke it.
+type Revocation struct {
+	Identifier  string
+	RevokedAt   time.Time
+	Reason      string
+	Certificate []byte
+	Signature   string
+}
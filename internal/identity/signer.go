@@ -0,0 +1,295 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package identity
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// External signers keep the private key out of the process. They are located
+// by a URI whose scheme selects the backend:
+//
+//	ssh-agent:               the agent at $SSH_AUTH_SOCK
+//	ssh-agent:/path/to/sock  a specific agent, e.g. yubikey-agent for a PIV key
+//	https://kms/keys/abc     a remote signing service, only over https
+//
+// Other backends (PKCS#11, cloud KMS APIs etc) can be added with
+// RegisterSignerBackend.
+
+const signerTimeout = 30 * time.Second
+
+var (
+	ErrUnknownSignerBackend = errors.New("unknown signer backend")
+	ErrSignerKeyNotFound    = errors.New("signer doesn't hold the key")
+	ErrInsecureSigner       = errors.New("remote signers must use https")
+)
+
+// SignerBackend opens a signer at a backend specific location. If publicKey
+// is nil the backend picks a key, otherwise it must use the matching one.
+type SignerBackend func(ctx context.Context, location string, publicKey ed25519.PublicKey) (crypto.Signer, error)
+
+var (
+	signerBackendsMu sync.RWMutex
+	signerBackends   = map[string]SignerBackend{
+		"ssh-agent": sshAgentBackend,
+		"https":     remoteSignerBackend,
+	}
+)
+
+// RegisterSignerBackend adds a backend for URIs with the given scheme
+func RegisterSignerBackend(scheme string, backend SignerBackend) {
+	signerBackendsMu.Lock()
+	defer signerBackendsMu.Unlock()
+	signerBackends[scheme] = backend
+}
+
+// OpenSigner returns a signer for the key at the URI
+func OpenSigner(ctx context.Context, uri string, publicKey ed25519.PublicKey) (crypto.Signer, error) {
+	scheme, location, ok := strings.Cut(uri, ":")
+	if !ok {
+		return nil, fmt.Errorf("signer %s: %w", uri, ErrUnknownSignerBackend)
+	}
+
+	// messages sent to a remote signer are signed as the identity, so
+	// they must not be open to tampering on the way
+	if scheme == "http" {
+		return nil, fmt.Errorf("signer %s: %w", uri, ErrInsecureSigner)
+	}
+
+	signerBackendsMu.RLock()
+	backend, ok := signerBackends[scheme]
+	signerBackendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("signer %s: %w", scheme, ErrUnknownSignerBackend)
+	}
+
+	// remote signers need the whole URL
+	if scheme == "https" {
+		location = uri
+	}
+
+	return backend(ctx, location, publicKey)
+}
+
+type sshAgentSigner struct {
+	socket    string
+	publicKey ed25519.PublicKey
+	sshKey    ssh.PublicKey
+}
+
+func sshAgentBackend(ctx context.Context, socket string, publicKey ed25519.PublicKey) (crypto.Signer, error) {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket == "" {
+		return nil, fmt.Errorf("no ssh agent: SSH_AUTH_SOCK not set")
+	}
+
+	s := &sshAgentSigner{socket: socket}
+	err := s.withAgent(func(a agent.ExtendedAgent) error {
+		keys, err := a.List()
+		if err != nil {
+			return fmt.Errorf("listing agent keys: %w", err)
+		}
+
+		for _, key := range keys {
+			if key.Type() != ssh.KeyAlgoED25519 {
+				continue
+			}
+
+			sshKey, err := ssh.ParsePublicKey(key.Marshal())
+			if err != nil {
+				continue
+			}
+
+			cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+			if !ok {
+				continue
+			}
+
+			edKey, ok := cryptoKey.CryptoPublicKey().(ed25519.PublicKey)
+			if !ok || (publicKey != nil && !publicKey.Equal(edKey)) {
+				continue
+			}
+
+			s.publicKey = edKey
+			s.sshKey = sshKey
+			return nil
+		}
+
+		return ErrSignerKeyNotFound
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// withAgent connects to the agent for each operation so a restarted agent
+// doesn't break signing
+func (s *sshAgentSigner) withAgent(fn func(a agent.ExtendedAgent) error) error {
+	conn, err := net.DialTimeout("unix", s.socket, signerTimeout)
+	if err != nil {
+		return fmt.Errorf("connecting to ssh agent: %w", err)
+	}
+	defer conn.Close()
+
+	return fn(agent.NewClient(conn))
+}
+
+func (s *sshAgentSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs the message with the agent. ed25519 ssh signatures are plain
+// ed25519 signatures of the data.
+func (s *sshAgentSigner) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("ed25519 can't sign prehashed messages")
+	}
+
+	var sig *ssh.Signature
+	err := s.withAgent(func(a agent.ExtendedAgent) error {
+		var err error
+		sig, err = a.Sign(s.sshKey, message)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("signing with ssh agent: %w", err)
+	}
+
+	if sig.Format != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("unexpected signature format: %s", sig.Format)
+	}
+
+	return sig.Blob, nil
+}
+
+// remoteSignerTransport carries requests to remote signers
+var remoteSignerTransport http.RoundTripper = http.DefaultTransport
+
+// remoteSigner calls a signing service. GET on the URL returns
+// {"public_key": base64}, POST {"message": base64} returns
+// {"signature": base64}.
+type remoteSigner struct {
+	url       string
+	client    *http.Client
+	publicKey ed25519.PublicKey
+}
+
+func remoteSignerBackend(ctx context.Context, url string, publicKey ed25519.PublicKey) (crypto.Signer, error) {
+	s := &remoteSigner{
+		url:    url,
+		client: &http.Client{Timeout: signerTimeout, Transport: remoteSignerTransport},
+	}
+
+	resp := struct {
+		PublicKey []byte `json:"public_key"`
+	}{}
+	err := s.do(ctx, "GET", nil, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("fetching public key: %w", err)
+	}
+
+	if len(resp.PublicKey) != ed25519.PublicKeySize {
+		return nil, ErrUnsupportedPublicKey
+	}
+
+	s.publicKey = resp.PublicKey
+	if publicKey != nil && !publicKey.Equal(s.publicKey) {
+		return nil, ErrSignerKeyNotFound
+	}
+
+	return s, nil
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+func (s *remoteSigner) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("ed25519 can't sign prehashed messages")
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), signerTimeout)
+	defer cancelFn()
+
+	req := struct {
+		Message []byte `json:"message"`
+	}{message}
+	resp := struct {
+		Signature []byte `json:"signature"`
+	}{}
+	err := s.do(ctx, "POST", &req, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("signing with remote signer: %w", err)
+	}
+
+	// don't trust the service to have used the right key
+	if !ed25519.Verify(s.publicKey, message, resp.Signature) {
+		return nil, ErrSignerMismatch
+	}
+
+	return resp.Signature, nil
+}
+
+func (s *remoteSigner) do(ctx context.Context, method string, body, out any) error {
+	var rdr io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rdr = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.url, rdr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad response: %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
@@ -0,0 +1,178 @@
+package identity
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSSHAgentSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(err)
+
+	keyring := agent.NewKeyring()
+	assert.NoError(keyring.Add(agent.AddedKey{PrivateKey: privateKey}))
+
+	socket := path.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	assert.NoError(err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	store, err := NewStore("file:sshagent.db?mode=memory&cache=shared")
+	assert.NoError(err)
+
+	svc, err := NewService(store)
+	assert.NoError(err)
+
+	id, err := svc.CreateIdentityWithSigner("test user", "", true, "ssh-agent:"+socket)
+	assert.NoError(err)
+	assert.True(privateKey.Public().(ed25519.PublicKey).Equal(id.Certificate.PublicKey))
+
+	// the private key never reaches the store so the agent is used again
+	stored, err := store.GetPrimaryIdentity()
+	assert.NoError(err)
+	for _, key := range stored.Keys {
+		assert.NotEqual(KeyTypeED25519PrivateKey, key.Type)
+	}
+
+	signer, err := NewSigner(stored)
+	assert.NoError(err)
+	signer.Add([]byte("data"))
+	sig, err := signer.Sign()
+	assert.NoError(err)
+
+	v, err := NewVerifier(id.Certificate)
+	assert.NoError(err)
+	v.Add([]byte("data"))
+	assert.NoError(v.Verify(sig))
+
+	keyring.RemoveAll()
+	_, err = NewSigner(stored)
+	assert.ErrorIs(err, ErrSignerKeyNotFound)
+}
+
+func TestRemoteSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, publicKeys := newRemoteSigner(t)
+
+	key, err := OpenSigner(context.Background(), srv.URL+"/keys/1", publicKeys["1"])
+	assert.NoError(err)
+
+	id := &Identity{KeySigner: key}
+	signer, err := NewSigner(id)
+	assert.NoError(err)
+	signer.Add([]byte("data"))
+	_, err = signer.Sign()
+	assert.NoError(err)
+
+	_, err = OpenSigner(context.Background(), "http"+strings.TrimPrefix(srv.URL, "https")+"/keys/1", publicKeys["1"])
+	assert.ErrorIs(err, ErrInsecureSigner)
+
+	_, err = OpenSigner(context.Background(), "pkcs11:token", nil)
+	assert.ErrorIs(err, ErrUnknownSignerBackend)
+}
+
+func TestRotateKeysWithSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore("file:signerrotation.db?mode=memory&cache=shared")
+	assert.NoError(err)
+
+	svc, err := NewService(store)
+	assert.NoError(err)
+
+	srv, publicKeys := newRemoteSigner(t)
+
+	id, err := svc.CreateIdentityWithSigner("test user", "", true, srv.URL+"/keys/1")
+	assert.NoError(err)
+
+	// rotating mustn't bring the private key into the process
+	_, err = svc.RotateKeys(id)
+	assert.ErrorIs(err, ErrExternalSigner)
+
+	_, err = svc.RotateKeysWithSigner(id, srv.URL+"/keys/1")
+	assert.ErrorIs(err, ErrKeyNotRotated)
+
+	rotation, err := svc.RotateKeysWithSigner(id, srv.URL+"/keys/2")
+	assert.NoError(err)
+	assert.True(publicKeys["2"].Equal(id.Certificate.PublicKey))
+
+	_, err = VerifyRotation(rotation)
+	assert.NoError(err)
+
+	stored, err := store.GetPrimaryIdentity()
+	assert.NoError(err)
+	for _, key := range stored.Keys {
+		assert.NotEqual(KeyTypeED25519PrivateKey, key.Type)
+	}
+
+	signer, err := NewSigner(stored)
+	assert.NoError(err)
+	signer.Add([]byte("data"))
+	sig, err := signer.Sign()
+	assert.NoError(err)
+
+	v, err := NewVerifier(id.Certificate)
+	assert.NoError(err)
+	v.Add([]byte("data"))
+	assert.NoError(v.Verify(sig))
+}
+
+// newRemoteSigner serves new keys at /keys/1 and /keys/2 over https,
+// trusted by remote signers until the test ends
+func newRemoteSigner(t *testing.T) (*httptest.Server, map[string]ed25519.PublicKey) {
+	publicKeys := map[string]ed25519.PublicKey{}
+	privateKeys := map[string]ed25519.PrivateKey{}
+	for _, name := range []string{"1", "2"} {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		publicKeys[name], privateKeys[name] = publicKey, privateKey
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys/{name}", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]byte{"public_key": publicKeys[r.PathValue("name")]})
+	})
+	mux.HandleFunc("POST /keys/{name}", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Message []byte `json:"message"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string][]byte{"signature": ed25519.Sign(privateKeys[r.PathValue("name")], req.Message)})
+	})
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	transport := remoteSignerTransport
+	remoteSignerTransport = srv.Client().Transport
+	t.Cleanup(func() { remoteSignerTransport = transport })
+
+	return srv, publicKeys
+}
@@ -3,93 +3,146 @@ package identity
 import (
 	"context"
 	"database/sql"
+	"embed"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/sqlite3"
 	"github.com/jdudmesh/propolis/internal/model"
-	"github.com/jdudmesh/propolis/pkg/migrate/v4/source/reflect"
+	"github.com/jdudmesh/propolis/internal/secrets"
 
+	"github.com/jdudmesh/propolis/internal/migration"
 	"github.com/jmoiron/sqlx"
 )
 
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migrations are the versions of the identity database schema
+var Migrations = migration.New("identity", migrationFiles, "migrations")
+
 const defaultTimeout = 10 * time.Second
 
 type store struct {
-	db *sqlx.DB
+	db     *sqlx.DB
+	sealer secrets.Sealer
+	mu     sync.Mutex
+	// keystore wraps private keys when a passphrase is set, nil while locked
+	keystore secrets.Sealer
+	unlocker secrets.PassphraseProvider
 }
 
+// NewStore opens the identity store. Key material and certificates are
+// encrypted if a key is set in the PROPOLIS_DB_KEY environment variable.
 func NewStore(databaseURL string) (*store, error) {
+	sealer, err := secrets.FromProvider(context.Background(), secrets.EnvKeyProvider(secrets.EnvKey))
+	if err != nil {
+		return nil, fmt.Errorf("creating sealer: %w", err)
+	}
+	return NewStoreWithSealer(databaseURL, sealer)
+}
+
+func NewStoreWithSealer(databaseURL string, sealer secrets.Sealer) (*store, error) {
 	db, err := sqlx.Connect("sqlite3", databaseURL)
 	if err != nil {
 		return nil, fmt.Errorf("connecting to database: %w", err)
 	}
 
-	err = createSchema(db)
+	err = Migrations.Up(db.DB)
 	if err != nil {
 		return nil, fmt.Errorf("creating schema: %w", err)
 	}
 
 	s := &store{
-		db: db,
+		db:     db,
+		sealer: sealer,
 	}
 
 	return s, nil
 }
 
-func createSchema(db *sqlx.DB) error {
-	driver, err := sqlite3.WithInstance(db.DB, &sqlite3.Config{})
+func (s *store) GetPrimaryIdentity() (*Identity, error) {
+	return s.getIdentity("select * from identity where is_primary = 1;")
+}
+
+func (s *store) GetIdentity(identifier string) (*Identity, error) {
+	return s.getIdentity("select * from identity where id = ?;", identifier)
+}
+
+// ListIdentities returns every local identity, primary first, without their
+// keys
+func (s *store) ListIdentities() ([]*Identity, error) {
+	ids := []*Identity{}
+	err := s.db.Select(&ids, "select * from identity order by is_primary desc, created_at;")
 	if err != nil {
-		return fmt.Errorf("creating driver: %w", err)
+		return nil, fmt.Errorf("listing identities: %w", err)
 	}
 
-	schema := &struct {
-		Identity_up string
-		KeyStore_up string
-	}{
-		Identity_up: `create table identity (
-			id text not null primary key,
-			created_at datetime not null,
-			updated_at datetime null,
-			handle text not null,
-			bio text not null default '',
-			is_primary int not null default 0,
-			certificate blob not null
-		);`,
+	for _, id := range ids {
+		id.CertificateData, err = s.sealer.Open(id.CertificateData)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting certificate: %w", err)
+		}
+	}
+
+	return ids, nil
+}
+
+// SetPrimaryIdentity makes the identity the primary identity
+func (s *store) SetPrimaryIdentity(identifier string) error {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("set primary (begin): %w", err)
+	}
 
-		KeyStore_up: `create table keys (
-			id text not null primary key,
-			created_at datetime not null,
-			updated_at datetime null,
-			owner_id text not null,
-			key_type int not null,
-			data blob not null
-		);`,
+	_, err = tx.ExecContext(ctx, `update identity set is_primary = 0 where is_primary = 1 and id != ?`, identifier)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("set primary (clear primary): %w", err)
 	}
 
-	source, err := reflect.New(schema)
+	res, err := tx.ExecContext(ctx, `update identity set is_primary = 1, updated_at = ? where id = ?`, time.Now().UTC(), identifier)
 	if err != nil {
-		return fmt.Errorf("creating migration source driver: %w", err)
+		tx.Rollback()
+		return fmt.Errorf("set primary (update identity): %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		return model.ErrNotFound
 	}
 
-	m, err := migrate.NewWithInstance("reflect", source, "sqlite3", driver)
+	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("creating migration: %w", err)
+		return fmt.Errorf("set primary (commit): %w", err)
 	}
 
-	err = m.Up()
-	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
-		return err
+	return nil
+}
+
+// UpdateProfile changes an identity's handle and bio
+func (s *store) UpdateProfile(identifier, handle, bio string, updatedAt time.Time) error {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	res, err := s.db.ExecContext(ctx, `update identity set handle = ?, bio = ?, updated_at = ? where id = ?`,
+		handle, bio, updatedAt, identifier)
+	if err != nil {
+		return fmt.Errorf("update profile: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return model.ErrNotFound
 	}
 
 	return nil
 }
 
-func (s *store) GetPrimaryIdentity() (*Identity, error) {
+func (s *store) getIdentity(query string, args ...any) (*Identity, error) {
 	id := &Identity{}
-	err := s.db.Get(id, "select * from identity where is_primary = 1;")
+	err := s.db.Get(id, query, args...)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, model.ErrNotFound
@@ -97,12 +150,24 @@ func (s *store) GetPrimaryIdentity() (*Identity, error) {
 		return nil, fmt.Errorf("fetching identity: %w", err)
 	}
 
+	id.CertificateData, err = s.sealer.Open(id.CertificateData)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting certificate: %w", err)
+	}
+
 	id.Keys = []*KeyItem{}
-	err = s.db.Select(&id.Keys, "select * from keys where owner_id = ?", id.Identifier)
+	err = s.db.Select(&id.Keys, "select * from keys where owner_id = ? and retired_at is null", id.Identifier)
 	if err != nil {
 		return nil, fmt.Errorf("fetching keys: %w", err)
 	}
 
+	for _, key := range id.Keys {
+		key.Data, err = s.openKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting key: %w", err)
+		}
+	}
+
 	return id, nil
 }
 
@@ -110,15 +175,31 @@ func (s *store) PutIdentity(id *Identity) error {
 	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
 	defer cancelFn()
 
+	// seal copies so the caller's identity is left untouched
+	sealed := *id
+	var err error
+	sealed.CertificateData, err = s.sealer.Seal(id.CertificateData)
+	if err != nil {
+		return fmt.Errorf("put identity (sealing certificate): %w", err)
+	}
+
 	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("put identity (begin): %w", err)
 	}
 
+	if id.IsPrimary {
+		_, err = tx.ExecContext(ctx, `update identity set is_primary = 0 where is_primary = 1`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("put identity (clear primary): %w", err)
+		}
+	}
+
 	_, err = tx.NamedExecContext(ctx, `
 		insert into identity (id, created_at, updated_at, handle, bio, is_primary, certificate)
 		values (:id, :created_at, :updated_at, :handle, :bio, :is_primary, :certificate);
-	`, id)
+	`, &sealed)
 	if err != nil {
 		err2 := tx.Rollback()
 		if err2 != nil {
@@ -128,10 +209,17 @@ func (s *store) PutIdentity(id *Identity) error {
 	}
 
 	for _, key := range id.Keys {
+		sealedKey := *key
+		sealedKey.Data, err = s.sealKey(key)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("put identity (sealing key): %w", err)
+		}
+
 		_, err = tx.NamedExecContext(ctx, `
 			insert into keys (id, created_at, updated_at, owner_id, key_type, data)
 			values (:id, :created_at, :updated_at, :owner_id, :key_type, :data);
-		`, key)
+		`, &sealedKey)
 		if err != nil {
 			err2 := tx.Rollback()
 			if err2 != nil {
@@ -148,3 +236,59 @@ func (s *store) PutIdentity(id *Identity) error {
 
 	return nil
 }
+
+// RotateKeys replaces the identity's certificate, retires its current keys and
+// stores the new ones
+func (s *store) RotateKeys(id *Identity, retiredAt time.Time) error {
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancelFn()
+
+	certData, err := s.sealer.Seal(id.CertificateData)
+	if err != nil {
+		return fmt.Errorf("rotate keys (sealing certificate): %w", err)
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("rotate keys (begin): %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `update identity set certificate = ?, updated_at = ? where id = ?`,
+		certData, retiredAt, id.Identifier)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("rotate keys (update identity): %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `update keys set retired_at = ?, updated_at = ? where owner_id = ? and retired_at is null`,
+		retiredAt, retiredAt, id.Identifier)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("rotate keys (retire keys): %w", err)
+	}
+
+	for _, key := range id.Keys {
+		sealedKey := *key
+		sealedKey.Data, err = s.sealKey(key)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("rotate keys (sealing key): %w", err)
+		}
+
+		_, err = tx.NamedExecContext(ctx, `
+			insert into keys (id, created_at, updated_at, owner_id, key_type, data)
+			values (:id, :created_at, :updated_at, :owner_id, :key_type, :data);
+		`, &sealedKey)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("rotate keys (insert key): %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("rotate keys (commit): %w", err)
+	}
+
+	return nil
+}
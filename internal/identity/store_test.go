@@ -3,6 +3,8 @@ package identity
 import (
 	"testing"
 
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/jdudmesh/propolis/internal/secrets"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,3 +16,74 @@ func TestStore(t *testing.T) {
 	assert.NoError(err)
 	assert.NotNil(store)
 }
+
+func TestStoreEncrypted(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := secrets.GenerateKey()
+	assert.NoError(err)
+	t.Setenv(secrets.EnvKey, key)
+
+	store, err := NewStore("file::encrypted.db?mode=memory&cache=shared")
+	assert.NoError(err)
+
+	svc, err := NewService(store)
+	assert.NoError(err)
+
+	id, err := svc.CreateIdentity("test user", "", true)
+	assert.NoError(err)
+
+	var raw []byte
+	err = store.db.Get(&raw, "select data from keys where owner_id = ?", id.Identifier)
+	assert.NoError(err)
+	assert.NotEqual(id.Keys[0].Data, raw)
+
+	id2, err := store.GetPrimaryIdentity()
+	assert.NoError(err)
+	assert.Equal(id.Keys[0].Data, id2.Keys[0].Data)
+	assert.Equal(id.CertificateData, id2.CertificateData)
+}
+
+func TestSetPrimaryIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore("file:primary.db?mode=memory&cache=shared")
+	assert.NoError(err)
+
+	svc, err := NewService(store)
+	assert.NoError(err)
+
+	first, err := svc.CreateIdentity("first", "", true)
+	assert.NoError(err)
+	second, err := svc.CreateIdentity("second", "", false)
+	assert.NoError(err)
+
+	ids, err := svc.ListIdentities()
+	assert.NoError(err)
+	assert.Len(ids, 2)
+	assert.Equal(first.Identifier, ids[0].Identifier)
+	assert.True(ids[0].IsPrimary)
+	assert.Equal(first.CertificateData, ids[0].CertificateData)
+	assert.Equal(first.Fingerprint(), ids[0].Fingerprint())
+	assert.NotEqual(first.Fingerprint(), second.Fingerprint())
+	assert.Len(first.Fingerprint(), 95)
+
+	err = svc.SetPrimaryIdentity(second.Identifier)
+	assert.NoError(err)
+
+	primary, err := svc.GetPrimaryIdentity()
+	assert.NoError(err)
+	assert.Equal(second.Identifier, primary.Identifier)
+
+	ids, err = svc.ListIdentities()
+	assert.NoError(err)
+	assert.Equal(second.Identifier, ids[0].Identifier)
+	assert.False(ids[1].IsPrimary)
+
+	err = svc.SetPrimaryIdentity("missing")
+	assert.ErrorIs(err, model.ErrNotFound)
+
+	primary, err = svc.GetPrimaryIdentity()
+	assert.NoError(err)
+	assert.Equal(second.Identifier, primary.Identifier)
+}
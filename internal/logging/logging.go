@@ -0,0 +1,288 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Modules are the subsystems whose log levels can be set separately
+const (
+	ModuleNode     = "node"
+	ModuleExecutor = "executor"
+	ModuleAST      = "ast"
+	ModuleIdentity = "identity"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var Modules = []string{ModuleNode, ModuleExecutor, ModuleAST, ModuleIdentity}
+
+var ErrUnknownModule = errors.New("unknown log module")
+
+// Loggers hands out a logger for each module. Records are filtered by the
+// module's level, or the default level if it hasn't got one, and passed to a
+// shared handler which can be replaced while the loggers are in use. The
+// handler's own level still applies so it should pass every level.
+type Loggers struct {
+	handler      atomic.Pointer[handlerRef]
+	defaultLevel slog.LevelVar
+	mu           sync.Mutex
+	levels       map[string]*moduleLevel
+}
+
+type handlerRef struct {
+	handler    slog.Handler
+	generation uint64
+}
+
+type moduleLevel struct {
+	level slog.LevelVar
+	set   atomic.Bool
+}
+
+func New(handler slog.Handler, level slog.Level) *Loggers {
+	l := &Loggers{
+		levels: map[string]*moduleLevel{},
+	}
+	for _, module := range Modules {
+		l.levels[module] = &moduleLevel{}
+	}
+	l.handler.Store(&handlerRef{handler: handler})
+	l.defaultLevel.Set(level)
+	return l
+}
+
+// NewHandler creates a text or JSON handler writing to w which passes every
+// level, leaving the filtering to Loggers
+func NewHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}
+	switch format {
+	case "", FormatText:
+		return slog.NewTextHandler(w, opts), nil
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, use %s or %s", format, FormatText, FormatJSON)
+	}
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return level, fmt.Errorf("%q should be debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// SetHandler sends the records of every logger to a new handler
+func (l *Loggers) SetHandler(handler slog.Handler) {
+	for {
+		current := l.handler.Load()
+		next := &handlerRef{handler: handler, generation: current.generation + 1}
+		if l.handler.CompareAndSwap(current, next) {
+			return
+		}
+	}
+}
+
+// Logger returns the logger for a module, which adds the module to every
+// record. The empty module uses the default level and adds nothing.
+func (l *Loggers) Logger(module string) *slog.Logger {
+	h := &moduleHandler{loggers: l}
+	if module != "" {
+		h.level = l.moduleLevel(module)
+		h.ops = []func(slog.Handler) slog.Handler{
+			func(next slog.Handler) slog.Handler {
+				return next.WithAttrs([]slog.Attr{slog.String("module", module)})
+			},
+		}
+	}
+	return slog.New(h)
+}
+
+// Level returns the default level, so that Loggers can be used as the level
+// of other handlers
+func (l *Loggers) Level() slog.Level {
+	return l.defaultLevel.Level()
+}
+
+func (l *Loggers) SetDefaultLevel(level slog.Level) {
+	l.defaultLevel.Set(level)
+}
+
+// SetLevel gives a module its own level
+func (l *Loggers) SetLevel(module string, level slog.Level) error {
+	m, ok := l.knownModule(module)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownModule, module)
+	}
+	m.level.Set(level)
+	m.set.Store(true)
+	return nil
+}
+
+// ResetLevel puts a module back on the default level
+func (l *Loggers) ResetLevel(module string) error {
+	m, ok := l.knownModule(module)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownModule, module)
+	}
+	m.set.Store(false)
+	return nil
+}
+
+// ApplyLevels replaces the module levels with those in a config, a map of
+// module to level name. Modules not in the map use the default level.
+func (l *Loggers) ApplyLevels(levels map[string]string) error {
+	parsed := map[string]slog.Level{}
+	for module, s := range levels {
+		if _, ok := l.knownModule(module); !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownModule, module)
+		}
+		level, err := ParseLevel(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", module, err)
+		}
+		parsed[module] = level
+	}
+
+	for _, module := range Modules {
+		level, ok := parsed[module]
+		if !ok {
+			l.ResetLevel(module)
+			continue
+		}
+		l.SetLevel(module, level)
+	}
+	return nil
+}
+
+// Levels returns the modules which have their own level
+func (l *Loggers) Levels() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	levels := map[string]string{}
+	for module, m := range l.levels {
+		if m.set.Load() {
+			levels[module] = m.level.Level().String()
+		}
+	}
+	return levels
+}
+
+func (l *Loggers) knownModule(module string) (*moduleLevel, bool) {
+	if !slices.Contains(Modules, module) {
+		return nil, false
+	}
+	return l.moduleLevel(module), true
+}
+
+// moduleLevel returns the level of a module, adding one for modules which
+// aren't in Modules so that packages can log under their own names
+func (l *Loggers) moduleLevel(module string) *moduleLevel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m, ok := l.levels[module]
+	if !ok {
+		m = &moduleLevel{}
+		l.levels[module] = m
+	}
+	return m
+}
+
+func (l *Loggers) enabled(m *moduleLevel, level slog.Level) bool {
+	if m != nil && m.set.Load() {
+		return level >= m.level.Level()
+	}
+	return level >= l.defaultLevel.Level()
+}
+
+// moduleHandler filters records by its module's level. The attributes and
+// groups added to it are replayed onto the shared handler whenever that
+// changes.
+type moduleHandler struct {
+	loggers *Loggers
+	level   *moduleLevel
+	ops     []func(slog.Handler) slog.Handler
+	cache   atomic.Pointer[handlerRef]
+}
+
+func (h *moduleHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.loggers.enabled(h.level, level) && h.current().Enabled(ctx, level)
+}
+
+func (h *moduleHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.current().Handle(ctx, r)
+}
+
+func (h *moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	return h.with(func(next slog.Handler) slog.Handler {
+		return next.WithAttrs(attrs)
+	})
+}
+
+func (h *moduleHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.with(func(next slog.Handler) slog.Handler {
+		return next.WithGroup(name)
+	})
+}
+
+func (h *moduleHandler) with(op func(slog.Handler) slog.Handler) *moduleHandler {
+	return &moduleHandler{
+		loggers: h.loggers,
+		level:   h.level,
+		ops:     append(slices.Clip(h.ops), op),
+	}
+}
+
+func (h *moduleHandler) current() slog.Handler {
+	shared := h.loggers.handler.Load()
+	cached := h.cache.Load()
+	if cached != nil && cached.generation == shared.generation {
+		return cached.handler
+	}
+
+	next := shared.handler
+	for _, op := range h.ops {
+		next = op(next)
+	}
+	h.cache.Store(&handlerRef{handler: next, generation: shared.generation})
+	return next
+}
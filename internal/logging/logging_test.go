@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModuleLevels(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := &bytes.Buffer{}
+	handler, err := NewHandler(buf, FormatText)
+	assert.NoError(err)
+
+	loggers := New(handler, slog.LevelInfo)
+	node := loggers.Logger(ModuleNode).With("peer", "a")
+	executor := loggers.Logger(ModuleExecutor)
+
+	node.Debug("hidden")
+	assert.Empty(buf.String())
+
+	assert.NoError(loggers.SetLevel(ModuleNode, slog.LevelDebug))
+	node.Debug("shown")
+	executor.Debug("hidden")
+	assert.Contains(buf.String(), "msg=shown module=node peer=a")
+	assert.NotContains(buf.String(), "hidden")
+	assert.Equal(map[string]string{ModuleNode: "DEBUG"}, loggers.Levels())
+
+	assert.NoError(loggers.ResetLevel(ModuleNode))
+	node.Debug("hidden")
+	assert.NotContains(buf.String(), "hidden")
+
+	assert.ErrorIs(loggers.SetLevel("gossip", slog.LevelDebug), ErrUnknownModule)
+	assert.Error(loggers.ApplyLevels(map[string]string{ModuleAST: "loud"}))
+	assert.NoError(loggers.ApplyLevels(map[string]string{ModuleExecutor: "error"}))
+	assert.Equal(map[string]string{ModuleExecutor: "ERROR"}, loggers.Levels())
+}
+
+func TestSetHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	first := &bytes.Buffer{}
+	handler, err := NewHandler(first, FormatText)
+	assert.NoError(err)
+
+	loggers := New(handler, slog.LevelInfo)
+	logger := loggers.Logger(ModuleIdentity).WithGroup("g").With("a", 1)
+	logger.Info("before")
+
+	second := &bytes.Buffer{}
+	handler, err = NewHandler(second, FormatJSON)
+	assert.NoError(err)
+	loggers.SetHandler(handler)
+	logger.Info("after")
+
+	assert.Contains(first.String(), "msg=before module=identity g.a=1")
+	assert.Contains(second.String(), `"msg":"after","module":"identity","g":{"a":1}`)
+
+	_, err = NewHandler(second, "xml")
+	assert.Error(err)
+}
@@ -0,0 +1,220 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+// Package migration versions the schemas of the node, graph and identity
+// databases. Each database has a directory of numbered migrations,
+// <version>_<title>.up.sql and <version>_<title>.down.sql, which are applied
+// when it is opened so the schema is always the latest the binary knows.
+// Databases whose schema is newer, or which a failed migration left part way,
+// are refused rather than used. Going back to an older binary means migrating
+// down with the newer one first, e.g. with propolis migrate down.
+package migration
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+var (
+	// ErrTooNew is returned for a database migrated by a later version
+	ErrTooNew = errors.New("schema is newer than this version supports, migrate it down with the version which upgraded it")
+	// ErrDirty is returned for a database a failed migration left part way
+	ErrDirty = errors.New("a migration failed part way, repair the schema then force the version")
+	// ErrUnknownVersion is returned when migrating to a version there are no
+	// migrations for
+	ErrUnknownVersion = errors.New("unknown schema version")
+)
+
+// Migrations are the schema versions of one kind of database
+type Migrations struct {
+	name  string
+	files fs.FS
+	dir   string
+}
+
+// New returns the migrations in dir of files, named name in errors
+func New(name string, files fs.FS, dir string) *Migrations {
+	return &Migrations{
+		name:  name,
+		files: files,
+		dir:   dir,
+	}
+}
+
+// Name is the kind of database the migrations are for
+func (m *Migrations) Name() string {
+	return m.name
+}
+
+// Status is the version of a database's schema
+type Status struct {
+	// Version is the last migration applied, 0 for none
+	Version uint `json:"version"`
+	// Latest is the last migration there is
+	Latest uint `json:"latest"`
+	// Dirty is set when the last migration failed part way
+	Dirty bool `json:"dirty"`
+}
+
+// check refuses a schema the migrations can't move on from
+func (s *Status) check() error {
+	switch {
+	case s.Dirty:
+		return fmt.Errorf("%w: version %d", ErrDirty, s.Version)
+	case s.Version > s.Latest:
+		return fmt.Errorf("%w: version %d, latest %d", ErrTooNew, s.Version, s.Latest)
+	}
+	return nil
+}
+
+// Latest is the version of the last migration
+func (m *Migrations) Latest() (uint, error) {
+	files, err := iofs.New(m.files, m.dir)
+	if err != nil {
+		return 0, fmt.Errorf("reading %s migrations: %w", m.name, err)
+	}
+	return latest(files)
+}
+
+func latest(files source.Driver) (uint, error) {
+	version, err := files.First()
+	if err != nil {
+		return 0, fmt.Errorf("reading first migration: %w", err)
+	}
+	for {
+		next, err := files.Next(version)
+		if errors.Is(err, os.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reading migration after %d: %w", version, err)
+		}
+		version = next
+	}
+}
+
+// open prepares to migrate db. The migrate instance isn't closed as that
+// would close db.
+func (m *Migrations) open(db *sql.DB) (*migrate.Migrate, *Status, error) {
+	files, err := iofs.New(m.files, m.dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading %s migrations: %w", m.name, err)
+	}
+	latest, err := latest(files)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading %s migrations: %w", m.name, err)
+	}
+
+	driver, err := sqlite3.WithInstance(db, &sqlite3.Config{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating driver: %w", err)
+	}
+	migrator, err := migrate.NewWithInstance("iofs", files, "sqlite3", driver)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating migration: %w", err)
+	}
+
+	status := &Status{Latest: latest}
+	version, dirty, err := migrator.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return nil, nil, fmt.Errorf("reading %s schema version: %w", m.name, err)
+	}
+	status.Version = version
+	status.Dirty = dirty
+
+	return migrator, status, nil
+}
+
+// Status reads the version of db's schema
+func (m *Migrations) Status(db *sql.DB) (*Status, error) {
+	_, status, err := m.open(db)
+	return status, err
+}
+
+// Up migrates db to the latest version, unless its schema is newer or dirty.
+// It is run whenever a database is opened.
+func (m *Migrations) Up(db *sql.DB) error {
+	migrator, status, err := m.open(db)
+	if err != nil {
+		return err
+	}
+	err = status.check()
+	if err != nil {
+		return fmt.Errorf("%s database: %w", m.name, err)
+	}
+
+	err = migrator.Up()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("migrating %s database: %w", m.name, err)
+	}
+	return nil
+}
+
+// Migrate moves db up or down to version, 0 undoing every migration
+func (m *Migrations) Migrate(db *sql.DB, version uint) error {
+	migrator, status, err := m.open(db)
+	if err != nil {
+		return err
+	}
+	err = status.check()
+	if err != nil {
+		return fmt.Errorf("%s database: %w", m.name, err)
+	}
+	if version > status.Latest {
+		return fmt.Errorf("%w: %d, the latest %s version is %d", ErrUnknownVersion, version, m.name, status.Latest)
+	}
+
+	if version == 0 {
+		err = migrator.Down()
+	} else {
+		err = migrator.Migrate(version)
+	}
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("migrating %s database to %d: %w", m.name, version, err)
+	}
+	return nil
+}
+
+// Force records db as being at version without migrating it, once the
+// schema has been repaired by hand after a failed migration
+func (m *Migrations) Force(db *sql.DB, version uint) error {
+	migrator, status, err := m.open(db)
+	if err != nil {
+		return err
+	}
+	if version > status.Latest {
+		return fmt.Errorf("%w: %d, the latest %s version is %d", ErrUnknownVersion, version, m.name, status.Latest)
+	}
+
+	forced := int(version)
+	if version == 0 {
+		forced = database.NilVersion
+	}
+	err = migrator.Force(forced)
+	if err != nil {
+		return fmt.Errorf("forcing %s database version: %w", m.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package migration_test
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/migration"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tables(t *testing.T, db *sql.DB) []string {
+	rows, err := db.Query("select name from sqlite_master where type = 'table' and name != 'schema_migrations' order by name")
+	require.NoError(t, err)
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestMigrations(t *testing.T) {
+	assert := assert.New(t)
+
+	files := fstest.MapFS{
+		"m/0001_users.up.sql":     {Data: []byte("create table users (id text not null primary key);")},
+		"m/0001_users.down.sql":   {Data: []byte("drop table users;")},
+		"m/0002_posts.up.sql":     {Data: []byte("create table posts (id text not null primary key);")},
+		"m/0002_posts.down.sql":   {Data: []byte("drop table posts;")},
+		"m/0003_broken.up.sql":    {Data: []byte("create table broken (")},
+		"m/0003_broken.down.sql":  {Data: []byte("")},
+		"m/0004_unused.up.sql":    {Data: []byte("create table unused (id text);")},
+		"m/0004_unused.down.sql":  {Data: []byte("drop table unused;")},
+		"other/0001_x.up.sql":     {Data: []byte("create table x (id text);")},
+		"other/0001_x.down.sql":   {Data: []byte("drop table x;")},
+		"other/0002_y.up.sql":     {Data: []byte("create table y (id text);")},
+		"other/0002_y.down.sql":   {Data: []byte("drop table y;")},
+		"other/0003_z.up.sql":     {Data: []byte("create table z (id text);")},
+		"other/0003_z.down.sql":   {Data: []byte("drop table z;")},
+		"other/0004_w.up.sql":     {Data: []byte("create table w (id text);")},
+		"other/0004_w.down.sql":   {Data: []byte("drop table w;")},
+		"other/0005_extra.up.sql": {Data: []byte("create table extra (id text);")},
+	}
+	m := migration.New("test", files, "m")
+	db := openDB(t)
+
+	status, err := m.Status(db)
+	require.NoError(t, err)
+	assert.Equal(&migration.Status{Latest: 4}, status)
+
+	require.NoError(t, m.Migrate(db, 2))
+	assert.Equal([]string{"posts", "users"}, tables(t, db))
+	require.NoError(t, m.Migrate(db, 1))
+	assert.Equal([]string{"users"}, tables(t, db))
+	assert.ErrorIs(m.Migrate(db, 5), migration.ErrUnknownVersion)
+
+	// a failed migration leaves the database dirty until it's forced
+	assert.Error(m.Up(db))
+	status, err = m.Status(db)
+	require.NoError(t, err)
+	assert.Equal(&migration.Status{Version: 3, Latest: 4, Dirty: true}, status)
+	assert.ErrorIs(m.Up(db), migration.ErrDirty)
+	assert.ErrorIs(m.Migrate(db, 1), migration.ErrDirty)
+	require.NoError(t, m.Force(db, 2))
+	require.NoError(t, m.Migrate(db, 0))
+	assert.Empty(tables(t, db))
+
+	// a database migrated by a later version is refused
+	require.NoError(t, migration.New("newer", files, "other").Up(db))
+	assert.ErrorIs(m.Up(db), migration.ErrTooNew)
+}
+
+// TestDowngrade migrates each database all the way down and up again, so
+// every down migration undoes its up migration
+func TestDowngrade(t *testing.T) {
+	for _, m := range []*migration.Migrations{node.Migrations, graph.Migrations, identity.Migrations} {
+		t.Run(m.Name(), func(t *testing.T) {
+			db := openDB(t)
+			require.NoError(t, m.Up(db))
+			latest, err := m.Latest()
+			require.NoError(t, err)
+			migrated := tables(t, db)
+			assert.NotEmpty(t, migrated)
+
+			for version := latest; version > 0; version-- {
+				require.NoError(t, m.Migrate(db, version-1), version)
+			}
+			assert.Empty(t, tables(t, db))
+
+			require.NoError(t, m.Up(db))
+			assert.Equal(t, migrated, tables(t, db))
+			status, err := m.Status(db)
+			require.NoError(t, err)
+			assert.Equal(t, &migration.Status{Version: latest, Latest: latest}, status)
+		})
+	}
+}
@@ -18,8 +18,11 @@ package model
 
 import (
 	"crypto/rand"
+	"database/sql/driver"
 	"errors"
+	"fmt"
 	"math/big"
+	"strings"
 	"time"
 
 	"github.com/bwmarrin/snowflake"
@@ -58,11 +61,127 @@ type SeedSpec struct {
 }
 
 type PeerSpec struct {
-	RemoteAddr string     `db:"remote_addr"`
-	CreatedAt  time.Time  `db:"created_at"`
-	UpdatedAt  *time.Time `db:"updated_at"`
-	NodeID     string     `db:"node_id"`
-	Filter     string     `db:"filter" json:"filter,omitempty"`
+	RemoteAddr    string      `db:"remote_addr"`
+	CreatedAt     time.Time   `db:"created_at"`
+	UpdatedAt     *time.Time  `db:"updated_at"`
+	NodeID        string      `db:"node_id"`
+	Filter        string      `db:"filter" json:"filter,omitempty"`
+	Addresses     AddressList `db:"addresses" json:"addresses,omitempty"`
+	PreferredAddr string      `db:"preferred_addr" json:"preferredAddr,omitempty"`
+	// NodeType is "peer" or "cache", caches replicate content for the
+	// subscriptions in their filter
+	NodeType string `db:"node_type" json:"nodeType,omitempty"`
+	// Group is the sharing group a cache belongs to, if any
+	Group string `db:"group_name" json:"group,omitempty"`
+	// NodeKey is the public key the peer signs control messages with, bound
+	// to its address when it first joins
+	NodeKey string `db:"node_key" json:"nodeKey,omitempty"`
+	// Protocol is the wire protocol version the peer speaks, 0 if it isn't
+	// known yet, and Features the protocol features it listed
+	Protocol int    `db:"protocol_version" json:"protocol,omitempty"`
+	Features string `db:"features" json:"features,omitempty"`
+	// SoftwareVersion is the version of the software the peer runs
+	SoftwareVersion string `db:"software_version" json:"version,omitempty"`
+	// Source is the seed which first handed the peer out
+	Source string `db:"source" json:"-"`
+	// MissedPings is how many pings in a row the peer has missed
+	MissedPings int `db:"missed_pings" json:"-"`
+}
+
+const (
+	// BlockModeBlock rejects an identity's actions outright
+	BlockModeBlock = "block"
+	// BlockModeMute accepts an identity's actions locally but never passes
+	// them on to other nodes
+	BlockModeMute = "mute"
+)
+
+// BlockSpec records an identity which has been blocked or muted, either by the
+// node operator (BlockedBy is empty) or on behalf of a local identity
+type BlockSpec struct {
+	Identity  string    `db:"identity" json:"identity"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	Mode      string    `db:"mode" json:"mode"`
+	BlockedBy string    `db:"blocked_by" json:"blockedBy,omitempty"`
+}
+
+// HandleClaim records an identity publishing a handle. Claims are ranked by
+// verification then by when they were first seen.
+type HandleClaim struct {
+	Handle      string     `db:"handle" json:"handle"`
+	Identity    string     `db:"identity" json:"identity"`
+	FirstSeenAt time.Time  `db:"first_seen_at" json:"firstSeenAt"`
+	ActionID    string     `db:"action_id" json:"actionId"`
+	VerifiedAt  *time.Time `db:"verified_at" json:"verifiedAt,omitempty"`
+}
+
+// SeenAt is when the peer last joined or pinged
+func (p *PeerSpec) SeenAt() time.Time {
+	if p.UpdatedAt != nil {
+		return *p.UpdatedAt
+	}
+	return p.CreatedAt
+}
+
+// PeerTombstone records that a peer left or was dropped, so that seeds
+// sharing a peer table delete it too
+type PeerTombstone struct {
+	RemoteAddr string    `db:"remote_addr" json:"remoteAddr"`
+	DeletedAt  time.Time `db:"deleted_at" json:"deletedAt"`
+}
+
+// DialAddresses returns the addresses a peer can be reached on in the order
+// they should be tried: the last one that worked, the address it connected
+// from and then any it advertised.
+func (p *PeerSpec) DialAddresses() []string {
+	seen := map[string]bool{}
+	addrs := []string{}
+	candidates := append([]string{p.PreferredAddr, p.RemoteAddr}, p.Addresses...)
+	for _, a := range candidates {
+		if a == "" || seen[a] {
+			continue
+		}
+		seen[a] = true
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
+
+// AddressList is a list of host:port specs (IPv4, IPv6 or hostname) stored as a
+// comma separated string
+type AddressList []string
+
+func ParseAddressList(s string) AddressList {
+	l := AddressList{}
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a != "" {
+			l = append(l, a)
+		}
+	}
+	return l
+}
+
+func (l AddressList) String() string {
+	return strings.Join(l, ",")
+}
+
+func (l AddressList) Value() (driver.Value, error) {
+	return l.String(), nil
+}
+
+func (l *AddressList) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*l = AddressList{}
+	case string:
+		*l = ParseAddressList(v)
+	case []byte:
+		*l = ParseAddressList(string(v))
+	default:
+		return fmt.Errorf("unsupported address list type: %T", src)
+	}
+	return nil
 }
 
 type SubscriptionSpec struct {
@@ -16,6 +16,8 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 */
 package model
 
+import "time"
+
 type PingResponse struct {
 	Seeds []string `json:"seeds"`
 }
@@ -35,4 +37,29 @@ type Action struct {
 type JoinResponse struct {
 	Seeds []*SeedSpec `json:"seeds"`
 	Peers []*PeerSpec `json:"peers"`
+	// FilterTypes are the subscription filter types the seed understands
+	FilterTypes []string `json:"filterTypes,omitempty"`
+}
+
+// GroupResponse lists the members of a sharing group, caches which together
+// keep the group's topics
+type GroupResponse struct {
+	Name    string      `json:"name"`
+	Members []*PeerSpec `json:"members"`
+}
+
+// PeerReplication is a page of the changes to a seed's peer table since a
+// replica last asked. At is the time on the seed's clock the page was read.
+type PeerReplication struct {
+	At      time.Time        `json:"at"`
+	Peers   []*PeerSpec      `json:"peers"`
+	Deleted []*PeerTombstone `json:"deleted,omitempty"`
+	More    bool             `json:"more,omitempty"`
+}
+
+// GossipMessage is exchanged between seeds so that each learns the seeds and
+// peers the others know about
+type GossipMessage struct {
+	Seeds []*SeedSpec `json:"seeds"`
+	Peers []*PeerSpec `json:"peers"`
 }
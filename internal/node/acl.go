@@ -0,0 +1,235 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+// MaxQuerySkew is how far the time a query was signed at may be from the
+// node's clock
+const MaxQuerySkew = 5 * time.Minute
+
+var ErrQueryExpired = errors.New("query signed too long ago")
+
+// ReadRule is read from an entry in the read_acl section of the config file.
+// It limits who can MATCH the entities with any of its labels and owned by
+// any of its owners through the node's query endpoints, so that a node can
+// host private subgraphs such as direct messages. Backfill isn't signed so it
+// leaves out the actions writing anything a rule covers. Queries made through
+// the application and admin APIs aren't limited.
+type ReadRule struct {
+	// Namespace is the graph the rule applies to, the default graph if empty
+	Namespace string `mapstructure:"namespace"`
+	// Labels are the labels of the entities the rule covers, any label if
+	// empty
+	Labels []string `mapstructure:"labels"`
+	// Owners are the identities owning the entities the rule covers, any
+	// owner if empty
+	Owners []string `mapstructure:"owners"`
+	// Readers are the identities which can read the entities
+	Readers []string `mapstructure:"readers"`
+	// Owner lets the identity owning an entity read it
+	Owner bool `mapstructure:"owner"`
+}
+
+func (r ReadRule) validate(check *configCheck, i int, namespaces map[string]NamespaceConfig) {
+	if len(r.Labels) == 0 && len(r.Owners) == 0 {
+		check.addf(fmt.Sprintf("%d", i), "must have labels or owners")
+	}
+	if _, ok := namespaces[r.Namespace]; r.Namespace != "" && !ok {
+		check.addf(fmt.Sprintf("%d.namespace", i), "%s isn't in namespaces", r.Namespace)
+	}
+}
+
+// covers reports whether the rule applies to an entity
+func (r *ReadRule) covers(ownerID string, labels []string) bool {
+	if len(r.Owners) > 0 && !slices.Contains(r.Owners, ownerID) {
+		return false
+	}
+	if len(r.Labels) == 0 {
+		return true
+	}
+	for _, l := range labels {
+		if slices.Contains(r.Labels, l) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the reader, empty for an anonymous query, can read
+// an entity the rule covers
+func (r *ReadRule) allows(reader, ownerID string) bool {
+	if reader == "" {
+		return false
+	}
+	return slices.Contains(r.Readers, reader) || (r.Owner && reader == ownerID)
+}
+
+// readFilter returns the filter for the reader's queries of a namespace, nil
+// if no rules apply to it. An entity covered by several rules must be allowed
+// by all of them.
+func (n *node) readFilter(namespace, reader string) graph.ReadFilter {
+	rules := []*ReadRule{}
+	for i := range n.readACL {
+		if n.readACL[i].Namespace == namespace {
+			rules = append(rules, &n.readACL[i])
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	return func(ownerID string, labels []string) bool {
+		for _, r := range rules {
+			if r.covers(ownerID, labels) && !r.allows(reader, ownerID) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// anyoneCanRead reports whether an anonymous query could read everything an
+// action writes. Encrypted actions can only be read with their key anyway.
+func (n *node) anyoneCanRead(action *graph.Action) bool {
+	filter := n.readFilter(action.Namespace, "")
+	if filter == nil || action.KeyID != "" {
+		return true
+	}
+
+	cmd := action.Command
+	if cmd == nil {
+		parser, err := ast.Parse(action.Action)
+		if err != nil {
+			return false
+		}
+		cmd = parser.Command()
+	}
+	return readableEntity(cmd.Entity(), action.Identity, filter)
+}
+
+func readableEntity(e ast.Entity, ownerID string, filter graph.ReadFilter) bool {
+	if e == nil {
+		return true
+	}
+	if !filter(ownerID, e.Labels()) {
+		return false
+	}
+	if r, ok := e.(ast.Relation); ok {
+		return readableEntity(r.Left(), ownerID, filter) && readableEntity(r.Right(), ownerID, filter)
+	}
+	return true
+}
+
+// QuerySigningPayload returns what an identity signs to query a node as
+// itself. The timestamp is sent as is in the x-propolis-timestamp header.
+func QuerySigningPayload(namespace, timestamp, stmt string) []byte {
+	return []byte("propolis-query\n" + namespace + "\n" + timestamp + "\n" + stmt)
+}
+
+// queryReader returns the identity which signed a query, empty if it wasn't
+// signed. Only identities whose certificates the node already holds can sign
+// queries, the node doesn't ask the network for them.
+func (n *node) queryReader(req *http.Request, namespace, stmt string) (string, error) {
+	reader := req.Header.Get(HeaderIdentifier)
+	if reader == "" {
+		return "", nil
+	}
+
+	timestamp := req.Header.Get(HeaderTimestamp)
+	signedAt, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return "", identity.ErrBadSignature
+	}
+	now := time.Now().UTC()
+	if signedAt.Before(now.Add(-MaxQuerySkew)) || signedAt.After(now.Add(MaxQuerySkew)) {
+		return "", ErrQueryExpired
+	}
+
+	cert, err := n.readerCertificate(req.Context(), reader, now)
+	if err != nil {
+		return "", err
+	}
+
+	v, err := identity.NewVerifier(cert)
+	if err != nil {
+		return "", err
+	}
+	v.Add(QuerySigningPayload(namespace, timestamp, stmt))
+	err = v.Verify(req.Header.Get(HeaderSignature))
+	if err != nil {
+		return "", err
+	}
+
+	return reader, nil
+}
+
+// readerCertificate returns the certificate of an identity signing a query
+// from those cached or published to the node
+func (n *node) readerCertificate(ctx context.Context, reader string, now time.Time) (*x509.Certificate, error) {
+	revokedAt, err := n.store.GetRevocation(ctx, reader)
+	if err != nil {
+		return nil, fmt.Errorf("checking revocation: %w", err)
+	}
+	if revokedAt != nil {
+		return nil, identity.ErrRevoked
+	}
+
+	cert, err := n.store.GetCachedCertificate(ctx, reader)
+	if errors.Is(err, model.ErrNotFound) || (err == nil && identity.CheckValidity(cert, now) != nil) {
+		cert, err = n.store.GetIdentityRecord(ctx, reader)
+	}
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		return nil, identity.ErrUnauthorized
+	case err != nil:
+		return nil, fmt.Errorf("getting certificate: %w", err)
+	}
+
+	err = identity.CheckValidity(cert, now)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// writeReaderError maps an error from queryReader to a response
+func (n *node) writeReaderError(w http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, identity.ErrUnauthorized), errors.Is(err, identity.ErrBadSignature), errors.Is(err, identity.ErrUnsupportedPublicKey),
+		errors.Is(err, identity.ErrRevoked), errors.Is(err, identity.ErrCertificateExpired),
+		errors.Is(err, ErrQueryExpired):
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+	default:
+		n.logger.Error("checking query signature", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const (
+	defaultAddressQuorum = 2
+	// maxAdvertisedAddresses is how many of the addresses a joining node
+	// advertises are checked and stored
+	maxAdvertisedAddresses = 8
+)
+
+// ErrNodeMismatch is returned when the node answering at an address isn't
+// the one expected
+var ErrNodeMismatch = errors.New("a different node answered")
+
+// publicAddress is the address other nodes use to reach this one. Unless it is
+// configured it is discovered from the addresses seeds see requests arriving
+// from, each seed gets one vote and an address is adopted once enough agree.
+// Only the seeds this node was configured with or discovered for itself vote,
+// by address, as the node IDs seeds report and the seeds learnt by gossip are
+// up to other nodes.
+type publicAddress struct {
+	mu sync.RWMutex
+	// fixed is set when the address was configured
+	fixed   bool
+	addr    string
+	port    int
+	quorum  int
+	voters  map[string]struct{}
+	votes   map[string]string
+	adopted bool
+}
+
+func newPublicAddress(configured, fallback string, port, quorum int) *publicAddress {
+	if quorum == 0 {
+		quorum = defaultAddressQuorum
+	}
+	p := &publicAddress{
+		addr:   fallback,
+		port:   port,
+		quorum: quorum,
+		voters: map[string]struct{}{},
+		votes:  map[string]string{},
+	}
+	if configured != "" {
+		p.fixed = true
+		p.addr = configured
+	}
+	return p
+}
+
+// String returns the public address, empty if it isn't known yet
+func (p *publicAddress) String() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.addr
+}
+
+// discovered returns the address if it was discovered rather than configured
+func (p *publicAddress) discovered() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.adopted {
+		return ""
+	}
+	return p.addr
+}
+
+// setVoters replaces the addresses of the seeds which vote, dropping the
+// votes of any which no longer do
+func (p *publicAddress) setVoters(seeds []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.voters = map[string]struct{}{}
+	for _, s := range seeds {
+		p.voters[s] = struct{}{}
+	}
+	for s := range p.votes {
+		if _, ok := p.voters[s]; !ok {
+			delete(p.votes, s)
+		}
+	}
+}
+
+// observe records the address the seed at seedAddr saw a request arrive
+// from. Only the host is voted on, NATs and TCP connections don't preserve
+// the port so the node's listen port is used. It returns the new address when
+// the vote changes it.
+func (p *publicAddress) observe(seedAddr, remoteAddr string) (string, bool) {
+	if seedAddr == "" || remoteAddr == "" {
+		return "", false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.fixed {
+		return "", false
+	}
+	if _, ok := p.voters[seedAddr]; !ok {
+		return "", false
+	}
+	p.votes[seedAddr] = ip.String()
+
+	tally := map[string]int{}
+	for _, h := range p.votes {
+		tally[h]++
+	}
+
+	leader, leaderVotes, runnerUpVotes := "", 0, 0
+	for h, v := range tally {
+		switch {
+		case v > leaderVotes:
+			leader, leaderVotes, runnerUpVotes = h, v, leaderVotes
+		case v > runnerUpVotes:
+			runnerUpVotes = v
+		}
+	}
+
+	// with fewer seeds than the quorum every one of them has to agree
+	if leaderVotes < min(p.quorum, len(p.voters)) || leaderVotes == runnerUpVotes {
+		return "", false
+	}
+
+	addr := net.JoinHostPort(leader, strconv.Itoa(p.port))
+	if p.adopted && addr == p.addr {
+		return "", false
+	}
+	p.addr = addr
+	p.adopted = true
+	return addr, true
+}
+
+// observePublicAddress records the address the node at seedAddr saw this
+// node's request arriving from
+func (n *node) observePublicAddress(seedAddr, remoteAddr string) {
+	addr, changed := n.publicAddr.observe(seedAddr, remoteAddr)
+	if changed {
+		n.logger.Info("discovered public address", "addr", addr, "seed", seedAddr)
+	}
+}
+
+// advertisedAddresses are the configured addresses other nodes can use to
+// reach this one plus the discovered public address
+func (n *node) advertisedAddresses() model.AddressList {
+	addr := n.publicAddr.discovered()
+	if addr == "" || slices.Contains(n.addresses, addr) {
+		return n.addresses
+	}
+	return append(slices.Clone(n.addresses), addr)
+}
+
+// confirmNode checks the node answering at addr is the one which sent a
+// request. Nodes which signed it must answer with the same node key, others
+// with the node ID they sent.
+func (n *node) confirmNode(ctx context.Context, addr, nodeID, nodeKey string) error {
+	spec, err := n.getNodeInfo(ctx, addr)
+	if err != nil {
+		return err
+	}
+	if nodeKey != "" && spec.NodeKey != nodeKey {
+		return fmt.Errorf("node key doesn't match: %w", ErrNodeMismatch)
+	}
+	if nodeKey == "" && (nodeID == "" || spec.NodeID != nodeID) {
+		return fmt.Errorf("node ID doesn't match: %w", ErrNodeMismatch)
+	}
+	return nil
+}
+
+// confirmAddresses returns the addresses a joining node advertised which it
+// answers at, so a node can't have others dial an address it doesn't own.
+// The address it joined from is already known to be its own.
+func (n *node) confirmAddresses(ctx context.Context, addrs model.AddressList, remoteAddr, nodeID, nodeKey string) model.AddressList {
+	if len(addrs) > maxAdvertisedAddresses {
+		addrs = addrs[:maxAdvertisedAddresses]
+	}
+
+	confirmed := make([]bool, len(addrs))
+	wg := sync.WaitGroup{}
+	for i, addr := range addrs {
+		if addr == remoteAddr {
+			confirmed[i] = true
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := n.confirmNode(ctx, addr, nodeID, nodeKey)
+			if err != nil {
+				n.logger.Warn("dropping advertised address", "error", err, "addr", addr, "remote", remoteAddr)
+				return
+			}
+			confirmed[i] = true
+		}()
+	}
+	wg.Wait()
+
+	l := model.AddressList{}
+	for i, addr := range addrs {
+		if confirmed[i] {
+			l = append(l, addr)
+		}
+	}
+	return l
+}
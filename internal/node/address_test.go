@@ -0,0 +1,142 @@
+package node
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicAddressObserve(t *testing.T) {
+	type vote struct {
+		seed, remote string
+	}
+
+	tests := map[string]struct {
+		configured string
+		seeds      []string
+		votes      []vote
+		expected   string
+	}{
+		"quorum": {
+			seeds:    []string{"s1:9000", "s2:9000", "s3:9000"},
+			votes:    []vote{{"s1:9000", "1.2.3.4:5000"}, {"s2:9000", "1.2.3.4:6000"}},
+			expected: "1.2.3.4:9000",
+		},
+		// the first seed to answer can't decide alone
+		"one vote": {
+			seeds: []string{"s1:9000", "s2:9000", "s3:9000"},
+			votes: []vote{{"s1:9000", "1.2.3.4:5000"}},
+		},
+		"only seed": {
+			seeds:    []string{"s1:9000"},
+			votes:    []vote{{"s1:9000", "1.2.3.4:5000"}},
+			expected: "1.2.3.4:9000",
+		},
+		"disagree": {
+			seeds: []string{"s1:9000", "s2:9000"},
+			votes: []vote{{"s1:9000", "1.2.3.4:5000"}, {"s2:9000", "5.6.7.8:5000"}},
+		},
+		// gossiped seeds and other nodes don't get a vote
+		"not a voter": {
+			seeds: []string{"s1:9000", "s2:9000"},
+			votes: []vote{{"s1:9000", "6.6.6.6:5000"}, {"evil:9000", "6.6.6.6:5000"}},
+		},
+		"voting twice": {
+			seeds: []string{"s1:9000", "s2:9000"},
+			votes: []vote{{"s1:9000", "6.6.6.6:5000"}, {"s1:9000", "6.6.6.6:5000"}},
+		},
+		"changed vote": {
+			seeds:    []string{"s1:9000", "s2:9000"},
+			votes:    []vote{{"s1:9000", "1.2.3.4:5000"}, {"s2:9000", "1.2.3.4:5000"}, {"s1:9000", "5.6.7.8:5000"}, {"s2:9000", "5.6.7.8:5000"}},
+			expected: "5.6.7.8:9000",
+		},
+		"unspecified": {
+			seeds: []string{"s1:9000"},
+			votes: []vote{{"s1:9000", "0.0.0.0:5000"}},
+		},
+		"configured": {
+			configured: "example.com:9000",
+			seeds:      []string{"s1:9000"},
+			votes:      []vote{{"s1:9000", "1.2.3.4:5000"}},
+			expected:   "example.com:9000",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newPublicAddress(tt.configured, "", 9000, 0)
+			p.setVoters(tt.seeds)
+			for _, v := range tt.votes {
+				p.observe(v.seed, v.remote)
+			}
+			assert.Equal(t, tt.expected, p.String())
+		})
+	}
+}
+
+func TestPublicAddressSetVoters(t *testing.T) {
+	p := newPublicAddress("", "", 9000, 0)
+	p.setVoters([]string{"s1:9000", "s2:9000", "s3:9000"})
+	p.observe("s1:9000", "1.2.3.4:5000")
+
+	// a seed that is dropped takes its vote with it
+	p.setVoters([]string{"s2:9000", "s3:9000"})
+	p.observe("s2:9000", "1.2.3.4:5000")
+	assert.Empty(t, p.String())
+
+	p.observe("s3:9000", "1.2.3.4:5000")
+	assert.Equal(t, "1.2.3.4:9000", p.String())
+}
+
+func TestConfirmAddresses(t *testing.T) {
+	nodes := map[string]*node{}
+	for _, id := range []string{"joining", "other"} {
+		n := newTestNode(t)
+		n.nodeID = id
+		n.publicAddr = newPublicAddress("", "", 9000, 1)
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		n.nodeKey = key
+		nodes[id] = n
+	}
+	joining := nodes["joining"]
+	listening := map[string]*node{
+		"10.0.0.2:9000":    joining,
+		"192.168.1.2:9000": joining,
+		"10.0.0.9:9000":    nodes["other"],
+	}
+
+	n := newTestNode(t)
+	n.client = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		there, ok := listening[req.URL.Host]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+		w := httptest.NewRecorder()
+		there.handleWhoAmI(w, req)
+		return w.Result(), nil
+	})}
+
+	advertised := model.AddressList{"10.0.0.2:9000", "192.168.1.2:9000", "10.0.0.9:9000", "10.0.0.3:9000"}
+	expected := model.AddressList{"10.0.0.2:9000", "192.168.1.2:9000"}
+
+	// signed joins are checked by node key, unsigned ones by node ID
+	assert.Equal(t, expected, n.confirmAddresses(context.Background(), advertised, "10.0.0.2:9000", "joining", joining.NodeKey()))
+	assert.Equal(t, expected, n.confirmAddresses(context.Background(), advertised, "10.0.0.2:9000", "joining", ""))
+	assert.Equal(t, model.AddressList{"10.0.0.2:9000"}, n.confirmAddresses(context.Background(), advertised, "10.0.0.2:9000", "spoofed", ""))
+
+	// only the first few are checked
+	many := model.AddressList{}
+	for range maxAdvertisedAddresses + 1 {
+		many = append(many, "192.168.1.2:9000")
+	}
+	assert.Len(t, n.confirmAddresses(context.Background(), many, "10.0.0.2:9000", "joining", ""), maxAdvertisedAddresses)
+}
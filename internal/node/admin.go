@@ -0,0 +1,531 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/logging"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const AdminSocketPrefix = "unix:"
+
+type AdminStatus struct {
+	NodeID           string            `json:"nodeId"`
+	NodeKey          string            `json:"nodeKey"`
+	Protocol         int               `json:"protocol"`
+	Features         []string          `json:"features"`
+	Version          VersionStatus     `json:"version"`
+	Type             string            `json:"type"`
+	Capabilities     []string          `json:"capabilities"`
+	PublicAddr       string            `json:"publicAddr,omitempty"`
+	Addresses        model.AddressList `json:"addresses,omitempty"`
+	Group            string            `json:"group,omitempty"`
+	Peers            int               `json:"peers"`
+	Seeds            int               `json:"seeds"`
+	Sessions         int               `json:"sessions"`
+	ActionQueueDepth int               `json:"actionQueueDepth"`
+	QueuedActions    int               `json:"queuedActions"`
+	EventsDropped    uint64            `json:"eventsDropped"`
+	Subscriptions    string            `json:"subscriptions"`
+}
+
+// local servers, for the admin and application APIs, listen on separate
+// (usually loopback or unix socket) addresses so that they are never exposed
+// on the peer port
+type localServer struct {
+	server     *http.Server
+	socketPath string
+}
+
+func (n *node) newAdminMux(withAPI bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(n.metrics.registry, promhttp.HandlerOpts{
+		Registry: n.metrics.registry,
+	}))
+
+	if !withAPI {
+		return mux
+	}
+
+	mux.Handle("GET /admin/status", n.requireAdminToken(n.handleAdminStatus))
+	mux.Handle("GET /admin/peers", n.requireAdminToken(n.handleAdminPeers))
+	mux.Handle("DELETE /admin/peers/{addr}", n.requireAdminToken(n.handleAdminDropPeer))
+	mux.Handle("POST /admin/ping", n.requireAdminToken(n.handleAdminPing))
+	mux.Handle("GET /admin/seeds", n.requireAdminToken(n.handleAdminSeeds))
+	mux.Handle("GET /admin/subscriptions", n.requireAdminToken(n.handleAdminSubscriptions))
+	mux.Handle("POST /admin/subscriptions/{id}", n.requireAdminToken(n.handleAdminSubscribe))
+	mux.Handle("DELETE /admin/subscriptions/{id}", n.requireAdminToken(n.handleAdminUnsubscribe))
+	mux.Handle("POST /admin/topics/{topic}", n.requireAdminToken(n.handleAdminSubscribeTopic))
+	mux.Handle("DELETE /admin/topics/{topic}", n.requireAdminToken(n.handleAdminUnsubscribeTopic))
+	mux.Handle("POST /admin/resync", n.requireAdminToken(n.handleAdminResync))
+	mux.Handle("GET /admin/blocks", n.requireAdminToken(n.handleAdminBlocks))
+	mux.Handle("POST /admin/blocks/{identity}", n.requireAdminToken(n.handleAdminBlock))
+	mux.Handle("DELETE /admin/blocks/{identity}", n.requireAdminToken(n.handleAdminUnblock))
+	mux.Handle("POST /admin/blocks/{identity}/purge", n.requireAdminToken(n.handleAdminPurge))
+	mux.Handle("GET /admin/handles/{handle}", n.requireAdminToken(n.handleResolveHandle))
+	mux.Handle("GET /admin/actions", n.requireAdminToken(n.handleAdminActions))
+	mux.Handle("GET /admin/checkpoint", n.requireAdminToken(n.handleAdminCheckpoint))
+	mux.Handle("POST /admin/checkpoint", n.requireAdminToken(n.handleAdminTakeCheckpoint))
+	mux.Handle("GET /admin/checkpoint/graph", n.requireAdminToken(n.handleAdminCheckpointGraph))
+	mux.Handle("GET /admin/events", n.requireAdminToken(n.handleAdminEvents))
+	mux.Handle("POST /admin/query", n.requireAdminToken(n.handleAPIQuery))
+	mux.Handle("GET /admin/log-levels", n.requireAdminToken(n.handleAdminLogLevels))
+	mux.Handle("POST /admin/log-levels/{module}", n.requireAdminToken(n.handleAdminSetLogLevel))
+	mux.Handle("DELETE /admin/log-levels/{module}", n.requireAdminToken(n.handleAdminResetLogLevel))
+
+	// profiles and goroutine dumps can leak data from memory so they are
+	// opt in and need the token
+	if n.diagnostics {
+		mux.Handle("GET /debug/pprof/", n.requireAdminToken(pprof.Index))
+		mux.Handle("GET /debug/pprof/cmdline", n.requireAdminToken(pprof.Cmdline))
+		mux.Handle("GET /debug/pprof/profile", n.requireAdminToken(pprof.Profile))
+		mux.Handle("GET /debug/pprof/symbol", n.requireAdminToken(pprof.Symbol))
+		mux.Handle("POST /debug/pprof/symbol", n.requireAdminToken(pprof.Symbol))
+		mux.Handle("GET /debug/pprof/trace", n.requireAdminToken(pprof.Trace))
+		mux.Handle("GET /debug/vars", n.requireAdminToken(expvar.Handler().ServeHTTP))
+	}
+
+	return mux
+}
+
+func (n *node) startAdminServer() (*localServer, error) {
+	if n.adminAddr == "" {
+		return nil, nil
+	}
+
+	listener, socketPath, err := listenLocal(n.adminAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on admin address: %w", err)
+	}
+
+	// the socket is only accessible to the user running the node so the
+	// token is optional there
+	withAPI := true
+	if socketPath == "" && n.adminToken == "" {
+		n.logger.Warn("no admin token set, admin API disabled")
+		withAPI = false
+	}
+
+	n.logger.Info("starting admin server", "addr", listener.Addr())
+	return n.serveLocal(listener, socketPath, n.newAdminMux(withAPI)), nil
+}
+
+// listenLocal listens on a TCP address or, with the unix: prefix, on a unix
+// socket only accessible to the user running the node, returning the socket's
+// path
+func listenLocal(addr string) (net.Listener, string, error) {
+	path, ok := strings.CutPrefix(addr, AdminSocketPrefix)
+	if !ok {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, "", err
+		}
+		return listener, "", nil
+	}
+
+	// the socket is made in a directory only the user can enter and moved
+	// into place once its permissions are set, so nobody can connect to it
+	// in between
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".socket")
+	if err != nil {
+		return nil, "", fmt.Errorf("creating socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(path))
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, "", err
+	}
+	err = os.Chmod(tmp, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, "", fmt.Errorf("setting socket permissions: %w", err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		listener.Close()
+		return nil, "", fmt.Errorf("moving socket into place: %w", err)
+	}
+	return listener, path, nil
+}
+
+func (n *node) serveLocal(listener net.Listener, socketPath string, handler http.Handler) *localServer {
+	s := &localServer{
+		server: &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: defaultTimeout,
+		},
+		socketPath: socketPath,
+	}
+
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			n.logger.Error("closing local server", "error", err, "addr", listener.Addr())
+		}
+	}()
+
+	return s
+}
+
+func (s *localServer) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	err := s.server.Shutdown(ctx)
+	if s.socketPath != "" {
+		os.Remove(s.socketPath)
+	}
+	return err
+}
+
+func (n *node) requireAdminToken(next http.HandlerFunc) http.Handler {
+	return requireToken(n.adminToken, next)
+}
+
+// requireToken checks the request's bearer token if a token is set
+func requireToken(expected string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if expected != "" {
+			token, _ := strings.CutPrefix(req.Header.Get(HeaderAuthorization), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, req)
+	})
+}
+
+func (n *node) writeJSON(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		n.logger.Error("marshalling response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add(HeaderContentType, ContentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (n *node) handleAdminStatus(w http.ResponseWriter, req *http.Request) {
+	peers, err := n.store.CountOfPeers(req.Context())
+	if err != nil {
+		n.logger.Error("counting peers", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	seeds, err := n.store.GetSeeds(req.Context())
+	if err != nil {
+		n.logger.Error("fetching seeds", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	queued, err := n.store.CountQueuedActions(req.Context())
+	if err != nil {
+		n.logger.Error("counting queued actions", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	n.writeJSON(w, &AdminStatus{
+		NodeID:           n.nodeID,
+		NodeKey:          n.NodeKey(),
+		Protocol:         ProtocolVersion,
+		Features:         protocolFeatures,
+		Version:          n.versions.Status(),
+		Type:             n.nodeType.String(),
+		Capabilities:     n.capabilities.Names(),
+		PublicAddr:       n.publicAddr.String(),
+		Addresses:        n.advertisedAddresses(),
+		Group:            n.group,
+		Peers:            peers,
+		Seeds:            len(seeds),
+		Sessions:         n.countOfSessions(),
+		ActionQueueDepth: len(n.actionQueue),
+		QueuedActions:    queued,
+		EventsDropped:    n.events.Dropped(),
+		Subscriptions:    n.subscriptionFilter().String(),
+	})
+}
+
+func (n *node) handleAdminPeers(w http.ResponseWriter, req *http.Request) {
+	peers, err := n.store.GetAllPeers(req.Context())
+	if err != nil {
+		n.logger.Error("fetching peers", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n.writeJSON(w, peers)
+}
+
+func (n *node) handleAdminDropPeer(w http.ResponseWriter, req *http.Request) {
+	addr := req.PathValue("addr")
+
+	peer, err := n.store.GetPeer(req.Context(), addr)
+	if err != nil {
+		n.logger.Error("fetching peer", "error", err, "remote", addr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if peer == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	n.logger.Info("dropping peer", "remote", addr)
+	if n.transports != nil {
+		n.transports.DropSession(addr)
+	}
+	n.dropPeer(req.Context(), addr, "dropped by admin")
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *node) handleAdminPing(w http.ResponseWriter, req *http.Request) {
+	addr := req.URL.Query().Get("addr")
+	if addr == "" {
+		err := n.pingPeers(req.Context())
+		if err != nil {
+			n.logger.Error("pinging peers", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	peer, err := n.store.GetPeer(req.Context(), addr)
+	if err != nil {
+		n.logger.Error("fetching peer", "error", err, "remote", addr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if peer == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = n.tryPeerAddresses(req.Context(), peer, func(addr string) error {
+		return n.sendPing(req.Context(), addr)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *node) handleAdminSeeds(w http.ResponseWriter, req *http.Request) {
+	seeds, err := n.store.GetSeeds(req.Context())
+	if err != nil {
+		n.logger.Error("fetching seeds", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n.writeJSON(w, seeds)
+}
+
+func (n *node) handleAdminSubscriptions(w http.ResponseWriter, req *http.Request) {
+	n.writeJSON(w, map[string]any{
+		"filter": n.subscriptionFilter().String(),
+		"count":  n.CountOfSubscriptions(),
+	})
+}
+
+// handleAdminSubscribe subscribes to an entity ID. Subscriptions here and
+// below are in the namespace given by the namespace parameter, the default
+// graph if there isn't one.
+func (n *node) handleAdminSubscribe(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+	n.Subscribe(namespaceKeys(namespace, []string{req.PathValue("id")})...)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *node) handleAdminUnsubscribe(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+	n.Unsubscribe(namespaceKeys(namespace, []string{req.PathValue("id")})...)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *node) handleAdminSubscribeTopic(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+	n.Subscribe(namespaceKeys(namespace, topicKeys([]string{req.PathValue("topic")}))...)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *node) handleAdminUnsubscribeTopic(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+	n.Unsubscribe(namespaceKeys(namespace, topicKeys([]string{req.PathValue("topic")}))...)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminResync refreshes the seed list and, for peers, rejoins the
+// network to pick up a fresh set of peers
+func (n *node) handleAdminResync(w http.ResponseWriter, req *http.Request) {
+	n.logger.Info("resyncing")
+
+	err := n.setInitialSeeds(req.Context())
+	if err != nil {
+		n.logger.Error("resyncing seeds", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if n.capabilities.Has(CapabilityRelay) {
+		err = n.joinSeeds(req.Context())
+		if err != nil {
+			n.logger.Error("resyncing peers", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *node) handleAdminBlocks(w http.ResponseWriter, req *http.Request) {
+	blocks, err := n.Blocks(req.Context())
+	if err != nil {
+		n.logger.Error("fetching blocks", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n.writeJSON(w, blocks)
+}
+
+func (n *node) handleAdminBlock(w http.ResponseWriter, req *http.Request) {
+	identifier := req.PathValue("identity")
+	mode := req.URL.Query().Get("mode")
+	if mode == "" {
+		mode = model.BlockModeBlock
+	}
+
+	err := n.BlockIdentity(req.Context(), identifier, mode, req.URL.Query().Get("by"))
+	if err != nil {
+		n.logger.Error("blocking identity", "error", err, "identity", identifier)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	n.logger.Info("blocked identity", "identity", identifier, "mode", mode)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *node) handleAdminUnblock(w http.ResponseWriter, req *http.Request) {
+	identifier := req.PathValue("identity")
+	err := n.UnblockIdentity(req.Context(), identifier)
+	if err != nil {
+		n.logger.Error("unblocking identity", "error", err, "identity", identifier)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *node) handleAdminPurge(w http.ResponseWriter, req *http.Request) {
+	identifier := req.PathValue("identity")
+	count, err := n.PurgeIdentity(identifier)
+	if err != nil {
+		n.logger.Error("purging identity", "error", err, "identity", identifier)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n.writeJSON(w, map[string]int{
+		"purged": count,
+	})
+}
+
+// AdminLogLevels are the default log level and the modules with their own
+type AdminLogLevels struct {
+	Default string            `json:"default"`
+	Modules map[string]string `json:"modules"`
+}
+
+func (n *node) handleAdminLogLevels(w http.ResponseWriter, req *http.Request) {
+	n.writeJSON(w, &AdminLogLevels{
+		Default: n.loggers.Level().String(),
+		Modules: n.loggers.Levels(),
+	})
+}
+
+// handleAdminSetLogLevel changes a module's level until the config is next
+// loaded
+func (n *node) handleAdminSetLogLevel(w http.ResponseWriter, req *http.Request) {
+	module := req.PathValue("module")
+	level, err := logging.ParseLevel(req.URL.Query().Get("level"))
+	if err == nil {
+		err = n.loggers.SetLevel(module, level)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	n.logger.Info("set log level", "target", module, "level", level)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *node) handleAdminResetLogLevel(w http.ResponseWriter, req *http.Request) {
+	module := req.PathValue("module")
+	err := n.loggers.ResetLevel(module)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	n.logger.Info("reset log level", "target", module)
+	w.WriteHeader(http.StatusOK)
+}
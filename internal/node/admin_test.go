@@ -0,0 +1,37 @@
+package node
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenLocal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	// a socket left behind by a node which didn't stop cleanly is replaced
+	require.NoError(t, os.WriteFile(path, nil, 0666))
+
+	listener, socketPath, err := listenLocal(AdminSocketPrefix + path)
+	require.NoError(t, err)
+	defer listener.Close()
+	assert.Equal(t, path, socketPath)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSocket, info.Mode().Type())
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn.Close()
+
+	// nothing is left behind from making the socket
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
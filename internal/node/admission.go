@@ -0,0 +1,186 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+var errBlocked = errors.New("identity is blocked")
+
+// rejection is an action failing one of the checks made before it is
+// processed, whether it was received or published here. The reason is one of
+// the RejectReason constants, empty when the failure isn't the action's fault.
+type rejection struct {
+	reason  string
+	status  int
+	message string
+	err     error
+}
+
+func (r *rejection) Error() string {
+	return r.err.Error()
+}
+
+func (r *rejection) Unwrap() error {
+	return r.err
+}
+
+// checkAction makes sure an action's identity isn't blocked, that it signed
+// the action and that it is within its quotas. Actions published here are
+// verified with the publishing identity's own certificate.
+func (n *node) checkAction(ctx context.Context, action *graph.Action, local bool) error {
+	block, err := n.nodeBlock(ctx, action.Identity)
+	if err != nil {
+		n.logger.Error("checking block", "error", err, "identity", action.Identity)
+		return &rejection{status: http.StatusInternalServerError, err: fmt.Errorf("checking block: %w", err)}
+	}
+
+	if block != nil && block.Mode == model.BlockModeBlock {
+		return &rejection{reason: RejectReasonBlocked, status: http.StatusForbidden, err: errBlocked}
+	}
+
+	if local {
+		err = n.verifyLocalAction(ctx, action)
+	} else {
+		err = n.verifyAction(ctx, action)
+	}
+	switch {
+	case err == identity.ErrUnsupportedPublicKey:
+		return &rejection{reason: RejectReasonError, status: http.StatusInternalServerError, err: err}
+	case err == identity.ErrUnauthorized:
+		return &rejection{reason: RejectReasonUnauthorized, status: http.StatusUnauthorized, err: err}
+	case errors.Is(err, identity.ErrRevoked):
+		return &rejection{reason: RejectReasonRevoked, status: http.StatusForbidden, err: err}
+	case errors.Is(err, identity.ErrCertificateExpired), errors.Is(err, identity.ErrDelegationExpired):
+		return &rejection{reason: RejectReasonExpired, status: http.StatusUnauthorized, err: err}
+	case errors.Is(err, identity.ErrDelegationScope):
+		return &rejection{reason: RejectReasonUnauthorized, status: http.StatusForbidden, err: err}
+	case errors.Is(err, ErrCertificateQuorum):
+		return &rejection{reason: RejectReasonUnauthorized, status: http.StatusUnauthorized, err: err}
+	case err == identity.ErrBadSignature:
+		return &rejection{reason: RejectReasonSignature, status: http.StatusBadRequest, message: "bad signature", err: err}
+	case err != nil:
+		n.logger.Error("verifying action", "error", err)
+		return &rejection{reason: RejectReasonError, status: http.StatusInternalServerError, err: err}
+	}
+
+	err = n.checkQuota(ctx, action)
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return &rejection{reason: RejectReasonQuota, status: http.StatusTooManyRequests, err: err}
+	case errors.Is(err, ErrStorageQuota):
+		return &rejection{reason: RejectReasonQuota, status: http.StatusInsufficientStorage, err: err}
+	case err != nil:
+		n.logger.Error("checking quota", "error", err, "identity", action.Identity)
+		return &rejection{reason: RejectReasonError, status: http.StatusInternalServerError, err: err}
+	}
+
+	return nil
+}
+
+// verifyLocalAction checks an action published here against the certificate
+// of the identity which signed it, which other nodes have to fetch
+func (n *node) verifyLocalAction(ctx context.Context, action *graph.Action) error {
+	revokedAt, err := n.store.GetRevocation(ctx, action.Identity)
+	if err != nil {
+		return fmt.Errorf("checking revocation: %w", err)
+	}
+	if revokedAt != nil {
+		return identity.ErrRevoked
+	}
+
+	if action.Certificate == nil {
+		return identity.ErrUnauthorized
+	}
+
+	err = verifySignature(action.Certificate, action)
+	if err != nil {
+		return err
+	}
+
+	return identity.CheckValidity(action.Certificate, time.Now().UTC())
+}
+
+// moderateStatement runs the moderation policies over the action's plaintext
+// statement, applies any key rotation or revocation it makes and checks a
+// profile is the signer's own
+func (n *node) moderateStatement(ctx context.Context, action *graph.Action, stmt string) error {
+	// policies look at the statement so give them the plaintext
+	moderated := *action
+	moderated.Action = stmt
+	err := n.moderateAction(&moderated)
+	action.Command = moderated.Command
+	if err == nil {
+		err = n.applyRotation(ctx, action)
+	}
+	if err == nil {
+		err = n.applyRevocation(ctx, action)
+	}
+	if err == nil {
+		err = n.checkProfile(action, time.Now().UTC())
+	}
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, identity.ErrUnauthorized) || errors.Is(err, identity.ErrBadSignature):
+		n.logger.Info("identity statement rejected", "reason", err, "id", action.ID, "identity", action.Identity)
+		return &rejection{reason: RejectReasonUnauthorized, status: http.StatusUnauthorized, err: err}
+	case errors.Is(err, model.ErrNotAcceptable):
+		n.logger.Info("action rejected", "reason", err, "id", action.ID, "identity", action.Identity)
+		return &rejection{reason: RejectReasonModeration, status: http.StatusNotAcceptable, err: err}
+	case errors.Is(err, ErrClockSkew):
+		n.logger.Info("identity statement rejected", "reason", err, "id", action.ID, "identity", action.Identity)
+		return &rejection{reason: RejectReasonClock, status: http.StatusUnprocessableEntity, err: err}
+	default:
+		n.logger.Error("moderating action", "error", err, "action", action)
+		return &rejection{reason: RejectReasonError, status: http.StatusInternalServerError, err: err}
+	}
+}
+
+// recordRejection publishes the rejection of an action which failed a check
+func (n *node) recordRejection(action graph.Action, err error) {
+	r := &rejection{}
+	if errors.As(err, &r) && r.reason != "" {
+		n.rejectAction(action, r.reason)
+	}
+}
+
+// writeRejection records the rejection of a received action and responds
+// with its status
+func (n *node) writeRejection(w http.ResponseWriter, action graph.Action, err error) {
+	n.recordRejection(action, err)
+
+	r := &rejection{}
+	if !errors.As(err, &r) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(r.status)
+	if r.message != "" {
+		w.Write([]byte(r.message))
+	}
+}
@@ -0,0 +1,38 @@
+package node
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckActionBlocks(t *testing.T) {
+	tests := map[string]struct {
+		blockedBy string
+		expected  int
+	}{
+		"operator":       {expected: http.StatusForbidden},
+		"local identity": {blockedBy: "alice", expected: http.StatusUnauthorized},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			n := newTestNode(t)
+			require.NoError(t, n.BlockIdentity(ctx, "spammer", model.BlockModeBlock, tt.blockedBy))
+
+			// only the operator's block stops the action before its
+			// signature is checked, which fails here as it has none
+			err := n.checkAction(ctx, &graph.Action{ID: "a1", Identity: "spammer", Timestamp: time.Now().UTC()}, true)
+			var r *rejection
+			require.ErrorAs(t, err, &r)
+			assert.Equal(t, tt.expected, r.status)
+		})
+	}
+}
@@ -0,0 +1,542 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+// ContentTypeNDJSON is used for streams of JSON objects, one per line
+const ContentTypeNDJSON = "application/x-ndjson"
+
+// ErrNoIdentities is returned when the API is asked to sign without an
+// identity store
+var ErrNoIdentities = errors.New("no identity store")
+
+// IdentityProvider gives the application API access to the identities it
+// publishes as
+type IdentityProvider interface {
+	GetPrimaryIdentity() (*identity.Identity, error)
+	GetIdentity(identifier string) (*identity.Identity, error)
+	CreateIdentity(handle, bio string, isPrimary bool) (*identity.Identity, error)
+	UpdateProfile(identifier, handle, bio string, publish func(id *identity.Identity) error) (*identity.Identity, error)
+}
+
+type APIPublishRequest struct {
+	Statement string `json:"statement"`
+	// Identity is the local identity to sign as, the primary identity if empty
+	Identity string `json:"identity,omitempty"`
+	// KeyID encrypts the statement with a private subscription key
+	KeyID string `json:"keyId,omitempty"`
+	// Namespace is the graph to publish to, the default graph if empty
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type APIPublishResponse struct {
+	ID string `json:"id"`
+}
+
+type APIQueryRequest struct {
+	Statement string `json:"statement"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// APIStats are the approximate number of nodes and relations with each label
+// and attribute in a graph
+type APIStats struct {
+	NodeLabels         map[string]int64 `json:"nodeLabels"`
+	NodeAttributes     map[string]int64 `json:"nodeAttributes"`
+	RelationLabels     map[string]int64 `json:"relationLabels"`
+	RelationAttributes map[string]int64 `json:"relationAttributes"`
+}
+
+// APIVisualizeRequest renders a MATCH statement's results as dot or d3, the
+// default
+type APIVisualizeRequest struct {
+	Statement string `json:"statement"`
+	Format    string `json:"format,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type APICreateIdentityRequest struct {
+	Handle  string `json:"handle"`
+	Bio     string `json:"bio"`
+	Primary bool   `json:"primary"`
+}
+
+// APIUpdateProfileRequest replaces a local identity's handle and bio
+type APIUpdateProfileRequest struct {
+	Handle string `json:"handle"`
+	Bio    string `json:"bio"`
+}
+
+// APIIdentity is the public part of a local identity
+type APIIdentity struct {
+	Identifier  string    `json:"identifier"`
+	Handle      string    `json:"handle"`
+	Bio         string    `json:"bio"`
+	CreatedAt   time.Time `json:"createdAt"`
+	IsPrimary   bool      `json:"isPrimary"`
+	Certificate string    `json:"certificate"`
+}
+
+// APIAction is an action streamed to applications. Private actions are only
+// streamed if the node holds their key, and are decrypted.
+type APIAction struct {
+	ID         string     `json:"id"`
+	Identity   string     `json:"identity"`
+	Statement  string     `json:"statement"`
+	KeyID      string     `json:"keyId,omitempty"`
+	Namespace  string     `json:"namespace,omitempty"`
+	Topics     []string   `json:"topics,omitempty"`
+	EntityIDs  []string   `json:"entityIds,omitempty"`
+	CreatedAt  *time.Time `json:"createdAt,omitempty"`
+	ReceivedAt time.Time  `json:"receivedAt"`
+}
+
+// the application API lets programs in any language use a running node as a
+// daemon. It is served on its own address, usually a unix socket, so that
+// applications don't get the admin API's operator endpoints.
+func (n *node) newAPIMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/publish", n.requireAPIToken(n.handleAPIPublish))
+	mux.Handle("POST /api/query", n.requireAPIToken(n.handleAPIQuery))
+	mux.Handle("POST /api/visualize", n.requireAPIToken(n.handleAPIVisualize))
+	mux.Handle("GET /api/actions", n.requireAPIToken(n.handleAPIActions))
+	mux.Handle("GET /api/subscriptions", n.requireAPIToken(n.handleAdminSubscriptions))
+	mux.Handle("POST /api/subscriptions/{id}", n.requireAPIToken(n.handleAdminSubscribe))
+	mux.Handle("DELETE /api/subscriptions/{id}", n.requireAPIToken(n.handleAdminUnsubscribe))
+	mux.Handle("POST /api/topics/{topic}", n.requireAPIToken(n.handleAdminSubscribeTopic))
+	mux.Handle("DELETE /api/topics/{topic}", n.requireAPIToken(n.handleAdminUnsubscribeTopic))
+	mux.Handle("GET /api/identity", n.requireAPIToken(n.handleAPIIdentity))
+	mux.Handle("GET /api/identities/{id}", n.requireAPIToken(n.handleAPIIdentity))
+	mux.Handle("POST /api/identities", n.requireAPIToken(n.handleAPICreateIdentity))
+	mux.Handle("PUT /api/identities/{id}/profile", n.requireAPIToken(n.handleAPIUpdateProfile))
+	mux.Handle("GET /api/schemas", n.requireAPIToken(n.handleAPISchemas))
+	mux.Handle("GET /api/stats", n.requireAPIToken(n.handleAPIStats))
+	mux.Handle("POST /api/schemas", n.requireAPIToken(n.handleAPIDeclareSchema))
+	mux.Handle("GET /api/feed", n.requireAPIToken(n.handleAPIFeed))
+	mux.Handle("GET /api/views", n.requireAPIToken(n.handleAPIViews))
+	mux.Handle("GET /api/views/{name}", n.requireAPIToken(n.handleAPIView))
+	mux.Handle("POST /api/views/{name}", n.requireAPIToken(n.handleAPIRegisterView))
+	mux.Handle("DELETE /api/views/{name}", n.requireAPIToken(n.handleAPIDropView))
+	if n.graphql != nil {
+		mux.Handle("GET /api/graphql", n.requireAPIToken(n.handleAPIGraphQL))
+		mux.Handle("POST /api/graphql", n.requireAPIToken(n.handleAPIGraphQL))
+	}
+	return mux
+}
+
+func (n *node) startAPIServer() (*localServer, error) {
+	if n.apiAddr == "" {
+		return nil, nil
+	}
+
+	listener, socketPath, err := listenLocal(n.apiAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on api address: %w", err)
+	}
+	if socketPath == "" && n.apiToken == "" {
+		listener.Close()
+		return nil, errors.New("an api token is required when the api listens on TCP")
+	}
+
+	n.logger.Info("starting api server", "addr", listener.Addr())
+	return n.serveLocal(listener, socketPath, n.newAPIMux()), nil
+}
+
+func (n *node) requireAPIToken(next http.HandlerFunc) http.Handler {
+	return requireToken(n.apiToken, next)
+}
+
+// readAPIRequest decodes a JSON request body, writing a bad request response
+// if it can't
+func readAPIRequest(w http.ResponseWriter, req *http.Request, v any) bool {
+	defer req.Body.Close()
+
+	err := json.NewDecoder(io.LimitReader(req.Body, MaxBodySize)).Decode(v)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("decoding request: " + err.Error()))
+		return false
+	}
+	return true
+}
+
+func (n *node) handleAPIPublish(w http.ResponseWriter, req *http.Request) {
+	body := APIPublishRequest{}
+	if !readAPIRequest(w, req, &body) {
+		return
+	}
+
+	id, ok := n.apiIdentity(w, body.Identity)
+	if !ok {
+		return
+	}
+
+	cmd, err := n.statementLimits().parseStatement(body.Statement)
+	if err == nil && cmd == nil {
+		err = errors.New("no statement")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("syntax error: " + err.Error()))
+		return
+	}
+
+	n.apiExecute(w, req, id, body.Namespace, body.Statement, body.KeyID)
+}
+
+// apiExecute signs and publishes a parsed statement for the application API
+func (n *node) apiExecute(w http.ResponseWriter, req *http.Request, id *identity.Identity, namespace, stmt, keyID string) {
+	actionID, err := n.execute(req.Context(), id, namespace, stmt, keyID)
+	r := &rejection{}
+	switch {
+	case errors.Is(err, ErrUnknownNamespace):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	case errors.Is(err, ErrUnknownSubscriptionKey):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	case errors.As(err, &r) && r.reason != "":
+		w.WriteHeader(r.status)
+		w.Write([]byte("rejected: " + r.Error()))
+		return
+	case err != nil:
+		n.logger.Error("publishing action", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	n.writeJSON(w, APIPublishResponse{ID: actionID})
+}
+
+func (n *node) handleAPIQuery(w http.ResponseWriter, req *http.Request) {
+	body := APIQueryRequest{}
+	if !readAPIRequest(w, req, &body) {
+		return
+	}
+
+	res, err := n.query(body.Namespace, body.Statement, nil)
+	if err != nil {
+		n.writeQueryError(w, req, err)
+		return
+	}
+
+	n.writeResults(w, req, res)
+}
+
+// handleAPIStats returns the label and attribute counts of the graph given by
+// the namespace parameter
+func (n *node) handleAPIStats(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+
+	executor, err := n.graphFor(namespace)
+	if err != nil {
+		n.writeQueryError(w, req, err)
+		return
+	}
+
+	stats, err := executor.Stats()
+	if err != nil {
+		n.logger.Error("reading stats", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	n.writeJSON(w, APIStats{
+		NodeLabels:         stats.NodeLabels,
+		NodeAttributes:     stats.NodeAttributes,
+		RelationLabels:     stats.RelationLabels,
+		RelationAttributes: stats.RelationAttributes,
+	})
+}
+
+// handleAPIActions streams the actions the node accepts from peers as they
+// arrive, one JSON object per line, until the client disconnects. Actions can
+// be limited to those with a topic matching a path.Match pattern or touching
+// an entity, given by repeating the topic and entity parameters.
+func (n *node) handleAPIActions(w http.ResponseWriter, req *http.Request) {
+	patterns := req.URL.Query()["topic"]
+	for _, p := range patterns {
+		_, err := path.Match(p, "")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("topic pattern %q: %s", p, err)))
+			return
+		}
+	}
+	entities := req.URL.Query()["entity"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	events := n.events.Subscribe()
+	defer n.events.Unsubscribe(events)
+
+	w.Header().Set(HeaderContentType, ContentTypeNDJSON)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-n.ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			accepted, ok := e.(ActionAccepted)
+			if !ok {
+				continue
+			}
+
+			action, ok := n.apiAction(accepted)
+			if !ok || !matchesAPIFilter(action, patterns, entities) {
+				continue
+			}
+
+			err := enc.Encode(action)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// apiAction returns an accepted action as streamed to applications, false if
+// it is private and can't be read
+func (n *node) apiAction(e ActionAccepted) (APIAction, bool) {
+	action := e.Action
+	if action.Command == nil {
+		return APIAction{}, false
+	}
+
+	stmt := action.Action
+	if action.KeyID != "" {
+		plaintext, ok, err := n.subscriptionKeys.Open(action.KeyID, action.Action)
+		if err != nil || !ok {
+			return APIAction{}, false
+		}
+		stmt = plaintext
+	}
+
+	return APIAction{
+		ID:         action.ID,
+		Identity:   action.Identity,
+		Statement:  stmt,
+		KeyID:      action.KeyID,
+		Namespace:  action.Namespace,
+		Topics:     ast.Topics(action.Command),
+		EntityIDs:  action.EntityIDs,
+		CreatedAt:  action.CreatedAt,
+		ReceivedAt: e.At,
+	}, true
+}
+
+// matchesAPIFilter reports whether the action has a topic matching one of the
+// patterns or touches one of the entities. Empty filters match everything.
+func matchesAPIFilter(action APIAction, patterns, entities []string) bool {
+	if len(patterns) == 0 && len(entities) == 0 {
+		return true
+	}
+
+	for _, id := range entities {
+		if slices.Contains(action.EntityIDs, id) {
+			return true
+		}
+	}
+
+	for _, p := range patterns {
+		for _, t := range action.Topics {
+			if ok, _ := path.Match(p, t); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (n *node) handleAPIIdentity(w http.ResponseWriter, req *http.Request) {
+	id, ok := n.apiIdentity(w, req.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	n.writeJSON(w, apiIdentityFor(id))
+}
+
+// handleAPICreateIdentity creates a local identity and publishes its
+// certificate so that other nodes can verify its actions
+func (n *node) handleAPICreateIdentity(w http.ResponseWriter, req *http.Request) {
+	if n.identities == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(ErrNoIdentities.Error()))
+		return
+	}
+
+	body := APICreateIdentityRequest{}
+	if !readAPIRequest(w, req, &body) {
+		return
+	}
+	if body.Handle == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("no handle"))
+		return
+	}
+
+	id, err := n.identities.CreateIdentity(body.Handle, body.Bio, body.Primary)
+	if err != nil {
+		n.logger.Error("creating identity", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = n.PublishIdentity(req.Context(), id)
+	if err != nil {
+		n.logger.Error("publishing identity", "error", err, "identity", id.Identifier)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	n.writeJSON(w, apiIdentityFor(id))
+}
+
+// handleAPIUpdateProfile changes a local identity's handle and bio and
+// publishes them
+func (n *node) handleAPIUpdateProfile(w http.ResponseWriter, req *http.Request) {
+	id, ok := n.apiIdentity(w, req.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	body := APIUpdateProfileRequest{}
+	if !readAPIRequest(w, req, &body) {
+		return
+	}
+	if body.Handle == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("no handle"))
+		return
+	}
+
+	// the statement is checked before anything is changed
+	updated := *id
+	updated.Handle, updated.Bio = body.Handle, body.Bio
+	_, err := IdentityStatement(&updated)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	profile, err := n.identities.UpdateProfile(id.Identifier, body.Handle, body.Bio, func(id *identity.Identity) error {
+		return n.PublishIdentity(req.Context(), id)
+	})
+	if err != nil {
+		n.logger.Error("updating profile", "error", err, "identity", id.Identifier)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	n.writeJSON(w, apiIdentityFor(profile))
+}
+
+// apiIdentity loads a local identity, the primary one if identifier is empty,
+// writing an error response if it can't
+func (n *node) apiIdentity(w http.ResponseWriter, identifier string) (*identity.Identity, bool) {
+	id, err := n.localIdentity(identifier)
+	switch {
+	case errors.Is(err, ErrNoIdentities):
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(err.Error()))
+		return nil, false
+	case errors.Is(err, model.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		n.logger.Error("fetching identity", "error", err, "identity", identifier)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	return id, true
+}
+
+// localIdentity loads an identity from the identity store, the primary one if
+// identifier is empty
+func (n *node) localIdentity(identifier string) (*identity.Identity, error) {
+	if n.identities == nil {
+		return nil, ErrNoIdentities
+	}
+
+	var id *identity.Identity
+	var err error
+	if identifier == "" {
+		id, err = n.identities.GetPrimaryIdentity()
+	} else {
+		id, err = n.identities.GetIdentity(identifier)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if id.Certificate == nil {
+		id.Certificate, err = x509.ParseCertificate(id.CertificateData)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate: %w", err)
+		}
+	}
+
+	return id, nil
+}
+
+func apiIdentityFor(id *identity.Identity) APIIdentity {
+	return APIIdentity{
+		Identifier:  id.Identifier,
+		Handle:      id.Handle,
+		Bio:         id.Bio,
+		CreatedAt:   id.CreatedAt,
+		IsPrimary:   id.IsPrimary,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: id.CertificateData})),
+	}
+}
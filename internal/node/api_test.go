@@ -0,0 +1,157 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAPI returns a node serving the application API with a primary
+// identity and its token
+func newTestAPI(t *testing.T) (*node, *identity.Identity, *httptest.Server) {
+	store, err := identity.NewStore("file:" + t.Name() + ".db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	svc, err := identity.NewService(store)
+	require.NoError(t, err)
+	id, err := svc.CreateIdentity("alice", "", true)
+	require.NoError(t, err)
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	t.Cleanup(cancelFn)
+
+	n := newTestNode(t)
+	n.ctx = ctx
+	n.identities = svc
+	n.apiToken = "secret"
+	n.limits = StatementLimits{}.withDefaults()
+	n.events = newEventBus()
+	t.Cleanup(n.events.Close)
+	n.subscriptionKeys, err = newSubscriptionKeyring(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(n.newAPIMux())
+	t.Cleanup(server.Close)
+	return n, id, server
+}
+
+func apiRequest(t *testing.T, server *httptest.Server, method, path, token, body string) *http.Response {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set(HeaderAuthorization, "Bearer "+token)
+	}
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAPIRequests(t *testing.T) {
+	_, id, server := newTestAPI(t)
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{name: "no token", method: "GET", path: "/api/identity", status: http.StatusUnauthorized},
+		{name: "wrong token", method: "GET", path: "/api/identity", token: "guess", status: http.StatusUnauthorized},
+		{name: "primary identity", method: "GET", path: "/api/identity", token: "secret", status: http.StatusOK},
+		{name: "identity", method: "GET", path: "/api/identities/" + id.Identifier, token: "secret", status: http.StatusOK},
+		{name: "unknown identity", method: "GET", path: "/api/identities/nobody", token: "secret", status: http.StatusNotFound},
+		{name: "publish bad json", method: "POST", path: "/api/publish", token: "secret", body: "{", status: http.StatusBadRequest},
+		{name: "publish bad statement", method: "POST", path: "/api/publish", token: "secret", body: `{"statement": "MERGE (p:Post"}`, status: http.StatusBadRequest},
+		{name: "publish nothing", method: "POST", path: "/api/publish", token: "secret", body: `{"statement": ""}`, status: http.StatusBadRequest},
+		{name: "publish as unknown identity", method: "POST", path: "/api/publish", token: "secret", body: `{"statement": "MERGE (p:Post{id:'1'})", "identity": "nobody"}`, status: http.StatusNotFound},
+		{name: "identity without handle", method: "POST", path: "/api/identities", token: "secret", body: `{"bio": "anon"}`, status: http.StatusBadRequest},
+		{name: "profile without handle", method: "PUT", path: "/api/identities/" + id.Identifier + "/profile", token: "secret", body: `{"bio": "anon"}`, status: http.StatusBadRequest},
+		{name: "profile with quotes", method: "PUT", path: "/api/identities/" + id.Identifier + "/profile", token: "secret", body: `{"handle": "o'brien"}`, status: http.StatusBadRequest},
+		{name: "bad topic pattern", method: "GET", path: "/api/actions?topic=%5B", token: "secret", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := apiRequest(t, server, tc.method, tc.path, tc.token, tc.body)
+			assert.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+
+	// identities are returned with their certificate but not their key
+	resp := apiRequest(t, server, "GET", "/api/identity", "secret", "")
+	got := map[string]any{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	assert.Equal(t, id.Identifier, got["identifier"])
+	assert.Equal(t, true, got["isPrimary"])
+	assert.Contains(t, got["certificate"], "BEGIN CERTIFICATE")
+	assert.NotContains(t, got, "privateKey")
+}
+
+func TestAPIActions(t *testing.T) {
+	n, _, server := newTestAPI(t)
+
+	resp := apiRequest(t, server, "GET", "/api/actions?topic=Tag:*&entity=p1", "secret", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ContentTypeNDJSON, resp.Header.Get(HeaderContentType))
+
+	publish := func(id, stmt, keyID string, entityIDs ...string) {
+		p, err := ast.Parse(stmt)
+		require.NoError(t, err)
+		n.events.Publish(ActionAccepted{At: time.Now().UTC(), Action: graph.Action{
+			ID:        id,
+			Identity:  "alice",
+			Action:    stmt,
+			Command:   p.Command(),
+			KeyID:     keyID,
+			EntityIDs: entityIDs,
+		}})
+	}
+	publish("untagged", "MERGE (p:Post{id:'p2'})", "", "p2")
+	// private actions the node can't read aren't streamed
+	publish("private", "MERGE (t:Tag{value:'go'})", "friends")
+	publish("tagged", "MERGE (t:Tag{value:'go'})", "")
+	publish("entity", "MERGE (p:Post{id:'p1'})", "", "p1")
+
+	lines := bufio.NewScanner(resp.Body)
+	ids := []string{}
+	for len(ids) < 2 && lines.Scan() {
+		action := APIAction{}
+		require.NoError(t, json.Unmarshal(lines.Bytes(), &action))
+		ids = append(ids, action.ID)
+	}
+	assert.Equal(t, []string{"tagged", "entity"}, ids)
+}
+
+func TestMatchesAPIFilter(t *testing.T) {
+	action := APIAction{Topics: []string{"Post", "Tag:value=golang"}, EntityIDs: []string{"p1"}}
+
+	tests := []struct {
+		patterns []string
+		entities []string
+		expected bool
+	}{
+		{expected: true},
+		{patterns: []string{"Tag:*"}, expected: true},
+		{patterns: []string{"Tag"}, expected: false},
+		{entities: []string{"p1"}, expected: true},
+		{entities: []string{"p2"}, expected: false},
+		{patterns: []string{"Person"}, entities: []string{"p1"}, expected: true},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, matchesAPIFilter(action, tt.patterns, tt.entities), "%v %v", tt.patterns, tt.entities)
+	}
+}
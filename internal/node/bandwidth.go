@@ -0,0 +1,302 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// bandwidthChunk is the most bytes of a response written at once, so
+	// that a large backfill is paced rather than sent in one burst
+	bandwidthChunk = 16 * 1024
+	// bandwidthIdle is how long a peer's limits are kept after its last
+	// request, by when its byte allowance would have refilled anyway
+	bandwidthIdle = time.Minute
+)
+
+// errBandwidthWait is returned when the bytes can't be sent before the
+// context's deadline
+var errBandwidthWait = errors.New("bandwidth limit would exceed deadline")
+
+// BandwidthConfig is read from the bandwidth section of the config file. It
+// limits what the node sends when propagating actions and serving backfill,
+// so that a node with a small uplink keeps up with everything else during a
+// burst of actions. Peers are told apart by host, zero values don't limit.
+type BandwidthConfig struct {
+	// MaxRequests is the most propagation and backfill requests in flight
+	// at once. Backfill requests over the limit are refused with 429.
+	MaxRequests int `mapstructure:"max_requests"`
+	// MaxPeerRequests is the most in flight to or from any one peer
+	MaxPeerRequests int `mapstructure:"max_peer_requests"`
+	// BytesPerSecond is the most bytes of actions sent each second
+	BytesPerSecond int `mapstructure:"bytes_per_second"`
+	// PeerBytesPerSecond is the most sent to any one peer each second
+	PeerBytesPerSecond int `mapstructure:"peer_bytes_per_second"`
+}
+
+func (c BandwidthConfig) validate(check *configCheck) {
+	nonNegative(check, "max_requests", c.MaxRequests)
+	nonNegative(check, "max_peer_requests", c.MaxPeerRequests)
+	nonNegative(check, "bytes_per_second", c.BytesPerSecond)
+	nonNegative(check, "peer_bytes_per_second", c.PeerBytesPerSecond)
+}
+
+// byteLimiter is a token bucket holding up to a second's worth of bytes.
+// Sending more than there are tokens for borrows against the future, so
+// later sends wait for the debt to be paid off.
+type byteLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteLimiter(rate int) *byteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes n bytes and returns how long to wait before sending them.
+// The caller must hold the bandwidth lock.
+func (l *byteLimiter) reserve(now time.Time, n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel returns bytes reserved but not sent
+func (l *byteLimiter) cancel(n int) {
+	if l != nil {
+		l.tokens += float64(n)
+	}
+}
+
+// peerBandwidth is one peer's share of the limits
+type peerBandwidth struct {
+	requests int
+	bytes    *byteLimiter
+	lastUsed time.Time
+}
+
+// bandwidth enforces the node's BandwidthConfig. A nil bandwidth doesn't
+// limit anything.
+type bandwidth struct {
+	config  BandwidthConfig
+	metrics *nodeMetrics
+
+	mu        sync.Mutex
+	freed     *sync.Cond
+	requests  int
+	bytes     *byteLimiter
+	peers     map[string]*peerBandwidth
+	lastSweep time.Time
+}
+
+// newBandwidth returns nil unless the config sets a limit
+func newBandwidth(config BandwidthConfig, metrics *nodeMetrics) *bandwidth {
+	if config == (BandwidthConfig{}) {
+		return nil
+	}
+	b := &bandwidth{
+		config:    config,
+		metrics:   metrics,
+		bytes:     newByteLimiter(config.BytesPerSecond),
+		peers:     map[string]*peerBandwidth{},
+		lastSweep: time.Now(),
+	}
+	b.freed = sync.NewCond(&b.mu)
+	return b
+}
+
+// peerHost is the key a peer's limits are kept under, its host so that
+// every connection from one machine shares them
+func peerHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// peer returns a peer's limits, forgetting those of peers idle long enough
+// for their allowance to have refilled. The caller must hold the lock.
+func (b *bandwidth) peer(remoteAddr string, now time.Time) *peerBandwidth {
+	if now.Sub(b.lastSweep) > bandwidthIdle {
+		for host, p := range b.peers {
+			if p.requests == 0 && now.Sub(p.lastUsed) > bandwidthIdle {
+				delete(b.peers, host)
+			}
+		}
+		b.lastSweep = now
+	}
+
+	host := peerHost(remoteAddr)
+	p, ok := b.peers[host]
+	if !ok {
+		p = &peerBandwidth{bytes: newByteLimiter(b.config.PeerBytesPerSecond)}
+		b.peers[host] = p
+	}
+	p.lastUsed = now
+	return p
+}
+
+// available reports whether another request to or from the peer is allowed.
+// The caller must hold the lock.
+func (b *bandwidth) available(p *peerBandwidth) bool {
+	return (b.config.MaxRequests == 0 || b.requests < b.config.MaxRequests) &&
+		(b.config.MaxPeerRequests == 0 || p.requests < b.config.MaxPeerRequests)
+}
+
+// acquire waits until a request to the peer is allowed, returning a function
+// which ends it
+func (b *bandwidth) acquire(ctx context.Context, remoteAddr string) (func(), error) {
+	if b == nil {
+		return func() {}, nil
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.freed.Broadcast()
+	})
+	defer stop()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.peer(remoteAddr, time.Now())
+	for !b.available(p) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		b.freed.Wait()
+	}
+	return b.start(p), nil
+}
+
+// tryAcquire starts a request from the peer if one is allowed now
+func (b *bandwidth) tryAcquire(remoteAddr string) (func(), bool) {
+	if b == nil {
+		return func() {}, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.peer(remoteAddr, time.Now())
+	if !b.available(p) {
+		return nil, false
+	}
+	return b.start(p), true
+}
+
+// start counts a request against the limits. The caller must hold the lock.
+func (b *bandwidth) start(p *peerBandwidth) func() {
+	b.requests++
+	p.requests++
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.requests--
+			p.requests--
+			p.lastUsed = time.Now()
+			b.freed.Broadcast()
+		})
+	}
+}
+
+// wait blocks until n more bytes can be sent to the peer. Bytes which
+// couldn't be sent before the context's deadline aren't taken.
+func (b *bandwidth) wait(ctx context.Context, remoteAddr string, n int) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	p := b.peer(remoteAddr, now)
+	delay := max(b.bytes.reserve(now, n), p.bytes.reserve(now, n))
+	if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+		b.bytes.cancel(n)
+		p.bytes.cancel(n)
+		b.mu.Unlock()
+		return errBandwidthWait
+	}
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	b.metrics.throttleSeconds.Add(delay.Seconds())
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledWriter paces a response to a peer to the bandwidth limits
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx        context.Context
+	bandwidth  *bandwidth
+	remoteAddr string
+}
+
+// writer returns w paced to the limits for the peer
+func (b *bandwidth) writer(ctx context.Context, w http.ResponseWriter, remoteAddr string) http.ResponseWriter {
+	if b == nil || (b.config.BytesPerSecond == 0 && b.config.PeerBytesPerSecond == 0) {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: ctx, bandwidth: b, remoteAddr: remoteAddr}
+}
+
+func (w *throttledWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		chunk := data[:min(len(data), bandwidthChunk)]
+		err := w.bandwidth.wait(w.ctx, w.remoteAddr, len(chunk))
+		if err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		data = data[len(chunk):]
+	}
+	return written, nil
+}
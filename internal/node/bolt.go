@@ -0,0 +1,417 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/bolt"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+// BoltDefaultUser is the user name Neo4j tools log in with by default. It,
+// or no user name, signs statements as the primary identity.
+const BoltDefaultUser = "neo4j"
+
+// boltBackend lets Neo4j drivers and tools use the node. Clients log in
+// with the API token as the password and a local identity as the user name.
+// MATCH statements are queried and others published as that identity. A
+// trailing RETURN clause picks the identifiers returned, Cypher's other
+// clauses aren't supported.
+type boltBackend struct {
+	n *node
+}
+
+func (n *node) startBoltServer() (io.Closer, error) {
+	if n.boltAddr == "" {
+		return nil, nil
+	}
+	if n.apiToken == "" {
+		return nil, errors.New("an api token is required for the bolt server")
+	}
+
+	listener, err := net.Listen("tcp", n.boltAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on bolt address: %w", err)
+	}
+
+	n.logger.Info("starting bolt server", "addr", listener.Addr())
+	s := bolt.NewServer(&boltBackend{n: n}, n.logger)
+	go func() {
+		err := s.Serve(listener)
+		if err != nil {
+			n.logger.Error("closing bolt server", "error", err)
+		}
+	}()
+
+	return s, nil
+}
+
+func (b *boltBackend) Authenticate(scheme, principal, credentials string) (string, error) {
+	if scheme != "basic" || subtle.ConstantTimeCompare([]byte(credentials), []byte(b.n.apiToken)) != 1 {
+		return "", &bolt.Error{Code: bolt.CodeUnauthorized, Message: "the password must be the api token"}
+	}
+
+	if principal == BoltDefaultUser {
+		principal = ""
+	}
+	if principal != "" {
+		_, err := b.n.localIdentity(principal)
+		if err != nil {
+			return "", &bolt.Error{Code: bolt.CodeUnauthorized, Message: fmt.Sprintf("%s isn't a local identity", principal)}
+		}
+	}
+
+	return principal, nil
+}
+
+func (b *boltBackend) Run(ctx context.Context, user, query string, params map[string]any) (*bolt.Result, error) {
+	stmt, ret, err := translateCypher(query, params)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := b.n.statementLimits().parseStatement(stmt)
+	if err == nil && cmd == nil {
+		err = errors.New("no statement")
+	}
+	switch {
+	case errors.Is(err, ErrStatementLimit):
+		return nil, &bolt.Error{Code: bolt.CodeArgumentError, Message: err.Error()}
+	case err != nil:
+		return nil, &bolt.Error{Code: bolt.CodeSyntaxError, Message: err.Error()}
+	}
+
+	if cmd.Type() != ast.EntityTypeMatchCmd {
+		return b.publish(ctx, user, stmt)
+	}
+
+	results, err := b.n.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.records(results.Bindings(), ret)
+}
+
+func (b *boltBackend) publish(ctx context.Context, user, stmt string) (*bolt.Result, error) {
+	id, err := b.n.localIdentity(user)
+	switch {
+	case errors.Is(err, ErrNoIdentities), errors.Is(err, model.ErrNotFound):
+		return nil, &bolt.Error{Code: bolt.CodeForbidden, Message: "there is no identity to publish as"}
+	case err != nil:
+		return nil, err
+	}
+
+	_, err = b.n.execute(ctx, id, "", stmt, "")
+	if err != nil {
+		return nil, fmt.Errorf("publishing action: %w", err)
+	}
+
+	return &bolt.Result{Write: true}, nil
+}
+
+// records turns the bindings of a match into rows of the returned
+// identifiers, all of them if there was no RETURN clause
+func (b *boltBackend) records(bindings map[string][]any, ret *cypherReturn) (*bolt.Result, error) {
+	items := []cypherReturnItem{}
+	if ret == nil || ret.all {
+		names := []string{}
+		for name := range bindings {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			items = append(items, cypherReturnItem{name: name, alias: name})
+		}
+	} else {
+		for _, item := range ret.items {
+			if _, ok := bindings[item.name]; !ok || item.name == "" {
+				return nil, &bolt.Error{Code: bolt.CodeSyntaxError, Message: fmt.Sprintf("%s isn't defined", item.name)}
+			}
+			items = append(items, item)
+		}
+	}
+
+	res := &bolt.Result{Fields: make([]string, len(items))}
+	rows := -1
+	for i, item := range items {
+		res.Fields[i] = item.alias
+		if rows < 0 || len(bindings[item.name]) < rows {
+			rows = len(bindings[item.name])
+		}
+	}
+	if ret != nil && ret.limit >= 0 {
+		rows = min(rows, ret.limit)
+	}
+
+	converted := map[string]any{}
+	for row := range max(rows, 0) {
+		record := make([]any, len(items))
+		for i, item := range items {
+			v, err := b.value(bindings[item.name][row], converted)
+			if err != nil {
+				return nil, err
+			}
+			record[i] = v
+		}
+		res.Records = append(res.Records, record)
+	}
+
+	return res, nil
+}
+
+// value converts a matched node or relation to its bolt structure
+func (b *boltBackend) value(v any, converted map[string]any) (any, error) {
+	switch rec := v.(type) {
+	case *graph.NodeRecord:
+		if c, ok := converted[rec.ID]; ok {
+			return c, nil
+		}
+		node := &bolt.Node{
+			ID:         boltID(rec.ID),
+			ElementID:  rec.ID,
+			Labels:     rec.Labels,
+			Properties: boltProperties(rec.Attributes),
+		}
+		if node.Labels == nil {
+			node.Labels = []string{}
+		}
+		converted[rec.ID] = node
+		return node, nil
+	case *graph.RelationRecord:
+		if c, ok := converted[rec.ID]; ok {
+			return c, nil
+		}
+		start, end := rec.LeftNodeID, rec.RightNodeID
+		if rec.Direction == ast.RelationDirLeft {
+			start, end = end, start
+		}
+		rel := &bolt.Relationship{
+			ID:             boltID(rec.ID),
+			ElementID:      rec.ID,
+			StartID:        boltID(start),
+			StartElementID: start,
+			EndID:          boltID(end),
+			EndElementID:   end,
+			Properties:     boltProperties(rec.Attributes),
+		}
+		if len(rec.Labels) > 0 {
+			rel.Type = rec.Labels[0]
+		}
+		converted[rec.ID] = rel
+		return rel, nil
+	}
+	return nil, nil
+}
+
+// boltID is the integer ID of an entity, its snowflake ID if it has one
+func boltID(id string) int64 {
+	sf, err := snowflake.ParseBase58([]byte(id))
+	if err == nil {
+		return sf.Int64()
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return int64(h.Sum64() & math.MaxInt64)
+}
+
+// boltProperties returns whole numbers as integers as Neo4j would
+func boltProperties(attrs map[string]any) map[string]any {
+	props := make(map[string]any, len(attrs))
+	for k, v := range attrs {
+		if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			v = int64(f)
+		}
+		props[k] = v
+	}
+	return props
+}
+
+type cypherReturnItem struct {
+	name  string
+	alias string
+}
+
+type cypherReturn struct {
+	all   bool
+	items []cypherReturnItem
+	limit int
+}
+
+// translateCypher substitutes parameters into a statement as literals and
+// splits off a trailing RETURN clause
+func translateCypher(query string, params map[string]any) (string, *cypherReturn, error) {
+	stmt, err := substituteParams(strings.TrimSuffix(strings.TrimSpace(query), ";"), params)
+	if err != nil {
+		return "", nil, err
+	}
+
+	i := findKeyword(stmt, "RETURN")
+	if i < 0 {
+		return stmt, nil, nil
+	}
+
+	ret, err := parseReturn(stmt[i+len("RETURN"):])
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSpace(stmt[:i]), ret, nil
+}
+
+func parseReturn(clause string) (*cypherReturn, error) {
+	ret := &cypherReturn{limit: -1}
+
+	if i := findKeyword(clause, "LIMIT"); i >= 0 {
+		limit, err := strconv.Atoi(strings.TrimSpace(clause[i+len("LIMIT"):]))
+		if err != nil || limit < 0 {
+			return nil, &bolt.Error{Code: bolt.CodeSyntaxError, Message: "LIMIT must be a number"}
+		}
+		ret.limit = limit
+		clause = clause[:i]
+	}
+
+	for _, item := range strings.Split(clause, ",") {
+		fields := strings.Fields(item)
+		switch {
+		case len(fields) == 1 && fields[0] == "*":
+			ret.all = true
+		case len(fields) == 1 && isCypherIdentifier(fields[0]):
+			ret.items = append(ret.items, cypherReturnItem{name: fields[0], alias: fields[0]})
+		case len(fields) == 3 && strings.EqualFold(fields[1], "AS") && isCypherIdentifier(fields[0]) && isCypherIdentifier(fields[2]):
+			ret.items = append(ret.items, cypherReturnItem{name: fields[0], alias: fields[2]})
+		default:
+			return nil, &bolt.Error{Code: bolt.CodeSyntaxError, Message: fmt.Sprintf("only identifiers can be returned, got %q", strings.TrimSpace(item))}
+		}
+	}
+
+	return ret, nil
+}
+
+func isCypherIdentifier(s string) bool {
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// findKeyword returns the index of the last whole word keyword outside of
+// quotes, or -1
+func findKeyword(s, keyword string) int {
+	found := -1
+	scanUnquoted(s, func(i int) int {
+		end := i + len(keyword)
+		if end <= len(s) && strings.EqualFold(s[i:end], keyword) &&
+			(i == 0 || !isWordByte(s[i-1])) && (end == len(s) || !isWordByte(s[end])) {
+			found = i
+			return end
+		}
+		return i + 1
+	})
+	return found
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b == '$' || (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// scanUnquoted calls fn with the index of each byte outside of quoted
+// strings. fn returns the index to carry on from.
+func scanUnquoted(s string, fn func(i int) int) {
+	var quote byte
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i += 2
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			i++
+		case c == '\'' || c == '"':
+			quote = c
+			i++
+		default:
+			i = fn(i)
+		}
+	}
+}
+
+// substituteParams replaces $name parameters with literals
+func substituteParams(stmt string, params map[string]any) (string, error) {
+	out := strings.Builder{}
+	last := 0
+	var err error
+	scanUnquoted(stmt, func(i int) int {
+		if stmt[i] != '$' || err != nil {
+			return i + 1
+		}
+		end := i + 1
+		for end < len(stmt) && isWordByte(stmt[end]) && stmt[end] != '$' {
+			end++
+		}
+		name := stmt[i+1 : end]
+		v, ok := params[name]
+		if !ok {
+			err = &bolt.Error{Code: "Neo.ClientError.Statement.ParameterMissing", Message: fmt.Sprintf("expected parameter $%s", name)}
+			return end
+		}
+
+		var literal string
+		switch v := v.(type) {
+		case string:
+			literal = ast.Quote(v)
+		case int64:
+			literal = strconv.FormatInt(v, 10)
+		case float64:
+			literal = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			err = &bolt.Error{Code: bolt.CodeArgumentError, Message: fmt.Sprintf("$%s is a %T, only strings and numbers are supported", name, v)}
+			return end
+		}
+
+		out.WriteString(stmt[last:i])
+		out.WriteString(literal)
+		last = end
+		return end
+	})
+	if err != nil {
+		return "", err
+	}
+
+	out.WriteString(stmt[last:])
+	return out.String(), nil
+}
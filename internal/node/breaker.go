@@ -0,0 +1,216 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailures    = 3
+	defaultBreakerCooldown    = 30 * time.Second
+	defaultBreakerMaxCooldown = 10 * time.Minute
+)
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+// BreakerConfig is read from the breaker section of the config file. Zero
+// values use the defaults.
+type BreakerConfig struct {
+	// Failures is how many requests in a row to a node can fail before
+	// requests to it are short circuited
+	Failures int `mapstructure:"failures"`
+	// Cooldown is how long the circuit stays open before a probe request is
+	// let through. It doubles each time the probe fails.
+	Cooldown time.Duration `mapstructure:"cooldown"`
+	// MaxCooldown caps the cooldown
+	MaxCooldown time.Duration `mapstructure:"max_cooldown"`
+}
+
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.Failures == 0 {
+		c.Failures = defaultBreakerFailures
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = defaultBreakerCooldown
+	}
+	if c.MaxCooldown == 0 {
+		c.MaxCooldown = defaultBreakerMaxCooldown
+	}
+	c.MaxCooldown = max(c.MaxCooldown, c.Cooldown)
+	return c
+}
+
+func (c BreakerConfig) validate(check *configCheck) {
+	nonNegative(check, "failures", c.Failures)
+	nonNegative(check, "cooldown", c.Cooldown)
+	nonNegative(check, "max_cooldown", c.MaxCooldown)
+}
+
+// breakerState tracks a node whose requests have been failing. Nodes which
+// are answering have no state.
+type breakerState struct {
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+	probing   bool
+}
+
+// circuitBreaker fails requests to unreachable nodes straight away rather
+// than waiting for every one to time out. Once a node has failed enough times
+// in a row its circuit opens. After the cooldown a single probe request is let
+// through (half open), closing the circuit if it succeeds.
+type circuitBreaker struct {
+	mu      sync.Mutex
+	next    http.RoundTripper
+	config  BreakerConfig
+	hosts   map[string]*breakerState
+	logger  *slog.Logger
+	metrics *nodeMetrics
+}
+
+func newCircuitBreaker(next http.RoundTripper, config BreakerConfig, logger *slog.Logger, metrics *nodeMetrics) *circuitBreaker {
+	return &circuitBreaker{
+		next:    next,
+		config:  config,
+		hosts:   map[string]*breakerState{},
+		logger:  logger,
+		metrics: metrics,
+	}
+}
+
+func (b *circuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+
+	err := b.allow(host)
+	if err != nil {
+		b.metrics.breakerRejections.Inc()
+		return nil, err
+	}
+
+	resp, err := b.next.RoundTrip(req)
+	if err != nil {
+		// the caller gave up, which says nothing about the remote node
+		if errors.Is(req.Context().Err(), context.Canceled) {
+			b.release(host)
+			return nil, err
+		}
+		b.failure(host)
+		return nil, err
+	}
+
+	b.success(host)
+	return resp, nil
+}
+
+// allow returns ErrCircuitOpen if requests to the host should not be sent
+func (b *circuitBreaker) allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.hosts[host]
+	if !ok || s.failures < b.config.Failures {
+		return nil
+	}
+
+	if s.probing || time.Now().Before(s.openUntil) {
+		return fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+	}
+
+	s.probing = true
+	b.logger.Debug("probing circuit", "remote", host)
+	return nil
+}
+
+func (b *circuitBreaker) success(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.hosts[host]
+	if !ok {
+		return
+	}
+
+	if s.failures >= b.config.Failures {
+		b.logger.Info("circuit closed", "remote", host)
+	}
+	delete(b.hosts, host)
+}
+
+func (b *circuitBreaker) failure(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.hosts[host]
+	if !ok {
+		s = &breakerState{}
+		b.hosts[host] = s
+	}
+
+	s.failures++
+	if s.failures < b.config.Failures {
+		return
+	}
+
+	// a failed probe backs off further
+	if s.probing {
+		s.cooldown = min(s.cooldown*2, b.config.MaxCooldown)
+	} else {
+		s.cooldown = b.config.Cooldown
+		b.metrics.breakerTrips.Inc()
+		b.logger.Info("circuit opened", "remote", host, "failures", s.failures)
+	}
+	s.probing = false
+	s.openUntil = time.Now().Add(s.cooldown)
+}
+
+// release lets another probe through if an abandoned request was the probe
+func (b *circuitBreaker) release(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s, ok := b.hosts[host]; ok {
+		s.probing = false
+	}
+}
+
+// Forget drops the state kept for a host, e.g. when it leaves the network
+func (b *circuitBreaker) Forget(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.hosts, host)
+}
+
+// CountOfOpen returns the number of hosts whose circuit is open or half open
+func (b *circuitBreaker) CountOfOpen() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := 0
+	for _, s := range b.hosts {
+		if s.failures >= b.config.Failures {
+			count++
+		}
+	}
+	return count
+}
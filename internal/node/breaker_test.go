@@ -0,0 +1,213 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const breakerTestHost = "10.0.0.2:9000"
+
+// expireCooldown ends the cooldown of every open circuit now rather than
+// waiting for it
+func (b *circuitBreaker) expireCooldown() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.hosts {
+		s.openUntil = time.Now()
+	}
+}
+
+func (b *circuitBreaker) cooldown(host string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.hosts[host]; ok {
+		return s.cooldown
+	}
+	return 0
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	config := BreakerConfig{Failures: 2, Cooldown: time.Minute, MaxCooldown: 3 * time.Minute}
+
+	type step struct {
+		// expire ends the cooldown before the request is made
+		expire bool
+		// outcome is how the next transport answers: ok, fail or cancel
+		outcome string
+		// open means the request is short circuited before the transport
+		open     bool
+		cooldown time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		trips int
+	}{
+		{
+			name: "trips after consecutive failures",
+			steps: []step{
+				{outcome: "fail"},
+				{outcome: "fail", cooldown: time.Minute},
+				{outcome: "ok", open: true, cooldown: time.Minute},
+				{outcome: "ok", open: true, cooldown: time.Minute},
+			},
+			trips: 1,
+		},
+		{
+			name: "success resets the count",
+			steps: []step{
+				{outcome: "fail"},
+				{outcome: "ok"},
+				{outcome: "fail"},
+				{outcome: "ok"},
+			},
+		},
+		{
+			name: "failed probes double the cooldown up to the max",
+			steps: []step{
+				{outcome: "fail"},
+				{outcome: "fail", cooldown: time.Minute},
+				{expire: true, outcome: "fail", cooldown: 2 * time.Minute},
+				{outcome: "ok", open: true, cooldown: 2 * time.Minute},
+				{expire: true, outcome: "fail", cooldown: 3 * time.Minute},
+				{expire: true, outcome: "fail", cooldown: 3 * time.Minute},
+				{expire: true, outcome: "ok"},
+				{outcome: "fail"},
+			},
+			trips: 1,
+		},
+		{
+			name: "cancelled requests are not failures",
+			steps: []step{
+				{outcome: "cancel"},
+				{outcome: "cancel"},
+				{outcome: "cancel"},
+				{outcome: "ok"},
+			},
+		},
+		{
+			name: "cancelled probe lets another through",
+			steps: []step{
+				{outcome: "fail"},
+				{outcome: "fail", cooldown: time.Minute},
+				{expire: true, outcome: "cancel", cooldown: time.Minute},
+				{outcome: "ok"},
+			},
+			trips: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newTestNode(t)
+			var outcome string
+			calls := 0
+			next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				calls++
+				switch outcome {
+				case "fail":
+					return nil, errors.New("connection refused")
+				case "cancel":
+					return nil, req.Context().Err()
+				default:
+					return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+				}
+			})
+			b := newCircuitBreaker(next, config, n.logger, n.metrics)
+
+			for i, s := range tt.steps {
+				if s.expire {
+					b.expireCooldown()
+				}
+				outcome = s.outcome
+
+				ctx, cancel := context.WithCancel(context.Background())
+				if s.outcome == "cancel" {
+					cancel()
+				}
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+breakerTestHost+"/ping", nil)
+				require.NoError(t, err)
+
+				before := calls
+				resp, err := b.RoundTrip(req)
+				cancel()
+
+				if s.open {
+					assert.ErrorIs(t, err, ErrCircuitOpen, "step %d", i)
+					assert.Equal(t, before, calls, "step %d reached the transport", i)
+				} else {
+					assert.Equal(t, before+1, calls, "step %d", i)
+					if s.outcome == "ok" {
+						require.NoError(t, err, "step %d", i)
+						resp.Body.Close()
+					} else {
+						assert.Error(t, err, "step %d", i)
+						assert.NotErrorIs(t, err, ErrCircuitOpen, "step %d", i)
+					}
+				}
+				assert.Equal(t, s.cooldown, b.cooldown(breakerTestHost), "step %d", i)
+			}
+
+			assert.Equal(t, float64(tt.trips), testutil.ToFloat64(n.metrics.breakerTrips))
+		})
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	n := newTestNode(t)
+	var fail atomic.Bool
+	fail.Store(true)
+	probing := make(chan struct{})
+	finish := make(chan struct{})
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if fail.Load() {
+			return nil, errors.New("connection refused")
+		}
+		close(probing)
+		<-finish
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	b := newCircuitBreaker(next, BreakerConfig{Failures: 1, Cooldown: time.Minute}.withDefaults(), n.logger, n.metrics)
+
+	get := func() (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+breakerTestHost+"/ping", nil)
+		if err != nil {
+			return nil, err
+		}
+		return b.RoundTrip(req)
+	}
+
+	_, err := get()
+	require.Error(t, err)
+	assert.Equal(t, 1, b.CountOfOpen())
+
+	b.expireCooldown()
+	fail.Store(false)
+	probed := make(chan error, 1)
+	go func() {
+		resp, err := get()
+		if err == nil {
+			resp.Body.Close()
+		}
+		probed <- err
+	}()
+	<-probing
+
+	// only the probe goes through while it is in flight
+	_, err = get()
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, float64(1), testutil.ToFloat64(n.metrics.breakerRejections))
+
+	close(finish)
+	assert.NoError(t, <-probed)
+	assert.Equal(t, 0, b.CountOfOpen())
+}
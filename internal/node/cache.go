@@ -0,0 +1,340 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/bloom"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const (
+	// MaxBackfill is the most actions returned by a single /actions request
+	MaxBackfill = 500
+	// MaxCaches is the most cache replicas a seed hands to a joining peer
+	MaxCaches = 2
+)
+
+var (
+	// ErrNotQuery is returned when a statement other than MATCH is queried
+	ErrNotQuery = errors.New("only MATCH statements can be queried")
+	errExecutor = errors.New("executing query")
+)
+
+// BackfillAction is an action as served by a cache so that peers can replay
+// what they missed. It carries everything needed to verify the signature.
+type BackfillAction struct {
+	ID               string     `json:"id"`
+	Timestamp        time.Time  `json:"timestamp"`
+	Action           string     `json:"action"`
+	NodeID           string     `json:"nodeId"`
+	Identity         string     `json:"identity"`
+	ReceivedBy       string     `json:"receivedBy"`
+	EncodedSignature string     `json:"signature"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	KeyID            string     `json:"keyId,omitempty"`
+	ManifestVersion  int        `json:"manifestVersion"`
+	CreatedAt        *time.Time `json:"createdAt,omitempty"`
+	TTL              int        `json:"ttl,omitempty"`
+	Namespace        string     `json:"namespace,omitempty"`
+	Delegation       string     `json:"delegation,omitempty"`
+}
+
+type BackfillResponse struct {
+	Actions []*BackfillAction `json:"actions"`
+	// More is set when the limit was reached, request again with Since and
+	// After
+	More bool `json:"more"`
+	// Since and After are the timestamp and ID of the last action read,
+	// including those not served, which the next request continues from
+	Since *time.Time `json:"since,omitempty"`
+	After string     `json:"after,omitempty"`
+	// Checkpoint is set when the actions requested have been compacted into
+	// it. The actions are then the tail received since the checkpoint.
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+// handleActions serves the actions received since a point in time so peers
+// can catch up on what they missed while offline. Actions are served in
+// timestamp then ID order and the after parameter continues from the action
+// with that ID received at the since time, as the response's Since and After
+// give.
+func (n *node) handleActions(w http.ResponseWriter, req *http.Request) {
+	release, ok := n.bandwidth.tryAcquire(req.RemoteAddr)
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+	w = n.bandwidth.writer(req.Context(), w, req.RemoteAddr)
+
+	since := time.Time{}
+	if v := req.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("bad since: " + err.Error()))
+			return
+		}
+	}
+
+	after := req.URL.Query().Get("after")
+
+	limit := MaxBackfill
+	if v := req.URL.Query().Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("bad limit"))
+			return
+		}
+		limit = min(l, MaxBackfill)
+	}
+
+	// actions compacted into a checkpoint are replaced by it
+	checkpoint := n.checkpoints.covering(since)
+	if checkpoint != nil {
+		since, after = checkpoint.Since, ""
+	}
+
+	// the journal holds the same actions without a query of the store
+	var actions []*graph.Action
+	var err error
+	if n.journal != nil {
+		actions, err = n.journal.since(since, after, limit)
+	} else {
+		actions, err = n.store.GetActionsSince(req.Context(), since, after, limit)
+	}
+	if err != nil {
+		n.logger.Error("fetching actions", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := BackfillResponse{
+		Actions:    make([]*BackfillAction, 0, len(actions)),
+		More:       len(actions) == limit,
+		Checkpoint: checkpoint,
+	}
+	// the cursor moves past actions which aren't served so a page of them
+	// doesn't stop the requester
+	if len(actions) > 0 {
+		last := actions[len(actions)-1]
+		resp.Since, resp.After = &last.Timestamp, last.ID
+	}
+	for _, a := range actions {
+		if !n.isBackfillable(req.Context(), a) {
+			continue
+		}
+		resp.Actions = append(resp.Actions, newBackfillAction(a))
+	}
+
+	n.writeJSON(w, &resp)
+}
+
+// newBackfillAction returns the fields of an action served to peers
+func newBackfillAction(a *graph.Action) *BackfillAction {
+	return &BackfillAction{
+		ID:               a.ID,
+		Timestamp:        a.Timestamp,
+		Action:           a.Action,
+		NodeID:           a.NodeID,
+		Identity:         a.Identity,
+		ReceivedBy:       a.ReceivedBy,
+		EncodedSignature: a.EncodedSignature,
+		ExpiresAt:        a.ExpiresAt,
+		KeyID:            a.KeyID,
+		ManifestVersion:  a.ManifestVersion,
+		CreatedAt:        a.CreatedAt,
+		TTL:              a.TTL,
+		Namespace:        a.Namespace,
+		Delegation:       a.Delegation,
+	}
+}
+
+// isBackfillable returns false for actions which shouldn't be handed out again
+func (n *node) isBackfillable(ctx context.Context, action *graph.Action) bool {
+	// backfill isn't signed, so it only carries what anyone can read
+	if !n.anyoneCanRead(action) {
+		return false
+	}
+
+	if action.Identity == "" {
+		return true
+	}
+
+	block, err := n.nodeBlock(ctx, action.Identity)
+	if err != nil {
+		n.logger.Error("checking block", "error", err, "identity", action.Identity)
+		return false
+	}
+
+	return block == nil
+}
+
+// handleQuery runs a MATCH statement against the cached graph, or that of the
+// namespace given by the namespace parameter, writing its results in the form
+// given by the results parameter. Signed queries see what the
+// read ACL lets their identity read, unsigned ones what anyone can.
+func (n *node) handleQuery(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+
+	body := req.Body
+	defer body.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(body, MaxBodySize))
+	if err != nil {
+		n.logger.Error("reading body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reader, err := n.queryReader(req, namespace, string(buf))
+	if err != nil {
+		n.writeReaderError(w, req, err)
+		return
+	}
+
+	res, err := n.query(namespace, string(buf), n.readFilter(namespace, reader))
+	if err != nil {
+		n.writeQueryError(w, req, err)
+		return
+	}
+
+	n.writeResults(w, req, res)
+}
+
+// query runs a MATCH statement against a namespace's local graph, returning
+// only what the read filter accepts if it is set
+func (n *node) query(namespace, stmt string, readable graph.ReadFilter) (any, error) {
+	executor, err := n.graphFor(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := n.statementLimits().parseStatement(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd == nil || cmd.Type() != ast.EntityTypeMatchCmd {
+		return nil, ErrNotQuery
+	}
+
+	start := time.Now()
+	res, err := executor.Execute(graph.Action{
+		Action:   stmt,
+		Command:  cmd,
+		Readable: readable,
+	})
+	n.metrics.executorLatency.WithLabelValues(commandName(cmd)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		n.metrics.executorErrors.Inc()
+		return nil, fmt.Errorf("%w: %w", errExecutor, err)
+	}
+
+	return res, nil
+}
+
+// ResultsParam selects how a query's results are written: ResultsBindings,
+// the default, maps each identifier to the entities bound to it and
+// ResultsPaths lists the path of each match
+const (
+	ResultsParam    = "results"
+	ResultsBindings = "bindings"
+	ResultsPaths    = "paths"
+)
+
+// writeResults writes the results of a query in the form the results
+// parameter asks for
+func (n *node) writeResults(w http.ResponseWriter, req *http.Request, res any) {
+	switch format := req.URL.Query().Get(ResultsParam); format {
+	case "", ResultsBindings:
+		n.writeJSON(w, res)
+	case ResultsPaths:
+		paths := []*graph.Path{}
+		if results, ok := res.(*graph.SearchResults); ok {
+			paths = results.Paths()
+		}
+		n.writeJSON(w, paths)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("unknown results format %q", format)))
+	}
+}
+
+// writeQueryError maps an error from query to a response
+func (n *node) writeQueryError(w http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrStatementLimit):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+	case errors.Is(err, ErrUnknownNamespace):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+	case errors.Is(err, ErrNotQuery):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	case errors.Is(err, errExecutor):
+		n.logger.Error("executing query", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("syntax error: " + err.Error()))
+	}
+}
+
+// cacheReplicas returns the caches holding content the joining peer is
+// subscribed to
+func (n *node) cacheReplicas(ctx context.Context, filter bloom.Membership, excluding string) ([]*model.PeerSpec, error) {
+	caches, err := n.store.GetCaches(ctx, excluding)
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := []*model.PeerSpec{}
+	for _, c := range caches {
+		b, err := bloom.Decode(c.Filter)
+		if err != nil {
+			n.logger.Error("parsing cache filter", "error", err, "remote", c.RemoteAddr)
+			continue
+		}
+		if !b.Overlaps(filter) {
+			continue
+		}
+		replicas = append(replicas, c)
+		if len(replicas) == MaxCaches {
+			break
+		}
+	}
+
+	return replicas, nil
+}
@@ -0,0 +1,57 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleActionsPaging(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode(t)
+
+	at := time.Now().UTC().Add(-time.Minute)
+	actions := []graph.Action{
+		{ID: "a1", Identity: "alice", Timestamp: at},
+		{ID: "s1", Identity: "spammer", Timestamp: at},
+		{ID: "s2", Identity: "spammer", Timestamp: at},
+		{ID: "a2", Identity: "alice", Timestamp: at},
+		{ID: "a3", Identity: "alice", Timestamp: at.Add(time.Second)},
+	}
+	for _, a := range actions {
+		a.Action = "MERGE (p:Post{id:'" + a.ID + "'})"
+		require.NoError(t, n.store.CreateAction(ctx, a))
+	}
+	require.NoError(t, n.BlockIdentity(ctx, "spammer", model.BlockModeBlock, ""))
+
+	// a page of blocked actions is skipped rather than ending the backfill,
+	// and none received at the same time are missed
+	served := []string{}
+	q := url.Values{"since": {at.Add(-time.Second).Format(time.RFC3339Nano)}, "limit": {"2"}}
+	for range len(actions) {
+		w := httptest.NewRecorder()
+		n.handleActions(w, httptest.NewRequest("GET", "/actions?"+q.Encode(), nil))
+		require.Equal(t, 200, w.Code)
+
+		resp := BackfillResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		for _, a := range resp.Actions {
+			served = append(served, a.ID)
+		}
+		if !resp.More {
+			break
+		}
+		require.NotNil(t, resp.Since)
+		q.Set("since", resp.Since.Format(time.RFC3339Nano))
+		q.Set("after", resp.After)
+	}
+	assert.Equal(t, []string{"a1", "a2", "a3"}, served)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Capabilities are the behaviours a node is assembled from. Each node type is
+// a usual combination of them, which the capabilities config key replaces so
+// that, for example, a seed can also be a peer.
+type Capabilities uint
+
+const (
+	// CapabilityAcceptJoins lets other nodes join the network through this
+	// one. It hands out peers, answers whoami and gossips with other seeds.
+	CapabilityAcceptJoins Capabilities = 1 << iota
+	// CapabilityStoreGraph executes received actions into the graph
+	CapabilityStoreGraph
+	// CapabilityRelay joins seeds, receives actions from peers and passes
+	// them on to those subscribed
+	CapabilityRelay
+	// CapabilityServeQueries serves stored actions and MATCH queries to other
+	// nodes, and is advertised to seeds as a cache
+	CapabilityServeQueries
+)
+
+type capabilityName struct {
+	capability Capabilities
+	name       string
+}
+
+var capabilityNames = []capabilityName{
+	{CapabilityAcceptJoins, "accepts-joins"},
+	{CapabilityStoreGraph, "stores-graph"},
+	{CapabilityRelay, "relays"},
+	{CapabilityServeQueries, "serves-queries"},
+}
+
+// Capabilities returns the capabilities of the node type
+func (t NodeType) Capabilities() Capabilities {
+	switch t {
+	case NodeTypeSeed:
+		return CapabilityAcceptJoins
+	case NodeTypePeer:
+		return CapabilityStoreGraph | CapabilityRelay
+	case NodeTypeCache:
+		return CapabilityStoreGraph | CapabilityRelay | CapabilityServeQueries
+	}
+	return 0
+}
+
+// Has returns true if every one of the given capabilities is set
+func (c Capabilities) Has(capabilities Capabilities) bool {
+	return c&capabilities == capabilities
+}
+
+// Names returns the config names of the capabilities
+func (c Capabilities) Names() []string {
+	names := []string{}
+	for _, cn := range capabilityNames {
+		if c.Has(cn.capability) {
+			names = append(names, cn.name)
+		}
+	}
+	return names
+}
+
+func (c Capabilities) String() string {
+	return strings.Join(c.Names(), ",")
+}
+
+// ParseCapabilities combines capabilities given by their config names
+func ParseCapabilities(names []string) (Capabilities, error) {
+	var c Capabilities
+	for _, name := range names {
+		i := slices.IndexFunc(capabilityNames, func(cn capabilityName) bool {
+			return cn.name == name
+		})
+		if i < 0 {
+			return 0, fmt.Errorf("unknown capability %q", name)
+		}
+		c |= capabilityNames[i].capability
+	}
+	return c, nil
+}
+
+// joinType is the node type sent to seeds when joining, which tells them
+// whether to hand the node out as a cache
+func (c Capabilities) joinType() NodeType {
+	if c.Has(CapabilityServeQueries) {
+		return NodeTypeCache
+	}
+	return NodeTypePeer
+}
+
+// capabilities returns the configured capabilities, or those of the node type
+// if none are configured
+func (c Config) capabilities() (Capabilities, error) {
+	if len(c.Capabilities) == 0 {
+		return c.Type.Capabilities(), nil
+	}
+	return ParseCapabilities(c.Capabilities)
+}
+
+func validateCapabilities(check *configCheck, c Config) {
+	capabilities, err := c.capabilities()
+	if err != nil {
+		check.addf("capabilities", "%s, use %s", err, strings.Join(Capabilities(^uint(0)).Names(), ", "))
+		return
+	}
+	if capabilities.Has(CapabilityServeQueries) && !capabilities.Has(CapabilityStoreGraph|CapabilityRelay) {
+		check.addf("capabilities", "serves-queries also needs stores-graph and relays")
+	}
+}
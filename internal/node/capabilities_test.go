@@ -0,0 +1,110 @@
+package node
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	tests := []struct {
+		names    []string
+		expected Capabilities
+		err      bool
+	}{
+		{names: nil, expected: 0},
+		{names: []string{"accepts-joins"}, expected: CapabilityAcceptJoins},
+		{names: []string{"relays", "stores-graph", "relays"}, expected: CapabilityStoreGraph | CapabilityRelay},
+		{names: []string{"accepts-joins", "stores-graph", "relays", "serves-queries"}, expected: CapabilityAcceptJoins | CapabilityStoreGraph | CapabilityRelay | CapabilityServeQueries},
+		{names: []string{"relays", "flies"}, err: true},
+		{names: []string{"Relays"}, err: true},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseCapabilities(tt.names)
+		if tt.err {
+			assert.Error(t, err, "%v", tt.names)
+			continue
+		}
+		require.NoError(t, err, "%v", tt.names)
+		assert.Equal(t, tt.expected, c, "%v", tt.names)
+
+		// names round trip in a fixed order
+		parsed, err := ParseCapabilities(c.Names())
+		require.NoError(t, err)
+		assert.Equal(t, c, parsed)
+	}
+
+	assert.Equal(t, "stores-graph,relays", (CapabilityRelay | CapabilityStoreGraph).String())
+}
+
+func TestNodeTypeCapabilities(t *testing.T) {
+	tests := []struct {
+		configured []string
+		nodeType   NodeType
+		expected   Capabilities
+		joinType   NodeType
+	}{
+		{nodeType: NodeTypeSeed, expected: CapabilityAcceptJoins, joinType: NodeTypePeer},
+		{nodeType: NodeTypePeer, expected: CapabilityStoreGraph | CapabilityRelay, joinType: NodeTypePeer},
+		{nodeType: NodeTypeCache, expected: CapabilityStoreGraph | CapabilityRelay | CapabilityServeQueries, joinType: NodeTypeCache},
+		// configured capabilities replace the type's
+		{configured: []string{"accepts-joins", "stores-graph", "relays"}, nodeType: NodeTypeSeed, expected: CapabilityAcceptJoins | CapabilityStoreGraph | CapabilityRelay, joinType: NodeTypePeer},
+		{configured: []string{"stores-graph", "relays", "serves-queries"}, nodeType: NodeTypePeer, expected: CapabilityStoreGraph | CapabilityRelay | CapabilityServeQueries, joinType: NodeTypeCache},
+	}
+
+	for _, tt := range tests {
+		c, err := Config{Type: tt.nodeType, Capabilities: tt.configured}.capabilities()
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, c, "%s %v", tt.nodeType, tt.configured)
+		assert.Equal(t, tt.joinType, c.joinType(), "%s %v", tt.nodeType, tt.configured)
+	}
+
+	// serving queries needs the graph and actions from peers
+	c := validConfig()
+	c.Capabilities = []string{"serves-queries"}
+	assert.ErrorContains(t, c.Validate(), "serves-queries also needs stores-graph and relays")
+}
+
+func TestServeMuxCapabilities(t *testing.T) {
+	routes := []struct {
+		method, path string
+		needs        Capabilities
+	}{
+		{"GET", "/whois/alice", 0},
+		{"POST", "/hello", CapabilityAcceptJoins},
+		{"GET", "/whoami", CapabilityAcceptJoins},
+		{"POST", "/gossip", CapabilityAcceptJoins},
+		{"POST", "/ping", CapabilityRelay},
+		{"POST", "/publish", CapabilityRelay},
+		{"GET", "/actions", CapabilityServeQueries},
+		{"POST", "/query", CapabilityServeQueries},
+	}
+
+	composed := []Capabilities{
+		NodeTypeSeed.Capabilities(),
+		NodeTypePeer.Capabilities(),
+		NodeTypeCache.Capabilities(),
+		// a seed which is also a peer
+		CapabilityAcceptJoins | CapabilityStoreGraph | CapabilityRelay,
+	}
+
+	for _, c := range composed {
+		n := newTestNode(t)
+		n.capabilities = c
+		mux := n.newServeMux()
+		for _, r := range routes {
+			_, pattern := mux.Handler(httptest.NewRequest(r.method, r.path, nil))
+			assert.Equal(t, c.Has(r.needs), pattern != "", "%s %s %s", c, r.method, r.path)
+		}
+	}
+
+	// queries move to the client address when there is one
+	n := newTestNode(t)
+	n.capabilities = NodeTypeCache.Capabilities()
+	n.clientAddr = ":9095"
+	_, pattern := n.newServeMux().Handler(httptest.NewRequest("POST", "/query", nil))
+	assert.Empty(t, pattern)
+}
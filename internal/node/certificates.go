@@ -0,0 +1,300 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const (
+	defaultCertificateQuorum  = 2
+	defaultCertificateSources = 4
+)
+
+var ErrCertificateQuorum = errors.New("no quorum for certificate")
+
+// fetchCertificate finds the certificate for the identity that signed an
+// action. The identity's own published record is trusted first, otherwise the
+// certificate is fetched from several independent nodes and they must agree,
+// so a single node can't vouch for a fake identity it made up.
+func (n *node) fetchCertificate(ctx context.Context, action *graph.Action, now time.Time) (*x509.Certificate, error) {
+	cert, err := n.store.GetIdentityRecord(ctx, action.Identity)
+	switch {
+	case err == nil && identity.CheckValidity(cert, now) == nil:
+		return cert, nil
+	case err != nil && !errors.Is(err, model.ErrNotFound):
+		return nil, fmt.Errorf("getting identity record: %w", err)
+	}
+
+	votes := n.queryCertificateSources(ctx, action)
+	cert, err = chooseCertificate(votes, selfPublishedCertificate(action), n.certificateQuorum)
+	if errors.Is(err, ErrCertificateQuorum) {
+		n.logger.Warn("certificate quorum not reached", "identity", action.Identity, "candidates", len(votes), "error", err)
+	}
+	return cert, err
+}
+
+// chooseCertificate picks the certificate the sources agree on. Identifiers
+// aren't derived from keys, so an identity announcing itself for the first
+// time only vouches for its own certificate when no source knows another,
+// otherwise anyone could claim an identity that few nodes have seen.
+func chooseCertificate(votes []*certificateVote, self *x509.Certificate, quorum int) (*x509.Certificate, error) {
+	if self != nil {
+		for _, v := range votes {
+			if !v.cert.Equal(self) {
+				return nil, fmt.Errorf("self published certificate disputed: %w", ErrCertificateQuorum)
+			}
+		}
+		return self, nil
+	}
+
+	var leader *x509.Certificate
+	leaderVotes, runnerUpVotes := 0, 0
+	for _, v := range votes {
+		switch {
+		case v.count > leaderVotes:
+			leader, runnerUpVotes, leaderVotes = v.cert, leaderVotes, v.count
+		case v.count > runnerUpVotes:
+			runnerUpVotes = v.count
+		}
+	}
+
+	if leader == nil || leaderVotes < quorum || leaderVotes == runnerUpVotes {
+		return nil, fmt.Errorf("%d of %d votes: %w", leaderVotes, quorum, ErrCertificateQuorum)
+	}
+
+	return leader, nil
+}
+
+type certificateVote struct {
+	cert  *x509.Certificate
+	count int
+}
+
+// queryCertificateSources asks the sending node plus a sample of peers and seeds
+// for the identity's certificate and tallies the answers
+func (n *node) queryCertificateSources(ctx context.Context, action *graph.Action) []*certificateVote {
+	sources := [][]string{}
+	seen := map[string]bool{n.nodeID: true}
+	add := func(nodeID string, addrs ...string) {
+		if len(sources) >= n.certificateSources || len(addrs) == 0 || addrs[0] == "" {
+			return
+		}
+		// each node only gets one say however many addresses it has
+		for _, k := range append([]string{nodeID}, addrs...) {
+			if k != "" && seen[k] {
+				return
+			}
+		}
+		for _, k := range append([]string{nodeID}, addrs...) {
+			if k != "" {
+				seen[k] = true
+			}
+		}
+		sources = append(sources, addrs)
+	}
+
+	add(action.NodeID, action.RemoteAddr)
+
+	peers, err := n.store.GetRandomPeers(ctx, action.RemoteAddr, n.certificateSources)
+	if err != nil {
+		n.logger.Error("fetching certificate sources", "error", err)
+	}
+	for _, p := range peers {
+		add(p.NodeID, p.DialAddresses()...)
+	}
+
+	seeds, err := n.store.GetSeeds(ctx)
+	if err != nil {
+		n.logger.Error("fetching certificate sources", "error", err)
+	}
+	for _, s := range seeds {
+		add(s.NodeID, s.RemoteAddr)
+	}
+
+	mu := sync.Mutex{}
+	votes := []*certificateVote{}
+	wg := sync.WaitGroup{}
+	for _, addrs := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var cert *x509.Certificate
+			errs := []error{}
+			for _, addr := range addrs {
+				c, err := n.fetchIdentity(ctx, action.Identity, addr)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+					continue
+				}
+				cert = c
+				break
+			}
+			if cert == nil {
+				n.logger.Debug("certificate source failed", "identity", action.Identity, "error", errors.Join(errs...))
+				return
+			}
+			if cert.Subject.CommonName != action.Identity {
+				n.logger.Warn("certificate source returned wrong identity", "identity", action.Identity, "addr", addrs[0])
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, v := range votes {
+				if v.cert.Equal(cert) {
+					v.count++
+					return
+				}
+			}
+			votes = append(votes, &certificateVote{cert: cert, count: 1})
+		}()
+	}
+	wg.Wait()
+
+	return votes
+}
+
+// selfPublishedCertificate returns the certificate embedded in an action which
+// publishes the signer's own Identity, nil if it is anything else
+func selfPublishedCertificate(action *graph.Action) *x509.Certificate {
+	if action.KeyID != "" {
+		return nil
+	}
+
+	parser, err := ast.Parse(action.Action)
+	if err != nil {
+		return nil
+	}
+
+	cert, err := identityCertificate(parser.Command())
+	if err != nil || cert == nil {
+		return nil
+	}
+
+	if cert.Subject.CommonName != action.Identity {
+		return nil
+	}
+
+	return cert
+}
+
+// IdentityStatement returns the Identity merge which publishes an identity's
+// handle, bio and certificate. Nodes trust the certificate in it when the
+// statement is signed by the identity itself. updatedAt orders profile
+// updates, see staleProfile.
+func IdentityStatement(id *identity.Identity) (string, error) {
+	for _, v := range []string{id.Handle, id.Bio} {
+		if strings.ContainsAny(v, `'\`) {
+			return "", fmt.Errorf("%q can't contain quotes or backslashes", v)
+		}
+	}
+
+	certPEM, err := json.Marshal(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: id.CertificateData})))
+	if err != nil {
+		return "", fmt.Errorf("encoding certificate: %w", err)
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString("MERGE (:" + LabelIdentity + "{")
+	props := []string{
+		fmt.Sprintf("id:'%s'", id.Identifier),
+		fmt.Sprintf("handle:'%s'", id.Handle),
+		fmt.Sprintf("bio:'%s'", id.Bio),
+		fmt.Sprintf("certificate:'%s'", string(certPEM)),
+		fmt.Sprintf("%s:'%s'", attrProfileUpdatedAt, profileUpdatedAt(id).Format(time.RFC3339Nano)),
+	}
+	sb.WriteString(strings.Join(props, ", "))
+	sb.WriteString("})")
+
+	return sb.String(), nil
+}
+
+// identityCertificate extracts the certificate from an Identity merge, or nil
+// if the command is something else
+func identityCertificate(cmd ast.Command) (*x509.Certificate, error) {
+	e := identityStatement(cmd, LabelIdentity)
+	if e == nil {
+		return nil, nil
+	}
+
+	id, _ := e.Attribute("id")
+	attr, ok := e.Attribute("certificate")
+	if !ok {
+		return nil, nil
+	}
+
+	certPEM := ""
+	err := json.Unmarshal([]byte(attr), &certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("decoding certificate: %w", err)
+	}
+
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("decoding certificate: no PEM block")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	if cert.Subject.CommonName != id {
+		return nil, nil
+	}
+
+	return cert, nil
+}
+
+// recordIdentity keeps the certificate from an identity's own Identity merge so
+// it can be trusted without asking other nodes
+func (n *node) recordIdentity(ctx context.Context, action graph.Action) {
+	if action.Certificate == nil {
+		return
+	}
+
+	cert, err := identityCertificate(action.Command)
+	if err != nil {
+		n.logger.Debug("reading identity certificate", "error", err, "id", action.ID)
+		return
+	}
+
+	// only the certificate the action was verified with is recorded
+	if cert == nil || !cert.Equal(action.Certificate) {
+		return
+	}
+
+	err = n.store.PutIdentityRecord(ctx, cert, action.ID)
+	if err != nil {
+		n.logger.Error("recording identity", "error", err, "identity", action.Identity)
+	}
+}
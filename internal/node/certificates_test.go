@@ -0,0 +1,80 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCertificate(t *testing.T, commonName string) *x509.Certificate {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestChooseCertificate(t *testing.T) {
+	victim := newTestCertificate(t, "victim")
+	forged := newTestCertificate(t, "victim")
+
+	tests := map[string]struct {
+		votes    []*certificateVote
+		self     *x509.Certificate
+		expected *x509.Certificate
+	}{
+		"new identity": {
+			self:     victim,
+			expected: victim,
+		},
+		"self published and agreed": {
+			votes:    []*certificateVote{{cert: victim, count: 1}},
+			self:     victim,
+			expected: victim,
+		},
+		// a single source knowing another certificate is enough to refuse
+		"self published and disputed": {
+			votes: []*certificateVote{{cert: victim, count: 1}},
+			self:  forged,
+		},
+		"quorum": {
+			votes:    []*certificateVote{{cert: victim, count: 2}, {cert: forged, count: 1}},
+			expected: victim,
+		},
+		"below quorum": {
+			votes: []*certificateVote{{cert: victim, count: 1}},
+		},
+		"tied": {
+			votes: []*certificateVote{{cert: victim, count: 2}, {cert: forged, count: 2}},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cert, err := chooseCertificate(tt.votes, tt.self, defaultCertificateQuorum)
+			if tt.expected == nil {
+				assert.ErrorIs(t, err, ErrCertificateQuorum)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, tt.expected.Equal(cert))
+		})
+	}
+}
@@ -0,0 +1,383 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCheckpointInterval = 24 * time.Hour
+	defaultCheckpointKeep     = 2
+
+	// checkpointOverlap moves the start of the tail back to cover actions
+	// which were still being checked when the checkpoint was taken. Those
+	// already in the checkpoint are recognised by ID when replayed.
+	checkpointOverlap = time.Minute
+
+	checkpointManifest = "checkpoint.json"
+	checkpointGraph    = "graph.db"
+)
+
+// CheckpointConfig is read from the checkpoint section of the config file.
+// With a directory set the node periodically copies its graphs there so that
+// the actions before the copy no longer need to be kept to rebuild them.
+type CheckpointConfig struct {
+	// Dir holds the checkpoints, empty disables them
+	Dir string `mapstructure:"dir"`
+	// Interval is how often a checkpoint is taken
+	Interval time.Duration `mapstructure:"interval"`
+	// Keep is how many checkpoints are kept, older ones are deleted
+	Keep int `mapstructure:"keep"`
+	// Compact prunes the actions received before the latest checkpoint, as
+	// long as they're older than the replay window, and answers backfill
+	// from before it with the checkpoint and the actions since
+	Compact bool `mapstructure:"compact"`
+}
+
+func (c CheckpointConfig) withDefaults() CheckpointConfig {
+	if c.Interval == 0 {
+		c.Interval = defaultCheckpointInterval
+	}
+	if c.Keep == 0 {
+		c.Keep = defaultCheckpointKeep
+	}
+	return c
+}
+
+func (c CheckpointConfig) validate(check *configCheck) {
+	nonNegative(check, "interval", c.Interval)
+	nonNegative(check, "keep", c.Keep)
+
+	if c.Dir == "" && c.Compact {
+		check.addf("compact", "needs dir to keep checkpoints in")
+	}
+}
+
+// Checkpoint is a copy of the node's graphs. It has the effect of every
+// action received before Since, the actions received since are the tail
+// served by /actions.
+type Checkpoint struct {
+	ID        string    `json:"id"`
+	Since     time.Time `json:"since"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Namespaces are the graphs copied alongside the default one
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// checkpoints keeps track of the checkpoints in the configured directory
+type checkpoints struct {
+	config CheckpointConfig
+	logger *slog.Logger
+	busy   atomic.Bool
+
+	mu    sync.Mutex
+	taken []*Checkpoint
+}
+
+// newCheckpoints reads the checkpoints already in the directory, returning
+// nil if checkpoints are disabled
+func newCheckpoints(config CheckpointConfig, logger *slog.Logger) (*checkpoints, error) {
+	if config.Dir == "" {
+		return nil, nil
+	}
+
+	c := &checkpoints{
+		config: config.withDefaults(),
+		logger: logger.With("checkpoints", config.Dir),
+	}
+
+	err := os.MkdirAll(config.Dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("creating checkpoint directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(config.Dir, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, checkpointManifest))
+		if errors.Is(err, os.ErrNotExist) {
+			// the manifest is written last so this one was never finished
+			c.logger.Warn("removing incomplete checkpoint", "id", entry.Name())
+			os.RemoveAll(dir)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading checkpoint %s: %w", entry.Name(), err)
+		}
+
+		cp := &Checkpoint{}
+		err = json.Unmarshal(data, cp)
+		if err != nil {
+			return nil, fmt.Errorf("reading checkpoint %s: %w", entry.Name(), err)
+		}
+		c.taken = append(c.taken, cp)
+	}
+	c.sort()
+
+	return c, nil
+}
+
+func (c *checkpoints) sort() {
+	slices.SortFunc(c.taken, func(a, b *Checkpoint) int {
+		return a.Since.Compare(b.Since)
+	})
+}
+
+// latest returns the newest checkpoint, nil if there isn't one
+func (c *checkpoints) latest() *Checkpoint {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.taken) == 0 {
+		return nil
+	}
+	return c.taken[len(c.taken)-1]
+}
+
+// covering returns the checkpoint to backfill from instead of the actions
+// received since the given time, nil if the actions are all kept
+func (c *checkpoints) covering(since time.Time) *Checkpoint {
+	if c == nil || !c.config.Compact {
+		return nil
+	}
+
+	cp := c.latest()
+	if cp == nil || !since.Before(cp.Since) {
+		return nil
+	}
+	return cp
+}
+
+// file is where a checkpoint's copy of a namespace's graph is kept
+func (c *checkpoints) file(cp *Checkpoint, namespace string) string {
+	name := checkpointGraph
+	if namespace != "" {
+		name = namespace + ".db"
+	}
+	return filepath.Join(c.config.Dir, cp.ID, name)
+}
+
+// add records a finished checkpoint, deleting the oldest beyond those kept
+func (c *checkpoints) add(cp *Checkpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.taken = append(c.taken, cp)
+	c.sort()
+	for len(c.taken) > c.config.Keep {
+		err := os.RemoveAll(filepath.Join(c.config.Dir, c.taken[0].ID))
+		if err != nil {
+			c.logger.Error("removing checkpoint", "error", err, "id", c.taken[0].ID)
+		}
+		c.taken = c.taken[1:]
+	}
+}
+
+// inFlight tracks when the actions being processed were received so that
+// a checkpoint's tail starts before any it might have missed
+type inFlight struct {
+	mu      sync.Mutex
+	actions map[string]time.Time
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{actions: map[string]time.Time{}}
+}
+
+func (f *inFlight) start(id string, receivedAt time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.actions[id] = receivedAt
+}
+
+func (f *inFlight) done(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.actions, id)
+}
+
+// oldest returns when the oldest action being processed was received, or
+// the given time if that is earlier
+func (f *inFlight) oldest(now time.Time) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	oldest := now
+	for _, t := range f.actions {
+		if t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return oldest
+}
+
+// takeCheckpoint copies the node's graphs into a new checkpoint and, when
+// compacting, prunes the actions it makes redundant. It returns nil without
+// a checkpoint if one is already being taken.
+func (n *node) takeCheckpoint(ctx context.Context) (*Checkpoint, error) {
+	c := n.checkpoints
+	if !c.busy.CompareAndSwap(false, true) {
+		return nil, nil
+	}
+	defer c.busy.Store(false)
+
+	now := time.Now().UTC()
+	cp := &Checkpoint{
+		ID:         strconv.FormatInt(now.UnixNano(), 10),
+		Since:      n.inFlight.oldest(now).Add(-checkpointOverlap),
+		CreatedAt:  now,
+		Namespaces: slices.Sorted(maps.Keys(n.namespaces)),
+	}
+
+	dir := filepath.Join(c.config.Dir, cp.ID)
+	err := n.writeCheckpoint(dir, cp)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	c.add(cp)
+	n.logger.Info("took checkpoint", "id", cp.ID, "since", cp.Since, "took", time.Since(now))
+
+	if c.config.Compact {
+		// replays of pruned actions have to be old enough for the clock
+		// check to reject
+		before := cp.Since
+		if window := time.Now().UTC().Add(-n.clock.replayWindow()); window.Before(before) {
+			before = window
+		}
+		err = n.pruneActionsBefore(ctx, before)
+		if err != nil {
+			return cp, fmt.Errorf("compacting actions: %w", err)
+		}
+	}
+
+	return cp, nil
+}
+
+// writeCheckpoint copies each graph into the directory followed by the
+// manifest, which marks the checkpoint as complete
+func (n *node) writeCheckpoint(dir string, cp *Checkpoint) error {
+	err := os.Mkdir(dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("creating checkpoint: %w", err)
+	}
+
+	for _, namespace := range append([]string{""}, cp.Namespaces...) {
+		g, err := n.graphFor(namespace)
+		if err != nil {
+			return err
+		}
+		err = g.Checkpoint(n.checkpoints.file(cp, namespace))
+		if err != nil {
+			return fmt.Errorf("checkpointing namespace %q: %w", namespace, err)
+		}
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("encoding checkpoint: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, checkpointManifest), data, 0o600)
+	if err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (n *node) handleAdminCheckpoint(w http.ResponseWriter, req *http.Request) {
+	cp := n.checkpoints.latest()
+	if cp == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	n.writeJSON(w, cp)
+}
+
+func (n *node) handleAdminTakeCheckpoint(w http.ResponseWriter, req *http.Request) {
+	if n.checkpoints == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("checkpoints are disabled"))
+		return
+	}
+
+	cp, err := n.takeCheckpoint(req.Context())
+	switch {
+	case err != nil && cp == nil:
+		n.logger.Error("taking checkpoint", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case err != nil:
+		n.logger.Error("taking checkpoint", "error", err)
+	case cp == nil:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("a checkpoint is already being taken"))
+		return
+	}
+	n.writeJSON(w, cp)
+}
+
+// handleAdminCheckpointGraph serves the latest checkpoint's copy of a
+// namespace's graph as a database file
+func (n *node) handleAdminCheckpointGraph(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+
+	cp := n.checkpoints.latest()
+	if cp == nil || (namespace != "" && !slices.Contains(cp.Namespaces, namespace)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(n.checkpoints.file(cp, namespace))
+	if err != nil {
+		// it may have been deleted by a newer checkpoint
+		n.logger.Error("opening checkpoint", "error", err, "id", cp.ID)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set(HeaderContentType, "application/vnd.sqlite3")
+	w.Header().Set(HeaderCheckpointID, cp.ID)
+	w.Header().Set(HeaderCheckpointSince, cp.Since.Format(time.RFC3339Nano))
+	http.ServeContent(w, req, "", cp.CreatedAt, f)
+}
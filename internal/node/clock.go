@@ -0,0 +1,92 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+const (
+	defaultMaxClockSkew = 5 * time.Minute
+	defaultMaxActionAge = 24 * time.Hour
+)
+
+var ErrClockSkew = errors.New("action timestamp outside the accepted window")
+
+// ClockConfig is read from the clock section of the config file. Zero values
+// use the defaults.
+type ClockConfig struct {
+	// MaxSkew is how far in the future an action's creation time can be
+	MaxSkew time.Duration `mapstructure:"max_skew"`
+	// MaxAge is how long ago an action can have been created and still be
+	// accepted. It also bounds how long an action can wait in an outbox
+	// before peers stop accepting it.
+	MaxAge time.Duration `mapstructure:"max_age"`
+	// TagReceiveTime adds the time each action was received to the manifest
+	// sent on to peers so that they can measure this node's clock skew
+	TagReceiveTime bool `mapstructure:"tag_receive_time"`
+}
+
+func (c ClockConfig) withDefaults() ClockConfig {
+	if c.MaxSkew == 0 {
+		c.MaxSkew = defaultMaxClockSkew
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultMaxActionAge
+	}
+	return c
+}
+
+func (c ClockConfig) validate(check *configCheck) {
+	nonNegative(check, "max_skew", c.MaxSkew)
+	nonNegative(check, "max_age", c.MaxAge)
+}
+
+// checkTimestamp rejects actions created too far from the local time. Actions
+// made before manifests were timestamped have no creation time to check, so
+// they could be replayed forever and are rejected.
+func (n *node) checkTimestamp(action *graph.Action, now time.Time) error {
+	if action.CreatedAt == nil {
+		return fmt.Errorf("no creation time: %w", ErrClockSkew)
+	}
+
+	age := now.Sub(*action.CreatedAt)
+	n.metrics.actionAge.Observe(age.Seconds())
+
+	if -age > n.clock.MaxSkew {
+		return fmt.Errorf("created %s in the future: %w", (-age).Round(time.Second), ErrClockSkew)
+	}
+	if age > n.clock.MaxAge {
+		return fmt.Errorf("created %s ago: %w", age.Round(time.Second), ErrClockSkew)
+	}
+
+	return nil
+}
+
+// observePeerClock records how far the peer's receive time tag is from the
+// local clock. The difference includes the time the peer took to process and
+// send the action so a peer in step with us reads slightly negative.
+func (n *node) observePeerClock(remoteAddr string, receivedAt *time.Time, now time.Time) {
+	if receivedAt == nil {
+		return
+	}
+	n.metrics.peerClockSkew.WithLabelValues(remoteAddr).Set(receivedAt.Sub(now).Seconds())
+}
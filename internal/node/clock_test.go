@@ -0,0 +1,43 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckTimestamp(t *testing.T) {
+	n := newTestNode(t)
+	n.clock = ClockConfig{}.withDefaults()
+
+	now := time.Now().UTC()
+	at := func(d time.Duration) *time.Time {
+		ts := now.Add(d)
+		return &ts
+	}
+
+	tests := map[string]struct {
+		createdAt *time.Time
+		expected  error
+	}{
+		"now":            {createdAt: at(0)},
+		"within skew":    {createdAt: at(defaultMaxClockSkew - time.Second)},
+		"too far ahead":  {createdAt: at(defaultMaxClockSkew + time.Second), expected: ErrClockSkew},
+		"within max age": {createdAt: at(-defaultMaxActionAge + time.Second)},
+		"too old":        {createdAt: at(-defaultMaxActionAge - time.Second), expected: ErrClockSkew},
+		"untimestamped":  {expected: ErrClockSkew},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := n.checkTimestamp(&graph.Action{CreatedAt: tt.createdAt}, now)
+			if tt.expected != nil {
+				assert.ErrorIs(t, err, tt.expected)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingZstd     = "zstd"
+	EncodingGzip     = "gzip"
+	EncodingIdentity = "identity"
+
+	HeaderAcceptEncoding  = "Accept-Encoding"
+	HeaderContentEncoding = "Content-Encoding"
+	HeaderContentLength   = "Content-Length"
+
+	// bodies smaller than this aren't worth the CPU
+	MinCompressSize = 512
+)
+
+var supportedEncodings = EncodingZstd + ", " + EncodingGzip
+
+// negotiateEncoding picks the best encoding we support from an Accept-Encoding
+// style header value. Encodings with a q value of 0 are refused.
+func negotiateEncoding(accept string) string {
+	offered := map[string]bool{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if refusedEncoding(params) {
+			continue
+		}
+		offered[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	switch {
+	case offered[EncodingZstd]:
+		return EncodingZstd
+	case offered[EncodingGzip]:
+		return EncodingGzip
+	default:
+		return EncodingIdentity
+	}
+}
+
+// refusedEncoding reports whether the parameters of an encoding in an
+// Accept-Encoding header give it a q value of 0
+func refusedEncoding(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if !strings.EqualFold(key, "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return err == nil && q == 0
+	}
+	return false
+}
+
+func compressBody(encoding string, data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	switch encoding {
+	case EncodingZstd:
+		enc, err := zstd.NewWriter(buf)
+		if err != nil {
+			return nil, fmt.Errorf("creating zstd encoder: %w", err)
+		}
+		_, err = enc.Write(data)
+		if err != nil {
+			return nil, fmt.Errorf("zstd encoding: %w", err)
+		}
+		err = enc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("zstd encoding: %w", err)
+		}
+	case EncodingGzip:
+		enc := gzip.NewWriter(buf)
+		_, err := enc.Write(data)
+		if err != nil {
+			return nil, fmt.Errorf("gzip encoding: %w", err)
+		}
+		err = enc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("gzip encoding: %w", err)
+		}
+	default:
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressBody reads at most limit bytes of decoded data so that a small
+// compressed payload can't expand without bound, returning ErrBodyTooLarge
+// if there is more.
+func decompressBody(encoding string, r io.Reader, limit int64) ([]byte, error) {
+	var rdr io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", EncodingIdentity:
+		rdr = r
+	case EncodingZstd:
+		dec, err := zstd.NewReader(r, zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, fmt.Errorf("creating zstd decoder: %w", err)
+		}
+		defer dec.Close()
+		rdr = dec
+	case EncodingGzip:
+		dec, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("creating gzip decoder: %w", err)
+		}
+		defer dec.Close()
+		rdr = dec
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(rdr, limit+1))
+	if errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, ErrBodyTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding body: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	return data, nil
+}
+
+// compressionMiddleware transparently decodes compressed request bodies and
+// compresses responses when the caller has said it can handle them.
+func compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(HeaderAcceptEncoding, supportedEncodings)
+
+		if enc := req.Header.Get(HeaderContentEncoding); enc != "" && req.Body != nil {
+			data, err := decompressBody(enc, req.Body, MaxBodySize)
+			req.Body.Close()
+			switch {
+			case errors.Is(err, ErrBodyTooLarge):
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			case err != nil:
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			req.Body = io.NopCloser(bytes.NewReader(data))
+			req.ContentLength = int64(len(data))
+			req.Header.Del(HeaderContentEncoding)
+		}
+
+		encoding := negotiateEncoding(req.Header.Get(HeaderAcceptEncoding))
+		if encoding == EncodingIdentity {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		bw := &bufferedResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(bw, req)
+		bw.flush(encoding)
+	})
+}
+
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *bufferedResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+func (w *bufferedResponseWriter) flush(encoding string) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	data := w.body.Bytes()
+	if len(data) >= MinCompressSize {
+		compressed, err := compressBody(encoding, data)
+		if err == nil && len(compressed) < len(data) {
+			w.Header().Set(HeaderContentEncoding, encoding)
+			w.Header().Set(HeaderContentLength, strconv.Itoa(len(compressed)))
+			data = compressed
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(data)
+}
+
+// compressionRoundTripper compresses outbound bodies for peers which have
+// advertised support and decodes compressed responses. Until a peer has
+// answered at least once its request bodies are sent uncompressed.
+type compressionRoundTripper struct {
+	next     http.RoundTripper
+	mu       sync.Mutex
+	accepted map[string]string
+}
+
+func newCompressionRoundTripper(next http.RoundTripper) *compressionRoundTripper {
+	return &compressionRoundTripper{
+		next:     next,
+		accepted: map[string]string{},
+	}
+}
+
+func (t *compressionRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	req = req.Clone(req.Context())
+	req.Header.Set(HeaderAcceptEncoding, supportedEncodings)
+
+	t.mu.Lock()
+	encoding, ok := t.accepted[host]
+	t.mu.Unlock()
+
+	if ok && encoding != EncodingIdentity && req.Body != nil {
+		data, err := readRequestBody(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) >= MinCompressSize {
+			compressed, err := compressBody(encoding, data)
+			if err != nil {
+				return nil, err
+			}
+			data = compressed
+			req.Header.Set(HeaderContentEncoding, encoding)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(data))
+		req.ContentLength = int64(len(data))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.accepted[host] = negotiateEncoding(resp.Header.Get(HeaderAcceptEncoding))
+	t.mu.Unlock()
+
+	if enc := resp.Header.Get(HeaderContentEncoding); enc != "" {
+		data, err := decompressBody(enc, resp.Body, MaxBodySize)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		resp.ContentLength = int64(len(data))
+		resp.Header.Del(HeaderContentEncoding)
+		resp.Header.Del(HeaderContentLength)
+		resp.Uncompressed = true
+	}
+
+	return resp, nil
+}
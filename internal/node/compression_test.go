@@ -0,0 +1,127 @@
+package node
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{accept: "", expected: EncodingIdentity},
+		{accept: "br", expected: EncodingIdentity},
+		{accept: "gzip", expected: EncodingGzip},
+		{accept: "gzip, zstd", expected: EncodingZstd},
+		{accept: " ZSTD ", expected: EncodingZstd},
+		{accept: "zstd;q=0, gzip", expected: EncodingGzip},
+		{accept: "zstd;q=0.0, gzip;q=0.5", expected: EncodingGzip},
+		{accept: "zstd; Q=0, gzip;q=0", expected: EncodingIdentity},
+		{accept: "zstd;level=3;q=0, gzip", expected: EncodingGzip},
+		{accept: "zstd;q=0.1", expected: EncodingZstd},
+		{accept: "zstd;q=bad", expected: EncodingZstd},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, negotiateEncoding(tt.accept), tt.accept)
+	}
+}
+
+func TestDecompressBody(t *testing.T) {
+	data := []byte(strings.Repeat("MERGE (p:Post{id:'1'}) ", 100))
+
+	for _, encoding := range []string{EncodingZstd, EncodingGzip, EncodingIdentity} {
+		compressed, err := compressBody(encoding, data)
+		require.NoError(t, err)
+		decoded, err := decompressBody(encoding, bytes.NewReader(compressed), MaxBodySize)
+		require.NoError(t, err, encoding)
+		assert.Equal(t, data, decoded, encoding)
+
+		// a small body can't expand past the limit
+		bomb, err := compressBody(encoding, make([]byte, MaxBodySize+1))
+		require.NoError(t, err)
+		_, err = decompressBody(encoding, bytes.NewReader(bomb), MaxBodySize)
+		assert.ErrorIs(t, err, ErrBodyTooLarge, encoding)
+	}
+
+	_, err := decompressBody("br", bytes.NewReader(data), MaxBodySize)
+	assert.Error(t, err)
+}
+
+func TestCompression(t *testing.T) {
+	response := strings.Repeat("results ", 200)
+	var lastEncoding atomic.Value
+	compressed := compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil || req.Header.Get(HeaderContentEncoding) != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(response + string(body)))
+	}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lastEncoding.Store(req.Header.Get(HeaderContentEncoding))
+		compressed.ServeHTTP(w, req)
+	}))
+	t.Cleanup(server.Close)
+
+	rt := newCompressionRoundTripper(server.Client().Transport)
+	send := func(body string) (*http.Response, string, error) {
+		req, err := http.NewRequest("POST", server.URL+"/publish", strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(data), nil
+	}
+
+	statement := strings.Repeat("MERGE (p:Post{id:'1'}) ", 50)
+
+	// bodies are sent as they are until the peer says what it accepts
+	resp, data, err := send(statement)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", lastEncoding.Load())
+	assert.Equal(t, response+statement, data)
+	assert.True(t, resp.Uncompressed)
+	assert.Empty(t, resp.Header.Get(HeaderContentEncoding))
+
+	resp, data, err = send(statement)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, EncodingZstd, lastEncoding.Load())
+	assert.Equal(t, response+statement, data)
+
+	// small bodies aren't worth compressing
+	_, _, err = send("MERGE (p:Post)")
+	require.NoError(t, err)
+	assert.Equal(t, "", lastEncoding.Load())
+
+	// nor are bodies cut short
+	_, _, err = send(strings.Repeat("x", MaxBodySize+1))
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// a request which expands past the limit is refused
+	bomb, err := compressBody(EncodingGzip, make([]byte, MaxBodySize+1))
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", server.URL+"/publish", bytes.NewReader(bomb))
+	require.NoError(t, err)
+	req.Header.Set(HeaderContentEncoding, EncodingGzip)
+	resp, err = server.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
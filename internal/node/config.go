@@ -0,0 +1,269 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"cmp"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/logging"
+	"github.com/jdudmesh/propolis/internal/secrets"
+)
+
+// ConfigError lists every problem found in a config so they can all be fixed
+// at once. Problems start with the config file key they were found in.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// configCheck collects the problems found in a config
+type configCheck struct {
+	section  string
+	problems []string
+}
+
+func (c *configCheck) addf(key, format string, args ...any) {
+	if c.section != "" {
+		key = c.section + "." + key
+	}
+	c.problems = append(c.problems, key+": "+fmt.Sprintf(format, args...))
+}
+
+func nonNegative[T int | int64 | float64 | time.Duration](c *configCheck, key string, v T) {
+	if v < 0 {
+		c.addf(key, "must not be negative, got %v", v)
+	}
+}
+
+// hostPort checks an address is a host and numeric port. Listen addresses
+// can leave out the host.
+func (c *configCheck) hostPort(key, addr string, listen bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		c.addf(key, "%q should be host:port", addr)
+		return
+	}
+	if host == "" && !listen {
+		c.addf(key, "%q has no host", addr)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		c.addf(key, "%q has an invalid port", addr)
+	}
+}
+
+// localAddress checks a TCP address or unix: socket path for the admin or
+// application API
+func (c *configCheck) localAddress(key, addr string) bool {
+	path, ok := strings.CutPrefix(addr, AdminSocketPrefix)
+	if !ok {
+		c.hostPort(key, addr, true)
+		return true
+	}
+	if path == "" {
+		c.addf(key, "%q has no socket path", addr)
+	}
+	return false
+}
+
+// Validate checks the config before a node is created, returning a
+// *ConfigError listing every problem found
+func (c Config) Validate() error {
+	check := &configCheck{}
+
+	if c.Host == "" {
+		check.addf("host", "must be set, use 0.0.0.0 or :: to listen on all interfaces")
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		check.addf("port", "must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.PublicAddress != "" {
+		if capabilities, err := c.capabilities(); err == nil && !capabilities.Has(CapabilityAcceptJoins) {
+			check.addf("public_address", "is only used by nodes which accept joins")
+		} else {
+			check.hostPort("public_address", c.PublicAddress, false)
+		}
+	}
+
+	if c.NodeDatabaseURL == "" && c.Store == nil {
+		check.addf("node_db", "must be set")
+	}
+	if c.GraphDatabaseURL == "" {
+		check.addf("graph_db", "must be set")
+	}
+	switch c.SchemaValidation {
+	case "", graph.SchemaValidationWarn, graph.SchemaValidationReject:
+	default:
+		check.addf("schema_validation", "must be %s or %s, got %q", graph.SchemaValidationWarn, graph.SchemaValidationReject, c.SchemaValidation)
+	}
+
+	validateCapabilities(check, c)
+
+	for module, level := range c.LogLevels {
+		if !slices.Contains(logging.Modules, module) {
+			check.addf("log_levels", "unknown module %q, use one of %s", module, strings.Join(logging.Modules, ", "))
+			continue
+		}
+		_, err := logging.ParseLevel(level)
+		if err != nil {
+			check.addf("log_levels", "%s: %s", module, err)
+		}
+	}
+
+	for _, addr := range c.Seeds {
+		check.hostPort("seeds", addr, false)
+	}
+	for _, addr := range c.AdvertiseAddresses {
+		check.hostPort("advertise", addr, false)
+	}
+	for _, domain := range c.SeedDomains {
+		if domain == "" || strings.ContainsAny(domain, "/: ") {
+			check.addf("seed_domains", "%q is not a domain name", domain)
+		}
+	}
+	for _, u := range c.BootstrapURLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			check.addf("bootstrap_urls", "%q should be an http or https URL", u)
+		}
+	}
+
+	if c.AdminAddress != "" {
+		check.localAddress("admin_address", c.AdminAddress)
+	}
+	if c.Diagnostics && c.AdminAddress == "" && c.DashboardAddress == "" {
+		check.addf("diagnostics", "are served on the admin API, which needs admin_address")
+	}
+	if c.APIAddress != "" {
+		if check.localAddress("api_address", c.APIAddress) && c.APIToken == "" {
+			check.addf("api_token", "must be set when the api listens on TCP")
+		}
+	}
+	if c.DashboardAddress != "" {
+		if check.localAddress("dashboard_address", c.DashboardAddress) && c.AdminToken == "" {
+			check.addf("admin_token", "must be set when the dashboard listens on TCP")
+		}
+	}
+	if c.ClientAddress != "" {
+		check.hostPort("client_address", c.ClientAddress, true)
+		if _, port, err := net.SplitHostPort(c.ClientAddress); err == nil && port == strconv.Itoa(c.Port) {
+			check.addf("client_address", "must use a different port to the node")
+		}
+	}
+	if c.BoltAddress != "" {
+		check.hostPort("bolt_address", c.BoltAddress, true)
+		if c.APIToken == "" {
+			check.addf("api_token", "must be set to log in to the bolt server")
+		}
+	}
+
+	for id, encoded := range c.SubscriptionKeys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != secrets.KeySize {
+			check.addf("subscription_keys."+id, "should be a base64 encoded %d byte key, see propolis dbkey", secrets.KeySize)
+		}
+	}
+
+	nonNegative(check, "key_rotation_grace", c.KeyRotationGrace)
+	if c.MinManifestVersion != 0 && (c.MinManifestVersion < ManifestVersionTimestamped || c.MinManifestVersion > ManifestVersion) {
+		check.addf("min_manifest_version", "must be between %d and %d, got %d", ManifestVersionTimestamped, ManifestVersion, c.MinManifestVersion)
+	}
+	nonNegative(check, "address_quorum", c.AddressQuorum)
+	nonNegative(check, "certificate_quorum", c.CertificateQuorum)
+	nonNegative(check, "certificate_sources", c.CertificateSources)
+	nonNegative(check, "dedupe_cache_size", c.DedupeCacheSize)
+	nonNegative(check, "dispatch_workers", c.DispatchWorkers)
+	nonNegative(check, "peer_queue_size", c.PeerQueueSize)
+
+	quorum := cmp.Or(c.CertificateQuorum, defaultCertificateQuorum)
+	sources := cmp.Or(c.CertificateSources, defaultCertificateSources)
+	if quorum > sources {
+		check.addf("certificate_quorum", "%d can't be reached by asking %d nodes, raise certificate_sources", quorum, sources)
+	}
+
+	check.section = "moderation"
+	c.Moderation.validate(check)
+	check.section = "quotas"
+	c.Quotas.validate(check)
+	check.section = "liveness"
+	c.Liveness.validate(check)
+	check.section = "breaker"
+	c.Breaker.validate(check)
+	check.section = "limits"
+	c.Limits.validate(check)
+	check.section = "clock"
+	c.Clock.validate(check)
+	check.section = "filter"
+	c.Filter.validate(check)
+	check.section = "export"
+	c.Export.validate(check)
+	check.section = "tls"
+	c.TLS.validate(check)
+	check.section = "retention"
+	c.Retention.validate(check, c.Clock)
+	check.section = "publish"
+	c.Publish.validate(check)
+	check.section = "journal"
+	c.Journal.validate(check)
+	check.section = "checkpoint"
+	c.Checkpoint.validate(check)
+	check.section = "consistency"
+	c.Consistency.validate(check)
+	check.section = "group"
+	c.Group.validate(check, c)
+	check.section = "replication"
+	c.Replication.validate(check, c)
+	check.section = "known_peers"
+	c.KnownPeers.validate(check)
+	check.section = "bandwidth"
+	c.Bandwidth.validate(check)
+	check.section = "control"
+	c.Control.validate(check)
+	check.section = "peer_table"
+	c.PeerTable.validate(check)
+	check.section = "join_policy"
+	c.JoinPolicy.validate(check, c)
+	check.section = "version_check"
+	c.VersionCheck.validate(check)
+	check.section = "namespaces"
+	validateNamespaces(check, c)
+	check.section = "read_acl"
+	for i, r := range c.ReadACL {
+		r.validate(check, i, c.Namespaces)
+	}
+	check.section = "webhooks"
+	for i, w := range c.Webhooks {
+		w.validate(check, i)
+	}
+
+	if len(check.problems) > 0 {
+		slices.Sort(check.problems)
+		return &ConfigError{Problems: check.problems}
+	}
+	return nil
+}
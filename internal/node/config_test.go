@@ -0,0 +1,73 @@
+package node
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validConfig() Config {
+	return Config{
+		Config:          graph.Config{GraphDatabaseURL: "file::memory:"},
+		Host:            "0.0.0.0",
+		Port:            9090,
+		NodeDatabaseURL: "file::memory:",
+		Type:            NodeTypePeer,
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	require.NoError(t, validConfig().Validate())
+
+	testCases := []struct {
+		name      string
+		configure func(c *Config)
+		problems  []string
+	}{
+		{name: "no host", configure: func(c *Config) { c.Host = "" }, problems: []string{"host:"}},
+		{name: "port out of range", configure: func(c *Config) { c.Port = 70000 }, problems: []string{"port:"}},
+		{name: "public address on a peer", configure: func(c *Config) { c.PublicAddress = "1.2.3.4:9000" }, problems: []string{"public_address:"}},
+		{name: "public address on a seed", configure: func(c *Config) { c.Type, c.PublicAddress = NodeTypeSeed, "1.2.3.4:9000" }},
+		{name: "public address without a host", configure: func(c *Config) { c.Type, c.PublicAddress = NodeTypeSeed, ":9000" }, problems: []string{"public_address:"}},
+		{name: "no databases", configure: func(c *Config) { c.NodeDatabaseURL, c.GraphDatabaseURL = "", "" }, problems: []string{"graph_db:", "node_db:"}},
+		{name: "unknown capability", configure: func(c *Config) { c.Capabilities = []string{"flies"} }, problems: []string{"capabilities:"}},
+		{name: "unknown log module", configure: func(c *Config) { c.LogLevels = map[string]string{"nowhere": "debug"} }, problems: []string{"log_levels:"}},
+		{name: "bad seed", configure: func(c *Config) { c.Seeds = []string{"seed.example"} }, problems: []string{"seeds:"}},
+		{name: "bad bootstrap url", configure: func(c *Config) { c.BootstrapURLs = []string{"ftp://seeds.example"} }, problems: []string{"bootstrap_urls:"}},
+		{name: "api on tcp without a token", configure: func(c *Config) { c.APIAddress = "127.0.0.1:9092" }, problems: []string{"api_token:"}},
+		{name: "api on a socket without a token", configure: func(c *Config) { c.APIAddress = "unix:./api.sock" }},
+		{name: "client address on the node's port", configure: func(c *Config) { c.ClientAddress = ":9090" }, problems: []string{"client_address:"}},
+		{name: "bad subscription key", configure: func(c *Config) { c.SubscriptionKeys = map[string]string{"friends": "short"} }, problems: []string{"subscription_keys.friends:"}},
+		{name: "old manifest version", configure: func(c *Config) { c.MinManifestVersion = ManifestVersionSigned }, problems: []string{"min_manifest_version:"}},
+		{name: "future manifest version", configure: func(c *Config) { c.MinManifestVersion = ManifestVersion + 1 }, problems: []string{"min_manifest_version:"}},
+		{name: "unreachable certificate quorum", configure: func(c *Config) { c.CertificateQuorum, c.CertificateSources = 3, 2 }, problems: []string{"certificate_quorum:"}},
+		{name: "negative worker count", configure: func(c *Config) { c.DispatchWorkers = -1 }, problems: []string{"dispatch_workers:"}},
+		{name: "retention shorter than the replay window", configure: func(c *Config) { c.Retention.MaxAge = 2 * time.Hour }, problems: []string{"retention.max_age:"}},
+		// every problem is listed at once
+		{name: "several problems", configure: func(c *Config) { c.Port, c.Host, c.Clock.MaxSkew = 0, "", -time.Second }, problems: []string{"clock.max_skew:", "host:", "port:"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := validConfig()
+			tc.configure(&c)
+			err := c.Validate()
+			if len(tc.problems) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			configErr := &ConfigError{}
+			require.True(t, errors.As(err, &configErr), "%v", err)
+			require.Len(t, configErr.Problems, len(tc.problems), configErr.Problems)
+			for i, p := range tc.problems {
+				assert.True(t, strings.HasPrefix(configErr.Problems[i], p), "%q should start with %q", configErr.Problems[i], p)
+			}
+		})
+	}
+}
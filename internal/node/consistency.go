@@ -0,0 +1,326 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const (
+	defaultConsistencyPeers = 3
+	// MaxStateTopics is the most topics hashed by a single /state request
+	MaxStateTopics = 64
+	// consistencyStreak is how many checks in a row a topic has to differ
+	// from a peer's before it is reported, as actions still propagating make
+	// single differences common
+	consistencyStreak = 2
+)
+
+// ConsistencyConfig is read from the consistency section of the config
+// file. Peers periodically compare hashes of the graph their subscriptions
+// reach with a few other peers to find where their graphs have diverged.
+type ConsistencyConfig struct {
+	// Interval is how often hashes are compared, 0 turns the checks off
+	Interval time.Duration `mapstructure:"interval"`
+	// Peers is how many peers are compared with each time
+	Peers int `mapstructure:"peers"`
+}
+
+func (c ConsistencyConfig) withDefaults() ConsistencyConfig {
+	if c.Peers == 0 {
+		c.Peers = defaultConsistencyPeers
+	}
+	return c
+}
+
+func (c ConsistencyConfig) validate(check *configCheck) {
+	nonNegative(check, "interval", c.Interval)
+	nonNegative(check, "peers", c.Peers)
+}
+
+// StateHashes are the hashes of the part of a namespace's graph each topic
+// reaches. Node and relation IDs are generated by each node so the hashes
+// cover what the entities hold, see graph.State. The empty topic stands for
+// the whole graph.
+type StateHashes struct {
+	Namespace string            `json:"namespace,omitempty"`
+	Topics    map[string]string `json:"topics"`
+	// Root hashes the topic hashes so a single comparison shows whether any
+	// of them differ
+	Root string `json:"root"`
+}
+
+func newStateHashes(namespace string, topics map[string]string) *StateHashes {
+	h := sha256.New()
+	for _, topic := range slices.Sorted(maps.Keys(topics)) {
+		h.Write([]byte(topic))
+		h.Write([]byte{0})
+		h.Write([]byte(topics[topic]))
+		h.Write([]byte{0})
+	}
+	return &StateHashes{
+		Namespace: namespace,
+		Topics:    topics,
+		Root:      hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+// consistencyChecker compares state hashes with peers and remembers which
+// topics differed last time
+type consistencyChecker struct {
+	config ConsistencyConfig
+	busy   atomic.Bool
+
+	mu      sync.Mutex
+	streaks map[divergence]int
+}
+
+type divergence struct {
+	remoteAddr string
+	namespace  string
+	topic      string
+}
+
+// newConsistencyChecker returns nil if the checks are turned off
+func newConsistencyChecker(config ConsistencyConfig) *consistencyChecker {
+	if config.Interval == 0 {
+		return nil
+	}
+	return &consistencyChecker{
+		config:  config.withDefaults(),
+		streaks: map[divergence]int{},
+	}
+}
+
+// compare records which topics match the peer's and returns those which
+// have now differed for long enough to report
+func (c *consistencyChecker) compare(remoteAddr string, local, remote *StateHashes) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	diverged := []string{}
+	for topic, hash := range local.Topics {
+		d := divergence{remoteAddr, local.Namespace, topic}
+		other, ok := remote.Topics[topic]
+		if !ok || other == hash {
+			delete(c.streaks, d)
+			continue
+		}
+		c.streaks[d]++
+		if c.streaks[d] == consistencyStreak {
+			diverged = append(diverged, topic)
+		}
+	}
+	slices.Sort(diverged)
+	return diverged
+}
+
+// holdsTopic reports whether the node keeps everything a topic reaches in a
+// namespace, because it subscribes to the topic or to everything. Only a
+// node subscribed to everything holds the whole graph, the empty topic.
+func (n *node) holdsTopic(namespace, topic string) bool {
+	if !n.hostsNamespace(namespace) {
+		return false
+	}
+
+	n.subscriptionsMu.Lock()
+	defer n.subscriptionsMu.Unlock()
+
+	for key := range n.subscribed {
+		if inNamespace(key, namespace) {
+			if topic == "" {
+				return false
+			}
+			_, ok := n.subscribed[namespaceKeys(namespace, topicKeys([]string{topic}))[0]]
+			return ok
+		}
+	}
+	return true
+}
+
+// stateHashes hashes the graph each topic the node holds reaches, leaving
+// out those it doesn't
+func (n *node) stateHashes(namespace string, topics []string) (*StateHashes, error) {
+	g, err := n.graphFor(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]string{}
+	for _, topic := range topics {
+		if !n.holdsTopic(namespace, topic) {
+			continue
+		}
+
+		var state *graph.State
+		if topic == "" {
+			state, err = g.State()
+		} else {
+			state, err = g.TopicState(topic)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("hashing %q: %w", topic, err)
+		}
+		hashes[topic] = state.Hash
+	}
+	return newStateHashes(namespace, hashes), nil
+}
+
+// handleState serves the hashes of the topics given as topic parameters,
+// the whole graph if there are none
+func (n *node) handleState(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+
+	topics := req.URL.Query()["topic"]
+	if len(topics) == 0 {
+		topics = []string{""}
+	}
+	if len(topics) > MaxStateTopics {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("at most %d topics can be hashed at once", MaxStateTopics)))
+		return
+	}
+
+	hashes, err := n.stateHashes(namespace, topics)
+	if err != nil {
+		n.logger.Error("hashing state", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n.writeJSON(w, hashes)
+}
+
+// checkConsistency compares the hashes of what the node's subscriptions
+// reach in each namespace with a sample of peers
+func (n *node) checkConsistency(ctx context.Context) error {
+	c := n.consistency
+	if !c.busy.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer c.busy.Store(false)
+
+	peers, err := n.store.GetAllPeers(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching peers: %w", err)
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	peers = peers[:min(len(peers), c.config.Peers)]
+	if len(peers) == 0 {
+		return nil
+	}
+
+	for _, namespace := range append([]string{""}, slices.Sorted(maps.Keys(n.namespaces))...) {
+		topics := n.subscribedTopics(namespace)
+		if len(topics) == 0 {
+			topics = []string{""}
+		}
+		slices.Sort(topics)
+		topics = topics[:min(len(topics), MaxStateTopics)]
+
+		local, err := n.stateHashes(namespace, topics)
+		if err != nil {
+			return err
+		}
+		if len(local.Topics) == 0 {
+			// subscribed to entity IDs alone, which aren't hashed
+			continue
+		}
+
+		for _, peer := range peers {
+			var remote *StateHashes
+			err := n.tryPeerAddresses(ctx, peer, func(addr string) error {
+				remote, err = n.fetchStateHashes(ctx, addr, namespace, topics)
+				return err
+			})
+			if err != nil {
+				n.logger.Debug("fetching state hashes", "error", err, "remote", peer.RemoteAddr)
+				continue
+			}
+
+			for _, topic := range c.compare(peer.RemoteAddr, local, remote) {
+				n.reportDivergence(peer, namespace, topic)
+			}
+		}
+	}
+	return nil
+}
+
+func (n *node) reportDivergence(peer *model.PeerSpec, namespace, topic string) {
+	n.logger.Warn("graph diverged from peer", "remote", peer.RemoteAddr, "namespace", namespace, "topic", topic)
+	n.metrics.stateDivergences.Inc()
+	n.events.Publish(StateDiverged{
+		At:         time.Now().UTC(),
+		RemoteAddr: peer.RemoteAddr,
+		Namespace:  namespace,
+		Topic:      topic,
+	})
+}
+
+func (n *node) fetchStateHashes(ctx context.Context, remoteAddr, namespace string, topics []string) (*StateHashes, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
+	defer cancelFn()
+
+	q := url.Values{"topic": topics}
+	if namespace != "" {
+		q.Set("namespace", namespace)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/state?%s", remoteAddr, q.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating state request: %w", err)
+	}
+	req.Header.Add(HeaderNodeID, n.nodeID)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting state: %w", err)
+	}
+
+	body := resp.Body
+	defer body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad state response: %d", resp.StatusCode)
+	}
+
+	hashes := &StateHashes{}
+	err = json.NewDecoder(io.LimitReader(body, MaxBodySize)).Decode(hashes)
+	if err != nil {
+		return nil, fmt.Errorf("decoding state: %w", err)
+	}
+	return hashes, nil
+}
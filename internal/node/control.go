@@ -0,0 +1,204 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/bloom"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const defaultControlMaxSkew = time.Minute
+
+var (
+	// ErrControlUnsigned is returned for an unsigned hello, goodbye or ping
+	// from an address with a node key bound to it, or from any address if
+	// signatures are required
+	ErrControlUnsigned = errors.New("control message isn't signed")
+	// ErrNodeKeyMismatch is returned when a control message is signed by a
+	// different key to the one bound to the sender's address
+	ErrNodeKeyMismatch = errors.New("node key doesn't match the address")
+	// ErrControlExpired is returned when a control message's timestamp is
+	// too far from the node's clock
+	ErrControlExpired = errors.New("control message timestamp out of range")
+)
+
+// ControlConfig is read from the control section of the config file. Hellos,
+// goodbyes and pings are signed with a key kept in the node database, which
+// is bound to the sender's address when it first joins or pings. Later
+// control messages from the address must be signed by the same key, so one
+// node can't deregister or re-register another by spoofing its address. The
+// binding goes when the peer is dropped, so a node which loses its database
+// can rejoin once it has been missed.
+type ControlConfig struct {
+	// RequireSignatures rejects unsigned control messages from any address.
+	// Otherwise they are accepted from addresses without a key bound to
+	// them, so nodes which don't sign can still join.
+	RequireSignatures bool `mapstructure:"require_signatures"`
+	// MaxSkew is how far a control message's timestamp can be from the
+	// node's clock
+	MaxSkew time.Duration `mapstructure:"max_skew"`
+}
+
+func (c ControlConfig) withDefaults() ControlConfig {
+	if c.MaxSkew == 0 {
+		c.MaxSkew = defaultControlMaxSkew
+	}
+	return c
+}
+
+func (c ControlConfig) validate(check *configCheck) {
+	nonNegative(check, "max_skew", c.MaxSkew)
+}
+
+// loadNodeKey returns the node's key from the store, generating one the first
+// time the node starts
+func loadNodeKey(ctx context.Context, s Store) (ed25519.PrivateKey, error) {
+	key, err := s.GetNodeKey(ctx)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, model.ErrNotFound) {
+		return nil, err
+	}
+
+	_, key, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating node key: %w", err)
+	}
+	err = s.PutNodeKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// another process sharing the database may have stored its key first
+	return s.GetNodeKey(ctx)
+}
+
+// encodeNodeKey returns the form a node's public key is sent and stored in
+func encodeNodeKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// NodeKey returns the public key the node signs control messages with, which
+// invitations to join seeds name
+func (n *node) NodeKey() string {
+	return encodeNodeKey(n.nodeKey.Public().(ed25519.PublicKey))
+}
+
+// ControlSigningPayload returns what a node signs to send a control message.
+// The host is the address the message was sent to, so it can't be replayed
+// against other nodes, and the timestamp is sent as is in the
+// x-propolis-timestamp header.
+func ControlSigningPayload(method, host, path, timestamp string, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	return []byte("propolis-control\n" + method + "\n" + host + "\n" + path + "\n" + timestamp + "\n" + hex.EncodeToString(digest[:]))
+}
+
+// signControl signs a control message with the node key
+func (n *node) signControl(req *http.Request, body []byte) {
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	payload := ControlSigningPayload(req.Method, cmp.Or(req.Host, req.URL.Host), req.URL.Path, timestamp, body)
+	req.Header.Set(HeaderNodeKey, n.NodeKey())
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(ed25519.Sign(n.nodeKey, payload)))
+}
+
+// readControlBody reads the body of a control message, which is at most a
+// subscription filter, so that it can be checked against the signature
+func readControlBody(req *http.Request) ([]byte, error) {
+	defer req.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(req.Body, bloom.MaxEncodedLen+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	return body, nil
+}
+
+// verifyControl checks a control message's signature against the key bound
+// to the sender's address, peer being nil if the address isn't known. It
+// returns the key which signed the message, empty if it wasn't signed.
+func (n *node) verifyControl(req *http.Request, body []byte, peer *model.PeerSpec) (string, error) {
+	encoded := req.Header.Get(HeaderNodeKey)
+	if encoded == "" {
+		if n.control.RequireSignatures || (peer != nil && peer.NodeKey != "") {
+			return "", ErrControlUnsigned
+		}
+		return "", nil
+	}
+	if peer != nil && peer.NodeKey != "" && peer.NodeKey != encoded {
+		return "", ErrNodeKeyMismatch
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return "", identity.ErrUnsupportedPublicKey
+	}
+
+	timestamp := req.Header.Get(HeaderTimestamp)
+	signedAt, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return "", identity.ErrBadSignature
+	}
+	now := time.Now().UTC()
+	if signedAt.Before(now.Add(-n.control.MaxSkew)) || signedAt.After(now.Add(n.control.MaxSkew)) {
+		return "", ErrControlExpired
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(req.Header.Get(HeaderSignature))
+	if err != nil {
+		return "", identity.ErrBadSignature
+	}
+	if !ed25519.Verify(key, ControlSigningPayload(req.Method, req.Host, req.URL.Path, timestamp, body), sig) {
+		return "", identity.ErrBadSignature
+	}
+
+	return encoded, nil
+}
+
+// writeControlError rejects a control message which failed verifyControl
+func (n *node) writeControlError(w http.ResponseWriter, req *http.Request, err error) {
+	n.metrics.controlRejected.Inc()
+	n.logger.Warn("rejecting control message", "error", err, "remote", req.RemoteAddr, "path", req.URL.Path)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(err.Error()))
+}
+
+// newControlRequest creates a signed control message
+func (n *node) newControlRequest(ctx context.Context, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	n.signControl(req, body)
+	n.setProtocolHeaders(req.Header)
+	return req, nil
+}
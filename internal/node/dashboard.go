@@ -0,0 +1,212 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+const (
+	defaultRecentActions = 50
+	maxRecentActions     = 500
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// AdminAction is an action as listed by the admin API. Private statements are
+// left encrypted.
+type AdminAction struct {
+	ID         string     `json:"id"`
+	Identity   string     `json:"identity,omitempty"`
+	Statement  string     `json:"statement"`
+	KeyID      string     `json:"keyId,omitempty"`
+	RemoteAddr string     `json:"remoteAddr,omitempty"`
+	NodeID     string     `json:"nodeId,omitempty"`
+	CreatedAt  *time.Time `json:"createdAt,omitempty"`
+	ReceivedAt time.Time  `json:"receivedAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+}
+
+// AdminEvent is an event from the node's event bus as streamed by the admin
+// API. Only the fields relevant to the event's type are set.
+type AdminEvent struct {
+	Type       string       `json:"type"`
+	At         time.Time    `json:"at"`
+	RemoteAddr string       `json:"remoteAddr,omitempty"`
+	NodeID     string       `json:"nodeId,omitempty"`
+	Reason     string       `json:"reason,omitempty"`
+	Filter     string       `json:"filter,omitempty"`
+	Namespace  string       `json:"namespace,omitempty"`
+	Topic      string       `json:"topic,omitempty"`
+	Action     *AdminAction `json:"action,omitempty"`
+}
+
+func newAdminAction(action *graph.Action) *AdminAction {
+	return &AdminAction{
+		ID:         action.ID,
+		Identity:   action.Identity,
+		Statement:  action.Action,
+		KeyID:      action.KeyID,
+		RemoteAddr: action.RemoteAddr,
+		NodeID:     action.NodeID,
+		CreatedAt:  action.CreatedAt,
+		ReceivedAt: action.Timestamp,
+		ExpiresAt:  action.ExpiresAt,
+	}
+}
+
+func newAdminEvent(e Event) AdminEvent {
+	out := AdminEvent{At: e.Time()}
+	switch e := e.(type) {
+	case PeerJoined:
+		out.Type = "peer-joined"
+		out.RemoteAddr = e.RemoteAddr
+		out.NodeID = e.NodeID
+	case PeerDropped:
+		out.Type = "peer-dropped"
+		out.RemoteAddr = e.RemoteAddr
+		out.Reason = e.Reason
+	case ActionAccepted:
+		out.Type = "action-accepted"
+		out.Action = newAdminAction(&e.Action)
+	case ActionRejected:
+		out.Type = "action-rejected"
+		out.Action = newAdminAction(&e.Action)
+		out.Reason = e.Reason
+	case SubscriptionChanged:
+		out.Type = "subscription-changed"
+		out.RemoteAddr = e.RemoteAddr
+		out.Filter = e.Filter
+	case StateDiverged:
+		out.Type = "state-diverged"
+		out.RemoteAddr = e.RemoteAddr
+		out.Namespace = e.Namespace
+		out.Topic = e.Topic
+	}
+	return out
+}
+
+// the dashboard is a small web UI for watching a node, served on its own
+// address. It is a static page driven by the admin API, which is served
+// alongside it and needs the admin token as usual.
+func (n *node) newDashboardMux() (*http.ServeMux, error) {
+	static, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		return nil, fmt.Errorf("reading dashboard files: %w", err)
+	}
+
+	mux := n.newAdminMux(true)
+	mux.Handle("GET /", http.FileServerFS(static))
+	return mux, nil
+}
+
+func (n *node) startDashboardServer() (*localServer, error) {
+	if n.dashboardAddr == "" {
+		return nil, nil
+	}
+
+	mux, err := n.newDashboardMux()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, socketPath, err := listenLocal(n.dashboardAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on dashboard address: %w", err)
+	}
+	if socketPath == "" && n.adminToken == "" {
+		listener.Close()
+		return nil, errors.New("an admin token is required when the dashboard listens on TCP")
+	}
+
+	n.logger.Info("starting dashboard server", "addr", listener.Addr())
+	return n.serveLocal(listener, socketPath, mux), nil
+}
+
+// handleAdminActions lists the most recently received actions, newest first,
+// up to the limit parameter
+func (n *node) handleAdminActions(w http.ResponseWriter, req *http.Request) {
+	limit := defaultRecentActions
+	if s := req.URL.Query().Get("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid limit: " + s))
+			return
+		}
+		limit = min(l, maxRecentActions)
+	}
+
+	actions, err := n.store.GetRecentActions(req.Context(), limit)
+	if err != nil {
+		n.logger.Error("fetching recent actions", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]*AdminAction, 0, len(actions))
+	for _, action := range actions {
+		out = append(out, newAdminAction(action))
+	}
+	n.writeJSON(w, out)
+}
+
+// handleAdminEvents streams every event from the node's event bus, one JSON
+// object per line, until the client disconnects
+func (n *node) handleAdminEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	events := n.events.Subscribe()
+	defer n.events.Unsubscribe(events)
+
+	w.Header().Set(HeaderContentType, ContentTypeNDJSON)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-n.ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			err := enc.Encode(newAdminEvent(e))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
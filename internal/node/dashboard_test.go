@@ -0,0 +1,133 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDashboard returns a node serving the dashboard with an admin token
+func newTestDashboard(t *testing.T) (*node, *httptest.Server) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	t.Cleanup(cancelFn)
+
+	n := newTestNode(t)
+	n.ctx = ctx
+	n.adminToken = "secret"
+	n.events = newEventBus()
+	t.Cleanup(n.events.Close)
+
+	mux, err := n.newDashboardMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return n, server
+}
+
+func TestDashboard(t *testing.T) {
+	n, server := newTestDashboard(t)
+
+	now := time.Now().UTC()
+	for i, id := range []string{"1", "2", "3"} {
+		require.NoError(t, n.store.CreateAction(context.Background(), graph.Action{
+			ID:        id,
+			Timestamp: now.Add(time.Duration(i) * time.Minute),
+			Action:    "MERGE (p:Post{id:'" + id + "'})",
+			Identity:  "alice",
+		}))
+	}
+
+	testCases := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+		ids    []string
+	}{
+		// the page itself is public, everything it shows needs the token
+		{name: "page", path: "/", status: http.StatusOK},
+		{name: "no token", path: "/admin/actions", status: http.StatusUnauthorized},
+		{name: "wrong token", path: "/admin/actions", token: "guess", status: http.StatusUnauthorized},
+		{name: "recent actions", path: "/admin/actions", token: "secret", status: http.StatusOK, ids: []string{"3", "2", "1"}},
+		{name: "limit", path: "/admin/actions?limit=2", token: "secret", status: http.StatusOK, ids: []string{"3", "2"}},
+		{name: "zero limit", path: "/admin/actions?limit=0", token: "secret", status: http.StatusBadRequest},
+		{name: "bad limit", path: "/admin/actions?limit=all", token: "secret", status: http.StatusBadRequest},
+		{name: "events without token", path: "/admin/events", status: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := apiRequest(t, server, "GET", tc.path, tc.token, "")
+			require.Equal(t, tc.status, resp.StatusCode)
+			if tc.ids == nil {
+				return
+			}
+			actions := []*AdminAction{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&actions))
+			ids := []string{}
+			for _, a := range actions {
+				ids = append(ids, a.ID)
+				assert.Equal(t, "alice", a.Identity)
+			}
+			assert.Equal(t, tc.ids, ids)
+		})
+	}
+
+	resp := apiRequest(t, server, "GET", "/", "", "")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "<title>propolis</title>")
+}
+
+func TestDashboardEvents(t *testing.T) {
+	n, server := newTestDashboard(t)
+
+	// the stream is subscribed once the headers are written
+	resp := apiRequest(t, server, "GET", "/admin/events", "secret", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ContentTypeNDJSON, resp.Header.Get(HeaderContentType))
+
+	n.events.Publish(PeerJoined{At: time.Now().UTC(), RemoteAddr: "10.0.0.2:9000", NodeID: "peer"})
+	n.events.Publish(ActionRejected{At: time.Now().UTC(), Action: graph.Action{ID: "a1", Action: "MERGE (p:Post{id:'1'})"}, Reason: "blocked"})
+
+	lines := bufio.NewScanner(resp.Body)
+	events := []AdminEvent{}
+	for len(events) < 2 && lines.Scan() {
+		e := AdminEvent{}
+		require.NoError(t, json.Unmarshal(lines.Bytes(), &e))
+		events = append(events, e)
+	}
+	require.Len(t, events, 2)
+
+	assert.Equal(t, "peer-joined", events[0].Type)
+	assert.Equal(t, "10.0.0.2:9000", events[0].RemoteAddr)
+	assert.Equal(t, "peer", events[0].NodeID)
+	assert.Nil(t, events[0].Action)
+
+	assert.Equal(t, "action-rejected", events[1].Type)
+	assert.Equal(t, "blocked", events[1].Reason)
+	require.NotNil(t, events[1].Action)
+	assert.Equal(t, "a1", events[1].Action.ID)
+}
+
+func TestStartDashboardServer(t *testing.T) {
+	n := newTestNode(t)
+
+	server, err := n.startDashboardServer()
+	require.NoError(t, err)
+	assert.Nil(t, server)
+
+	// anyone who can reach a TCP address could use the admin API
+	n.dashboardAddr = "127.0.0.1:0"
+	_, err = n.startDashboardServer()
+	assert.ErrorContains(t, err, "admin token is required")
+}
@@ -0,0 +1,183 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/bits-and-blooms/bitset"
+)
+
+const (
+	defaultDedupeCacheSize = 10000
+	// dedupeFilterBits sizes the filter of every action ID seen, 8Mbit keeps
+	// false positives around 2% for a million actions
+	dedupeFilterBits   = 1 << 23
+	dedupeFilterHashes = 4
+)
+
+const (
+	dedupeResultRecent = "recent"
+	dedupeResultNew    = "new"
+	dedupeResultStore  = "store"
+)
+
+// actionDedupe answers whether an action has been seen before without going
+// to the store in the common cases. Recently seen IDs are kept in an LRU so
+// duplicates arriving by several routes are caught, and a bloom filter of
+// every ID seen means brand new actions don't need a lookup either.
+type actionDedupe struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	recent   map[string]*list.Element
+	seen     *bitset.BitSet
+}
+
+func newActionDedupe(capacity int) *actionDedupe {
+	if capacity <= 0 {
+		capacity = defaultDedupeCacheSize
+	}
+	return &actionDedupe{
+		capacity: capacity,
+		order:    list.New(),
+		recent:   map[string]*list.Element{},
+		seen:     bitset.New(dedupeFilterBits),
+	}
+}
+
+// Add records the ID as seen
+func (d *actionDedupe) Add(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.setSeen(id)
+
+	if e, ok := d.recent[id]; ok {
+		d.order.MoveToFront(e)
+		return
+	}
+
+	d.recent[id] = d.order.PushFront(id)
+	if d.order.Len() > d.capacity {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.recent, oldest.Value.(string))
+	}
+}
+
+// AddSeen records the ID in the filter only, for loading IDs already stored
+func (d *actionDedupe) AddSeen(id string) {
+	d.AddDigest(int64(actionDigest(id)))
+}
+
+// AddDigest records the digest of an ID in the filter, for loading the IDs of
+// pruned actions
+func (d *actionDedupe) AddDigest(digest int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, pos := range filterPositions(uint64(digest)) {
+		d.seen.Set(pos)
+	}
+}
+
+// IsRecent returns true if the ID is in the LRU
+func (d *actionDedupe) IsRecent(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.recent[id]
+	if ok {
+		d.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// MaybeSeen returns false if the ID has definitely never been seen
+func (d *actionDedupe) MaybeSeen(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, pos := range filterPositions(actionDigest(id)) {
+		if !d.seen.Test(pos) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *actionDedupe) setSeen(id string) {
+	for _, pos := range filterPositions(actionDigest(id)) {
+		d.seen.Set(pos)
+	}
+}
+
+// actionDigest is the hash of an action ID kept once the action is pruned
+func actionDigest(id string) uint64 {
+	return xxhash.ChecksumString64S(id, 0)
+}
+
+// filterPositions uses double hashing to derive the filter bits for an ID
+// from its digest, so pruned IDs can be loaded into the filter too
+func filterPositions(digest uint64) [dedupeFilterHashes]uint {
+	h1 := uint32(digest)
+	h2 := uint32(digest >> 32)
+
+	positions := [dedupeFilterHashes]uint{}
+	for i := range positions {
+		positions[i] = uint((h1 + uint32(i)*h2) % dedupeFilterBits)
+	}
+	return positions
+}
+
+// isActionProcessed checks the dedupe cache before falling back to the store
+func (n *node) isActionProcessed(ctx context.Context, id string) (bool, error) {
+	if n.dedupe.IsRecent(id) {
+		n.metrics.dedupeLookups.WithLabelValues(dedupeResultRecent).Inc()
+		return true, nil
+	}
+
+	if !n.dedupe.MaybeSeen(id) {
+		n.metrics.dedupeLookups.WithLabelValues(dedupeResultNew).Inc()
+		return false, nil
+	}
+
+	n.metrics.dedupeLookups.WithLabelValues(dedupeResultStore).Inc()
+	isProcessed, err := n.store.IsActionProcessed(ctx, id, int64(actionDigest(id)))
+	if err != nil {
+		return false, err
+	}
+
+	if isProcessed {
+		n.dedupe.Add(id)
+	}
+
+	return isProcessed, nil
+}
+
+// loadDedupe fills the filter with the IDs of the actions already stored and
+// those pruned
+func (n *node) loadDedupe() error {
+	err := n.store.EachActionID(n.ctx, n.dedupe.AddSeen)
+	if err != nil {
+		return err
+	}
+	return n.store.EachActionDigest(n.ctx, n.dedupe.AddDigest)
+}
@@ -0,0 +1,95 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActionDedupe(t *testing.T) {
+	assert := assert.New(t)
+	d := newActionDedupe(2)
+
+	assert.False(d.IsRecent("a"))
+	assert.False(d.MaybeSeen("a"))
+
+	d.Add("a")
+	d.Add("b")
+	assert.True(d.IsRecent("a"))
+	assert.True(d.IsRecent("b"))
+
+	// reading a keeps it recent so b is the one evicted, although the filter
+	// still remembers it
+	assert.True(d.IsRecent("a"))
+	d.Add("c")
+	assert.True(d.IsRecent("a"))
+	assert.False(d.IsRecent("b"))
+	assert.True(d.IsRecent("c"))
+	assert.True(d.MaybeSeen("b"))
+
+	// IDs loaded from the store or as digests of pruned actions are only in
+	// the filter
+	d.AddSeen("stored")
+	d.AddDigest(int64(actionDigest("pruned")))
+	assert.False(d.IsRecent("stored"))
+	assert.True(d.MaybeSeen("stored"))
+	assert.False(d.IsRecent("pruned"))
+	assert.True(d.MaybeSeen("pruned"))
+	assert.False(d.MaybeSeen("unseen"))
+
+	assert.Equal(defaultDedupeCacheSize, newActionDedupe(0).capacity)
+}
+
+func TestIsActionProcessed(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode(t)
+	n.ctx = ctx
+	n.dedupe = newActionDedupe(2)
+
+	for _, id := range []string{"stored", "pruned"} {
+		require.NoError(t, n.store.CreateAction(ctx, graph.Action{ID: id, Identity: "alice", Action: "MERGE (p:Post{id:'1'})", Timestamp: time.Now().UTC()}))
+	}
+	require.NoError(t, n.store.PruneActions(ctx, []string{"pruned"}, []int64{int64(actionDigest("pruned"))}))
+	require.NoError(t, n.loadDedupe())
+
+	lookups := func(result string) float64 {
+		return testutil.ToFloat64(n.metrics.dedupeLookups.WithLabelValues(result))
+	}
+
+	tests := []struct {
+		name      string
+		id        string
+		processed bool
+		result    string
+	}{
+		{name: "new action", id: "new", result: dedupeResultNew},
+		{name: "stored action", id: "stored", processed: true, result: dedupeResultStore},
+		{name: "stored action again", id: "stored", processed: true, result: dedupeResultRecent},
+		{name: "pruned action", id: "pruned", processed: true, result: dedupeResultStore},
+		{name: "pruned action again", id: "pruned", processed: true, result: dedupeResultRecent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := lookups(tt.result)
+			processed, err := n.isActionProcessed(ctx, tt.id)
+			require.NoError(t, err)
+			assert.Equal(t, tt.processed, processed)
+			assert.Equal(t, before+1, lookups(tt.result))
+		})
+	}
+
+	// a duplicate arriving after the action is processed never reaches the
+	// store
+	n.dedupe.Add("processed")
+	before := lookups(dedupeResultStore)
+	processed, err := n.isActionProcessed(ctx, "processed")
+	require.NoError(t, err)
+	assert.True(t, processed)
+	assert.Equal(t, before, lookups(dedupeResultStore))
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+)
+
+// verifyDelegatedAction checks an action signed by a key the identity
+// delegated to: the delegation must be signed by the identity's certificate,
+// the action by the delegate's key and the statement must be within the
+// delegation's scope. Private actions can't be checked by the nodes which
+// can't read them so they can't be delegated.
+func verifyDelegatedAction(cert *x509.Certificate, action *graph.Action, now time.Time) error {
+	d, err := identity.ParseDelegation(action.Delegation)
+	if err != nil {
+		return identity.ErrBadSignature
+	}
+	if d.Identifier != action.Identity {
+		return identity.ErrUnauthorized
+	}
+
+	err = identity.VerifyDelegation(d, cert, now)
+	switch {
+	case err == identity.ErrBadDelegation:
+		return identity.ErrBadSignature
+	case err != nil:
+		return err
+	}
+
+	signed, err := manifestFor(action).SigningPayload()
+	if err != nil {
+		return identity.ErrBadSignature
+	}
+	v, err := d.NewVerifier()
+	if err != nil {
+		return err
+	}
+	v.Add(signed)
+	err = v.Verify(action.EncodedSignature)
+	if err != nil {
+		return err
+	}
+
+	if action.KeyID != "" {
+		return identity.ErrDelegationScope
+	}
+	parser, err := ast.Parse(action.Action)
+	if err != nil || parser.Command() == nil {
+		return identity.ErrBadSignature
+	}
+	if !delegationCovers(d, parser.Command().Entity()) {
+		return identity.ErrDelegationScope
+	}
+	return nil
+}
+
+// delegationCovers reports whether the entity, and for a relation the nodes
+// it joins, are all within the delegation's scope
+func delegationCovers(d *identity.Delegation, e ast.Entity) bool {
+	if e == nil {
+		return false
+	}
+
+	id, _ := e.Attribute("id")
+	if !d.Covers(e.Labels(), id) {
+		return false
+	}
+
+	if r, ok := e.(ast.Relation); ok {
+		return delegationCovers(d, r.Left()) && delegationCovers(d, r.Right())
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SeedService  = "propolis"
+	SeedProtocol = "udp"
+)
+
+var errSeedsUnreachable = errors.New("no seeds could be reached")
+
+// BootstrapList is served from a bootstrap URL
+type BootstrapList struct {
+	Seeds []string `json:"seeds"`
+}
+
+// discoverSeeds finds seeds from the configured DNS domains and bootstrap URLs
+// in addition to any given explicitly
+func (n *node) discoverSeeds(ctx context.Context) []string {
+	n.reloadMu.RLock()
+	seeds := slices.Clone(n.seeds)
+	seedDomains := n.seedDomains
+	bootstrapURLs := n.bootstrapURLs
+	n.reloadMu.RUnlock()
+
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
+	defer cancelFn()
+
+	for _, domain := range seedDomains {
+		found, err := lookupSeeds(ctx, net.DefaultResolver, domain)
+		if err != nil {
+			n.logger.Error("looking up seeds", "error", err, "domain", domain)
+			continue
+		}
+		n.logger.Debug("found seeds in DNS", "domain", domain, "seeds", found)
+		seeds = append(seeds, found...)
+	}
+
+	client := &http.Client{Timeout: defaultTimeout}
+	for _, url := range bootstrapURLs {
+		found, err := fetchBootstrapList(ctx, client, url)
+		if err != nil {
+			n.logger.Error("fetching bootstrap list", "error", err, "url", url)
+			continue
+		}
+		n.logger.Debug("found seeds in bootstrap list", "url", url, "seeds", found)
+		seeds = append(seeds, found...)
+	}
+
+	slices.Sort(seeds)
+	return slices.Compact(seeds)
+}
+
+// connectSeeds reaches the seeds and, for relays, joins them. A node started
+// before its seeds keeps trying with backoff, once it has joined the regular
+// pings keep it joined.
+func (n *node) connectSeeds(ctx context.Context) {
+	for attempt := 1; ; attempt++ {
+		err := n.reachSeeds(ctx)
+		if err == nil {
+			if attempt > 1 {
+				n.logger.Info("reached seeds", "attempts", attempt)
+			}
+			if n.versions.config.Interval > 0 {
+				n.checkVersions(ctx)
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		wait := n.liveness.nextJoin(attempt)
+		n.logger.Warn("reaching seeds", "error", err, "attempt", attempt, "retry_in", wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (n *node) reachSeeds(ctx context.Context) error {
+	err := n.setInitialSeeds(ctx)
+	if err != nil {
+		return fmt.Errorf("setting initial seeds: %w", err)
+	}
+
+	if n.capabilities.Has(CapabilityRelay) {
+		// joining advertises caches to the seeds as replicas for their
+		// subscriptions
+		err = n.joinSeeds(ctx)
+		if err != nil {
+			return fmt.Errorf("joining: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// lookupSeeds returns the seeds in the _propolis._udp SRV records for the
+// domain, in priority order
+func lookupSeeds(ctx context.Context, resolver *net.Resolver, domain string) ([]string, error) {
+	_, records, err := resolver.LookupSRV(ctx, SeedService, SeedProtocol, domain)
+	if err != nil {
+		return nil, fmt.Errorf("looking up SRV records: %w", err)
+	}
+
+	seeds := make([]string, 0, len(records))
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		if host == "" {
+			continue
+		}
+		seeds = append(seeds, net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+	}
+
+	return seeds, nil
+}
+
+func fetchBootstrapList(ctx context.Context, client *http.Client, url string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating bootstrap request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching bootstrap list: %w", err)
+	}
+
+	body := resp.Body
+	defer body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad bootstrap response: %d", resp.StatusCode)
+	}
+
+	list := BootstrapList{}
+	err = json.NewDecoder(io.LimitReader(body, MaxBodySize)).Decode(&list)
+	if err != nil {
+		return nil, fmt.Errorf("decoding bootstrap list: %w", err)
+	}
+
+	seeds := make([]string, 0, len(list.Seeds))
+	for _, s := range list.Seeds {
+		_, _, err := net.SplitHostPort(s)
+		if err != nil {
+			continue
+		}
+		seeds = append(seeds, s)
+	}
+
+	return seeds, nil
+}
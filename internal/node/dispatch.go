@@ -0,0 +1,161 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"sync"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const (
+	defaultDispatchWorkers = 16
+	defaultPeerQueueSize   = 256
+)
+
+// peerQueue holds the actions waiting to be sent to one peer
+type peerQueue struct {
+	peer      *model.PeerSpec
+	actions   []graph.Action
+	scheduled bool
+}
+
+// dispatcher sends actions to peers from a fixed pool of workers. Each peer
+// has its own queue and at most one request in flight, so a slow peer only
+// holds up its own actions. Peers with work waiting are served in turn.
+type dispatcher struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	queueSize int
+	queues    map[string]*peerQueue
+	ready     []string
+	closed    bool
+	send      func(peer *model.PeerSpec, action graph.Action)
+	metrics   *nodeMetrics
+}
+
+func newDispatcher(queueSize int, send func(*model.PeerSpec, graph.Action), metrics *nodeMetrics) *dispatcher {
+	if queueSize <= 0 {
+		queueSize = defaultPeerQueueSize
+	}
+	d := &dispatcher{
+		queueSize: queueSize,
+		queues:    map[string]*peerQueue{},
+		send:      send,
+		metrics:   metrics,
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// Start runs the workers until the dispatcher is closed
+func (d *dispatcher) Start(workers int) {
+	if workers <= 0 {
+		workers = defaultDispatchWorkers
+	}
+	for range workers {
+		go d.work()
+	}
+}
+
+// Enqueue adds an action to the peer's queue. When the queue is full the
+// oldest action is dropped.
+func (d *dispatcher) Enqueue(peer *model.PeerSpec, action graph.Action) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	q, ok := d.queues[peer.RemoteAddr]
+	if !ok {
+		q = &peerQueue{}
+		d.queues[peer.RemoteAddr] = q
+	}
+	q.peer = peer
+
+	if len(q.actions) >= d.queueSize {
+		q.actions = q.actions[1:]
+		d.metrics.propagationDropped.Inc()
+	}
+	q.actions = append(q.actions, action)
+
+	if !q.scheduled {
+		q.scheduled = true
+		d.ready = append(d.ready, peer.RemoteAddr)
+		d.cond.Signal()
+	}
+}
+
+func (d *dispatcher) work() {
+	for {
+		d.mu.Lock()
+		for len(d.ready) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if d.closed {
+			d.mu.Unlock()
+			return
+		}
+
+		addr := d.ready[0]
+		d.ready = d.ready[1:]
+		q := d.queues[addr]
+		action := q.actions[0]
+		q.actions = q.actions[1:]
+		peer := q.peer
+		d.mu.Unlock()
+
+		d.send(peer, action)
+
+		d.mu.Lock()
+		if len(q.actions) > 0 {
+			d.ready = append(d.ready, addr)
+			d.cond.Signal()
+		} else {
+			q.scheduled = false
+			delete(d.queues, addr)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// Len returns the number of actions waiting to be sent
+func (d *dispatcher) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	count := 0
+	for _, q := range d.queues {
+		count += len(q.actions)
+	}
+	return count
+}
+
+// Close stops the workers once their current requests finish. Queued
+// actions are discarded.
+func (d *dispatcher) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	d.queues = map[string]*peerQueue{}
+	d.ready = nil
+	d.cond.Broadcast()
+}
@@ -0,0 +1,136 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sentActions records what a dispatcher sends to each peer
+type sentActions struct {
+	mu       sync.Mutex
+	byPeer   map[string][]string
+	inFlight map[string]*atomic.Int32
+	overlap  atomic.Bool
+	total    atomic.Int32
+}
+
+func newSentActions(peers ...string) *sentActions {
+	s := &sentActions{byPeer: map[string][]string{}, inFlight: map[string]*atomic.Int32{}}
+	for _, p := range peers {
+		s.inFlight[p] = &atomic.Int32{}
+	}
+	return s
+}
+
+func (s *sentActions) send(wait func(peer string)) func(*model.PeerSpec, graph.Action) {
+	return func(peer *model.PeerSpec, action graph.Action) {
+		inFlight := s.inFlight[peer.RemoteAddr]
+		if inFlight.Add(1) > 1 {
+			s.overlap.Store(true)
+		}
+		wait(peer.RemoteAddr)
+		inFlight.Add(-1)
+
+		s.mu.Lock()
+		s.byPeer[peer.RemoteAddr] = append(s.byPeer[peer.RemoteAddr], action.ID)
+		s.mu.Unlock()
+		s.total.Add(1)
+	}
+}
+
+func (s *sentActions) sent(peer string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.byPeer[peer]...)
+}
+
+func TestDispatcherFanOut(t *testing.T) {
+	n := newTestNode(t)
+	peers := []string{"slow", "b", "c"}
+	sent := newSentActions(peers...)
+
+	release := make(chan struct{})
+	d := newDispatcher(10, sent.send(func(peer string) {
+		if peer == "slow" {
+			<-release
+		}
+	}), n.metrics)
+	d.Start(2)
+	t.Cleanup(d.Close)
+
+	ids := []string{}
+	for i := range 5 {
+		id := fmt.Sprintf("a%d", i)
+		ids = append(ids, id)
+		for _, p := range peers {
+			d.Enqueue(&model.PeerSpec{RemoteAddr: p}, graph.Action{ID: id})
+		}
+	}
+
+	// the slow peer holds one worker but the other peers still get every
+	// action, in order
+	require.Eventually(t, func() bool {
+		return len(sent.sent("b")) == len(ids) && len(sent.sent("c")) == len(ids)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, ids, sent.sent("b"))
+	assert.Equal(t, ids, sent.sent("c"))
+	assert.Empty(t, sent.sent("slow"))
+	assert.Equal(t, len(ids)-1, d.Len())
+
+	close(release)
+	require.Eventually(t, func() bool {
+		return len(sent.sent("slow")) == len(ids)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, ids, sent.sent("slow"))
+	assert.Equal(t, 0, d.Len())
+	assert.False(t, sent.overlap.Load(), "more than one request in flight to a peer")
+	assert.Zero(t, testutil.ToFloat64(n.metrics.propagationDropped))
+}
+
+func TestDispatcherBackpressure(t *testing.T) {
+	n := newTestNode(t)
+	sent := newSentActions("a")
+	d := newDispatcher(3, sent.send(func(string) {}), n.metrics)
+	t.Cleanup(d.Close)
+
+	// with no workers running the queue fills and the oldest actions make
+	// way for new ones
+	peer := &model.PeerSpec{RemoteAddr: "a"}
+	for i := range 5 {
+		d.Enqueue(peer, graph.Action{ID: fmt.Sprintf("a%d", i)})
+	}
+	assert.Equal(t, 3, d.Len())
+	assert.Equal(t, float64(2), testutil.ToFloat64(n.metrics.propagationDropped))
+
+	d.Start(1)
+	require.Eventually(t, func() bool { return sent.total.Load() == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"a2", "a3", "a4"}, sent.sent("a"))
+	assert.Equal(t, 0, d.Len())
+}
+
+func TestDispatcherClose(t *testing.T) {
+	n := newTestNode(t)
+	sent := newSentActions("a")
+	d := newDispatcher(3, sent.send(func(string) {}), n.metrics)
+
+	peer := &model.PeerSpec{RemoteAddr: "a"}
+	d.Enqueue(peer, graph.Action{ID: "queued"})
+	d.Close()
+	assert.Equal(t, 0, d.Len())
+
+	// queued actions are discarded and new ones ignored
+	d.Enqueue(peer, graph.Action{ID: "late"})
+	assert.Equal(t, 0, d.Len())
+	d.Start(1)
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, sent.total.Load())
+}
@@ -0,0 +1,222 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+type EventType int
+
+const (
+	EventTypePeerJoined EventType = iota
+	EventTypePeerDropped
+	EventTypeActionAccepted
+	EventTypeActionRejected
+	EventTypeSubscriptionChanged
+	EventTypeStateDiverged
+)
+
+const eventBufferSize = 256
+
+// Event is implemented by all of the events emitted on the node's event bus.
+// Use a type switch to get at the details.
+type Event interface {
+	Type() EventType
+	Time() time.Time
+}
+
+// EventHook is called for every event, in order, from the bus's dispatch
+// goroutine. Hooks must not block for long.
+type EventHook func(Event)
+
+type PeerJoined struct {
+	At         time.Time
+	RemoteAddr string
+	NodeID     string
+}
+
+type PeerDropped struct {
+	At         time.Time
+	RemoteAddr string
+	Reason     string
+}
+
+type ActionAccepted struct {
+	At     time.Time
+	Action graph.Action
+}
+
+type ActionRejected struct {
+	At     time.Time
+	Action graph.Action
+	Reason string
+}
+
+// SubscriptionChanged is emitted when either this node's subscriptions change
+// (RemoteAddr is empty) or a peer reports a new subscription filter.
+type SubscriptionChanged struct {
+	At         time.Time
+	RemoteAddr string
+	Filter     string
+}
+
+// StateDiverged is emitted when what a topic reaches in the node's graph has
+// differed from a peer's for several consistency checks in a row. The empty
+// topic is the whole graph.
+type StateDiverged struct {
+	At         time.Time
+	RemoteAddr string
+	Namespace  string
+	Topic      string
+}
+
+func (e PeerJoined) Type() EventType          { return EventTypePeerJoined }
+func (e PeerJoined) Time() time.Time          { return e.At }
+func (e PeerDropped) Type() EventType         { return EventTypePeerDropped }
+func (e PeerDropped) Time() time.Time         { return e.At }
+func (e ActionAccepted) Type() EventType      { return EventTypeActionAccepted }
+func (e ActionAccepted) Time() time.Time      { return e.At }
+func (e ActionRejected) Type() EventType      { return EventTypeActionRejected }
+func (e ActionRejected) Time() time.Time      { return e.At }
+func (e SubscriptionChanged) Type() EventType { return EventTypeSubscriptionChanged }
+func (e SubscriptionChanged) Time() time.Time { return e.At }
+func (e StateDiverged) Type() EventType       { return EventTypeStateDiverged }
+func (e StateDiverged) Time() time.Time       { return e.At }
+
+// eventBus fans events out to channel subscribers and hooks. Publishing never
+// blocks the node: if a subscriber falls behind its events are dropped.
+type eventBus struct {
+	mu          sync.Mutex
+	queue       chan Event
+	subscribers []chan Event
+	hooks       []EventHook
+	dropped     uint64
+	done        chan struct{}
+	stopped     chan struct{}
+	closeOnce   sync.Once
+}
+
+func newEventBus() *eventBus {
+	b := &eventBus{
+		queue:   make(chan Event, eventBufferSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go b.dispatch()
+	return b
+}
+
+func (b *eventBus) Publish(e Event) {
+	select {
+	case <-b.done:
+	case b.queue <- e:
+	default:
+		b.mu.Lock()
+		b.dropped++
+		b.mu.Unlock()
+	}
+}
+
+func (b *eventBus) Subscribe() <-chan Event {
+	ch := make(chan Event, eventBufferSize)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-b.done:
+		close(ch)
+	default:
+		b.subscribers = append(b.subscribers, ch)
+	}
+
+	return ch
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe. The
+// channel isn't closed as dispatch may still be sending to it.
+func (b *eventBus) Unsubscribe(ch <-chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// dispatch ranges over a copy of the slice header so build a new one
+	// rather than deleting in place
+	b.subscribers = slices.DeleteFunc(slices.Clone(b.subscribers), func(sub chan Event) bool {
+		return sub == ch
+	})
+}
+
+func (b *eventBus) AddHook(hook EventHook) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks = append(b.hooks, hook)
+}
+
+func (b *eventBus) Dropped() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+func (b *eventBus) dispatch() {
+	defer close(b.stopped)
+	for {
+		select {
+		case <-b.done:
+			return
+		case e := <-b.queue:
+			b.mu.Lock()
+			hooks := b.hooks
+			subscribers := b.subscribers
+			b.mu.Unlock()
+
+			for _, hook := range hooks {
+				hook(e)
+			}
+
+			for _, ch := range subscribers {
+				select {
+				case ch <- e:
+				default:
+					b.mu.Lock()
+					b.dropped++
+					b.mu.Unlock()
+				}
+			}
+		}
+	}
+}
+
+func (b *eventBus) Close() {
+	b.closeOnce.Do(func() {
+		// subscribers are only closed once dispatch can't send to them
+		close(b.done)
+		<-b.stopped
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, ch := range b.subscribers {
+			close(ch)
+		}
+		b.subscribers = nil
+	})
+}
@@ -0,0 +1,327 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	ExportTypeKafka = "kafka"
+	ExportTypeNATS  = "nats"
+
+	defaultExportQueueSize = 4096
+	defaultExportBatchSize = 100
+	defaultExportTimeout   = 10 * time.Second
+)
+
+// ExportConfig is read from the export section of the config file. When a
+// type is set every action the node accepts is published to a Kafka topic or
+// NATS subject once it has been executed.
+type ExportConfig struct {
+	// Type is kafka or nats, empty disables the export
+	Type string `mapstructure:"type"`
+	// Servers are the Kafka brokers as host:port or the NATS server URLs
+	Servers []string `mapstructure:"servers"`
+	// Topic is the Kafka topic or NATS subject
+	Topic string `mapstructure:"topic"`
+	// QueueSize is how many actions can wait to be sent before new ones are
+	// dropped
+	QueueSize int `mapstructure:"queue_size"`
+	// BatchSize is the most actions sent in one write
+	BatchSize int           `mapstructure:"batch_size"`
+	Timeout   time.Duration `mapstructure:"timeout"`
+}
+
+func (c ExportConfig) withDefaults() ExportConfig {
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultExportQueueSize
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultExportBatchSize
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultExportTimeout
+	}
+	return c
+}
+
+func (c ExportConfig) validate(check *configCheck) {
+	nonNegative(check, "queue_size", c.QueueSize)
+	nonNegative(check, "batch_size", c.BatchSize)
+	nonNegative(check, "timeout", c.Timeout)
+
+	if c.Type == "" {
+		return
+	}
+	if !slices.Contains([]string{ExportTypeKafka, ExportTypeNATS}, c.Type) {
+		check.addf("type", "must be %s or %s, got %q", ExportTypeKafka, ExportTypeNATS, c.Type)
+	}
+	if len(c.Servers) == 0 {
+		check.addf("servers", "at least one is needed to export to %s", c.Type)
+	}
+	if c.Topic == "" {
+		check.addf("topic", "is needed to export to %s", c.Type)
+	}
+}
+
+// ExportedAction is the JSON message published for each accepted action.
+// Statements of private actions are left encrypted and have the ID of the
+// key needed to read them.
+type ExportedAction struct {
+	ID         string    `json:"id"`
+	Identity   string    `json:"identity"`
+	NodeID     string    `json:"nodeId"`
+	Statement  string    `json:"statement"`
+	KeyID      string    `json:"keyId,omitempty"`
+	Namespace  string    `json:"namespace,omitempty"`
+	EntityIDs  []string  `json:"entityIds"`
+	Topics     []string  `json:"topics,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	ExportedAt time.Time `json:"exportedAt"`
+}
+
+type exportMessage struct {
+	key   string
+	value []byte
+}
+
+// exportSink writes a batch of messages to the stream
+type exportSink interface {
+	write(ctx context.Context, msgs []exportMessage) error
+	Close() error
+}
+
+// exporter publishes accepted actions from its own goroutine so a slow or
+// unreachable broker doesn't hold up execution
+type exporter struct {
+	config  ExportConfig
+	sink    exportSink
+	logger  *slog.Logger
+	metrics *nodeMetrics
+	queue   chan exportMessage
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newExporter connects to the configured stream, returning nil if the export
+// is disabled
+func newExporter(config ExportConfig, logger *slog.Logger, metrics *nodeMetrics) (*exporter, error) {
+	config = config.withDefaults()
+
+	var sink exportSink
+	switch config.Type {
+	case "":
+		return nil, nil
+	case ExportTypeKafka:
+		sink = &kafkaSink{writer: &kafka.Writer{
+			Addr:         kafka.TCP(config.Servers...),
+			Topic:        config.Topic,
+			Balancer:     &kafka.Hash{},
+			BatchSize:    config.BatchSize,
+			BatchTimeout: 10 * time.Millisecond,
+			WriteTimeout: config.Timeout,
+			RequiredAcks: kafka.RequireAll,
+		}}
+	case ExportTypeNATS:
+		// keep trying in the background rather than failing to start when the
+		// server is down
+		conn, err := nats.Connect(strings.Join(config.Servers, ","),
+			nats.Timeout(config.Timeout),
+			nats.MaxReconnects(-1),
+			nats.RetryOnFailedConnect(true))
+		if err != nil {
+			return nil, fmt.Errorf("connecting to nats: %w", err)
+		}
+		sink = &natsSink{conn: conn, subject: config.Topic}
+	default:
+		return nil, fmt.Errorf("unknown export type %q", config.Type)
+	}
+
+	return startExporter(config, sink, logger, metrics), nil
+}
+
+// startExporter runs an exporter writing to the sink
+func startExporter(config ExportConfig, sink exportSink, logger *slog.Logger, metrics *nodeMetrics) *exporter {
+	e := &exporter{
+		config:  config,
+		sink:    sink,
+		logger:  logger.With("export", config.Type, "topic", config.Topic),
+		metrics: metrics,
+		queue:   make(chan exportMessage, config.QueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// export queues an executed action to be published, dropping it if the
+// queue is full
+func (e *exporter) export(action graph.Action) {
+	if e == nil {
+		return
+	}
+
+	value, err := json.Marshal(&ExportedAction{
+		ID:         action.ID,
+		Identity:   action.Identity,
+		NodeID:     action.NodeID,
+		Statement:  action.Action,
+		KeyID:      action.KeyID,
+		Namespace:  action.Namespace,
+		EntityIDs:  action.EntityIDs,
+		Topics:     action.Topics,
+		Timestamp:  action.Timestamp,
+		ExportedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		e.logger.Error("encoding exported action", "error", err, "action", action.ID)
+		return
+	}
+
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+
+	select {
+	case e.queue <- exportMessage{key: action.ID, value: value}:
+	default:
+		e.metrics.actionsExported.WithLabelValues("dropped").Inc()
+		e.logger.Warn("export queue full, dropping action", "action", action.ID)
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.stopped)
+
+	batch := make([]exportMessage, 0, e.config.BatchSize)
+	for {
+		select {
+		case <-e.done:
+			// send whatever was already queued before stopping
+			for len(e.queue) > 0 {
+				batch = e.fill(batch[:0])
+				e.write(batch)
+			}
+			return
+		case msg := <-e.queue:
+			batch = e.fill(append(batch[:0], msg))
+			e.write(batch)
+		}
+	}
+}
+
+// fill adds any other queued messages to the batch, up to the batch size
+func (e *exporter) fill(batch []exportMessage) []exportMessage {
+	for len(batch) < e.config.BatchSize {
+		select {
+		case msg := <-e.queue:
+			batch = append(batch, msg)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (e *exporter) write(batch []exportMessage) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), e.config.Timeout)
+	defer cancelFn()
+
+	err := e.sink.write(ctx, batch)
+	if err != nil {
+		e.metrics.actionsExported.WithLabelValues("failed").Add(float64(len(batch)))
+		e.logger.Error("exporting actions", "error", err, "count", len(batch))
+		return
+	}
+	e.metrics.actionsExported.WithLabelValues("exported").Add(float64(len(batch)))
+}
+
+// Close sends any queued actions then disconnects
+func (e *exporter) Close() error {
+	if e == nil {
+		return nil
+	}
+	close(e.done)
+	<-e.stopped
+	return e.sink.Close()
+}
+
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func (s *kafkaSink) write(ctx context.Context, msgs []exportMessage) error {
+	return s.writer.WriteMessages(ctx, kafkaMessages(msgs)...)
+}
+
+// kafkaMessages keys each message by action ID, which spreads actions over
+// the partitions
+func kafkaMessages(msgs []exportMessage) []kafka.Message {
+	kmsgs := make([]kafka.Message, len(msgs))
+	for i, m := range msgs {
+		kmsgs[i] = kafka.Message{Key: []byte(m.key), Value: m.value}
+	}
+	return kmsgs
+}
+
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
+
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (s *natsSink) write(ctx context.Context, msgs []exportMessage) error {
+	var errs []error
+	for _, m := range msgs {
+		errs = append(errs, s.conn.PublishMsg(natsMessage(s.subject, m)))
+	}
+	errs = append(errs, s.conn.FlushWithContext(ctx))
+	return errors.Join(errs...)
+}
+
+// natsMessage sets the message ID to the action ID so JetStream can drop
+// duplicates
+func natsMessage(subject string, m exportMessage) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(nats.MsgIdHdr, m.key)
+	msg.Data = m.value
+	return msg
+}
+
+func (s *natsSink) Close() error {
+	err := s.conn.Flush()
+	s.conn.Close()
+	return err
+}
@@ -0,0 +1,209 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSink records the batches written to it. Writes wait while blocked is
+// open and fail with err.
+type fakeSink struct {
+	writes  atomic.Int32
+	mu      sync.Mutex
+	batches [][]exportMessage
+	err     error
+	blocked chan struct{}
+	closed  bool
+}
+
+func (s *fakeSink) write(ctx context.Context, msgs []exportMessage) error {
+	s.writes.Add(1)
+	if s.blocked != nil {
+		<-s.blocked
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, append([]exportMessage{}, msgs...))
+	return s.err
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeSink) written() [][]exportMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]exportMessage{}, s.batches...)
+}
+
+func (s *fakeSink) keys() []string {
+	keys := []string{}
+	for _, batch := range s.written() {
+		for _, m := range batch {
+			keys = append(keys, m.key)
+		}
+	}
+	return keys
+}
+
+func newTestExporter(t *testing.T, config ExportConfig, sink exportSink) (*exporter, *nodeMetrics) {
+	n := newTestNode(t)
+	config.Type = ExportTypeNATS
+	config.Topic = "actions"
+	return startExporter(config.withDefaults(), sink, n.logger, n.metrics), n.metrics
+}
+
+func exported(metrics *nodeMetrics, result string) float64 {
+	return testutil.ToFloat64(metrics.actionsExported.WithLabelValues(result))
+}
+
+func TestExportedAction(t *testing.T) {
+	sink := &fakeSink{}
+	e, _ := newTestExporter(t, ExportConfig{}, sink)
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.export(graph.Action{ID: "a1", Identity: "alice", NodeID: "node", Action: "MERGE (p:Post{id:'1'})", EntityIDs: []string{"e1"}, Topics: []string{"Post"}, Timestamp: at})
+	e.export(graph.Action{ID: "a2", Identity: "alice", NodeID: "node", Action: "ciphertext", KeyID: "key", Namespace: "team", EntityIDs: []string{"e2"}, Timestamp: at})
+	require.NoError(t, e.Close())
+
+	batches := sink.written()
+	require.NotEmpty(t, batches)
+	msgs := []exportMessage{}
+	for _, b := range batches {
+		msgs = append(msgs, b...)
+	}
+	require.Len(t, msgs, 2)
+
+	public := ExportedAction{}
+	assert.Equal(t, "a1", msgs[0].key)
+	require.NoError(t, json.Unmarshal(msgs[0].value, &public))
+	assert.Equal(t, "a1", public.ID)
+	assert.Equal(t, "alice", public.Identity)
+	assert.Equal(t, "node", public.NodeID)
+	assert.Equal(t, "MERGE (p:Post{id:'1'})", public.Statement)
+	assert.Equal(t, []string{"e1"}, public.EntityIDs)
+	assert.Equal(t, []string{"Post"}, public.Topics)
+	assert.True(t, at.Equal(public.Timestamp))
+	assert.False(t, public.ExportedAt.IsZero())
+
+	// private statements stay encrypted, with the key needed to read them
+	fields := map[string]any{}
+	require.NoError(t, json.Unmarshal(msgs[0].value, &fields))
+	assert.NotContains(t, fields, "keyId")
+	assert.NotContains(t, fields, "namespace")
+
+	private := ExportedAction{}
+	assert.Equal(t, "a2", msgs[1].key)
+	require.NoError(t, json.Unmarshal(msgs[1].value, &private))
+	assert.Equal(t, "ciphertext", private.Statement)
+	assert.Equal(t, "key", private.KeyID)
+	assert.Equal(t, "team", private.Namespace)
+}
+
+func TestExportMessages(t *testing.T) {
+	msgs := []exportMessage{{key: "a1", value: []byte(`{"id":"a1"}`)}, {key: "a2", value: []byte(`{"id":"a2"}`)}}
+
+	kmsgs := kafkaMessages(msgs)
+	require.Len(t, kmsgs, 2)
+	for i, m := range msgs {
+		assert.Equal(t, []byte(m.key), kmsgs[i].Key)
+		assert.Equal(t, m.value, kmsgs[i].Value)
+	}
+
+	msg := natsMessage("actions", msgs[0])
+	assert.Equal(t, "actions", msg.Subject)
+	assert.Equal(t, "a1", msg.Header.Get(nats.MsgIdHdr))
+	assert.Equal(t, msgs[0].value, msg.Data)
+}
+
+func TestExporter(t *testing.T) {
+	t.Run("batches queued actions", func(t *testing.T) {
+		sink := &fakeSink{blocked: make(chan struct{})}
+		e, metrics := newTestExporter(t, ExportConfig{BatchSize: 3}, sink)
+
+		// the first action is written on its own while the rest queue behind
+		// it and go in batches of up to three
+		e.export(graph.Action{ID: "a0"})
+		require.Eventually(t, func() bool { return sink.writes.Load() == 1 }, 5*time.Second, time.Millisecond)
+		for i := 1; i < 6; i++ {
+			e.export(graph.Action{ID: fmt.Sprintf("a%d", i)})
+		}
+		close(sink.blocked)
+		require.NoError(t, e.Close())
+
+		sizes := []int{}
+		for _, b := range sink.written() {
+			sizes = append(sizes, len(b))
+		}
+		assert.Equal(t, []int{1, 3, 2}, sizes)
+		assert.Equal(t, []string{"a0", "a1", "a2", "a3", "a4", "a5"}, sink.keys())
+		assert.Equal(t, float64(6), exported(metrics, "exported"))
+		assert.True(t, sink.closed)
+	})
+
+	t.Run("drops actions when the queue is full", func(t *testing.T) {
+		sink := &fakeSink{blocked: make(chan struct{})}
+		e, metrics := newTestExporter(t, ExportConfig{QueueSize: 2}, sink)
+
+		// one action is held by the sink, two wait and the rest are dropped
+		e.export(graph.Action{ID: "a0"})
+		require.Eventually(t, func() bool { return sink.writes.Load() == 1 }, 5*time.Second, time.Millisecond)
+		for i := 1; i < 6; i++ {
+			e.export(graph.Action{ID: fmt.Sprintf("a%d", i)})
+		}
+		assert.Equal(t, float64(3), exported(metrics, "dropped"))
+
+		close(sink.blocked)
+		require.NoError(t, e.Close())
+		assert.Equal(t, []string{"a0", "a1", "a2"}, sink.keys())
+		assert.Equal(t, float64(3), exported(metrics, "exported"))
+	})
+
+	t.Run("counts failed writes", func(t *testing.T) {
+		sink := &fakeSink{err: errors.New("broker unavailable")}
+		e, metrics := newTestExporter(t, ExportConfig{}, sink)
+
+		e.export(graph.Action{ID: "a0"})
+		e.export(graph.Action{ID: "a1"})
+		require.NoError(t, e.Close())
+		assert.Equal(t, float64(2), exported(metrics, "failed"))
+		assert.Zero(t, exported(metrics, "exported"))
+	})
+
+	t.Run("ignores actions once closed", func(t *testing.T) {
+		sink := &fakeSink{}
+		e, _ := newTestExporter(t, ExportConfig{}, sink)
+
+		require.NoError(t, e.Close())
+		e.export(graph.Action{ID: "late"})
+		assert.Empty(t, sink.written())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		n := newTestNode(t)
+		e, err := newExporter(ExportConfig{}, n.logger, n.metrics)
+		require.NoError(t, err)
+		assert.Nil(t, e)
+		e.export(graph.Action{ID: "a0"})
+		assert.NoError(t, e.Close())
+
+		_, err = newExporter(ExportConfig{Type: "carrier pigeon"}, n.logger, n.metrics)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,181 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+const (
+	// DefaultFeedLabel is the label of the nodes in a feed unless another
+	// is asked for
+	DefaultFeedLabel = "Post"
+	// DefaultFeedPageSize and MaxFeedPageSize bound the nodes in a page
+	DefaultFeedPageSize = 20
+	MaxFeedPageSize     = 100
+)
+
+var errBadFeedCursor = errors.New("invalid cursor")
+
+// APIFeed is a page of a feed, newest first. Cursor fetches the next page and
+// is empty on the last one.
+type APIFeed struct {
+	Items  []*APIFeedItem `json:"items"`
+	Cursor string         `json:"cursor,omitempty"`
+}
+
+// APIFeedItem is a node in a feed
+type APIFeedItem struct {
+	ID         string         `json:"id"`
+	Owner      string         `json:"owner"`
+	Labels     []string       `json:"labels"`
+	Attributes map[string]any `json:"attributes"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	UpdatedAt  *time.Time     `json:"updatedAt,omitempty"`
+}
+
+// Feed returns a page of a namespace's feed from the local graph. A query
+// which follows no owners or topics follows the topics the node is
+// subscribed to in the namespace.
+func (n *node) Feed(namespace string, q graph.FeedQuery) ([]*graph.NodeRecord, error) {
+	executor, err := n.graphFor(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(q.Owners) == 0 && len(q.Topics) == 0 {
+		q.Topics = n.subscribedTopics(namespace)
+	}
+
+	return executor.Feed(q)
+}
+
+// subscribedTopics lists the topics the node is subscribed to in a namespace
+func (n *node) subscribedTopics(namespace string) []string {
+	n.subscriptionsMu.Lock()
+	defer n.subscriptionsMu.Unlock()
+
+	prefix := topicPrefix
+	if namespace != "" {
+		prefix = namespacePrefix + namespace + "/" + topicPrefix
+	}
+
+	topics := []string{}
+	for key := range n.subscribed {
+		if topic, ok := strings.CutPrefix(key, prefix); ok {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// handleAPIFeed returns a page of the feed of nodes with the label parameter,
+// Post by default, belonging to the identities given by repeating the owner
+// parameter or matching the topics given by repeating the topic parameter.
+// Without either the feed follows the node's topic subscriptions.
+func (n *node) handleAPIFeed(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+
+	params := req.URL.Query()
+	q := graph.FeedQuery{
+		Label:  params.Get("label"),
+		Owners: params["owner"],
+		Topics: params["topic"],
+		Limit:  DefaultFeedPageSize,
+	}
+	if q.Label == "" {
+		q.Label = DefaultFeedLabel
+	}
+
+	if v := params.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("bad limit"))
+			return
+		}
+		q.Limit = min(l, MaxFeedPageSize)
+	}
+
+	if v := params.Get("cursor"); v != "" {
+		cursor, err := decodeFeedCursor(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		q.Before = cursor
+	}
+
+	// one more than the page shows whether there is another
+	limit := q.Limit
+	q.Limit++
+	nodes, err := n.Feed(namespace, q)
+	if err != nil {
+		n.logger.Error("reading feed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := &APIFeed{Items: make([]*APIFeedItem, 0, min(len(nodes), limit))}
+	for _, r := range nodes[:min(len(nodes), limit)] {
+		res.Items = append(res.Items, &APIFeedItem{
+			ID:         r.ID,
+			Owner:      r.OwnerID,
+			Labels:     r.Labels,
+			Attributes: r.Attributes,
+			CreatedAt:  r.CreatedAt,
+			UpdatedAt:  r.UpdatedAt,
+		})
+	}
+	if len(nodes) > limit {
+		last := nodes[limit-1]
+		res.Cursor = encodeFeedCursor(&graph.FeedCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+
+	n.writeJSON(w, res)
+}
+
+func encodeFeedCursor(c *graph.FeedCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.CreatedAt.Format(time.RFC3339Nano) + " " + c.ID))
+}
+
+func decodeFeedCursor(cursor string) (*graph.FeedCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errBadFeedCursor
+	}
+	at, id, ok := strings.Cut(string(b), " ")
+	if !ok {
+		return nil, errBadFeedCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return nil, errBadFeedCursor
+	}
+	return &graph.FeedCursor{CreatedAt: createdAt, ID: id}, nil
+}
@@ -0,0 +1,293 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+// MaxGossipPeers is the most peers a seed shares or accepts in one gossip round
+const MaxGossipPeers = 32
+
+// gossipSeeds swaps seed and peer tables with every other known seed
+func (n *node) gossipSeeds(ctx context.Context) error {
+	seeds, err := n.store.GetSeeds(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching seeds: %w", err)
+	}
+
+	msg, err := n.gossipMessage(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshalling gossip: %w", err)
+	}
+
+	wg := sync.WaitGroup{}
+	for _, seed := range seeds {
+		if n.isSelf(seed) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := n.sendGossip(ctx, seed.RemoteAddr, data)
+			if err != nil {
+				n.logger.Error("gossiping with seed", "error", err, "remote", seed.RemoteAddr)
+				return
+			}
+
+			err = n.store.TouchSeed(ctx, seed.RemoteAddr)
+			if err != nil {
+				n.logger.Error("touching seed", "error", err, "remote", seed.RemoteAddr)
+			}
+
+			n.mergeGossip(ctx, resp)
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+func (n *node) sendGossip(ctx context.Context, remoteAddr string, data []byte) (*model.GossipMessage, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
+	defer cancelFn()
+
+	url := fmt.Sprintf("https://%s/gossip", remoteAddr)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("creating gossip request: %w", err)
+	}
+	req.Header.Add(HeaderNodeID, n.nodeID)
+	req.Header.Add(HeaderContentType, ContentTypeJSON)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending gossip: %w", err)
+	}
+
+	body := resp.Body
+	defer body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad gossip response: %d", resp.StatusCode)
+	}
+
+	msg := &model.GossipMessage{}
+	err = json.NewDecoder(io.LimitReader(body, MaxBodySize)).Decode(msg)
+	if err != nil {
+		return nil, fmt.Errorf("decoding gossip: %w", err)
+	}
+
+	return msg, nil
+}
+
+func (n *node) handleGossip(w http.ResponseWriter, req *http.Request) {
+	n.logger.Debug("gossip", "remote", req.RemoteAddr)
+
+	body := req.Body
+	defer body.Close()
+
+	msg := &model.GossipMessage{}
+	err := json.NewDecoder(io.LimitReader(body, MaxBodySize)).Decode(msg)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := n.gossipMessage(req.Context())
+	if err != nil {
+		n.logger.Error("building gossip", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	n.writeJSON(w, resp)
+
+	go n.mergeGossip(n.ctx, msg)
+}
+
+// gossipMessage describes the seeds (including this one) and a sample of the
+// peers this seed knows about
+func (n *node) gossipMessage(ctx context.Context) (*model.GossipMessage, error) {
+	seeds, err := n.store.GetSeeds(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching seeds: %w", err)
+	}
+
+	if publicAddr := n.publicAddr.String(); publicAddr != "" {
+		seeds = append(seeds, &model.SeedSpec{
+			CreatedAt:  time.Now().UTC(),
+			RemoteAddr: publicAddr,
+			NodeID:     n.nodeID,
+		})
+	}
+
+	peers, err := n.store.GetRandomPeers(ctx, "", MaxGossipPeers)
+	if err != nil {
+		return nil, fmt.Errorf("fetching peers: %w", err)
+	}
+
+	return &model.GossipMessage{
+		Seeds: seeds,
+		Peers: peers,
+	}, nil
+}
+
+// mergeGossip adds seeds and peers we didn't know about. New seeds and peers
+// are only added once they answer as the node they claim to be.
+func (n *node) mergeGossip(ctx context.Context, msg *model.GossipMessage) {
+	known, err := n.store.GetSeeds(ctx)
+	if err != nil {
+		n.logger.Error("fetching seeds", "error", err)
+		return
+	}
+
+	knownSeeds := map[string]struct{}{}
+	for _, s := range known {
+		knownSeeds[s.RemoteAddr] = struct{}{}
+	}
+
+	newSeeds := []*model.SeedSpec{}
+	for _, s := range msg.Seeds {
+		if _, ok := knownSeeds[s.RemoteAddr]; ok || s.RemoteAddr == "" || n.isSelf(s) {
+			continue
+		}
+		knownSeeds[s.RemoteAddr] = struct{}{}
+
+		spec, err := n.getNodeInfo(ctx, s.RemoteAddr)
+		if err != nil {
+			n.logger.Debug("checking gossiped seed", "error", err, "remote", s.RemoteAddr)
+			continue
+		}
+		if spec.NodeID == n.nodeID || (s.NodeID != "" && spec.NodeID != s.NodeID) {
+			continue
+		}
+
+		newSeeds = append(newSeeds, &model.SeedSpec{
+			CreatedAt:  time.Now().UTC(),
+			RemoteAddr: s.RemoteAddr,
+			NodeID:     spec.NodeID,
+		})
+	}
+
+	if len(newSeeds) > 0 {
+		n.logger.Info("learned seeds from gossip", "count", len(newSeeds))
+		err = n.store.AddSeeds(ctx, newSeeds)
+		if err != nil {
+			n.logger.Error("adding seeds", "error", err)
+		}
+	}
+
+	candidates := []*model.PeerSpec{}
+	for _, p := range msg.Peers {
+		if len(candidates) == MaxGossipPeers {
+			break
+		}
+		if p.RemoteAddr == "" || p.NodeID == n.nodeID {
+			continue
+		}
+
+		existing, err := n.store.GetPeer(ctx, p.RemoteAddr)
+		if err != nil {
+			n.logger.Error("fetching peer", "error", err, "remote", p.RemoteAddr)
+			continue
+		}
+		if existing != nil {
+			continue
+		}
+
+		candidates = append(candidates, p)
+	}
+
+	newPeers := []*model.PeerSpec{}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, p := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			peer, err := n.verifyGossipedPeer(ctx, p)
+			if err != nil {
+				n.logger.Debug("checking gossiped peer", "error", err, "remote", p.RemoteAddr)
+				return
+			}
+
+			mu.Lock()
+			newPeers = append(newPeers, peer)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(newPeers) > 0 {
+		err = n.store.UpsertPeers(ctx, newPeers)
+		if err != nil {
+			n.logger.Error("adding peers", "error", err)
+			return
+		}
+		n.peersAdded()
+	}
+}
+
+// verifyGossipedPeer asks a gossiped peer who it is. Only its subscription
+// filter and node type are taken from the gossip, the rest comes from the
+// peer itself, and its node key is left to be bound when it next joins.
+func (n *node) verifyGossipedPeer(ctx context.Context, p *model.PeerSpec) (*model.PeerSpec, error) {
+	spec, err := n.getNodeInfo(ctx, p.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if spec.NodeID == "" || spec.NodeID == n.nodeID {
+		return nil, fmt.Errorf("unexpected node id: %s", spec.NodeID)
+	}
+	if p.NodeID != "" && spec.NodeID != p.NodeID {
+		return nil, fmt.Errorf("node id mismatch: %s claimed %s", spec.NodeID, p.NodeID)
+	}
+
+	return &model.PeerSpec{
+		CreatedAt:       time.Now().UTC(),
+		RemoteAddr:      p.RemoteAddr,
+		NodeID:          spec.NodeID,
+		Filter:          p.Filter,
+		Addresses:       spec.Addresses,
+		NodeType:        p.NodeType,
+		Group:           p.Group,
+		SoftwareVersion: spec.SoftwareVersion,
+	}, nil
+}
+
+func (n *node) isSelf(seed *model.SeedSpec) bool {
+	publicAddr := n.publicAddr.String()
+	return seed.NodeID == n.nodeID || (publicAddr != "" && seed.RemoteAddr == publicAddr)
+}
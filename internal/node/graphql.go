@@ -0,0 +1,607 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+const (
+	defaultGraphQLPageSize = 20
+	maxGraphQLPageSize     = 100
+)
+
+var (
+	graphqlNameRe = regexp.MustCompile(`[^_0-9A-Za-z]`)
+
+	// types every schema has which labels can't be named after
+	graphqlReservedTypes = []string{
+		"Query", "Node", "Entity", "Edge", "EdgeConnection", "PageInfo", "Attribute", "Direction",
+		"String", "Int", "Float", "Boolean", "ID", "DateTime",
+	}
+)
+
+// APIGraphQLRequest is a GraphQL query posted to /api/graphql
+type APIGraphQLRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables,omitempty"`
+	OperationName string         `json:"operationName,omitempty"`
+}
+
+// graphqlAPI serves a read only GraphQL view of the local graph. Each node
+// label is a type with a field for each attribute seen on it and relations
+// are edges between them. The schema is generated from the labels and
+// attributes in the graph and regenerated when they change.
+type graphqlAPI struct {
+	graph   Graph
+	mu      sync.Mutex
+	summary *graph.Schema
+	schema  graphql.Schema
+}
+
+func newGraphQLAPI(g Graph) *graphqlAPI {
+	return &graphqlAPI{graph: g}
+}
+
+func (n *node) handleAPIGraphQL(w http.ResponseWriter, req *http.Request) {
+	body := APIGraphQLRequest{}
+	if req.Method == http.MethodGet {
+		q := req.URL.Query()
+		body.Query = q.Get("query")
+		body.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			err := json.Unmarshal([]byte(v), &body.Variables)
+			if err != nil {
+				http.Error(w, "reading variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	} else if !readAPIRequest(w, req, &body) {
+		return
+	}
+
+	if body.Query == "" {
+		http.Error(w, "no query", http.StatusBadRequest)
+		return
+	}
+
+	schema, err := n.graphql.currentSchema()
+	if err != nil {
+		n.logger.Error("building graphql schema", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := graphql.Do(graphql.Params{
+		Schema:         schema,
+		RequestString:  body.Query,
+		VariableValues: body.Variables,
+		OperationName:  body.OperationName,
+		Context:        req.Context(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		n.logger.Error("sending graphql response", "error", err)
+	}
+}
+
+// currentSchema returns the schema for the labels now in the graph, only
+// building a new one if they have changed
+func (g *graphqlAPI) currentSchema() (graphql.Schema, error) {
+	summary, err := g.graph.Schema()
+	if err != nil {
+		return graphql.Schema{}, fmt.Errorf("reading labels: %w", err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.summary != nil && reflect.DeepEqual(summary, g.summary) {
+		return g.schema, nil
+	}
+
+	schema, err := g.buildSchema(summary)
+	if err != nil {
+		return graphql.Schema{}, err
+	}
+	g.summary = summary
+	g.schema = schema
+
+	return schema, nil
+}
+
+// graphqlName turns a label or attribute into a valid GraphQL name
+func graphqlName(s string) string {
+	s = graphqlNameRe.ReplaceAllString(s, "_")
+	if s == "" || (s[0] >= '0' && s[0] <= '9') || strings.HasPrefix(s, "__") {
+		s = "_" + s
+	}
+	return s
+}
+
+// uniqueName adds underscores to a name until it isn't already used
+func uniqueName(name string, used map[string]bool) string {
+	for used[name] {
+		name += "_"
+	}
+	used[name] = true
+	return name
+}
+
+type graphqlEdge struct {
+	relation *graph.RelationRecord
+	// from is the node the relation was reached from
+	from string
+}
+
+type graphqlPage struct {
+	items   any
+	offset  int
+	count   int
+	hasNext bool
+}
+
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("offset:" + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("invalid cursor")
+	}
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(b), "offset:"))
+	if err != nil || offset < 0 {
+		return 0, errors.New("invalid cursor")
+	}
+	return offset, nil
+}
+
+// pageArgs reads the first and after arguments, returning the offset and
+// page size
+func pageArgs(args map[string]any) (int, int, error) {
+	limit := defaultGraphQLPageSize
+	if first, ok := args["first"].(int); ok {
+		if first < 0 {
+			return 0, 0, errors.New("first must not be negative")
+		}
+		limit = min(first, maxGraphQLPageSize)
+	}
+
+	after, _ := args["after"].(string)
+	offset, err := decodeCursor(after)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return offset, limit, nil
+}
+
+func attributeString(v any) any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type namedAttribute struct {
+	Name  string
+	Value any
+}
+
+func attributeList(attrs map[string]any) []namedAttribute {
+	list := make([]namedAttribute, 0, len(attrs))
+	for name, value := range attrs {
+		list = append(list, namedAttribute{Name: name, Value: attributeString(value)})
+	}
+	slices.SortFunc(list, func(a, b namedAttribute) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
+func (g *graphqlAPI) buildSchema(summary *graph.Schema) (graphql.Schema, error) {
+	used := map[string]bool{}
+	for _, name := range graphqlReservedTypes {
+		used[name] = true
+	}
+
+	pageInfo := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"endCursor":   &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	attribute := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Attribute",
+		Fields: graphql.Fields{
+			"name":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"value": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	direction := graphql.NewEnum(graphql.EnumConfig{
+		Name:        "Direction",
+		Description: "Which way a relation points from the node it was reached from. ANY is undirected.",
+		Values: graphql.EnumValueConfigMap{
+			"OUT": &graphql.EnumValueConfig{Value: ast.RelationDirRight},
+			"IN":  &graphql.EnumValueConfig{Value: ast.RelationDirLeft},
+			"ANY": &graphql.EnumValueConfig{Value: ast.RelationDirNeutral},
+		},
+	})
+
+	types := map[string]*graphql.Object{}
+	var nodeInterface *graphql.Interface
+	var entity, edge, edgeConnection *graphql.Object
+
+	commonFields := func() graphql.Fields {
+		return graphql.Fields{
+			"id":         &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"labels":     &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"createdAt":  &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"updatedAt":  &graphql.Field{Type: graphql.DateTime},
+			"ownerId":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"attributes": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(attribute)))},
+		}
+	}
+
+	resolveCommon := func(p graphql.ResolveParams) (any, error) {
+		switch src := p.Source.(type) {
+		case *graph.NodeRecord:
+			return commonValue(p.Info.FieldName, src.ID, src.Labels, src.CreatedAt, src.UpdatedAt, src.OwnerID, src.Attributes), nil
+		case *graphqlEdge:
+			r := src.relation
+			return commonValue(p.Info.FieldName, r.ID, r.Labels, r.CreatedAt, r.UpdatedAt, r.OwnerID, r.Attributes), nil
+		}
+		return nil, nil
+	}
+
+	relationsField := func() *graphql.Field {
+		return &graphql.Field{
+			Type: graphql.NewNonNull(edgeConnection),
+			Args: graphql.FieldConfigArgument{
+				"label":     &graphql.ArgumentConfig{Type: graphql.String},
+				"direction": &graphql.ArgumentConfig{Type: direction, DefaultValue: ast.RelationDirNeutral},
+				"first":     &graphql.ArgumentConfig{Type: graphql.Int},
+				"after":     &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				src, ok := p.Source.(*graph.NodeRecord)
+				if !ok {
+					return nil, nil
+				}
+				offset, limit, err := pageArgs(p.Args)
+				if err != nil {
+					return nil, err
+				}
+				label, _ := p.Args["label"].(string)
+				dir, _ := p.Args["direction"].(ast.RelationDir)
+
+				relations, err := g.graph.ListRelations(graph.RelationQuery{
+					NodeID:    src.ID,
+					Label:     label,
+					Direction: dir,
+					Offset:    offset,
+					Limit:     limit + 1,
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				page := &graphqlPage{offset: offset, hasNext: len(relations) > limit}
+				relations = relations[:min(len(relations), limit)]
+				edges := make([]*graphqlEdge, len(relations))
+				for i, r := range relations {
+					edges[i] = &graphqlEdge{relation: r, from: src.ID}
+				}
+				page.items = edges
+				page.count = len(edges)
+				return page, nil
+			},
+		}
+	}
+
+	connectionFields := func(itemsName string, itemType graphql.Output) graphql.Fields {
+		return graphql.Fields{
+			itemsName: &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(itemType))),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*graphqlPage).items, nil
+				},
+			},
+			"pageInfo": &graphql.Field{
+				Type: graphql.NewNonNull(pageInfo),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					page := p.Source.(*graphqlPage)
+					info := map[string]any{"hasNextPage": page.hasNext}
+					if page.count > 0 {
+						info["endCursor"] = encodeCursor(page.offset + page.count)
+					}
+					return info, nil
+				},
+			},
+		}
+	}
+
+	// labels are sorted so a node with several is always given the same type
+	labels := make([]string, 0, len(summary.NodeLabels))
+	for label := range summary.NodeLabels {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+
+	typeNames := map[string]string{}
+	for _, label := range labels {
+		typeNames[label] = uniqueName(graphqlName(label), used)
+	}
+
+	nodeInterface = graphql.NewInterface(graphql.InterfaceConfig{
+		Name:        "Node",
+		Description: "A node in the graph",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := commonFields()
+			fields["relations"] = relationsField()
+			return fields
+		}),
+		ResolveType: func(p graphql.ResolveTypeParams) *graphql.Object {
+			if n, ok := p.Value.(*graph.NodeRecord); ok {
+				for _, label := range slices.Sorted(slices.Values(n.Labels)) {
+					if t, ok := types[label]; ok {
+						return t
+					}
+				}
+			}
+			return entity
+		},
+	})
+
+	nodeType := func(name, description string, attrs []graph.AttributeInfo) *graphql.Object {
+		return graphql.NewObject(graphql.ObjectConfig{
+			Name:        name,
+			Description: description,
+			Interfaces:  []*graphql.Interface{nodeInterface},
+			IsTypeOf: func(p graphql.IsTypeOfParams) bool {
+				_, ok := p.Value.(*graph.NodeRecord)
+				return ok
+			},
+			Fields: graphql.FieldsThunk(func() graphql.Fields {
+				fields := commonFields()
+				for _, f := range fields {
+					f.Resolve = resolveCommon
+				}
+				fields["relations"] = relationsField()
+
+				for _, a := range attrs {
+					name := graphqlName(a.Name)
+					if _, ok := fields[name]; ok {
+						continue
+					}
+					attr := a
+					field := &graphql.Field{Type: graphql.String}
+					if attr.Type == ast.AttributeDataTypeNumber {
+						field.Type = graphql.Float
+					}
+					field.Resolve = func(p graphql.ResolveParams) (any, error) {
+						n := p.Source.(*graph.NodeRecord)
+						v := n.Attributes[attr.Name]
+						if attr.Type == ast.AttributeDataTypeNumber {
+							f, ok := v.(float64)
+							if !ok {
+								return nil, nil
+							}
+							return f, nil
+						}
+						return attributeString(v), nil
+					}
+					fields[name] = field
+				}
+				return fields
+			}),
+		})
+	}
+
+	entity = nodeType("Entity", "A node without a label of its own type", nil)
+
+	edge = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Edge",
+		Description: "A relation between two nodes",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := commonFields()
+			for _, f := range fields {
+				f.Resolve = resolveCommon
+			}
+			fields["direction"] = &graphql.Field{
+				Type: graphql.NewNonNull(direction),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					e := p.Source.(*graphqlEdge)
+					return edgeDirection(e.relation, e.from), nil
+				},
+			}
+			fields["node"] = &graphql.Field{
+				Type:        nodeInterface,
+				Description: "The node at the other end of the relation",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					e := p.Source.(*graphqlEdge)
+					id := e.relation.RightNodeID
+					if id == e.from {
+						id = e.relation.LeftNodeID
+					}
+					n, err := g.graph.GetNode(id)
+					if errors.Is(err, graph.ErrNotFound) {
+						return nil, nil
+					}
+					return n, err
+				},
+			}
+			return fields
+		}),
+	})
+
+	edgeConnection = graphql.NewObject(graphql.ObjectConfig{
+		Name:   "EdgeConnection",
+		Fields: connectionFields("edges", edge),
+	})
+
+	query := graphql.Fields{
+		"node": &graphql.Field{
+			Type: nodeInterface,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				n, err := g.graph.GetNode(p.Args["id"].(string))
+				if errors.Is(err, graph.ErrNotFound) {
+					return nil, nil
+				}
+				return n, err
+			},
+		},
+	}
+
+	schemaTypes := []graphql.Type{entity}
+	for _, label := range labels {
+		name := typeNames[label]
+		t := nodeType(name, fmt.Sprintf("Nodes labelled %s", label), summary.NodeLabels[label])
+		types[label] = t
+		schemaTypes = append(schemaTypes, t)
+
+		connection := graphql.NewObject(graphql.ObjectConfig{
+			Name:   uniqueName(name+"Connection", used),
+			Fields: connectionFields("nodes", t),
+		})
+
+		// attributes filter on their exact value
+		args := graphql.FieldConfigArgument{
+			"first": &graphql.ArgumentConfig{Type: graphql.Int},
+			"after": &graphql.ArgumentConfig{Type: graphql.String},
+		}
+		filters := map[string]string{}
+		for _, a := range summary.NodeLabels[label] {
+			argName := graphqlName(a.Name)
+			if _, ok := args[argName]; ok {
+				continue
+			}
+			args[argName] = &graphql.ArgumentConfig{Type: graphql.String}
+			filters[argName] = a.Name
+		}
+
+		query[name] = &graphql.Field{
+			Type: graphql.NewNonNull(connection),
+			Args: args,
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				offset, limit, err := pageArgs(p.Args)
+				if err != nil {
+					return nil, err
+				}
+
+				attrs := map[string]string{}
+				for argName, attrName := range filters {
+					if v, ok := p.Args[argName].(string); ok {
+						attrs[attrName] = v
+					}
+				}
+
+				nodes, err := g.graph.ListNodes(graph.NodeQuery{
+					Label:      label,
+					Attributes: attrs,
+					Offset:     offset,
+					Limit:      limit + 1,
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				page := &graphqlPage{offset: offset, hasNext: len(nodes) > limit}
+				nodes = nodes[:min(len(nodes), limit)]
+				page.items = nodes
+				page.count = len(nodes)
+				return page, nil
+			},
+		}
+	}
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: query,
+		}),
+		Types: schemaTypes,
+	})
+	if err != nil {
+		return graphql.Schema{}, fmt.Errorf("creating schema: %w", err)
+	}
+
+	return schema, nil
+}
+
+func commonValue(field, id string, labels []string, createdAt any, updatedAt any, ownerID string, attrs map[string]any) any {
+	switch field {
+	case "id":
+		return id
+	case "labels":
+		if labels == nil {
+			return []string{}
+		}
+		return labels
+	case "createdAt":
+		return createdAt
+	case "updatedAt":
+		return updatedAt
+	case "ownerId":
+		return ownerID
+	case "attributes":
+		return attributeList(attrs)
+	}
+	return nil
+}
+
+// edgeDirection is the direction of a relation seen from one of its nodes
+func edgeDirection(r *graph.RelationRecord, from string) ast.RelationDir {
+	switch {
+	case r.Direction == ast.RelationDirNeutral:
+		return ast.RelationDirNeutral
+	case (r.LeftNodeID == from) == (r.Direction == ast.RelationDirRight):
+		return ast.RelationDirRight
+	default:
+		return ast.RelationDirLeft
+	}
+}
@@ -0,0 +1,282 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGraph returns a graph holding the statements
+func newTestGraph(t *testing.T, stmts ...string) Graph {
+	g, err := graph.New(graph.Config{GraphDatabaseURL: fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())})
+	require.NoError(t, err)
+	t.Cleanup(func() { g.Close() })
+	seedGraph(t, g, stmts...)
+	return g
+}
+
+func seedGraph(t *testing.T, g Graph, stmts ...string) {
+	for i, stmt := range stmts {
+		p, err := ast.Parse(stmt)
+		require.NoError(t, err)
+		_, err = g.Execute(graph.Action{ID: fmt.Sprintf("%s.%d", t.Name(), i), Identity: "alice", Command: p.Command()})
+		require.NoError(t, err)
+	}
+}
+
+type graphqlResponse struct {
+	Data   map[string]any `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func graphqlQuery(t *testing.T, server *httptest.Server, query string) graphqlResponse {
+	body, err := json.Marshal(APIGraphQLRequest{Query: query})
+	require.NoError(t, err)
+	resp, err := server.Client().Post(server.URL, "application/json", strings.NewReader(string(body)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	res := graphqlResponse{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	return res
+}
+
+// field walks down a decoded response, indexing lists by number
+func field(v any, path ...any) any {
+	for _, p := range path {
+		switch k := p.(type) {
+		case string:
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil
+			}
+			v = m[k]
+		case int:
+			l, ok := v.([]any)
+			if !ok || k >= len(l) {
+				return nil
+			}
+			v = l[k]
+		}
+	}
+	return v
+}
+
+func newTestGraphQL(t *testing.T) (*node, *httptest.Server) {
+	n := newTestNode(t)
+	n.graphql = newGraphQLAPI(newTestGraph(t,
+		`MERGE (i:Person {name: 'ann'})-[:posted{via:'web'}]->(p:Post {uri: 'ipfs://1', likes: 1})`,
+		`MERGE (i:Person {name: 'ann'})-[:posted]->(p:Post {uri: 'ipfs://2', likes: 2})`,
+		`MERGE (j:Person {name: 'bob'})-[:follows]->(i:Person {name: 'ann'})`,
+		`MERGE (i:Person {name: 'ann'})-[:knows]-(c:Person {name: 'cat'})`,
+		`MERGE (q:Query {text: 'reserved'})`,
+	))
+	server := httptest.NewServer(http.HandlerFunc(n.handleAPIGraphQL))
+	t.Cleanup(server.Close)
+	return n, server
+}
+
+func TestGraphQLSchema(t *testing.T) {
+	_, server := newTestGraphQL(t)
+
+	res := graphqlQuery(t, server, `{ __schema { types { name } queryType { fields { name args { name } } } } }`)
+	require.Empty(t, res.Errors)
+
+	types := []string{}
+	for _, ty := range field(res.Data, "__schema", "types").([]any) {
+		types = append(types, field(ty, "name").(string))
+	}
+	// labels clashing with the schema's own types or which aren't valid
+	// names are renamed
+	for _, name := range []string{"Node", "Entity", "Edge", "EdgeConnection", "PageInfo", "Direction", "Person", "PersonConnection", "Post", "PostConnection", "Query_"} {
+		assert.Contains(t, types, name)
+	}
+
+	queries := map[string][]string{}
+	for _, f := range field(res.Data, "__schema", "queryType", "fields").([]any) {
+		args := []string{}
+		for _, a := range field(f, "args").([]any) {
+			args = append(args, field(a, "name").(string))
+		}
+		queries[field(f, "name").(string)] = args
+	}
+	assert.ElementsMatch(t, []string{"id"}, queries["node"])
+	assert.ElementsMatch(t, []string{"first", "after", "name"}, queries["Person"])
+	assert.ElementsMatch(t, []string{"first", "after", "uri", "likes"}, queries["Post"])
+	assert.ElementsMatch(t, []string{"first", "after", "text"}, queries["Query_"])
+
+	res = graphqlQuery(t, server, `{ __type(name: "Post") { fields { name type { name } } } }`)
+	require.Empty(t, res.Errors)
+	fieldTypes := map[string]any{}
+	for _, f := range field(res.Data, "__type", "fields").([]any) {
+		fieldTypes[field(f, "name").(string)] = field(f, "type", "name")
+	}
+	assert.Equal(t, "Float", fieldTypes["likes"])
+	assert.Equal(t, "String", fieldTypes["uri"])
+}
+
+func TestGraphQLQueries(t *testing.T) {
+	_, server := newTestGraphQL(t)
+
+	res := graphqlQuery(t, server, `{ Person(name: "ann") { nodes { id } } }`)
+	require.Empty(t, res.Errors)
+	ann := field(res.Data, "Person", "nodes", 0, "id").(string)
+
+	tests := []struct {
+		name  string
+		query string
+		path  []any
+		want  any
+		err   string
+	}{
+		{name: "list", query: `{ Post { nodes { uri } } }`, path: []any{"Post", "nodes", 1, "uri"}, want: "ipfs://2"},
+		{name: "filter", query: `{ Person(name: "bob") { nodes { name } } }`, path: []any{"Person", "nodes", 0, "name"}, want: "bob"},
+		{name: "filter without match", query: `{ Person(name: "dan") { nodes { name } pageInfo { hasNextPage endCursor } } }`, path: []any{"Person"}, want: map[string]any{"nodes": []any{}, "pageInfo": map[string]any{"hasNextPage": false, "endCursor": nil}}},
+		{name: "number attribute", query: `{ Post(uri: "ipfs://1") { nodes { likes } } }`, path: []any{"Post", "nodes", 0, "likes"}, want: 1.0},
+		{name: "common fields", query: `{ Post(uri: "ipfs://1") { nodes { labels ownerId attributes { name value } } } }`, path: []any{"Post", "nodes", 0}, want: map[string]any{
+			"labels":     []any{"Post"},
+			"ownerId":    "alice",
+			"attributes": []any{map[string]any{"name": "likes", "value": "1"}, map[string]any{"name": "uri", "value": "ipfs://1"}},
+		}},
+		{name: "renamed label", query: `{ Query_ { nodes { __typename text } } }`, path: []any{"Query_", "nodes", 0}, want: map[string]any{"__typename": "Query_", "text": "reserved"}},
+		{name: "node by id", query: fmt.Sprintf(`{ node(id: %q) { __typename ... on Person { name } } }`, ann), path: []any{"node"}, want: map[string]any{"__typename": "Person", "name": "ann"}},
+		{name: "unknown node", query: `{ node(id: "missing") { id } }`, path: []any{"node"}, want: nil},
+		{name: "outgoing relations", query: fmt.Sprintf(`{ node(id: %q) { relations(direction: OUT) { edges { labels direction node { ... on Post { uri } } } } } }`, ann), path: []any{"node", "relations", "edges"}, want: []any{
+			map[string]any{"labels": []any{"posted"}, "direction": "OUT", "node": map[string]any{"uri": "ipfs://1"}},
+			map[string]any{"labels": []any{"posted"}, "direction": "OUT", "node": map[string]any{"uri": "ipfs://2"}},
+			map[string]any{"labels": []any{"knows"}, "direction": "ANY", "node": map[string]any{}},
+		}},
+		{name: "incoming relations", query: fmt.Sprintf(`{ node(id: %q) { relations(direction: IN) { edges { labels direction node { ... on Person { name } } } } } }`, ann), path: []any{"node", "relations", "edges"}, want: []any{
+			map[string]any{"labels": []any{"follows"}, "direction": "IN", "node": map[string]any{"name": "bob"}},
+			map[string]any{"labels": []any{"knows"}, "direction": "ANY", "node": map[string]any{"name": "cat"}},
+		}},
+		{name: "relations by label", query: fmt.Sprintf(`{ node(id: %q) { relations(label: "posted") { edges { attributes { name value } } } } }`, ann), path: []any{"node", "relations", "edges", 0, "attributes"}, want: []any{map[string]any{"name": "via", "value": "web"}}},
+		{name: "negative page size", query: `{ Post(first: -1) { nodes { uri } } }`, err: "first must not be negative"},
+		{name: "invalid cursor", query: `{ Post(after: "nonsense") { nodes { uri } } }`, err: "invalid cursor"},
+		{name: "unknown field", query: `{ Post { nodes { colour } } }`, err: "colour"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := graphqlQuery(t, server, tt.query)
+			if tt.err != "" {
+				require.NotEmpty(t, res.Errors)
+				assert.Contains(t, res.Errors[0].Message, tt.err)
+				return
+			}
+			require.Empty(t, res.Errors)
+			assert.Equal(t, tt.want, field(res.Data, tt.path...))
+		})
+	}
+}
+
+func TestGraphQLNames(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "Post", want: "Post"},
+		{name: "my-label", want: "my_label"},
+		{name: "2fa", want: "_2fa"},
+		{name: "__typename", want: "___typename"},
+		{name: "", want: "_"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, graphqlName(tt.name), tt.name)
+	}
+
+	used := map[string]bool{"Query": true}
+	assert.Equal(t, "Query_", uniqueName("Query", used))
+	assert.Equal(t, "Query__", uniqueName("Query", used))
+	assert.Equal(t, "Post", uniqueName("Post", used))
+}
+
+func TestGraphQLPaging(t *testing.T) {
+	_, server := newTestGraphQL(t)
+
+	names := []any{}
+	cursor := ""
+	for {
+		res := graphqlQuery(t, server, fmt.Sprintf(`{ Person(first: 2, after: %q) { nodes { name } pageInfo { hasNextPage endCursor } } }`, cursor))
+		require.Empty(t, res.Errors)
+		nodes := field(res.Data, "Person", "nodes").([]any)
+		require.LessOrEqual(t, len(nodes), 2)
+		for _, node := range nodes {
+			names = append(names, field(node, "name"))
+		}
+		if !field(res.Data, "Person", "pageInfo", "hasNextPage").(bool) {
+			break
+		}
+		cursor = field(res.Data, "Person", "pageInfo", "endCursor").(string)
+	}
+	assert.Equal(t, []any{"ann", "bob", "cat"}, names)
+
+	offset, err := decodeCursor(encodeCursor(40))
+	require.NoError(t, err)
+	assert.Equal(t, 40, offset)
+}
+
+func TestGraphQLRequests(t *testing.T) {
+	_, server := newTestGraphQL(t)
+
+	get := func(params url.Values) *http.Response {
+		resp, err := server.Client().Get(server.URL + "?" + params.Encode())
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get(url.Values{
+		"query":     {`query People($name: String) { Person(name: $name) { nodes { name } } }`},
+		"variables": {`{"name": "cat"}`},
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	res := graphqlResponse{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	assert.Equal(t, "cat", field(res.Data, "Person", "nodes", 0, "name"))
+
+	assert.Equal(t, http.StatusBadRequest, get(url.Values{"query": {`{ Post { nodes { uri } } }`}, "variables": {"{"}}).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, get(url.Values{}).StatusCode)
+
+	resp, err := server.Client().Post(server.URL, "application/json", strings.NewReader("{"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGraphQLSchemaChanges(t *testing.T) {
+	n, server := newTestGraphQL(t)
+
+	before, err := n.graphql.currentSchema()
+	require.NoError(t, err)
+	unchanged, err := n.graphql.currentSchema()
+	require.NoError(t, err)
+	assert.Same(t, before.QueryType(), unchanged.QueryType())
+
+	res := graphqlQuery(t, server, `{ Tag { nodes { value } } }`)
+	assert.NotEmpty(t, res.Errors)
+
+	// a new label or attribute rebuilds the schema
+	seedGraph(t, n.graphql.graph, `MERGE (t:Tag {value: 'golang'})`)
+	res = graphqlQuery(t, server, `{ Tag { nodes { value } } }`)
+	require.Empty(t, res.Errors)
+	assert.Equal(t, "golang", field(res.Data, "Tag", "nodes", 0, "value"))
+
+	after, err := n.graphql.currentSchema()
+	require.NoError(t, err)
+	assert.NotSame(t, before.QueryType(), after.QueryType())
+}
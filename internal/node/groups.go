@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"net/http"
+
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+// MaxGroupMembers is the most members of a sharing group a seed lists
+const MaxGroupMembers = 16
+
+// GroupConfig is read from the group section of the config file. Caches which
+// share a group name together keep the actions and graph of its topics, each
+// member subscribing to all of them. Members tell the seeds they join which
+// group they are in so that clients can spread their backfill requests over
+// the group rather than load a single cache.
+type GroupConfig struct {
+	// Name is the group the node belongs to, empty for none
+	Name string `mapstructure:"name"`
+	// Namespace is the graph the group's topics are in, the default graph if
+	// empty
+	Namespace string `mapstructure:"namespace"`
+	// Topics are the labels and Label:key=value pairs the group keeps
+	Topics []string `mapstructure:"topics"`
+}
+
+func (c GroupConfig) validate(check *configCheck, config Config) {
+	if c.Name == "" {
+		if len(c.Topics) > 0 {
+			check.addf("name", "must be set with topics")
+		}
+		return
+	}
+	if !namespaceName.MatchString(c.Name) {
+		check.addf("name", "groups are lower case letters, digits, '_', '.' and '-'")
+	}
+	if len(c.Topics) == 0 {
+		check.addf("topics", "must list what the group keeps")
+	}
+	if _, ok := config.Namespaces[c.Namespace]; c.Namespace != "" && !ok {
+		check.addf("namespace", "%q isn't in namespaces", c.Namespace)
+	}
+	capabilities, err := config.capabilities()
+	if err == nil && !capabilities.Has(CapabilityServeQueries) {
+		check.addf("name", "members serve backfill so need the serves-queries capability")
+	}
+}
+
+// keys returns the subscription filter keys of the group's topics
+func (c GroupConfig) keys() []string {
+	return namespaceKeys(c.Namespace, topicKeys(c.Topics))
+}
+
+// handleGroup lists the most recently seen members of a sharing group
+func (n *node) handleGroup(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	if !namespaceName.MatchString(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	members, err := n.store.GetGroupMembers(req.Context(), name, MaxGroupMembers)
+	if err != nil {
+		n.logger.Error("fetching group members", "error", err, "group", name, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	n.writeJSON(w, model.GroupResponse{
+		Name:    name,
+		Members: members,
+	})
+}
+
+// joinGroup returns the group named by a joining node, empty unless the node
+// is a cache with a valid group name
+func joinGroup(req *http.Request, nodeType string) string {
+	group := req.Header.Get(HeaderGroup)
+	if nodeType != NodeTypeCache.String() || !namespaceName.MatchString(group) {
+		return ""
+	}
+	return group
+}
@@ -0,0 +1,223 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+// Handles are claimed by publishing an Identity node. Nothing stops two
+// identities claiming the same handle so claims are ranked: a handle of the
+// form user@domain can be verified by the domain's webfinger listing the
+// identity (as an alias or link href of propolis:<identifier>), otherwise the
+// first identity seen with the handle wins. The time a claim was made is the
+// creation time signed into the action's manifest so nodes in a federation
+// agree on the order.
+
+const (
+	LabelIdentity           = "Identity"
+	WebfingerIdentityPrefix = "propolis:"
+)
+
+// HandleResolution is the result of resolving a handle. Conflict is set if
+// more than one identity claims it.
+type HandleResolution struct {
+	Handle   string               `json:"handle"`
+	Identity string               `json:"identity"`
+	Verified bool                 `json:"verified"`
+	Conflict bool                 `json:"conflict"`
+	Claims   []*model.HandleClaim `json:"claims"`
+}
+
+// NormalizeHandle lower cases a handle and strips any leading @
+func NormalizeHandle(handle string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(handle), "@"))
+}
+
+// ResolveHandle returns the identity a handle belongs to along with all the
+// claims to it
+func (n *node) ResolveHandle(ctx context.Context, handle string) (*HandleResolution, error) {
+	handle = NormalizeHandle(handle)
+
+	claims, err := n.store.GetHandleClaims(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(claims) == 0 {
+		return nil, model.ErrNotFound
+	}
+
+	return &HandleResolution{
+		Handle:   handle,
+		Identity: claims[0].Identity,
+		Verified: claims[0].VerifiedAt != nil,
+		Conflict: len(claims) > 1,
+		Claims:   claims,
+	}, nil
+}
+
+// recordHandleClaim records the handle if the action publishes the signer's
+// own Identity node
+func (n *node) recordHandleClaim(ctx context.Context, action graph.Action) {
+	e := identityStatement(action.Command, LabelIdentity)
+	if e == nil {
+		return
+	}
+
+	signer := action.Identity
+	if signer == "" && action.Certificate != nil {
+		signer = action.Certificate.Subject.CommonName
+	}
+
+	id, _ := e.Attribute("id")
+	handle, _ := e.Attribute("handle")
+	handle = NormalizeHandle(handle)
+	if handle == "" || id != signer {
+		return
+	}
+
+	claim := &model.HandleClaim{
+		Handle:      handle,
+		Identity:    signer,
+		FirstSeenAt: claimTime(action),
+		ActionID:    action.ID,
+	}
+
+	err := n.store.PutHandleClaim(ctx, claim)
+	if err != nil {
+		n.logger.Error("recording handle claim", "error", err, "handle", handle, "identity", signer)
+		return
+	}
+
+	if n.verifyHandles {
+		go n.verifyHandleClaim(ctx, claim)
+	}
+}
+
+// verifyHandleClaim checks a user@domain handle against the domain's webfinger
+func (n *node) verifyHandleClaim(ctx context.Context, claim *model.HandleClaim) {
+	user, domain, ok := strings.Cut(claim.Handle, "@")
+	if !ok || user == "" || domain == "" || strings.ContainsAny(domain, "/?#@:") {
+		return
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
+	defer cancelFn()
+
+	err := verifyWebfinger(ctx, n.webfinger, user, domain, claim.Identity)
+	if err != nil {
+		n.logger.Info("handle not verified", "handle", claim.Handle, "identity", claim.Identity, "reason", err)
+		return
+	}
+
+	err = n.store.SetHandleVerified(ctx, claim.Handle, claim.Identity, time.Now().UTC())
+	if err != nil {
+		n.logger.Error("verifying handle", "error", err, "handle", claim.Handle)
+		return
+	}
+
+	n.logger.Info("handle verified", "handle", claim.Handle, "identity", claim.Identity)
+}
+
+func verifyWebfinger(ctx context.Context, client *http.Client, user, domain, identifier string) error {
+	resource := url.QueryEscape("acct:" + user + "@" + domain)
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+domain+"/.well-known/webfinger?resource="+resource, nil)
+	if err != nil {
+		return fmt.Errorf("creating webfinger request: %w", err)
+	}
+	req.Header.Add("Accept", "application/jrd+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching webfinger: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad webfinger response: %d", resp.StatusCode)
+	}
+
+	jrd := struct {
+		Aliases []string `json:"aliases"`
+		Links   []struct {
+			Href string `json:"href"`
+		} `json:"links"`
+	}{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, MaxBodySize)).Decode(&jrd)
+	if err != nil {
+		return fmt.Errorf("decoding webfinger: %w", err)
+	}
+
+	proof := WebfingerIdentityPrefix + identifier
+	if slices.Contains(jrd.Aliases, proof) {
+		return nil
+	}
+	for _, link := range jrd.Links {
+		if link.Href == proof {
+			return nil
+		}
+	}
+
+	return errors.New("identity not listed")
+}
+
+// claimTime is when the claim was signed, falling back to when we received it
+// for actions made locally. The received-by header isn't signed so it can't be
+// used to backdate a claim, and a creation time ahead of our clock is no
+// earlier than now.
+func claimTime(action graph.Action) time.Time {
+	if action.CreatedAt != nil && action.CreatedAt.Before(action.Timestamp) {
+		return action.CreatedAt.UTC()
+	}
+	return action.Timestamp
+}
+
+func (n *node) handleResolveHandle(w http.ResponseWriter, req *http.Request) {
+	res, err := n.ResolveHandle(req.Context(), req.PathValue("handle"))
+	if err != nil {
+		if errors.Is(err, model.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n.logger.Error("resolving handle", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add(HeaderContentType, ContentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
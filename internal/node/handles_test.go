@@ -0,0 +1,76 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimTime(t *testing.T) {
+	received := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		ts := received.Add(d)
+		return &ts
+	}
+
+	tests := map[string]struct {
+		action   graph.Action
+		expected time.Time
+	}{
+		"signed creation time": {
+			action:   graph.Action{Timestamp: received, CreatedAt: at(-time.Hour)},
+			expected: received.Add(-time.Hour),
+		},
+		"created ahead of our clock": {
+			action:   graph.Action{Timestamp: received, CreatedAt: at(time.Minute)},
+			expected: received,
+		},
+		"made locally": {
+			action:   graph.Action{Timestamp: received},
+			expected: received,
+		},
+		// the received-by header is unsigned so a relay could write anything in it
+		"received-by ignored": {
+			action:   graph.Action{Timestamp: received, ReceivedBy: "by=relay,from=10.0.0.2:9000,on=2020-01-01T00:00:00Z"},
+			expected: received,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, claimTime(tt.action))
+		})
+	}
+}
+
+func TestRecordHandleClaim(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode(t)
+
+	now := time.Now().UTC()
+	claim := func(id, identity string, createdAt time.Time, receivedBy string) {
+		parser, err := ast.Parse(`MERGE (:Identity {id: '` + identity + `', handle: 'ann'})`)
+		require.NoError(t, err)
+		n.recordHandleClaim(ctx, graph.Action{
+			ID:         id,
+			Identity:   identity,
+			Timestamp:  now,
+			CreatedAt:  &createdAt,
+			ReceivedBy: receivedBy,
+			Command:    parser.Command(),
+		})
+	}
+
+	claim("1", "first", now.Add(-time.Hour), "")
+	claim("2", "second", now.Add(-time.Minute), "by=relay,from=10.0.0.2:9000,on=2020-01-01T00:00:00Z")
+
+	res, err := n.ResolveHandle(ctx, "ann")
+	require.NoError(t, err)
+	assert.Equal(t, "first", res.Identity)
+	assert.True(t, res.Conflict)
+}
@@ -0,0 +1,323 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/identity"
+)
+
+const (
+	// JoinRequireOpen lets any node join
+	JoinRequireOpen = "open"
+	// JoinRequireWork needs a proof of work in the hello
+	JoinRequireWork = "work"
+	// JoinRequireInvitation needs an invitation from one of the inviters
+	JoinRequireInvitation = "invitation"
+	// JoinRequireEither needs a proof of work or an invitation
+	JoinRequireEither = "either"
+
+	// MaxJoinDifficulty is the most leading zero bits a seed can ask for, a
+	// joining node won't try to find more
+	MaxJoinDifficulty     = 28
+	defaultJoinDifficulty = 20
+)
+
+var (
+	ErrJoinWorkRequired       = errors.New("join needs a proof of work")
+	ErrJoinInvitationRequired = errors.New("join needs an invitation")
+)
+
+// JoinPolicyConfig is read from the join_policy section of the config file. A
+// seed can make mass registering fake peers costly by asking joining nodes
+// for a proof of work, or restrict joining to nodes invited by one of a set
+// of identities. Both are bound to the key the joining node signs its hello
+// with, and while either is required one key can only be registered from one
+// address at a time.
+type JoinPolicyConfig struct {
+	// Require is open (the default), work, invitation or either
+	Require string `mapstructure:"require"`
+	// Difficulty is how many leading zero bits the hash of a proof of work
+	// needs, each one doubling the work
+	Difficulty int `mapstructure:"difficulty"`
+	// Inviters are PEM encoded certificate files of the identities whose
+	// invitations are accepted
+	Inviters []string `mapstructure:"inviters"`
+	// InvitationFile holds the invitation this node sends when it joins
+	// seeds. It is read each time, so the node can be invited while running.
+	InvitationFile string `mapstructure:"invitation_file"`
+}
+
+func (c JoinPolicyConfig) withDefaults() JoinPolicyConfig {
+	if c.Require == "" {
+		c.Require = JoinRequireOpen
+	}
+	if c.Difficulty == 0 {
+		c.Difficulty = defaultJoinDifficulty
+	}
+	return c
+}
+
+func (c JoinPolicyConfig) validate(check *configCheck, config Config) {
+	switch c.Require {
+	case "", JoinRequireOpen:
+		return
+	case JoinRequireWork, JoinRequireInvitation, JoinRequireEither:
+	default:
+		check.addf("require", "%q isn't a requirement, use %s, %s, %s or %s", c.Require, JoinRequireOpen, JoinRequireWork, JoinRequireInvitation, JoinRequireEither)
+		return
+	}
+
+	capabilities, err := config.capabilities()
+	if err == nil && !capabilities.Has(CapabilityAcceptJoins) {
+		check.addf("require", "only nodes which accept joins check them")
+	}
+	if c.Difficulty < 0 || c.Difficulty > MaxJoinDifficulty {
+		check.addf("difficulty", "must be between 0 and %d, got %d", MaxJoinDifficulty, c.Difficulty)
+	}
+	if c.Require != JoinRequireWork && len(c.Inviters) == 0 {
+		check.addf("inviters", "are needed to accept invitations")
+	}
+}
+
+// joinPolicy checks the hellos of nodes joining a seed
+type joinPolicy struct {
+	config   JoinPolicyConfig
+	inviters []*x509.Certificate
+}
+
+// newJoinPolicy loads the inviters' certificates. It returns nil if any node
+// can join.
+func newJoinPolicy(c JoinPolicyConfig) (*joinPolicy, error) {
+	c = c.withDefaults()
+	if c.Require == JoinRequireOpen {
+		return nil, nil
+	}
+
+	a := &joinPolicy{config: c}
+	for _, path := range c.Inviters {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading inviter: %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("decoding inviter %s: no certificate", path)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing inviter %s: %w", path, err)
+		}
+		a.inviters = append(a.inviters, cert)
+	}
+	return a, nil
+}
+
+// check returns an error unless a hello signed with nodeKey carries what the
+// seed with seedKey requires
+func (a *joinPolicy) check(req *http.Request, nodeKey, seedKey string) error {
+	if a == nil {
+		return nil
+	}
+	if nodeKey == "" {
+		return ErrControlUnsigned
+	}
+
+	workErr, invitationErr := ErrJoinWorkRequired, ErrJoinInvitationRequired
+	if a.config.Require != JoinRequireInvitation && checkJoinWork(seedKey, nodeKey, req.Header.Get(HeaderJoinWork), a.config.Difficulty) {
+		workErr = nil
+	}
+	if a.config.Require != JoinRequireWork {
+		invitationErr = a.checkInvitation(req.Header.Get(HeaderInvitation), nodeKey, time.Now().UTC())
+	}
+
+	switch a.config.Require {
+	case JoinRequireWork:
+		return workErr
+	case JoinRequireInvitation:
+		return invitationErr
+	}
+	if workErr == nil || invitationErr == nil {
+		return nil
+	}
+	// a node which sent an invitation wants to know what was wrong with it
+	if req.Header.Get(HeaderInvitation) != "" {
+		return invitationErr
+	}
+	return workErr
+}
+
+// checkInvitation checks that an invitation names the node's key and was
+// signed by one of the inviters
+func (a *joinPolicy) checkInvitation(token, nodeKey string, now time.Time) error {
+	if token == "" {
+		return ErrJoinInvitationRequired
+	}
+	inv, err := identity.ParseInvitation(token)
+	if err != nil {
+		return err
+	}
+	if base64.StdEncoding.EncodeToString(inv.NodeKey) != nodeKey {
+		return identity.ErrBadInvitation
+	}
+
+	i := slices.IndexFunc(a.inviters, func(cert *x509.Certificate) bool {
+		return cert.Subject.CommonName == inv.Identifier
+	})
+	if i < 0 {
+		return identity.ErrUnauthorized
+	}
+	err = identity.CheckValidity(a.inviters[i], now)
+	if err != nil {
+		return err
+	}
+	return identity.VerifyInvitation(inv, a.inviters[i], now)
+}
+
+// workDifficulty is the difficulty a refused node is told to work to, zero
+// if work isn't accepted
+func (a *joinPolicy) workDifficulty() int {
+	if a == nil || a.config.Require == JoinRequireInvitation {
+		return 0
+	}
+	return a.config.Difficulty
+}
+
+// writeJoinRefusal turns away a node whose hello failed the join policy
+// check, telling it the difficulty of the work it can do instead and the
+// seed's node key the work is bound to
+func (n *node) writeJoinRefusal(w http.ResponseWriter, req *http.Request, err error) {
+	n.metrics.joinsRefused.Inc()
+	n.logger.Warn("refusing join", "error", err, "remote", req.RemoteAddr)
+	if difficulty := n.joinPolicy.workDifficulty(); difficulty > 0 {
+		w.Header().Set(HeaderJoinDifficulty, strconv.Itoa(difficulty))
+		w.Header().Set(HeaderNodeKey, n.NodeKey())
+	}
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(err.Error()))
+}
+
+// JoinWorkPayload returns what is hashed to prove work to join the seed with
+// seedKey with a node key. The work is bound to the seed's key rather than
+// its address, which the seed may not see as the joining node dialed it.
+func JoinWorkPayload(seedKey, nodeKey, nonce string) []byte {
+	return []byte("propolis-join\n" + seedKey + "\n" + nodeKey + "\n" + nonce)
+}
+
+func checkJoinWork(seedKey, nodeKey, nonce string, difficulty int) bool {
+	if nonce == "" {
+		return false
+	}
+	return leadingZeroBits(sha256.Sum256(JoinWorkPayload(seedKey, nodeKey, nonce))) >= difficulty
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	count := 0
+	for _, b := range sum {
+		count += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return count
+}
+
+// solveJoinWork finds a nonce whose hash has difficulty leading zero bits
+func solveJoinWork(ctx context.Context, seedKey, nodeKey string, difficulty int) (string, error) {
+	if difficulty > MaxJoinDifficulty {
+		return "", fmt.Errorf("join difficulty %d is over %d", difficulty, MaxJoinDifficulty)
+	}
+	for i := uint64(0); ; i++ {
+		if i%4096 == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		nonce := strconv.FormatUint(i, 36)
+		if checkJoinWork(seedKey, nodeKey, nonce, difficulty) {
+			return nonce, nil
+		}
+	}
+}
+
+// joinWork keeps the proofs of work found for each seed, which stay good for
+// as long as the node key does
+type joinWork struct {
+	mu     sync.Mutex
+	nonces map[string]string
+}
+
+func newJoinWork() *joinWork {
+	return &joinWork{nonces: map[string]string{}}
+}
+
+func (j *joinWork) get(seed string) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.nonces[seed]
+}
+
+func (j *joinWork) set(seed, nonce string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.nonces[seed] = nonce
+}
+
+// invitation returns the invitation to send with a hello, empty if the node
+// hasn't been invited
+func (n *node) invitation() string {
+	if n.invitationFile == "" {
+		return ""
+	}
+	data, err := os.ReadFile(n.invitationFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			n.logger.Error("reading invitation", "error", err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// dropMovedPeers drops the peers registered with a node key from addresses
+// other than the one it is joining from, so that a proof of work or an
+// invitation can't register a key many times over
+func (n *node) dropMovedPeers(ctx context.Context, nodeKey, remoteAddr string) {
+	peers, err := n.store.GetPeersByNodeKey(ctx, nodeKey)
+	if err != nil {
+		n.logger.Error("fetching peers by node key", "error", err, "remote", remoteAddr)
+		return
+	}
+	for _, p := range peers {
+		if p.RemoteAddr != remoteAddr {
+			n.dropPeer(ctx, p.RemoteAddr, "moved")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package node
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jdudmesh/propolis/internal/bloom"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoinWorkOverSession(t *testing.T) {
+	seed := newTestNode(t)
+	_, seedKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	seed.nodeKey = seedKey
+	seed.control = ControlConfig{}.withDefaults()
+	seed.joinPolicy, err = newJoinPolicy(JoinPolicyConfig{Require: JoinRequireWork, Difficulty: 8})
+	require.NoError(t, err)
+
+	hellos := atomic.Int32{}
+	listener := newTestQUICTransport(t, seed, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hellos.Add(1)
+		body, err := readControlBody(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		nodeKey, err := seed.verifyControl(req, body, nil)
+		if err != nil {
+			seed.writeControlError(w, req, err)
+			return
+		}
+		err = seed.joinPolicy.check(req, nodeKey, seed.NodeKey())
+		if err != nil {
+			seed.writeJoinRefusal(w, req, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	addr := fmt.Sprintf("localhost:%d", listener.udpConn.LocalAddr().(*net.UDPAddr).Port)
+
+	joining := newTestNode(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	joining.nodeKey = key
+	joining.joinWork = newJoinWork()
+	joining.subscriptions = bloom.New()
+	joining.publicAddr = newPublicAddress("", "", 0, 1)
+	joining.client = &http.Client{Transport: newTestQUICTransport(t, joining, http.NotFoundHandler())}
+
+	// the seed is dialed by name, which it doesn't see, so the work is bound
+	// to its key
+	resp, err := joining.sendHello(context.Background(), addr)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, ProtocolSession, resp.Proto)
+	assert.Equal(t, int32(2), hellos.Load())
+
+	// the work is kept for the next hello
+	resp, err = joining.sendHello(context.Background(), addr)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, int32(3), hellos.Load())
+	assert.True(t, checkJoinWork(seed.NodeKey(), joining.NodeKey(), joining.joinWork.get(addr), 8))
+}
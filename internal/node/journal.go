@@ -0,0 +1,725 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+const (
+	journalAppend  = "append"
+	journalApplied = "applied"
+	journalEvicted = "evicted"
+
+	// journalReplayBatchSize is the most actions ReplayJournal executes in
+	// one transaction
+	journalReplayBatchSize = 500
+)
+
+// JournalConfig is read from the journal section of the config file. When a
+// path is set accepted actions are written to an append only file before
+// they're executed, so those interrupted by a crash are replayed on restart
+// and backfill is served from the file rather than the database.
+type JournalConfig struct {
+	// Path is the journal file, empty disables the journal
+	Path string `mapstructure:"path"`
+	// Sync flushes every entry to disk before the action is executed.
+	// Without it a power cut, rather than a crash of the node, can lose the
+	// newest entries.
+	Sync bool `mapstructure:"sync"`
+}
+
+func (c JournalConfig) validate(check *configCheck) {
+	if c.Path == "" {
+		if c.Sync {
+			check.addf("sync", "needs a path to write the journal to")
+		}
+		return
+	}
+
+	info, err := os.Stat(filepath.Dir(c.Path))
+	if err != nil || !info.IsDir() {
+		check.addf("path", "directory %s doesn't exist", filepath.Dir(c.Path))
+	}
+}
+
+// journalAction is an accepted action as written to the journal, with what
+// processing it again needs alongside the fields served to peers
+type journalAction struct {
+	BackfillAction
+	RemoteAddr  string   `json:"remoteAddr,omitempty"`
+	EntityIDs   []string `json:"entityIds,omitempty"`
+	Certificate []byte   `json:"certificate,omitempty"`
+}
+
+// journalEntry is one line of the journal. An append carries the action,
+// applied and evicted carry the IDs of actions appended earlier.
+type journalEntry struct {
+	Op     string         `json:"op"`
+	Action *journalAction `json:"action,omitempty"`
+	IDs    []string       `json:"ids,omitempty"`
+}
+
+// journalPosition is where an appended action is in the file
+type journalPosition struct {
+	id        string
+	timestamp time.Time
+	expires   bool
+	offset    int64
+	length    int
+}
+
+// journal is the write-ahead log of accepted actions. Only the positions of
+// the actions are kept in memory, ordered by timestamp, and the actions are
+// read back from the file when needed.
+type journal struct {
+	config JournalConfig
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	positions []journalPosition
+	pending   map[string]struct{}
+}
+
+// openJournal opens the journal file, creating it if needed, and reads the
+// positions of the actions in it. It returns nil if the journal is disabled.
+func openJournal(config JournalConfig, logger *slog.Logger) (*journal, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+
+	j := &journal{
+		config: config,
+		logger: logger.With("journal", config.Path),
+	}
+
+	err := j.open()
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// open (re)opens the file and rebuilds the positions from it
+func (j *journal) open() error {
+	file, err := os.OpenFile(j.config.Path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening journal: %w", err)
+	}
+
+	j.file = file
+	j.positions = nil
+	j.pending = map[string]struct{}{}
+
+	j.size, err = readJournal(file, j.replay)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("reading journal: %w", err)
+	}
+	if info.Size() > j.size {
+		// the node stopped part way through writing the last entry, which
+		// was never acknowledged
+		j.logger.Warn("dropping incomplete journal entry", "offset", j.size)
+		err = file.Truncate(j.size)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("truncating journal: %w", err)
+		}
+	}
+
+	_, err = file.Seek(j.size, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("seeking journal: %w", err)
+	}
+	return nil
+}
+
+// readJournal calls fn with each complete entry and where it is in the file,
+// returning where the last complete entry ends
+func readJournal(r io.Reader, fn func(entry journalEntry, offset int64, length int)) (int64, error) {
+	br := bufio.NewReader(r)
+	size := int64(0)
+	for {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return size, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reading journal: %w", err)
+		}
+
+		entry := journalEntry{}
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return 0, fmt.Errorf("reading journal at offset %d: %w", size, err)
+		}
+		fn(entry, size, len(line))
+		size += int64(len(line))
+	}
+}
+
+// replay applies an entry read from the file to the positions
+func (j *journal) replay(entry journalEntry, offset int64, length int) {
+	switch entry.Op {
+	case journalAppend:
+		if entry.Action == nil {
+			return
+		}
+		j.insert(journalPosition{
+			id:        entry.Action.ID,
+			timestamp: entry.Action.Timestamp,
+			expires:   entry.Action.ExpiresAt != nil,
+			offset:    offset,
+			length:    length,
+		})
+		j.pending[entry.Action.ID] = struct{}{}
+	case journalApplied:
+		for _, id := range entry.IDs {
+			delete(j.pending, id)
+		}
+	case journalEvicted:
+		j.remove(entry.IDs)
+	}
+}
+
+// insert adds a position keeping them in timestamp then ID order. Actions
+// mostly arrive in order so this is usually an append.
+func (j *journal) insert(p journalPosition) {
+	i := sort.Search(len(j.positions), func(i int) bool {
+		return actionAfter(j.positions[i].timestamp, j.positions[i].id, p.timestamp, p.id)
+	})
+	j.positions = slices.Insert(j.positions, i, p)
+}
+
+func (j *journal) remove(ids []string) {
+	drop := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		drop[id] = struct{}{}
+		delete(j.pending, id)
+	}
+	j.positions = slices.DeleteFunc(j.positions, func(p journalPosition) bool {
+		_, ok := drop[p.id]
+		return ok
+	})
+}
+
+// write adds an entry to the end of the file, returning where it was written
+func (j *journal) write(entry journalEntry) (int64, int, error) {
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return 0, 0, fmt.Errorf("encoding journal entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	offset := j.size
+	_, err = j.file.Write(line)
+	if err != nil {
+		// leave the file as it was so the next entry isn't written after a
+		// partial one
+		j.file.Truncate(offset)
+		j.file.Seek(offset, io.SeekStart)
+		return 0, 0, fmt.Errorf("writing journal: %w", err)
+	}
+	j.size += int64(len(line))
+
+	if j.config.Sync {
+		err = j.file.Sync()
+		if err != nil {
+			return 0, 0, fmt.Errorf("syncing journal: %w", err)
+		}
+	}
+	return offset, len(line), nil
+}
+
+// append records an accepted action before it's processed
+func (j *journal) append(action graph.Action) error {
+	if j == nil {
+		return nil
+	}
+
+	entry := &journalAction{
+		BackfillAction: *newBackfillAction(&action),
+		RemoteAddr:     action.RemoteAddr,
+		EntityIDs:      action.EntityIDs,
+	}
+	if action.Certificate != nil {
+		entry.Certificate = action.Certificate.Raw
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	offset, length, err := j.write(journalEntry{Op: journalAppend, Action: entry})
+	if err != nil {
+		return err
+	}
+	j.insert(journalPosition{
+		id:        action.ID,
+		timestamp: action.Timestamp,
+		expires:   action.ExpiresAt != nil,
+		offset:    offset,
+		length:    length,
+	})
+	j.pending[action.ID] = struct{}{}
+	return nil
+}
+
+// applied records that an action has been processed so it isn't replayed.
+// Failing to record it only means the action is processed again after a
+// restart, so the error is logged rather than returned.
+func (j *journal) applied(id string) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.pending[id]; !ok {
+		return
+	}
+	_, _, err := j.write(journalEntry{Op: journalApplied, IDs: []string{id}})
+	if err != nil {
+		j.logger.Error("marking action applied", "error", err, "id", id)
+		return
+	}
+	delete(j.pending, id)
+}
+
+// evict records that the content of expired actions is gone so they're no
+// longer served to peers
+func (j *journal) evict(ids []string) error {
+	if j == nil || len(ids) == 0 {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, _, err := j.write(journalEntry{Op: journalEvicted, IDs: ids})
+	if err != nil {
+		return err
+	}
+	j.remove(ids)
+	return nil
+}
+
+// read loads the action at a position, which must be called with the lock
+// held
+func (j *journal) read(p journalPosition) (*journalAction, error) {
+	line := make([]byte, p.length)
+	_, err := j.file.ReadAt(line, p.offset)
+	if err != nil {
+		return nil, fmt.Errorf("reading journal at offset %d: %w", p.offset, err)
+	}
+
+	entry := journalEntry{}
+	err = json.Unmarshal(line, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("reading journal at offset %d: %w", p.offset, err)
+	}
+	if entry.Action == nil || entry.Action.ID != p.id {
+		return nil, fmt.Errorf("reading journal at offset %d: expected action %s", p.offset, p.id)
+	}
+	return entry.Action, nil
+}
+
+// since returns the actions received after the given time, oldest first, in
+// the same way as the store's GetActionsSince
+func (j *journal) since(since time.Time, after string, limit int) ([]*graph.Action, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	i := sort.Search(len(j.positions), func(i int) bool {
+		return actionAfter(j.positions[i].timestamp, j.positions[i].id, since, after)
+	})
+
+	actions := []*graph.Action{}
+	for _, p := range j.positions[i:] {
+		if len(actions) == limit {
+			break
+		}
+		a, err := j.read(p)
+		if err != nil {
+			return nil, err
+		}
+		action := a.action()
+		actions = append(actions, &action)
+	}
+	return actions, nil
+}
+
+// unapplied returns the actions which were accepted but not processed,
+// oldest first
+func (j *journal) unapplied() ([]*journalAction, error) {
+	if j == nil {
+		return nil, nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	actions := []*journalAction{}
+	for _, p := range j.positions {
+		if _, ok := j.pending[p.id]; !ok {
+			continue
+		}
+		a, err := j.read(p)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+// compact rewrites the journal without the processed actions received
+// before the retention cutoff. Actions waiting to expire are kept until
+// they're evicted, as they are in the store.
+func (j *journal) compact(before time.Time) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	keep := make([]journalPosition, 0, len(j.positions))
+	for _, p := range j.positions {
+		_, pending := j.pending[p.id]
+		if pending || p.expires || !p.timestamp.Before(before) {
+			keep = append(keep, p)
+		}
+	}
+	if len(keep) == len(j.positions) {
+		return nil
+	}
+
+	tmp := j.config.Path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("compacting journal: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	err = j.copyTo(out, keep)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("compacting journal: %w", err)
+	}
+
+	err = os.Rename(tmp, j.config.Path)
+	if err != nil {
+		return fmt.Errorf("compacting journal: %w", err)
+	}
+
+	j.file.Close()
+	err = j.open()
+	if err != nil {
+		return err
+	}
+
+	j.logger.Debug("compacted journal", "dropped", len(j.positions)-len(keep), "kept", len(keep))
+	return nil
+}
+
+// copyTo writes the kept actions to a new file followed by a single entry
+// marking those already processed
+func (j *journal) copyTo(w io.Writer, keep []journalPosition) error {
+	bw := bufio.NewWriter(w)
+	applied := []string{}
+	for _, p := range keep {
+		line := make([]byte, p.length)
+		_, err := j.file.ReadAt(line, p.offset)
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(line)
+		if err != nil {
+			return err
+		}
+		if _, ok := j.pending[p.id]; !ok {
+			applied = append(applied, p.id)
+		}
+	}
+
+	if len(applied) > 0 {
+		line, err := json.Marshal(&journalEntry{Op: journalApplied, IDs: applied})
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(append(line, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// action rebuilds the accepted action, without the parsed statement
+func (a *journalAction) action() graph.Action {
+	return graph.Action{
+		ID:               a.ID,
+		Timestamp:        a.Timestamp,
+		Action:           a.Action,
+		RemoteAddr:       a.RemoteAddr,
+		NodeID:           a.NodeID,
+		Identity:         a.Identity,
+		ReceivedBy:       a.ReceivedBy,
+		EncodedSignature: a.EncodedSignature,
+		ExpiresAt:        a.ExpiresAt,
+		KeyID:            a.KeyID,
+		ManifestVersion:  a.ManifestVersion,
+		CreatedAt:        a.CreatedAt,
+		TTL:              a.TTL,
+		Namespace:        a.Namespace,
+		Delegation:       a.Delegation,
+		EntityIDs:        a.EntityIDs,
+	}
+}
+
+// replayJournal processes the actions which were accepted but hadn't been
+// processed when the node last stopped
+func (n *node) replayJournal(ctx context.Context) {
+	actions, err := n.journal.unapplied()
+	if err != nil {
+		n.logger.Error("reading journal", "error", err)
+		return
+	}
+
+	for _, a := range actions {
+		if ctx.Err() != nil {
+			return
+		}
+
+		action := a.action()
+		if len(a.Certificate) > 0 {
+			action.Certificate, err = x509.ParseCertificate(a.Certificate)
+			if err != nil {
+				n.logger.Warn("reading journalled certificate", "error", err, "id", action.ID)
+			}
+		}
+
+		stmt := action.Action
+		if action.KeyID != "" {
+			plaintext, ok, err := n.subscriptionKeys.Open(action.KeyID, action.Action)
+			if err != nil {
+				n.logger.Error("replaying action", "error", err, "id", action.ID)
+				n.journal.applied(action.ID)
+				continue
+			}
+			// unreadable actions are only passed on
+			stmt = plaintext
+			if !ok {
+				stmt = ""
+			}
+		}
+
+		if stmt != "" {
+			action.Command, err = n.statementLimits().parseStatement(stmt)
+			if err != nil {
+				n.logger.Error("replaying action", "error", err, "id", action.ID)
+				n.journal.applied(action.ID)
+				continue
+			}
+
+			// the journal holds the signed statement so plugin rewrites are
+			// made again
+			moderated := action
+			moderated.Action = stmt
+			err = n.moderateAction(&moderated)
+			if err != nil {
+				n.logger.Warn("replaying action", "error", err, "id", action.ID)
+				n.journal.applied(action.ID)
+				continue
+			}
+			action.Command = moderated.Command
+		}
+
+		n.processAction(ctx, action)
+	}
+
+	if len(actions) > 0 {
+		n.logger.Info("replayed journal", "actions", len(actions))
+	}
+}
+
+// JournalReplay counts the actions ReplayJournal went through
+type JournalReplay struct {
+	Executed int
+	// Skipped are private actions none of the subscription keys open
+	Skipped int
+	// Failed are actions which didn't parse or execute, as they may have
+	// when the node first received them
+	Failed int
+	// Evicted are expired actions whose writes were purged
+	Evicted int
+}
+
+// ReplayJournal executes the actions of a namespace in the configured journal
+// against a graph, in the order they were journalled, and purges the writes
+// of actions evicted since as the node did. Private actions are opened with
+// the configured subscription keys. The journal is only read, so that of a
+// running node can be replayed. Actions are executed in batches, each in one
+// unit of work.
+func ReplayJournal(config Config, namespace string, g Graph) (*JournalReplay, error) {
+	keys, err := newSubscriptionKeyring(config.SubscriptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("reading subscription keys: %w", err)
+	}
+	limits := config.Limits.withDefaults()
+
+	file, err := os.Open(config.Journal.Path)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+	defer file.Close()
+
+	var uow graph.UnitOfWork
+	batched := 0
+	commit := func() error {
+		if uow == nil {
+			return nil
+		}
+		err := uow.Commit()
+		uow = nil
+		batched = 0
+		return err
+	}
+
+	// the IDs of the namespace's actions, to pick out its evictions
+	ids := map[string]struct{}{}
+	replay := &JournalReplay{}
+	var replayErr error
+	_, err = readJournal(file, func(entry journalEntry, offset int64, length int) {
+		if replayErr != nil {
+			return
+		}
+
+		switch {
+		case entry.Op == journalAppend && entry.Action != nil && entry.Action.Namespace == namespace:
+			ids[entry.Action.ID] = struct{}{}
+			if uow == nil {
+				uow, replayErr = g.Begin()
+				if replayErr != nil {
+					return
+				}
+			}
+			replay.replayAction(entry.Action.action(), keys, limits, uow)
+			batched++
+			if batched >= journalReplayBatchSize {
+				replayErr = commit()
+			}
+		case entry.Op == journalEvicted:
+			evicted := slices.DeleteFunc(slices.Clone(entry.IDs), func(id string) bool {
+				_, ok := ids[id]
+				return !ok
+			})
+			if len(evicted) == 0 {
+				return
+			}
+			// the purge has to see the writes it removes
+			replayErr = commit()
+			if replayErr != nil {
+				return
+			}
+			_, replayErr = g.PurgeActions(evicted)
+			replay.Evicted += len(evicted)
+		}
+	})
+	if err == nil {
+		err = replayErr
+	}
+	if err == nil {
+		err = commit()
+	} else if uow != nil {
+		uow.Rollback()
+	}
+	if err != nil {
+		return replay, fmt.Errorf("replaying journal: %w", err)
+	}
+	return replay, nil
+}
+
+func (r *JournalReplay) replayAction(action graph.Action, keys *subscriptionKeyring, limits StatementLimits, uow graph.UnitOfWork) {
+	stmt := action.Action
+	if action.KeyID != "" {
+		plaintext, ok, err := keys.Open(action.KeyID, action.Action)
+		if err != nil {
+			r.Failed++
+			return
+		}
+		if !ok {
+			r.Skipped++
+			return
+		}
+		stmt = plaintext
+	}
+
+	var err error
+	action.Command, err = limits.parseStatement(stmt)
+	if err != nil {
+		r.Failed++
+		return
+	}
+
+	_, err = uow.Execute(action)
+	if err != nil {
+		r.Failed++
+		return
+	}
+	r.Executed++
+}
@@ -0,0 +1,209 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestJournal returns a journal in a temporary directory
+func newTestJournal(t *testing.T) *journal {
+	n := newTestNode(t)
+	j, err := openJournal(JournalConfig{Path: filepath.Join(t.TempDir(), "journal.jsonl")}, n.logger)
+	require.NoError(t, err)
+	t.Cleanup(func() { j.Close() })
+	return j
+}
+
+func journalTestAction(id, stmt string, at time.Time) graph.Action {
+	return graph.Action{ID: id, Identity: "alice", NodeID: "node", Action: stmt, Timestamp: at}
+}
+
+// countingGraph counts the units of work begun on a graph
+type countingGraph struct {
+	Graph
+	begun int
+}
+
+func (g *countingGraph) Begin() (graph.UnitOfWork, error) {
+	g.begun++
+	return g.Graph.Begin()
+}
+
+func TestReplayJournal(t *testing.T) {
+	j := newTestJournal(t)
+	start := time.Now().UTC().Add(-time.Hour)
+
+	// more actions than fit in one batch, with an eviction part way through
+	// a batch and actions which fail to parse or execute
+	require.NoError(t, j.append(journalTestAction("schema", "MERGE (:Schema {label: 'Post', uri: 'string!'})", start)))
+	count := journalReplayBatchSize + 50
+	for i := range count {
+		require.NoError(t, j.append(journalTestAction(fmt.Sprintf("a%04d", i), fmt.Sprintf("MERGE (p:Post {uri: 'ipfs://%d'})", i), start.Add(time.Duration(i)*time.Millisecond))))
+		if i == journalReplayBatchSize+10 {
+			require.NoError(t, j.evict([]string{"a0001", "a0002", fmt.Sprintf("a%04d", i)}))
+		}
+	}
+	require.NoError(t, j.append(journalTestAction("invalid", "MERGE (p:Post {likes: 1})", start)))
+	require.NoError(t, j.append(journalTestAction("unparsed", "MERGE (p:Post", start)))
+	other := journalTestAction("other", "MERGE (p:Post {uri: 'ipfs://other'})", start)
+	other.Namespace = "team"
+	require.NoError(t, j.append(other))
+
+	g, err := graph.New(graph.Config{
+		GraphDatabaseURL: fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()),
+		SchemaValidation: graph.SchemaValidationReject,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { g.Close() })
+
+	counted := &countingGraph{Graph: g}
+	replay, err := ReplayJournal(Config{Journal: j.config}, "", counted)
+	require.NoError(t, err)
+	// a full batch, the batch cut short by the eviction and the rest
+	assert.Equal(t, 3, counted.begun)
+	assert.Equal(t, count+1, replay.Executed)
+	assert.Equal(t, 2, replay.Failed)
+	assert.Equal(t, 3, replay.Evicted)
+
+	posts, err := g.ListNodes(graph.NodeQuery{Label: "Post", Limit: count + 10})
+	require.NoError(t, err)
+	assert.Len(t, posts, count-3)
+	uris := map[any]bool{}
+	for _, p := range posts {
+		uris[p.Attributes["uri"]] = true
+	}
+	assert.False(t, uris["ipfs://1"])
+	assert.False(t, uris["ipfs://other"])
+	assert.True(t, uris["ipfs://0"])
+	assert.True(t, uris[fmt.Sprintf("ipfs://%d", count-1)])
+}
+
+// pageActions reads every action after the cursor a page at a time, as peers
+// do when backfilling
+func pageActions(t *testing.T, since time.Time, after string, page func(since time.Time, after string, limit int) ([]*graph.Action, error)) []string {
+	ids := []string{}
+	for {
+		actions, err := page(since, after, 2)
+		require.NoError(t, err)
+		for _, a := range actions {
+			ids = append(ids, a.ID)
+		}
+		if len(actions) < 2 {
+			return ids
+		}
+		last := actions[len(actions)-1]
+		since, after = last.Timestamp, last.ID
+	}
+}
+
+func TestJournalSince(t *testing.T) {
+	ctx := context.Background()
+	base := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	at := func(i int) time.Time {
+		return base.Add(time.Duration(i) * time.Second)
+	}
+
+	// several actions share a timestamp and some arrive out of order
+	actions := []graph.Action{
+		journalTestAction("c", "MERGE (p:Post {id: 'c'})", at(1)),
+		journalTestAction("a", "MERGE (p:Post {id: 'a'})", at(1)),
+		journalTestAction("d", "MERGE (p:Post {id: 'd'})", at(2)),
+		journalTestAction("b", "MERGE (p:Post {id: 'b'})", at(1)),
+		journalTestAction("f", "MERGE (p:Post {id: 'f'})", at(3)),
+		journalTestAction("e", "MERGE (p:Post {id: 'e'})", at(3)),
+		journalTestAction("g", "MERGE (p:Post {id: 'g'})", at(3)),
+		journalTestAction("z", "MERGE (p:Post {id: 'z'})", at(0)),
+	}
+	evicted := []string{"f"}
+
+	stores := map[string]Store{"memory": newMemoryStore()}
+	sqlite, err := newStore(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()), secrets.Plaintext())
+	require.NoError(t, err)
+	stores["sqlite"] = sqlite
+
+	j := newTestJournal(t)
+	for _, a := range actions {
+		require.NoError(t, j.append(a))
+		for _, s := range stores {
+			require.NoError(t, s.CreateAction(ctx, a))
+		}
+	}
+	require.NoError(t, j.evict(evicted))
+	for _, s := range stores {
+		t.Cleanup(func() { s.Close() })
+		require.NoError(t, s.EvictActions(ctx, evicted))
+	}
+
+	cursors := []struct {
+		name  string
+		since time.Time
+		after string
+		want  []string
+	}{
+		{name: "from the start", want: []string{"z", "a", "b", "c", "d", "e", "g"}},
+		{name: "after a timestamp", since: at(1), want: []string{"d", "e", "g"}},
+		{name: "within a timestamp", since: at(1), after: "a", want: []string{"b", "c", "d", "e", "g"}},
+		{name: "after the last of a timestamp", since: at(1), after: "c", want: []string{"d", "e", "g"}},
+		{name: "past an evicted action", since: at(3), after: "e", want: []string{"g"}},
+		{name: "at the end", since: at(3), after: "g", want: []string{}},
+	}
+
+	check := func(t *testing.T, j *journal) {
+		for _, c := range cursors {
+			t.Run(c.name, func(t *testing.T) {
+				assert.Equal(t, c.want, pageActions(t, c.since, c.after, j.since))
+				for name, s := range stores {
+					page := func(since time.Time, after string, limit int) ([]*graph.Action, error) {
+						return s.GetActionsSince(ctx, since, after, limit)
+					}
+					assert.Equal(t, c.want, pageActions(t, c.since, c.after, page), name)
+				}
+			})
+		}
+	}
+	t.Run("running", func(t *testing.T) {
+		check(t, j)
+	})
+
+	j.applied("a")
+	j.applied("b")
+
+	// reopening rebuilds the positions from the file, ignoring a
+	// partly written entry
+	require.NoError(t, j.Close())
+	f, err := os.OpenFile(j.config.Path, os.O_APPEND|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"append","action":{"id":"h"`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	n := newTestNode(t)
+	j, err = openJournal(j.config, n.logger)
+	require.NoError(t, err)
+	t.Cleanup(func() { j.Close() })
+
+	t.Run("restarted", func(t *testing.T) {
+		check(t, j)
+	})
+
+	unapplied, err := j.unapplied()
+	require.NoError(t, err)
+	ids := []string{}
+	for _, a := range unapplied {
+		ids = append(ids, a.ID)
+	}
+	assert.Equal(t, []string{"z", "c", "d", "e", "g"}, ids)
+
+	// appends carry on after the dropped entry
+	require.NoError(t, j.append(journalTestAction("h", "MERGE (p:Post {id: 'h'})", at(4))))
+	assert.Equal(t, []string{"g", "h"}, pageActions(t, at(3), "e", j.since))
+}
@@ -0,0 +1,160 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const (
+	// KnownPeersReuse reconnects to the peers known before a restart while
+	// the seeds are joined
+	KnownPeersReuse = "reuse"
+	// KnownPeersForget starts from the peers the seeds hand out
+	KnownPeersForget = "forget"
+
+	defaultKnownPeersMaxAge = 24 * time.Hour
+	defaultKnownPeersMax    = 16
+)
+
+// KnownPeersConfig is read from the known_peers section of the config file.
+// The peer table is kept in the node database, and on a restart peers are
+// pinged straight away rather than waiting for the seeds, which speeds up
+// rejoining and means fewer peers need handing out by the seeds. Seeds keep
+// their peer tables as they are.
+type KnownPeersConfig struct {
+	// Policy is reuse (the default) or forget
+	Policy string `mapstructure:"policy"`
+	// MaxAge is how recently a peer must have been seen to be reused
+	MaxAge time.Duration `mapstructure:"max_age"`
+	// Max is the most peers reused, those which missed fewest pings then
+	// were seen most recently first
+	Max int `mapstructure:"max"`
+}
+
+func (c KnownPeersConfig) withDefaults() KnownPeersConfig {
+	if c.Policy == "" {
+		c.Policy = KnownPeersReuse
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultKnownPeersMaxAge
+	}
+	if c.Max == 0 {
+		c.Max = defaultKnownPeersMax
+	}
+	return c
+}
+
+func (c KnownPeersConfig) validate(check *configCheck) {
+	if c.Policy != "" && c.Policy != KnownPeersReuse && c.Policy != KnownPeersForget {
+		check.addf("policy", "%q isn't a policy, use %s or %s", c.Policy, KnownPeersReuse, KnownPeersForget)
+	}
+	nonNegative(check, "max_age", c.MaxAge)
+	nonNegative(check, "max", c.Max)
+}
+
+// reuseKnownPeers applies the known peers policy to the peer table left by
+// the last run, read before joining the seeds, and pings the peers kept,
+// dropping those which don't answer. It runs alongside joining the seeds, so
+// peers they hand out again aren't dropped.
+func (n *node) reuseKnownPeers(ctx context.Context, peers []*model.PeerSpec) {
+	if len(peers) == 0 {
+		return
+	}
+
+	started := time.Now().UTC()
+	keep := n.knownPeers.keep(peers, started)
+	for _, p := range peers {
+		if !slices.Contains(keep, p) {
+			n.dropKnownPeer(ctx, p.RemoteAddr, started)
+		}
+	}
+
+	var reached atomic.Int32
+	wg := sync.WaitGroup{}
+	for _, peer := range keep {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := n.tryPeerAddresses(ctx, peer, func(addr string) error {
+				return n.sendPing(ctx, addr)
+			})
+			if err != nil {
+				n.logger.Debug("reaching known peer", "error", err, "remote", peer.RemoteAddr)
+				n.dropKnownPeer(ctx, peer.RemoteAddr, started)
+				return
+			}
+
+			reached.Add(1)
+			err = n.store.TouchPeer(ctx, peer.RemoteAddr, "")
+			if err != nil {
+				n.logger.Error("touching peer", "error", err, "remote", peer.RemoteAddr)
+			}
+		}()
+	}
+	wg.Wait()
+
+	n.logger.Info("reused known peers", "reached", reached.Load(), "tried", len(keep), "known", len(peers))
+	if reached.Load() == 0 {
+		return
+	}
+
+	// actions published while the node was down can go out before the seeds
+	// answer
+	err := n.flushOutbox(ctx)
+	if err != nil {
+		n.logger.Error("flushing outbox", "error", err)
+	}
+}
+
+// keep returns the peers the policy reuses, in the order they should be tried
+func (c KnownPeersConfig) keep(peers []*model.PeerSpec, now time.Time) []*model.PeerSpec {
+	if c.Policy == KnownPeersForget {
+		return nil
+	}
+
+	fresh := []*model.PeerSpec{}
+	for _, p := range peers {
+		if now.Sub(p.SeenAt()) <= c.MaxAge {
+			fresh = append(fresh, p)
+		}
+	}
+	slices.SortStableFunc(fresh, func(a, b *model.PeerSpec) int {
+		return cmp.Or(cmp.Compare(a.MissedPings, b.MissedPings), b.SeenAt().Compare(a.SeenAt()))
+	})
+	return fresh[:min(len(fresh), c.Max)]
+}
+
+// dropKnownPeer deletes a peer from the last run which isn't being reused,
+// unless it has been seen since the node started
+func (n *node) dropKnownPeer(ctx context.Context, remoteAddr string, started time.Time) {
+	deleted, err := n.store.DeletePeerSeenBefore(ctx, remoteAddr, started)
+	if err != nil {
+		n.logger.Error("deleting known peer", "error", err, "remote", remoteAddr)
+		return
+	}
+	if deleted {
+		n.forgetPeer(remoteAddr)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+)
+
+const (
+	defaultMaxStatementLength = 16 * 1024
+	defaultMaxDepth           = 4
+	defaultMaxEntities        = 8
+	defaultMaxLabels          = 16
+	defaultMaxAttributes      = 64
+)
+
+var ErrStatementLimit = errors.New("statement exceeds limits")
+
+// StatementLimits is read from the limits section of the config file. Zero
+// values use the defaults.
+type StatementLimits struct {
+	// MaxLength is the longest statement, in bytes, which will be parsed
+	MaxLength int `mapstructure:"max_length"`
+	// MaxDepth is how deeply entities can be nested, a relation between two
+	// nodes has a depth of 2
+	MaxDepth int `mapstructure:"max_depth"`
+	// MaxEntities is the number of nodes and relations in a statement
+	MaxEntities int `mapstructure:"max_entities"`
+	// MaxLabels is the total number of labels across all entities
+	MaxLabels int `mapstructure:"max_labels"`
+	// MaxAttributes is the total number of attributes across all entities
+	MaxAttributes int `mapstructure:"max_attributes"`
+}
+
+func (l StatementLimits) withDefaults() StatementLimits {
+	if l.MaxLength == 0 {
+		l.MaxLength = defaultMaxStatementLength
+	}
+	if l.MaxDepth == 0 {
+		l.MaxDepth = defaultMaxDepth
+	}
+	if l.MaxEntities == 0 {
+		l.MaxEntities = defaultMaxEntities
+	}
+	if l.MaxLabels == 0 {
+		l.MaxLabels = defaultMaxLabels
+	}
+	if l.MaxAttributes == 0 {
+		l.MaxAttributes = defaultMaxAttributes
+	}
+	return l
+}
+
+func (l StatementLimits) validate(check *configCheck) {
+	nonNegative(check, "max_length", l.MaxLength)
+	nonNegative(check, "max_depth", l.MaxDepth)
+	nonNegative(check, "max_entities", l.MaxEntities)
+	nonNegative(check, "max_labels", l.MaxLabels)
+	nonNegative(check, "max_attributes", l.MaxAttributes)
+}
+
+// parseStatement checks the statement against the limits before and after
+// parsing it so oversized statements never reach the executor. Violations
+// wrap ErrStatementLimit, anything else is a syntax error.
+func (l StatementLimits) parseStatement(stmt string) (ast.Command, error) {
+	if len(stmt) > l.MaxLength {
+		return nil, fmt.Errorf("length %d is over %d: %w", len(stmt), l.MaxLength, ErrStatementLimit)
+	}
+
+	parser, err := ast.Parse(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := parser.Command()
+	c := ast.Measure(cmd)
+	switch {
+	case c.Depth > l.MaxDepth:
+		return nil, fmt.Errorf("depth %d is over %d: %w", c.Depth, l.MaxDepth, ErrStatementLimit)
+	case c.Entities > l.MaxEntities:
+		return nil, fmt.Errorf("%d entities is over %d: %w", c.Entities, l.MaxEntities, ErrStatementLimit)
+	case c.Labels > l.MaxLabels:
+		return nil, fmt.Errorf("%d labels is over %d: %w", c.Labels, l.MaxLabels, ErrStatementLimit)
+	case c.Attributes > l.MaxAttributes:
+		return nil, fmt.Errorf("%d attributes is over %d: %w", c.Attributes, l.MaxAttributes, ErrStatementLimit)
+	}
+
+	return cmd, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	defaultPingInterval   = time.Minute
+	defaultPingJitter     = 0.2
+	defaultMaxMissedPings = 3
+	defaultJoinBackoff    = time.Second
+	defaultMaxJoinBackoff = time.Minute
+)
+
+// LivenessConfig is read from the liveness section of the config file. Zero
+// values use the defaults.
+type LivenessConfig struct {
+	// PingInterval is how often peers ping their neighbours and rejoin their
+	// seeds, and how often seeds check for peers which have gone quiet
+	PingInterval time.Duration `mapstructure:"ping_interval"`
+	// Jitter is the fraction of the interval each tick is randomly moved by so
+	// that nodes started together don't stay in step
+	Jitter float64 `mapstructure:"jitter"`
+	// MaxMissedPings is how many pings in a row a peer can miss before it is
+	// dropped
+	MaxMissedPings int `mapstructure:"max_missed_pings"`
+	// JoinBackoff is how long a node which can't reach any seed at startup
+	// waits before trying again, doubling with each attempt up to
+	// MaxJoinBackoff
+	JoinBackoff    time.Duration `mapstructure:"join_backoff"`
+	MaxJoinBackoff time.Duration `mapstructure:"max_join_backoff"`
+}
+
+func (c LivenessConfig) withDefaults() LivenessConfig {
+	if c.PingInterval == 0 {
+		c.PingInterval = defaultPingInterval
+	}
+	if c.Jitter == 0 {
+		c.Jitter = defaultPingJitter
+	}
+	c.Jitter = min(max(c.Jitter, 0), 1)
+	if c.MaxMissedPings == 0 {
+		c.MaxMissedPings = defaultMaxMissedPings
+	}
+	if c.JoinBackoff == 0 {
+		c.JoinBackoff = defaultJoinBackoff
+	}
+	if c.MaxJoinBackoff == 0 {
+		c.MaxJoinBackoff = defaultMaxJoinBackoff
+	}
+	c.MaxJoinBackoff = max(c.MaxJoinBackoff, c.JoinBackoff)
+	return c
+}
+
+func (c LivenessConfig) validate(check *configCheck) {
+	nonNegative(check, "ping_interval", c.PingInterval)
+	if c.Jitter < 0 || c.Jitter > 1 {
+		check.addf("jitter", "must be between 0 and 1, got %v", c.Jitter)
+	}
+	nonNegative(check, "max_missed_pings", c.MaxMissedPings)
+	nonNegative(check, "join_backoff", c.JoinBackoff)
+	nonNegative(check, "max_join_backoff", c.MaxJoinBackoff)
+}
+
+// nextPing returns the time until the next ping, the interval moved randomly
+// by up to the jitter either way
+func (c LivenessConfig) nextPing() time.Duration {
+	spread := float64(c.PingInterval) * c.Jitter
+	return c.PingInterval + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+// nextJoin returns the time until the join after the given failed attempt,
+// starting at 1, jittered in the same way as pings
+func (c LivenessConfig) nextJoin(attempt int) time.Duration {
+	backoff := c.JoinBackoff
+	for i := 1; i < attempt && backoff < c.MaxJoinBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, c.MaxJoinBackoff)
+	spread := float64(backoff) * c.Jitter
+	return backoff + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+// tidyPeers counts a missed ping against every peer which hasn't been seen
+// since the last check and drops those which have missed too many
+func (n *node) tidyPeers(ctx context.Context) error {
+	before := time.Now().UTC().Add(-n.liveness.PingInterval)
+	err := n.store.MissPeers(ctx, before)
+	if err != nil {
+		return fmt.Errorf("counting missed pings: %w", err)
+	}
+
+	dropped, err := n.store.DeleteMissingPeers(ctx, n.liveness.MaxMissedPings)
+	if err != nil {
+		return fmt.Errorf("deleting peers: %w", err)
+	}
+
+	for _, addr := range dropped {
+		n.forgetPeer(addr)
+		n.events.Publish(PeerDropped{
+			At:         time.Now().UTC(),
+			RemoteAddr: addr,
+			Reason:     "missed pings",
+		})
+	}
+
+	return nil
+}
+
+// missedPing records a failed ping to a neighbour, dropping it once it has
+// missed too many
+func (n *node) missedPing(ctx context.Context, remoteAddr string) {
+	missed, err := n.store.MissPeer(ctx, remoteAddr)
+	if err != nil {
+		n.logger.Error("counting missed ping", "error", err, "remote", remoteAddr)
+		return
+	}
+
+	if missed >= n.liveness.MaxMissedPings {
+		n.dropPeer(ctx, remoteAddr, "ping failed")
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+const (
+	// ManifestVersionLegacy actions were sent with their metadata in headers
+	// and only the action ID and statement are signed
+	ManifestVersionLegacy = 0
+	// ManifestVersionSigned actions are signed over the canonical manifest so
+	// the identity, origin node and key ID can't be swapped in transit
+	ManifestVersionSigned = 1
+	// ManifestVersionTimestamped adds the time the action was created to the
+	// signed fields
+	ManifestVersionTimestamped = 2
+	// ManifestVersionCanonical actions are signed over the canonical form of
+	// their statement, so reformatting one doesn't change what was signed,
+	// and over the TTL they were published with, which every hop sends on
+	// unchanged
+	ManifestVersionCanonical = 3
+	// ManifestVersionNamespaced adds the namespace the action belongs to to
+	// the signed fields so it can't be replayed into another one
+	ManifestVersionNamespaced = 4
+	// ManifestVersion is the version new actions are made with
+	ManifestVersion = ManifestVersionNamespaced
+
+	// defaultMinManifestVersion is the oldest version accepted unless
+	// configured otherwise. Earlier versions don't sign the TTL, which lets
+	// any hop extend an action's life.
+	defaultMinManifestVersion = ManifestVersionCanonical
+)
+
+var (
+	ErrBadManifest = errors.New("bad action manifest")
+	// ErrManifestVersion is returned for manifests older than the node
+	// accepts
+	ErrManifestVersion = errors.New("manifest version not accepted")
+)
+
+// ActionManifest is the body of a publish request. The signature covers the
+// fields returned by SigningPayload, the rest are updated at each hop.
+type ActionManifest struct {
+	Version   int    `json:"version"`
+	ID        string `json:"id"`
+	Identity  string `json:"identity"`
+	NodeID    string `json:"nodeId"`
+	KeyID     string `json:"keyId,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Statement string `json:"statement"`
+	Signature string `json:"signature"`
+	// Delegation is the token of an identity's delegation to the key which
+	// signed the action, if it wasn't the identity's own. It is signed by the
+	// identity so isn't covered by the action's signature.
+	Delegation string `json:"delegation,omitempty"`
+
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+
+	ReceivedBy string `json:"receivedBy,omitempty"`
+	// ReceivedAt is when the sending node received the action, if it tags
+	// actions with receive times
+	ReceivedAt *time.Time `json:"receivedAt,omitempty"`
+	TTL        int        `json:"ttl,omitempty"`
+	// EntityIDs and Topics are derived from the statement, topics only for
+	// public actions. They aren't signed, so nodes which can read the
+	// statement derive their own and only private actions they can't read
+	// are routed on the sender's.
+	EntityIDs []string `json:"entityIds,omitempty"`
+	Topics    []string `json:"topics,omitempty"`
+}
+
+// signedManifest is the canonical form of the signed fields. Field order is
+// fixed by the struct so the encoding is the same wherever it is made.
+type signedManifest struct {
+	Version   int    `json:"v"`
+	ID        string `json:"id"`
+	Identity  string `json:"identity"`
+	NodeID    string `json:"nodeId"`
+	KeyID     string `json:"keyId"`
+	Statement string `json:"statement"`
+	CreatedAt string `json:"createdAt,omitempty"`
+	TTL       int    `json:"ttl,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// SigningPayload returns the bytes the manifest's signature is made over
+func (m *ActionManifest) SigningPayload() ([]byte, error) {
+	switch m.Version {
+	case ManifestVersionLegacy:
+		return []byte(m.ID + m.Statement), nil
+	case ManifestVersionSigned, ManifestVersionTimestamped, ManifestVersionCanonical, ManifestVersionNamespaced:
+		signed := &signedManifest{
+			Version:   m.Version,
+			ID:        m.ID,
+			Identity:  m.Identity,
+			NodeID:    m.NodeID,
+			KeyID:     m.KeyID,
+			Statement: m.Statement,
+		}
+		if m.Version >= ManifestVersionTimestamped {
+			if m.CreatedAt == nil {
+				return nil, fmt.Errorf("missing created at: %w", ErrBadManifest)
+			}
+			signed.CreatedAt = m.CreatedAt.UTC().Format(time.RFC3339Nano)
+		}
+		if m.Version >= ManifestVersionCanonical {
+			stmt, err := canonicalStatement(m.Statement, m.KeyID)
+			if err != nil {
+				return nil, err
+			}
+			signed.Statement = stmt
+			signed.TTL = m.TTL
+		}
+		if m.Version >= ManifestVersionNamespaced {
+			signed.Namespace = m.Namespace
+		}
+		return json.Marshal(signed)
+	default:
+		return nil, fmt.Errorf("unsupported version %d: %w", m.Version, ErrBadManifest)
+	}
+}
+
+// canonicalStatement returns the form of a statement which is signed. Private
+// statements are sealed before they are signed so their ciphertext is used
+// as it is.
+func canonicalStatement(stmt, keyID string) (string, error) {
+	if keyID != "" {
+		return stmt, nil
+	}
+
+	parser, err := ast.Parse(stmt)
+	if err != nil || parser.Command() == nil {
+		return "", fmt.Errorf("unparseable statement: %w", ErrBadManifest)
+	}
+	return ast.Format(parser.Command()), nil
+}
+
+func (m *ActionManifest) validate() error {
+	if m.ID == "" || m.Identity == "" || m.Signature == "" {
+		return fmt.Errorf("missing fields: %w", ErrBadManifest)
+	}
+	if m.TTL < 0 {
+		return fmt.Errorf("invalid ttl: %w", ErrBadManifest)
+	}
+	if m.Version >= ManifestVersionTimestamped && m.CreatedAt == nil {
+		return fmt.Errorf("missing created at: %w", ErrBadManifest)
+	}
+	if m.Version < ManifestVersionNamespaced && m.Namespace != "" {
+		return fmt.Errorf("unsigned namespace: %w", ErrBadManifest)
+	}
+	return nil
+}
+
+// manifestFor builds the manifest used to sign or send an action. Before
+// ManifestVersionCanonical the TTL is left for the caller as it depends on
+// when the action is sent.
+func manifestFor(action *graph.Action) *ActionManifest {
+	return &ActionManifest{
+		Version:    action.ManifestVersion,
+		ID:         action.ID,
+		Identity:   actionIdentity(action),
+		NodeID:     action.NodeID,
+		KeyID:      action.KeyID,
+		Namespace:  action.Namespace,
+		Statement:  action.Action,
+		Signature:  action.EncodedSignature,
+		Delegation: action.Delegation,
+		CreatedAt:  action.CreatedAt,
+		TTL:        action.TTL,
+		ReceivedBy: action.ReceivedBy,
+		EntityIDs:  action.EntityIDs,
+		Topics:     action.Topics,
+	}
+}
+
+// actionFromManifest returns the action described by a received manifest
+func actionFromManifest(m *ActionManifest, remoteAddr string, receivedAt time.Time) graph.Action {
+	return graph.Action{
+		ID:               m.ID,
+		RemoteAddr:       remoteAddr,
+		NodeID:           m.NodeID,
+		Identity:         m.Identity,
+		Timestamp:        receivedAt,
+		Action:           m.Statement,
+		ReceivedBy:       m.ReceivedBy,
+		EncodedSignature: m.Signature,
+		Delegation:       m.Delegation,
+		KeyID:            m.KeyID,
+		Namespace:        m.Namespace,
+		EntityIDs:        m.EntityIDs,
+		Topics:           m.Topics,
+		ManifestVersion:  m.Version,
+		CreatedAt:        m.CreatedAt,
+		TTL:              signedTTL(m),
+	}
+}
+
+// signedTTL returns the TTL a manifest was signed with. Earlier versions
+// send the time left at each hop instead, which isn't kept.
+func signedTTL(m *ActionManifest) int {
+	if m.Version < ManifestVersionCanonical {
+		return 0
+	}
+	return m.TTL
+}
+
+// hopInfo is the per-hop metadata sent with an action, which isn't stored
+type hopInfo struct {
+	// TTL is what is left of the TTL the action was signed with, empty if it
+	// wasn't signed with one
+	TTL string
+	// ReceivedAt is when the sending node received the action, nil if it
+	// doesn't tag actions with receive times
+	ReceivedAt *time.Time
+}
+
+// readAction reads a publish request's manifest. Older nodes sent actions
+// with their metadata in headers, which nothing signed, and are no longer
+// accepted.
+func readAction(req *http.Request, body []byte) (graph.Action, hopInfo, error) {
+	now := time.Now().UTC()
+
+	if req.Header.Get(HeaderContentType) != ContentTypeAction {
+		return graph.Action{RemoteAddr: req.RemoteAddr, Timestamp: now}, hopInfo{}, fmt.Errorf("not a manifest: %w", ErrBadManifest)
+	}
+
+	m := &ActionManifest{}
+	err := json.Unmarshal(body, m)
+	if err != nil {
+		return graph.Action{RemoteAddr: req.RemoteAddr, Timestamp: now}, hopInfo{}, fmt.Errorf("decoding manifest: %w", ErrBadManifest)
+	}
+
+	action := actionFromManifest(m, req.RemoteAddr, now)
+	err = m.validate()
+	if err != nil {
+		return action, hopInfo{}, err
+	}
+
+	// the signed TTL runs from when the action was created, an expired
+	// action is left with a TTL of zero or less which is rejected. Earlier
+	// versions don't sign the TTL so any hop could change it, and the
+	// node's own action TTL is used instead.
+	hop := hopInfo{ReceivedAt: m.ReceivedAt}
+	if m.TTL > 0 && m.Version >= ManifestVersionCanonical {
+		left := m.CreatedAt.Add(time.Duration(m.TTL) * time.Second).Sub(now)
+		hop.TTL = strconv.Itoa(int(left.Seconds()))
+	}
+
+	return action, hop, nil
+}
+
+// checkManifestVersion rejects actions made with a manifest version older
+// than the node accepts
+func (n *node) checkManifestVersion(action *graph.Action) error {
+	if action.ManifestVersion < n.minManifestVersion {
+		return fmt.Errorf("version %d, need %d: %w", action.ManifestVersion, n.minManifestVersion, ErrManifestVersion)
+	}
+	return nil
+}
+
+// actionIdentity returns the identity which signed the action. Actions made
+// locally only carry the certificate.
+func actionIdentity(action *graph.Action) string {
+	if action.Identity == "" && action.Certificate != nil {
+		return action.Certificate.Subject.CommonName
+	}
+	return action.Identity
+}
@@ -0,0 +1,64 @@
+package node
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadActionTTL(t *testing.T) {
+	createdAt := time.Now().UTC().Add(-time.Minute)
+
+	tests := map[string]struct {
+		version int
+		ttl     int
+		// expected is the TTL left in seconds, 0 for none
+		expected int
+	}{
+		"signed":     {version: ManifestVersion, ttl: 3600, expected: 3540},
+		"expired":    {version: ManifestVersion, ttl: 30, expected: -30},
+		"none":       {version: ManifestVersion},
+		"not signed": {version: ManifestVersionTimestamped, ttl: 3600},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(&ActionManifest{
+				Version:   tt.version,
+				ID:        "a1",
+				Identity:  "id1",
+				Statement: "MERGE (:Post{text:'hi'})",
+				Signature: "sig",
+				CreatedAt: &createdAt,
+				TTL:       tt.ttl,
+			})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest("POST", "/publish", strings.NewReader(string(data)))
+			req.Header.Set(HeaderContentType, ContentTypeAction)
+			_, hop, err := readAction(req, data)
+			require.NoError(t, err)
+			if tt.expected == 0 {
+				assert.Empty(t, hop.TTL)
+				return
+			}
+			left, err := strconv.Atoi(hop.TTL)
+			require.NoError(t, err)
+			assert.InDelta(t, tt.expected, left, 1)
+		})
+	}
+}
+
+func TestReadActionHeaders(t *testing.T) {
+	// metadata in headers isn't signed so isn't read
+	req := httptest.NewRequest("POST", "/publish", strings.NewReader("MERGE (:Post{text:'hi'})"))
+	req.Header.Set(HeaderEntityIDs, "ann")
+	_, _, err := readAction(req, []byte("MERGE (:Post{text:'hi'})"))
+	assert.ErrorIs(t, err, ErrBadManifest)
+}
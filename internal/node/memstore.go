@@ -0,0 +1,1058 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+// memoryStore is a Store which keeps everything in maps, for tests of
+// node logic which don't want a database. It follows the SQLite store's
+// rules for which columns each write changes, and returns copies so callers
+// can't change what is stored.
+type memoryStore struct {
+	mu              sync.Mutex
+	seeds           []*model.SeedSpec
+	peers           map[string]*model.PeerSpec
+	tombstones      map[string]time.Time
+	nodeKey         ed25519.PrivateKey
+	certificates    map[string]*memoryCertificate
+	identityRecords map[string]*x509.Certificate
+	handles         []*model.HandleClaim
+	actions         map[string]*memoryAction
+	digests         map[int64]struct{}
+	outbox          map[string]*memoryQueued
+	blocks          map[string]*model.BlockSpec
+}
+
+// memoryCertificate is a row of the certificate cache
+type memoryCertificate struct {
+	certificate *x509.Certificate
+	previous    *x509.Certificate
+	rotatedAt   *time.Time
+	revokedAt   *time.Time
+}
+
+// memoryAction is a stored action and when its content was evicted
+type memoryAction struct {
+	action    graph.Action
+	evictedAt *time.Time
+}
+
+// memoryQueued is an action waiting in the outbox
+type memoryQueued struct {
+	queuedAt  time.Time
+	entityIDs []string
+	topics    []string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		peers:           map[string]*model.PeerSpec{},
+		tombstones:      map[string]time.Time{},
+		certificates:    map[string]*memoryCertificate{},
+		identityRecords: map[string]*x509.Certificate{},
+		actions:         map[string]*memoryAction{},
+		digests:         map[int64]struct{}{},
+		outbox:          map[string]*memoryQueued{},
+		blocks:          map[string]*model.BlockSpec{},
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// limited returns at most limit items, all of them for a negative limit as
+// with SQL
+func limited[T any](items []T, limit int) []T {
+	if limit >= 0 && len(items) > limit {
+		return items[:limit]
+	}
+	return items
+}
+
+// actionAfter returns true if an action received at timestamp with id comes
+// after the point given by since and after in GetActionsSince's order
+func actionAfter(timestamp time.Time, id string, since time.Time, after string) bool {
+	return timestamp.After(since) || (after != "" && timestamp.Equal(since) && id > after)
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	return timePtr(*t)
+}
+
+func copyPeer(p *model.PeerSpec) *model.PeerSpec {
+	c := *p
+	c.UpdatedAt = copyTime(p.UpdatedAt)
+	c.Addresses = slices.Clone(p.Addresses)
+	return &c
+}
+
+// peersWhere returns copies of the peers match accepts, least recently seen
+// first or, with newestFirst, most recently seen first
+func (s *memoryStore) peersWhere(match func(p *model.PeerSpec) bool, newestFirst bool) []*model.PeerSpec {
+	peers := []*model.PeerSpec{}
+	for _, p := range s.peers {
+		if match(p) {
+			peers = append(peers, copyPeer(p))
+		}
+	}
+	slices.SortFunc(peers, func(a, b *model.PeerSpec) int {
+		c := a.SeenAt().Compare(b.SeenAt())
+		if newestFirst {
+			c = -c
+		}
+		return cmp.Or(c, cmp.Compare(a.RemoteAddr, b.RemoteAddr))
+	})
+	return peers
+}
+
+func (s *memoryStore) UpsertSeeds(ctx context.Context, seeds []*model.SeedSpec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replaced := make([]*model.SeedSpec, 0, len(seeds))
+	seen := map[string]struct{}{}
+	for _, seed := range seeds {
+		if _, ok := seen[seed.RemoteAddr]; ok {
+			return fmt.Errorf("saving seeds (insert): %s: %w", seed.RemoteAddr, model.ErrAlreadyExists)
+		}
+		seen[seed.RemoteAddr] = struct{}{}
+		replaced = append(replaced, &model.SeedSpec{CreatedAt: seed.CreatedAt, RemoteAddr: seed.RemoteAddr, NodeID: seed.NodeID})
+	}
+	s.seeds = replaced
+	return nil
+}
+
+func (s *memoryStore) AddSeeds(ctx context.Context, seeds []*model.SeedSpec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seed := range seeds {
+		i := slices.IndexFunc(s.seeds, func(known *model.SeedSpec) bool { return known.RemoteAddr == seed.RemoteAddr })
+		if i >= 0 {
+			s.seeds[i].NodeID = seed.NodeID
+			continue
+		}
+		s.seeds = append(s.seeds, &model.SeedSpec{CreatedAt: seed.CreatedAt, RemoteAddr: seed.RemoteAddr, NodeID: seed.NodeID})
+	}
+	return nil
+}
+
+func (s *memoryStore) GetSeeds(ctx context.Context) ([]*model.SeedSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seeds := make([]*model.SeedSpec, 0, len(s.seeds))
+	for _, seed := range s.seeds {
+		c := *seed
+		c.UpdatedAt = copyTime(seed.UpdatedAt)
+		seeds = append(seeds, &c)
+	}
+	return seeds, nil
+}
+
+func (s *memoryStore) TouchSeed(ctx context.Context, remoteAddr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seed := range s.seeds {
+		if seed.RemoteAddr == remoteAddr {
+			seed.UpdatedAt = timePtr(time.Now().UTC())
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetAllPeers(ctx context.Context) ([]*model.PeerSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peersWhere(func(p *model.PeerSpec) bool { return true }, false), nil
+}
+
+func (s *memoryStore) GetPeer(ctx context.Context, remoteAddr string) (*model.PeerSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[remoteAddr]
+	if !ok {
+		return nil, nil
+	}
+	return copyPeer(p), nil
+}
+
+func (s *memoryStore) GetRandomPeers(ctx context.Context, excluding string, maxPeers int) ([]*model.PeerSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := s.peersWhere(func(p *model.PeerSpec) bool { return p.RemoteAddr != excluding }, true)
+	return limited(peers, maxPeers), nil
+}
+
+func (s *memoryStore) GetCaches(ctx context.Context, excluding string) ([]*model.PeerSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.peersWhere(func(p *model.PeerSpec) bool {
+		return p.NodeType == NodeTypeCache.String() && p.RemoteAddr != excluding
+	}, true), nil
+}
+
+func (s *memoryStore) GetGroupMembers(ctx context.Context, group string, max int) ([]*model.PeerSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := s.peersWhere(func(p *model.PeerSpec) bool {
+		return p.NodeType == NodeTypeCache.String() && p.Group == group
+	}, true)
+	return limited(peers, max), nil
+}
+
+func (s *memoryStore) GetPeersByNodeKey(ctx context.Context, key string) ([]*model.PeerSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peersWhere(func(p *model.PeerSpec) bool { return p.NodeKey == key }, false), nil
+}
+
+func (s *memoryStore) CountOfPeers(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.peers), nil
+}
+
+func (s *memoryStore) CountPeersBySoftwareVersion(ctx context.Context) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := map[string]int{}
+	for _, p := range s.peers {
+		if p.SoftwareVersion != "" {
+			counts[p.SoftwareVersion]++
+		}
+	}
+	return counts, nil
+}
+
+// keepNodeKey returns the key already bound to a peer, or key if there isn't
+// one
+func keepNodeKey(known, key string) string {
+	if known != "" {
+		return known
+	}
+	return key
+}
+
+func (s *memoryStore) UpsertPeer(ctx context.Context, peer model.PeerSpec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if peer.NodeType == "" {
+		peer.NodeType = NodeTypePeer.String()
+	}
+
+	known, ok := s.peers[peer.RemoteAddr]
+	if !ok {
+		s.peers[peer.RemoteAddr] = &model.PeerSpec{
+			RemoteAddr:      peer.RemoteAddr,
+			CreatedAt:       peer.CreatedAt,
+			NodeID:          peer.NodeID,
+			Filter:          peer.Filter,
+			Addresses:       slices.Clone(peer.Addresses),
+			NodeType:        peer.NodeType,
+			Group:           peer.Group,
+			NodeKey:         peer.NodeKey,
+			Protocol:        peer.Protocol,
+			Features:        peer.Features,
+			SoftwareVersion: peer.SoftwareVersion,
+		}
+		return nil
+	}
+
+	known.UpdatedAt = timePtr(time.Now().UTC())
+	known.Addresses = slices.Clone(peer.Addresses)
+	known.NodeType = peer.NodeType
+	known.Group = peer.Group
+	known.MissedPings = 0
+	known.NodeKey = keepNodeKey(known.NodeKey, peer.NodeKey)
+	known.Protocol = peer.Protocol
+	known.Features = peer.Features
+	known.SoftwareVersion = peer.SoftwareVersion
+	return nil
+}
+
+func (s *memoryStore) UpsertPeers(ctx context.Context, peers []*model.PeerSpec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, p := range peers {
+		p.UpdatedAt = &now
+		if p.NodeType == "" {
+			p.NodeType = NodeTypePeer.String()
+		}
+
+		known, ok := s.peers[p.RemoteAddr]
+		if !ok {
+			s.peers[p.RemoteAddr] = &model.PeerSpec{
+				RemoteAddr:      p.RemoteAddr,
+				CreatedAt:       p.CreatedAt,
+				NodeID:          p.NodeID,
+				Filter:          p.Filter,
+				Addresses:       slices.Clone(p.Addresses),
+				NodeType:        p.NodeType,
+				Group:           p.Group,
+				NodeKey:         p.NodeKey,
+				Source:          p.Source,
+				Protocol:        p.Protocol,
+				Features:        p.Features,
+				SoftwareVersion: p.SoftwareVersion,
+			}
+			continue
+		}
+
+		known.UpdatedAt = timePtr(now)
+		known.Addresses = slices.Clone(p.Addresses)
+		known.NodeType = p.NodeType
+		known.Group = p.Group
+		known.MissedPings = 0
+		known.NodeKey = keepNodeKey(known.NodeKey, p.NodeKey)
+	}
+	return nil
+}
+
+func (s *memoryStore) TouchPeer(ctx context.Context, remoteAddr, subsFilter string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[remoteAddr]
+	if !ok {
+		return nil
+	}
+	p.UpdatedAt = timePtr(time.Now().UTC())
+	p.MissedPings = 0
+	if subsFilter != "" {
+		p.Filter = subsFilter
+	}
+	return nil
+}
+
+func (s *memoryStore) SetPeerNodeKey(ctx context.Context, remoteAddr, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.peers[remoteAddr]; ok && p.NodeKey == "" {
+		p.NodeKey = key
+	}
+	return nil
+}
+
+func (s *memoryStore) SetPeerProtocol(ctx context.Context, remoteAddr string, version int, features, software string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.peers[remoteAddr]; ok {
+		p.Protocol = version
+		p.Features = features
+		p.SoftwareVersion = software
+	}
+	return nil
+}
+
+func (s *memoryStore) SetPreferredAddress(ctx context.Context, remoteAddr, addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.peers[remoteAddr]; ok {
+		p.PreferredAddr = addr
+	}
+	return nil
+}
+
+func (s *memoryStore) DeletePeer(ctx context.Context, peer string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, peer)
+	return nil
+}
+
+func (s *memoryStore) DeletePeerSeenBefore(ctx context.Context, remoteAddr string, before time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[remoteAddr]
+	if !ok || !p.SeenAt().Before(before) {
+		return false, nil
+	}
+	delete(s.peers, remoteAddr)
+	return true, nil
+}
+
+func (s *memoryStore) MissPeers(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.peers {
+		if p.SeenAt().Before(before) {
+			p.MissedPings++
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) MissPeer(ctx context.Context, remoteAddr string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[remoteAddr]
+	if !ok {
+		return 0, nil
+	}
+	p.MissedPings++
+	return p.MissedPings, nil
+}
+
+func (s *memoryStore) DeleteMissingPeers(ctx context.Context, maxMissed int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := []string{}
+	for addr, p := range s.peers {
+		if p.MissedPings >= maxMissed {
+			addrs = append(addrs, addr)
+			delete(s.peers, addr)
+		}
+	}
+	slices.Sort(addrs)
+	return addrs, nil
+}
+
+func (s *memoryStore) GetPeersChangedSince(ctx context.Context, since time.Time, after string, max int) ([]*model.PeerSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// peers page in the same way as actions, by address within a timestamp
+	peers := s.peersWhere(func(p *model.PeerSpec) bool { return actionAfter(p.SeenAt(), p.RemoteAddr, since, after) }, false)
+	return limited(peers, max), nil
+}
+
+func (s *memoryStore) MergeReplicatedPeers(ctx context.Context, peers []*model.PeerSpec, deleted []*model.PeerTombstone) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range deleted {
+		if p, ok := s.peers[d.RemoteAddr]; ok && p.SeenAt().Before(d.DeletedAt) {
+			delete(s.peers, d.RemoteAddr)
+		}
+		if at, ok := s.tombstones[d.RemoteAddr]; !ok || d.DeletedAt.After(at) {
+			s.tombstones[d.RemoteAddr] = d.DeletedAt
+		}
+	}
+
+	for _, p := range peers {
+		if p.NodeType == "" {
+			p.NodeType = NodeTypePeer.String()
+		}
+		if at, ok := s.tombstones[p.RemoteAddr]; ok && !at.Before(p.SeenAt()) {
+			continue
+		}
+
+		known, ok := s.peers[p.RemoteAddr]
+		if !ok {
+			s.peers[p.RemoteAddr] = &model.PeerSpec{
+				RemoteAddr:      p.RemoteAddr,
+				CreatedAt:       p.CreatedAt,
+				UpdatedAt:       copyTime(p.UpdatedAt),
+				NodeID:          p.NodeID,
+				Filter:          p.Filter,
+				Addresses:       slices.Clone(p.Addresses),
+				NodeType:        p.NodeType,
+				Group:           p.Group,
+				NodeKey:         p.NodeKey,
+				Protocol:        p.Protocol,
+				Features:        p.Features,
+				SoftwareVersion: p.SoftwareVersion,
+			}
+			continue
+		}
+		if !p.SeenAt().After(known.SeenAt()) {
+			continue
+		}
+
+		known.UpdatedAt = copyTime(p.UpdatedAt)
+		known.NodeID = p.NodeID
+		known.Filter = p.Filter
+		known.Addresses = slices.Clone(p.Addresses)
+		known.NodeType = p.NodeType
+		known.Group = p.Group
+		known.MissedPings = 0
+		known.NodeKey = keepNodeKey(known.NodeKey, p.NodeKey)
+		known.Protocol = p.Protocol
+		known.Features = p.Features
+		known.SoftwareVersion = p.SoftwareVersion
+	}
+	return nil
+}
+
+func (s *memoryStore) AddPeerTombstone(ctx context.Context, remoteAddr string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tombstones[remoteAddr] = at
+	return nil
+}
+
+func (s *memoryStore) GetPeerTombstones(ctx context.Context, since time.Time) ([]*model.PeerTombstone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := []*model.PeerTombstone{}
+	for addr, at := range s.tombstones {
+		if at.After(since) {
+			deleted = append(deleted, &model.PeerTombstone{RemoteAddr: addr, DeletedAt: at})
+		}
+	}
+	slices.SortFunc(deleted, func(a, b *model.PeerTombstone) int {
+		return cmp.Or(a.DeletedAt.Compare(b.DeletedAt), cmp.Compare(a.RemoteAddr, b.RemoteAddr))
+	})
+	return deleted, nil
+}
+
+func (s *memoryStore) PrunePeerTombstones(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for addr, at := range s.tombstones {
+		if at.Before(before) {
+			delete(s.tombstones, addr)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetNodeKey(ctx context.Context) (ed25519.PrivateKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nodeKey == nil {
+		return nil, model.ErrNotFound
+	}
+	return slices.Clone(s.nodeKey), nil
+}
+
+func (s *memoryStore) PutNodeKey(ctx context.Context, key ed25519.PrivateKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nodeKey == nil {
+		s.nodeKey = slices.Clone(key)
+	}
+	return nil
+}
+
+func (s *memoryStore) PutCachedCertificate(ctx context.Context, cert *x509.Certificate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := cert.Subject.CommonName
+	if c, ok := s.certificates[id]; ok {
+		c.certificate = cert
+		return nil
+	}
+	s.certificates[id] = &memoryCertificate{certificate: cert}
+	return nil
+}
+
+func (s *memoryStore) GetCachedCertificate(ctx context.Context, identifier string) (*x509.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.certificates[identifier]
+	if !ok {
+		return nil, model.ErrNotFound
+	}
+	return c.certificate, nil
+}
+
+func (s *memoryStore) RotateCachedCertificate(ctx context.Context, cert, previous *x509.Certificate, rotatedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := cert.Subject.CommonName
+	c, ok := s.certificates[id]
+	if !ok {
+		c = &memoryCertificate{}
+		s.certificates[id] = c
+	}
+	c.certificate = cert
+	c.previous = previous
+	c.rotatedAt = timePtr(rotatedAt)
+	return nil
+}
+
+func (s *memoryStore) GetPreviousCertificate(ctx context.Context, identifier string) (*x509.Certificate, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.certificates[identifier]
+	if !ok || c.previous == nil || c.rotatedAt == nil {
+		return nil, time.Time{}, model.ErrNotFound
+	}
+	return c.previous, *c.rotatedAt, nil
+}
+
+func (s *memoryStore) RevokeCachedCertificate(ctx context.Context, cert *x509.Certificate, revokedAt time.Time, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := cert.Subject.CommonName
+	c, ok := s.certificates[id]
+	if !ok {
+		c = &memoryCertificate{certificate: cert}
+		s.certificates[id] = c
+	}
+	c.revokedAt = timePtr(revokedAt)
+	return nil
+}
+
+func (s *memoryStore) GetRevocation(ctx context.Context, identifier string) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.certificates[identifier]
+	if !ok {
+		return nil, nil
+	}
+	return copyTime(c.revokedAt), nil
+}
+
+func (s *memoryStore) PutIdentityRecord(ctx context.Context, cert *x509.Certificate, actionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identityRecords[cert.Subject.CommonName] = cert
+	return nil
+}
+
+func (s *memoryStore) GetIdentityRecord(ctx context.Context, identifier string) (*x509.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cert, ok := s.identityRecords[identifier]
+	if !ok {
+		return nil, model.ErrNotFound
+	}
+	return cert, nil
+}
+
+func (s *memoryStore) PutHandleClaim(ctx context.Context, claim *model.HandleClaim) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// an identity has one handle
+	s.handles = slices.DeleteFunc(s.handles, func(h *model.HandleClaim) bool {
+		return h.Identity == claim.Identity && h.Handle != claim.Handle
+	})
+
+	for _, h := range s.handles {
+		if h.Handle == claim.Handle && h.Identity == claim.Identity {
+			if claim.FirstSeenAt.Before(h.FirstSeenAt) {
+				h.FirstSeenAt = claim.FirstSeenAt
+			}
+			return nil
+		}
+	}
+	s.handles = append(s.handles, &model.HandleClaim{
+		Handle:      claim.Handle,
+		Identity:    claim.Identity,
+		FirstSeenAt: claim.FirstSeenAt,
+		ActionID:    claim.ActionID,
+	})
+	return nil
+}
+
+func (s *memoryStore) GetHandleClaims(ctx context.Context, handle string) ([]*model.HandleClaim, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	claims := []*model.HandleClaim{}
+	for _, h := range s.handles {
+		if h.Handle != handle {
+			continue
+		}
+		if c, ok := s.certificates[h.Identity]; ok && c.revokedAt != nil {
+			continue
+		}
+		c := *h
+		c.VerifiedAt = copyTime(h.VerifiedAt)
+		claims = append(claims, &c)
+	}
+
+	// verified claims first, then in the order they were seen
+	slices.SortStableFunc(claims, func(a, b *model.HandleClaim) int {
+		if (a.VerifiedAt == nil) != (b.VerifiedAt == nil) {
+			if a.VerifiedAt != nil {
+				return -1
+			}
+			return 1
+		}
+		return a.FirstSeenAt.Compare(b.FirstSeenAt)
+	})
+	return claims, nil
+}
+
+func (s *memoryStore) SetHandleVerified(ctx context.Context, handle, identity string, verifiedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, h := range s.handles {
+		if h.Handle == handle && h.Identity == identity {
+			h.VerifiedAt = timePtr(verifiedAt)
+		}
+	}
+	return nil
+}
+
+// storedAction returns a copy of the columns of an action the SQLite store
+// keeps
+func storedAction(a graph.Action) graph.Action {
+	return graph.Action{
+		ID:               a.ID,
+		Timestamp:        a.Timestamp,
+		Action:           a.Action,
+		RemoteAddr:       a.RemoteAddr,
+		NodeID:           a.NodeID,
+		Identity:         a.Identity,
+		ReceivedBy:       a.ReceivedBy,
+		EncodedSignature: a.EncodedSignature,
+		ExpiresAt:        copyTime(a.ExpiresAt),
+		KeyID:            a.KeyID,
+		ManifestVersion:  a.ManifestVersion,
+		CreatedAt:        copyTime(a.CreatedAt),
+		TTL:              a.TTL,
+		Namespace:        a.Namespace,
+		Delegation:       a.Delegation,
+	}
+}
+
+// actionsWhere returns copies of the actions match accepts, oldest first or,
+// with newestFirst, newest first
+func (s *memoryStore) actionsWhere(match func(a *memoryAction) bool, newestFirst bool) []*graph.Action {
+	actions := []*graph.Action{}
+	for _, a := range s.actions {
+		if match(a) {
+			c := storedAction(a.action)
+			actions = append(actions, &c)
+		}
+	}
+	slices.SortFunc(actions, func(a, b *graph.Action) int {
+		c := a.Timestamp.Compare(b.Timestamp)
+		if newestFirst {
+			c = -c
+		}
+		return cmp.Or(c, cmp.Compare(a.ID, b.ID))
+	})
+	return actions
+}
+
+func (s *memoryStore) CreateAction(ctx context.Context, action graph.Action) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.actions[action.ID]; ok {
+		return fmt.Errorf("create action %s: %w", action.ID, model.ErrAlreadyExists)
+	}
+	s.actions[action.ID] = &memoryAction{action: storedAction(action)}
+	return nil
+}
+
+func (s *memoryStore) GetActionsSince(ctx context.Context, since time.Time, after string, limit int) ([]*graph.Action, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	actions := s.actionsWhere(func(a *memoryAction) bool {
+		return actionAfter(a.action.Timestamp, a.action.ID, since, after) && a.evictedAt == nil
+	}, false)
+	return limited(actions, limit), nil
+}
+
+func (s *memoryStore) GetRecentActions(ctx context.Context, limit int) ([]*graph.Action, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	actions := s.actionsWhere(func(a *memoryAction) bool { return a.evictedAt == nil }, true)
+	return limited(actions, limit), nil
+}
+
+func (s *memoryStore) IsActionProcessed(ctx context.Context, id string, digest int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, stored := s.actions[id]
+	_, pruned := s.digests[digest]
+	return stored || pruned, nil
+}
+
+// EachActionID calls fn outside the lock, so fn can use the store
+func (s *memoryStore) EachActionID(ctx context.Context, fn func(id string)) error {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.actions))
+	for id := range s.actions {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		fn(id)
+	}
+	return nil
+}
+
+func (s *memoryStore) EachActionDigest(ctx context.Context, fn func(digest int64)) error {
+	s.mu.Lock()
+	digests := make([]int64, 0, len(s.digests))
+	for digest := range s.digests {
+		digests = append(digests, digest)
+	}
+	s.mu.Unlock()
+
+	for _, digest := range digests {
+		fn(digest)
+	}
+	return nil
+}
+
+func (s *memoryStore) CountActionsSince(ctx context.Context, identity string, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, a := range s.actions {
+		if a.action.Identity == identity && a.action.Timestamp.After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) BytesStoredBy(ctx context.Context, identity string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var size int64
+	for _, a := range s.actions {
+		if a.action.Identity == identity {
+			size += int64(len(a.action.Action))
+		}
+	}
+	return size, nil
+}
+
+func (s *memoryStore) GetExpiredActions(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := []*graph.Action{}
+	for _, a := range s.actions {
+		if a.action.ExpiresAt != nil && a.action.ExpiresAt.Before(before) && a.evictedAt == nil {
+			expired = append(expired, &a.action)
+		}
+	}
+	slices.SortFunc(expired, func(a, b *graph.Action) int {
+		return cmp.Or(a.ExpiresAt.Compare(*b.ExpiresAt), cmp.Compare(a.ID, b.ID))
+	})
+
+	ids := []string{}
+	for _, a := range limited(expired, limit) {
+		ids = append(ids, a.ID)
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) EvictActions(ctx context.Context, ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, id := range ids {
+		if a, ok := s.actions[id]; ok {
+			a.action.Action = ""
+			a.evictedAt = timePtr(now)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetPrunableActions(ctx context.Context, before time.Time, limit int) ([]*graph.Action, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	actions := s.actionsWhere(func(a *memoryAction) bool {
+		return a.action.Timestamp.Before(before) && (a.action.ExpiresAt == nil || a.evictedAt != nil)
+	}, false)
+
+	prunable := []*graph.Action{}
+	for _, a := range limited(actions, limit) {
+		prunable = append(prunable, &graph.Action{ID: a.ID, CreatedAt: a.CreatedAt})
+	}
+	return prunable, nil
+}
+
+func (s *memoryStore) PruneActions(ctx context.Context, ids []string, digests []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, digest := range digests {
+		s.digests[digest] = struct{}{}
+	}
+	for _, id := range ids {
+		delete(s.outbox, id)
+		delete(s.actions, id)
+	}
+	return nil
+}
+
+func (s *memoryStore) QueueAction(ctx context.Context, action graph.Action) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.outbox[action.ID]; ok {
+		return nil
+	}
+	s.outbox[action.ID] = &memoryQueued{
+		queuedAt:  time.Now().UTC(),
+		entityIDs: slices.Clone(action.EntityIDs),
+		topics:    slices.Clone(action.Topics),
+	}
+	return nil
+}
+
+func (s *memoryStore) GetQueuedActions(ctx context.Context, limit int) ([]*graph.Action, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type queued struct {
+		action   graph.Action
+		queuedAt time.Time
+	}
+	rows := []queued{}
+	for id, q := range s.outbox {
+		a, ok := s.actions[id]
+		if !ok {
+			continue
+		}
+		action := storedAction(a.action)
+		action.EntityIDs = slices.Clone(q.entityIDs)
+		action.Topics = slices.Clone(q.topics)
+		rows = append(rows, queued{action: action, queuedAt: q.queuedAt})
+	}
+	slices.SortFunc(rows, func(a, b queued) int {
+		return cmp.Or(a.queuedAt.Compare(b.queuedAt), cmp.Compare(a.action.ID, b.action.ID))
+	})
+
+	actions := []*graph.Action{}
+	for _, r := range limited(rows, limit) {
+		actions = append(actions, &r.action)
+	}
+	return actions, nil
+}
+
+func (s *memoryStore) DequeueActions(ctx context.Context, ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		delete(s.outbox, id)
+	}
+	return nil
+}
+
+func (s *memoryStore) CountQueuedActions(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.outbox), nil
+}
+
+func (s *memoryStore) PutBlock(ctx context.Context, block model.BlockSpec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b, ok := s.blocks[block.Identity]; ok {
+		// the operator's blocks take precedence
+		if block.BlockedBy != "" && b.BlockedBy == "" {
+			return nil
+		}
+		b.Mode = block.Mode
+		b.BlockedBy = block.BlockedBy
+		return nil
+	}
+	s.blocks[block.Identity] = &block
+	return nil
+}
+
+func (s *memoryStore) DeleteBlock(ctx context.Context, identity string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blocks, identity)
+	return nil
+}
+
+func (s *memoryStore) GetBlock(ctx context.Context, identity string) (*model.BlockSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blocks[identity]
+	if !ok {
+		return nil, nil
+	}
+	c := *b
+	return &c, nil
+}
+
+func (s *memoryStore) GetBlocks(ctx context.Context) ([]*model.BlockSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blocks := []*model.BlockSpec{}
+	for _, b := range s.blocks {
+		c := *b
+		blocks = append(blocks, &c)
+	}
+	slices.SortFunc(blocks, func(a, b *model.BlockSpec) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.Identity, b.Identity))
+	})
+	return blocks, nil
+}
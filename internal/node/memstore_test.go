@@ -0,0 +1,342 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/jdudmesh/propolis/internal/secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestNode returns a node with an in memory store, enough for the logic
+// which decides what to do with peers
+func newTestNode(t *testing.T) *node {
+	n := &node{
+		store:     newMemoryStore(),
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		peerTable: PeerTableConfig{}.withDefaults(),
+	}
+	n.metrics = newNodeMetrics(n)
+	t.Cleanup(func() { n.store.Close() })
+	return n
+}
+
+// TestStores runs the same operations against both stores, so the memory
+// store used in tests behaves as the one nodes use
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"sqlite": func(t *testing.T) Store {
+			s, err := newStore(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()), secrets.Plaintext())
+			require.NoError(t, err)
+			return s
+		},
+		"memory": func(t *testing.T) Store {
+			return newMemoryStore()
+		},
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			t.Cleanup(func() { s.Close() })
+			testPeers(t, s)
+			testPeerChangePaging(t, s)
+			testActions(t, s)
+			testActionPaging(t, s)
+			testBlocks(t, s)
+		})
+	}
+}
+
+func testPeers(t *testing.T, s Store) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	created := time.Now().UTC().Add(-time.Hour)
+
+	// a rejoin keeps the first node key and the filter, which only pings
+	// change
+	require.NoError(t, s.UpsertPeer(ctx, model.PeerSpec{RemoteAddr: "a", CreatedAt: created, NodeID: "n1", Filter: "f1", NodeKey: "k1"}))
+	require.NoError(t, s.UpsertPeer(ctx, model.PeerSpec{RemoteAddr: "a", CreatedAt: created, NodeID: "n2", Filter: "f2", NodeKey: "k2", NodeType: NodeTypeCache.String()}))
+	p, err := s.GetPeer(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal("n1", p.NodeID)
+	assert.Equal("f1", p.Filter)
+	assert.Equal("k1", p.NodeKey)
+	assert.Equal(NodeTypeCache.String(), p.NodeType)
+	assert.NotNil(p.UpdatedAt)
+
+	require.NoError(t, s.TouchPeer(ctx, "a", "f3"))
+	p, err = s.GetPeer(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal("f3", p.Filter)
+
+	missing, err := s.GetPeer(ctx, "missing")
+	assert.NoError(err)
+	assert.Nil(missing)
+
+	// peers handed out by seeds remember the seed
+	require.NoError(t, s.UpsertPeers(ctx, []*model.PeerSpec{
+		{RemoteAddr: "b", CreatedAt: created, NodeID: "n3", Source: "seed"},
+		{RemoteAddr: "c", CreatedAt: created, NodeID: "n4", Source: "seed", SoftwareVersion: "v1.0.0"},
+	}))
+	p, err = s.GetPeer(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal("seed", p.Source)
+	assert.Equal(NodeTypePeer.String(), p.NodeType)
+
+	count, err := s.CountOfPeers(ctx)
+	require.NoError(t, err)
+	assert.Equal(3, count)
+	versions, err := s.CountPeersBySoftwareVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(map[string]int{"v1.0.0": 1}, versions)
+
+	caches, err := s.GetCaches(ctx, "")
+	require.NoError(t, err)
+	assert.Len(caches, 1)
+	random, err := s.GetRandomPeers(ctx, "a", 10)
+	require.NoError(t, err)
+	assert.Len(random, 2)
+
+	// missed pings add up until the peer is dropped
+	missed, err := s.MissPeer(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(1, missed)
+	_, err = s.MissPeer(ctx, "b")
+	require.NoError(t, err)
+	dropped, err := s.DeleteMissingPeers(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal([]string{"b"}, dropped)
+
+	// replicated peers are written unless deleted since
+	deletedAt := time.Now().UTC()
+	require.NoError(t, s.MergeReplicatedPeers(ctx, []*model.PeerSpec{
+		{RemoteAddr: "d", CreatedAt: deletedAt.Add(-time.Minute), NodeID: "n5"},
+		{RemoteAddr: "e", CreatedAt: deletedAt.Add(time.Minute), NodeID: "n6"},
+	}, []*model.PeerTombstone{
+		{RemoteAddr: "c", DeletedAt: deletedAt},
+		{RemoteAddr: "d", DeletedAt: deletedAt},
+	}))
+	for addr, exists := range map[string]bool{"c": false, "d": false, "e": true} {
+		p, err := s.GetPeer(ctx, addr)
+		require.NoError(t, err)
+		assert.Equal(exists, p != nil, addr)
+	}
+	tombstones, err := s.GetPeerTombstones(ctx, time.Time{})
+	require.NoError(t, err)
+	assert.Len(tombstones, 2)
+
+	changed, err := s.GetPeersChangedSince(ctx, deletedAt, "", 10)
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	assert.Equal("e", changed[0].RemoteAddr)
+}
+
+// testActionPaging pages through actions received at the same time
+func testActionPaging(t *testing.T, s Store) {
+	ctx := context.Background()
+	at := time.Now().UTC().Add(time.Hour)
+	for _, id := range []string{"p3", "p1", "p2"} {
+		require.NoError(t, s.CreateAction(ctx, graph.Action{ID: id, Timestamp: at, Action: id}))
+	}
+	require.NoError(t, s.CreateAction(ctx, graph.Action{ID: "p0", Timestamp: at.Add(time.Second), Action: "p0"}))
+
+	ids := []string{}
+	since, after := at.Add(-time.Nanosecond), ""
+	for range 5 {
+		page, err := s.GetActionsSince(ctx, since, after, 2)
+		require.NoError(t, err)
+		if len(page) == 0 {
+			break
+		}
+		for _, a := range page {
+			ids = append(ids, a.ID)
+		}
+		since, after = page[len(page)-1].Timestamp, page[len(page)-1].ID
+	}
+	assert.Equal(t, []string{"p1", "p2", "p3", "p0"}, ids)
+}
+
+func testActions(t *testing.T, s Store) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	expires := now.Add(-time.Minute)
+	for i, a := range []graph.Action{
+		{ID: "1", Timestamp: now.Add(-3 * time.Hour), Action: "one", Identity: "id"},
+		{ID: "2", Timestamp: now.Add(-2 * time.Hour), Action: "two", Identity: "id", ExpiresAt: &expires},
+		{ID: "3", Timestamp: now.Add(-time.Hour), Action: "three", Identity: "other", EntityIDs: []string{"e"}},
+	} {
+		require.NoError(t, s.CreateAction(ctx, a), i)
+	}
+	assert.Error(s.CreateAction(ctx, graph.Action{ID: "1", Timestamp: now}))
+
+	since, err := s.GetActionsSince(ctx, now.Add(-150*time.Minute), "", 10)
+	require.NoError(t, err)
+	require.Len(t, since, 2)
+	assert.Equal("2", since[0].ID)
+	assert.Nil(since[1].EntityIDs)
+
+	size, err := s.BytesStoredBy(ctx, "id")
+	require.NoError(t, err)
+	assert.Equal(int64(6), size)
+
+	// expired actions are evicted, then pruned with the others
+	expired, err := s.GetExpiredActions(ctx, now, 10)
+	require.NoError(t, err)
+	assert.Equal([]string{"2"}, expired)
+	require.NoError(t, s.EvictActions(ctx, expired))
+	recent, err := s.GetRecentActions(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, recent, 2)
+	assert.Equal("3", recent[0].ID)
+
+	require.NoError(t, s.QueueAction(ctx, graph.Action{ID: "3", EntityIDs: []string{"e"}, Topics: []string{"Post"}}))
+	queued, err := s.GetQueuedActions(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	assert.Equal([]string{"Post"}, queued[0].Topics)
+	assert.Equal("three", queued[0].Action)
+
+	prunable, err := s.GetPrunableActions(ctx, now, 10)
+	require.NoError(t, err)
+	require.Len(t, prunable, 3)
+	require.NoError(t, s.PruneActions(ctx, []string{"1", "3"}, []int64{42}))
+	processed, err := s.IsActionProcessed(ctx, "1", 42)
+	require.NoError(t, err)
+	assert.True(processed)
+	processed, err = s.IsActionProcessed(ctx, "1", 43)
+	require.NoError(t, err)
+	assert.False(processed)
+	count, err := s.CountQueuedActions(ctx)
+	require.NoError(t, err)
+	assert.Zero(count)
+}
+
+func TestAdmitPeers(t *testing.T) {
+	peer := func(addr, source string) *model.PeerSpec {
+		return &model.PeerSpec{RemoteAddr: addr, Source: source}
+	}
+	spread := func(n int, source string) []*model.PeerSpec {
+		peers := []*model.PeerSpec{}
+		for i := range n {
+			peers = append(peers, peer(fmt.Sprintf("198.51.%d.1:9000", 100+i), source))
+		}
+		return peers
+	}
+
+	tests := []struct {
+		name       string
+		known      []*model.PeerSpec
+		candidates []*model.PeerSpec
+		admitted   int
+	}{
+		{
+			name:       "subnet limit",
+			candidates: []*model.PeerSpec{peer("203.0.113.1:9000", "a"), peer("203.0.113.2:9000", "a"), peer("203.0.113.3:9000", "a")},
+			admitted:   2,
+		},
+		{
+			name:       "known peers count against the subnet",
+			known:      []*model.PeerSpec{peer("203.0.113.1:9000", "a")},
+			candidates: []*model.PeerSpec{peer("203.0.113.1:9000", "a"), peer("203.0.113.2:9000", "a"), peer("203.0.113.3:9000", "a")},
+			admitted:   2,
+		},
+		{
+			name:       "private addresses aren't limited",
+			candidates: []*model.PeerSpec{peer("10.0.0.1:9000", "a"), peer("10.0.0.2:9000", "a"), peer("10.0.0.3:9000", "a")},
+			admitted:   3,
+		},
+		{
+			name:       "one seed can't fill the table",
+			candidates: append(spread(6, "a"), peer("192.0.2.1:9000", "b"), peer("192.0.2.129:9000", "b")),
+			admitted:   4,
+		},
+		{
+			name:       "a single seed isn't limited",
+			candidates: spread(6, "a"),
+			admitted:   6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newTestNode(t)
+			assert.Len(t, n.admitPeers(tt.known, tt.candidates), tt.admitted)
+		})
+	}
+}
+
+// testPeerChangePaging pages through peers seen at the same time, as
+// replication does
+func testPeerChangePaging(t *testing.T, s Store) {
+	ctx := context.Background()
+	seen := time.Now().UTC().Add(time.Hour)
+
+	peers := []*model.PeerSpec{}
+	want := []string{}
+	for i := range 7 {
+		addr := fmt.Sprintf("tied-%d", i)
+		peers = append(peers, &model.PeerSpec{RemoteAddr: addr, CreatedAt: seen.Add(-time.Hour), UpdatedAt: timePtr(seen)})
+		want = append(want, addr)
+	}
+	later := &model.PeerSpec{RemoteAddr: "later", CreatedAt: seen.Add(time.Second)}
+	require.NoError(t, s.MergeReplicatedPeers(ctx, append(peers, later), nil))
+	want = append(want, "later")
+
+	// pages of three end part way through the peers sharing a timestamp
+	got := []string{}
+	since, after := seen.Add(-time.Millisecond), ""
+	for {
+		page, err := s.GetPeersChangedSince(ctx, since, after, 3)
+		require.NoError(t, err)
+		for _, p := range page {
+			got = append(got, p.RemoteAddr)
+		}
+		if len(page) < 3 {
+			break
+		}
+		last := page[len(page)-1]
+		since, after = last.SeenAt(), last.RemoteAddr
+	}
+	assert.Equal(t, want, got)
+
+	page, err := s.GetPeersChangedSince(ctx, seen, "", 10)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, "later", page[0].RemoteAddr)
+
+	for _, addr := range want {
+		require.NoError(t, s.DeletePeer(ctx, addr))
+	}
+}
+
+func testBlocks(t *testing.T, s Store) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	// a local identity's mute doesn't undo the operator's block
+	require.NoError(t, s.PutBlock(ctx, model.BlockSpec{Identity: "spammer", CreatedAt: now, Mode: model.BlockModeBlock}))
+	require.NoError(t, s.PutBlock(ctx, model.BlockSpec{Identity: "spammer", CreatedAt: now, Mode: model.BlockModeMute, BlockedBy: "alice"}))
+	b, err := s.GetBlock(ctx, "spammer")
+	require.NoError(t, err)
+	assert.Equal(model.BlockModeBlock, b.Mode)
+	assert.Empty(b.BlockedBy)
+
+	// but the operator can take over a local identity's block
+	require.NoError(t, s.PutBlock(ctx, model.BlockSpec{Identity: "troll", CreatedAt: now, Mode: model.BlockModeBlock, BlockedBy: "alice"}))
+	require.NoError(t, s.PutBlock(ctx, model.BlockSpec{Identity: "troll", CreatedAt: now, Mode: model.BlockModeMute}))
+	b, err = s.GetBlock(ctx, "troll")
+	require.NoError(t, err)
+	assert.Equal(model.BlockModeMute, b.Mode)
+	assert.Empty(b.BlockedBy)
+}
@@ -0,0 +1,370 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/quic-go/quic-go/logging"
+	quicmetrics "github.com/quic-go/quic-go/metrics"
+)
+
+const metricsNamespace = "propolis"
+
+const (
+	RejectReasonDuplicate    = "duplicate"
+	RejectReasonUnauthorized = "unauthorized"
+	RejectReasonSignature    = "bad_signature"
+	RejectReasonSyntax       = "syntax"
+	RejectReasonLimits       = "limits"
+	RejectReasonClock        = "clock_skew"
+	RejectReasonIrrelevant   = "irrelevant"
+	RejectReasonModeration   = "moderation"
+	RejectReasonBlocked      = "blocked"
+	RejectReasonQuota        = "quota"
+	RejectReasonRevoked      = "revoked"
+	RejectReasonExpired      = "expired"
+	RejectReasonError        = "error"
+)
+
+type nodeMetrics struct {
+	registry              *prometheus.Registry
+	actionsReceived       prometheus.Counter
+	actionsAccepted       prometheus.Counter
+	actionsRejected       *prometheus.CounterVec
+	actionsPropagated     prometheus.Counter
+	propagationErrors     prometheus.Counter
+	propagationDropped    prometheus.Counter
+	propagationSkipped    prometheus.Counter
+	propagationIrrelevant prometheus.Counter
+	actionsInFlight       prometheus.Gauge
+	executorLatency       *prometheus.HistogramVec
+	executorErrors        prometheus.Counter
+	actionsEvicted        prometheus.Counter
+	actionsPruned         prometheus.Counter
+	stateDivergences      prometheus.Counter
+	peersReplicated       prometheus.Counter
+	throttleSeconds       prometheus.Counter
+	controlRejected       prometheus.Counter
+	peersRefused          *prometheus.CounterVec
+	joinsRefused          prometheus.Counter
+	requestsByEndpoint    *prometheus.CounterVec
+	dedupeLookups         *prometheus.CounterVec
+	connectionsUsed       *prometheus.CounterVec
+	breakerTrips          prometheus.Counter
+	breakerRejections     prometheus.Counter
+	actionAge             prometheus.Histogram
+	peerClockSkew         *prometheus.GaugeVec
+	peerPrecision         *prometheus.GaugeVec
+	webhookDeliveries     *prometheus.CounterVec
+	actionsExported       *prometheus.CounterVec
+	versionOutdated       prometheus.Gauge
+	networkVersions       *prometheus.GaugeVec
+}
+
+func newNodeMetrics(n *node) *nodeMetrics {
+	reg := prometheus.NewRegistry()
+
+	m := &nodeMetrics{
+		registry: reg,
+		actionsReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "actions_received_total",
+			Help:      "Actions received from other nodes",
+		}),
+		actionsAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "actions_accepted_total",
+			Help:      "Actions accepted for execution",
+		}),
+		actionsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "actions_rejected_total",
+			Help:      "Actions rejected, by reason",
+		}, []string{"reason"}),
+		actionsPropagated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "actions_propagated_total",
+			Help:      "Actions successfully sent on to peers",
+		}),
+		propagationErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_propagation_errors_total",
+			Help:      "Failed attempts to send actions on to peers",
+		}),
+		propagationDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_propagation_dropped_total",
+			Help:      "Actions dropped because a peer's queue was full",
+		}),
+		propagationSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_propagation_skipped_total",
+			Help:      "Actions not sent to peers whose saturated filters match mostly irrelevant actions",
+		}),
+		propagationIrrelevant: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_propagation_irrelevant_total",
+			Help:      "Actions sent to peers which rejected them as touching none of their subscriptions",
+		}),
+		actionsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "actions_in_flight",
+			Help:      "Actions currently being executed or propagated",
+		}),
+		executorLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "executor_duration_seconds",
+			Help:      "Time taken to execute actions against the graph",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"command"}),
+		executorErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "executor_errors_total",
+			Help:      "Actions which failed to execute",
+		}),
+		actionsEvicted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "actions_evicted_total",
+			Help:      "Expired actions evicted by the garbage collector",
+		}),
+		actionsPruned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "actions_pruned_total",
+			Help:      "Processed actions deleted once older than the retention window",
+		}),
+		stateDivergences: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "state_divergences_total",
+			Help:      "Topics found to differ from a peer's by consistency checks",
+		}),
+		peersReplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "peers_replicated_total",
+			Help:      "Peer changes pulled from replica seeds",
+		}),
+		throttleSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "outbound_throttle_seconds_total",
+			Help:      "Time propagation and backfill waited for the bandwidth limits",
+		}),
+		controlRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "control_rejected_total",
+			Help:      "Hellos, goodbyes and pings rejected for a missing or bad signature",
+		}),
+		peersRefused: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "peers_refused_total",
+			Help:      "Peers handed out by seeds which weren't added to the peer table, by reason",
+		}, []string{"reason"}),
+		joinsRefused: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "joins_refused_total",
+			Help:      "Hellos refused for want of a proof of work or an invitation",
+		}),
+		requestsByEndpoint: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Requests served, by route",
+		}, []string{"route"}),
+		dedupeLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "dedupe_lookups_total",
+			Help:      "Duplicate action checks, by where they were answered",
+		}, []string{"result"}),
+		connectionsUsed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connections_used_total",
+			Help:      "Connections used for outgoing requests, by transport and whether an existing connection was reused",
+		}, []string{"transport", "reused"}),
+		breakerTrips: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breaker_trips_total",
+			Help:      "Times a node's circuit opened after repeated failures",
+		}),
+		breakerRejections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breaker_rejections_total",
+			Help:      "Requests failed without being sent because the node's circuit was open",
+		}),
+		actionAge: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_age_seconds",
+			Help:      "Time between an action's creation and its receipt, negative if created in the future",
+			Buckets:   []float64{-300, -60, -10, -1, 0, 1, 10, 60, 300, 3600, 86400},
+		}),
+		peerClockSkew: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "peer_clock_skew_seconds",
+			Help:      "Difference between a peer's receive time tag on the last action it sent and the local clock",
+		}, []string{"peer"}),
+		peerPrecision: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "peer_filter_precision",
+			Help:      "Share of the actions sent to a peer since its filter last changed which it found relevant",
+		}, []string{"peer"}),
+		webhookDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "webhook_deliveries_total",
+			Help:      "Webhook payloads delivered, retried or dead lettered",
+		}, []string{"result"}),
+		actionsExported: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "actions_exported_total",
+			Help:      "Actions published to the export stream, dropped or failed",
+		}, []string{"result"}),
+		versionOutdated: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "version_outdated",
+			Help:      "1 when the node's software version is further behind the network majority than allowed",
+		}),
+		networkVersions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "network_versions",
+			Help:      "Nodes seen running each software version at the last version check",
+		}, []string{"version"}),
+	}
+
+	reg.MustRegister(
+		m.actionsReceived,
+		m.actionsAccepted,
+		m.actionsRejected,
+		m.actionsPropagated,
+		m.propagationErrors,
+		m.propagationDropped,
+		m.propagationSkipped,
+		m.propagationIrrelevant,
+		m.actionsInFlight,
+		m.executorLatency,
+		m.executorErrors,
+		m.actionsEvicted,
+		m.actionsPruned,
+		m.stateDivergences,
+		m.peersReplicated,
+		m.throttleSeconds,
+		m.controlRejected,
+		m.peersRefused,
+		m.joinsRefused,
+		m.requestsByEndpoint,
+		m.dedupeLookups,
+		m.connectionsUsed,
+		m.breakerTrips,
+		m.breakerRejections,
+		m.actionAge,
+		m.peerClockSkew,
+		m.peerPrecision,
+		m.webhookDeliveries,
+		m.actionsExported,
+		m.versionOutdated,
+		m.networkVersions,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "peers",
+			Help:      "Number of known peers",
+		}, func() float64 {
+			count, err := n.store.CountOfPeers(n.ctx)
+			if err != nil {
+				return 0
+			}
+			return float64(count)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "seeds",
+			Help:      "Number of known seeds",
+		}, func() float64 {
+			seeds, err := n.store.GetSeeds(n.ctx)
+			if err != nil {
+				return 0
+			}
+			return float64(len(seeds))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_queue_depth",
+			Help:      "Actions waiting in the node's action queue",
+		}, func() float64 {
+			return float64(len(n.actionQueue))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "propagation_queue_depth",
+			Help:      "Actions waiting to be sent on to peers",
+		}, func() float64 {
+			if n.dispatcher == nil {
+				return 0
+			}
+			return float64(n.dispatcher.Len())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "sessions",
+			Help:      "Open peer sessions",
+		}, func() float64 {
+			return float64(n.countOfSessions())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breakers_open",
+			Help:      "Nodes whose circuit is open or half open",
+		}, func() float64 {
+			return float64(n.countOfOpenCircuits())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "build_info",
+			Help:        "Always 1, labelled with the node's software version",
+			ConstLabels: prometheus.Labels{"version": n.version},
+		}, func() float64 {
+			return 1
+		}),
+	)
+
+	return m
+}
+
+// connectionTracer feeds QUIC connection stats (connections started/closed,
+// handshake and connection durations) into the node's registry
+func (m *nodeMetrics) connectionTracer() func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+	return func(_ context.Context, p logging.Perspective, _ logging.ConnectionID) *logging.ConnectionTracer {
+		if p == logging.PerspectiveClient {
+			return quicmetrics.NewClientConnectionTracerWithRegisterer(m.registry)
+		}
+		return quicmetrics.NewServerConnectionTracerWithRegisterer(m.registry)
+	}
+}
+
+func (m *nodeMetrics) transportTracer() *logging.Tracer {
+	return quicmetrics.NewTracerWithRegisterer(m.registry)
+}
+
+// connectionUsed counts a connection picked for an outgoing request. HTTP/3
+// fallback requests aren't counted as their pool isn't observable, new QUIC
+// connections show up in the connection tracer.
+func (m *nodeMetrics) connectionUsed(transport string, reused bool) {
+	m.connectionsUsed.WithLabelValues(transport, strconv.FormatBool(reused)).Inc()
+}
+
+func (m *nodeMetrics) rejected(reason string) {
+	m.actionsRejected.WithLabelValues(reason).Inc()
+}
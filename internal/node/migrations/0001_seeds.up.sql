@@ -0,0 +1,6 @@
+create table seeds (
+	remote_addr text not null primary key,
+	created_at datetime not null,
+	updated_at datetime null,
+	node_id text not null
+);
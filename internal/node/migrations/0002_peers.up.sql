@@ -0,0 +1,7 @@
+create table peers (
+	remote_addr text not null primary key,
+	created_at datetime not null,
+	updated_at datetime null,
+	node_id text not null,
+	filter text not null
+);
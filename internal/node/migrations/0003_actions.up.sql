@@ -0,0 +1,10 @@
+create table actions (
+	id text not null primary key,
+	timestamp datetime not null,
+	action text not null,
+	remote_addr text not null,
+	node_id text not null,
+	identity text not null,
+	received_by text not null,
+	encoded_sig text not null
+);
@@ -0,0 +1 @@
+drop index idx_actions_peer;
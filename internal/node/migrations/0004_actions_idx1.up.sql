@@ -0,0 +1 @@
+create index idx_actions_peer on actions(remote_addr);
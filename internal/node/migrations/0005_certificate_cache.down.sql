@@ -0,0 +1 @@
+drop table certificate_cache;
@@ -0,0 +1,2 @@
+alter table peers drop column preferred_addr;
+alter table peers drop column addresses;
@@ -0,0 +1,2 @@
+alter table peers add column addresses text not null default '';
+alter table peers add column preferred_addr text not null default '';
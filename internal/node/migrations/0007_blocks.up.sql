@@ -0,0 +1,6 @@
+create table blocks (
+	identity text not null primary key,
+	created_at datetime not null,
+	mode text not null,
+	blocked_by text not null
+);
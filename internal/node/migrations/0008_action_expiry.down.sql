@@ -0,0 +1,4 @@
+drop index idx_actions_expires_at;
+drop index idx_actions_identity;
+alter table actions drop column evicted_at;
+alter table actions drop column expires_at;
@@ -0,0 +1,4 @@
+alter table actions add column expires_at datetime null;
+alter table actions add column evicted_at datetime null;
+create index idx_actions_identity on actions(identity, timestamp);
+create index idx_actions_expires_at on actions(expires_at);
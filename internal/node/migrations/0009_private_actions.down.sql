@@ -0,0 +1 @@
+alter table actions drop column key_id;
@@ -0,0 +1 @@
+alter table actions add column key_id text not null default '';
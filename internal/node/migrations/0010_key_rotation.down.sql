@@ -0,0 +1,2 @@
+alter table certificate_cache drop column rotated_at;
+alter table certificate_cache drop column previous_certificate;
@@ -0,0 +1,2 @@
+alter table certificate_cache add column previous_certificate blob null;
+alter table certificate_cache add column rotated_at datetime null;
@@ -0,0 +1,2 @@
+alter table certificate_cache drop column revocation_reason;
+alter table certificate_cache drop column revoked_at;
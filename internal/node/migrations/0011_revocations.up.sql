@@ -0,0 +1,2 @@
+alter table certificate_cache add column revoked_at datetime null;
+alter table certificate_cache add column revocation_reason text not null default '';
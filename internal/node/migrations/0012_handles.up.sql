@@ -0,0 +1,9 @@
+create table handles (
+	handle text not null,
+	identity text not null,
+	first_seen_at datetime not null,
+	action_id text not null,
+	verified_at datetime null,
+	primary key (handle, identity)
+);
+create index idx_handles_identity on handles(identity);
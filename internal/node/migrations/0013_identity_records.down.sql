@@ -0,0 +1 @@
+drop table identity_records;
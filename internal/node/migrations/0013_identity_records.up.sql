@@ -0,0 +1,7 @@
+create table identity_records (
+	id text not null primary key,
+	created_at datetime not null,
+	updated_at datetime null,
+	action_id text not null,
+	certificate blob not null
+);
@@ -0,0 +1 @@
+alter table peers add column node_type text not null default 'peer';
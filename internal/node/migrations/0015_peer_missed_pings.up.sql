@@ -0,0 +1 @@
+alter table peers add column missed_pings int not null default 0;
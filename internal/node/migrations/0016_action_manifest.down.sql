@@ -0,0 +1 @@
+alter table actions drop column manifest_version;
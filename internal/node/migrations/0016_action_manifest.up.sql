@@ -0,0 +1 @@
+alter table actions add column manifest_version int not null default 0;
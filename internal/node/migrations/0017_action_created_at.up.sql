@@ -0,0 +1 @@
+alter table actions add column created_at datetime null;
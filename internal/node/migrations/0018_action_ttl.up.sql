@@ -0,0 +1 @@
+alter table actions add column ttl int not null default 0;
@@ -0,0 +1,2 @@
+drop index idx_actions_timestamp;
+drop table action_digests;
@@ -0,0 +1,4 @@
+create table action_digests (
+	digest integer not null primary key
+);
+create index idx_actions_timestamp on actions(timestamp);
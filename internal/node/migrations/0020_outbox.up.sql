@@ -0,0 +1,6 @@
+create table outbox (
+	action_id text not null primary key,
+	queued_at datetime not null,
+	entity_ids text not null,
+	topics text not null
+);
@@ -0,0 +1 @@
+alter table actions add column namespace text not null default '';
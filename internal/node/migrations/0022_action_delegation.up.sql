@@ -0,0 +1 @@
+alter table actions add column delegation text not null default '';
@@ -0,0 +1 @@
+alter table peers add column group_name text not null default '';
@@ -0,0 +1,2 @@
+drop index idx_peers_seen_at;
+drop table peer_tombstones;
@@ -0,0 +1,5 @@
+create table peer_tombstones (
+	remote_addr text not null primary key,
+	deleted_at datetime not null
+);
+create index idx_peers_seen_at on peers(coalesce(updated_at, created_at));
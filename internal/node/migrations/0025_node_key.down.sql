@@ -0,0 +1,2 @@
+alter table peers drop column node_key;
+drop table node_key;
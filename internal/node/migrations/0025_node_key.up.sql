@@ -0,0 +1,6 @@
+create table node_key (
+	id integer not null primary key check (id = 1),
+	created_at datetime not null,
+	private_key blob not null
+);
+alter table peers add column node_key text not null default '';
@@ -0,0 +1 @@
+alter table peers drop column source;
@@ -0,0 +1 @@
+alter table peers add column source text not null default '';
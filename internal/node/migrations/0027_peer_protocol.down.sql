@@ -0,0 +1,2 @@
+alter table peers drop column features;
+alter table peers drop column protocol_version;
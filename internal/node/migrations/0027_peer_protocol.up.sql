@@ -0,0 +1,2 @@
+alter table peers add column protocol_version int not null default 0;
+alter table peers add column features text not null default '';
@@ -0,0 +1 @@
+alter table peers add column software_version text not null default '';
@@ -1,8 +1,12 @@
 package node
 
 import (
+	"time"
+
 	"github.com/jdudmesh/propolis/internal/graph"
 	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/logging"
+	"github.com/jdudmesh/propolis/internal/secrets"
 )
 
 const (
@@ -11,11 +15,37 @@ const (
 	HeaderRemoteAddress = "x-propolis-remote-address"
 	HeaderActionID      = "x-propolis-action-id"
 	HeaderNodeID        = "x-propolis-node-id"
+	HeaderNodeType      = "x-propolis-node-type"
 	HeaderSender        = "x-propolis-sender"
 	HeaderSignature     = "x-propolis-signature"
 	HeaderIdentifier    = "x-propolis-identifier"
 	HeaderReceivedBy    = "x-propolis-received-by"
+	HeaderListenPort    = "x-propolis-listen-port"
+	HeaderAddresses     = "x-propolis-addresses"
 	HeaderContentType   = "Content-Type"
+	HeaderAuthorization = "Authorization"
+	HeaderTTL           = "x-propolis-ttl"
+	HeaderKeyID         = "x-propolis-key-id"
+	HeaderEntityIDs     = "x-propolis-entity-ids"
+	HeaderFilterTypes   = "x-propolis-filter-types"
+	HeaderTimestamp     = "x-propolis-timestamp"
+	HeaderGroup         = "x-propolis-group"
+	HeaderNodeKey       = "x-propolis-node-key"
+	// HeaderJoinWork and HeaderInvitation carry what a seed needs to admit
+	// a joining node, HeaderJoinDifficulty the work a refused node can do
+	HeaderJoinWork       = "x-propolis-join-work"
+	HeaderJoinDifficulty = "x-propolis-join-difficulty"
+	HeaderInvitation     = "x-propolis-invitation"
+	// HeaderProtocol and HeaderFeatures give the sender's wire protocol
+	// version and features
+	HeaderProtocol = "x-propolis-protocol"
+	HeaderFeatures = "x-propolis-features"
+	// HeaderSoftwareVersion gives the sender's software version
+	HeaderSoftwareVersion = "x-propolis-version"
+	// HeaderCheckpointID and HeaderCheckpointSince identify the checkpoint
+	// a graph was copied from
+	HeaderCheckpointID    = "x-propolis-checkpoint-id"
+	HeaderCheckpointSince = "x-propolis-checkpoint-since"
 
 	SelfRemoteAddress = "0.0.0.0"
 	MaxPeers          = 3
@@ -24,6 +54,7 @@ const (
 	ContentTypePing      = "x-propolis/ping"
 	ContentTypePong      = "x-propolis/pong"
 	ContentTypeSubscribe = "x-propolis/subscribe"
+	ContentTypeAction    = "x-propolis/action+json"
 
 	ContentTypeJSON = "application/json; utf-8"
 )
@@ -36,17 +67,175 @@ const (
 	NodeTypeCache
 )
 
+func (t NodeType) String() string {
+	switch t {
+	case NodeTypeSeed:
+		return "seed"
+	case NodeTypePeer:
+		return "peer"
+	case NodeTypeCache:
+		return "cache"
+	}
+	return "unknown"
+}
+
+// Config is the configuration shared by all node types. The mapstructure tags
+// are the keys in the config file.
 type Config struct {
-	graph.Config
-	Host            string
-	Port            int
-	PublicAddress   string
-	Seeds           []string
-	NodeDatabaseURL string
-	Type            NodeType
-	Identity        identity.Identity
+	graph.Config    `mapstructure:",squash"`
+	Host            string            `mapstructure:"host"`
+	Port            int               `mapstructure:"port"`
+	PublicAddress   string            `mapstructure:"public_address"`
+	Seeds           []string          `mapstructure:"seeds"`
+	NodeDatabaseURL string            `mapstructure:"node_db"`
+	Type            NodeType          `mapstructure:"-"`
+	Identity        identity.Identity `mapstructure:"-"`
+	EnableTCP       bool              `mapstructure:"tcp"`
+	// Capabilities replace those of the node type: accepts-joins,
+	// stores-graph, relays and serves-queries
+	Capabilities []string `mapstructure:"capabilities"`
+	// AdvertiseAddresses are additional host:port specs (IPv4, IPv6 or
+	// hostname) other nodes can use to reach this one
+	AdvertiseAddresses []string `mapstructure:"advertise"`
+	// AddressQuorum is how many seeds must see requests coming from the same
+	// IP before it is used as the public address, when none is configured.
+	// Fewer are needed when fewer seeds respond.
+	AddressQuorum int `mapstructure:"address_quorum"`
+	// AdminAddress is where the admin server (metrics etc) listens, empty to
+	// disable it. Use a unix: prefix to listen on a unix socket.
+	AdminAddress string `mapstructure:"admin_address"`
+	// AdminToken is the bearer token required by the admin API. The API is
+	// only served over TCP when a token is set.
+	AdminToken string `mapstructure:"admin_token"`
+	// Diagnostics serves pprof profiles at /debug/pprof/ and expvar at
+	// /debug/vars on the admin API
+	Diagnostics bool `mapstructure:"diagnostics"`
+	// APIAddress is where the application API listens, empty to disable it.
+	// Use a unix: prefix to listen on a unix socket.
+	APIAddress string `mapstructure:"api_address"`
+	// APIToken is the bearer token required by the application API, which
+	// needs one to listen on TCP
+	APIToken string `mapstructure:"api_token"`
+	// ClientAddress, if set, is where clients publish and query, leaving the
+	// node's port to gossip between nodes. Listens with the same transports.
+	ClientAddress string `mapstructure:"client_address"`
+	// BoltAddress is where Neo4j drivers and tools can connect, logging in with
+	// the API token as the password. Empty disables it.
+	BoltAddress string `mapstructure:"bolt_address"`
+	// DashboardAddress is where the web dashboard and the admin API it uses
+	// listen, empty to disable it. Use a unix: prefix to listen on a unix
+	// socket.
+	DashboardAddress string `mapstructure:"dashboard_address"`
+	// GraphQL serves a read only GraphQL view of the graph at /api/graphql on
+	// the application API
+	GraphQL bool `mapstructure:"graphql"`
+	// Identities are the identities the application API publishes as
+	Identities IdentityProvider `mapstructure:"-"`
+	// Loggers, if set, replaces Logger and gives the node and executor
+	// loggers whose levels can be changed from the admin API
+	Loggers *logging.Loggers `mapstructure:"-"`
+	// LogLevels sets the levels of the node, executor, ast and identity
+	// modules, the others log at the default level
+	LogLevels map[string]string `mapstructure:"log_levels"`
+	// Transports replaces the QUIC and TCP transports, e.g. with simulated ones
+	// in tests
+	Transports TransportFactory `mapstructure:"-"`
+	// Store, if set, replaces the node database at NodeDatabaseURL, e.g. with
+	// one backed by another database. The node closes it when it stops.
+	Store      Store            `mapstructure:"-"`
+	Moderation ModerationConfig `mapstructure:"moderation"`
+	Quotas     QuotaConfig      `mapstructure:"quotas"`
+	Liveness   LivenessConfig   `mapstructure:"liveness"`
+	Breaker    BreakerConfig    `mapstructure:"breaker"`
+	Limits     StatementLimits  `mapstructure:"limits"`
+	Clock      ClockConfig      `mapstructure:"clock"`
+	Filter     FilterConfig     `mapstructure:"filter"`
+	Webhooks   []WebhookConfig  `mapstructure:"webhooks"`
+	Export     ExportConfig     `mapstructure:"export"`
+	TLS        TLSConfig        `mapstructure:"tls"`
+	Retention  RetentionConfig  `mapstructure:"retention"`
+	Publish    PublishConfig    `mapstructure:"publish"`
+	Journal    JournalConfig    `mapstructure:"journal"`
+	Checkpoint CheckpointConfig `mapstructure:"checkpoint"`
+	// Consistency compares graph state hashes with peers
+	Consistency ConsistencyConfig `mapstructure:"consistency"`
+	// Group is the sharing group the node keeps topics for
+	Group GroupConfig `mapstructure:"group"`
+	// Replication shares a seed's peer table with other seeds
+	Replication ReplicationConfig `mapstructure:"replication"`
+	// KnownPeers is what is done with the peer table on a restart
+	KnownPeers KnownPeersConfig `mapstructure:"known_peers"`
+	// Bandwidth limits the requests and bytes sent by propagation and
+	// backfill
+	Bandwidth BandwidthConfig `mapstructure:"bandwidth"`
+	// Control is how control messages from other nodes are authenticated
+	Control ControlConfig `mapstructure:"control"`
+	// PeerTable limits how a relay's peer table is made up
+	PeerTable PeerTableConfig `mapstructure:"peer_table"`
+	// JoinPolicy is what a seed needs from joining nodes, and the invitation
+	// this node sends
+	JoinPolicy JoinPolicyConfig `mapstructure:"join_policy"`
+	// VersionCheck compares the node's software version with the network's
+	VersionCheck VersionCheckConfig `mapstructure:"version_check"`
+	// Version replaces the software version the node reports, e.g. to
+	// simulate a network of mixed versions in tests
+	Version string `mapstructure:"-"`
+	// Namespaces are the graphs the node hosts alongside the default one,
+	// by name
+	Namespaces map[string]NamespaceConfig `mapstructure:"namespaces"`
+	// ReadACL limits who can query entities through the query endpoints
+	ReadACL []ReadRule `mapstructure:"read_acl"`
+	// DatabaseKey supplies the key used to encrypt sensitive columns in the
+	// node database. Defaults to the PROPOLIS_DB_KEY environment variable.
+	DatabaseKey secrets.KeyProvider `mapstructure:"-"`
+	// SubscriptionKeys maps key IDs to base64 encoded shared keys for private
+	// subscriptions
+	SubscriptionKeys map[string]string `mapstructure:"subscription_keys"`
+	// KeyRotationGrace is how long signatures made with an identity's previous
+	// key are accepted after it rotates its keys
+	KeyRotationGrace time.Duration `mapstructure:"key_rotation_grace"`
+	// MinManifestVersion is the oldest action manifest version accepted from
+	// other nodes, at least ManifestVersionTimestamped
+	MinManifestVersion int `mapstructure:"min_manifest_version"`
+	// VerifyHandles enables webfinger verification of user@domain handles
+	VerifyHandles bool `mapstructure:"verify_handles"`
+	// CertificateQuorum is how many independent nodes must return the same
+	// certificate before an unknown identity is trusted
+	CertificateQuorum int `mapstructure:"certificate_quorum"`
+	// CertificateSources is the maximum number of nodes asked for a certificate
+	CertificateSources int `mapstructure:"certificate_sources"`
+	// SeedDomains are domains whose _propolis._udp SRV records list seeds
+	SeedDomains []string `mapstructure:"seed_domains"`
+	// BootstrapURLs serve a JSON list of seeds for new installs to start from
+	BootstrapURLs []string `mapstructure:"bootstrap_urls"`
+	// DedupeCacheSize is how many recently seen action IDs are kept in memory
+	// so duplicates are rejected without querying the database
+	DedupeCacheSize int `mapstructure:"dedupe_cache_size"`
+	// DispatchWorkers is how many actions can be sent to peers at once
+	DispatchWorkers int `mapstructure:"dispatch_workers"`
+	// PeerQueueSize is how many actions can wait to be sent to each peer
+	// before the oldest are dropped
+	PeerQueueSize int `mapstructure:"peer_queue_size"`
 }
 
 type Graph interface {
 	Execute(action graph.Action) (any, error)
+	Begin() (graph.UnitOfWork, error)
+	PurgeIdentity(identity string) (int, error)
+	PurgeActions(actionIDs []string) (int, error)
+	Schema() (*graph.Schema, error)
+	Stats() (*graph.Stats, error)
+	Checkpoint(path string) error
+	State() (*graph.State, error)
+	TopicState(topic string) (*graph.State, error)
+	DeclaredSchemas() ([]*graph.LabelSchema, error)
+	RegisterView(name, stmt string) error
+	DropView(name string) error
+	RegisteredViews() ([]*graph.RegisteredView, error)
+	QueryView(name string, readable graph.ReadFilter) (*graph.SearchResults, error)
+	Feed(q graph.FeedQuery) ([]*graph.NodeRecord, error)
+	GetNode(id string) (*graph.NodeRecord, error)
+	GetRelation(id string) (*graph.RelationRecord, error)
+	ListNodes(q graph.NodeQuery) ([]*graph.NodeRecord, error)
+	ListRelations(q graph.RelationQuery) ([]*graph.RelationRecord, error)
 }
@@ -0,0 +1,267 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+// ModerationConfig is read from the moderation section of the config file
+type ModerationConfig struct {
+	// DenyIdentities rejects actions signed by any of these identities
+	DenyIdentities []string `mapstructure:"deny_identities"`
+	// DenyLabels rejects actions which touch entities with any of these labels
+	DenyLabels []string `mapstructure:"deny_labels"`
+	// DenyAttributes rejects actions which touch entities with a matching
+	// attribute
+	DenyAttributes []AttributeFilter `mapstructure:"deny_attributes"`
+	// MaxStatementSize is the largest statement accepted in bytes, 0 for no
+	// limit
+	MaxStatementSize int `mapstructure:"max_statement_size"`
+	// DenyPatterns are regular expressions matched against the statement text
+	DenyPatterns []string `mapstructure:"deny_patterns"`
+	// Plugins are paths to WASM modules which can accept, reject or rewrite
+	// actions. They run after the built in policies. Rewrites only change
+	// what this node executes, the signed statement is passed on as it is.
+	Plugins []string `mapstructure:"plugins"`
+}
+
+// AttributeFilter matches an attribute by key and, optionally, a regular
+// expression on its value
+type AttributeFilter struct {
+	Key     string `mapstructure:"key"`
+	Pattern string `mapstructure:"pattern"`
+}
+
+func (c ModerationConfig) validate(check *configCheck) {
+	nonNegative(check, "max_statement_size", c.MaxStatementSize)
+	for _, p := range c.DenyPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			check.addf("deny_patterns", "%q is not a regular expression: %s", p, err)
+		}
+	}
+	for _, f := range c.DenyAttributes {
+		if f.Key == "" {
+			check.addf("deny_attributes", "every filter needs a key")
+		}
+		if _, err := regexp.Compile(f.Pattern); err != nil {
+			check.addf("deny_attributes", "%q is not a regular expression: %s", f.Pattern, err)
+		}
+	}
+	for _, path := range c.Plugins {
+		if _, err := os.Stat(path); err != nil {
+			check.addf("plugins", "can't read %s: %s", path, err)
+		}
+	}
+}
+
+// ModerationPolicy decides whether an action is acceptable. Policies return an
+// error wrapping model.ErrNotAcceptable to reject an action; any other error is
+// treated as a failure to moderate.
+type ModerationPolicy interface {
+	Name() string
+	Moderate(action *graph.Action) error
+}
+
+type moderationPipeline []ModerationPolicy
+
+// newModerationPipeline creates the configured policies, plugins holding the
+// statements they rewrite to limits
+func newModerationPipeline(config ModerationConfig, limits StatementLimits) (moderationPipeline, error) {
+	p := moderationPipeline{}
+
+	if len(config.DenyIdentities) > 0 {
+		p = append(p, &identityDenyPolicy{identities: config.DenyIdentities})
+	}
+
+	if config.MaxStatementSize > 0 {
+		p = append(p, &statementSizePolicy{max: config.MaxStatementSize})
+	}
+
+	if len(config.DenyPatterns) > 0 {
+		policy := &contentPolicy{}
+		for _, s := range config.DenyPatterns {
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, fmt.Errorf("compiling deny pattern %q: %w", s, err)
+			}
+			policy.patterns = append(policy.patterns, re)
+		}
+		p = append(p, policy)
+	}
+
+	if len(config.DenyLabels) > 0 || len(config.DenyAttributes) > 0 {
+		policy := &entityPolicy{labels: config.DenyLabels}
+		for _, f := range config.DenyAttributes {
+			if f.Key == "" {
+				return nil, fmt.Errorf("attribute filter has no key")
+			}
+			af := attributeMatcher{key: f.Key}
+			if f.Pattern != "" {
+				re, err := regexp.Compile(f.Pattern)
+				if err != nil {
+					return nil, fmt.Errorf("compiling attribute pattern %q: %w", f.Pattern, err)
+				}
+				af.pattern = re
+			}
+			policy.attributes = append(policy.attributes, af)
+		}
+		p = append(p, policy)
+	}
+
+	for _, path := range config.Plugins {
+		policy, err := newWASMPolicy(path, limits)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("loading plugin %s: %w", path, err)
+		}
+		p = append(p, policy)
+	}
+
+	return p, nil
+}
+
+// Moderate runs each policy in turn and stops at the first rejection
+func (p moderationPipeline) Moderate(action *graph.Action) error {
+	for _, policy := range p {
+		err := policy.Moderate(action)
+		if err != nil {
+			return fmt.Errorf("%s: %w", policy.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (p moderationPipeline) Close() error {
+	errs := []error{}
+	for _, policy := range p {
+		if c, ok := policy.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type identityDenyPolicy struct {
+	identities []string
+}
+
+func (p *identityDenyPolicy) Name() string {
+	return "identity"
+}
+
+func (p *identityDenyPolicy) Moderate(action *graph.Action) error {
+	if slices.Contains(p.identities, action.Identity) {
+		return fmt.Errorf("identity %s denied: %w", action.Identity, model.ErrNotAcceptable)
+	}
+	return nil
+}
+
+type statementSizePolicy struct {
+	max int
+}
+
+func (p *statementSizePolicy) Name() string {
+	return "size"
+}
+
+func (p *statementSizePolicy) Moderate(action *graph.Action) error {
+	if len(action.Action) > p.max {
+		return fmt.Errorf("statement is %d bytes (max %d): %w", len(action.Action), p.max, model.ErrNotAcceptable)
+	}
+	return nil
+}
+
+type contentPolicy struct {
+	patterns []*regexp.Regexp
+}
+
+func (p *contentPolicy) Name() string {
+	return "content"
+}
+
+func (p *contentPolicy) Moderate(action *graph.Action) error {
+	for _, re := range p.patterns {
+		if re.MatchString(action.Action) {
+			return fmt.Errorf("statement matches %q: %w", re.String(), model.ErrNotAcceptable)
+		}
+	}
+	return nil
+}
+
+type attributeMatcher struct {
+	key     string
+	pattern *regexp.Regexp
+}
+
+type entityPolicy struct {
+	labels     []string
+	attributes []attributeMatcher
+}
+
+func (p *entityPolicy) Name() string {
+	return "entity"
+}
+
+func (p *entityPolicy) Moderate(action *graph.Action) error {
+	if action.Command == nil {
+		return nil
+	}
+	return p.check(action.Command.Entity())
+}
+
+func (p *entityPolicy) check(e ast.Entity) error {
+	if e == nil {
+		return nil
+	}
+
+	for _, l := range e.Labels() {
+		if slices.ContainsFunc(p.labels, func(s string) bool { return strings.EqualFold(s, l) }) {
+			return fmt.Errorf("label %s denied: %w", l, model.ErrNotAcceptable)
+		}
+	}
+
+	for _, m := range p.attributes {
+		v, ok := e.Attribute(m.key)
+		if !ok {
+			continue
+		}
+		if m.pattern == nil || m.pattern.MatchString(v) {
+			return fmt.Errorf("attribute %s denied: %w", m.key, model.ErrNotAcceptable)
+		}
+	}
+
+	if r, ok := e.(ast.Relation); ok {
+		err := p.check(r.Left())
+		if err != nil {
+			return err
+		}
+		return p.check(r.Right())
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package node
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModerationPolicies(t *testing.T) {
+	config := ModerationConfig{
+		DenyIdentities:   []string{"spammer"},
+		DenyLabels:       []string{"Advert"},
+		DenyAttributes:   []AttributeFilter{{Key: "url", Pattern: `^https?://spam\.`}, {Key: "secret"}},
+		MaxStatementSize: 80,
+		DenyPatterns:     []string{`(?i)buy now`},
+	}
+	pipeline, err := newModerationPipeline(config, StatementLimits{}.withDefaults())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		identity string
+		stmt     string
+		policy   string
+	}{
+		{name: "accepted", identity: "alice", stmt: "MERGE (p:Post{text:'hello'})"},
+		{name: "denied identity", identity: "spammer", stmt: "MERGE (p:Post{text:'hello'})", policy: "identity"},
+		{name: "too large", identity: "alice", stmt: "MERGE (p:Post{text:'" + strings.Repeat("x", 80) + "'})", policy: "size"},
+		{name: "denied pattern", identity: "alice", stmt: "MERGE (p:Post{text:'Buy Now'})", policy: "content"},
+		{name: "denied label", identity: "alice", stmt: "MERGE (p:advert{id:'1'})", policy: "entity"},
+		{name: "denied attribute value", identity: "alice", stmt: "MERGE (p:Post{url:'http://spam.example'})", policy: "entity"},
+		{name: "other attribute value", identity: "alice", stmt: "MERGE (p:Post{url:'http://example.com'})"},
+		{name: "denied attribute", identity: "alice", stmt: "MERGE (p:Post{secret:'x'})", policy: "entity"},
+		{name: "denied in relation", identity: "alice", stmt: "MERGE (p:Post{id:'1'})-[:About]->(a:Advert{id:'2'})", policy: "entity"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ast.Parse(tt.stmt)
+			require.NoError(t, err)
+			err = pipeline.Moderate(&graph.Action{Identity: tt.identity, Action: tt.stmt, Command: p.Command()})
+			if tt.policy == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, model.ErrNotAcceptable)
+			assert.ErrorContains(t, err, tt.policy+": ")
+		})
+	}
+
+	// policies are only added for what is configured
+	empty, err := newModerationPipeline(ModerationConfig{}, StatementLimits{}.withDefaults())
+	require.NoError(t, err)
+	assert.Empty(t, empty)
+
+	_, err = newModerationPipeline(ModerationConfig{DenyPatterns: []string{"("}}, StatementLimits{}.withDefaults())
+	assert.Error(t, err)
+	_, err = newModerationPipeline(ModerationConfig{DenyAttributes: []AttributeFilter{{Pattern: "x"}}}, StatementLimits{}.withDefaults())
+	assert.Error(t, err)
+}
+
+func TestModerateStatement(t *testing.T) {
+	n := newTestNode(t)
+	var err error
+	n.moderation, err = newModerationPipeline(ModerationConfig{DenyLabels: []string{"Advert"}}, StatementLimits{}.withDefaults())
+	require.NoError(t, err)
+
+	// private actions are moderated on their plaintext
+	stmt := "MERGE (a:Advert{id:'1'})"
+	p, err := ast.Parse(stmt)
+	require.NoError(t, err)
+	action := &graph.Action{ID: "a1", Identity: "alice", Action: "ciphertext", KeyID: "friends", Command: p.Command()}
+	err = n.moderateStatement(context.Background(), action, stmt)
+	var r *rejection
+	require.ErrorAs(t, err, &r)
+	assert.Equal(t, RejectReasonModeration, r.reason)
+	assert.Equal(t, http.StatusNotAcceptable, r.status)
+	assert.Equal(t, "ciphertext", action.Action)
+
+	stmt = "MERGE (p:Post{id:'1'})"
+	p, err = ast.Parse(stmt)
+	require.NoError(t, err)
+	assert.NoError(t, n.moderateStatement(context.Background(), &graph.Action{ID: "a2", Identity: "alice", Action: stmt, Command: p.Command()}, stmt))
+}
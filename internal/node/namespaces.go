@@ -0,0 +1,164 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+// namespacePrefix marks the filter keys of entities and topics in a
+// namespace, keeping each namespace's subscriptions apart
+const namespacePrefix = "ns:"
+
+// ErrUnknownNamespace is returned for a namespace the node doesn't host
+var ErrUnknownNamespace = errors.New("unknown namespace")
+
+var namespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// NamespaceConfig is read from an entry in the namespaces section of the
+// config file. Each namespace is a graph of its own, published to and queried
+// separately from the default graph and the other namespaces.
+type NamespaceConfig struct {
+	// GraphDatabaseURL is the namespace's graph database
+	GraphDatabaseURL string `mapstructure:"graph_db"`
+	// Subscriptions are the entity IDs, and topics as topic:name, the node
+	// subscribes to in the namespace. Empty subscribes to everything in it.
+	Subscriptions []string `mapstructure:"subscriptions"`
+}
+
+func validateNamespaces(check *configCheck, c Config) {
+	databases := map[string]string{c.GraphDatabaseURL: "graph_db"}
+	for name, ns := range c.Namespaces {
+		if !namespaceName.MatchString(name) {
+			check.addf(name, "namespaces are lower case letters, digits, '_', '.' and '-'")
+		}
+		if ns.GraphDatabaseURL == "" {
+			check.addf(name+".graph_db", "must be set")
+			continue
+		}
+		if other, ok := databases[ns.GraphDatabaseURL]; ok {
+			check.addf(name+".graph_db", "is already used by %s", other)
+		}
+		databases[ns.GraphDatabaseURL] = name + ".graph_db"
+	}
+}
+
+// openNamespaces opens the graph of each namespace, closing those already
+// opened if one fails
+func openNamespaces(config Config, graphConfig graph.Config) (map[string]Graph, error) {
+	graphs := map[string]Graph{}
+	for name, ns := range config.Namespaces {
+		graphConfig.GraphDatabaseURL = ns.GraphDatabaseURL
+		executor, err := graph.New(graphConfig)
+		if err != nil {
+			closeGraphs(graphs)
+			return nil, fmt.Errorf("creating executor for namespace %s: %w", name, err)
+		}
+		graphs[name] = executor
+	}
+	return graphs, nil
+}
+
+func closeGraphs(graphs map[string]Graph) error {
+	errs := []error{}
+	for _, g := range graphs {
+		if c, ok := g.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// graphFor returns the graph of a namespace, the default graph for the empty
+// namespace
+func (n *node) graphFor(namespace string) (Graph, error) {
+	if namespace == "" {
+		return n.executor, nil
+	}
+	g, ok := n.namespaces[namespace]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownNamespace, namespace)
+	}
+	return g, nil
+}
+
+// hostsNamespace reports whether the node holds the namespace's graph
+func (n *node) hostsNamespace(namespace string) bool {
+	_, err := n.graphFor(namespace)
+	return err == nil
+}
+
+// namespaceKeys returns the filter keys of entity IDs and topic keys in a
+// namespace. The default namespace's keys are left as they are so that nodes
+// without namespaces still understand them.
+func namespaceKeys(namespace string, keys []string) []string {
+	if namespace == "" {
+		return keys
+	}
+	nsKeys := make([]string, len(keys))
+	for i, k := range keys {
+		nsKeys[i] = namespacePrefix + namespace + "/" + k
+	}
+	return nsKeys
+}
+
+// inNamespace reports whether a filter key belongs to the namespace
+func inNamespace(key, namespace string) bool {
+	if namespace == "" {
+		return !strings.HasPrefix(key, namespacePrefix)
+	}
+	return strings.HasPrefix(key, namespacePrefix+namespace+"/")
+}
+
+// requestNamespace returns the namespace given by a request's namespace
+// parameter, writing an error if the node doesn't host it
+func (n *node) requestNamespace(w http.ResponseWriter, req *http.Request) (string, bool) {
+	namespace := req.URL.Query().Get("namespace")
+	if !n.hostsNamespace(namespace) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(ErrUnknownNamespace.Error() + ": " + namespace))
+		return "", false
+	}
+	return namespace, true
+}
+
+// SubscribeIn adds entity IDs, and topics as topic:name, to the node's
+// subscriptions in a namespace
+func (n *node) SubscribeIn(namespace string, keys ...string) error {
+	if !n.hostsNamespace(namespace) {
+		return fmt.Errorf("%w: %s", ErrUnknownNamespace, namespace)
+	}
+	n.Subscribe(namespaceKeys(namespace, keys)...)
+	return nil
+}
+
+// UnsubscribeIn removes entity IDs, and topics as topic:name, from the node's
+// subscriptions in a namespace
+func (n *node) UnsubscribeIn(namespace string, keys ...string) error {
+	if !n.hostsNamespace(namespace) {
+		return fmt.Errorf("%w: %s", ErrUnknownNamespace, namespace)
+	}
+	n.Unsubscribe(namespaceKeys(namespace, keys)...)
+	return nil
+}
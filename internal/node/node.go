@@ -19,103 +19,383 @@ package node
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
+	"crypto/ed25519"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"math/big"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jdudmesh/propolis/internal/ast"
 	"github.com/jdudmesh/propolis/internal/bloom"
 	"github.com/jdudmesh/propolis/internal/graph"
 	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/logging"
 	"github.com/jdudmesh/propolis/internal/model"
-	"github.com/quic-go/quic-go"
-	"github.com/quic-go/quic-go/http3"
+	"github.com/jdudmesh/propolis/internal/secrets"
 )
 
+// ErrClosed is returned by Run and Close once the node has been closed
+var ErrClosed = errors.New("node closed")
+
+// leaveTimeout bounds saying goodbye to the seeds when the node stops
+const leaveTimeout = 5 * time.Second
+
 type node struct {
 	nodeID             string
 	host               string
 	port               int
-	store              *store
+	store              Store
 	logger             *slog.Logger
-	roundTripper       *http3.RoundTripper
-	server             *http3.Server
+	transports         *transportSelector
+	handler            http.Handler
+	clientHandler      http.Handler
 	client             *http.Client
+	enableTCP          bool
+	adminAddr          string
+	adminToken         string
+	diagnostics        bool
+	apiAddr            string
+	apiToken           string
+	clientAddr         string
+	publish            PublishConfig
+	readACL            []ReadRule
+	pingedBy           *pingTracker
+	identities         IdentityProvider
+	transportFactory   TransportFactory
+	metrics            *nodeMetrics
 	notifyPendingPeers chan string
 	actionQueue        chan graph.Action
-	quit               chan struct{}
-	publicAddr         string
+	ctx                context.Context
+	cancel             context.CancelFunc
+	lifecycleMu        sync.Mutex
+	closed             bool
+	running            sync.WaitGroup
+	started            chan struct{}
+	startOnce          sync.Once
+	publicAddr         *publicAddress
+	addresses          model.AddressList
 	nodeType           NodeType
+	capabilities       Capabilities
 	executor           Graph
-	subscriptions      *bloom.Filter
+	namespaces         map[string]Graph
+	subscriptions      bloom.Membership
+	bloomSubscriptions *bloom.Filter
 	seeds              []string
 	identity           identity.Identity
+	events             *eventBus
+	reloadMu           sync.RWMutex
+	moderation         moderationPipeline
+	webhooks           webhooks
+	exporter           *exporter
+	journal            *journal
+	checkpoints        *checkpoints
+	inFlight           *inFlight
+	consistency        *consistencyChecker
+	group              string
+	replication        *replicator
+	knownPeers         KnownPeersConfig
+	control            ControlConfig
+	peerTable          PeerTableConfig
+	joinPolicy         *joinPolicy
+	joinWork           *joinWork
+	invitationFile     string
+	nodeKey            ed25519.PrivateKey
+	version            string
+	versions           *versionCheck
+	bandwidth          *bandwidth
+	graphql            *graphqlAPI
+	boltAddr           string
+	dashboardAddr      string
+	policies           moderationPipeline
+	quotas             QuotaConfig
+	subscriptionKeys   *subscriptionKeyring
+	keyRotationGrace   time.Duration
+	minManifestVersion int
+	verifyHandles      bool
+	webfinger          *http.Client
+	certificateQuorum  int
+	certificateSources int
+	seedDomains        []string
+	bootstrapURLs      []string
+	liveness           LivenessConfig
+	dedupe             *actionDedupe
+	breakerConfig      BreakerConfig
+	breaker            *circuitBreaker
+	dispatcher         *dispatcher
+	precision          *precisionTracker
+	dispatchWorkers    int
+	limits             StatementLimits
+	clock              ClockConfig
+	filterConfig       FilterConfig
+	subscriptionsMu    sync.Mutex
+	outboxMu           sync.Mutex
+	outboxEmpty        atomic.Bool
+	profileMu          sync.Mutex
+	subscribed         map[string]struct{}
+	peerFilterTypes    map[string][]bloom.Type
+	tls                *certificateSource
+	retention          RetentionConfig
+	loggers            *logging.Loggers
 }
 
 func New(config Config, subscriptions *bloom.Filter) (*node, error) {
 	if subscriptions == nil {
 		subscriptions = bloom.New()
 	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	// without shared loggers the handler's own level still applies
+	loggers := config.Loggers
+	if loggers == nil {
+		loggers = logging.New(config.Logger.Handler(), slog.LevelDebug)
+	}
+	err := loggers.ApplyLevels(config.LogLevels)
+	if err != nil {
+		return nil, fmt.Errorf("setting log levels: %w", err)
+	}
+	config.Logger = loggers.Logger(logging.ModuleNode)
+
+	keyProvider := config.DatabaseKey
+	if keyProvider == nil {
+		keyProvider = secrets.EnvKeyProvider(secrets.EnvKey)
+	}
+
+	sealer, err := secrets.FromProvider(context.Background(), keyProvider)
+	if err != nil {
+		return nil, fmt.Errorf("creating sealer: %w", err)
+	}
+
+	store := config.Store
+	if store == nil {
+		store, err = openStore(config.NodeDatabaseURL, sealer)
+		if err != nil {
+			return nil, fmt.Errorf("creating store: %w", err)
+		}
+	}
 
-	store, err := newStore(config.NodeDatabaseURL)
+	nodeKey, err := loadNodeKey(context.Background(), store)
 	if err != nil {
-		return nil, fmt.Errorf("creating store: %w", err)
+		return nil, fmt.Errorf("loading node key: %w", err)
 	}
 
-	executor, err := graph.New(config.Config)
+	graphConfig := config.Config
+	graphConfig.Logger = loggers.Logger(logging.ModuleExecutor)
+	executor, err := graph.New(graphConfig)
 	if err != nil {
 		return nil, fmt.Errorf("creating executor: %w", err)
 	}
 
-	publicAddr := config.PublicAddress
-	if publicAddr == "" && config.Type == NodeTypeSeed {
-		publicAddr = fmt.Sprintf("%s:%d", config.Host, config.Port)
+	namespaces, err := openNamespaces(config, graphConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	moderation, err := newModerationPipeline(config.Moderation, config.Limits.withDefaults())
+	if err != nil {
+		return nil, fmt.Errorf("creating moderation pipeline: %w", err)
+	}
+
+	subscriptionKeys, err := newSubscriptionKeyring(config.SubscriptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("loading subscription keys: %w", err)
+	}
+
+	keyRotationGrace := config.KeyRotationGrace
+	if keyRotationGrace == 0 {
+		keyRotationGrace = defaultKeyRotationGrace
+	}
+
+	minManifestVersion := config.MinManifestVersion
+	if minManifestVersion == 0 {
+		minManifestVersion = defaultMinManifestVersion
+	}
+
+	certificateQuorum := config.CertificateQuorum
+	if certificateQuorum == 0 {
+		certificateQuorum = defaultCertificateQuorum
+	}
+
+	certificateSources := config.CertificateSources
+	if certificateSources == 0 {
+		certificateSources = defaultCertificateSources
+	}
+
+	capabilities, err := config.capabilities()
+	if err != nil {
+		return nil, err
+	}
+
+	// nodes which accept joins advertise their listen address until a better
+	// one is discovered
+	fallbackAddr := ""
+	if capabilities.Has(CapabilityAcceptJoins) {
+		fallbackAddr = net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	}
+
+	version := config.Version
+	if version == "" {
+		version = softwareVersion()
 	}
 
 	n := &node{
 		nodeID:             model.NewID(),
 		host:               config.Host,
 		port:               config.Port,
-		publicAddr:         publicAddr,
+		publicAddr:         newPublicAddress(config.PublicAddress, fallbackAddr, config.Port, config.AddressQuorum),
+		addresses:          config.AdvertiseAddresses,
 		store:              store,
 		logger:             config.Logger,
+		loggers:            loggers,
 		nodeType:           config.Type,
+		capabilities:       capabilities,
 		executor:           executor,
+		namespaces:         namespaces,
 		notifyPendingPeers: make(chan string),
+		started:            make(chan struct{}),
 		actionQueue:        make(chan graph.Action),
-		quit:               make(chan struct{}),
+		inFlight:           newInFlight(),
+		consistency:        newConsistencyChecker(config.Consistency),
+		group:              config.Group.Name,
+		replication:        newReplicator(config.Replication),
+		knownPeers:         config.KnownPeers.withDefaults(),
+		control:            config.Control.withDefaults(),
+		peerTable:          config.PeerTable.withDefaults(),
+		joinWork:           newJoinWork(),
+		invitationFile:     config.JoinPolicy.InvitationFile,
+		nodeKey:            nodeKey,
+		version:            version,
+		versions:           newVersionCheck(config.VersionCheck, version),
 		subscriptions:      subscriptions,
+		bloomSubscriptions: subscriptions,
 		seeds:              config.Seeds,
 		identity:           config.Identity,
+		enableTCP:          config.EnableTCP,
+		adminAddr:          config.AdminAddress,
+		adminToken:         config.AdminToken,
+		diagnostics:        config.Diagnostics,
+		apiAddr:            config.APIAddress,
+		apiToken:           config.APIToken,
+		clientAddr:         config.ClientAddress,
+		publish:            config.Publish,
+		readACL:            config.ReadACL,
+		boltAddr:           config.BoltAddress,
+		dashboardAddr:      config.DashboardAddress,
+		identities:         config.Identities,
+		transportFactory:   config.Transports,
+		events:             newEventBus(),
+		moderation:         moderation,
+		quotas:             config.Quotas,
+		subscriptionKeys:   subscriptionKeys,
+		keyRotationGrace:   keyRotationGrace,
+		minManifestVersion: minManifestVersion,
+		verifyHandles:      config.VerifyHandles,
+		webfinger:          &http.Client{Timeout: defaultTimeout},
+		certificateQuorum:  certificateQuorum,
+		certificateSources: certificateSources,
+		seedDomains:        config.SeedDomains,
+		bootstrapURLs:      config.BootstrapURLs,
+		liveness:           config.Liveness.withDefaults(),
+		dedupe:             newActionDedupe(config.DedupeCacheSize),
+		breakerConfig:      config.Breaker.withDefaults(),
+		dispatchWorkers:    config.DispatchWorkers,
+		precision:          newPrecisionTracker(),
+		limits:             config.Limits.withDefaults(),
+		clock:              config.Clock.withDefaults(),
+		retention:          config.Retention.withDefaults(),
+		filterConfig:       config.Filter.withDefaults(),
+		subscribed:         map[string]struct{}{},
+		peerFilterTypes:    map[string][]bloom.Type{},
+	}
+
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.metrics = newNodeMetrics(n)
+	n.pingedBy = newPingTracker(n.liveness.PingInterval * time.Duration(n.liveness.MaxMissedPings))
+	n.tls = newCertificateSource(config.TLS, n.nodeID)
+	if config.GraphQL {
+		n.graphql = newGraphQLAPI(executor)
+	}
+	n.dispatcher = newDispatcher(config.PeerQueueSize, n.sendQueuedAction, n.metrics)
+	n.bandwidth = newBandwidth(config.Bandwidth, n.metrics)
+	n.webhooks = newWebhooks(config.Webhooks, n.logger, n.metrics)
+	n.events.AddHook(n.sendWebhooks)
+
+	n.joinPolicy, err = newJoinPolicy(config.JoinPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("loading join policy: %w", err)
+	}
+
+	n.exporter, err = newExporter(config.Export, n.logger, n.metrics)
+	if err != nil {
+		return nil, fmt.Errorf("creating exporter: %w", err)
+	}
+
+	n.journal, err = openJournal(config.Journal, n.logger)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+
+	n.checkpoints, err = newCheckpoints(config.Checkpoint, n.logger)
+	if err != nil {
+		return nil, fmt.Errorf("opening checkpoints: %w", err)
+	}
+
+	err = n.loadDedupe()
+	if err != nil {
+		return nil, fmt.Errorf("loading action IDs: %w", err)
+	}
+
+	// each namespace's subscriptions are kept apart by prefixing their keys
+	for name, ns := range config.Namespaces {
+		for _, key := range namespaceKeys(name, ns.Subscriptions) {
+			n.subscribed[key] = struct{}{}
+		}
+	}
+	// group members keep everything in the group's topics
+	for _, key := range config.Group.keys() {
+		n.subscribed[key] = struct{}{}
+	}
+	if len(n.subscribed) > 0 {
+		n.rebuildSubscriptions()
 	}
 
-	n.server = &http3.Server{
-		Handler: n.newServeMux(),
+	n.handler = compressionMiddleware(n.countRequests(n.newServeMux()))
+	if n.clientAddr != "" {
+		n.clientHandler = compressionMiddleware(n.countRequests(n.newClientServeMux()))
 	}
 
 	return n, nil
 }
 
-func (n *node) setInitialSeeds() error {
-	s := make([]*model.SeedSpec, 0, len(n.seeds))
-	for _, seed := range n.seeds {
-		spec, err := n.getNodeInfo(seed)
+// setInitialSeeds replaces the seeds with those discovered which answer. It
+// returns errSeedsUnreachable if none of them do.
+func (n *node) setInitialSeeds(ctx context.Context) error {
+	seeds := n.discoverSeeds(ctx)
+	n.publicAddr.setVoters(seeds)
+	s := make([]*model.SeedSpec, 0, len(seeds))
+	reached := 0
+	for _, seed := range seeds {
+		spec, err := n.getNodeInfo(ctx, seed)
 		if err != nil {
-			n.logger.Error("getting seed info", "error", err)
+			n.logger.Error("getting seed info", "error", err, "remote", seed)
+			continue
+		}
+		reached++
+
+		// a seed may find itself in the discovered list
+		if spec.NodeID == n.nodeID {
 			continue
 		}
 
@@ -126,17 +406,28 @@ func (n *node) setInitialSeeds() error {
 			NodeID:     spec.NodeID,
 		})
 	}
-	return n.store.UpsertSeeds(s)
+
+	err := n.store.UpsertSeeds(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if len(seeds) > 0 && reached == 0 {
+		return errSeedsUnreachable
+	}
+
+	return nil
 }
 
-func (n *node) getNodeInfo(remoteAddr string) (*model.PeerSpec, error) {
-	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+func (n *node) getNodeInfo(ctx context.Context, remoteAddr string) (*model.PeerSpec, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
 	defer cancelFn()
 
 	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/whoami", remoteAddr), nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating whoami request: %w", err)
 	}
+	n.setProtocolHeaders(req.Header)
 
 	resp, err := n.client.Do(req)
 	if err != nil {
@@ -147,8 +438,10 @@ func (n *node) getNodeInfo(remoteAddr string) (*model.PeerSpec, error) {
 		return nil, fmt.Errorf("bad whoami response: %d", resp.StatusCode)
 	}
 
-	if n.publicAddr == "" {
-		n.publicAddr = resp.Header.Get(HeaderRemoteAddress)
+	protocol, _ := parseProtocolHeaders(resp.Header)
+	if protocol < MinProtocolVersion {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %d", ErrProtocolUnsupported, protocol)
 	}
 
 	body := resp.Body
@@ -161,113 +454,288 @@ func (n *node) getNodeInfo(remoteAddr string) (*model.PeerSpec, error) {
 		return nil, fmt.Errorf("decoding whoami: %w", err)
 	}
 
+	n.observePublicAddress(remoteAddr, resp.Header.Get(HeaderRemoteAddress))
+
 	return spec, nil
 }
 
+// newServeMux routes the requests served by each of the node's capabilities
 func (n *node) newServeMux() *http.ServeMux {
 	mux := http.NewServeMux()
-	switch n.nodeType {
-	case NodeTypeSeed:
+	mux.HandleFunc("GET /whois/{id}", n.handleWhoIs)
+	if n.capabilities.Has(CapabilityAcceptJoins) {
 		mux.HandleFunc("POST /hello", n.handleJoin)
 		mux.HandleFunc("POST /goodbye", n.handleLeave)
-		mux.HandleFunc("GET /whois/{id}", n.handleWhoIs)
 		mux.HandleFunc("GET /whoami", n.handleWhoAmI)
-	case NodeTypePeer:
+		mux.HandleFunc("POST /gossip", n.handleGossip)
+		mux.HandleFunc("GET /nodes", n.handleNodes)
+		mux.HandleFunc("GET /versions", n.handleVersions)
+		mux.HandleFunc("GET /groups/{name}", n.handleGroup)
+		if n.replication != nil {
+			mux.Handle("GET /replication/peers", requireToken(n.replication.config.Token, n.handleReplicatePeers))
+		}
+	}
+	if n.capabilities.Has(CapabilityRelay) {
 		// mux.HandleFunc("POST /subscription", n.handleCreateSubscription)
 		// mux.HandleFunc("DELETE /subscription", n.handleDeleteSubscription)
 		// mux.HandleFunc("POST /subscription/peer", n.handleSubscriptionPeerUpdate)
 		mux.HandleFunc("POST /ping", n.handlePing)
 		mux.HandleFunc("POST /pong", n.handlePong)
-		mux.HandleFunc("GET /whois/{id}", n.handleWhoIs)
-		mux.HandleFunc("POST /exec", n.handleExecute)
+		mux.HandleFunc("POST /publish", n.handleExecute)
+		mux.HandleFunc("GET /handles/{handle}", n.handleResolveHandle)
+		mux.HandleFunc("GET /state", n.handleState)
+	}
+	// queries are served to clients on their own address when there is one
+	if n.capabilities.Has(CapabilityServeQueries) && n.clientAddr == "" {
+		mux.HandleFunc("GET /actions", n.handleActions)
+		mux.HandleFunc("POST /query", n.handleQuery)
+		mux.HandleFunc("GET /views/{name}", n.handleView)
+		mux.HandleFunc("POST /visualize", n.handleVisualize)
 	}
 	return mux
 }
 
-func (n *node) Run() error {
-	defer n.server.CloseGracefully(10 * time.Second)
-
-	addr := &net.UDPAddr{IP: net.ParseIP(n.host), Port: n.port}
-	switch n.nodeType {
-	case NodeTypePeer:
-		n.logger.Info("starting peer", "addr", addr)
-	case NodeTypeSeed:
-		n.logger.Info("starting seed", "addr", addr)
+// Run serves the node until ctx is cancelled or the node is closed, returning
+// an error if it can't start. It returns ErrClosed if the node has already been
+// closed. Cancelling ctx cancels the node's outbound requests and database
+// calls, the node must still be closed to release its databases.
+func (n *node) Run(ctx context.Context) error {
+	n.lifecycleMu.Lock()
+	if n.closed {
+		n.lifecycleMu.Unlock()
+		return ErrClosed
 	}
+	n.running.Add(1)
+	n.lifecycleMu.Unlock()
+	defer n.running.Done()
+
+	stop := context.AfterFunc(ctx, n.cancel)
+	defer stop()
 
-	udpConn, err := net.ListenUDP("udp", addr)
+	addr := net.JoinHostPort(n.host, strconv.Itoa(n.port))
+	n.logger.Info("starting "+n.nodeType.String(), "addr", addr, "capabilities", n.capabilities.String())
+
+	challenges, err := n.tls.startChallengeServer(n.logger)
 	if err != nil {
-		return fmt.Errorf("creating sock: %w", err)
+		return err
+	}
+	if challenges != nil {
+		defer challenges.Close()
 	}
 
-	tr := quic.Transport{
-		Conn: udpConn,
+	// the client has to exist before anything can contact seeds, including
+	// the admin API's resync
+	transports, err := n.createTransports(addr, n.handler)
+	if err != nil {
+		return err
 	}
-	defer tr.Close()
+	defer transports.Close()
 
-	n.roundTripper = &http3.RoundTripper{
-		TLSClientConfig: &tls.Config{
-			NextProtos:         []string{"h3", "propolis"},
-			InsecureSkipVerify: true,
-		},
-		QUICConfig: &quic.Config{}, // QUIC connection options
-		Dial: func(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
-			n.logger.Debug("dialing", "addr", addr)
-			a, err := net.ResolveUDPAddr("udp", addr)
-			if err != nil {
-				return nil, err
-			}
-			return tr.DialEarly(ctx, a, tlsConf, quicConf)
-		},
+	if n.clientHandler != nil {
+		n.logger.Info("serving clients", "addr", n.clientAddr)
+		clients, err := n.createTransports(n.clientAddr, n.clientHandler)
+		if err != nil {
+			return fmt.Errorf("starting client listener: %w", err)
+		}
+		defer clients.Close()
 	}
-	defer n.roundTripper.Close()
 
+	n.transports = transports
+	n.breaker = newCircuitBreaker(newCompressionRoundTripper(transports), n.breakerConfig, n.logger, n.metrics)
 	n.client = &http.Client{
-		Transport: n.roundTripper,
+		Transport: n.breaker,
 	}
+	n.startOnce.Do(func() { close(n.started) })
+
+	// finish what was accepted before the node stopped ahead of anything new
+	n.replayJournal(ctx)
 
-	listener, err := tr.ListenEarly(n.generateTLSConfig(), nil)
+	admin, err := n.startAdminServer()
 	if err != nil {
-		return fmt.Errorf("setting up listener sock: %w", err)
+		return err
 	}
+	defer admin.Close()
 
-	go func() {
-		err := n.server.ServeListener(listener)
+	api, err := n.startAPIServer()
+	if err != nil {
+		return err
+	}
+	defer api.Close()
+
+	dashboard, err := n.startDashboardServer()
+	if err != nil {
+		return err
+	}
+	defer dashboard.Close()
+
+	boltServer, err := n.startBoltServer()
+	if err != nil {
+		return err
+	}
+	if boltServer != nil {
+		defer boltServer.Close()
+	}
+
+	n.dispatcher.Start(n.dispatchWorkers)
+
+	err = n.runLoop(n.ctx)
+
+	// requests cut short by the node stopping aren't failures
+	if errors.Is(err, context.Canceled) && n.ctx.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+// isStarted reports whether Run has set up the client used to contact other
+// nodes
+func (n *node) isStarted() bool {
+	select {
+	case <-n.started:
+		return true
+	default:
+		return false
+	}
+}
+
+// createTransports listens on addr with each transport, serving handler
+func (n *node) createTransports(addr string, handler http.Handler) (*transportSelector, error) {
+	factory := n.transportFactory
+	if factory == nil {
+		factory = n.defaultTransports
+	}
+
+	transports, err := factory(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := newTransportSelector(transports, n.logger)
+	for _, t := range transports {
+		err := t.Listen(handler)
 		if err != nil {
-			n.logger.Error("closing peer server", "error", err)
+			selector.Close()
+			return nil, fmt.Errorf("starting %s transport: %w", t.Name(), err)
 		}
-	}()
-
-	switch n.nodeType {
-	case NodeTypePeer:
-		return n.runLoopPeer()
-	case NodeTypeSeed:
-		return n.runLoopSeed()
-	case NodeTypeCache:
-		return n.runLoopCache()
 	}
 
-	return nil
+	return selector, nil
 }
 
-func (n *node) runLoopPeer() error {
-	defer n.leaveSeeds()
+// defaultTransports listens on QUIC and, if enabled, TCP
+func (n *node) defaultTransports(addr string) ([]Transport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolving listen address: %w", err)
+	}
 
-	err := n.setInitialSeeds()
+	tlsConfig, err := n.tls.transportConfig()
 	if err != nil {
-		return fmt.Errorf("setting initial seeds: %w", err)
+		return nil, err
 	}
 
-	err = n.joinSeeds()
+	qt, err := newQUICTransport(udpAddr, tlsConfig, n.logger, n.handleSessionClosed, n.metrics)
 	if err != nil {
-		return fmt.Errorf("joining: %w", err)
+		return nil, err
 	}
 
+	transports := []Transport{qt}
+	if n.enableTCP {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing listen address: %w", err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("parsing listen port: %w", err)
+		}
+		transports = append(transports, newTCPTransport(host, p, tlsConfig, n.logger, n.metrics))
+	}
+
+	return transports, nil
+}
+
+func (n *node) handleSessionClosed(remoteAddr string) {
+	select {
+	case <-n.ctx.Done():
+		return
+	default:
+	}
+
+	n.dropPeer(n.ctx, remoteAddr, "session closed")
+}
+
+// runLoop does the periodic work of each of the node's capabilities until ctx
+// is done
+func (n *node) runLoop(ctx context.Context) error {
+	relays := n.capabilities.Has(CapabilityRelay)
+	if relays {
+		defer n.leaveSeeds(ctx)
+	}
+
+	// known peers are tried while the seeds are joined, seeds keep their
+	// tables for the peers which joined them
+	if relays && !n.capabilities.Has(CapabilityAcceptJoins) {
+		known, err := n.store.GetAllPeers(ctx)
+		if err != nil {
+			n.logger.Error("fetching known peers", "error", err)
+		}
+		go n.reuseKnownPeers(ctx, known)
+	}
+
+	// local operations are served while the seeds are being reached
+	go n.connectSeeds(ctx)
+
 	// t1 := time.NewTicker(5 * time.Second)
 	// defer t1.Stop()
-	t2 := time.NewTicker(time.Minute)
+	t2 := time.NewTimer(n.liveness.nextPing())
 	defer t2.Stop()
 
+	// nil channels disable the work of capabilities the node doesn't have
+	var gc, prune, checkpoint, consistency, replication, reseed, versions <-chan time.Time
+	if n.capabilities.Has(CapabilityServeQueries) {
+		gcInterval := n.quotaConfig().GCInterval
+		if gcInterval == 0 {
+			gcInterval = defaultGCInterval
+		}
+		ticker := time.NewTicker(gcInterval)
+		defer ticker.Stop()
+		gc = ticker.C
+	}
+	if relays {
+		ticker := time.NewTicker(n.retention.PruneInterval)
+		defer ticker.Stop()
+		prune = ticker.C
+	}
+	if n.checkpoints != nil && n.capabilities.Has(CapabilityStoreGraph) {
+		ticker := time.NewTicker(n.checkpoints.config.Interval)
+		defer ticker.Stop()
+		checkpoint = ticker.C
+	}
+	if n.consistency != nil && relays {
+		ticker := time.NewTicker(n.consistency.config.Interval)
+		defer ticker.Stop()
+		consistency = ticker.C
+	}
+	if n.replication != nil && len(n.replication.config.Replicas) > 0 && n.capabilities.Has(CapabilityAcceptJoins) {
+		ticker := time.NewTicker(n.replication.config.Interval)
+		defer ticker.Stop()
+		replication = ticker.C
+		// a restarted seed gets its peer table back straight away
+		go n.replicatePeers(ctx)
+	}
+	if relays && !n.capabilities.Has(CapabilityAcceptJoins) && n.peerTable.ReseedInterval > 0 {
+		ticker := time.NewTicker(n.peerTable.ReseedInterval)
+		defer ticker.Stop()
+		reseed = ticker.C
+	}
+	if n.versions.config.Interval > 0 {
+		ticker := time.NewTicker(n.versions.config.Interval)
+		defer ticker.Stop()
+		versions = ticker.C
+	}
+
 	for {
 		select {
 		// case <-t1.C:
@@ -276,125 +744,335 @@ func (n *node) runLoopPeer() error {
 		// 	n.logger.Error("refreshing subscriptions", "error", err)
 		// }
 		case <-t2.C:
-			go func() {
-				err := n.joinSeeds()
+			t2.Reset(n.liveness.nextPing())
+			if n.capabilities.Has(CapabilityAcceptJoins) {
+				err := n.tidyPeers(ctx)
 				if err != nil {
 					n.logger.Error("refreshing seeds", "error", err)
 				}
+				go func() {
+					err := n.gossipSeeds(ctx)
+					if err != nil {
+						n.logger.Error("gossiping with seeds", "error", err)
+					}
+				}()
+			}
+			if relays {
+				go func() {
+					err := n.joinSeeds(ctx)
+					if err != nil {
+						n.logger.Error("refreshing seeds", "error", err)
+					}
+				}()
+				go func() {
+					err := n.pingPeers(ctx)
+					if err != nil {
+						n.logger.Error("pinging peers", "error", err)
+					}
+				}()
+				n.transports.CloseIdleConnections()
+			}
+		case action := <-n.actionQueue:
+			n.processAction(ctx, action)
+		case <-gc:
+			err := n.collectExpiredActions(ctx)
+			if err != nil {
+				n.logger.Error("collecting expired actions", "error", err)
+			}
+		case <-prune:
+			err := n.pruneActions(ctx)
+			if err != nil {
+				n.logger.Error("pruning actions", "error", err)
+			}
+		case <-checkpoint:
+			// copying a large graph takes a while
+			go func() {
+				_, err := n.takeCheckpoint(ctx)
+				if err != nil {
+					n.logger.Error("taking checkpoint", "error", err)
+				}
 			}()
+		case <-consistency:
 			go func() {
-				err = n.pingPeers()
+				err := n.checkConsistency(ctx)
 				if err != nil {
-					n.logger.Error("pinging peers", "error", err)
+					n.logger.Error("checking consistency", "error", err)
 				}
 			}()
-			n.roundTripper.CloseIdleConnections()
-		case action := <-n.actionQueue:
-			n.processAction(action)
-
-		case <-n.quit:
+		case <-replication:
+			go n.replicatePeers(ctx)
+		case <-reseed:
+			go n.reseedPeers(ctx)
+		case <-versions:
+			go n.checkVersions(ctx)
+		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
-func (n *node) processAction(action graph.Action) {
-	err := n.store.CreateAction(action)
+func (n *node) processAction(ctx context.Context, action graph.Action) {
+	n.metrics.actionsInFlight.Inc()
+	defer n.metrics.actionsInFlight.Dec()
+	defer n.journal.applied(action.ID)
+	n.inFlight.start(action.ID, action.Timestamp)
+	defer n.inFlight.done(action.ID)
+
+	n.dedupe.Add(action.ID)
+	err := n.store.CreateAction(ctx, action)
 	if err != nil {
 		n.logger.Error("saving action", "error", err)
 	}
 
-	res, err := n.executor.Execute(action)
+	entityIDs := append([]string{}, action.EntityIDs...)
+
+	// private actions we can't read are only passed on
+	if action.Command != nil {
+		if n.capabilities.Has(CapabilityStoreGraph) {
+			entityIDs = n.executeAction(action, entityIDs)
+		}
+
+		n.recordIdentity(ctx, action)
+		n.recordHandleClaim(ctx, action)
+
+		// topics would give away the contents of private actions
+		if action.KeyID == "" {
+			action.Topics = ast.Topics(action.Command)
+		}
+	}
+	action.EntityIDs = entityIDs
+	n.exporter.export(action)
+
+	if !n.capabilities.Has(CapabilityRelay) {
+		return
+	}
+
+	// actions from blocked or muted identities are never passed on
+	if action.Identity != "" {
+		block, err := n.nodeBlock(ctx, action.Identity)
+		if err != nil {
+			n.logger.Error("checking block", "error", err, "identity", action.Identity)
+			return
+		}
+		if block != nil {
+			n.logger.Debug("not propagating action", "id", action.ID, "identity", action.Identity, "mode", block.Mode)
+			return
+		}
+	}
+
+	// actions published here while the node is offline are sent when it has
+	// peers again
+	if action.NodeID == n.nodeID && n.queueIfOffline(ctx, action) {
+		return
+	}
+
+	//propagate action to peers
+	n.propagateAction(ctx, action, namespaceKeys(action.Namespace, append(entityIDs, topicKeys(action.Topics)...))...)
+}
+
+// executeAction executes an action into the graph, returning the entity IDs
+// with the ID of the node it wrote added
+func (n *node) executeAction(action graph.Action, entityIDs []string) []string {
+	executor, err := n.graphFor(action.Namespace)
 	if err != nil {
+		n.logger.Error("executing action", "error", err, "id", action.ID)
+		return entityIDs
+	}
+
+	// actions are processed concurrently so a profile update is checked and
+	// written before another can be
+	if identityStatement(action.Command, LabelIdentity) != nil {
+		n.profileMu.Lock()
+		defer n.profileMu.Unlock()
+	}
+
+	if n.staleProfile(executor, action) {
+		n.logger.Debug("ignoring older profile", "id", action.ID, "identity", action.Identity)
+		return entityIDs
+	}
+
+	start := time.Now()
+	res, err := executor.Execute(action)
+	n.metrics.executorLatency.WithLabelValues(commandName(action.Command)).Observe(time.Since(start).Seconds())
+	switch {
+	case errors.Is(err, graph.ErrSchemaViolation):
+		n.metrics.executorErrors.Inc()
+		n.logger.Warn("action violates schema", "error", err, "id", action.ID)
+	case err != nil:
+		n.metrics.executorErrors.Inc()
 		n.logger.Error("executing action", "error", err)
 	}
 
 	n.logger.Debug("action executed", "result", res)
-	entityIDs := []string{}
 	switch res.(type) {
 	case *graph.Node:
-		entityIDs = append(entityIDs, res.(*graph.Node).ID)
+		if id := res.(*graph.Node).ID; !slices.Contains(entityIDs, id) {
+			entityIDs = append(entityIDs, id)
+		}
 	}
+	return entityIDs
+}
 
-	//propagate action to peers
-	n.propagateAction(action, entityIDs...)
+// Close stops the node, waits for Run to return and closes its databases. It
+// returns ErrClosed if the node has already been closed.
+func (n *node) Close() error {
+	n.lifecycleMu.Lock()
+	if n.closed {
+		n.lifecycleMu.Unlock()
+		return ErrClosed
+	}
+	n.closed = true
+	n.lifecycleMu.Unlock()
+
+	n.cancel()
+	n.running.Wait()
+	n.dispatcher.Close()
+	n.events.Close()
+
+	n.reloadMu.Lock()
+	defer n.reloadMu.Unlock()
+	n.webhooks.Close()
+	errs := []error{n.moderation.Close(), n.policies.Close(), n.exporter.Close(), n.journal.Close()}
+	if c, ok := n.executor.(io.Closer); ok {
+		errs = append(errs, c.Close())
+	}
+	errs = append(errs, closeGraphs(n.namespaces))
+	errs = append(errs, n.store.Close())
+	return errors.Join(errs...)
+}
+
+// Graph gives in process access to the node's graph. Changes made through it
+// are local to this node, use Execute to publish them to the network.
+func (n *node) Graph() Graph {
+	return n.executor
+}
+
+// Query runs a MATCH statement against the node's graph
+func (n *node) Query(stmt string) (*graph.SearchResults, error) {
+	return n.QueryIn("", stmt)
 }
 
-func (n *node) runLoopSeed() error {
-	err := n.setInitialSeeds()
+// QueryIn runs a MATCH statement against a namespace's graph
+func (n *node) QueryIn(namespace, stmt string) (*graph.SearchResults, error) {
+	res, err := n.query(namespace, stmt, nil)
 	if err != nil {
-		return fmt.Errorf("setting initial seeds: %w", err)
+		return nil, err
 	}
 
-	// t1 := time.NewTicker(5 * time.Second)
-	// defer t1.Stop()
-	t2 := time.NewTicker(time.Minute)
-	defer t2.Stop()
-
-	for {
-		select {
-		// case sub := <-n.notifyPendingPeers:
-		// 	err := n.doNotifyPendingPeers(sub)
-		// 	if err != nil {
-		// 		n.logger.Error("notifying peers", "error", err)
-		// 	}
-		// case <-t1.C:
-		// 	n.roundTripper.CloseIdleConnections()
-		case <-t2.C:
-			err := n.tidyPeers()
-			if err != nil {
-				n.logger.Error("refreshing seeds", "error", err)
-			}
-		case <-n.quit:
-			return nil
-		}
+	results, ok := res.(*graph.SearchResults)
+	if !ok {
+		return &graph.SearchResults{}, nil
 	}
+	return results, nil
 }
 
-func (n *node) runLoopCache() error {
-	dispatchQueue := make(chan any)
-	defer close(dispatchQueue)
+// Events returns a channel which receives all events emitted by the node from
+// now on. The channel is closed when the node is closed. Slow readers miss
+// events rather than holding up the node.
+func (n *node) Events() <-chan Event {
+	return n.events.Subscribe()
+}
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for a := range dispatchQueue {
-			fmt.Println(a)
-		}
-	}()
+// AddEventHook registers a function to be called for every event emitted by
+// the node
+func (n *node) AddEventHook(hook EventHook) {
+	n.events.AddHook(hook)
+}
 
-outer:
-	for {
-		select {
-		case action := <-n.actionQueue:
+// BlockIdentity blocks or mutes an identity. Actions from blocked identities
+// are rejected, actions from muted identities are accepted but not propagated.
+// blockedBy is the local identity the block is on behalf of, empty for the
+// node operator. Only the operator's blocks apply to the whole node, and a
+// local identity's block doesn't replace one of them.
+func (n *node) BlockIdentity(ctx context.Context, identifier, mode, blockedBy string) error {
+	if mode != model.BlockModeBlock && mode != model.BlockModeMute {
+		return fmt.Errorf("unknown block mode: %s", mode)
+	}
+
+	return n.store.PutBlock(ctx, model.BlockSpec{
+		Identity:  identifier,
+		CreatedAt: time.Now().UTC(),
+		Mode:      mode,
+		BlockedBy: blockedBy,
+	})
+}
 
-			res, err := n.executor.Execute(action)
-			if err != nil {
-				n.logger.Error("executing action", "error", err)
-				continue
-			}
-			dispatchQueue <- res
-		case <-n.quit:
-			break outer
+// nodeBlock returns the operator's block on an identity, nil if there isn't
+// one. Blocks made on behalf of local identities are theirs alone.
+func (n *node) nodeBlock(ctx context.Context, identifier string) (*model.BlockSpec, error) {
+	block, err := n.store.GetBlock(ctx, identifier)
+	if err != nil || block == nil || block.BlockedBy != "" {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (n *node) UnblockIdentity(ctx context.Context, identifier string) error {
+	return n.store.DeleteBlock(ctx, identifier)
+}
+
+func (n *node) Blocks(ctx context.Context) ([]*model.BlockSpec, error) {
+	return n.store.GetBlocks(ctx)
+}
+
+// PurgeIdentity removes everything owned by the identity from the local
+// graph and the graph of each namespace
+func (n *node) PurgeIdentity(identifier string) (int, error) {
+	count, err := n.executor.PurgeIdentity(identifier)
+	if err != nil {
+		return 0, fmt.Errorf("purging identity: %w", err)
+	}
+	for name, g := range n.namespaces {
+		c, err := g.PurgeIdentity(identifier)
+		if err != nil {
+			return count, fmt.Errorf("purging identity in namespace %s: %w", name, err)
 		}
+		count += c
 	}
+	n.logger.Info("purged identity", "identity", identifier, "entities", count)
+	return count, nil
+}
 
-	close(dispatchQueue)
-	wg.Wait()
+func (n *node) dropPeer(ctx context.Context, remoteAddr, reason string) {
+	err := n.store.DeletePeer(ctx, remoteAddr)
+	if err != nil {
+		n.logger.Error("deleting peer", "error", err, "remote", remoteAddr)
+		return
+	}
+	n.recordPeerDeleted(ctx, remoteAddr)
+	n.forgetPeer(remoteAddr)
+	n.events.Publish(PeerDropped{
+		At:         time.Now().UTC(),
+		RemoteAddr: remoteAddr,
+		Reason:     reason,
+	})
+}
 
-	return nil
+// forgetPeer clears the state held in memory for a peer which has gone
+func (n *node) forgetPeer(remoteAddr string) {
+	if n.breaker != nil {
+		n.breaker.Forget(remoteAddr)
+	}
+	n.metrics.peerClockSkew.DeleteLabelValues(remoteAddr)
+	n.precision.Forget(remoteAddr)
+	n.metrics.peerPrecision.DeleteLabelValues(remoteAddr)
+	n.recordFilterTypes(remoteAddr, nil)
 }
 
-func (n *node) Close() error {
-	close(n.quit)
-	return nil
+func (n *node) rejectAction(action graph.Action, reason string) {
+	n.metrics.rejected(reason)
+	n.events.Publish(ActionRejected{
+		At:     time.Now().UTC(),
+		Action: action,
+		Reason: reason,
+	})
 }
 
 func (n *node) handleJoin(w http.ResponseWriter, req *http.Request) {
 	n.logger.Debug("join", "remote", req.RemoteAddr)
+	ctx := req.Context()
 
-	seeds, err := n.store.GetSeeds()
+	seeds, err := n.store.GetSeeds(ctx)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -403,42 +1081,89 @@ func (n *node) handleJoin(w http.ResponseWriter, req *http.Request) {
 	// add us to the seeds
 	seeds = append(seeds, &model.SeedSpec{
 		CreatedAt:  time.Now().UTC(),
-		RemoteAddr: n.publicAddr,
+		RemoteAddr: n.publicAddr.String(),
 		NodeID:     n.nodeID,
 	})
 
-	peers, err := n.store.GetRandomPeers(req.RemoteAddr, MaxPeers)
+	protocol, features := parseProtocolHeaders(req.Header)
+	if protocol < MinProtocolVersion {
+		n.writeUpgradeRequired(w, req, protocol)
+		return
+	}
+
+	body, err := readControlBody(req)
 	if err != nil {
-		n.logger.Error("fetching peers", "error", err, "remote", req.RemoteAddr)
+		n.logger.Error("reading filter", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	known, err := n.store.GetPeer(ctx, req.RemoteAddr)
+	if err != nil {
+		n.logger.Error("fetching peer", "error", err, "remote", req.RemoteAddr)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	nodeKey, err := n.verifyControl(req, body, known)
+	if err != nil {
+		n.writeControlError(w, req, err)
+		return
+	}
+	err = n.joinPolicy.check(req, nodeKey, n.NodeKey())
+	if err != nil {
+		n.writeJoinRefusal(w, req, err)
+		return
+	}
 
 	nodeID := req.Header.Get(HeaderNodeID)
+	err = n.confirmListenPort(ctx, req, nodeID, nodeKey)
+	if err != nil {
+		n.writeJoinRefusal(w, req, err)
+		return
+	}
+	if n.joinPolicy != nil {
+		n.dropMovedPeers(ctx, nodeKey, req.RemoteAddr)
+	}
 
-	body := req.Body
-	defer body.Close()
-	rdr := io.LimitReader(body, bloom.FilterLen)
-	f, err := io.ReadAll(rdr)
+	n.recordFilterTypesHeader(req.RemoteAddr, req.Header)
+
+	b, err := bloom.ReadFilter(bytes.NewReader(body))
+	if errors.Is(err, bloom.ErrOversized) {
+		n.logger.Error("reading filter", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
-		n.logger.Error("reading body", "error", err)
+		n.logger.Error("reading filter", "error", err, "remote", req.RemoteAddr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	b := bloom.New()
-	err = b.Parse(string(f))
+	peers, err := n.selectPeers(ctx, b, req.RemoteAddr, MaxPeers)
 	if err != nil {
-		n.logger.Error("parsing filter", "error", err)
-		w.WriteHeader(http.StatusBadRequest)
+		n.logger.Error("fetching peers", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	err = n.store.UpsertPeer(model.PeerSpec{
+	nodeType := NodeTypePeer.String()
+	if req.Header.Get(HeaderNodeType) == NodeTypeCache.String() {
+		nodeType = NodeTypeCache.String()
+	}
+
+	err = n.store.UpsertPeer(ctx, model.PeerSpec{
 		RemoteAddr: req.RemoteAddr,
 		CreatedAt:  time.Now().UTC(),
 		NodeID:     nodeID,
 		Filter:     b.String(),
+		Addresses:  n.confirmAddresses(ctx, model.ParseAddressList(req.Header.Get(HeaderAddresses)), req.RemoteAddr, nodeID, nodeKey),
+		NodeType:   nodeType,
+		Group:      joinGroup(req, nodeType),
+		NodeKey:    nodeKey,
+		Protocol:   protocol,
+		Features:   strings.Join(features, ","),
+		// the version of a node which doesn't say isn't known
+		SoftwareVersion: req.Header.Get(HeaderSoftwareVersion),
 	})
 
 	if err != nil {
@@ -447,9 +1172,28 @@ func (n *node) handleJoin(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	n.events.Publish(PeerJoined{
+		At:         time.Now().UTC(),
+		RemoteAddr: req.RemoteAddr,
+		NodeID:     nodeID,
+	})
+	n.peersAdded()
+
+	// point the peer at caches replicating what it subscribes to
+	caches, err := n.cacheReplicas(ctx, b, req.RemoteAddr)
+	if err != nil {
+		n.logger.Error("fetching caches", "error", err, "remote", req.RemoteAddr)
+	}
+	for _, c := range caches {
+		if !slices.ContainsFunc(peers, func(p *model.PeerSpec) bool { return p.RemoteAddr == c.RemoteAddr }) {
+			peers = append(peers, c)
+		}
+	}
+
 	resp := model.JoinResponse{
-		Seeds: seeds,
-		Peers: peers,
+		Seeds:       seeds,
+		Peers:       peers,
+		FilterTypes: filterTypes(),
 	}
 
 	data, err := json.Marshal(&resp)
@@ -459,9 +1203,10 @@ func (n *node) handleJoin(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
 	w.Header().Add(HeaderContentType, ContentTypeJSON)
 	w.Header().Add(HeaderRemoteAddress, req.RemoteAddr)
+	n.setProtocolHeaders(w.Header())
+	w.WriteHeader(http.StatusAccepted)
 	w.Write(data)
 
 	//go n.notifyPeers(peers, req.RemoteAddr)
@@ -494,16 +1239,49 @@ func (n *node) handleJoin(w http.ResponseWriter, req *http.Request) {
 
 func (n *node) handleLeave(w http.ResponseWriter, req *http.Request) {
 	n.logger.Info("leave", "remote", req.RemoteAddr)
-	err := n.store.DeletePeer(req.RemoteAddr)
+	body, err := readControlBody(req)
+	if err != nil {
+		n.logger.Error("reading body", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	peer, err := n.store.GetPeer(req.Context(), req.RemoteAddr)
+	if err != nil {
+		n.logger.Error("fetching peer", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = n.verifyControl(req, body, peer)
+	if err != nil {
+		n.writeControlError(w, req, err)
+		return
+	}
+
+	err = n.store.DeletePeer(req.Context(), req.RemoteAddr)
 	if err != nil {
 		n.logger.Error("deleting peer", "error", err, "remote", req.RemoteAddr)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	n.recordPeerDeleted(req.Context(), req.RemoteAddr)
+	n.forgetPeer(req.RemoteAddr)
+	n.events.Publish(PeerDropped{
+		At:         time.Now().UTC(),
+		RemoteAddr: req.RemoteAddr,
+		Reason:     "left",
+	})
 	w.WriteHeader(http.StatusOK)
 }
 
 func (n *node) handleExecute(w http.ResponseWriter, req *http.Request) {
+	n.receiveAction(w, req, false)
+}
+
+// receiveAction checks and accepts an action sent by another node or, on the
+// client address, by a client
+func (n *node) receiveAction(w http.ResponseWriter, req *http.Request, client bool) {
+	ctx := req.Context()
 	body := req.Body
 	defer body.Close()
 
@@ -513,46 +1291,106 @@ func (n *node) handleExecute(w http.ResponseWriter, req *http.Request) {
 		n.logger.Error("reading body", "error", err)
 	}
 
-	action := graph.Action{
-		ID:               req.Header.Get(HeaderActionID),
-		RemoteAddr:       req.RemoteAddr,
-		NodeID:           req.Header.Get(HeaderNodeID),
-		Identity:         req.Header.Get(HeaderIdentifier),
-		Timestamp:        time.Now().UTC(),
-		Action:           string(buf),
-		ReceivedBy:       req.Header.Get(HeaderReceivedBy),
-		EncodedSignature: req.Header.Get(HeaderSignature),
+	action, hop, err := readAction(req, buf)
+	if err == nil {
+		err = n.checkManifestVersion(&action)
+	}
+	if err != nil {
+		n.metrics.actionsReceived.Inc()
+		n.rejectAction(action, RejectReasonSyntax)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	n.logger.Info("action", "data", action)
+	n.metrics.actionsReceived.Inc()
+
+	err = n.authorizePublisher(req, buf, &action, client)
+	if err != nil {
+		n.writeRejection(w, action, err)
+		return
+	}
+
+	n.observePeerClock(req.RemoteAddr, hop.ReceivedAt, action.Timestamp)
+
+	action.ExpiresAt, err = n.actionExpiry(action.Timestamp, hop.TTL)
+	if err != nil {
+		n.rejectAction(action, RejectReasonError)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	isProcessed, err := n.isActionProcessed(ctx, action.ID)
+	if err != nil {
+		n.logger.Error("checking action", "error", err, "id", action.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if isProcessed {
+		n.rejectAction(action, RejectReasonDuplicate)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+
+	err = n.checkTimestamp(&action, action.Timestamp)
+	if err != nil {
+		n.rejectAction(action, RejectReasonClock)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	stmt := action.Action
+	readable := true
+	if action.KeyID != "" {
+		plaintext, ok, err := n.subscriptionKeys.Open(action.KeyID, action.Action)
+		if err != nil {
+			n.rejectAction(action, RejectReasonSyntax)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		stmt, readable = plaintext, ok
+	}
+
+	if readable {
+		cmd, err := n.statementLimits().parseStatement(stmt)
+		if errors.Is(err, ErrStatementLimit) {
+			n.rejectAction(action, RejectReasonLimits)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			n.rejectAction(action, RejectReasonSyntax)
+			w.WriteHeader(http.StatusBadRequest)
+			_, err := w.Write([]byte("syntax error: " + err.Error()))
+			if err != nil {
+				n.logger.Error("sending response", "error", err)
+			}
+			return
+		}
+		action.Command = cmd
+		setRoutingKeys(&action)
 	}
 
-	n.logger.Info("action", "data", action)
-
-	isProcessed, err := n.store.IsActionProcessed(action.ID)
+	err = n.checkAction(ctx, &action, false)
 	if err != nil {
-		n.logger.Error("checking action", "error", err, "id", action.ID)
-		w.WriteHeader(http.StatusInternalServerError)
+		n.writeRejection(w, action, err)
 		return
 	}
 
-	if isProcessed {
-		w.WriteHeader(http.StatusFound)
-		return
+	// what we can't read can only be judged by its namespace
+	relevant := n.hostsNamespace(action.Namespace)
+	if readable {
+		relevant = n.isRelevant(&action)
 	}
-
-	err = n.verifyAction(&action)
-	switch {
-	case err == identity.ErrUnsupportedPublicKey:
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	case err == identity.ErrUnauthorized:
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	case err == identity.ErrBadSignature:
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("bad signature"))
-		return
-	case err != nil:
-		n.logger.Error("verifying action", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if !relevant {
+		n.rejectAction(action, RejectReasonIrrelevant)
+		w.WriteHeader(http.StatusMisdirectedRequest)
 		return
 	}
 
@@ -568,68 +1406,108 @@ func (n *node) handleExecute(w http.ResponseWriter, req *http.Request) {
 		action.Timestamp.Format(time.RFC3339)))
 	action.ReceivedBy = sb.String()
 
-	parser, err := ast.Parse(action.Action)
+	if !readable {
+		// we can't read it but can still pass it on to subscribers
+		n.acceptAction(w, action)
+		return
+	}
+
+	err = n.moderateStatement(ctx, &action, stmt)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte("syntax error: " + err.Error()))
-		if err != nil {
-			n.logger.Error("sending response", "error", err)
-		}
+		n.writeRejection(w, action, err)
 		return
 	}
-	action.Command = parser.Command()
 
-	err = n.moderateAction(&action)
+	n.acceptAction(w, action)
+}
+
+func (n *node) acceptAction(w http.ResponseWriter, action graph.Action) {
+	// the sender retries if the action can't be journalled
+	err := n.journal.append(action)
 	if err != nil {
-		if errors.Is(err, model.ErrNotAcceptable) {
-			w.WriteHeader(http.StatusNotAcceptable)
-			return
-		}
-		n.logger.Error("moderating action", "error", err, "action", action)
+		n.logger.Error("journalling action", "error", err, "id", action.ID)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	n.dedupe.Add(action.ID)
+	n.metrics.actionsAccepted.Inc()
+	n.events.Publish(ActionAccepted{
+		At:     time.Now().UTC(),
+		Action: action,
+	})
 	w.WriteHeader(http.StatusAccepted)
 	n.logger.Debug("action accepted", "action", action)
 
-	go n.processAction(action)
+	// processing outlives the request so it runs under the node's context
+	go n.processAction(n.ctx, action)
 }
 
 func (n *node) handlePing(w http.ResponseWriter, req *http.Request) {
 	n.logger.Info("got ping", "remote", req.RemoteAddr)
 
-	w.Header().Add(HeaderRemoteAddress, req.RemoteAddr)
-	w.WriteHeader(http.StatusOK)
-
-	body := req.Body
-	defer body.Close()
-	rdr := io.LimitReader(body, bloom.FilterLen)
-	f, err := io.ReadAll(rdr)
+	body, err := readControlBody(req)
 	if err != nil {
-		n.logger.Error("reading body", "error", err)
+		n.logger.Error("reading filter", "error", err, "remote", req.RemoteAddr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	b := bloom.New()
-	err = b.Parse(string(f))
+	peer, err := n.store.GetPeer(req.Context(), req.RemoteAddr)
 	if err != nil {
-		n.logger.Error("parsing filter", "error", err)
-		w.WriteHeader(http.StatusBadRequest)
+		n.logger.Error("fetching peer", "error", err, "remote", req.RemoteAddr)
+	}
+	nodeKey, err := n.verifyControl(req, body, peer)
+	if err != nil {
+		n.writeControlError(w, req, err)
+		return
+	}
+
+	w.Header().Add(HeaderRemoteAddress, req.RemoteAddr)
+	w.Header().Add(HeaderFilterTypes, strings.Join(filterTypes(), ","))
+	n.setProtocolHeaders(w.Header())
+	w.WriteHeader(http.StatusOK)
+	n.recordFilterTypesHeader(req.RemoteAddr, req.Header)
+	n.recordPeerProtocol(req.Context(), req.RemoteAddr, req.Header)
+	if nodeKey != "" {
+		n.pingedBy.record(nodeKey)
+	}
+
+	b, err := bloom.ReadFilter(bytes.NewReader(body))
+	if err != nil {
+		n.logger.Error("reading filter", "error", err, "remote", req.RemoteAddr)
 		return
 	}
 
-	err = n.store.TouchPeer(req.RemoteAddr, b.String())
+	filter := b.String()
+	if peer != nil && peer.NodeKey == "" && nodeKey != "" {
+		err = n.confirmListenPort(req.Context(), req, peer.NodeID, nodeKey)
+		if err == nil {
+			err = n.store.SetPeerNodeKey(req.Context(), req.RemoteAddr, nodeKey)
+		}
+		if err != nil {
+			n.logger.Error("binding node key", "error", err, "remote", req.RemoteAddr)
+		}
+	}
+
+	err = n.store.TouchPeer(req.Context(), req.RemoteAddr, filter)
 	if err != nil {
 		n.logger.Error("touching peer", "error", err, "remote", req.RemoteAddr)
 	}
 
-	go n.sendPong(req.RemoteAddr)
+	if peer != nil && peer.Filter != filter {
+		n.events.Publish(SubscriptionChanged{
+			At:         time.Now().UTC(),
+			RemoteAddr: req.RemoteAddr,
+			Filter:     filter,
+		})
+	}
+
+	go n.sendPong(n.ctx, req.RemoteAddr)
 }
 
-func (n *node) sendPong(addr string) {
-	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+func (n *node) sendPong(ctx context.Context, addr string) {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
 	defer cancelFn()
 
 	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("https://%s/pong", addr), nil)
@@ -640,19 +1518,13 @@ func (n *node) sendPong(addr string) {
 	resp, err := n.client.Do(req)
 	if err != nil {
 		n.logger.Error("sending pong", "error", err, "remote", addr)
-		err = n.store.DeletePeer(addr)
-		if err != nil {
-			n.logger.Error("deleting peer", "error", err, "remote", addr)
-		}
+		n.dropPeer(ctx, addr, "pong failed")
 		return
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		n.logger.Error("bad pong response", "remote", addr)
-		err = n.store.DeletePeer(addr)
-		if err != nil {
-			n.logger.Error("deleting peer", "error", err, "remote", addr)
-		}
+		n.dropPeer(ctx, addr, "pong rejected")
 	}
 }
 
@@ -661,8 +1533,56 @@ func (n *node) handlePong(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (n *node) joinSeeds() error {
-	seeds, err := n.store.GetSeeds()
+// sendHello joins a seed. A seed which turns the node away for want of a
+// proof of work says how hard it must be and the key it is bound to, and the
+// hello is sent again with one.
+func (n *node) sendHello(ctx context.Context, seed string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		url := fmt.Sprintf("https://%s/hello", seed)
+		filter := []byte(n.subscriptionFilterFor(seed).String())
+		req, err := n.newControlRequest(ctx, url, filter)
+		if err != nil {
+			return nil, fmt.Errorf("constructing request: %w", err)
+		}
+		req.Header.Add(HeaderNodeID, n.nodeID)
+		req.Header.Add(HeaderFilterTypes, strings.Join(filterTypes(), ","))
+		req.Header.Add(HeaderNodeType, n.capabilities.joinType().String())
+		if addresses := n.advertisedAddresses(); len(addresses) > 0 {
+			req.Header.Add(HeaderAddresses, addresses.String())
+		}
+		if n.group != "" {
+			req.Header.Add(HeaderGroup, n.group)
+		}
+		if nonce := n.joinWork.get(seed); nonce != "" {
+			req.Header.Add(HeaderJoinWork, nonce)
+		}
+		if invitation := n.invitation(); invitation != "" {
+			req.Header.Add(HeaderInvitation, invitation)
+		}
+
+		resp, err := n.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		difficulty, _ := strconv.Atoi(resp.Header.Get(HeaderJoinDifficulty))
+		seedKey := resp.Header.Get(HeaderNodeKey)
+		if resp.StatusCode != http.StatusForbidden || difficulty <= 0 || seedKey == "" || attempt > 0 {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		n.logger.Debug("working to join seed", "seed", seed, "difficulty", difficulty)
+		nonce, err := solveJoinWork(ctx, seedKey, req.Header.Get(HeaderNodeKey), difficulty)
+		if err != nil {
+			return nil, fmt.Errorf("working to join: %w", err)
+		}
+		n.joinWork.set(seed, nonce)
+	}
+}
+
+func (n *node) joinSeeds(ctx context.Context) error {
+	seeds, err := n.store.GetSeeds(ctx)
 	if err != nil {
 		return fmt.Errorf("join seeds (fetching seeds): %w", err)
 	}
@@ -671,13 +1591,12 @@ func (n *node) joinSeeds() error {
 		return nil
 	}
 
-	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancelFn := context.WithTimeout(ctx, 30*time.Second)
 	defer cancelFn()
 
 	wg := sync.WaitGroup{}
 	ch := make(chan model.JoinResponse, len(seeds))
 
-	subs := n.subscriptions.String()
 	for _, seed := range seeds {
 		wg.Add(1)
 		go func() {
@@ -688,21 +1607,16 @@ func (n *node) joinSeeds() error {
 			ctxInner, cancelFnInner := context.WithTimeout(ctx, 5*time.Second)
 			defer cancelFnInner()
 
-			url := fmt.Sprintf("https://%s/hello", seed.RemoteAddr)
-			buf := bytes.NewBufferString(subs)
-			req, err := http.NewRequestWithContext(ctxInner, "POST", url, buf)
+			resp, err := n.sendHello(ctxInner, seed.RemoteAddr)
 			if err != nil {
-				n.logger.Error("sending hello (constructing request)", "error", err, "remote", seed)
+				n.logger.Error("sending hello", "error", err, "remote", seed)
 				return
 			}
-			req.Header.Add(HeaderNodeID, n.nodeID)
 
-			resp, err := n.client.Do(req)
-			if err != nil {
-				n.logger.Error("sending hello", "error", err, "remote", seed)
+			if resp.StatusCode == http.StatusUpgradeRequired {
+				n.logger.Error("seed needs a newer protocol", "remote", seed, "protocol", ProtocolVersion, "seed_protocol", resp.Header.Get(HeaderProtocol))
 				return
 			}
-
 			if resp.StatusCode != http.StatusAccepted {
 				n.logger.Error("bad hellop response", "remote", seed, "status", resp.StatusCode)
 				return
@@ -720,8 +1634,13 @@ func (n *node) joinSeeds() error {
 			}
 
 			n.logger.Debug("join response", "seeds", len(respData.Seeds), "peers", len(respData.Peers))
+			for _, p := range respData.Peers {
+				p.Source = seed.RemoteAddr
+			}
+			n.observePublicAddress(seed.RemoteAddr, resp.Header.Get(HeaderRemoteAddress))
+			n.recordFilterTypes(seed.RemoteAddr, respData.FilterTypes)
 
-			err = n.store.TouchSeed(seed.RemoteAddr)
+			err = n.store.TouchSeed(ctx, seed.RemoteAddr)
 			if err != nil {
 				n.logger.Error("touching seed", "error", err, "remote", seed.RemoteAddr)
 			}
@@ -753,13 +1672,13 @@ func (n *node) joinSeeds() error {
 		seedList = append(seedList, v)
 	}
 
-	if len(seedList) == 0 {
-		n.logger.Warn("no seeds found")
-	}
-
-	err = n.store.UpsertSeeds(seedList)
-	if err != nil {
-		return fmt.Errorf("updating seeds: %w", err)
+	// the seeds are kept if none answered so the node can rejoin the network
+	// once they are reachable again
+	if len(seedList) > 0 {
+		err = n.store.UpsertSeeds(ctx, seedList)
+		if err != nil {
+			return fmt.Errorf("updating seeds: %w", err)
+		}
 	}
 
 	peerList := []*model.PeerSpec{}
@@ -771,20 +1690,60 @@ func (n *node) joinSeeds() error {
 		n.logger.Warn("no peers found")
 	}
 
-	err = n.store.UpsertPeers(peerList)
+	known, err := n.store.GetAllPeers(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching known peers: %w", err)
+	}
+	knownAddrs := map[string]struct{}{}
+	for _, p := range known {
+		knownAddrs[p.RemoteAddr] = struct{}{}
+	}
+
+	// seeds keep every peer which joins them
+	if !n.capabilities.Has(CapabilityAcceptJoins) {
+		peerList = n.admitPeers(known, peerList)
+	}
+
+	err = n.store.UpsertPeers(ctx, peerList)
 	if err != nil {
 		return fmt.Errorf("updating peers: %w", err)
 	}
 
+	for _, p := range peerList {
+		if _, ok := knownAddrs[p.RemoteAddr]; ok {
+			continue
+		}
+		n.events.Publish(PeerJoined{
+			At:         time.Now().UTC(),
+			RemoteAddr: p.RemoteAddr,
+			NodeID:     p.NodeID,
+		})
+	}
+
 	n.logger.Debug("joined seeds", "seeds", len(seeds), "peers", len(peerList))
 
-	n.pingPeers()
+	n.pingPeers(ctx)
+
+	err = n.flushOutbox(ctx)
+	if err != nil {
+		n.logger.Error("flushing outbox", "error", err)
+	}
+
+	// known peers are still pinged while the seeds can't be reached
+	if len(seedList) == 0 {
+		return errSeedsUnreachable
+	}
 
 	return nil
 }
 
-func (n *node) leaveSeeds() error {
-	seeds, err := n.store.GetSeeds()
+// leaveSeeds says goodbye to the seeds as the node stops. It runs after ctx is
+// cancelled so it gets a short timeout of its own.
+func (n *node) leaveSeeds(ctx context.Context) error {
+	ctx, cancelFn := context.WithTimeout(context.WithoutCancel(ctx), leaveTimeout)
+	defer cancelFn()
+
+	seeds, err := n.store.GetSeeds(ctx)
 	if err != nil {
 		return fmt.Errorf("fetching seeds: %w", err)
 	}
@@ -793,9 +1752,6 @@ func (n *node) leaveSeeds() error {
 		return nil
 	}
 
-	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancelFn()
-
 	wg := sync.WaitGroup{}
 	for _, seed := range seeds {
 		wg.Add(1)
@@ -808,7 +1764,7 @@ func (n *node) leaveSeeds() error {
 			defer cancelFnInner()
 
 			url := fmt.Sprintf("https://%s/goodbye", seed.RemoteAddr)
-			req, err := http.NewRequestWithContext(ctxInner, "POST", url, nil)
+			req, err := n.newControlRequest(ctxInner, url, nil)
 			if err != nil {
 				n.logger.Error("sending goodbye (constructing request)", "error", err, "remote", seed)
 				return
@@ -832,10 +1788,10 @@ func (n *node) leaveSeeds() error {
 	return nil
 }
 
-func (n *node) pingPeers() error {
+func (n *node) pingPeers(ctx context.Context) error {
 	n.logger.Debug("pinging peers")
 
-	peers, err := n.store.GetAllPeers()
+	peers, err := n.store.GetAllPeers(ctx)
 	if err != nil {
 		return fmt.Errorf("fetching peers: %w", err)
 	}
@@ -846,26 +1802,36 @@ func (n *node) pingPeers() error {
 	}
 
 	for _, peer := range peers {
-		err := n.sendPing(peer.RemoteAddr)
+		err := n.tryPeerAddresses(ctx, peer, func(addr string) error {
+			return n.sendPing(ctx, addr)
+		})
 		if err != nil {
 			n.logger.Error("pinging peer", "error", err, "peer", peer)
-			n.store.DeletePeer(peer.RemoteAddr)
+			n.missedPing(ctx, peer.RemoteAddr)
+			continue
+		}
+
+		err = n.store.TouchPeer(ctx, peer.RemoteAddr, "")
+		if err != nil {
+			n.logger.Error("touching peer", "error", err, "remote", peer.RemoteAddr)
 		}
 	}
 	return nil
 }
 
-func (n *node) sendPing(remote string) error {
+func (n *node) sendPing(ctx context.Context, remote string) error {
 	n.logger.Debug("pinging peer", "remote", remote)
 
-	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancelFn := context.WithTimeout(ctx, 30*time.Second)
 	defer cancelFn()
 
-	buf := bytes.NewBufferString(n.subscriptions.String())
-	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("https://%s/ping", remote), buf)
+	filter := []byte(n.subscriptionFilterFor(remote).String())
+	req, err := n.newControlRequest(ctx, fmt.Sprintf("https://%s/ping", remote), filter)
 	if err != nil {
 		return fmt.Errorf("creating ping: %w", err)
 	}
+	req.Header.Add(HeaderFilterTypes, strings.Join(filterTypes(), ","))
+	req.Header.Add(HeaderNodeID, n.nodeID)
 
 	resp, err := n.client.Do(req)
 	if err != nil {
@@ -875,141 +1841,210 @@ func (n *node) sendPing(remote string) error {
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("ping response code: %d", resp.StatusCode)
 	}
+	n.recordFilterTypesHeader(remote, resp.Header)
+	n.recordPeerProtocol(ctx, remote, resp.Header)
 
 	return nil
 }
 
-func (n *node) generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+// PublishIdentity publishes the identity's profile and certificate, signed by
+// the identity
+func (n *node) PublishIdentity(ctx context.Context, id *identity.Identity) error {
+	stmt, err := IdentityStatement(id)
 	if err != nil {
-		panic(err)
-	}
-	template := x509.Certificate{
-		Subject: pkix.Name{
-			CommonName: n.nodeID,
-		},
-		SerialNumber: big.NewInt(1),
-	}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		panic(err)
+		return err
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	return n.Execute(ctx, id, stmt)
+}
 
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		panic(err)
-	}
-	return &tls.Config{
-		InsecureSkipVerify: true,
-		Certificates:       []tls.Certificate{tlsCert},
-		NextProtos:         []string{"h3", "propolis"},
-	}
+func (n *node) Execute(ctx context.Context, id *identity.Identity, stmt string) error {
+	_, err := n.execute(ctx, id, "", stmt, "")
+	return err
 }
 
-func (n *node) PublishIdentity(id *identity.Identity) error {
-	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: id.CertificateData}))
-	certPEMEncoded, err := json.Marshal(certPEM)
-	if err != nil {
-		return fmt.Errorf("marshalling certificate: %w", err)
-	}
+// ExecuteIn signs and publishes a statement to a namespace's graph
+func (n *node) ExecuteIn(ctx context.Context, namespace string, id *identity.Identity, stmt string) error {
+	_, err := n.execute(ctx, id, namespace, stmt, "")
+	return err
+}
 
-	sb := strings.Builder{}
-	sb.WriteString("MERGE (:Identity{")
-	props := []string{
-		fmt.Sprintf("id:'%s'", id.Identifier),
-		fmt.Sprintf("handle:'%s'", id.Handle),
-		fmt.Sprintf("bio:'%s'", id.Bio),
-		fmt.Sprintf("certificate:'%s'", string(certPEMEncoded)),
+// execute signs and publishes a statement to a namespace, the default graph
+// if it is empty, encrypting it first if keyID is set, and returns the
+// action's ID. Nothing is published if ctx is cancelled
+// first. The action is applied to the local graph before execute returns so
+// the publisher sees its own writes, peers are sent it in the background.
+func (n *node) execute(ctx context.Context, id *identity.Identity, namespace, stmt, keyID string) (string, error) {
+	if !n.hostsNamespace(namespace) {
+		return "", fmt.Errorf("send action: %w: %s", ErrUnknownNamespace, namespace)
 	}
-	sb.WriteString(strings.Join(props, ", "))
-	sb.WriteString("})")
 
-	err = n.Execute(id, sb.String())
+	cmd, err := n.statementLimits().parseStatement(stmt)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("send action: parsing action: %w", err)
 	}
 
-	return nil
-}
-
-func (n *node) Execute(id *identity.Identity, stmt string) error {
-	parser, err := ast.Parse(stmt)
-	if err != nil {
-		return fmt.Errorf("send action: parsing action: %w", err)
+	payload := stmt
+	if keyID != "" {
+		payload, err = n.subscriptionKeys.Seal(keyID, stmt)
+		if err != nil {
+			return "", fmt.Errorf("send action: encrypting action: %w", err)
+		}
 	}
 
 	signer, err := identity.NewSigner(id)
 	if err != nil {
-		return fmt.Errorf("creating signer: %w", err)
+		return "", fmt.Errorf("creating signer: %w", err)
 	}
 
-	actionID := id.Identifier + "." + model.NewID()
-
-	signer.Add([]byte(actionID))
-	signer.Add([]byte(stmt))
-	encodedSig := signer.Sign()
-
 	now := time.Now().UTC()
 	recvBy := fmt.Sprintf("by=%s,from=,on=%s",
 		n.nodeID,
 		now.Format(time.RFC3339))
 
 	action := graph.Action{
-		ID:               actionID,
-		RemoteAddr:       n.publicAddr,
-		NodeID:           n.nodeID,
-		Certificate:      id.Certificate,
-		Timestamp:        now,
-		Action:           stmt,
-		ReceivedBy:       recvBy,
-		EncodedSignature: encodedSig,
-		Command:          parser.Command(),
+		ID:              id.Identifier + "." + model.NewID(),
+		RemoteAddr:      n.publicAddr.String(),
+		NodeID:          n.nodeID,
+		Certificate:     id.Certificate,
+		Timestamp:       now,
+		Action:          payload,
+		ReceivedBy:      recvBy,
+		Command:         cmd,
+		KeyID:           keyID,
+		Namespace:       namespace,
+		ManifestVersion: ManifestVersion,
+		CreatedAt:       &now,
+	}
+
+	signed, err := manifestFor(&action).SigningPayload()
+	if err != nil {
+		return "", fmt.Errorf("send action: %w", err)
+	}
+
+	signer.Add(signed)
+	action.EncodedSignature, err = signer.Sign()
+	if err != nil {
+		return "", fmt.Errorf("send action: %w", err)
+	}
+
+	// actions published here pass the same checks as those received
+	action.Identity = actionIdentity(&action)
+	err = n.checkAction(ctx, &action, true)
+	if err == nil {
+		err = n.moderateStatement(ctx, &action, stmt)
+	}
+	if err != nil {
+		n.recordRejection(action, err)
+		return "", fmt.Errorf("send action: %w", err)
 	}
 
-	go n.processAction(action)
+	err = ctx.Err()
+	if err != nil {
+		return "", fmt.Errorf("send action: %w", err)
+	}
 
-	return nil
+	err = n.journal.append(action)
+	if err != nil {
+		return "", fmt.Errorf("send action: %w", err)
+	}
+
+	n.processAction(n.ctx, action)
+
+	return action.ID, nil
 }
 
 func (n *node) dispatchAction(ctx context.Context, peer *model.PeerSpec, action graph.Action) error {
+	return n.tryPeerAddresses(ctx, peer, func(addr string) error {
+		return n.dispatchActionTo(ctx, addr, peer, action)
+	})
+}
+
+func (n *node) dispatchActionTo(ctx context.Context, addr string, peer *model.PeerSpec, action graph.Action) error {
 	ctxInner, cancelFnInner := context.WithTimeout(ctx, 5*time.Second)
 	defer cancelFnInner()
 
-	buf := bytes.NewBufferString(action.Action)
+	manifest := manifestFor(&action)
+	if n.clock.TagReceiveTime {
+		manifest.ReceivedAt = &action.Timestamp
+	}
+	switch {
+	case action.ManifestVersion >= ManifestVersionCanonical:
+		// the signed TTL is sent on as it is
+		if action.ExpiresAt != nil && !time.Now().Before(*action.ExpiresAt) {
+			return nil
+		}
+	case action.ExpiresAt != nil:
+		manifest.TTL = int(time.Until(*action.ExpiresAt).Seconds())
+		if manifest.TTL <= 0 {
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("send action: marshalling manifest: %w", err)
+	}
 
-	url := fmt.Sprintf("https://%s/publish", peer.RemoteAddr)
-	req, err := http.NewRequestWithContext(ctxInner, "POST", url, buf)
-	req.Header.Add(HeaderIdentifier, action.Certificate.Issuer.CommonName)
-	req.Header.Add(HeaderActionID, action.ID)
-	req.Header.Add(HeaderNodeID, action.NodeID)
-	req.Header.Add(HeaderSignature, action.EncodedSignature)
-	if len(action.ReceivedBy) > 0 {
-		req.Header.Add(HeaderReceivedBy, action.ReceivedBy)
+	err = n.bandwidth.wait(ctx, peer.RemoteAddr, len(data))
+	if err != nil {
+		return fmt.Errorf("send action: %w", err)
 	}
 
+	url := fmt.Sprintf("https://%s/publish", addr)
+	req, err := http.NewRequestWithContext(ctxInner, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		return fmt.Errorf("send action: creating action request: %w", err)
 	}
+	req.Header.Add(HeaderContentType, ContentTypeAction)
+	req.Header.Add(HeaderNodeID, n.nodeID)
+	// peers which require publishers to be peers know this node by its key
+	n.signControl(req, data)
 
 	resp, err := n.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("send action: executing action request: %w", err)
 	}
 
-	if resp.StatusCode != http.StatusAccepted {
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusMisdirectedRequest {
 		return fmt.Errorf("send action: action request not accepted: %d", resp.StatusCode)
 	}
 
-	err = n.store.TouchPeer(peer.RemoteAddr, "")
+	err = n.store.TouchPeer(ctx, peer.RemoteAddr, "")
 	if err != nil {
 		return fmt.Errorf("send action: touching peer: %w", err)
 	}
 
+	if resp.StatusCode == http.StatusMisdirectedRequest {
+		return ErrIrrelevant
+	}
 	return nil
 }
 
+// tryPeerAddresses calls fn with each of the peer's known addresses until one
+// succeeds and remembers the one that worked so it is tried first next time.
+// A peer which answers that the action is irrelevant was reached, so its other
+// addresses aren't tried.
+func (n *node) tryPeerAddresses(ctx context.Context, peer *model.PeerSpec, fn func(addr string) error) error {
+	errs := []error{}
+	for _, addr := range peer.DialAddresses() {
+		err := fn(addr)
+		if err != nil && !errors.Is(err, ErrIrrelevant) {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+			continue
+		}
+
+		if addr != peer.PreferredAddr {
+			peer.PreferredAddr = addr
+			storeErr := n.store.SetPreferredAddress(ctx, peer.RemoteAddr, addr)
+			if storeErr != nil {
+				n.logger.Error("recording preferred address", "error", storeErr, "remote", peer.RemoteAddr)
+			}
+		}
+		return err
+	}
+	return errors.Join(errs...)
+}
+
 func (n *node) handleWhoIs(w http.ResponseWriter, req *http.Request) {
 	id := req.PathValue("id")
 	if id == "" {
@@ -1018,7 +2053,10 @@ func (n *node) handleWhoIs(w http.ResponseWriter, req *http.Request) {
 	}
 	n.logger.Info("get certificate", "id", id)
 
-	cert, err := n.store.GetCachedCertificate(id)
+	cert, err := n.store.GetCachedCertificate(req.Context(), id)
+	if errors.Is(err, model.ErrNotFound) {
+		cert, err = n.store.GetIdentityRecord(req.Context(), id)
+	}
 	if err != nil {
 		if errors.Is(err, model.ErrNotFound) {
 			w.WriteHeader(http.StatusNotFound)
@@ -1038,8 +2076,13 @@ func (n *node) handleWhoAmI(w http.ResponseWriter, req *http.Request) {
 	n.logger.Info("whomai", "remote", req.RemoteAddr)
 	spec := model.PeerSpec{
 		CreatedAt:  time.Now().UTC(),
-		RemoteAddr: n.publicAddr,
+		RemoteAddr: n.publicAddr.String(),
 		NodeID:     n.nodeID,
+		Addresses:  n.advertisedAddresses(),
+		// so nodes which were sent a claimed address can check who is there
+		NodeKey: n.NodeKey(),
+		// the version is also in the headers, this is for clients
+		SoftwareVersion: n.version,
 	}
 
 	data, err := json.Marshal(&spec)
@@ -1051,12 +2094,13 @@ func (n *node) handleWhoAmI(w http.ResponseWriter, req *http.Request) {
 
 	w.Header().Add(HeaderContentType, ContentTypeJSON)
 	w.Header().Add(HeaderRemoteAddress, req.RemoteAddr)
+	n.setProtocolHeaders(w.Header())
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
-func (n *node) fetchIdentity(identifier, remoteAddr string) (*x509.Certificate, error) {
-	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+func (n *node) fetchIdentity(ctx context.Context, identifier, remoteAddr string) (*x509.Certificate, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, 30*time.Second)
 	defer cancelFn()
 
 	url := fmt.Sprintf("https://%s/whois/%s", remoteAddr, identifier)
@@ -1095,89 +2139,203 @@ func (n *node) fetchIdentity(identifier, remoteAddr string) (*x509.Certificate,
 	return cert, nil
 }
 
-func (n *node) tidyPeers() error {
-	// delete any peer who hasn't been touched in the last 3 minutes
-	before := time.Now().UTC().Add(-3 * time.Minute)
-	err := n.store.DeleteAgedPeers(before)
-	if err != nil {
-		return fmt.Errorf("deleteing peers: %w", err)
+func (n *node) countOfSessions() int {
+	if n.transports == nil {
+		return 0
 	}
+	return n.transports.CountOfSessions()
+}
 
-	return nil
+func (n *node) countOfOpenCircuits() int {
+	if n.breaker == nil {
+		return 0
+	}
+	return n.breaker.CountOfOpen()
+}
+
+func (n *node) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req)
+		route := req.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		n.metrics.requestsByEndpoint.WithLabelValues(route).Inc()
+	})
+}
+
+func commandName(cmd ast.Command) string {
+	if cmd == nil {
+		return "unknown"
+	}
+	switch cmd.Type() {
+	case ast.EntityTypeMergeCmd:
+		return "merge"
+	case ast.EntityTypeMatchCmd:
+		return "match"
+	default:
+		return "unknown"
+	}
 }
 
-func (n *node) CountOfPeers() (int, error) {
-	return n.store.CountOfPeers()
+func (n *node) CountOfPeers(ctx context.Context) (int, error) {
+	return n.store.CountOfPeers(ctx)
 }
 
-func (n *node) propagateAction(action graph.Action, entityIDs ...string) error {
-	peers, err := n.store.GetAllPeers()
+// propagateAction queues the action for peers whose filters match any of
+// the keys, its entity IDs and topics
+func (n *node) propagateAction(ctx context.Context, action graph.Action, keys ...string) error {
+	peers, err := n.store.GetAllPeers(ctx)
 	if err != nil {
 		return fmt.Errorf("dispatch getting peers: %w", err)
 	}
 
-	wg := sync.WaitGroup{}
 	for _, p := range peers {
-		wg.Add(1)
-
-		go func() {
-			defer wg.Done()
+		b, err := bloom.Decode(p.Filter)
+		if err != nil {
+			n.logger.Error("dispatch parsing filter", "error", err)
+			continue
+		}
 
-			b := bloom.New()
-			err = b.Parse(p.Filter)
-			if err != nil {
-				n.logger.Error("dispatch parsing filter", "error", err)
-				return
+		isWatching := false
+		for _, id := range keys {
+			if b.Intersects([]byte(id)) {
+				isWatching = true
+				break
 			}
+		}
 
-			isWatching := false
-			for _, id := range entityIDs {
-				if b.Intersects([]byte(id)) {
-					isWatching = true
-					break
-				}
-			}
+		if !isWatching {
+			continue
+		}
 
-			if !isWatching {
-				return
-			}
+		if !n.precision.ShouldSend(p, b) {
+			n.metrics.propagationSkipped.Inc()
+			continue
+		}
 
-			ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
-			defer cancelFn()
-			n.dispatchAction(ctx, p, action)
-		}()
+		n.dispatcher.Enqueue(p, action)
 	}
-	wg.Wait()
 
 	return nil
 }
 
-func (n *node) verifyAction(action *graph.Action) error {
-	cert, err := n.store.GetCachedCertificate(action.Identity)
+// sendQueuedAction is run by the dispatcher's workers
+func (n *node) sendQueuedAction(peer *model.PeerSpec, action graph.Action) {
+	release, err := n.bandwidth.acquire(n.ctx, peer.RemoteAddr)
 	if err != nil {
-		if !errors.Is(err, model.ErrNotFound) {
-			return fmt.Errorf("getting certificate: %w", err)
-		}
-		cert, err = n.fetchIdentity(action.Identity, action.RemoteAddr)
+		return
+	}
+	defer release()
+
+	ctx, cancelFn := context.WithTimeout(n.ctx, defaultTimeout)
+	defer cancelFn()
+
+	err = n.dispatchAction(ctx, peer, action)
+	switch {
+	case errors.Is(err, ErrIrrelevant):
+		n.metrics.propagationIrrelevant.Inc()
+		n.recordPrecision(peer, false)
+		return
+	case err != nil:
+		n.metrics.propagationErrors.Inc()
+		n.logger.Error("dispatching action", "error", err, "remote", peer.RemoteAddr)
+		return
+	}
+	n.metrics.actionsPropagated.Inc()
+	n.recordPrecision(peer, true)
+}
+
+func (n *node) verifyAction(ctx context.Context, action *graph.Action) error {
+	revokedAt, err := n.store.GetRevocation(ctx, action.Identity)
+	if err != nil {
+		return fmt.Errorf("checking revocation: %w", err)
+	}
+	if revokedAt != nil {
+		return identity.ErrRevoked
+	}
+
+	now := time.Now().UTC()
+	isFetched := false
+	cert, err := n.store.GetCachedCertificate(ctx, action.Identity)
+	switch {
+	case errors.Is(err, model.ErrNotFound) || (err == nil && identity.CheckValidity(cert, now) != nil):
+		// not seen before, or expired in which case the identity may have
+		// renewed it
+		isFetched = true
+		cert, err = n.fetchCertificate(ctx, action, now)
 		if err != nil {
 			return fmt.Errorf("fetching certificate: %w", err)
 		}
+	case err != nil:
+		return fmt.Errorf("getting certificate: %w", err)
 	}
 
-	v, err := identity.NewVerifier(cert)
-	v.Add([]byte(action.ID))
-	v.Add([]byte(action.Action))
-	err = v.Verify(action.EncodedSignature)
+	// actions signed by a delegate carry the identity's delegation to its key
+	verify := verifySignature
+	if action.Delegation != "" {
+		verify = func(cert *x509.Certificate, action *graph.Action) error {
+			return verifyDelegatedAction(cert, action, now)
+		}
+	}
+
+	err = verify(cert, action)
+	if errors.Is(err, identity.ErrUnauthorized) {
+		// the identity may have rotated its keys since the action was signed
+		prev, rotatedAt, err2 := n.store.GetPreviousCertificate(ctx, action.Identity)
+		if err2 == nil && time.Since(rotatedAt) < n.keyRotationGrace && verify(prev, action) == nil {
+			cert, err = prev, nil
+		}
+	}
 	if err != nil {
 		return err
 	}
 
+	err = identity.CheckValidity(cert, now)
+	if err != nil {
+		return err
+	}
+
+	if isFetched {
+		err = n.store.PutCachedCertificate(ctx, cert)
+		if err != nil {
+			n.logger.Error("caching certificate", "error", err, "identity", action.Identity)
+		}
+	}
+
 	action.Certificate = cert
 
 	return nil
 }
 
+func verifySignature(cert *x509.Certificate, action *graph.Action) error {
+	signed, err := manifestFor(action).SigningPayload()
+	if err != nil {
+		return identity.ErrBadSignature
+	}
+
+	v, err := identity.NewVerifier(cert)
+	if err != nil {
+		return err
+	}
+	v.Add(signed)
+	return v.Verify(action.EncodedSignature)
+}
+
 func (n *node) moderateAction(action *graph.Action) error {
-	//TODO: implement moderation
-	return nil
+	n.reloadMu.RLock()
+	defer n.reloadMu.RUnlock()
+
+	err := n.moderation.Moderate(action)
+	if err != nil {
+		return err
+	}
+	return n.policies.Moderate(action)
+}
+
+// AddModerationPolicy appends a policy to those configured for the node. It
+// must be called before Run. Added policies are kept when the config is
+// reloaded.
+func (n *node) AddModerationPolicy(policy ModerationPolicy) {
+	n.policies = append(n.policies, policy)
 }
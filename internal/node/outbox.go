@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+// outboxBatch is how many queued actions are sent at a time
+const outboxBatch = 100
+
+// queueIfOffline keeps an action published while the node has no peers so that
+// it is sent once the node rejoins the network. It returns true if the action
+// was queued.
+func (n *node) queueIfOffline(ctx context.Context, action graph.Action) bool {
+	peers, err := n.store.CountOfPeers(ctx)
+	if err != nil {
+		n.logger.Error("counting peers", "error", err)
+		return false
+	}
+	if peers > 0 {
+		return false
+	}
+
+	err = n.store.QueueAction(ctx, action)
+	if err != nil {
+		n.logger.Error("queueing action", "error", err, "id", action.ID)
+		return false
+	}
+
+	n.outboxEmpty.Store(false)
+	n.logger.Info("no peers, action queued", "id", action.ID)
+	return true
+}
+
+// peersAdded sends any queued actions now that the node has peers. Peers are
+// added by joining seeds, by nodes joining this one, by gossip and by
+// replication, so a node which went offline can find its way back by any of
+// them.
+func (n *node) peersAdded() {
+	if n.outboxEmpty.Load() {
+		return
+	}
+
+	go func() {
+		err := n.flushOutbox(n.ctx)
+		if err != nil {
+			n.logger.Error("flushing outbox", "error", err)
+		}
+	}()
+}
+
+// flushOutbox sends the actions queued while the node had no peers. Only one
+// flush runs at a time. Actions which have been queued for longer than peers
+// accept are dropped, they can't be signed again without the identity's key.
+func (n *node) flushOutbox(ctx context.Context) error {
+	if !n.outboxMu.TryLock() {
+		return nil
+	}
+	defer n.outboxMu.Unlock()
+
+	// anything queued from here on sets it again
+	n.outboxEmpty.Store(true)
+	drained := false
+	defer func() {
+		if !drained {
+			n.outboxEmpty.Store(false)
+		}
+	}()
+
+	sent := 0
+	defer func() {
+		if sent > 0 {
+			n.logger.Info("sent queued actions", "count", sent)
+		}
+	}()
+
+	for {
+		peers, err := n.store.CountOfPeers(ctx)
+		if err != nil {
+			return fmt.Errorf("counting peers: %w", err)
+		}
+		if peers == 0 {
+			return nil
+		}
+
+		actions, err := n.store.GetQueuedActions(ctx, outboxBatch)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		ids := make([]string, 0, len(actions))
+		stale := 0
+		for _, action := range actions {
+			if n.staleQueuedAction(*action, now) {
+				ids = append(ids, action.ID)
+				stale++
+				continue
+			}
+
+			keys := namespaceKeys(action.Namespace, append(append([]string{}, action.EntityIDs...), topicKeys(action.Topics)...))
+			err = n.propagateAction(ctx, *action, keys...)
+			if err != nil {
+				break
+			}
+			ids = append(ids, action.ID)
+		}
+
+		// the actions sent are dequeued even if the rest fail
+		err2 := n.store.DequeueActions(ctx, ids)
+		if err2 != nil {
+			return err2
+		}
+		sent += len(ids) - stale
+		if err != nil {
+			return fmt.Errorf("sending queued action: %w", err)
+		}
+
+		if len(actions) < outboxBatch {
+			drained = true
+			return nil
+		}
+	}
+}
+
+// staleQueuedAction reports whether an action has been queued too long for
+// peers to accept it, recording its rejection if so
+func (n *node) staleQueuedAction(action graph.Action, now time.Time) bool {
+	if action.CreatedAt == nil || now.Sub(*action.CreatedAt) <= n.clock.MaxAge {
+		return false
+	}
+
+	n.logger.Warn("queued action too old to send", "id", action.ID, "created", action.CreatedAt)
+	n.rejectAction(action, RejectReasonExpired)
+	return true
+}
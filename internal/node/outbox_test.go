@@ -0,0 +1,57 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushOutbox(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode(t)
+	n.clock = ClockConfig{}.withDefaults()
+	n.events = newEventBus()
+	t.Cleanup(n.events.Close)
+	events := n.events.Subscribe()
+
+	queue := func(id string, age time.Duration) {
+		createdAt := time.Now().UTC().Add(-age)
+		action := graph.Action{ID: id, NodeID: n.nodeID, Timestamp: createdAt, CreatedAt: &createdAt}
+		require.NoError(t, n.store.CreateAction(ctx, action))
+		require.NoError(t, n.store.QueueAction(ctx, action))
+	}
+	queued := func() int {
+		count, err := n.store.CountQueuedActions(ctx)
+		require.NoError(t, err)
+		return count
+	}
+
+	queue("fresh", time.Minute)
+	queue("stale", defaultMaxActionAge+time.Minute)
+
+	// nothing goes while there are no peers
+	require.NoError(t, n.flushOutbox(ctx))
+	assert.Equal(t, 2, queued())
+	assert.False(t, n.outboxEmpty.Load())
+
+	require.NoError(t, n.store.UpsertPeer(ctx, model.PeerSpec{RemoteAddr: "10.0.0.2:9000", CreatedAt: time.Now().UTC()}))
+	require.NoError(t, n.flushOutbox(ctx))
+	assert.Zero(t, queued())
+	assert.True(t, n.outboxEmpty.Load())
+
+	// peers wouldn't accept the stale action so its rejection is recorded
+	select {
+	case e := <-events:
+		rejected, ok := e.(ActionRejected)
+		require.True(t, ok)
+		assert.Equal(t, "stale", rejected.Action.ID)
+		assert.Equal(t, RejectReasonExpired, rejected.Reason)
+	case <-time.After(time.Second):
+		assert.Fail(t, "stale action not rejected")
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/jdudmesh/propolis/internal/bloom"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+// MaxPeerCandidates is how many recently seen peers are considered when
+// choosing neighbours for a joining peer
+const MaxPeerCandidates = 64
+
+// selectPeers chooses up to max neighbours for a joining peer. Peers which
+// share its subscriptions come first, and no two are picked from the same
+// network while there are alternatives so that one operator can't surround a
+// new peer (an eclipse attack). Saturated filters match everything, so peers
+// advertising one get no credit for sharing subscriptions.
+func (n *node) selectPeers(ctx context.Context, filter bloom.Membership, excluding string, max int) ([]*model.PeerSpec, error) {
+	candidates, err := n.store.GetRandomPeers(ctx, excluding, MaxPeerCandidates)
+	if err != nil {
+		return nil, err
+	}
+
+	type scored struct {
+		peer    *model.PeerSpec
+		overlap uint
+		network string
+	}
+
+	ranked := make([]scored, 0, len(candidates))
+	for _, p := range candidates {
+		s := scored{peer: p, network: networkPrefix(p.RemoteAddr)}
+		if p.Filter != "" {
+			b, err := bloom.Decode(p.Filter)
+			if err == nil && b.EstimateFPR(b.EstimateCount()) < saturatedFPR {
+				s.overlap = b.Overlap(filter)
+			}
+		}
+		ranked = append(ranked, s)
+	}
+
+	// shuffle so equally relevant peers share the load
+	rand.Shuffle(len(ranked), func(i, j int) {
+		ranked[i], ranked[j] = ranked[j], ranked[i]
+	})
+	slices.SortStableFunc(ranked, func(a, b scored) int {
+		return int(b.overlap) - int(a.overlap)
+	})
+
+	selected := make([]*model.PeerSpec, 0, max)
+	networks := map[string]struct{}{}
+	skipped := []*model.PeerSpec{}
+	for _, s := range ranked {
+		if len(selected) == max {
+			break
+		}
+		if _, ok := networks[s.network]; ok && s.network != "" {
+			skipped = append(skipped, s.peer)
+			continue
+		}
+		networks[s.network] = struct{}{}
+		selected = append(selected, s.peer)
+	}
+
+	// fall back to peers on networks we already picked from
+	for _, p := range skipped {
+		if len(selected) == max {
+			break
+		}
+		selected = append(selected, p)
+	}
+
+	return selected, nil
+}
+
+// handleNodes lists a sample of peers and the most recent caches for clients
+// which want somewhere to publish and query without joining the network
+func (n *node) handleNodes(w http.ResponseWriter, req *http.Request) {
+	seeds, err := n.store.GetSeeds(req.Context())
+	if err != nil {
+		n.logger.Error("fetching seeds", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	peers, err := n.selectPeers(req.Context(), bloom.New(), req.RemoteAddr, MaxPeers)
+	if err != nil {
+		n.logger.Error("fetching peers", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	caches, err := n.store.GetCaches(req.Context(), req.RemoteAddr)
+	if err != nil {
+		n.logger.Error("fetching caches", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, c := range caches[:min(len(caches), MaxCaches)] {
+		if !slices.ContainsFunc(peers, func(p *model.PeerSpec) bool { return p.RemoteAddr == c.RemoteAddr }) {
+			peers = append(peers, c)
+		}
+	}
+
+	n.writeJSON(w, model.JoinResponse{
+		Seeds:       seeds,
+		Peers:       peers,
+		FilterTypes: filterTypes(),
+	})
+}
+
+// networkPrefix returns the /16 (IPv4) or /32 (IPv6) network of an address,
+// empty if it isn't an IP address
+func networkPrefix(remoteAddr string) string {
+	return addressPrefix(remoteAddr, 16, 32)
+}
+
+// addressPrefix returns the network of an address with the given number of
+// bits for IPv4 and IPv6, empty if it isn't an IP address
+func addressPrefix(remoteAddr string, bits4, bits6 int) string {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return ""
+	}
+
+	addr := addrPort.Addr().Unmap()
+	bits := bits4
+	if addr.Is6() {
+		bits = bits6
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+
+	return prefix.String()
+}
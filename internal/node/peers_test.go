@@ -0,0 +1,48 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/bloom"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectPeers(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode(t)
+
+	wanted := bloom.New()
+	for _, topic := range []string{"cats", "dogs", "fish"} {
+		wanted.Set([]byte(topic))
+	}
+	shared := bloom.New()
+	shared.Set([]byte("cats"))
+
+	saturated := bloom.New()
+	for i := 0; saturated.EstimateFPR(saturated.EstimateCount()) < saturatedFPR; i++ {
+		saturated.Set([]byte(fmt.Sprintf("value%d", i)))
+	}
+	require.Greater(t, saturated.Overlap(wanted), shared.Overlap(wanted))
+
+	peers := map[string]string{
+		"10.1.0.1:9000": shared.String(),
+		"10.2.0.1:9000": saturated.String(),
+		"10.3.0.1:9000": bloom.New().String(),
+	}
+	for addr, filter := range peers {
+		require.NoError(t, n.store.UpsertPeer(ctx, model.PeerSpec{RemoteAddr: addr, Filter: filter, CreatedAt: time.Now().UTC()}))
+	}
+
+	// a filter matching everything doesn't outrank one sharing the subscription
+	for range 10 {
+		selected, err := n.selectPeers(ctx, wanted, "", 1)
+		require.NoError(t, err)
+		require.Len(t, selected, 1)
+		assert.Equal(t, "10.1.0.1:9000", selected[0].RemoteAddr)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const (
+	defaultMaxPeersPerSubnet = 2
+	defaultMaxSeedShare      = 0.5
+	defaultReseedInterval    = time.Hour
+	defaultReseedFraction    = 0.25
+)
+
+// PeerTableConfig is read from the peer_table section of the config file. It
+// limits how a relay's peer table is made up so that an attacker running
+// many nodes, or a seed handing out only its own, can't surround the node and
+// censor what it sees (an eclipse attack). Seeds' tables hold the peers which
+// joined them and aren't limited.
+type PeerTableConfig struct {
+	// MaxPerSubnet is the most peers kept from one /24 (IPv4) or /48 (IPv6)
+	// subnet, negative for no limit. Private and loopback addresses aren't
+	// limited.
+	MaxPerSubnet int `mapstructure:"max_per_subnet"`
+	// MaxSeedShare is the largest fraction of the peer table which one seed
+	// can have handed out, once peers have come from more than one seed. 1
+	// doesn't limit.
+	MaxSeedShare float64 `mapstructure:"max_seed_share"`
+	// ReseedInterval is how often peers chosen at random are dropped and the
+	// seeds asked for replacements, so that sybils which got in don't keep
+	// their places. Negative disables reseeding.
+	ReseedInterval time.Duration `mapstructure:"reseed_interval"`
+	// ReseedFraction is the fraction of the peer table dropped each time
+	ReseedFraction float64 `mapstructure:"reseed_fraction"`
+}
+
+func (c PeerTableConfig) withDefaults() PeerTableConfig {
+	if c.MaxPerSubnet == 0 {
+		c.MaxPerSubnet = defaultMaxPeersPerSubnet
+	}
+	if c.MaxSeedShare == 0 {
+		c.MaxSeedShare = defaultMaxSeedShare
+	}
+	if c.ReseedInterval == 0 {
+		c.ReseedInterval = defaultReseedInterval
+	}
+	if c.ReseedFraction == 0 {
+		c.ReseedFraction = defaultReseedFraction
+	}
+	return c
+}
+
+func (c PeerTableConfig) validate(check *configCheck) {
+	if c.MaxSeedShare < 0 || c.MaxSeedShare > 1 {
+		check.addf("max_seed_share", "must be between 0 and 1, got %v", c.MaxSeedShare)
+	}
+	if c.ReseedFraction < 0 || c.ReseedFraction > 1 {
+		check.addf("reseed_fraction", "must be between 0 and 1, got %v", c.ReseedFraction)
+	}
+}
+
+// subnetPrefix returns the /24 (IPv4) or /48 (IPv6) subnet of an address,
+// empty for private and loopback addresses and those which aren't IP
+// addresses
+func subnetPrefix(remoteAddr string) string {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return ""
+	}
+	addr := addrPort.Addr().Unmap()
+	if addr.IsPrivate() || addr.IsLoopback() {
+		return ""
+	}
+	return addressPrefix(remoteAddr, 24, 48)
+}
+
+// admitPeers chooses which of the peers handed out by the seeds are added to
+// a peer table holding known. Peers already in the table are kept. New peers
+// are refused from subnets which already have their share and, while the
+// seed which handed out the most new peers makes up more than its share of
+// the table, its peers are refused until it doesn't.
+func (n *node) admitPeers(known, candidates []*model.PeerSpec) []*model.PeerSpec {
+	knownAddrs := map[string]struct{}{}
+	subnets := map[string]int{}
+	sources := map[string]int{}
+	for _, p := range known {
+		knownAddrs[p.RemoteAddr] = struct{}{}
+		subnets[subnetPrefix(p.RemoteAddr)]++
+		sources[p.Source]++
+	}
+
+	admitted := []*model.PeerSpec{}
+	added := map[string][]*model.PeerSpec{}
+	for _, p := range candidates {
+		if _, ok := knownAddrs[p.RemoteAddr]; ok {
+			admitted = append(admitted, p)
+			continue
+		}
+		subnet := subnetPrefix(p.RemoteAddr)
+		if subnet != "" && n.peerTable.MaxPerSubnet > 0 && subnets[subnet] >= n.peerTable.MaxPerSubnet {
+			n.logger.Debug("refusing peer", "remote", p.RemoteAddr, "reason", "subnet", "source", p.Source)
+			n.metrics.peersRefused.WithLabelValues("subnet").Inc()
+			continue
+		}
+		subnets[subnet]++
+		sources[p.Source]++
+		added[p.Source] = append(added[p.Source], p)
+	}
+
+	for n.peerTable.MaxSeedShare < 1 {
+		total, seeds := 0, 0
+		for source, count := range sources {
+			total += count
+			if source != "" && count > 0 {
+				seeds++
+			}
+		}
+
+		worst := ""
+		for source, peers := range added {
+			if len(peers) > 0 && (worst == "" || sources[source] > sources[worst]) {
+				worst = source
+			}
+		}
+		if seeds < 2 || worst == "" || float64(sources[worst]) <= n.peerTable.MaxSeedShare*float64(total) {
+			break
+		}
+
+		refused := added[worst][len(added[worst])-1]
+		added[worst] = added[worst][:len(added[worst])-1]
+		sources[worst]--
+		n.logger.Debug("refusing peer", "remote", refused.RemoteAddr, "reason", "seed_share", "source", worst)
+		n.metrics.peersRefused.WithLabelValues("seed_share").Inc()
+	}
+
+	for _, peers := range added {
+		admitted = append(admitted, peers...)
+	}
+	return admitted
+}
+
+// reseedPeers drops a share of the peer table chosen at random and rejoins
+// the seeds to replace them
+func (n *node) reseedPeers(ctx context.Context) {
+	peers, err := n.store.GetAllPeers(ctx)
+	if err != nil {
+		n.logger.Error("fetching peers", "error", err)
+		return
+	}
+	if len(peers) == 0 {
+		return
+	}
+
+	count := int(math.Ceil(float64(len(peers)) * n.peerTable.ReseedFraction))
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	for _, p := range peers[:count] {
+		n.dropPeer(ctx, p.RemoteAddr, "reseeded")
+	}
+	n.logger.Debug("reseeding", "dropped", count, "peers", len(peers))
+
+	err = n.joinSeeds(ctx)
+	if err != nil {
+		n.logger.Error("rejoining seeds", "error", err)
+	}
+}
@@ -0,0 +1,288 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Plugins are WASM modules which export:
+//
+//	alloc(size i32) i32
+//	free(ptr i32, len i32)
+//	moderate(ptr i32, len i32) i64
+//
+// The node allocates a buffer with alloc, writes a JSON encoded pluginAction
+// into it and calls moderate. moderate returns the location of a JSON encoded
+// pluginVerdict packed as ptr<<32 | len, or 0 to accept the action unchanged.
+// The node hands both buffers back with free once it is done with them.
+// Modules may also export _initialize which is called when they are loaded.
+//
+// A call which overruns pluginTimeout is aborted, which discards the module's
+// instance; the next call starts again from a fresh instance.
+//
+// A rewrite only changes what this node executes. The signed statement is
+// what is journalled, stored, propagated and served as backfill, as peers
+// couldn't verify anything else, so peers apply their own moderation to the
+// original and the node's graph may differ from theirs. Actions replayed
+// from the journal are moderated again so the rewrite still applies.
+
+const (
+	PluginVerdictAccept  = "accept"
+	PluginVerdictReject  = "reject"
+	PluginVerdictRewrite = "rewrite"
+
+	pluginTimeout = time.Second
+)
+
+var ErrPluginABI = errors.New("plugin does not export alloc, free and moderate")
+
+type pluginAction struct {
+	ID         string    `json:"id"`
+	Identity   string    `json:"identity"`
+	NodeID     string    `json:"nodeId"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Timestamp  time.Time `json:"timestamp"`
+	Statement  string    `json:"statement"`
+}
+
+type pluginVerdict struct {
+	Verdict   string `json:"verdict"`
+	Reason    string `json:"reason,omitempty"`
+	Statement string `json:"statement,omitempty"`
+}
+
+type wasmPolicy struct {
+	mu       sync.Mutex
+	name     string
+	timeout  time.Duration
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	module   api.Module
+	alloc    api.Function
+	free     api.Function
+	moderate api.Function
+	limits   StatementLimits
+}
+
+func newWASMPolicy(path string, limits StatementLimits) (*wasmPolicy, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading plugin: %w", err)
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+
+	_, err = wasi_snapshot_preview1.Instantiate(ctx, runtime)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("instantiating wasi: %w", err)
+	}
+
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("compiling plugin: %w", err)
+	}
+
+	p := &wasmPolicy{
+		name:     "plugin:" + filepath.Base(path),
+		timeout:  pluginTimeout,
+		limits:   limits,
+		runtime:  runtime,
+		compiled: compiled,
+	}
+
+	err = p.instantiate(ctx)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// instantiate starts a fresh instance of the compiled module. The runtime
+// closes an instance whose call overruns its context, and with it any state
+// the plugin kept, so this is also how a policy recovers from a timeout.
+func (p *wasmPolicy) instantiate(ctx context.Context) error {
+	module, err := p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return fmt.Errorf("instantiating plugin: %w", err)
+	}
+
+	alloc := module.ExportedFunction("alloc")
+	free := module.ExportedFunction("free")
+	moderate := module.ExportedFunction("moderate")
+	if alloc == nil || free == nil || moderate == nil {
+		module.Close(ctx)
+		return ErrPluginABI
+	}
+
+	p.module, p.alloc, p.free, p.moderate = module, alloc, free, moderate
+	return nil
+}
+
+func (p *wasmPolicy) Name() string {
+	return p.name
+}
+
+// Moderate passes the action to the plugin. A rewritten statement is held to
+// the statement limits and replaces the statement and command seen by later
+// policies and executed locally; the original signed statement is what gets
+// propagated so that other nodes can still verify it.
+func (p *wasmPolicy) Moderate(action *graph.Action) error {
+	in, err := json.Marshal(&pluginAction{
+		ID:         action.ID,
+		Identity:   action.Identity,
+		NodeID:     action.NodeID,
+		RemoteAddr: action.RemoteAddr,
+		Timestamp:  action.Timestamp,
+		Statement:  action.Action,
+	})
+	if err != nil {
+		return fmt.Errorf("marshalling action: %w", err)
+	}
+
+	out, err := p.call(in)
+	if err != nil {
+		return err
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	verdict := pluginVerdict{}
+	err = json.Unmarshal(out, &verdict)
+	if err != nil {
+		return fmt.Errorf("decoding plugin verdict: %w", err)
+	}
+
+	switch verdict.Verdict {
+	case PluginVerdictAccept, "":
+		return nil
+	case PluginVerdictReject:
+		return fmt.Errorf("%s: %w", verdict.Reason, model.ErrNotAcceptable)
+	case PluginVerdictRewrite:
+		cmd, err := p.limits.parseStatement(verdict.Statement)
+		if err != nil {
+			return fmt.Errorf("parsing rewritten statement: %w", err)
+		}
+		action.Action = verdict.Statement
+		action.Command = cmd
+		return nil
+	}
+
+	return fmt.Errorf("unknown plugin verdict: %s", verdict.Verdict)
+}
+
+func (p *wasmPolicy) call(in []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), p.timeout)
+	defer cancelFn()
+
+	if p.module.IsClosed() {
+		err := p.instantiate(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := p.alloc.Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, fmt.Errorf("allocating plugin memory: %w", err)
+	}
+	ptr := uint32(res[0])
+
+	out, err := p.moderateAt(ctx, ptr, in)
+	if p.module.IsClosed() {
+		// the instance's memory went with it so there's nothing to free
+		return nil, err
+	}
+
+	freeErr := p.release(ctx, ptr, uint32(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	if freeErr != nil {
+		return nil, freeErr
+	}
+
+	return out, nil
+}
+
+func (p *wasmPolicy) moderateAt(ctx context.Context, ptr uint32, in []byte) ([]byte, error) {
+	if !p.module.Memory().Write(ptr, in) {
+		return nil, fmt.Errorf("writing plugin memory: out of range")
+	}
+
+	res, err := p.moderate.Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, fmt.Errorf("calling plugin: %w", err)
+	}
+
+	if res[0] == 0 {
+		return nil, nil
+	}
+
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	out, ok := p.module.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, fmt.Errorf("reading plugin memory: out of range")
+	}
+
+	// the slice is a view onto the module's memory so take a copy
+	out = append([]byte(nil), out...)
+
+	err = p.release(ctx, outPtr, outLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (p *wasmPolicy) release(ctx context.Context, ptr, size uint32) error {
+	_, err := p.free.Call(ctx, uint64(ptr), uint64(size))
+	if err != nil {
+		return fmt.Errorf("freeing plugin memory: %w", err)
+	}
+	return nil
+}
+
+func (p *wasmPolicy) Close() error {
+	return p.runtime.Close(context.Background())
+}
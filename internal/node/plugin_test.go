@@ -0,0 +1,107 @@
+package node
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testdata/plugin.wasm is assembled from testdata/plugin.wat
+func newTestPlugin(t *testing.T) *wasmPolicy {
+	p, err := newWASMPolicy(filepath.Join("testdata", "plugin.wasm"), StatementLimits{}.withDefaults())
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func liveBuffers(t *testing.T, p *wasmPolicy) uint64 {
+	live := p.module.ExportedGlobal("live")
+	require.NotNil(t, live)
+	return live.Get()
+}
+
+func TestWASMPolicy(t *testing.T) {
+	tests := map[string]struct {
+		id       string
+		expected error
+	}{
+		"accept": {id: "accepted"},
+		"reject": {id: "rejected", expected: model.ErrNotAcceptable},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newTestPlugin(t)
+
+			err := p.Moderate(&graph.Action{ID: tt.id, Action: `CREATE (:Post)`})
+			if tt.expected != nil {
+				assert.ErrorIs(t, err, tt.expected)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Zero(t, liveBuffers(t, p), "every buffer is handed back to the plugin")
+		})
+	}
+}
+
+func TestWASMPolicyTimeout(t *testing.T) {
+	p := newTestPlugin(t)
+	p.timeout = 50 * time.Millisecond
+
+	err := p.Moderate(&graph.Action{ID: "looping"})
+	assert.Error(t, err)
+	assert.True(t, p.module.IsClosed())
+
+	// an overrunning call costs that call, not the plugin
+	assert.NoError(t, p.Moderate(&graph.Action{ID: "accepted"}))
+	assert.ErrorIs(t, p.Moderate(&graph.Action{ID: "rejected"}), model.ErrNotAcceptable)
+	assert.Zero(t, liveBuffers(t, p))
+}
+
+func TestWASMPolicyABI(t *testing.T) {
+	// a module with no exports at all
+	path := filepath.Join(t.TempDir(), "empty.wasm")
+	require.NoError(t, os.WriteFile(path, []byte("\x00asm\x01\x00\x00\x00"), 0o600))
+
+	_, err := newWASMPolicy(path, StatementLimits{}.withDefaults())
+	assert.ErrorIs(t, err, ErrPluginABI)
+}
+
+func TestWASMPolicyRewrite(t *testing.T) {
+	n := newTestNode(t)
+	plugin := newTestPlugin(t)
+	n.moderation = moderationPipeline{plugin}
+
+	// the rewrite is executed but the signed statement is kept
+	stmt := "MERGE (p:Post{text:'original'})"
+	p, err := ast.Parse(stmt)
+	require.NoError(t, err)
+	action := &graph.Action{ID: "w1", Action: stmt, Command: p.Command()}
+	require.NoError(t, n.moderateStatement(context.Background(), action, stmt))
+	assert.Equal(t, stmt, action.Action)
+	text, _ := action.Command.Entity().Attribute("text")
+	assert.Equal(t, "rewritten", text)
+	assert.Zero(t, liveBuffers(t, plugin))
+
+	// later policies see the rewritten statement
+	deny, err := newModerationPipeline(ModerationConfig{DenyPatterns: []string{"rewritten"}}, StatementLimits{}.withDefaults())
+	require.NoError(t, err)
+	n.policies = deny
+	err = n.moderateStatement(context.Background(), &graph.Action{ID: "w2", Action: stmt, Command: p.Command()}, stmt)
+	var r *rejection
+	require.ErrorAs(t, err, &r)
+	assert.Equal(t, RejectReasonModeration, r.reason)
+
+	// rewrites are held to the statement limits
+	plugin.limits = StatementLimits{MaxLength: 10}.withDefaults()
+	err = plugin.Moderate(&graph.Action{ID: "w3", Action: stmt})
+	assert.ErrorIs(t, err, ErrStatementLimit)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/jdudmesh/propolis/internal/bloom"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const (
+	// precisionMinSamples is how many actions a peer must have been sent
+	// before its precision affects routing
+	precisionMinSamples = 100
+	// precisionFloor is the share of actions a peer must find relevant for
+	// it to be sent everything its filter matches
+	precisionFloor = 0.05
+	// saturatedFPR is the estimated false positive rate above which a peer's
+	// filter is treated as saturated
+	saturatedFPR = 0.5
+	// precisionProbeInterval is how often an action is still sent to an
+	// imprecise peer so that its precision keeps being measured
+	precisionProbeInterval = 10
+)
+
+// ErrIrrelevant is returned when a peer rejects an action because it touches
+// none of the peer's subscriptions
+var ErrIrrelevant = errors.New("action not relevant to peer")
+
+// peerPrecision counts how many of the actions sent to a peer it found
+// relevant. Counts start again when the peer's filter changes.
+type peerPrecision struct {
+	filter     string
+	sent       int
+	irrelevant int
+	skipped    int
+}
+
+func (p *peerPrecision) precision() float64 {
+	if p.sent == 0 {
+		return 1
+	}
+	return 1 - float64(p.irrelevant)/float64(p.sent)
+}
+
+// precisionTracker records which peers' filters match actions they don't
+// want, so that propagation can stop flooding peers whose filters are
+// saturated
+type precisionTracker struct {
+	mu    sync.Mutex
+	peers map[string]*peerPrecision
+}
+
+func newPrecisionTracker() *precisionTracker {
+	return &precisionTracker{
+		peers: map[string]*peerPrecision{},
+	}
+}
+
+// stats returns the peer's counts, resetting them if the filter has changed.
+// The caller must hold mu.
+func (t *precisionTracker) stats(peer *model.PeerSpec) *peerPrecision {
+	p, ok := t.peers[peer.RemoteAddr]
+	if !ok || p.filter != peer.Filter {
+		p = &peerPrecision{filter: peer.Filter}
+		t.peers[peer.RemoteAddr] = p
+	}
+	return p
+}
+
+// Record counts an action sent to the peer and returns the peer's precision
+func (t *precisionTracker) Record(peer *model.PeerSpec, relevant bool) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.stats(peer)
+	p.sent++
+	if !relevant {
+		p.irrelevant++
+	}
+	return p.precision()
+}
+
+// ShouldSend decides whether to send the peer an action its filter matches.
+// Peers are sent everything unless enough actions have been sent to show
+// that the filter is saturated and nearly everything it matches is rejected,
+// in which case only the occasional probe is sent.
+func (t *precisionTracker) ShouldSend(peer *model.PeerSpec, filter bloom.Membership) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.stats(peer)
+	if p.sent < precisionMinSamples || p.precision() >= precisionFloor {
+		return true
+	}
+	if filter.EstimateFPR(filter.EstimateCount()) < saturatedFPR {
+		return true
+	}
+
+	p.skipped++
+	return p.skipped%precisionProbeInterval == 0
+}
+
+// Forget drops the counts for the peer
+func (t *precisionTracker) Forget(remoteAddr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, remoteAddr)
+}
+
+// recordPrecision counts the outcome of sending an action to a peer
+func (n *node) recordPrecision(peer *model.PeerSpec, relevant bool) {
+	p := n.precision.Record(peer, relevant)
+	n.metrics.peerPrecision.WithLabelValues(peer.RemoteAddr).Set(p)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/secrets"
+)
+
+// Private subscriptions: the statement is encrypted with a key shared by the
+// members of the subscription and sent base64 encoded with the key ID in a
+// header. The signature covers the ciphertext so nodes without the key can
+// still verify the action, and the affected entity IDs travel in the clear so
+// they can route it, but only key holders can read or execute it.
+
+var ErrUnknownSubscriptionKey = errors.New("unknown subscription key")
+
+type subscriptionKeyring struct {
+	mu   sync.RWMutex
+	keys map[string]secrets.Sealer
+}
+
+func newSubscriptionKeyring(keys map[string]string) (*subscriptionKeyring, error) {
+	k := &subscriptionKeyring{
+		keys: map[string]secrets.Sealer{},
+	}
+
+	for id, encoded := range keys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("decoding subscription key %s: %w", id, err)
+		}
+		err = k.Add(id, key)
+		if err != nil {
+			return nil, fmt.Errorf("adding subscription key %s: %w", id, err)
+		}
+	}
+
+	return k, nil
+}
+
+func (k *subscriptionKeyring) Add(id string, key []byte) error {
+	sealer, err := secrets.New(key)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = sealer
+
+	return nil
+}
+
+func (k *subscriptionKeyring) get(id string) (secrets.Sealer, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	sealer, ok := k.keys[id]
+	return sealer, ok
+}
+
+func (k *subscriptionKeyring) Seal(id, stmt string) (string, error) {
+	sealer, ok := k.get(id)
+	if !ok {
+		return "", ErrUnknownSubscriptionKey
+	}
+
+	data, err := sealer.Seal([]byte(stmt))
+	if err != nil {
+		return "", fmt.Errorf("sealing statement: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Open decrypts a private statement. ok is false if we don't hold the key, in
+// which case the action can only be passed on.
+func (k *subscriptionKeyring) Open(id, payload string) (stmt string, ok bool, err error) {
+	sealer, ok := k.get(id)
+	if !ok {
+		return "", false, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", true, fmt.Errorf("decoding payload: %w", err)
+	}
+
+	plaintext, err := sealer.Open(data)
+	if err != nil {
+		return "", true, fmt.Errorf("opening payload: %w", err)
+	}
+
+	return string(plaintext), true, nil
+}
+
+// AddSubscriptionKey adds a shared key for a private subscription
+func (n *node) AddSubscriptionKey(id string, key []byte) error {
+	return n.subscriptionKeys.Add(id, key)
+}
+
+// ExecutePrivate signs and publishes a statement encrypted with the given
+// subscription key
+func (n *node) ExecutePrivate(ctx context.Context, id *identity.Identity, stmt, keyID string) error {
+	_, err := n.execute(ctx, id, "", stmt, keyID)
+	return err
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+)
+
+// An identity's profile, its handle and bio, is the Identity node it
+// publishes with its identifier as the id. Updates are merges of the same
+// node carrying the time the profile was changed, signed with the rest of
+// the statement, and the latest one is kept whatever order they arrive in so
+// every node ends up with the same profile.
+
+const attrProfileUpdatedAt = "updatedAt"
+
+// profileUpdatedAt is when the identity's profile last changed
+func profileUpdatedAt(id *identity.Identity) time.Time {
+	if id.UpdatedAt != nil {
+		return id.UpdatedAt.UTC()
+	}
+	return id.CreatedAt.UTC()
+}
+
+// checkProfile refuses an Identity merge for another identity, which would
+// take the identifier's node in the graph before the identity publishes it.
+// Profiles are ordered by the time they say they were updated, so one updated
+// further after the action was created than the clock skew allows is refused
+// too, as it could never be replaced.
+func (n *node) checkProfile(action *graph.Action, now time.Time) error {
+	e := identityStatement(action.Command, LabelIdentity)
+	if e == nil {
+		return nil
+	}
+	id, ok := e.Attribute("id")
+	if ok && id != action.Identity {
+		return fmt.Errorf("profile for another identity: %w", identity.ErrUnauthorized)
+	}
+
+	createdAt := now
+	if action.CreatedAt != nil {
+		createdAt = *action.CreatedAt
+	}
+	if ahead := profileTime(e).Sub(createdAt); ahead > n.clock.MaxSkew {
+		return fmt.Errorf("profile updated %s after it was signed: %w", ahead.Round(time.Second), ErrClockSkew)
+	}
+	return nil
+}
+
+// staleProfile reports whether the action publishes a profile older than the
+// one in the graph. Profiles without a time, published before updates were
+// ordered, are older than any with one, and the action ID breaks ties.
+func (n *node) staleProfile(executor Graph, action graph.Action) bool {
+	e := identityStatement(action.Command, LabelIdentity)
+	if e == nil {
+		return false
+	}
+	id, _ := e.Attribute("id")
+	if id == "" {
+		return false
+	}
+
+	current, err := executor.GetNode(id)
+	if err != nil {
+		if !errors.Is(err, graph.ErrNotFound) {
+			n.logger.Error("fetching profile", "error", err, "identity", id)
+		}
+		return false
+	}
+
+	currentAt, _ := current.Attributes[attrProfileUpdatedAt].(string)
+	return olderProfile(profileTime(e), action.ID, parseProfileTime(currentAt), current.LastActionID)
+}
+
+// olderProfile reports whether the profile updated at, by actionID, is older
+// than the one updated at current by currentActionID
+func olderProfile(at time.Time, actionID string, current time.Time, currentActionID string) bool {
+	if !at.Equal(current) {
+		return at.Before(current)
+	}
+	return actionID < currentActionID
+}
+
+func profileTime(e ast.Entity) time.Time {
+	v, _ := e.Attribute(attrProfileUpdatedAt)
+	return parseProfileTime(v)
+}
+
+func parseProfileTime(v string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,50 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckProfile(t *testing.T) {
+	n := newTestNode(t)
+	n.clock = ClockConfig{}.withDefaults()
+
+	now := time.Now().UTC()
+	createdAt := now.Add(-time.Hour)
+
+	testCases := []struct {
+		name      string
+		id        string
+		updatedAt time.Time
+		createdAt *time.Time
+		err       error
+	}{
+		{name: "own profile", id: "alice", updatedAt: createdAt, createdAt: &createdAt},
+		{name: "within the skew", id: "alice", updatedAt: createdAt.Add(n.clock.MaxSkew), createdAt: &createdAt},
+		// signed an hour ago, so it can't say it was updated now
+		{name: "updated after it was signed", id: "alice", updatedAt: now, createdAt: &createdAt, err: ErrClockSkew},
+		{name: "future without a creation time", id: "alice", updatedAt: now.Add(time.Hour), err: ErrClockSkew},
+		{name: "without a creation time", id: "alice", updatedAt: now},
+		{name: "another identity's profile", id: "bob", updatedAt: createdAt, createdAt: &createdAt, err: identity.ErrUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := ast.Parse("MERGE (i:" + LabelIdentity + "{id:" + ast.Quote(tc.id) + ", " + attrProfileUpdatedAt + ":" + ast.Quote(tc.updatedAt.Format(time.RFC3339Nano)) + "})")
+			require.NoError(t, err)
+
+			err = n.checkProfile(&graph.Action{Identity: "alice", Command: p.Command(), CreatedAt: tc.createdAt}, now)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
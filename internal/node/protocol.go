@@ -0,0 +1,124 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The wire protocol is versioned so that format changes can be rolled out a
+// node at a time:
+//
+//   - Hellos, goodbyes, pings and whoami carry the sender's protocol version
+//     and features in the x-propolis-protocol and x-propolis-features
+//     headers, and the answers carry the receiver's. A node which sends
+//     neither speaks version 1 with no features.
+//   - Two nodes talk using the lower of their versions, so a version only
+//     adds to the one before it. Peer tables keep the versions and features
+//     of peers, and seeds hand them out with the peers which joined them.
+//   - A seed refuses hellos from versions below MinProtocolVersion with 426
+//     Upgrade Required, giving its own version, and a node doesn't use seeds
+//     whose whoami gives one. Raising MinProtocolVersion is how support for
+//     an old version is dropped.
+//   - Features are optional formats or behaviours within a version, used
+//     with a node only once it has listed them. Unknown features are
+//     ignored, so a new one can be deployed gradually and folded into the
+//     next version once every supported version has it.
+//   - A change which can't be negotiated as a feature, such as a new
+//     envelope for actions, needs a new version.
+const (
+	// ProtocolVersion is the version of the wire protocol this node speaks
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version this node talks to
+	MinProtocolVersion = 1
+
+	// FeatureSignedControl is hellos, goodbyes and pings signed with the
+	// node key
+	FeatureSignedControl = "signed-control"
+	// FeatureJoinWork is doing the proof of work a seed asks for
+	FeatureJoinWork = "join-work"
+	// FeatureFilterTypes is subscription filters other than bloom filters,
+	// listed in the x-propolis-filter-types header
+	FeatureFilterTypes = "filter-types"
+
+	// legacyProtocolVersion is the version of nodes which don't say
+	legacyProtocolVersion = 1
+)
+
+// ErrProtocolUnsupported is returned for a node whose protocol version is
+// below MinProtocolVersion
+var ErrProtocolUnsupported = errors.New("protocol version unsupported")
+
+// protocolFeatures lists the features this node has
+var protocolFeatures = []string{
+	FeatureSignedControl,
+	FeatureJoinWork,
+	FeatureFilterTypes,
+}
+
+// setProtocolHeaders adds this node's protocol version, features and
+// software version to a request or response
+func (n *node) setProtocolHeaders(header http.Header) {
+	header.Set(HeaderProtocol, strconv.Itoa(ProtocolVersion))
+	header.Set(HeaderFeatures, strings.Join(protocolFeatures, ","))
+	header.Set(HeaderSoftwareVersion, n.version)
+}
+
+// parseProtocolHeaders returns the version and features another node sent,
+// the legacy version and none if it didn't say. A version which can't be
+// read is returned as 0, which is never supported.
+func parseProtocolHeaders(header http.Header) (int, []string) {
+	version := legacyProtocolVersion
+	if v := header.Get(HeaderProtocol); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			parsed = 0
+		}
+		version = parsed
+	}
+
+	features := []string{}
+	for _, f := range strings.Split(header.Get(HeaderFeatures), ",") {
+		f = strings.TrimSpace(f)
+		if f != "" {
+			features = append(features, f)
+		}
+	}
+	return version, features
+}
+
+// recordPeerProtocol stores the protocol version, features and software
+// version a peer sent in a request or response header
+func (n *node) recordPeerProtocol(ctx context.Context, remoteAddr string, header http.Header) {
+	version, features := parseProtocolHeaders(header)
+	err := n.store.SetPeerProtocol(ctx, remoteAddr, version, strings.Join(features, ","), header.Get(HeaderSoftwareVersion))
+	if err != nil {
+		n.logger.Error("recording protocol", "error", err, "remote", remoteAddr)
+	}
+}
+
+// writeUpgradeRequired refuses a hello from a node whose version is too old
+func (n *node) writeUpgradeRequired(w http.ResponseWriter, req *http.Request, version int) {
+	n.logger.Warn("refusing old protocol", "remote", req.RemoteAddr, "protocol", version, "min", MinProtocolVersion)
+	n.setProtocolHeaders(w.Header())
+	w.WriteHeader(http.StatusUpgradeRequired)
+	w.Write([]byte("protocol " + strconv.Itoa(version) + " is older than " + strconv.Itoa(MinProtocolVersion)))
+}
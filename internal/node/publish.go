@@ -0,0 +1,185 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+var (
+	errNotPeer          = errors.New("only peers can publish on the peer port")
+	errPublishForbidden = errors.New("identity can't publish through this node")
+)
+
+// PublishConfig is read from the publish section of the config file and
+// controls who can send actions to /publish. Actions are signed so by default
+// anyone can.
+type PublishConfig struct {
+	// RequirePeer only accepts actions on the peer port from this node's peers
+	// and nodes which have sent it signed pings recently, clients publish on
+	// the client address instead
+	RequirePeer bool `mapstructure:"require_peer"`
+	// Identities, if set, are the only identities which can publish through
+	// this node from outside the network. Actions relayed by peers are
+	// accepted whoever published them.
+	Identities []string `mapstructure:"identities"`
+}
+
+func (c PublishConfig) validate(check *configCheck) {
+	for _, id := range c.Identities {
+		if id == "" {
+			check.addf("identities", "must not be empty")
+		}
+	}
+}
+
+// authorizePublisher checks that the sender of an action may publish it.
+// Requests made on the client address always come from outside the network.
+func (n *node) authorizePublisher(req *http.Request, body []byte, action *graph.Action, client bool) error {
+	if !n.publish.RequirePeer && len(n.publish.Identities) == 0 {
+		return nil
+	}
+
+	peer := !client && n.isEstablishedPeer(req.Context(), req, body)
+	if !client && n.publish.RequirePeer && !peer {
+		n.logger.Info("publish from non-peer refused", "remote", req.RemoteAddr, "id", action.ID)
+		return &rejection{reason: RejectReasonUnauthorized, status: http.StatusForbidden, message: errNotPeer.Error(), err: errNotPeer}
+	}
+	if !peer && len(n.publish.Identities) > 0 && !slices.Contains(n.publish.Identities, action.Identity) {
+		n.logger.Info("publish refused", "remote", req.RemoteAddr, "id", action.ID, "identity", action.Identity)
+		return &rejection{reason: RejectReasonUnauthorized, status: http.StatusForbidden, message: errPublishForbidden.Error(), err: errPublishForbidden}
+	}
+	return nil
+}
+
+// isEstablishedPeer reports whether a request comes from one of this node's
+// peers or from a node which has sent it a signed ping recently, which it
+// will have done after getting this node from a seed. Nodes sending over TCP
+// connect from another port, so unless the request comes from a peer's own
+// address it must be signed with the node key the peer or ping was bound to.
+func (n *node) isEstablishedPeer(ctx context.Context, req *http.Request, body []byte) bool {
+	peer, err := n.store.GetPeer(ctx, req.RemoteAddr)
+	if err != nil {
+		n.logger.Error("fetching peer", "error", err, "remote", req.RemoteAddr)
+		return false
+	}
+
+	// a peer with a key bound to its address has to sign with it
+	nodeKey, err := n.verifyControl(req, body, peer)
+	if err != nil {
+		n.logger.Debug("publisher signature", "error", err, "remote", req.RemoteAddr)
+		return false
+	}
+	if peer != nil {
+		return true
+	}
+	if nodeKey == "" {
+		return false
+	}
+
+	if n.pingedBy.seen(nodeKey) {
+		return true
+	}
+
+	peers, err := n.store.GetAllPeers(ctx)
+	if err != nil {
+		n.logger.Error("fetching peers", "error", err)
+		return false
+	}
+	return slices.ContainsFunc(peers, func(p *model.PeerSpec) bool {
+		return p.NodeKey == nodeKey
+	})
+}
+
+// maxPingsTracked bounds the node keys remembered by a pingTracker, the
+// oldest is forgotten to make room
+const maxPingsTracked = 4096
+
+// pingTracker remembers the node keys which have signed pings to this node
+type pingTracker struct {
+	mu     sync.Mutex
+	window time.Duration
+	seenAt map[string]time.Time
+}
+
+func newPingTracker(window time.Duration) *pingTracker {
+	return &pingTracker{
+		window: window,
+		seenAt: map[string]time.Time{},
+	}
+}
+
+func (t *pingTracker) record(nodeKey string) {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	oldest := ""
+	for k, at := range t.seenAt {
+		if now.Sub(at) > t.window {
+			delete(t.seenAt, k)
+			continue
+		}
+		if oldest == "" || at.Before(t.seenAt[oldest]) {
+			oldest = k
+		}
+	}
+
+	if _, ok := t.seenAt[nodeKey]; !ok && len(t.seenAt) >= maxPingsTracked {
+		delete(t.seenAt, oldest)
+	}
+	t.seenAt[nodeKey] = now
+}
+
+func (t *pingTracker) seen(nodeKey string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	at, ok := t.seenAt[nodeKey]
+	return ok && time.Since(at) <= t.window
+}
+
+// newClientServeMux routes the requests clients make on the client address,
+// publishing and, for nodes which serve queries, reading the graph
+func (n *node) newClientServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /whois/{id}", n.handleWhoIs)
+	if n.capabilities.Has(CapabilityRelay) {
+		mux.HandleFunc("POST /publish", n.handleClientPublish)
+		mux.HandleFunc("GET /handles/{handle}", n.handleResolveHandle)
+	}
+	if n.capabilities.Has(CapabilityServeQueries) {
+		mux.HandleFunc("GET /actions", n.handleActions)
+		mux.HandleFunc("POST /query", n.handleQuery)
+		mux.HandleFunc("GET /views/{name}", n.handleView)
+		mux.HandleFunc("POST /visualize", n.handleVisualize)
+	}
+	return mux
+}
+
+func (n *node) handleClientPublish(w http.ResponseWriter, req *http.Request) {
+	n.receiveAction(w, req, true)
+}
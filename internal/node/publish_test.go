@@ -0,0 +1,79 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsEstablishedPeer(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode(t)
+	n.control = ControlConfig{}.withDefaults()
+	n.pingedBy = newPingTracker(time.Minute)
+
+	newSigner := func() *node {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		return &node{nodeKey: key}
+	}
+	peer, pinger, stranger := newSigner(), newSigner(), newSigner()
+	require.NoError(t, n.store.UpsertPeer(ctx, model.PeerSpec{RemoteAddr: "10.0.0.2:9000", CreatedAt: time.Now(), NodeID: "peer", NodeKey: peer.NodeKey()}))
+	n.pingedBy.record(pinger.NodeKey())
+
+	body := []byte(`{"id":"1"}`)
+	request := func(remoteAddr string, signer *node) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "https://10.0.0.1:9000/publish", bytes.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(HeaderNodeID, "peer")
+		if signer != nil {
+			signer.signControl(req, body)
+		}
+		return req
+	}
+
+	tests := map[string]struct {
+		req      *http.Request
+		expected bool
+	}{
+		"peer address":               {request("10.0.0.2:9000", peer), true},
+		"peer key from another port": {request("10.0.0.2:51234", peer), true},
+		"pinged":                     {request("10.0.0.3:51234", pinger), true},
+		// the node ID header isn't signed so it counts for nothing
+		"unsigned peer node ID":     {request("10.0.0.2:51234", nil), false},
+		"unsigned at peer address":  {request("10.0.0.2:9000", nil), false},
+		"unknown key":               {request("10.0.0.2:51234", stranger), false},
+		"wrong key at peer address": {request("10.0.0.2:9000", stranger), false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, n.isEstablishedPeer(ctx, tt.req, body))
+		})
+	}
+}
+
+func TestPingTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	tracker := newPingTracker(time.Minute)
+	for i := range maxPingsTracked + 1 {
+		tracker.record(fmt.Sprintf("key%d", i))
+	}
+	assert.Len(tracker.seenAt, maxPingsTracked)
+	assert.False(tracker.seen("key0"))
+	assert.True(tracker.seen(fmt.Sprintf("key%d", maxPingsTracked)))
+
+	tracker.seenAt["key1"] = time.Now().Add(-2 * time.Minute)
+	assert.False(tracker.seen("key1"))
+}
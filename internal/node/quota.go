@@ -0,0 +1,158 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+const (
+	defaultGCInterval = time.Minute
+	gcBatchSize       = 100
+)
+
+var (
+	ErrRateLimited  = errors.New("identity has exceeded its action rate")
+	ErrStorageQuota = errors.New("identity has exceeded its storage quota")
+)
+
+// QuotaConfig is read from the quotas section of the config file. Zero values
+// disable the corresponding limit.
+type QuotaConfig struct {
+	// ActionsPerHour is the number of actions accepted from each identity in
+	// any hour
+	ActionsPerHour int `mapstructure:"actions_per_hour"`
+	// MaxBytesPerIdentity is the total size of the statements stored for each
+	// identity
+	MaxBytesPerIdentity int64 `mapstructure:"max_bytes_per_identity"`
+	// ActionTTL is how long actions are kept. Publishers can ask for a shorter
+	// TTL with the x-propolis-ttl header.
+	ActionTTL time.Duration `mapstructure:"action_ttl"`
+	// GCInterval is how often expired actions are evicted on cache nodes
+	GCInterval time.Duration `mapstructure:"gc_interval"`
+}
+
+func (c QuotaConfig) validate(check *configCheck) {
+	nonNegative(check, "actions_per_hour", c.ActionsPerHour)
+	nonNegative(check, "max_bytes_per_identity", c.MaxBytesPerIdentity)
+	nonNegative(check, "action_ttl", c.ActionTTL)
+	nonNegative(check, "gc_interval", c.GCInterval)
+}
+
+func (n *node) checkQuota(ctx context.Context, action *graph.Action) error {
+	if action.Identity == "" {
+		return nil
+	}
+
+	quotas := n.quotaConfig()
+	if quotas.ActionsPerHour > 0 {
+		count, err := n.store.CountActionsSince(ctx, action.Identity, time.Now().UTC().Add(-time.Hour))
+		if err != nil {
+			return fmt.Errorf("checking action rate: %w", err)
+		}
+		if count >= quotas.ActionsPerHour {
+			return ErrRateLimited
+		}
+	}
+
+	if quotas.MaxBytesPerIdentity > 0 {
+		size, err := n.store.BytesStoredBy(ctx, action.Identity)
+		if err != nil {
+			return fmt.Errorf("checking storage: %w", err)
+		}
+		if size+int64(len(action.Action)) > quotas.MaxBytesPerIdentity {
+			return ErrStorageQuota
+		}
+	}
+
+	return nil
+}
+
+// actionExpiry works out when an action expires from the TTL requested by the
+// publisher (in seconds, may be empty) and the node's own TTL, whichever is
+// sooner
+func (n *node) actionExpiry(now time.Time, requestedTTL string) (*time.Time, error) {
+	ttl := n.quotaConfig().ActionTTL
+
+	if requestedTTL != "" {
+		secs, err := strconv.Atoi(requestedTTL)
+		if err != nil || secs <= 0 {
+			return nil, fmt.Errorf("invalid ttl: %s", requestedTTL)
+		}
+		requested := time.Duration(secs) * time.Second
+		if ttl == 0 || requested < ttl {
+			ttl = requested
+		}
+	}
+
+	if ttl == 0 {
+		return nil, nil
+	}
+
+	expiresAt := now.Add(ttl)
+	return &expiresAt, nil
+}
+
+// collectExpiredActions evicts expired actions and removes whatever they wrote
+// to the graph
+func (n *node) collectExpiredActions(ctx context.Context) error {
+	for {
+		ids, err := n.store.GetExpiredActions(ctx, time.Now().UTC(), gcBatchSize)
+		if err != nil {
+			return err
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		count, err := n.executor.PurgeActions(ids)
+		if err != nil {
+			return fmt.Errorf("purging expired actions: %w", err)
+		}
+		for name, g := range n.namespaces {
+			c, err := g.PurgeActions(ids)
+			if err != nil {
+				return fmt.Errorf("purging expired actions in namespace %s: %w", name, err)
+			}
+			count += c
+		}
+
+		err = n.store.EvictActions(ctx, ids)
+		if err != nil {
+			return err
+		}
+
+		err = n.journal.evict(ids)
+		if err != nil {
+			return fmt.Errorf("evicting journalled actions: %w", err)
+		}
+
+		n.metrics.actionsEvicted.Add(float64(len(ids)))
+		n.logger.Debug("evicted expired actions", "actions", len(ids), "entities", count)
+
+		if len(ids) < gcBatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Reload applies the parts of a changed config which can take effect while
+// the node runs: the moderation policies, webhooks, quotas, statement limits,
+// log levels and seeds.
+// Anything else needs a restart. If the seeds changed they are contacted again
+// in the background, as a resync from the admin API would.
+func (n *node) Reload(config Config) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	// levels set from the admin API are replaced by the config's
+	err = n.loggers.ApplyLevels(config.LogLevels)
+	if err != nil {
+		return fmt.Errorf("setting log levels: %w", err)
+	}
+
+	moderation, err := newModerationPipeline(config.Moderation, config.Limits.withDefaults())
+	if err != nil {
+		return fmt.Errorf("creating moderation pipeline: %w", err)
+	}
+
+	webhooks := newWebhooks(config.Webhooks, n.logger, n.metrics)
+
+	n.reloadMu.Lock()
+	previous := n.moderation
+	previousWebhooks := n.webhooks
+	seedsChanged := !slices.Equal(n.seeds, config.Seeds) ||
+		!slices.Equal(n.seedDomains, config.SeedDomains) ||
+		!slices.Equal(n.bootstrapURLs, config.BootstrapURLs)
+	n.moderation = moderation
+	n.webhooks = webhooks
+	n.quotas = config.Quotas
+	n.limits = config.Limits.withDefaults()
+	n.seeds = config.Seeds
+	n.seedDomains = config.SeedDomains
+	n.bootstrapURLs = config.BootstrapURLs
+	n.reloadMu.Unlock()
+
+	// policies in use hold the read lock so none are still moderating
+	err = previous.Close()
+	if err != nil {
+		n.logger.Error("closing moderation policies", "error", err)
+	}
+	// payloads still queued for the old webhooks are dropped
+	previousWebhooks.Close()
+
+	n.logger.Info("reloaded config", "policies", len(moderation), "webhooks", len(webhooks), "seeds_changed", seedsChanged)
+
+	// a node that hasn't started contacts the new seeds when it does
+	if seedsChanged && n.isStarted() {
+		go func() {
+			err := n.setInitialSeeds(n.ctx)
+			if err != nil {
+				n.logger.Error("refreshing seeds", "error", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (n *node) quotaConfig() QuotaConfig {
+	n.reloadMu.RLock()
+	defer n.reloadMu.RUnlock()
+	return n.quotas
+}
+
+func (n *node) statementLimits() StatementLimits {
+	n.reloadMu.RLock()
+	defer n.reloadMu.RUnlock()
+	return n.limits
+}
@@ -0,0 +1,260 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/model"
+)
+
+const (
+	defaultReplicationInterval = 10 * time.Second
+	// MaxReplicationPeers is the most peers sent in one replication response
+	MaxReplicationPeers = 64
+	// replicationOverlap is how far before the last change seen each pull
+	// starts, covering peers written while the previous pull was answered
+	replicationOverlap = time.Minute
+	// peerTombstoneAge is how long the deletion of a peer is remembered for
+	// replicas to pick up
+	peerTombstoneAge = time.Hour
+)
+
+// ReplicationConfig is read from the replication section of the config file.
+// Seeds run side by side, e.g. behind one address, share their peer table by
+// pulling what has changed from each other, so that any of them can answer a
+// joining peer and a restarted seed gets the table back from the others.
+type ReplicationConfig struct {
+	// Replicas are the addresses of the other seeds sharing the peer table
+	Replicas []string `mapstructure:"replicas"`
+	// Token authenticates the seeds to each other, all of them must use the
+	// same one
+	Token string `mapstructure:"token"`
+	// Interval is how often changes are pulled from each replica
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+func (c ReplicationConfig) withDefaults() ReplicationConfig {
+	if c.Interval == 0 {
+		c.Interval = defaultReplicationInterval
+	}
+	return c
+}
+
+func (c ReplicationConfig) validate(check *configCheck, config Config) {
+	nonNegative(check, "interval", c.Interval)
+	if len(c.Replicas) == 0 {
+		return
+	}
+	if c.Token == "" {
+		check.addf("token", "must be set with replicas")
+	}
+	capabilities, err := config.capabilities()
+	if err == nil && !capabilities.Has(CapabilityAcceptJoins) {
+		check.addf("replicas", "only seeds, with the accepts-joins capability, replicate peers")
+	}
+}
+
+// replicator pulls peer changes from the other seeds. Each replica's cursor is
+// the time, on its clock, of the last change pulled from it and is lost on
+// restart so that a restarted seed pulls the whole table.
+type replicator struct {
+	config ReplicationConfig
+	// busy stops a slow pull overlapping the next one
+	busy atomic.Bool
+
+	mu      sync.Mutex
+	cursors map[string]time.Time
+}
+
+// newReplicator returns nil unless the node replicates its peer table
+func newReplicator(config ReplicationConfig) *replicator {
+	if len(config.Replicas) == 0 && config.Token == "" {
+		return nil
+	}
+	return &replicator{
+		config:  config.withDefaults(),
+		cursors: map[string]time.Time{},
+	}
+}
+
+func (r *replicator) cursor(replica string) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cursors[replica]
+}
+
+func (r *replicator) advance(replica string, to time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cursors[replica] = to
+}
+
+// handleReplicatePeers returns the peers changed and deleted since the since
+// parameter, oldest first, with More set if there are more changes to fetch.
+// The after parameter is the address of the last peer read at since.
+func (n *node) handleReplicatePeers(w http.ResponseWriter, req *http.Request) {
+	since := time.Time{}
+	if s := req.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	after := req.URL.Query().Get("after")
+
+	now := time.Now().UTC()
+	peers, err := n.store.GetPeersChangedSince(req.Context(), since, after, MaxReplicationPeers)
+	if err != nil {
+		n.logger.Error("fetching changed peers", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	deleted, err := n.store.GetPeerTombstones(req.Context(), since)
+	if err != nil {
+		n.logger.Error("fetching deleted peers", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	n.writeJSON(w, model.PeerReplication{
+		At:      now,
+		Peers:   peers,
+		Deleted: deleted,
+		More:    len(peers) == MaxReplicationPeers,
+	})
+}
+
+// replicatePeers pulls the changes to the peer table from every replica
+func (n *node) replicatePeers(ctx context.Context) {
+	if n.replication == nil || !n.replication.busy.CompareAndSwap(false, true) {
+		return
+	}
+	defer n.replication.busy.Store(false)
+
+	err := n.store.PrunePeerTombstones(ctx, time.Now().UTC().Add(-peerTombstoneAge))
+	if err != nil {
+		n.logger.Error("pruning peer tombstones", "error", err)
+	}
+
+	wg := sync.WaitGroup{}
+	for _, replica := range n.replication.config.Replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := n.pullPeers(ctx, replica)
+			if err != nil {
+				n.logger.Error("replicating peers", "error", err, "remote", replica)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// pullPeers merges the peers changed on a replica since the last pull, page
+// by page
+func (n *node) pullPeers(ctx context.Context, replica string) error {
+	since := n.replication.cursor(replica)
+	if !since.IsZero() {
+		since = since.Add(-replicationOverlap)
+	}
+	after := ""
+
+	for {
+		resp, err := n.fetchPeerChanges(ctx, replica, since, after)
+		if err != nil {
+			return err
+		}
+
+		err = n.store.MergeReplicatedPeers(ctx, resp.Peers, resp.Deleted)
+		if err != nil {
+			return err
+		}
+		n.metrics.peersReplicated.Add(float64(len(resp.Peers)))
+		if len(resp.Peers) > 0 {
+			n.peersAdded()
+		}
+
+		if !resp.More || len(resp.Peers) == 0 {
+			n.replication.advance(replica, resp.At)
+			return nil
+		}
+		last := resp.Peers[len(resp.Peers)-1]
+		since, after = last.SeenAt(), last.RemoteAddr
+	}
+}
+
+func (n *node) fetchPeerChanges(ctx context.Context, replica string, since time.Time, after string) (*model.PeerReplication, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
+	defer cancelFn()
+
+	q := url.Values{}
+	if !since.IsZero() {
+		q.Set("since", since.Format(time.RFC3339Nano))
+	}
+	if after != "" {
+		q.Set("after", after)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/replication/peers?%s", replica, q.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating replication request: %w", err)
+	}
+	req.Header.Add(HeaderNodeID, n.nodeID)
+	req.Header.Add(HeaderAuthorization, "Bearer "+n.replication.config.Token)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching peer changes: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad replication response: %d", resp.StatusCode)
+	}
+
+	msg := &model.PeerReplication{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, MaxBodySize)).Decode(msg)
+	if err != nil {
+		return nil, fmt.Errorf("decoding peer changes: %w", err)
+	}
+	return msg, nil
+}
+
+// recordPeerDeleted remembers that a peer left or was dropped so replicas
+// delete it too. Peers dropped for missing pings aren't recorded, each seed
+// applies the liveness check to the last time any of them saw the peer.
+func (n *node) recordPeerDeleted(ctx context.Context, remoteAddr string) {
+	if n.replication == nil {
+		return
+	}
+	err := n.store.AddPeerTombstone(ctx, remoteAddr, time.Now().UTC())
+	if err != nil {
+		n.logger.Error("recording deleted peer", "error", err, "remote", remoteAddr)
+	}
+}
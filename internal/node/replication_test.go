@@ -0,0 +1,52 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullPeers(t *testing.T) {
+	ctx := context.Background()
+
+	// more peers than fit in one response, all seen at the same time so a
+	// page boundary falls between two of them
+	source := newTestNode(t)
+	seen := time.Now().UTC().Add(-time.Minute)
+	peers := []*model.PeerSpec{}
+	for i := range MaxReplicationPeers + 6 {
+		peers = append(peers, &model.PeerSpec{RemoteAddr: fmt.Sprintf("10.0.%d.%d:9000", i/256, i%256), CreatedAt: seen.Add(-time.Hour), UpdatedAt: timePtr(seen)})
+	}
+	require.NoError(t, source.store.MergeReplicatedPeers(ctx, peers, nil))
+
+	n := newTestNode(t)
+	n.ctx = ctx
+	n.outboxEmpty.Store(true)
+	n.replication = newReplicator(ReplicationConfig{Replicas: []string{"seed2:9000"}, Token: "secret"})
+
+	pages := 0
+	n.client = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		pages++
+		if req.URL.Host != "seed2:9000" || req.Header.Get(HeaderAuthorization) != "Bearer secret" {
+			return &http.Response{StatusCode: http.StatusUnauthorized, Body: http.NoBody, Request: req}, nil
+		}
+		rec := httptest.NewRecorder()
+		source.handleReplicatePeers(rec, req)
+		return rec.Result(), nil
+	})}
+
+	require.NoError(t, n.pullPeers(ctx, "seed2:9000"))
+	assert.Equal(t, 2, pages)
+
+	count, err := n.store.CountOfPeers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, len(peers), count)
+	assert.False(t, n.replication.cursor("seed2:9000").IsZero())
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultPruneInterval = 10 * time.Minute
+	pruneBatchSize       = 500
+)
+
+// RetentionConfig is read from the retention section of the config file.
+// Processed actions are kept so that duplicates and replays are recognised,
+// pruning them stops the node database growing forever.
+type RetentionConfig struct {
+	// MaxAge is how long processed actions are kept, 0 keeps them forever.
+	// Replays of pruned actions are rejected by the clock check as too old,
+	// so it can't be shorter than clock.max_age plus clock.max_skew. Actions
+	// from older nodes without a creation time leave a digest of their ID
+	// behind instead.
+	MaxAge time.Duration `mapstructure:"max_age"`
+	// PruneInterval is how often actions older than MaxAge are pruned
+	PruneInterval time.Duration `mapstructure:"prune_interval"`
+}
+
+func (c RetentionConfig) withDefaults() RetentionConfig {
+	if c.PruneInterval == 0 {
+		c.PruneInterval = defaultPruneInterval
+	}
+	return c
+}
+
+func (c RetentionConfig) validate(check *configCheck, clock ClockConfig) {
+	nonNegative(check, "max_age", c.MaxAge)
+	nonNegative(check, "prune_interval", c.PruneInterval)
+
+	if c.MaxAge == 0 {
+		return
+	}
+	window := clock.withDefaults().replayWindow()
+	if c.MaxAge < window {
+		check.addf("max_age", "must be at least %s, clock.max_age plus clock.max_skew, so replays of pruned actions are rejected", window)
+	}
+	if c.MaxAge < time.Hour {
+		check.addf("max_age", "must be at least 1h so quotas.actions_per_hour counts every action")
+	}
+}
+
+// replayWindow is how long after an action is received a replay of it could
+// still pass the clock check
+func (c ClockConfig) replayWindow() time.Duration {
+	return c.MaxAge + c.MaxSkew
+}
+
+// pruneActions deletes processed actions older than the retention window.
+// Actions waiting to expire are left for the garbage collector, which needs
+// them to find what they wrote to the graph.
+func (n *node) pruneActions(ctx context.Context) error {
+	if n.retention.MaxAge == 0 {
+		return nil
+	}
+
+	return n.pruneActionsBefore(ctx, time.Now().UTC().Add(-n.retention.MaxAge))
+}
+
+// pruneActionsBefore deletes the processed actions received before the given
+// time, from the journal as well as the store
+func (n *node) pruneActionsBefore(ctx context.Context, before time.Time) error {
+	err := n.journal.compact(before)
+	if err != nil {
+		return err
+	}
+
+	for {
+		actions, err := n.store.GetPrunableActions(ctx, before, pruneBatchSize)
+		if err != nil {
+			return err
+		}
+
+		if len(actions) == 0 {
+			return nil
+		}
+
+		ids := make([]string, 0, len(actions))
+		digests := []int64{}
+		for _, a := range actions {
+			ids = append(ids, a.ID)
+			// the clock check can't reject a replay without a creation time
+			if a.CreatedAt == nil {
+				digests = append(digests, int64(actionDigest(a.ID)))
+			}
+		}
+
+		err = n.store.PruneActions(ctx, ids, digests)
+		if err != nil {
+			return fmt.Errorf("pruning actions: %w", err)
+		}
+
+		n.metrics.actionsPruned.Add(float64(len(ids)))
+		n.logger.Debug("pruned actions", "actions", len(ids), "digests", len(digests))
+
+		if len(actions) < pruneBatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneActions(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"sqlite": func(t *testing.T) Store {
+			s, err := newStore(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()), secrets.Plaintext())
+			require.NoError(t, err)
+			return s
+		},
+		"memory": func(t *testing.T) Store {
+			return newMemoryStore()
+		},
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			n := newTestNode(t)
+			n.store.Close()
+			n.store = open(t)
+			n.retention = RetentionConfig{MaxAge: 48 * time.Hour}.withDefaults()
+
+			now := time.Now().UTC()
+			old := now.Add(-72 * time.Hour)
+			expires := now.Add(time.Hour)
+			create := func(id string, at time.Time, createdAt, expiresAt *time.Time) {
+				require.NoError(t, n.store.CreateAction(ctx, graph.Action{ID: id, Timestamp: at, Action: id, CreatedAt: createdAt, ExpiresAt: expiresAt}))
+			}
+			// more than one batch of old actions
+			for i := range pruneBatchSize + 1 {
+				create(fmt.Sprintf("old%d", i), old, &old, nil)
+			}
+			create("legacy", old, nil, nil)
+			create("expiring", old, &old, &expires)
+			create("recent", now, &now, nil)
+
+			require.NoError(t, n.pruneActions(ctx))
+
+			processed := func(id string) bool {
+				ok, err := n.store.IsActionProcessed(ctx, id, int64(actionDigest(id)))
+				require.NoError(t, err)
+				return ok
+			}
+			// the clock check rejects replays of old actions, so they are gone
+			assert.False(t, processed("old0"))
+			assert.False(t, processed(fmt.Sprintf("old%d", pruneBatchSize)))
+			// only a digest is left of an action without a creation time
+			assert.True(t, processed("legacy"))
+			// the garbage collector still needs expiring actions
+			assert.True(t, processed("expiring"))
+			assert.True(t, processed("recent"))
+
+			remaining, err := n.store.GetActionsSince(ctx, time.Time{}, "", 10)
+			require.NoError(t, err)
+			ids := []string{}
+			for _, a := range remaining {
+				ids = append(ids, a.ID)
+			}
+			assert.Equal(t, []string{"expiring", "recent"}, ids)
+		})
+	}
+
+	// retention is off unless max_age is set
+	n := newTestNode(t)
+	old := time.Now().UTC().Add(-72 * time.Hour)
+	require.NoError(t, n.store.CreateAction(context.Background(), graph.Action{ID: "kept", Timestamp: old, CreatedAt: &old}))
+	require.NoError(t, n.pruneActions(context.Background()))
+	processed, err := n.store.IsActionProcessed(context.Background(), "kept", 0)
+	require.NoError(t, err)
+	assert.True(t, processed)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+)
+
+const LabelRevocation = "Revocation"
+
+// PublishRevocation publishes an identity's revocation to the graph. Once
+// peers have seen it they reject any further actions from the identity.
+func (n *node) PublishRevocation(ctx context.Context, id *identity.Identity, r *identity.Revocation) error {
+	cert, err := identity.VerifyRevocation(r)
+	if err != nil {
+		return fmt.Errorf("verifying revocation: %w", err)
+	}
+
+	err = n.Execute(ctx, id, revocationStatement(r))
+	if err != nil {
+		return err
+	}
+
+	err = n.store.RevokeCachedCertificate(ctx, cert, r.RevokedAt, r.Reason)
+	if err != nil {
+		return fmt.Errorf("caching revocation: %w", err)
+	}
+
+	return nil
+}
+
+// revocationStatement returns the MERGE which publishes a revocation. The
+// values are quoted so the reason is published as it was signed.
+func revocationStatement(r *identity.Revocation) string {
+	props := []string{
+		"id:" + ast.Quote(r.Identifier+".revoked"),
+		"identity:" + ast.Quote(r.Identifier),
+		"revokedAt:" + ast.Quote(r.RevokedAt.Format(time.RFC3339Nano)),
+		"reason:" + ast.Quote(r.Reason),
+		"certificate:" + ast.Quote(base64.StdEncoding.EncodeToString(r.Certificate)),
+		"signature:" + ast.Quote(r.Signature),
+	}
+	return "MERGE (:" + LabelRevocation + "{" + strings.Join(props, ", ") + "})"
+}
+
+// applyRevocation marks the identity as revoked if the action is a
+// revocation. It must be signed with the key the action was verified with.
+func (n *node) applyRevocation(ctx context.Context, action *graph.Action) error {
+	r, err := revocationFromCommand(action.Command)
+	if err != nil || r == nil {
+		return err
+	}
+
+	if r.Identifier != action.Identity {
+		return fmt.Errorf("revocation for another identity: %w", identity.ErrUnauthorized)
+	}
+
+	cert, err := identity.VerifyRevocation(r)
+	if err != nil {
+		return err
+	}
+
+	if action.Certificate == nil || !action.Certificate.Equal(cert) {
+		return fmt.Errorf("revocation from unknown certificate: %w", identity.ErrUnauthorized)
+	}
+
+	err = n.store.RevokeCachedCertificate(ctx, cert, r.RevokedAt, r.Reason)
+	if err != nil {
+		return fmt.Errorf("caching revocation: %w", err)
+	}
+
+	n.logger.Info("identity revoked", "identity", r.Identifier, "reason", r.Reason)
+
+	return nil
+}
+
+// revocationFromCommand returns the revocation described by a Revocation
+// merge, or nil if the command is something else
+func revocationFromCommand(cmd ast.Command) (*identity.Revocation, error) {
+	e := identityStatement(cmd, LabelRevocation)
+	if e == nil {
+		return nil, nil
+	}
+
+	attr := func(k string) string {
+		v, _ := e.Attribute(k)
+		return v
+	}
+
+	r := &identity.Revocation{
+		Identifier: attr("identity"),
+		Reason:     attr("reason"),
+		Signature:  attr("signature"),
+	}
+
+	var err error
+	r.RevokedAt, err = time.Parse(time.RFC3339Nano, attr("revokedAt"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing revocation time: %w", identity.ErrBadSignature)
+	}
+
+	r.Certificate, err = base64.StdEncoding.DecodeString(attr("certificate"))
+	if err != nil {
+		return nil, fmt.Errorf("decoding certificate: %w", identity.ErrBadSignature)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,77 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyRevocation(t *testing.T) {
+	store, err := identity.NewStore("file:node-revocation.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	svc, err := identity.NewService(store)
+	require.NoError(t, err)
+	id, err := svc.CreateIdentity("revoked", "", true)
+	require.NoError(t, err)
+	other, err := svc.CreateIdentity("other", "", false)
+	require.NoError(t, err)
+
+	revocation, err := svc.Revoke(id, `key 'lost' \o/`)
+	require.NoError(t, err)
+	stmt := revocationStatement(revocation)
+
+	testCases := []struct {
+		name   string
+		stmt   string
+		action graph.Action
+		err    error
+	}{
+		{name: "another identity's revocation", stmt: stmt, action: graph.Action{Identity: other.Identifier, Certificate: other.Certificate}, err: identity.ErrUnauthorized},
+		{name: "signed by another certificate", stmt: stmt, action: graph.Action{Identity: id.Identifier, Certificate: other.Certificate}, err: identity.ErrUnauthorized},
+		{name: "changed reason", stmt: revocationStatementWith(t, revocation, "changed"), action: graph.Action{Identity: id.Identifier, Certificate: id.Certificate}, err: identity.ErrUnauthorized},
+		{name: "revocation", stmt: stmt, action: graph.Action{Identity: id.Identifier, Certificate: id.Certificate}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			n := newTestNode(t)
+
+			p, err := ast.Parse(tc.stmt)
+			require.NoError(t, err)
+			tc.action.Command = p.Command()
+
+			err = n.applyRevocation(ctx, &tc.action)
+			revokedAt, getErr := n.store.GetRevocation(ctx, id.Identifier)
+			require.NoError(t, getErr)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				assert.Nil(t, revokedAt)
+				return
+			}
+			require.NoError(t, err)
+			if assert.NotNil(t, revokedAt) {
+				assert.True(t, revocation.RevokedAt.Equal(*revokedAt))
+			}
+
+			// the reason is published as it was signed
+			r, err := revocationFromCommand(p.Command())
+			require.NoError(t, err)
+			assert.Equal(t, `key 'lost' \o/`, r.Reason)
+		})
+	}
+}
+
+// revocationStatementWith returns the statement publishing the revocation
+// with another reason than the one signed
+func revocationStatementWith(t *testing.T, r *identity.Revocation, reason string) string {
+	t.Helper()
+	changed := *r
+	changed.Reason = reason
+	return revocationStatement(&changed)
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+)
+
+const (
+	LabelKeyRotation        = "KeyRotation"
+	defaultKeyRotationGrace = 24 * time.Hour
+)
+
+// PublishRotation publishes a key rotation to the graph. The action is signed
+// with the previous key as that is the one peers hold.
+func (n *node) PublishRotation(ctx context.Context, r *identity.Rotation) error {
+	cert, previous, err := parseRotationCertificates(r)
+	if err != nil {
+		return err
+	}
+
+	err = n.store.RotateCachedCertificate(ctx, cert, previous, r.RotatedAt)
+	if err != nil {
+		return fmt.Errorf("caching certificate: %w", err)
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString("MERGE (:" + LabelKeyRotation + "{")
+	props := []string{
+		fmt.Sprintf("id:'%s.%s'", r.Identifier, cert.SerialNumber.String()),
+		fmt.Sprintf("identity:'%s'", r.Identifier),
+		fmt.Sprintf("rotatedAt:'%s'", r.RotatedAt.Format(time.RFC3339Nano)),
+		fmt.Sprintf("previousCertificate:'%s'", base64.StdEncoding.EncodeToString(r.PreviousCertificate)),
+		fmt.Sprintf("certificate:'%s'", base64.StdEncoding.EncodeToString(r.Certificate)),
+		fmt.Sprintf("signature:'%s'", r.Signature),
+	}
+	sb.WriteString(strings.Join(props, ", "))
+	sb.WriteString("})")
+
+	return n.Execute(ctx, r.Previous, sb.String())
+}
+
+// applyRotation updates the certificate cache if the action is a key rotation.
+// The rotation must be signed by the key we currently hold for the identity.
+func (n *node) applyRotation(ctx context.Context, action *graph.Action) error {
+	r, err := rotationFromCommand(action.Command)
+	if err != nil || r == nil {
+		return err
+	}
+
+	if r.Identifier != action.Identity {
+		return fmt.Errorf("rotation for another identity: %w", identity.ErrUnauthorized)
+	}
+
+	cert, err := identity.VerifyRotation(r)
+	if err != nil {
+		return err
+	}
+
+	current, err := n.store.GetCachedCertificate(ctx, r.Identifier)
+	if err != nil {
+		return fmt.Errorf("getting certificate: %w", err)
+	}
+
+	if current.Equal(cert) {
+		// already applied
+		return nil
+	}
+
+	if !slices.Equal(current.Raw, r.PreviousCertificate) {
+		return fmt.Errorf("rotation from unknown certificate: %w", identity.ErrUnauthorized)
+	}
+
+	err = n.store.RotateCachedCertificate(ctx, cert, current, r.RotatedAt)
+	if err != nil {
+		return fmt.Errorf("caching certificate: %w", err)
+	}
+
+	err = n.store.PutIdentityRecord(ctx, cert, action.ID)
+	if err != nil {
+		return fmt.Errorf("recording identity: %w", err)
+	}
+
+	n.logger.Info("identity rotated keys", "identity", r.Identifier, "serial", cert.SerialNumber)
+
+	return nil
+}
+
+// rotationFromCommand returns the rotation described by a KeyRotation merge, or
+// nil if the command is something else
+func rotationFromCommand(cmd ast.Command) (*identity.Rotation, error) {
+	e := identityStatement(cmd, LabelKeyRotation)
+	if e == nil {
+		return nil, nil
+	}
+
+	attr := func(k string) string {
+		v, _ := e.Attribute(k)
+		return v
+	}
+
+	r := &identity.Rotation{
+		Identifier: attr("identity"),
+		Signature:  attr("signature"),
+	}
+
+	var err error
+	r.RotatedAt, err = time.Parse(time.RFC3339Nano, attr("rotatedAt"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing rotation time: %w", identity.ErrBadSignature)
+	}
+
+	r.PreviousCertificate, err = base64.StdEncoding.DecodeString(attr("previousCertificate"))
+	if err != nil {
+		return nil, fmt.Errorf("decoding previous certificate: %w", identity.ErrBadSignature)
+	}
+
+	r.Certificate, err = base64.StdEncoding.DecodeString(attr("certificate"))
+	if err != nil {
+		return nil, fmt.Errorf("decoding certificate: %w", identity.ErrBadSignature)
+	}
+
+	return r, nil
+}
+
+// identityStatement returns the entity if the command merges a node with the
+// given label
+func identityStatement(cmd ast.Command, label string) ast.Entity {
+	if cmd == nil || cmd.Type() != ast.EntityTypeMergeCmd {
+		return nil
+	}
+
+	e := cmd.Entity()
+	if e == nil || !slices.Contains(e.Labels(), label) {
+		return nil
+	}
+
+	return e
+}
+
+func parseRotationCertificates(r *identity.Rotation) (cert, previous *x509.Certificate, err error) {
+	cert, err = x509.ParseCertificate(r.Certificate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	previous, err = x509.ParseCertificate(r.PreviousCertificate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing previous certificate: %w", err)
+	}
+
+	return cert, previous, nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+var schemaName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// APISchema is a label schema declared in the graph. Attributes map each
+// attribute to its type, string or number, ending in ! if it is required.
+type APISchema struct {
+	Label      string            `json:"label"`
+	Owner      string            `json:"owner,omitempty"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// APIDeclareSchemaRequest publishes a label schema into a graph
+type APIDeclareSchemaRequest struct {
+	APISchema
+	// Identity is the local identity to sign as, the primary identity if empty
+	Identity string `json:"identity,omitempty"`
+	// Namespace is the graph to publish to, the default graph if empty
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// handleAPISchemas lists the label schemas declared in the graph given by
+// the namespace parameter
+func (n *node) handleAPISchemas(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+
+	executor, err := n.graphFor(namespace)
+	if err != nil {
+		n.writeQueryError(w, req, err)
+		return
+	}
+
+	schemas, err := executor.DeclaredSchemas()
+	if err != nil {
+		n.logger.Error("listing schemas", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]*APISchema, 0, len(schemas))
+	for _, s := range schemas {
+		a := &APISchema{
+			Label:      s.Label,
+			Owner:      s.OwnerID,
+			Attributes: map[string]string{},
+		}
+		for name, attr := range s.Attributes {
+			a.Attributes[name] = attr.String()
+		}
+		res = append(res, a)
+	}
+	n.writeJSON(w, res)
+}
+
+// handleAPIDeclareSchema signs and publishes a label schema
+func (n *node) handleAPIDeclareSchema(w http.ResponseWriter, req *http.Request) {
+	body := APIDeclareSchemaRequest{}
+	if !readAPIRequest(w, req, &body) {
+		return
+	}
+
+	schema := &graph.LabelSchema{
+		Label:      body.Label,
+		Attributes: map[string]graph.AttributeSchema{},
+	}
+	if !schemaName.MatchString(body.Label) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("label must be an identifier"))
+		return
+	}
+	for name, typ := range body.Attributes {
+		attr, err := graph.ParseAttributeSchema(typ)
+		if err != nil || !schemaName.MatchString(name) || name == graph.SchemaLabelAttribute {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("bad attribute " + name + ": attributes are identifiers other than label with a type of string or number, ending in ! if required"))
+			return
+		}
+		schema.Attributes[name] = attr
+	}
+
+	id, ok := n.apiIdentity(w, body.Identity)
+	if !ok {
+		return
+	}
+
+	n.apiExecute(w, req, id, body.Namespace, schema.Statement(), "")
+}
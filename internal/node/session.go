@@ -0,0 +1,447 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// sessions are long lived QUIC connections negotiated with the "propolis" ALPN
+// token. Every request/response pair travels on its own bidirectional stream so
+// pings, publishes and query results are multiplexed over one connection and a
+// dropped connection is noticed as soon as QUIC gives up on it.
+
+const (
+	ProtocolSession = "propolis"
+	ProtocolHTTP3   = "h3"
+
+	// a frame is its JSON encoded header followed by the body as is, each
+	// prefixed with its length
+	maxFrameHeaderSize = 65536
+	maxFrameBodySize   = MaxBodySize
+
+	sessionKeepAlive   = 15 * time.Second
+	sessionIdleTimeout = 45 * time.Second
+)
+
+var ErrFrameTooLarge = errors.New("session frame too large")
+
+type sessionFrame struct {
+	Method string `json:"method,omitempty"`
+	// Host is the authority the sender dialed, which signed control
+	// messages cover
+	Host   string      `json:"host,omitempty"`
+	Path   string      `json:"path,omitempty"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"-"`
+}
+
+type sessionDialer func(ctx context.Context, addr string) (quic.Connection, error)
+
+type session struct {
+	conn       quic.Connection
+	remoteAddr string
+}
+
+type sessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	dial     sessionDialer
+	handler  http.Handler
+	logger   *slog.Logger
+	onClose  func(remoteAddr string)
+	metrics  *nodeMetrics
+}
+
+func newSessionManager(dial sessionDialer, handler http.Handler, logger *slog.Logger, onClose func(string), metrics *nodeMetrics) *sessionManager {
+	return &sessionManager{
+		sessions: map[string]*session{},
+		dial:     dial,
+		handler:  handler,
+		logger:   logger,
+		onClose:  onClose,
+		metrics:  metrics,
+	}
+}
+
+func writeFrame(w io.Writer, f *sessionFrame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("marshalling frame: %w", err)
+	}
+	if len(data) > maxFrameHeaderSize || len(f.Body) > maxFrameBodySize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, 0, 8+len(data)+len(f.Body))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.Body)))
+	buf = append(buf, f.Body...)
+	_, err = w.Write(buf)
+	if err != nil {
+		return fmt.Errorf("writing frame: %w", err)
+	}
+
+	return nil
+}
+
+func readFrame(r io.Reader) (*sessionFrame, error) {
+	data, err := readFrameSegment(r, maxFrameHeaderSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading frame header: %w", err)
+	}
+
+	f := &sessionFrame{}
+	err = json.Unmarshal(data, f)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalling frame: %w", err)
+	}
+
+	f.Body, err = readFrameSegment(r, maxFrameBodySize)
+	if err != nil {
+		return nil, fmt.Errorf("reading frame body: %w", err)
+	}
+
+	return f, nil
+}
+
+// readFrameSegment reads a length prefixed part of a frame
+func readFrameSegment(r io.Reader, limit int) ([]byte, error) {
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr)
+	if size > uint32(limit) {
+		return nil, ErrFrameTooLarge
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Accept registers an inbound connection so that replies to the remote node can
+// reuse it rather than dialing a new one.
+func (m *sessionManager) Accept(conn quic.Connection) {
+	m.register(conn)
+}
+
+func (m *sessionManager) register(conn quic.Connection) *session {
+	s := &session{
+		conn:       conn,
+		remoteAddr: conn.RemoteAddr().String(),
+	}
+
+	m.mu.Lock()
+	if prev, ok := m.sessions[s.remoteAddr]; ok && prev.conn.Context().Err() == nil {
+		m.mu.Unlock()
+		// keep the existing session but still serve anything sent on the new one
+		go m.serve(s)
+		return prev
+	}
+	m.sessions[s.remoteAddr] = s
+	m.mu.Unlock()
+
+	m.logger.Debug("session opened", "remote", s.remoteAddr)
+
+	go m.serve(s)
+	go m.watch(s)
+
+	return s
+}
+
+func (m *sessionManager) watch(s *session) {
+	<-s.conn.Context().Done()
+
+	m.mu.Lock()
+	cur, registered := m.sessions[s.remoteAddr]
+	registered = registered && cur == s
+	if registered {
+		delete(m.sessions, s.remoteAddr)
+	}
+	m.mu.Unlock()
+
+	m.logger.Info("session closed", "remote", s.remoteAddr, "cause", context.Cause(s.conn.Context()))
+
+	// sessions removed with Drop have already been dealt with by the caller
+	if registered && m.onClose != nil {
+		m.onClose(s.remoteAddr)
+	}
+}
+
+func (m *sessionManager) serve(s *session) {
+	for {
+		str, err := s.conn.AcceptStream(s.conn.Context())
+		if err != nil {
+			return
+		}
+		go m.serveStream(s, str)
+	}
+}
+
+func (m *sessionManager) serveStream(s *session, str quic.Stream) {
+	defer str.Close()
+
+	in, err := readFrame(str)
+	if err != nil {
+		m.logger.Error("reading session request", "error", err, "remote", s.remoteAddr)
+		str.CancelRead(0)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(s.conn.Context(), in.Method, "https://"+s.conn.LocalAddr().String()+in.Path, bytes.NewReader(in.Body))
+	if err != nil {
+		m.logger.Error("constructing session request", "error", err, "remote", s.remoteAddr)
+		writeFrame(str, &sessionFrame{Status: http.StatusBadRequest})
+		return
+	}
+	if in.Header != nil {
+		req.Header = in.Header
+	}
+	if in.Host != "" {
+		req.Host = in.Host
+	}
+	req.RemoteAddr = s.remoteAddr
+
+	w := &sessionResponseWriter{header: http.Header{}}
+	m.handler.ServeHTTP(w, req)
+
+	out := &sessionFrame{
+		Status: w.statusCode(),
+		Header: w.header,
+		Body:   w.body.Bytes(),
+	}
+
+	err = writeFrame(str, out)
+	if err != nil {
+		m.logger.Error("writing session response", "error", err, "remote", s.remoteAddr)
+	}
+}
+
+func (m *sessionManager) get(ctx context.Context, remoteAddr string) (*session, error) {
+	m.mu.Lock()
+	s, ok := m.sessions[remoteAddr]
+	m.mu.Unlock()
+	if ok && s.conn.Context().Err() == nil {
+		m.metrics.connectionUsed(TransportQUIC, true)
+		return s, nil
+	}
+
+	conn, err := m.dial(ctx, remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing session: %w", err)
+	}
+
+	m.metrics.connectionUsed(TransportQUIC, false)
+	return m.register(conn), nil
+}
+
+// RoundTrip sends the request over a session stream, dialing the remote node if
+// there is no live session yet.
+func (m *sessionManager) RoundTrip(req *http.Request) (*http.Response, error) {
+	s, err := m.get(req.Context(), req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	body := []byte{}
+	if req.Body != nil {
+		defer req.Body.Close()
+		body, err = readRequestBody(req.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	str, err := s.conn.OpenStreamSync(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("opening stream: %w", err)
+	}
+
+	if deadline, ok := req.Context().Deadline(); ok {
+		str.SetDeadline(deadline)
+	}
+
+	err = writeFrame(str, &sessionFrame{
+		Method: req.Method,
+		Host:   cmp.Or(req.Host, req.URL.Host),
+		Path:   req.URL.RequestURI(),
+		Header: req.Header,
+		Body:   body,
+	})
+	if err != nil {
+		str.CancelRead(0)
+		return nil, err
+	}
+	str.Close()
+
+	f, err := readFrame(str)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Header == nil {
+		f.Header = http.Header{}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+		StatusCode:    f.Status,
+		Proto:         ProtocolSession,
+		Header:        f.Header,
+		Body:          io.NopCloser(bytes.NewReader(f.Body)),
+		ContentLength: int64(len(f.Body)),
+		Request:       req,
+	}, nil
+}
+
+func (m *sessionManager) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+func (m *sessionManager) Drop(remoteAddr string) {
+	m.mu.Lock()
+	s, ok := m.sessions[remoteAddr]
+	delete(m.sessions, remoteAddr)
+	m.mu.Unlock()
+
+	if ok {
+		s.conn.CloseWithError(0, "dropped")
+	}
+}
+
+func (m *sessionManager) Close() error {
+	m.mu.Lock()
+	sessions := m.sessions
+	m.sessions = map[string]*session{}
+	m.mu.Unlock()
+
+	for _, s := range sessions {
+		s.conn.CloseWithError(0, "closing")
+	}
+
+	return nil
+}
+
+type sessionResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *sessionResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *sessionResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+func (w *sessionResponseWriter) WriteHeader(statusCode int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = statusCode
+}
+
+func (w *sessionResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// sessionRoundTripper prefers a session to the remote node and falls back to
+// one-shot HTTP/3 requests for nodes which don't speak the session protocol.
+type sessionRoundTripper struct {
+	sessions *sessionManager
+	fallback http.RoundTripper
+	logger   *slog.Logger
+}
+
+func (t *sessionRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		data, err := readRequestBody(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = data
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	resp, err := t.sessions.RoundTrip(req)
+	if err == nil {
+		return resp, nil
+	}
+
+	var netErr net.Error
+	if req.Context().Err() != nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return nil, err
+	}
+
+	t.logger.Debug("session unavailable, falling back to http3", "error", err, "remote", req.URL.Host)
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return t.fallback.RoundTrip(req)
+}
+
+func sessionQUICConfig(tracer func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer) *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod: sessionKeepAlive,
+		MaxIdleTimeout:  sessionIdleTimeout,
+		Tracer:          tracer,
+	}
+}
+
+func sessionTLSConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos:         []string{ProtocolSession},
+		InsecureSkipVerify: true,
+	}
+}
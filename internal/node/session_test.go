@@ -0,0 +1,258 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestQUICTransport listens on a loopback port with the QUIC transport,
+// serving handler
+func newTestQUICTransport(t *testing.T, n *node, handler http.Handler) *quicTransport {
+	tlsConfig, err := newCertificateSource(TLSConfig{}, "test").transportConfig()
+	require.NoError(t, err)
+	qt, err := newQUICTransport(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, tlsConfig, n.logger, nil, n.metrics)
+	require.NoError(t, err)
+	require.NoError(t, qt.Listen(handler))
+	t.Cleanup(func() { qt.Close() })
+	return qt
+}
+
+func TestSessionControlHost(t *testing.T) {
+	seed := newTestNode(t)
+	seed.control = ControlConfig{RequireSignatures: true}.withDefaults()
+	listener := newTestQUICTransport(t, seed, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := readControlBody(req)
+		if err == nil {
+			_, err = seed.verifyControl(req, body, nil)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write([]byte(req.Host))
+	}))
+	port := listener.udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	joining := newTestNode(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	joining.nodeKey = key
+	sender := newTestQUICTransport(t, joining, http.NotFoundHandler())
+
+	// the signature covers the name the seed was dialed by, not the address
+	// the session arrived on
+	for _, host := range []string{fmt.Sprintf("localhost:%d", port), fmt.Sprintf("127.0.0.1:%d", port)} {
+		req, err := joining.newControlRequest(context.Background(), "https://"+host+"/hello", []byte("filter"))
+		require.NoError(t, err)
+		resp, err := sender.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, ProtocolSession, resp.Proto)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, host)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, host, string(body))
+	}
+}
+
+func TestSessionFrames(t *testing.T) {
+	large := bytes.Repeat([]byte{0xff}, MaxBodySize)
+
+	tests := []struct {
+		name  string
+		frame sessionFrame
+		err   error
+	}{
+		{name: "request", frame: sessionFrame{Method: "POST", Host: "seed.example:9000", Path: "/hello", Header: http.Header{"X-Test": {"1"}}, Body: []byte("filter")}},
+		{name: "response", frame: sessionFrame{Status: http.StatusAccepted}},
+		// bodies aren't encoded so the whole limit can be used
+		{name: "largest body", frame: sessionFrame{Status: http.StatusOK, Body: large}},
+		{name: "body too large", frame: sessionFrame{Status: http.StatusOK, Body: append(large, 0)}, err: ErrFrameTooLarge},
+		{name: "header too large", frame: sessionFrame{Path: "/" + strings.Repeat("x", maxFrameHeaderSize)}, err: ErrFrameTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			err := writeFrame(&buf, &tt.frame)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				assert.Zero(t, buf.Len())
+				return
+			}
+			require.NoError(t, err)
+
+			f, err := readFrame(&buf)
+			require.NoError(t, err)
+			assert.Equal(t, tt.frame.Method, f.Method)
+			assert.Equal(t, tt.frame.Host, f.Host)
+			assert.Equal(t, tt.frame.Path, f.Path)
+			assert.Equal(t, tt.frame.Status, f.Status)
+			assert.Equal(t, tt.frame.Header, f.Header)
+			assert.Equal(t, len(tt.frame.Body), len(f.Body))
+			assert.True(t, bytes.Equal(tt.frame.Body, f.Body))
+		})
+	}
+
+	// lengths over the limits are refused before anything is read
+	buf := bytes.Buffer{}
+	require.NoError(t, writeFrame(&buf, &sessionFrame{Status: http.StatusOK}))
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[len(data)-4:], maxFrameBodySize+1)
+	_, err := readFrame(bytes.NewReader(data))
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+
+	// as are frames cut short
+	_, err = readFrame(bytes.NewReader(data[:len(data)-2]))
+	assert.Error(t, err)
+}
+
+func TestSessionRequests(t *testing.T) {
+	listening := newTestNode(t)
+	listener := newTestQUICTransport(t, listening, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Path", req.URL.Path)
+		w.Write(body)
+	}))
+	addr := listener.udpConn.LocalAddr().String()
+
+	n := newTestNode(t)
+	sender := newTestQUICTransport(t, n, http.NotFoundHandler())
+
+	send := func(path string, body []byte) (*http.Response, []byte, error) {
+		req, err := http.NewRequest("POST", "https://"+addr+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := sender.RoundTrip(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return resp, data, err
+	}
+
+	// requests sent at once each get their own stream on the one session
+	errs := make(chan error, 20)
+	wg := sync.WaitGroup{}
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/ping/%d", i)
+			body := bytes.Repeat([]byte{byte(i)}, 1000*i)
+			resp, data, err := send(path, body)
+			switch {
+			case err != nil:
+				errs <- err
+			case resp.Proto != ProtocolSession || resp.Header.Get("X-Path") != path || !bytes.Equal(body, data):
+				errs <- fmt.Errorf("%s: wrong response %s %q", path, resp.Proto, resp.Header.Get("X-Path"))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, sender.CountOfSessions())
+
+	// the largest body arrives whole, a larger one isn't cut short
+	body := bytes.Repeat([]byte("x"), MaxBodySize)
+	_, data, err := send("/publish", body)
+	require.NoError(t, err)
+	assert.Equal(t, len(body), len(data))
+
+	_, _, err = send("/publish", append(body, 'x'))
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestSessionClosed(t *testing.T) {
+	listening := newTestNode(t)
+	listener := newTestQUICTransport(t, listening, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	addr := listener.udpConn.LocalAddr().String()
+
+	n := newTestNode(t)
+	sender := newTestQUICTransport(t, n, http.NotFoundHandler())
+	closed := make(chan string, 1)
+	sender.sessions.onClose = func(remoteAddr string) {
+		closed <- remoteAddr
+	}
+
+	req, err := http.NewRequest("POST", "https://"+addr+"/ping", nil)
+	require.NoError(t, err)
+	resp, err := sender.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, 1, sender.CountOfSessions())
+
+	// the remote node going away is noticed without sending anything
+	require.NoError(t, listener.Close())
+	select {
+	case remoteAddr := <-closed:
+		assert.Equal(t, addr, remoteAddr)
+	case <-time.After(5 * time.Second):
+		t.Fatal("session close wasn't noticed")
+	}
+	assert.Zero(t, sender.CountOfSessions())
+}
+
+func TestSessionFallback(t *testing.T) {
+	// a node which only speaks HTTP/3
+	tlsConfig, err := newCertificateSource(TLSConfig{}, "test").transportConfig()
+	require.NoError(t, err)
+	tlsConfig.NextProtos = []string{ProtocolHTTP3}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	server := &http3.Server{
+		TLSConfig: tlsConfig,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := io.ReadAll(req.Body)
+			w.Write(body)
+		}),
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		server.Close()
+		conn.Close()
+	})
+
+	n := newTestNode(t)
+	sender := newTestQUICTransport(t, n, http.NotFoundHandler())
+
+	req, err := http.NewRequest("POST", "https://"+conn.LocalAddr().String()+"/publish", strings.NewReader("statement"))
+	require.NoError(t, err)
+	resp, err := sender.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	// the body is sent again with the HTTP/3 request
+	assert.Equal(t, "statement", string(data))
+	assert.Equal(t, 3, resp.ProtoMajor)
+	assert.Zero(t, sender.CountOfSessions())
+}
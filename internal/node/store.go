@@ -18,115 +18,174 @@ package node
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/x509"
 	"database/sql"
+	"embed"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/sqlite3"
-	"github.com/jdudmesh/propolis/pkg/migrate/v4/source/reflect"
-
 	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/migration"
 	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/jdudmesh/propolis/internal/secrets"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migrations are the versions of the node database schema
+var Migrations = migration.New("node", migrationFiles, "migrations")
+
 const defaultTimeout = 10 * time.Second
 
-type store struct {
-	db *sqlx.DB
-}
+// Store is the node's own database: seeds, peers, cached certificates and
+// the actions it has received. The node uses SQLite unless Config.Store
+// supplies another implementation; memoryStore keeps everything in maps so
+// node logic can be tested without a database.
+type Store interface {
+	PeerStore
+	ActionStore
+	CertificateStore
 
-func newStore(databaseURL string) (*store, error) {
-	db, err := sqlx.Connect("sqlite3", databaseURL)
-	if err != nil {
-		return nil, fmt.Errorf("connecting to database: %w", err)
-	}
+	// the key the node signs control messages with
+	GetNodeKey(ctx context.Context) (ed25519.PrivateKey, error)
+	PutNodeKey(ctx context.Context, key ed25519.PrivateKey) error
 
-	err = createSchema(db)
-	if err != nil {
-		return nil, fmt.Errorf("creating schema: %w", err)
-	}
+	// blocked and muted identities
+	PutBlock(ctx context.Context, block model.BlockSpec) error
+	DeleteBlock(ctx context.Context, identity string) error
+	GetBlock(ctx context.Context, identity string) (*model.BlockSpec, error)
+	GetBlocks(ctx context.Context) ([]*model.BlockSpec, error)
 
-	store := &store{
-		db,
-	}
+	Close() error
+}
 
-	return store, nil
+// PeerStore keeps the seeds and peers the node knows, and what seeds
+// replicate of their peer tables
+type PeerStore interface {
+	// seeds
+	UpsertSeeds(ctx context.Context, seeds []*model.SeedSpec) error
+	AddSeeds(ctx context.Context, seeds []*model.SeedSpec) error
+	GetSeeds(ctx context.Context) ([]*model.SeedSpec, error)
+	TouchSeed(ctx context.Context, remoteAddr string) error
+
+	// peers
+	GetAllPeers(ctx context.Context) ([]*model.PeerSpec, error)
+	GetPeer(ctx context.Context, remoteAddr string) (*model.PeerSpec, error)
+	GetRandomPeers(ctx context.Context, excluding string, maxPeers int) ([]*model.PeerSpec, error)
+	GetCaches(ctx context.Context, excluding string) ([]*model.PeerSpec, error)
+	GetGroupMembers(ctx context.Context, group string, max int) ([]*model.PeerSpec, error)
+	GetPeersByNodeKey(ctx context.Context, key string) ([]*model.PeerSpec, error)
+	CountOfPeers(ctx context.Context) (int, error)
+	CountPeersBySoftwareVersion(ctx context.Context) (map[string]int, error)
+	UpsertPeer(ctx context.Context, peer model.PeerSpec) error
+	UpsertPeers(ctx context.Context, peers []*model.PeerSpec) error
+	TouchPeer(ctx context.Context, remoteAddr, subsFilter string) error
+	SetPeerNodeKey(ctx context.Context, remoteAddr, key string) error
+	SetPeerProtocol(ctx context.Context, remoteAddr string, version int, features, software string) error
+	SetPreferredAddress(ctx context.Context, remoteAddr, addr string) error
+	DeletePeer(ctx context.Context, peer string) error
+	DeletePeerSeenBefore(ctx context.Context, remoteAddr string, before time.Time) (bool, error)
+	MissPeers(ctx context.Context, before time.Time) error
+	MissPeer(ctx context.Context, remoteAddr string) (int, error)
+	DeleteMissingPeers(ctx context.Context, maxMissed int) ([]string, error)
+
+	// peer table replication between seeds
+	GetPeersChangedSince(ctx context.Context, since time.Time, after string, max int) ([]*model.PeerSpec, error)
+	MergeReplicatedPeers(ctx context.Context, peers []*model.PeerSpec, deleted []*model.PeerTombstone) error
+	AddPeerTombstone(ctx context.Context, remoteAddr string, at time.Time) error
+	GetPeerTombstones(ctx context.Context, since time.Time) ([]*model.PeerTombstone, error)
+	PrunePeerTombstones(ctx context.Context, before time.Time) error
 }
 
-func createSchema(db *sqlx.DB) error {
-	driver, err := sqlite3.WithInstance(db.DB, &sqlite3.Config{})
-	if err != nil {
-		return fmt.Errorf("creating driver: %w", err)
-	}
+// ActionStore keeps the actions the node has received, what has been pruned
+// from them and those waiting for peers to publish to
+type ActionStore interface {
+	CreateAction(ctx context.Context, action graph.Action) error
+	GetActionsSince(ctx context.Context, since time.Time, after string, limit int) ([]*graph.Action, error)
+	GetRecentActions(ctx context.Context, limit int) ([]*graph.Action, error)
+	IsActionProcessed(ctx context.Context, id string, digest int64) (bool, error)
+	EachActionID(ctx context.Context, fn func(id string)) error
+	EachActionDigest(ctx context.Context, fn func(digest int64)) error
+	CountActionsSince(ctx context.Context, identity string, since time.Time) (int, error)
+	BytesStoredBy(ctx context.Context, identity string) (int64, error)
+	GetExpiredActions(ctx context.Context, before time.Time, limit int) ([]string, error)
+	EvictActions(ctx context.Context, ids []string) error
+	GetPrunableActions(ctx context.Context, before time.Time, limit int) ([]*graph.Action, error)
+	PruneActions(ctx context.Context, ids []string, digests []int64) error
 
-	schema := &struct {
-		Seeds_up            string
-		Peers_up            string
-		Actions_up          string
-		ActionsIdx1_up      string
-		CertificateCache_up string
-	}{
-		Seeds_up: `create table seeds (
-			remote_addr text not null primary key,
-			created_at datetime not null,
-			updated_at datetime null,
-			node_id text not null
-		);`,
+	// actions published while the node had no peers
+	QueueAction(ctx context.Context, action graph.Action) error
+	GetQueuedActions(ctx context.Context, limit int) ([]*graph.Action, error)
+	DequeueActions(ctx context.Context, ids []string) error
+	CountQueuedActions(ctx context.Context) (int, error)
+}
 
-		Peers_up: `create table peers (
-			remote_addr text not null primary key,
-			created_at datetime not null,
-			updated_at datetime null,
-			node_id text not null,
-			filter text not null
-		);`,
+// CertificateStore keeps the certificates of the identities the node has
+// seen, their rotations and revocations, and the handles they claim
+type CertificateStore interface {
+	PutCachedCertificate(ctx context.Context, cert *x509.Certificate) error
+	GetCachedCertificate(ctx context.Context, identifier string) (*x509.Certificate, error)
+	RotateCachedCertificate(ctx context.Context, cert, previous *x509.Certificate, rotatedAt time.Time) error
+	GetPreviousCertificate(ctx context.Context, identifier string) (*x509.Certificate, time.Time, error)
+	RevokeCachedCertificate(ctx context.Context, cert *x509.Certificate, revokedAt time.Time, reason string) error
+	GetRevocation(ctx context.Context, identifier string) (*time.Time, error)
+	PutIdentityRecord(ctx context.Context, cert *x509.Certificate, actionID string) error
+	GetIdentityRecord(ctx context.Context, identifier string) (*x509.Certificate, error)
 
-		Actions_up: `create table actions (
-			id text not null primary key,
-			timestamp datetime not null,
-			action text not null,
-			remote_addr text not null,
-			node_id text not null,
-			identity text not null,
-			received_by text not null,
-			encoded_sig text not null
-		);`,
+	// handles
+	PutHandleClaim(ctx context.Context, claim *model.HandleClaim) error
+	GetHandleClaims(ctx context.Context, handle string) ([]*model.HandleClaim, error)
+	SetHandleVerified(ctx context.Context, handle, identity string, verifiedAt time.Time) error
+}
 
-		ActionsIdx1_up: `create index idx_actions_peer on actions(remote_addr);`,
+// MemoryDatabaseURL as the node database URL keeps the node's own data in
+// memory, without SQLite, and loses it when the node stops
+const MemoryDatabaseURL = "memory:"
 
-		CertificateCache_up: `create table certificate_cache (
-				id text not null primary key,
-				created_at datetime not null,
-				updated_at datetime null,
-				certificate blob not null
-		);`,
+// openStore opens the node database at databaseURL
+func openStore(databaseURL string, sealer secrets.Sealer) (Store, error) {
+	if databaseURL == MemoryDatabaseURL {
+		return newMemoryStore(), nil
 	}
+	return newStore(databaseURL, sealer)
+}
 
-	source, err := reflect.New(schema)
+type store struct {
+	db     *sqlx.DB
+	sealer secrets.Sealer
+}
+
+func newStore(databaseURL string, sealer secrets.Sealer) (*store, error) {
+	db, err := sqlx.Connect("sqlite3", databaseURL)
 	if err != nil {
-		return fmt.Errorf("creating migration source driver: %w", err)
+		return nil, fmt.Errorf("connecting to database: %w", err)
 	}
 
-	m, err := migrate.NewWithInstance("reflect", source, "sqlite3", driver)
+	err = Migrations.Up(db.DB)
 	if err != nil {
-		return fmt.Errorf("creating migration: %w", err)
+		return nil, fmt.Errorf("creating schema: %w", err)
 	}
 
-	err = m.Up()
-	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
-		return err
+	store := &store{
+		db:     db,
+		sealer: sealer,
 	}
 
-	return nil
+	return store, nil
 }
 
-func (s *store) UpsertSeeds(seeds []*model.SeedSpec) error {
-	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+func (s *store) UpsertSeeds(ctx context.Context, seeds []*model.SeedSpec) error {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
 	defer cancelFn()
 
 	tx, err := s.db.BeginTxx(ctx, nil)
@@ -134,7 +193,7 @@ func (s *store) UpsertSeeds(seeds []*model.SeedSpec) error {
 		return fmt.Errorf("saving seeds (begin): %w", err)
 	}
 
-	_, err = tx.Exec("delete from seeds")
+	_, err = tx.ExecContext(ctx, "delete from seeds")
 	if err != nil {
 		err2 := tx.Rollback()
 		if err2 != nil {
@@ -144,7 +203,7 @@ func (s *store) UpsertSeeds(seeds []*model.SeedSpec) error {
 	}
 
 	for _, s := range seeds {
-		_, err = tx.NamedExec("insert into seeds(remote_addr, created_at, node_id) values(:remote_addr, :created_at, :node_id)", s)
+		_, err = tx.NamedExecContext(ctx, "insert into seeds(remote_addr, created_at, node_id) values(:remote_addr, :created_at, :node_id)", s)
 		if err != nil {
 			err2 := tx.Rollback()
 			if err2 != nil {
@@ -162,8 +221,22 @@ func (s *store) UpsertSeeds(seeds []*model.SeedSpec) error {
 	return nil
 }
 
-func (s *store) GetSeeds() ([]*model.SeedSpec, error) {
-	rows, err := s.db.Queryx(`select * from seeds`)
+// AddSeeds adds seeds to those already known, unlike UpsertSeeds which
+// replaces them
+func (s *store) AddSeeds(ctx context.Context, seeds []*model.SeedSpec) error {
+	for _, seed := range seeds {
+		_, err := s.db.NamedExecContext(ctx, `insert into seeds(remote_addr, created_at, node_id)
+			values(:remote_addr, :created_at, :node_id)
+			on conflict(remote_addr) do update set node_id = :node_id`, seed)
+		if err != nil {
+			return fmt.Errorf("adding seed: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *store) GetSeeds(ctx context.Context) ([]*model.SeedSpec, error) {
+	rows, err := s.db.QueryxContext(ctx, `select * from seeds`)
 	if err != nil {
 		return nil, fmt.Errorf("querying seeds: %w", err)
 	}
@@ -182,17 +255,17 @@ func (s *store) GetSeeds() ([]*model.SeedSpec, error) {
 	return seeds, nil
 }
 
-func (s *store) TouchSeed(remoteAddr string) error {
+func (s *store) TouchSeed(ctx context.Context, remoteAddr string) error {
 	now := time.Now().UTC()
-	_, err := s.db.Exec(`update seeds set updated_at = ? where remote_addr = ?`, now, remoteAddr)
+	_, err := s.db.ExecContext(ctx, `update seeds set updated_at = ? where remote_addr = ?`, now, remoteAddr)
 	if err != nil {
 		return fmt.Errorf("touch seed: %w", err)
 	}
 	return nil
 }
 
-func (s *store) GetAllPeers() ([]*model.PeerSpec, error) {
-	rows, err := s.db.Queryx(`select *
+func (s *store) GetAllPeers(ctx context.Context) ([]*model.PeerSpec, error) {
+	rows, err := s.db.QueryxContext(ctx, `select *
 		from peers
 		order by coalesce(updated_at, created_at);`)
 
@@ -214,8 +287,20 @@ func (s *store) GetAllPeers() ([]*model.PeerSpec, error) {
 	return peers, nil
 }
 
-func (s *store) GetRandomPeers(excluding string, maxPeers int) ([]*model.PeerSpec, error) {
-	rows, err := s.db.Queryx(`select *
+func (s *store) GetPeer(ctx context.Context, remoteAddr string) (*model.PeerSpec, error) {
+	peer := &model.PeerSpec{}
+	err := s.db.GetContext(ctx, peer, `select * from peers where remote_addr = ?`, remoteAddr)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get peer: %w", err)
+	}
+	return peer, nil
+}
+
+func (s *store) GetRandomPeers(ctx context.Context, excluding string, maxPeers int) ([]*model.PeerSpec, error) {
+	rows, err := s.db.QueryxContext(ctx, `select *
 		from peers
 		where remote_addr != ?
 		order by coalesce(updated_at, created_at) desc
@@ -239,30 +324,205 @@ func (s *store) GetRandomPeers(excluding string, maxPeers int) ([]*model.PeerSpe
 	return peers, nil
 }
 
-func (s *store) DeletePeer(peer string) error {
-	_, err := s.db.Exec(`delete from peers where remote_addr = ?`, peer)
+// GetCaches returns the cache nodes which have joined, most recently seen first
+func (s *store) GetCaches(ctx context.Context, excluding string) ([]*model.PeerSpec, error) {
+	peers := []*model.PeerSpec{}
+	err := s.db.SelectContext(ctx, &peers, `select *
+		from peers
+		where node_type = ? and remote_addr != ?
+		order by coalesce(updated_at, created_at) desc;`, NodeTypeCache.String(), excluding)
+	if err != nil {
+		return nil, fmt.Errorf("get caches: %w", err)
+	}
+	return peers, nil
+}
+
+// GetGroupMembers returns the caches in a sharing group, most recently seen
+// first
+func (s *store) GetGroupMembers(ctx context.Context, group string, max int) ([]*model.PeerSpec, error) {
+	peers := []*model.PeerSpec{}
+	err := s.db.SelectContext(ctx, &peers, `select *
+		from peers
+		where node_type = ? and group_name = ?
+		order by coalesce(updated_at, created_at) desc
+		limit ?;`, NodeTypeCache.String(), group, max)
+	if err != nil {
+		return nil, fmt.Errorf("get group members: %w", err)
+	}
+	return peers, nil
+}
+
+// GetPeersChangedSince returns up to max peers seen after since, oldest
+// first. Peers seen at the same time are ordered by address, and after is the
+// address of the last peer already read at since so that paging doesn't skip
+// peers sharing a timestamp.
+func (s *store) GetPeersChangedSince(ctx context.Context, since time.Time, after string, max int) ([]*model.PeerSpec, error) {
+	peers := []*model.PeerSpec{}
+	err := s.db.SelectContext(ctx, &peers, `select *
+		from peers
+		where coalesce(updated_at, created_at) > ? or (? <> '' and coalesce(updated_at, created_at) = ? and remote_addr > ?)
+		order by coalesce(updated_at, created_at), remote_addr
+		limit ?;`, since, after, since, after, max)
+	if err != nil {
+		return nil, fmt.Errorf("get changed peers: %w", err)
+	}
+	return peers, nil
+}
+
+// MergeReplicatedPeers applies the changes pulled from another seed. A peer is
+// written unless this seed saw it more recently or deleted it since, and a
+// deletion only removes a peer which hasn't been seen since.
+func (s *store) MergeReplicatedPeers(ctx context.Context, peers []*model.PeerSpec, deleted []*model.PeerTombstone) error {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
+	defer cancelFn()
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("merge peers (begin): %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, d := range deleted {
+		_, err = tx.ExecContext(ctx, `delete from peers where remote_addr = ? and coalesce(updated_at, created_at) < ?`, d.RemoteAddr, d.DeletedAt)
+		if err != nil {
+			return fmt.Errorf("merge peers (delete): %w", err)
+		}
+		_, err = tx.NamedExecContext(ctx, `insert into peer_tombstones(remote_addr, deleted_at)
+			values(:remote_addr, :deleted_at)
+			on conflict(remote_addr) do update set deleted_at = max(deleted_at, :deleted_at)`, d)
+		if err != nil {
+			return fmt.Errorf("merge peers (tombstone): %w", err)
+		}
+	}
+
+	for _, p := range peers {
+		if p.NodeType == "" {
+			p.NodeType = NodeTypePeer.String()
+		}
+		_, err = tx.NamedExecContext(ctx, `
+		insert into peers(remote_addr, created_at, updated_at, node_id, filter, addresses, node_type, group_name, node_key, protocol_version, features, software_version)
+		select :remote_addr, :created_at, :updated_at, :node_id, :filter, :addresses, :node_type, :group_name, :node_key, :protocol_version, :features, :software_version
+		where not exists (
+			select 1 from peer_tombstones
+			where remote_addr = :remote_addr and deleted_at >= coalesce(:updated_at, :created_at)
+		)
+		on conflict(remote_addr) do update set updated_at = excluded.updated_at, node_id = excluded.node_id,
+			filter = excluded.filter, addresses = excluded.addresses, node_type = excluded.node_type,
+			group_name = excluded.group_name, missed_pings = 0, node_key = coalesce(nullif(peers.node_key, ''), excluded.node_key),
+			protocol_version = excluded.protocol_version, features = excluded.features, software_version = excluded.software_version
+		where coalesce(excluded.updated_at, excluded.created_at) > coalesce(peers.updated_at, peers.created_at)
+		`, p)
+		if err != nil {
+			return fmt.Errorf("merge peers (upsert): %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("merge peers (commit): %w", err)
+	}
+	return nil
+}
+
+// AddPeerTombstone records that a peer was deleted
+func (s *store) AddPeerTombstone(ctx context.Context, remoteAddr string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `insert into peer_tombstones(remote_addr, deleted_at)
+		values(?, ?)
+		on conflict(remote_addr) do update set deleted_at = excluded.deleted_at`, remoteAddr, at)
+	if err != nil {
+		return fmt.Errorf("add peer tombstone: %w", err)
+	}
+	return nil
+}
+
+// GetPeerTombstones returns the peers deleted after since
+func (s *store) GetPeerTombstones(ctx context.Context, since time.Time) ([]*model.PeerTombstone, error) {
+	deleted := []*model.PeerTombstone{}
+	err := s.db.SelectContext(ctx, &deleted, `select * from peer_tombstones where deleted_at > ? order by deleted_at`, since)
+	if err != nil {
+		return nil, fmt.Errorf("get peer tombstones: %w", err)
+	}
+	return deleted, nil
+}
+
+// PrunePeerTombstones forgets peers deleted before the given time
+func (s *store) PrunePeerTombstones(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, `delete from peer_tombstones where deleted_at < ?`, before)
+	if err != nil {
+		return fmt.Errorf("prune peer tombstones: %w", err)
+	}
+	return nil
+}
+
+// DeletePeerSeenBefore deletes a peer unless it has been seen since before,
+// reporting whether it was deleted
+func (s *store) DeletePeerSeenBefore(ctx context.Context, remoteAddr string, before time.Time) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `delete from peers where remote_addr = ? and coalesce(updated_at, created_at) < ?`, remoteAddr, before)
+	if err != nil {
+		return false, fmt.Errorf("delete peer: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("delete peer: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (s *store) DeletePeer(ctx context.Context, peer string) error {
+	_, err := s.db.ExecContext(ctx, `delete from peers where remote_addr = ?`, peer)
 	if err != nil {
 		return fmt.Errorf("delete peer: %w", err)
 	}
 	return nil
 }
 
-func (s *store) DeleteAgedPeers(before time.Time) error {
-	_, err := s.db.Exec(`delete from peers where coalesce(updated_at, created_at) < ?`, before)
+// MissPeers counts a missed ping against every peer not seen since before
+func (s *store) MissPeers(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, `update peers set missed_pings = missed_pings + 1 where coalesce(updated_at, created_at) < ?`, before)
 	if err != nil {
-		return fmt.Errorf("delete aged peers: %w", err)
+		return fmt.Errorf("miss peers: %w", err)
 	}
 	return nil
 }
 
-func (s *store) UpsertPeer(peer model.PeerSpec) error {
+// MissPeer counts a missed ping against the peer and returns how many it has
+// missed in a row
+func (s *store) MissPeer(ctx context.Context, remoteAddr string) (int, error) {
+	var missed int
+	err := s.db.GetContext(ctx, &missed, `update peers set missed_pings = missed_pings + 1 where remote_addr = ? returning missed_pings`, remoteAddr)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("miss peer: %w", err)
+	}
+	return missed, nil
+}
+
+// DeleteMissingPeers deletes peers which have missed at least maxMissed pings
+// and returns their addresses
+func (s *store) DeleteMissingPeers(ctx context.Context, maxMissed int) ([]string, error) {
+	addrs := []string{}
+	err := s.db.SelectContext(ctx, &addrs, `delete from peers where missed_pings >= ? returning remote_addr`, maxMissed)
+	if err != nil {
+		return nil, fmt.Errorf("delete missing peers: %w", err)
+	}
+	return addrs, nil
+}
+
+func (s *store) UpsertPeer(ctx context.Context, peer model.PeerSpec) error {
 	now := time.Now().UTC()
 	peer.UpdatedAt = &now
+	if peer.NodeType == "" {
+		peer.NodeType = NodeTypePeer.String()
+	}
 
-	_, err := s.db.NamedExec(`
-	insert into peers(remote_addr, created_at, node_id, filter)
-	values(:remote_addr, :created_at, :node_id, :filter)
-	on conflict(remote_addr) do update set updated_at = :updated_at
+	_, err := s.db.NamedExecContext(ctx, `
+	insert into peers(remote_addr, created_at, node_id, filter, addresses, node_type, group_name, node_key, protocol_version, features, software_version)
+	values(:remote_addr, :created_at, :node_id, :filter, :addresses, :node_type, :group_name, :node_key, :protocol_version, :features, :software_version)
+	on conflict(remote_addr) do update set updated_at = :updated_at, addresses = :addresses, node_type = :node_type, group_name = :group_name, missed_pings = 0,
+		node_key = coalesce(nullif(peers.node_key, ''), :node_key), protocol_version = :protocol_version, features = :features,
+		software_version = :software_version
 	`, peer)
 
 	if err != nil {
@@ -272,8 +532,8 @@ func (s *store) UpsertPeer(peer model.PeerSpec) error {
 	return nil
 }
 
-func (s *store) UpsertPeers(peers []*model.PeerSpec) error {
-	ctx, cancelFn := context.WithTimeout(context.Background(), defaultTimeout)
+func (s *store) UpsertPeers(ctx context.Context, peers []*model.PeerSpec) error {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
 	defer cancelFn()
 
 	tx, err := s.db.BeginTxx(ctx, nil)
@@ -284,10 +544,14 @@ func (s *store) UpsertPeers(peers []*model.PeerSpec) error {
 	now := time.Now().UTC()
 	for _, p := range peers {
 		p.UpdatedAt = &now
-		_, err := s.db.NamedExec(`
-		insert into peers(remote_addr, created_at, node_id, filter)
-		values(:remote_addr, :created_at, :node_id, :filter)
-		on conflict(remote_addr) do update set updated_at = :updated_at
+		if p.NodeType == "" {
+			p.NodeType = NodeTypePeer.String()
+		}
+		_, err := s.db.NamedExecContext(ctx, `
+		insert into peers(remote_addr, created_at, node_id, filter, addresses, node_type, group_name, node_key, source, protocol_version, features, software_version)
+		values(:remote_addr, :created_at, :node_id, :filter, :addresses, :node_type, :group_name, :node_key, :source, :protocol_version, :features, :software_version)
+		on conflict(remote_addr) do update set updated_at = :updated_at, addresses = :addresses, node_type = :node_type, group_name = :group_name, missed_pings = 0,
+			node_key = coalesce(nullif(peers.node_key, ''), :node_key)
 		`, p)
 		if err != nil {
 			tx.Rollback()
@@ -303,14 +567,14 @@ func (s *store) UpsertPeers(peers []*model.PeerSpec) error {
 	return nil
 }
 
-func (s *store) TouchPeer(remoteAddr, subsFilter string) error {
+func (s *store) TouchPeer(ctx context.Context, remoteAddr, subsFilter string) error {
 	var err error
 	now := time.Now().UTC()
 
 	if subsFilter == "" {
-		_, err = s.db.Exec(`update peers set updated_at = ? where remote_addr = ?`, now, remoteAddr)
+		_, err = s.db.ExecContext(ctx, `update peers set updated_at = ?, missed_pings = 0 where remote_addr = ?`, now, remoteAddr)
 	} else {
-		_, err = s.db.Exec(`update peers set filter = ?, updated_at = ? where remote_addr = ?`, subsFilter, now, remoteAddr)
+		_, err = s.db.ExecContext(ctx, `update peers set filter = ?, updated_at = ?, missed_pings = 0 where remote_addr = ?`, subsFilter, now, remoteAddr)
 	}
 
 	if err != nil {
@@ -319,26 +583,126 @@ func (s *store) TouchPeer(remoteAddr, subsFilter string) error {
 	return nil
 }
 
-func (s *store) CountOfPeers() (int, error) {
+// SetPeerNodeKey binds a node key to a peer which joined without one
+func (s *store) SetPeerNodeKey(ctx context.Context, remoteAddr, key string) error {
+	_, err := s.db.ExecContext(ctx, `update peers set node_key = ? where remote_addr = ? and node_key = ''`, key, remoteAddr)
+	if err != nil {
+		return fmt.Errorf("set peer node key: %w", err)
+	}
+	return nil
+}
+
+// SetPeerProtocol records the wire protocol version, features and software
+// version a peer sent
+func (s *store) SetPeerProtocol(ctx context.Context, remoteAddr string, version int, features, software string) error {
+	_, err := s.db.ExecContext(ctx, `update peers set protocol_version = ?, features = ?, software_version = ? where remote_addr = ?`, version, features, software, remoteAddr)
+	if err != nil {
+		return fmt.Errorf("set peer protocol: %w", err)
+	}
+	return nil
+}
+
+// GetPeersByNodeKey returns the peers with a node key bound to them
+func (s *store) GetPeersByNodeKey(ctx context.Context, key string) ([]*model.PeerSpec, error) {
+	peers := []*model.PeerSpec{}
+	err := s.db.SelectContext(ctx, &peers, `select * from peers where node_key = ?`, key)
+	if err != nil {
+		return nil, fmt.Errorf("get peers by node key: %w", err)
+	}
+	return peers, nil
+}
+
+// GetNodeKey returns the key the node signs control messages with
+func (s *store) GetNodeKey(ctx context.Context) (ed25519.PrivateKey, error) {
+	keyData := []byte{}
+	err := s.db.GetContext(ctx, &keyData, `select private_key from node_key where id = 1`)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, model.ErrNotFound
+		}
+		return nil, fmt.Errorf("get node key: %w", err)
+	}
+
+	keyData, err = s.sealer.Open(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("opening node key: %w", err)
+	}
+	if len(keyData) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("get node key: bad key length %d", len(keyData))
+	}
+
+	return ed25519.PrivateKey(keyData), nil
+}
+
+// PutNodeKey stores the key the node signs control messages with, unless one
+// is already stored
+func (s *store) PutNodeKey(ctx context.Context, key ed25519.PrivateKey) error {
+	sealed, err := s.sealer.Seal(key)
+	if err != nil {
+		return fmt.Errorf("sealing node key: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `insert into node_key (id, created_at, private_key)
+		values (1, ?, ?)
+		on conflict(id) do nothing`, time.Now().UTC(), sealed)
+	if err != nil {
+		return fmt.Errorf("put node key: %w", err)
+	}
+	return nil
+}
+
+func (s *store) SetPreferredAddress(ctx context.Context, remoteAddr, addr string) error {
+	_, err := s.db.ExecContext(ctx, `update peers set preferred_addr = ? where remote_addr = ?`, addr, remoteAddr)
+	if err != nil {
+		return fmt.Errorf("set preferred address: %w", err)
+	}
+	return nil
+}
+
+func (s *store) CountOfPeers(ctx context.Context) (int, error) {
 	var count int
-	err := s.db.Get(&count, `select count(*) from peers`)
+	err := s.db.GetContext(ctx, &count, `select count(*) from peers`)
 	if err != nil {
 		return 0, fmt.Errorf("count of peers: %w", err)
 	}
 	return count, nil
 }
 
-func (s *store) PutCachedCertificate(cert *x509.Certificate) error {
+// CountPeersBySoftwareVersion returns how many peers run each software
+// version, leaving out those which haven't said
+func (s *store) CountPeersBySoftwareVersion(ctx context.Context) (map[string]int, error) {
+	rows := []struct {
+		Version string `db:"software_version"`
+		Count   int    `db:"count"`
+	}{}
+	err := s.db.SelectContext(ctx, &rows, `select software_version, count(*) as count from peers where software_version != '' group by software_version`)
+	if err != nil {
+		return nil, fmt.Errorf("count peers by software version: %w", err)
+	}
+
+	counts := make(map[string]int, len(rows))
+	for _, r := range rows {
+		counts[r.Version] = r.Count
+	}
+	return counts, nil
+}
+
+func (s *store) PutCachedCertificate(ctx context.Context, cert *x509.Certificate) error {
+	sealed, err := s.sealer.Seal(cert.Raw)
+	if err != nil {
+		return fmt.Errorf("sealing certificate: %w", err)
+	}
+
 	now := time.Now().UTC()
-	_, err := s.db.Exec(`insert into certificate_cache (id, created_at, certificate)
+	_, err = s.db.ExecContext(ctx, `insert into certificate_cache (id, created_at, certificate)
 		values (?, ?, ?)
 		on conflict(id) do update
 		set updated_at = ?, certificate = ?`,
 		cert.Subject.CommonName,
 		now,
-		cert.Raw,
+		sealed,
 		now,
-		cert.Raw)
+		sealed)
 	if err != nil {
 		return fmt.Errorf("put cached certificate: %w", err)
 	}
@@ -346,9 +710,9 @@ func (s *store) PutCachedCertificate(cert *x509.Certificate) error {
 	return nil
 }
 
-func (s *store) GetCachedCertificate(identifier string) (*x509.Certificate, error) {
+func (s *store) GetCachedCertificate(ctx context.Context, identifier string) (*x509.Certificate, error) {
 	certData := []byte{}
-	err := s.db.Get(&certData, `select certificate from certificate_cache where id = ?`, identifier)
+	err := s.db.GetContext(ctx, &certData, `select certificate from certificate_cache where id = ?`, identifier)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, model.ErrNotFound
@@ -356,6 +720,170 @@ func (s *store) GetCachedCertificate(identifier string) (*x509.Certificate, erro
 		return nil, fmt.Errorf("get cached certificate: %w", err)
 	}
 
+	certData, err = s.sealer.Open(certData)
+	if err != nil {
+		return nil, fmt.Errorf("opening certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(certData)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+// RotateCachedCertificate replaces an identity's cached certificate, keeping
+// the previous one so signatures made with the old key can be accepted for a
+// while
+func (s *store) RotateCachedCertificate(ctx context.Context, cert, previous *x509.Certificate, rotatedAt time.Time) error {
+	sealed, err := s.sealer.Seal(cert.Raw)
+	if err != nil {
+		return fmt.Errorf("sealing certificate: %w", err)
+	}
+
+	sealedPrevious, err := s.sealer.Seal(previous.Raw)
+	if err != nil {
+		return fmt.Errorf("sealing previous certificate: %w", err)
+	}
+
+	now := time.Now().UTC()
+	_, err = s.db.ExecContext(ctx, `insert into certificate_cache (id, created_at, certificate, previous_certificate, rotated_at)
+		values (?, ?, ?, ?, ?)
+		on conflict(id) do update
+		set updated_at = ?, certificate = ?, previous_certificate = ?, rotated_at = ?`,
+		cert.Subject.CommonName,
+		now,
+		sealed,
+		sealedPrevious,
+		rotatedAt,
+		now,
+		sealed,
+		sealedPrevious,
+		rotatedAt)
+	if err != nil {
+		return fmt.Errorf("rotate cached certificate: %w", err)
+	}
+
+	return nil
+}
+
+// GetPreviousCertificate returns the certificate replaced by the identity's
+// last key rotation and when it was rotated
+func (s *store) GetPreviousCertificate(ctx context.Context, identifier string) (*x509.Certificate, time.Time, error) {
+	row := struct {
+		Certificate []byte     `db:"previous_certificate"`
+		RotatedAt   *time.Time `db:"rotated_at"`
+	}{}
+	err := s.db.GetContext(ctx, &row, `select previous_certificate, rotated_at from certificate_cache where id = ?`, identifier)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, time.Time{}, model.ErrNotFound
+		}
+		return nil, time.Time{}, fmt.Errorf("get previous certificate: %w", err)
+	}
+
+	if row.Certificate == nil || row.RotatedAt == nil {
+		return nil, time.Time{}, model.ErrNotFound
+	}
+
+	certData, err := s.sealer.Open(row.Certificate)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("opening certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(certData)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	return cert, *row.RotatedAt, nil
+}
+
+// RevokeCachedCertificate marks an identity as revoked. Its certificate is
+// kept so whois still answers for it.
+func (s *store) RevokeCachedCertificate(ctx context.Context, cert *x509.Certificate, revokedAt time.Time, reason string) error {
+	sealed, err := s.sealer.Seal(cert.Raw)
+	if err != nil {
+		return fmt.Errorf("sealing certificate: %w", err)
+	}
+
+	now := time.Now().UTC()
+	_, err = s.db.ExecContext(ctx, `insert into certificate_cache (id, created_at, certificate, revoked_at, revocation_reason)
+		values (?, ?, ?, ?, ?)
+		on conflict(id) do update
+		set updated_at = ?, revoked_at = ?, revocation_reason = ?`,
+		cert.Subject.CommonName,
+		now,
+		sealed,
+		revokedAt,
+		reason,
+		now,
+		revokedAt,
+		reason)
+	if err != nil {
+		return fmt.Errorf("revoke cached certificate: %w", err)
+	}
+
+	return nil
+}
+
+// GetRevocation returns when the identity was revoked, or nil if it hasn't
+// been
+func (s *store) GetRevocation(ctx context.Context, identifier string) (*time.Time, error) {
+	var revokedAt *time.Time
+	err := s.db.GetContext(ctx, &revokedAt, `select revoked_at from certificate_cache where id = ?`, identifier)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get revocation: %w", err)
+	}
+	return revokedAt, nil
+}
+
+// PutIdentityRecord records the certificate an identity published about
+// itself
+func (s *store) PutIdentityRecord(ctx context.Context, cert *x509.Certificate, actionID string) error {
+	sealed, err := s.sealer.Seal(cert.Raw)
+	if err != nil {
+		return fmt.Errorf("sealing certificate: %w", err)
+	}
+
+	now := time.Now().UTC()
+	_, err = s.db.ExecContext(ctx, `insert into identity_records (id, created_at, action_id, certificate)
+		values (?, ?, ?, ?)
+		on conflict(id) do update
+		set updated_at = ?, action_id = ?, certificate = ?`,
+		cert.Subject.CommonName,
+		now,
+		actionID,
+		sealed,
+		now,
+		actionID,
+		sealed)
+	if err != nil {
+		return fmt.Errorf("put identity record: %w", err)
+	}
+
+	return nil
+}
+
+func (s *store) GetIdentityRecord(ctx context.Context, identifier string) (*x509.Certificate, error) {
+	certData := []byte{}
+	err := s.db.GetContext(ctx, &certData, `select certificate from identity_records where id = ?`, identifier)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, model.ErrNotFound
+		}
+		return nil, fmt.Errorf("get identity record: %w", err)
+	}
+
+	certData, err = s.sealer.Open(certData)
+	if err != nil {
+		return nil, fmt.Errorf("opening certificate: %w", err)
+	}
+
 	cert, err := x509.ParseCertificate(certData)
 	if err != nil {
 		return nil, fmt.Errorf("parsing certificate: %w", err)
@@ -364,19 +892,391 @@ func (s *store) GetCachedCertificate(identifier string) (*x509.Certificate, erro
 	return cert, nil
 }
 
-func (s *store) CreateAction(action graph.Action) error {
-	_, err := s.db.NamedExec(`
-		insert into actions (id, timestamp, action, remote_addr, node_id, identity, received_by, encoded_sig)
-		values(:id, :timestamp, :action, :remote_addr, :node_id, :identity, :received_by, :encoded_sig)
+// PutHandleClaim records an identity's claim to a handle, keeping the earliest
+// time it was seen. An identity has one handle so its other claims are
+// released.
+func (s *store) PutHandleClaim(ctx context.Context, claim *model.HandleClaim) error {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
+	defer cancelFn()
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("put handle claim (begin): %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from handles where identity = ? and handle <> ?`, claim.Identity, claim.Handle)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("put handle claim (release): %w", err)
+	}
+
+	_, err = tx.NamedExecContext(ctx, `insert into handles (handle, identity, first_seen_at, action_id)
+		values (:handle, :identity, :first_seen_at, :action_id)
+		on conflict(handle, identity) do update
+		set first_seen_at = min(first_seen_at, excluded.first_seen_at)`, claim)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("put handle claim (insert): %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("put handle claim (commit): %w", err)
+	}
+
+	return nil
+}
+
+// GetHandleClaims returns the claims to a handle by identities which haven't
+// been revoked, verified claims first then in the order they were seen
+func (s *store) GetHandleClaims(ctx context.Context, handle string) ([]*model.HandleClaim, error) {
+	claims := []*model.HandleClaim{}
+	err := s.db.SelectContext(ctx, &claims, `select h.* from handles h
+		left join certificate_cache c on c.id = h.identity
+		where h.handle = ? and c.revoked_at is null
+		order by h.verified_at is null, h.first_seen_at`, handle)
+	if err != nil {
+		return nil, fmt.Errorf("get handle claims: %w", err)
+	}
+	return claims, nil
+}
+
+func (s *store) SetHandleVerified(ctx context.Context, handle, identity string, verifiedAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `update handles set verified_at = ? where handle = ? and identity = ?`, verifiedAt, handle, identity)
+	if err != nil {
+		return fmt.Errorf("set handle verified: %w", err)
+	}
+	return nil
+}
+
+func (s *store) CreateAction(ctx context.Context, action graph.Action) error {
+	_, err := s.db.NamedExecContext(ctx, `
+		insert into actions (id, timestamp, action, remote_addr, node_id, identity, received_by, encoded_sig, expires_at, key_id, manifest_version, created_at, ttl, namespace, delegation)
+		values(:id, :timestamp, :action, :remote_addr, :node_id, :identity, :received_by, :encoded_sig, :expires_at, :key_id, :manifest_version, :created_at, :ttl, :namespace, :delegation)
 	`, &action)
 	return err
 }
 
-func (s *store) IsActionProcessed(id string) (bool, error) {
-	var count int
-	err := s.db.Get(&count, `select count(*) from actions where id = ?`, id)
+// GetActionsSince returns stored actions received after the given time, oldest
+// first with those received at the same time in ID order. With after set
+// those received at the given time with a greater ID are included, so paging
+// on the last action returned doesn't skip any. Evicted actions are skipped as
+// their content is gone.
+func (s *store) GetActionsSince(ctx context.Context, since time.Time, after string, limit int) ([]*graph.Action, error) {
+	actions := []*graph.Action{}
+	err := s.db.SelectContext(ctx, &actions, `select id, timestamp, action, remote_addr, node_id, identity, received_by, encoded_sig, expires_at, key_id, manifest_version, created_at, ttl, namespace, delegation
+		from actions
+		where (timestamp > ? or (? <> '' and timestamp = ? and id > ?)) and evicted_at is null
+		order by timestamp, id
+		limit ?`, since, after, since, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get actions since: %w", err)
+	}
+	return actions, nil
+}
+
+// GetRecentActions returns the most recently received actions, newest first.
+// Evicted actions are skipped.
+func (s *store) GetRecentActions(ctx context.Context, limit int) ([]*graph.Action, error) {
+	actions := []*graph.Action{}
+	err := s.db.SelectContext(ctx, &actions, `select id, timestamp, action, remote_addr, node_id, identity, received_by, encoded_sig, expires_at, key_id, manifest_version, created_at, ttl, namespace, delegation
+		from actions
+		where evicted_at is null
+		order by timestamp desc
+		limit ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get recent actions: %w", err)
+	}
+	return actions, nil
+}
+
+// IsActionProcessed returns true if the action is stored or was pruned
+// leaving the given digest of its ID
+func (s *store) IsActionProcessed(ctx context.Context, id string, digest int64) (bool, error) {
+	var processed bool
+	err := s.db.GetContext(ctx, &processed, `select exists(select 1 from actions where id = ?)
+		or exists(select 1 from action_digests where digest = ?)`, id, digest)
 	if err != nil {
 		return false, fmt.Errorf("is action processed: %w", err)
 	}
-	return count > 0, nil
+	return processed, nil
+}
+
+// EachActionID calls fn with the ID of every stored action
+func (s *store) EachActionID(ctx context.Context, fn func(id string)) error {
+	rows, err := s.db.QueryContext(ctx, `select id from actions`)
+	if err != nil {
+		return fmt.Errorf("each action id: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return fmt.Errorf("scanning action id: %w", err)
+		}
+		fn(id)
+	}
+
+	return rows.Err()
+}
+
+// EachActionDigest calls fn with the digest of every pruned action ID
+func (s *store) EachActionDigest(ctx context.Context, fn func(digest int64)) error {
+	rows, err := s.db.QueryContext(ctx, `select digest from action_digests`)
+	if err != nil {
+		return fmt.Errorf("each action digest: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var digest int64
+		err = rows.Scan(&digest)
+		if err != nil {
+			return fmt.Errorf("scanning action digest: %w", err)
+		}
+		fn(digest)
+	}
+
+	return rows.Err()
+}
+
+func (s *store) CountActionsSince(ctx context.Context, identity string, since time.Time) (int, error) {
+	var count int
+	err := s.db.GetContext(ctx, &count, `select count(*) from actions where identity = ? and timestamp > ?`, identity, since)
+	if err != nil {
+		return 0, fmt.Errorf("count actions: %w", err)
+	}
+	return count, nil
+}
+
+func (s *store) BytesStoredBy(ctx context.Context, identity string) (int64, error) {
+	var size int64
+	err := s.db.GetContext(ctx, &size, `select coalesce(sum(length(action)), 0) from actions where identity = ?`, identity)
+	if err != nil {
+		return 0, fmt.Errorf("bytes stored: %w", err)
+	}
+	return size, nil
+}
+
+func (s *store) GetExpiredActions(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	ids := []string{}
+	err := s.db.SelectContext(ctx, &ids, `select id from actions
+		where expires_at < ? and evicted_at is null
+		order by expires_at
+		limit ?`, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get expired actions: %w", err)
+	}
+	return ids, nil
+}
+
+// EvictActions drops the content of the given actions but keeps the IDs so
+// that they are still recognised as processed if they are seen again
+func (s *store) EvictActions(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In(`update actions set action = '', evicted_at = ? where id in (?)`, time.Now().UTC(), ids)
+	if err != nil {
+		return fmt.Errorf("evict actions: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, s.db.Rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("evict actions: %w", err)
+	}
+	return nil
+}
+
+// GetPrunableActions returns the IDs and creation times of actions received
+// before the given time, skipping those still waiting to expire
+func (s *store) GetPrunableActions(ctx context.Context, before time.Time, limit int) ([]*graph.Action, error) {
+	actions := []*graph.Action{}
+	err := s.db.SelectContext(ctx, &actions, `select id, created_at from actions
+		where timestamp < ? and (expires_at is null or evicted_at is not null)
+		order by timestamp
+		limit ?`, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get prunable actions: %w", err)
+	}
+	return actions, nil
+}
+
+// PruneActions deletes the given actions and records the digests of IDs which
+// must still be recognised as processed
+func (s *store) PruneActions(ctx context.Context, ids []string, digests []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("prune actions (begin): %w", err)
+	}
+
+	for _, digest := range digests {
+		_, err = tx.ExecContext(ctx, `insert into action_digests (digest) values (?) on conflict do nothing`, digest)
+		if err != nil {
+			err2 := tx.Rollback()
+			if err2 != nil {
+				return fmt.Errorf("prune actions (rollback): %w", err)
+			}
+			return fmt.Errorf("prune actions (digest): %w", err)
+		}
+	}
+
+	// actions still queued when pruned are never sent
+	query, args, err := sqlx.In(`delete from outbox where action_id in (?)`, ids)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, tx.Rebind(query), args...)
+	}
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			return fmt.Errorf("prune actions (rollback): %w", err)
+		}
+		return fmt.Errorf("prune actions (outbox): %w", err)
+	}
+
+	query, args, err = sqlx.In(`delete from actions where id in (?)`, ids)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, tx.Rebind(query), args...)
+	}
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			return fmt.Errorf("prune actions (rollback): %w", err)
+		}
+		return fmt.Errorf("prune actions (delete): %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("prune actions (commit): %w", err)
+	}
+	return nil
+}
+
+// QueueAction keeps an action published while the node had no peers, with the
+// entity IDs and topics it is sent to peers with
+func (s *store) QueueAction(ctx context.Context, action graph.Action) error {
+	entityIDs, err := json.Marshal(action.EntityIDs)
+	if err != nil {
+		return fmt.Errorf("queue action (entity IDs): %w", err)
+	}
+	topics, err := json.Marshal(action.Topics)
+	if err != nil {
+		return fmt.Errorf("queue action (topics): %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `insert into outbox (action_id, queued_at, entity_ids, topics)
+		values (?, ?, ?, ?)
+		on conflict do nothing`, action.ID, time.Now().UTC(), string(entityIDs), string(topics))
+	if err != nil {
+		return fmt.Errorf("queue action: %w", err)
+	}
+	return nil
+}
+
+// GetQueuedActions returns the oldest queued actions first
+func (s *store) GetQueuedActions(ctx context.Context, limit int) ([]*graph.Action, error) {
+	rows := []struct {
+		graph.Action
+		QueuedEntityIDs string `db:"entity_ids"`
+		QueuedTopics    string `db:"topics"`
+	}{}
+	err := s.db.SelectContext(ctx, &rows, `select a.id, a.timestamp, a.action, a.remote_addr, a.node_id, a.identity, a.received_by, a.encoded_sig, a.expires_at, a.key_id, a.manifest_version, a.created_at, a.ttl, a.namespace, a.delegation, o.entity_ids, o.topics
+		from outbox o
+		join actions a on a.id = o.action_id
+		order by o.queued_at
+		limit ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get queued actions: %w", err)
+	}
+
+	actions := make([]*graph.Action, 0, len(rows))
+	for _, r := range rows {
+		action := r.Action
+		err = json.Unmarshal([]byte(r.QueuedEntityIDs), &action.EntityIDs)
+		if err == nil {
+			err = json.Unmarshal([]byte(r.QueuedTopics), &action.Topics)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get queued actions (decoding %s): %w", action.ID, err)
+		}
+		actions = append(actions, &action)
+	}
+	return actions, nil
+}
+
+// DequeueActions removes actions from the outbox
+func (s *store) DequeueActions(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In(`delete from outbox where action_id in (?)`, ids)
+	if err != nil {
+		return fmt.Errorf("dequeue actions: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, s.db.Rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("dequeue actions: %w", err)
+	}
+	return nil
+}
+
+func (s *store) CountQueuedActions(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.GetContext(ctx, &count, `select count(*) from outbox`)
+	if err != nil {
+		return 0, fmt.Errorf("count queued actions: %w", err)
+	}
+	return count, nil
+}
+
+func (s *store) PutBlock(ctx context.Context, block model.BlockSpec) error {
+	_, err := s.db.NamedExecContext(ctx, `
+		insert into blocks (identity, created_at, mode, blocked_by)
+		values(:identity, :created_at, :mode, :blocked_by)
+		on conflict(identity) do update set mode = excluded.mode, blocked_by = excluded.blocked_by
+		where excluded.blocked_by = '' or blocks.blocked_by <> ''
+	`, &block)
+	if err != nil {
+		return fmt.Errorf("put block: %w", err)
+	}
+	return nil
+}
+
+func (s *store) DeleteBlock(ctx context.Context, identity string) error {
+	_, err := s.db.ExecContext(ctx, `delete from blocks where identity = ?`, identity)
+	if err != nil {
+		return fmt.Errorf("delete block: %w", err)
+	}
+	return nil
+}
+
+func (s *store) GetBlock(ctx context.Context, identity string) (*model.BlockSpec, error) {
+	block := &model.BlockSpec{}
+	err := s.db.GetContext(ctx, block, `select * from blocks where identity = ?`, identity)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get block: %w", err)
+	}
+	return block, nil
+}
+
+func (s *store) GetBlocks(ctx context.Context) ([]*model.BlockSpec, error) {
+	blocks := []*model.BlockSpec{}
+	err := s.db.SelectContext(ctx, &blocks, `select * from blocks order by created_at`)
+	if err != nil {
+		return nil, fmt.Errorf("get blocks: %w", err)
+	}
+	return blocks, nil
 }
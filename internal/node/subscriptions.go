@@ -0,0 +1,313 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/bloom"
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+// topicPrefix is added to topics before they go in the subscription filter
+const topicPrefix = "topic:"
+
+// FilterConfig is read from the filter section of the config file. Zero
+// values size the subscription filter automatically.
+type FilterConfig struct {
+	// Type is the kind of filter sent to peers which understand it, either
+	// bloom (the default) or cuckoo. Other peers are sent a bloom filter.
+	Type bloom.Type `mapstructure:"type"`
+	// Size fixes the number of bits in the filter, otherwise it grows with
+	// the number of subscriptions
+	Size uint `mapstructure:"size"`
+	// Hashes fixes the number of hash functions, otherwise it is chosen for
+	// the false positive rate
+	Hashes uint `mapstructure:"hashes"`
+	// FalsePositiveRate is the rate the filter is sized for
+	FalsePositiveRate float64 `mapstructure:"false_positive_rate"`
+}
+
+func (c FilterConfig) withDefaults() FilterConfig {
+	if c.Type != bloom.TypeCuckoo {
+		c.Type = bloom.TypeBloom
+	}
+	if c.FalsePositiveRate <= 0 || c.FalsePositiveRate >= 1 {
+		c.FalsePositiveRate = bloom.DefaultFPR
+	}
+	return c
+}
+
+func (c FilterConfig) validate(check *configCheck) {
+	if c.Type != "" && !slices.Contains(bloom.Types, c.Type) {
+		check.addf("type", "%q is not a filter type, use bloom or cuckoo", c.Type)
+	}
+	if c.FalsePositiveRate < 0 || c.FalsePositiveRate >= 1 {
+		check.addf("false_positive_rate", "must be between 0 and 1, got %v", c.FalsePositiveRate)
+	}
+}
+
+// newFilter returns an empty filter of the configured type for the given
+// number of subscriptions. Cuckoo filters fall back to bloom filters when
+// there are more subscriptions than they can hold.
+func (c FilterConfig) newFilter(count int) bloom.Membership {
+	if c.Type == bloom.TypeCuckoo && count > 0 && count <= bloom.MaxCuckooCapacity {
+		return bloom.NewCuckoo(uint(count))
+	}
+	return c.newBloomFilter(count)
+}
+
+// newBloomFilter returns an empty bloom filter for the given number of
+// subscriptions. Nodes without subscriptions use the default filter, which
+// older nodes can read.
+func (c FilterConfig) newBloomFilter(count int) *bloom.Filter {
+	hashes := c.Hashes
+	if hashes == 0 {
+		hashes = bloom.HashesForFPR(c.FalsePositiveRate)
+	}
+
+	switch {
+	case c.Size > 0:
+		return bloom.NewWithParams(c.Size, hashes)
+	case count == 0:
+		return bloom.New()
+	default:
+		return bloom.NewWithParams(uint(math.Ceil(float64(uint(count)*hashes)/math.Ln2)), hashes)
+	}
+}
+
+// subscriptionFilter returns the current subscription filter. It is replaced
+// rather than changed so callers can read it without holding the lock.
+func (n *node) subscriptionFilter() bloom.Membership {
+	n.subscriptionsMu.Lock()
+	defer n.subscriptionsMu.Unlock()
+	return n.subscriptions
+}
+
+// subscriptionFilterFor returns the subscription filter to send to a node,
+// the bloom version unless the node has said it understands the configured
+// type
+func (n *node) subscriptionFilterFor(remoteAddr string) bloom.Membership {
+	n.subscriptionsMu.Lock()
+	defer n.subscriptionsMu.Unlock()
+
+	if n.subscriptions.Type() == bloom.TypeBloom || slices.Contains(n.peerFilterTypes[remoteAddr], n.subscriptions.Type()) {
+		return n.subscriptions
+	}
+	return n.bloomSubscriptions
+}
+
+// recordFilterTypes remembers which filter types a node understands, as
+// listed in its filter types header or join response. Nodes which don't say
+// only understand bloom filters.
+func (n *node) recordFilterTypes(remoteAddr string, types []string) {
+	parsed := []bloom.Type{}
+	for _, t := range types {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			parsed = append(parsed, bloom.Type(t))
+		}
+	}
+
+	n.subscriptionsMu.Lock()
+	defer n.subscriptionsMu.Unlock()
+	if len(parsed) == 0 {
+		delete(n.peerFilterTypes, remoteAddr)
+		return
+	}
+	n.peerFilterTypes[remoteAddr] = parsed
+}
+
+// recordFilterTypesHeader is recordFilterTypes for a request or response
+// header
+func (n *node) recordFilterTypesHeader(remoteAddr string, header http.Header) {
+	n.recordFilterTypes(remoteAddr, strings.Split(header.Get(HeaderFilterTypes), ","))
+}
+
+// filterTypes lists the filter types this node understands
+func filterTypes() []string {
+	types := make([]string, len(bloom.Types))
+	for i, t := range bloom.Types {
+		types[i] = string(t)
+	}
+	return types
+}
+
+// Subscribe adds the given entity IDs to the node's subscription filter. Peers
+// pick up the change on the next ping.
+func (n *node) Subscribe(ids ...string) {
+	n.subscriptionsMu.Lock()
+	for _, id := range ids {
+		n.subscribed[id] = struct{}{}
+	}
+	f := n.rebuildSubscriptions()
+	n.subscriptionsMu.Unlock()
+
+	n.events.Publish(SubscriptionChanged{
+		At:     time.Now().UTC(),
+		Filter: f.String(),
+	})
+}
+
+// Unsubscribe removes the given entity IDs from the node's subscription
+// filter
+func (n *node) Unsubscribe(ids ...string) {
+	n.subscriptionsMu.Lock()
+	for _, id := range ids {
+		delete(n.subscribed, id)
+	}
+	f := n.rebuildSubscriptions()
+	n.subscriptionsMu.Unlock()
+
+	n.events.Publish(SubscriptionChanged{
+		At:     time.Now().UTC(),
+		Filter: f.String(),
+	})
+}
+
+// SubscribeTopics subscribes to actions on entities matching the given
+// topics, either a label or a label with an attribute as Label:key=value
+func (n *node) SubscribeTopics(topics ...string) {
+	n.Subscribe(topicKeys(topics)...)
+}
+
+// UnsubscribeTopics removes the given topics from the node's subscription
+// filter
+func (n *node) UnsubscribeTopics(topics ...string) {
+	n.Unsubscribe(topicKeys(topics)...)
+}
+
+// topicKeys returns the filter keys for topics. The prefix keeps them apart
+// from entity IDs.
+func topicKeys(topics []string) []string {
+	keys := make([]string, len(topics))
+	for i, t := range topics {
+		keys[i] = topicPrefix + t
+	}
+	return keys
+}
+
+// CountOfSubscriptions returns the number of entity IDs subscribed to
+func (n *node) CountOfSubscriptions() int {
+	n.subscriptionsMu.Lock()
+	defer n.subscriptionsMu.Unlock()
+	return len(n.subscribed)
+}
+
+// setRoutingKeys replaces the entity IDs and topics an action arrived with,
+// which aren't signed, with those of its parsed statement: the IDs it names
+// and, for public actions, its topics
+func setRoutingKeys(action *graph.Action) {
+	action.EntityIDs = statementEntityIDs(action.Command)
+	action.Topics = nil
+	// topics would give away the contents of private actions
+	if action.KeyID == "" {
+		action.Topics = ast.Topics(action.Command)
+	}
+}
+
+// statementEntityIDs returns the IDs of the nodes a command names with an id
+// attribute, which are the IDs every node gives them
+func statementEntityIDs(cmd ast.Command) []string {
+	if cmd == nil {
+		return nil
+	}
+
+	ids := []string{}
+	entityIDs(cmd.Entity(), &ids)
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+func entityIDs(e ast.Entity, ids *[]string) {
+	if e == nil {
+		return
+	}
+
+	if r, ok := e.(ast.Relation); ok {
+		entityIDs(r.Left(), ids)
+		entityIDs(r.Right(), ids)
+		return
+	}
+
+	if id, ok := e.Attribute("id"); ok && id != "" {
+		*ids = append(*ids, id)
+	}
+}
+
+// isRelevant reports whether an action touches any subscribed entity or
+// topic. Its entity IDs and topics must come from the statement rather than
+// the sender, see setRoutingKeys. Actions without either are accepted, as is
+// everything when the node hasn't subscribed to anything.
+func (n *node) isRelevant(action *graph.Action) bool {
+	if !n.hostsNamespace(action.Namespace) {
+		return false
+	}
+	if len(action.EntityIDs) == 0 && len(action.Topics) == 0 {
+		return true
+	}
+	keys := namespaceKeys(action.Namespace, append(slices.Clone(action.EntityIDs), topicKeys(action.Topics)...))
+
+	n.subscriptionsMu.Lock()
+	defer n.subscriptionsMu.Unlock()
+
+	subscribed := false
+	for key := range n.subscribed {
+		if inNamespace(key, action.Namespace) {
+			subscribed = true
+			break
+		}
+	}
+	if !subscribed {
+		return true
+	}
+	for _, key := range keys {
+		if _, ok := n.subscribed[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rebuildSubscriptions replaces the filter with one built from the subscribed
+// IDs. Bits can be shared between IDs so clearing an ID's bits would drop
+// others too, and rebuilding also resizes the filter as IDs come and go. A
+// bloom filter is kept alongside other types for nodes which can't read them.
+// The caller must hold subscriptionsMu.
+func (n *node) rebuildSubscriptions() bloom.Membership {
+	f := n.filterConfig.newFilter(len(n.subscribed))
+	for id := range n.subscribed {
+		f.Set([]byte(id))
+	}
+
+	b, ok := f.(*bloom.Filter)
+	if !ok {
+		b = n.filterConfig.newBloomFilter(len(n.subscribed))
+		for id := range n.subscribed {
+			b.Set([]byte(id))
+		}
+	}
+
+	n.subscriptions = f
+	n.bloomSubscriptions = b
+	return f
+}
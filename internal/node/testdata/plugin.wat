@@ -0,0 +1,39 @@
+;; Source for plugin.wasm, a moderation plugin for the plugin tests. It
+;; switches on the first character of the action ID: "l" spins forever, "r"
+;; rejects the action, "w" rewrites it and anything else is accepted. live
+;; counts buffers which have been allocated but not freed.
+(module
+  (memory (export "memory") 1)
+  (global $next (mut i32) (i32.const 1024))
+  (global $live (export "live") (mut i32) (i32.const 0))
+  (data (i32.const 16) "{\"verdict\":\"reject\",\"reason\":\"test\"}")
+  (data (i32.const 128) "{\"verdict\":\"rewrite\",\"statement\":\"MERGE (p:Post{text:'rewritten'})\"}")
+
+  (func $alloc (export "alloc") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (global.set $live (i32.add (global.get $live) (i32.const 1)))
+    (local.get $ptr))
+
+  (func (export "free") (param $ptr i32) (param $size i32)
+    (global.set $live (i32.sub (global.get $live) (i32.const 1))))
+
+  (func (export "moderate") (param $ptr i32) (param $len i32) (result i64)
+    ;; {"id":" is 7 bytes so the ID starts at offset 7
+    (if (i32.eq (i32.load8_u offset=7 (local.get $ptr)) (i32.const 108))
+      (then (loop $spin (br $spin))))
+    (if (i32.eq (i32.load8_u offset=7 (local.get $ptr)) (i32.const 114))
+      (then (return (call $reply (i32.const 16) (i32.const 36)))))
+    (if (i32.eq (i32.load8_u offset=7 (local.get $ptr)) (i32.const 119))
+      (then (return (call $reply (i32.const 128) (i32.const 68)))))
+    (i64.const 0))
+
+  ;; reply copies a verdict into a new buffer and returns its location
+  (func $reply (param $src i32) (param $len i32) (result i64)
+    (local $out i32)
+    (local.set $out (call $alloc (local.get $len)))
+    (memory.copy (local.get $out) (local.get $src) (local.get $len))
+    (i64.or
+      (i64.shl (i64.extend_i32_u (local.get $out)) (i64.const 32))
+      (i64.extend_i32_u (local.get $len)))))
@@ -0,0 +1,228 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"slices"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	CertificateSourceGenerate = "generate"
+	CertificateSourceFile     = "file"
+	CertificateSourceACME     = "acme"
+
+	defaultACMEHTTPAddress = ":80"
+)
+
+// TLSConfig is read from the tls section of the config file and chooses where
+// the certificate presented by the node's transports comes from. Nodes don't
+// verify each other's certificates, so a generated one is enough unless other
+// clients connect to the node directly.
+type TLSConfig struct {
+	// Source is generate, file or acme. Generated certificates are self signed
+	// and made afresh each time the node starts.
+	Source string `mapstructure:"source"`
+	// CertFile and KeyFile are the PEM encoded certificate chain and private
+	// key used by the file source
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ACME requests certificates from Let's Encrypt or another ACME CA
+	ACME ACMEConfig `mapstructure:"acme"`
+}
+
+// ACMEConfig configures the acme certificate source. Setting it up accepts the
+// CA's terms of service.
+type ACMEConfig struct {
+	// Domains are the names certificates are requested for, all of which must
+	// resolve to the node
+	Domains []string `mapstructure:"domains"`
+	// Email is given to the CA to contact about problems with certificates
+	Email string `mapstructure:"email"`
+	// CacheDir keeps the account key and issued certificates between restarts
+	CacheDir string `mapstructure:"cache_dir"`
+	// DirectoryURL is the CA's directory, Let's Encrypt if empty
+	DirectoryURL string `mapstructure:"directory_url"`
+	// HTTPAddress is where the CA's HTTP-01 challenges are answered, which it
+	// expects on port 80
+	HTTPAddress string `mapstructure:"http_address"`
+}
+
+func (c TLSConfig) withDefaults() TLSConfig {
+	if c.Source == "" {
+		c.Source = CertificateSourceGenerate
+	}
+	if c.ACME.HTTPAddress == "" {
+		c.ACME.HTTPAddress = defaultACMEHTTPAddress
+	}
+	return c
+}
+
+func (c TLSConfig) validate(check *configCheck) {
+	switch c.Source {
+	case "", CertificateSourceGenerate:
+	case CertificateSourceFile:
+		if c.CertFile == "" {
+			check.addf("cert_file", "is needed by the %s source", c.Source)
+		}
+		if c.KeyFile == "" {
+			check.addf("key_file", "is needed by the %s source", c.Source)
+		}
+	case CertificateSourceACME:
+		if len(c.ACME.Domains) == 0 {
+			check.addf("acme.domains", "at least one is needed by the %s source", c.Source)
+		}
+		if c.ACME.CacheDir == "" {
+			check.addf("acme.cache_dir", "is needed so certificates aren't requested on every start")
+		}
+		if c.ACME.HTTPAddress != "" {
+			check.hostPort("acme.http_address", c.ACME.HTTPAddress, true)
+		}
+	default:
+		check.addf("source", "must be %s, %s or %s, got %q", CertificateSourceGenerate, CertificateSourceFile, CertificateSourceACME, c.Source)
+	}
+}
+
+// certificateSource supplies the TLS config the transports listen with
+type certificateSource struct {
+	config TLSConfig
+	nodeID string
+	acme   *autocert.Manager
+}
+
+func newCertificateSource(config TLSConfig, nodeID string) *certificateSource {
+	config = config.withDefaults()
+	s := &certificateSource{
+		config: config,
+		nodeID: nodeID,
+	}
+
+	if config.Source == CertificateSourceACME {
+		s.acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(config.ACME.CacheDir),
+			HostPolicy: autocert.HostWhitelist(config.ACME.Domains...),
+			Email:      config.ACME.Email,
+		}
+		if config.ACME.DirectoryURL != "" {
+			s.acme.Client = &acme.Client{DirectoryURL: config.ACME.DirectoryURL}
+		}
+	}
+
+	return s
+}
+
+func (s *certificateSource) transportConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{ProtocolHTTP3, ProtocolSession},
+	}
+
+	switch s.config.Source {
+	case CertificateSourceFile:
+		cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case CertificateSourceACME:
+		tlsConfig.GetCertificate = s.getACMECertificate
+	default:
+		cert, err := generateCertificate(s.nodeID)
+		if err != nil {
+			return nil, fmt.Errorf("generating certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// getACMECertificate falls back to the first domain for nodes dialled by IP
+// address, which don't send a server name
+func (s *certificateSource) getACMECertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !slices.Contains(s.config.ACME.Domains, hello.ServerName) {
+		named := *hello
+		named.ServerName = s.config.ACME.Domains[0]
+		hello = &named
+	}
+	return s.acme.GetCertificate(hello)
+}
+
+// startChallengeServer answers the ACME CA's HTTP-01 challenges. It returns a
+// nil closer if certificates don't come from ACME.
+func (s *certificateSource) startChallengeServer(logger *slog.Logger) (io.Closer, error) {
+	if s.acme == nil {
+		return nil, nil
+	}
+
+	listener, err := net.Listen("tcp", s.config.ACME.HTTPAddress)
+	if err != nil {
+		return nil, fmt.Errorf("listening on acme http address: %w", err)
+	}
+
+	logger.Info("starting acme challenge server", "addr", listener.Addr())
+	server := &http.Server{
+		Handler:           s.acme.HTTPHandler(nil),
+		ReadHeaderTimeout: defaultTimeout,
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("closing acme challenge server", "error", err)
+		}
+	}()
+
+	return server, nil
+}
+
+// generateCertificate creates a self signed certificate for the node
+func generateCertificate(nodeID string) (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generating key: %w", err)
+	}
+	template := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: nodeID,
+		},
+		SerialNumber: big.NewInt(1),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("creating certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  key,
+	}, nil
+}
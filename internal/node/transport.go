@@ -0,0 +1,164 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+const (
+	TransportQUIC = "quic"
+	TransportTCP  = "tcp"
+)
+
+var (
+	ErrNoTransport = errors.New("no transport available")
+	// ErrBodyTooLarge is returned when a request to another node has a body
+	// over MaxBodySize, which would otherwise arrive cut short
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// Transport is a way of exchanging requests with other nodes. Every node
+// listens on all of its transports and the transportSelector picks one per
+// peer when sending.
+type Transport interface {
+	http.RoundTripper
+	Name() string
+	Listen(handler http.Handler) error
+	CloseIdleConnections()
+	Close() error
+}
+
+// TransportFactory creates the transports for a node listening on addr
+type TransportFactory func(addr string) ([]Transport, error)
+
+// transportSelector tries each transport in order of preference and remembers
+// which one last worked for each peer so that subsequent requests go straight
+// to it.
+type transportSelector struct {
+	mu         sync.Mutex
+	transports []Transport
+	preferred  map[string]int
+	logger     *slog.Logger
+}
+
+func newTransportSelector(transports []Transport, logger *slog.Logger) *transportSelector {
+	return &transportSelector{
+		transports: transports,
+		preferred:  map[string]int{},
+		logger:     logger,
+	}
+}
+
+func (s *transportSelector) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(s.transports) == 0 {
+		return nil, ErrNoTransport
+	}
+
+	var body []byte
+	if req.Body != nil {
+		data, err := readRequestBody(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = data
+	}
+
+	host := req.URL.Host
+	s.mu.Lock()
+	start := s.preferred[host]
+	s.mu.Unlock()
+
+	var errs []error
+	for i := 0; i < len(s.transports); i++ {
+		ix := (start + i) % len(s.transports)
+		t := s.transports[ix]
+
+		r := req.Clone(req.Context())
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		resp, err := t.RoundTrip(r)
+		if err == nil {
+			s.mu.Lock()
+			s.preferred[host] = ix
+			s.mu.Unlock()
+			return resp, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", t.Name(), err))
+		if req.Context().Err() != nil {
+			break
+		}
+		s.logger.Debug("transport failed", "transport", t.Name(), "error", err, "remote", host)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// readRequestBody reads the body of a request to be sent to another node,
+// returning ErrBodyTooLarge if it is over MaxBodySize
+func readRequestBody(body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, MaxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %w", err)
+	}
+	if len(data) > MaxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	return data, nil
+}
+
+func (s *transportSelector) CountOfSessions() int {
+	count := 0
+	for _, t := range s.transports {
+		if st, ok := t.(interface{ CountOfSessions() int }); ok {
+			count += st.CountOfSessions()
+		}
+	}
+	return count
+}
+
+func (s *transportSelector) DropSession(remoteAddr string) {
+	for _, t := range s.transports {
+		if st, ok := t.(interface{ DropSession(string) }); ok {
+			st.DropSession(remoteAddr)
+		}
+	}
+}
+
+func (s *transportSelector) CloseIdleConnections() {
+	for _, t := range s.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+func (s *transportSelector) Close() error {
+	errs := []error{}
+	for _, t := range s.transports {
+		err := t.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("closing %s transport: %w", t.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
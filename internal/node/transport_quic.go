@@ -0,0 +1,178 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+type quicTransport struct {
+	logger       *slog.Logger
+	udpConn      *net.UDPConn
+	tr           *quic.Transport
+	tlsConfig    *tls.Config
+	roundTripper *http3.RoundTripper
+	sessions     *sessionManager
+	client       *sessionRoundTripper
+	server       *http3.Server
+	listener     *quic.EarlyListener
+	onClose      func(remoteAddr string)
+	metrics      *nodeMetrics
+}
+
+func newQUICTransport(addr *net.UDPAddr, tlsConfig *tls.Config, logger *slog.Logger, onClose func(string), metrics *nodeMetrics) (*quicTransport, error) {
+	udpConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("creating sock: %w", err)
+	}
+
+	t := &quicTransport{
+		logger:  logger,
+		udpConn: udpConn,
+		tr: &quic.Transport{
+			Conn:   udpConn,
+			Tracer: metrics.transportTracer(),
+		},
+		tlsConfig: tlsConfig,
+		onClose:   onClose,
+		metrics:   metrics,
+	}
+
+	t.roundTripper = &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{
+			NextProtos:         []string{ProtocolHTTP3, ProtocolSession},
+			InsecureSkipVerify: true,
+		},
+		QUICConfig: &quic.Config{
+			Tracer: metrics.connectionTracer(),
+		},
+		Dial: func(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
+			t.logger.Debug("dialing", "addr", addr)
+			a, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return t.tr.DialEarly(ctx, a, tlsConf, quicConf)
+		},
+	}
+
+	return t, nil
+}
+
+func (t *quicTransport) Name() string {
+	return TransportQUIC
+}
+
+func (t *quicTransport) Listen(handler http.Handler) error {
+	t.server = &http3.Server{
+		Handler: handler,
+	}
+
+	t.sessions = newSessionManager(func(ctx context.Context, addr string) (quic.Connection, error) {
+		t.logger.Debug("dialing session", "addr", addr)
+		a, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return t.tr.Dial(ctx, a, sessionTLSConfig(), sessionQUICConfig(t.metrics.connectionTracer()))
+	}, handler, t.logger, t.onClose, t.metrics)
+
+	t.client = &sessionRoundTripper{
+		sessions: t.sessions,
+		fallback: t.roundTripper,
+		logger:   t.logger,
+	}
+
+	listener, err := t.tr.ListenEarly(t.tlsConfig, sessionQUICConfig(t.metrics.connectionTracer()))
+	if err != nil {
+		return fmt.Errorf("setting up listener sock: %w", err)
+	}
+	t.listener = listener
+
+	go t.acceptConnections()
+
+	return nil
+}
+
+func (t *quicTransport) acceptConnections() {
+	for {
+		conn, err := t.listener.Accept(context.Background())
+		if err != nil {
+			t.logger.Error("closing peer server", "error", err)
+			return
+		}
+
+		switch conn.ConnectionState().TLS.NegotiatedProtocol {
+		case ProtocolSession:
+			t.sessions.Accept(conn)
+		default:
+			go func() {
+				err := t.server.ServeQUICConn(conn)
+				if err != nil {
+					t.logger.Debug("serving http3 connection", "error", err, "remote", conn.RemoteAddr())
+				}
+			}()
+		}
+	}
+}
+
+func (t *quicTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.client == nil {
+		return t.roundTripper.RoundTrip(req)
+	}
+	return t.client.RoundTrip(req)
+}
+
+func (t *quicTransport) CountOfSessions() int {
+	if t.sessions == nil {
+		return 0
+	}
+	return t.sessions.Count()
+}
+
+func (t *quicTransport) DropSession(remoteAddr string) {
+	if t.sessions != nil {
+		t.sessions.Drop(remoteAddr)
+	}
+}
+
+func (t *quicTransport) CloseIdleConnections() {
+	t.roundTripper.CloseIdleConnections()
+}
+
+func (t *quicTransport) Close() error {
+	if t.sessions != nil {
+		t.sessions.Close()
+	}
+	if t.server != nil {
+		t.server.CloseGracefully(10 * time.Second)
+	}
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	t.roundTripper.Close()
+	return t.tr.Close()
+}
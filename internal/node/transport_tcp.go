@@ -0,0 +1,153 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"time"
+)
+
+// ErrListenPortUnconfirmed is returned when the node at the address a TCP
+// request claims to come from isn't the one which sent it
+var ErrListenPortUnconfirmed = errors.New("listen port not confirmed")
+
+// tcpTransport carries the same requests as HTTP/2 over TLS/TCP for networks
+// where UDP is blocked. TCP connections arrive from ephemeral ports so the
+// sender advertises its listen port and the server rewrites RemoteAddr to
+// match the address the peer is known by on the QUIC transport. Anyone can
+// send the header, so before the address is stored or a key bound to it the
+// node calls back to it to check who is there.
+type tcpTransport struct {
+	logger     *slog.Logger
+	addr       string
+	listenPort int
+	tlsConfig  *tls.Config
+	client     *http.Transport
+	server     *http.Server
+	metrics    *nodeMetrics
+}
+
+func newTCPTransport(host string, port int, tlsConfig *tls.Config, logger *slog.Logger, metrics *nodeMetrics) *tcpTransport {
+	return &tcpTransport{
+		logger:     logger,
+		metrics:    metrics,
+		addr:       net.JoinHostPort(host, strconv.Itoa(port)),
+		listenPort: port,
+		tlsConfig:  tlsConfig,
+		client: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: defaultTimeout,
+			IdleConnTimeout:     sessionIdleTimeout,
+		},
+	}
+}
+
+func (t *tcpTransport) Name() string {
+	return TransportTCP
+}
+
+func (t *tcpTransport) Listen(handler http.Handler) error {
+	tlsConfig := t.tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+
+	listener, err := tls.Listen("tcp", t.addr, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("listening on tcp: %w", err)
+	}
+
+	t.server = &http.Server{
+		Handler:           t.rewriteRemoteAddr(handler),
+		ReadHeaderTimeout: defaultTimeout,
+	}
+
+	go func() {
+		err := t.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.logger.Error("closing tcp server", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func (t *tcpTransport) rewriteRemoteAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		port := req.Header.Get(HeaderListenPort)
+		if _, err := strconv.Atoi(port); err == nil {
+			if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+				req = req.WithContext(context.WithValue(req.Context(), claimedPortKey{}, true))
+				req.RemoteAddr = net.JoinHostPort(host, port)
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// claimedPortKey marks requests whose RemoteAddr has the port the sender
+// claimed to listen on rather than the one the request came from
+type claimedPortKey struct{}
+
+// confirmListenPort calls back to the address a request claims to come from,
+// if its port was claimed, to check the node there is the one which sent it
+func (n *node) confirmListenPort(ctx context.Context, req *http.Request, nodeID, nodeKey string) error {
+	if claimed, _ := req.Context().Value(claimedPortKey{}).(bool); !claimed {
+		return nil
+	}
+
+	err := n.confirmNode(ctx, req.RemoteAddr, nodeID, nodeKey)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrListenPortUnconfirmed, err)
+	}
+	return nil
+}
+
+func (t *tcpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.metrics.connectionUsed(TransportTCP, info.Reused)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	req.Header.Set(HeaderListenPort, strconv.Itoa(t.listenPort))
+	return t.client.RoundTrip(req)
+}
+
+func (t *tcpTransport) CloseIdleConnections() {
+	t.client.CloseIdleConnections()
+}
+
+func (t *tcpTransport) Close() error {
+	t.client.CloseIdleConnections()
+	if t.server == nil {
+		return nil
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	return t.server.Shutdown(ctx)
+}
@@ -0,0 +1,89 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestConfirmListenPort(t *testing.T) {
+	listening := newTestNode(t)
+	listening.nodeID = "listening"
+	listening.publicAddr = newPublicAddress("", "10.0.0.2:9000", 9000, 1)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	listening.nodeKey = key
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other := encodeNodeKey(otherKey.Public().(ed25519.PublicKey))
+
+	n := newTestNode(t)
+	called := 0
+	n.client = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		called++
+		if req.URL.Host != "10.0.0.2:9000" {
+			return nil, errors.New("connection refused")
+		}
+		w := httptest.NewRecorder()
+		listening.handleWhoAmI(w, req)
+		return w.Result(), nil
+	})}
+
+	testCases := []struct {
+		name    string
+		port    string
+		nodeID  string
+		nodeKey string
+		remote  string
+		called  int
+		err     bool
+	}{
+		{name: "port not claimed", nodeID: "spoofed", nodeKey: other, remote: "10.0.0.2:54321"},
+		{name: "signed by the node there", port: "9000", nodeKey: listening.NodeKey(), remote: "10.0.0.2:9000", called: 1},
+		{name: "signed by another node", port: "9000", nodeID: "listening", nodeKey: other, remote: "10.0.0.2:9000", called: 1, err: true},
+		{name: "unsigned from the node there", port: "9000", nodeID: "listening", remote: "10.0.0.2:9000", called: 1},
+		{name: "unsigned from another node", port: "9000", nodeID: "spoofed", remote: "10.0.0.2:9000", called: 1, err: true},
+		{name: "unsigned without a node ID", port: "9000", remote: "10.0.0.2:9000", called: 1, err: true},
+		{name: "nothing listening", port: "9001", nodeKey: listening.NodeKey(), remote: "10.0.0.2:9001", called: 1, err: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			called = 0
+			var remote string
+			var confirmErr error
+			handler := (&tcpTransport{}).rewriteRemoteAddr(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				remote = req.RemoteAddr
+				confirmErr = n.confirmListenPort(req.Context(), req, tc.nodeID, tc.nodeKey)
+			}))
+
+			req := httptest.NewRequest("POST", "https://10.0.0.1:9000/hello", nil)
+			req.RemoteAddr = "10.0.0.2:54321"
+			if tc.port != "" {
+				req.Header.Set(HeaderListenPort, tc.port)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tc.remote, remote)
+			assert.Equal(t, tc.called, called)
+			if tc.err {
+				assert.ErrorIs(t, confirmErr, ErrListenPortUnconfirmed)
+			} else {
+				assert.NoError(t, confirmErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// Version is the software version of the node, set when building with
+//
+//	-ldflags "-X github.com/jdudmesh/propolis/internal/node.Version=v1.2.3"
+//
+// Otherwise it is the module version go install built, or dev.
+var Version = ""
+
+const (
+	defaultVersionCheckInterval = 6 * time.Hour
+	defaultMaxMinorsBehind      = 2
+	devVersion                  = "dev"
+)
+
+// VersionCheckConfig is read from the version_check section of the config
+// file. Nodes send their software version in pings, hellos and whoami, seeds
+// count the versions of the peers which joined them, and each node
+// periodically compares its own version with the network's majority and
+// warns when it has fallen behind.
+type VersionCheckConfig struct {
+	// Interval is how often the versions are counted, negative disables
+	// the check
+	Interval time.Duration `mapstructure:"interval"`
+	// MaxMinorsBehind is how many minor versions the node can trail the
+	// majority before it warns. A major version behind always warns.
+	MaxMinorsBehind int `mapstructure:"max_minors_behind"`
+}
+
+func (c VersionCheckConfig) withDefaults() VersionCheckConfig {
+	if c.Interval == 0 {
+		c.Interval = defaultVersionCheckInterval
+	}
+	if c.MaxMinorsBehind == 0 {
+		c.MaxMinorsBehind = defaultMaxMinorsBehind
+	}
+	return c
+}
+
+func (c VersionCheckConfig) validate(check *configCheck) {
+	if c.MaxMinorsBehind < 0 {
+		check.addf("max_minors_behind", "must not be negative, got %d", c.MaxMinorsBehind)
+	}
+}
+
+// VersionStatus is the outcome of the last version check
+type VersionStatus struct {
+	// Version is the node's software version
+	Version string `json:"version"`
+	// Majority is the newest version which more than half of the network
+	// runs or has passed, empty until the versions are counted
+	Majority string `json:"majority,omitempty"`
+	// MajorsBehind and MinorsBehind are how far the node trails it
+	MajorsBehind int `json:"majorsBehind"`
+	MinorsBehind int `json:"minorsBehind"`
+	// Outdated is set when the node is further behind than allowed
+	Outdated bool `json:"outdated"`
+	// Versions counts the nodes seen running each version
+	Versions  map[string]int `json:"versions,omitempty"`
+	CheckedAt *time.Time     `json:"checkedAt,omitempty"`
+}
+
+// versionCheck holds the last version status
+type versionCheck struct {
+	config VersionCheckConfig
+	mu     sync.Mutex
+	status VersionStatus
+}
+
+func newVersionCheck(config VersionCheckConfig, version string) *versionCheck {
+	return &versionCheck{
+		config: config.withDefaults(),
+		status: VersionStatus{Version: version},
+	}
+}
+
+func (v *versionCheck) Status() VersionStatus {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.status
+}
+
+// softwareVersion returns Version or, when it isn't set, the version of the
+// main module
+func softwareVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && semver.IsValid(info.Main.Version) {
+		return info.Main.Version
+	}
+	return devVersion
+}
+
+// majorityVersion returns the newest version which more than half of the
+// nodes counted run or have passed. Versions which aren't semantic versions,
+// such as development builds, aren't counted.
+func majorityVersion(versions map[string]int) string {
+	valid := []string{}
+	total := 0
+	for v, count := range versions {
+		if semver.IsValid(v) && count > 0 {
+			valid = append(valid, v)
+			total += count
+		}
+	}
+	slices.SortFunc(valid, func(a, b string) int {
+		return semver.Compare(b, a)
+	})
+
+	seen := 0
+	for _, v := range valid {
+		seen += versions[v]
+		if 2*seen > total {
+			return v
+		}
+	}
+	return ""
+}
+
+// versionsBehind returns how many major versions, and minor versions within
+// the same major version, version trails majority by
+func versionsBehind(version, majority string) (int, int) {
+	if !semver.IsValid(version) || !semver.IsValid(majority) || semver.Compare(version, majority) >= 0 {
+		return 0, 0
+	}
+
+	major, minor := versionNumbers(version)
+	majorityMajor, majorityMinor := versionNumbers(majority)
+	if majorityMajor > major {
+		return majorityMajor - major, 0
+	}
+	return 0, max(majorityMinor-minor, 0)
+}
+
+// versionNumbers returns the major and minor numbers of a semantic version
+func versionNumbers(version string) (int, int) {
+	parts := strings.SplitN(strings.TrimPrefix(semver.MajorMinor(version), "v"), ".", 2)
+	major, _ := strconv.Atoi(parts[0])
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	return major, minor
+}
+
+// countVersions counts the software versions of the network. Seeds count
+// the peers which joined them and themselves. Other nodes add up the counts
+// of their seeds, so nodes which joined more than one seed are counted more
+// than once, and count themselves only if they don't join.
+func (n *node) countVersions(ctx context.Context) (map[string]int, error) {
+	if n.capabilities.Has(CapabilityAcceptJoins) {
+		versions, err := n.store.CountPeersBySoftwareVersion(ctx)
+		if err != nil {
+			return nil, err
+		}
+		versions[n.version]++
+		return versions, nil
+	}
+
+	seeds, err := n.store.GetSeeds(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching seeds: %w", err)
+	}
+
+	versions := map[string]int{}
+	reached := 0
+	for _, seed := range seeds {
+		counts, err := n.fetchVersions(ctx, seed.RemoteAddr)
+		if err != nil {
+			n.logger.Warn("fetching versions", "error", err, "remote", seed.RemoteAddr)
+			continue
+		}
+		reached++
+		for v, count := range counts {
+			versions[v] += count
+		}
+	}
+	if len(seeds) > 0 && reached == 0 {
+		return nil, errSeedsUnreachable
+	}
+
+	if !n.capabilities.Has(CapabilityRelay) {
+		versions[n.version]++
+	}
+	return versions, nil
+}
+
+func (n *node) fetchVersions(ctx context.Context, remoteAddr string) (map[string]int, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, defaultTimeout)
+	defer cancelFn()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/versions", remoteAddr), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating versions request: %w", err)
+	}
+	n.setProtocolHeaders(req.Header)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("getting versions: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad versions response: %d", resp.StatusCode)
+	}
+
+	versions := map[string]int{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, MaxBodySize)).Decode(&versions)
+	if err != nil {
+		return nil, fmt.Errorf("decoding versions: %w", err)
+	}
+	return versions, nil
+}
+
+// checkVersions counts the network's versions and warns when the node has
+// fallen behind the majority
+func (n *node) checkVersions(ctx context.Context) {
+	versions, err := n.countVersions(ctx)
+	if err != nil {
+		n.logger.Error("counting versions", "error", err)
+		return
+	}
+
+	majority := majorityVersion(versions)
+	majors, minors := versionsBehind(n.version, majority)
+	outdated := majors > 0 || minors > n.versions.config.MaxMinorsBehind
+	now := time.Now().UTC()
+
+	n.versions.mu.Lock()
+	n.versions.status = VersionStatus{
+		Version:      n.version,
+		Majority:     majority,
+		MajorsBehind: majors,
+		MinorsBehind: minors,
+		Outdated:     outdated,
+		Versions:     versions,
+		CheckedAt:    &now,
+	}
+	n.versions.mu.Unlock()
+
+	n.metrics.networkVersions.Reset()
+	for v, count := range versions {
+		n.metrics.networkVersions.WithLabelValues(v).Set(float64(count))
+	}
+	if outdated {
+		n.metrics.versionOutdated.Set(1)
+		n.logger.Warn("node is behind the network", "version", n.version, "majority", majority, "majors_behind", majors, "minors_behind", minors)
+	} else {
+		n.metrics.versionOutdated.Set(0)
+	}
+}
+
+// handleVersions returns how many of the peers which joined the seed run
+// each software version
+func (n *node) handleVersions(w http.ResponseWriter, req *http.Request) {
+	versions, err := n.store.CountPeersBySoftwareVersion(req.Context())
+	if err != nil {
+		n.logger.Error("counting versions", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	versions[n.version]++
+
+	n.setProtocolHeaders(w.Header())
+	n.writeJSON(w, versions)
+}
+
+// VersionStatus returns the outcome of the last version check
+func (n *node) VersionStatus() VersionStatus {
+	return n.versions.Status()
+}
@@ -0,0 +1,190 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+// APIView is a named MATCH statement whose results the node keeps up to date
+// as actions arrive
+type APIView struct {
+	Name      string    `json:"name"`
+	Statement string    `json:"statement"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// APIRegisterViewRequest registers, or replaces, a view
+type APIRegisterViewRequest struct {
+	Statement string `json:"statement"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// ViewSigningPayload is the statement a reader signs, in place of a MATCH,
+// to read a view
+func ViewSigningPayload(name string) string {
+	return "VIEW " + name
+}
+
+// handleView returns a view's rows to a client, filtered by the read ACL
+func (n *node) handleView(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+
+	name := req.PathValue("name")
+	reader, err := n.queryReader(req, namespace, ViewSigningPayload(name))
+	if err != nil {
+		n.writeReaderError(w, req, err)
+		return
+	}
+
+	n.writeView(w, req, namespace, name, n.readFilter(namespace, reader))
+}
+
+// handleAPIView returns a view's rows
+func (n *node) handleAPIView(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+	n.writeView(w, req, namespace, req.PathValue("name"), nil)
+}
+
+func (n *node) writeView(w http.ResponseWriter, req *http.Request, namespace, name string, readable graph.ReadFilter) {
+	executor, err := n.graphFor(namespace)
+	if err != nil {
+		n.writeQueryError(w, req, err)
+		return
+	}
+
+	res, err := executor.QueryView(name, readable)
+	if err != nil {
+		n.writeViewError(w, req, err)
+		return
+	}
+
+	n.writeResults(w, req, res)
+}
+
+// handleAPIViews lists the views registered in the graph given by the
+// namespace parameter
+func (n *node) handleAPIViews(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+
+	executor, err := n.graphFor(namespace)
+	if err != nil {
+		n.writeQueryError(w, req, err)
+		return
+	}
+
+	views, err := executor.RegisteredViews()
+	if err != nil {
+		n.writeViewError(w, req, err)
+		return
+	}
+
+	res := make([]*APIView, 0, len(views))
+	for _, v := range views {
+		res = append(res, &APIView{
+			Name:      v.Name,
+			Statement: v.Statement,
+			CreatedAt: v.CreatedAt,
+		})
+	}
+	n.writeJSON(w, res)
+}
+
+// handleAPIRegisterView registers a view and fills it from the graph
+func (n *node) handleAPIRegisterView(w http.ResponseWriter, req *http.Request) {
+	body := APIRegisterViewRequest{}
+	if !readAPIRequest(w, req, &body) {
+		return
+	}
+
+	name := req.PathValue("name")
+	if !schemaName.MatchString(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("view name must be an identifier"))
+		return
+	}
+
+	executor, err := n.graphFor(body.Namespace)
+	if err != nil {
+		n.writeQueryError(w, req, err)
+		return
+	}
+
+	_, err = n.statementLimits().parseStatement(body.Statement)
+	if err != nil {
+		n.writeQueryError(w, req, err)
+		return
+	}
+
+	err = executor.RegisterView(name, body.Statement)
+	if err != nil {
+		n.writeViewError(w, req, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAPIDropView removes a view and its rows
+func (n *node) handleAPIDropView(w http.ResponseWriter, req *http.Request) {
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+
+	executor, err := n.graphFor(namespace)
+	if err != nil {
+		n.writeQueryError(w, req, err)
+		return
+	}
+
+	err = executor.DropView(req.PathValue("name"))
+	if err != nil {
+		n.writeViewError(w, req, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeViewError maps an error from the executor's views to a response
+func (n *node) writeViewError(w http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, graph.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no such view"))
+	case errors.Is(err, graph.ErrBadView):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	default:
+		n.logger.Error("reading view", "error", err, "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
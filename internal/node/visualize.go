@@ -0,0 +1,138 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jdudmesh/propolis/internal/graph"
+)
+
+const (
+	// VisualFormatDOT renders MATCH results as a Graphviz digraph
+	VisualFormatDOT = "dot"
+	// VisualFormatD3 renders MATCH results as the nodes and links JSON used
+	// by D3's force layout
+	VisualFormatD3 = "d3"
+
+	ContentTypeDOT = "text/vnd.graphviz"
+)
+
+var ErrUnknownVisualFormat = errors.New("unknown format, use dot or d3")
+
+// visualize runs a MATCH statement against a namespace and lays out the
+// nodes and relations it matched
+func (n *node) visualize(namespace, stmt string, readable graph.ReadFilter) (*graph.View, error) {
+	res, err := n.query(namespace, stmt, readable)
+	if err != nil {
+		return nil, err
+	}
+
+	results, ok := res.(*graph.SearchResults)
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected results %T", errExecutor, res)
+	}
+
+	executor, err := n.graphFor(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	view, err := graph.NewView(results, executor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errExecutor, err)
+	}
+	return view, nil
+}
+
+// handleVisualize renders a MATCH statement's results in the format given by
+// the format parameter, D3 JSON by default
+func (n *node) handleVisualize(w http.ResponseWriter, req *http.Request) {
+	format := req.URL.Query().Get("format")
+	if !validVisualFormat(format) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(ErrUnknownVisualFormat.Error()))
+		return
+	}
+
+	namespace, ok := n.requestNamespace(w, req)
+	if !ok {
+		return
+	}
+
+	defer req.Body.Close()
+	buf, err := io.ReadAll(io.LimitReader(req.Body, MaxBodySize))
+	if err != nil {
+		n.logger.Error("reading body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reader, err := n.queryReader(req, namespace, string(buf))
+	if err != nil {
+		n.writeReaderError(w, req, err)
+		return
+	}
+
+	n.writeVisualization(w, req, namespace, string(buf), format, n.readFilter(namespace, reader))
+}
+
+func (n *node) handleAPIVisualize(w http.ResponseWriter, req *http.Request) {
+	body := APIVisualizeRequest{}
+	if !readAPIRequest(w, req, &body) {
+		return
+	}
+	if !validVisualFormat(body.Format) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(ErrUnknownVisualFormat.Error()))
+		return
+	}
+
+	n.writeVisualization(w, req, body.Namespace, body.Statement, body.Format, nil)
+}
+
+func (n *node) writeVisualization(w http.ResponseWriter, req *http.Request, namespace, stmt, format string, readable graph.ReadFilter) {
+	view, err := n.visualize(namespace, stmt, readable)
+	if err != nil {
+		n.writeQueryError(w, req, err)
+		return
+	}
+
+	if format != VisualFormatDOT {
+		n.writeJSON(w, view)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = view.WriteDOT(buf)
+	if err != nil {
+		n.logger.Error("rendering dot", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(HeaderContentType, ContentTypeDOT)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func validVisualFormat(format string) bool {
+	return format == "" || format == VisualFormatDOT || format == VisualFormatD3
+}
@@ -0,0 +1,362 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+)
+
+const (
+	defaultWebhookAttempts = 5
+	defaultWebhookBackoff  = time.Second
+	defaultWebhookTimeout  = 10 * time.Second
+	webhookQueueSize       = 1024
+
+	// WebhookEventActionAccepted is sent in the X-Propolis-Event header
+	WebhookEventActionAccepted = "action.accepted"
+	// HeaderWebhookSignature carries sha256=<hex HMAC of the body> when the
+	// webhook has a secret
+	HeaderWebhookSignature = "X-Propolis-Signature"
+	HeaderWebhookEvent     = "X-Propolis-Event"
+)
+
+var errWebhookRejected = errors.New("webhook rejected the payload")
+
+// WebhookConfig is an entry in the webhooks section of the config file. Each
+// webhook is sent a JSON payload for every public action accepted by the node
+// which has a topic matching one of the filters.
+type WebhookConfig struct {
+	URL string `mapstructure:"url"`
+	// Filters are topics such as Post or Tag:value=golang and can use
+	// path.Match wildcards, no filters matches every action
+	Filters []string `mapstructure:"filters"`
+	// Secret signs the payload with HMAC-SHA256 so the receiver can check it
+	// came from this node
+	Secret string `mapstructure:"secret"`
+	// MaxAttempts is how many times a payload is sent before it is given up on
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// Backoff is the wait before the first retry, doubled for each one after
+	Backoff time.Duration `mapstructure:"backoff"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	// DeadLetterFile, if set, has a JSON line appended for each payload given
+	// up on as well as it being logged
+	DeadLetterFile string `mapstructure:"dead_letter_file"`
+}
+
+func (c WebhookConfig) withDefaults() WebhookConfig {
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = defaultWebhookAttempts
+	}
+	if c.Backoff == 0 {
+		c.Backoff = defaultWebhookBackoff
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultWebhookTimeout
+	}
+	return c
+}
+
+func (c WebhookConfig) validate(check *configCheck, i int) {
+	key := func(name string) string {
+		return fmt.Sprintf("%d.%s", i, name)
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		check.addf(key("url"), "must be an http or https URL, got %q", c.URL)
+	}
+	for _, f := range c.Filters {
+		_, err := path.Match(f, "")
+		if err != nil {
+			check.addf(key("filters"), "%q: %v", f, err)
+		}
+	}
+	nonNegative(check, key("max_attempts"), c.MaxAttempts)
+	nonNegative(check, key("backoff"), c.Backoff)
+	nonNegative(check, key("timeout"), c.Timeout)
+}
+
+// WebhookPayload is the JSON body sent to webhooks
+type WebhookPayload struct {
+	Event      string    `json:"event"`
+	ID         string    `json:"id"`
+	Identity   string    `json:"identity"`
+	NodeID     string    `json:"nodeId"`
+	Statement  string    `json:"statement"`
+	Topics     []string  `json:"topics"`
+	Timestamp  time.Time `json:"timestamp"`
+	AcceptedAt time.Time `json:"acceptedAt"`
+}
+
+type deadLetter struct {
+	Webhook  string          `json:"webhook"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	At       time.Time       `json:"at"`
+	Payload  *WebhookPayload `json:"payload"`
+}
+
+// webhook sends payloads to one URL from its own goroutine so a slow receiver
+// doesn't hold up the event bus or the other webhooks
+type webhook struct {
+	config  WebhookConfig
+	client  *http.Client
+	logger  *slog.Logger
+	metrics *nodeMetrics
+	queue   chan *WebhookPayload
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type webhooks []*webhook
+
+func newWebhooks(configs []WebhookConfig, logger *slog.Logger, metrics *nodeMetrics) webhooks {
+	hooks := make(webhooks, 0, len(configs))
+	for _, c := range configs {
+		c = c.withDefaults()
+		h := &webhook{
+			config:  c,
+			client:  &http.Client{Timeout: c.Timeout},
+			logger:  logger.With("webhook", c.URL),
+			metrics: metrics,
+			queue:   make(chan *WebhookPayload, webhookQueueSize),
+			done:    make(chan struct{}),
+			stopped: make(chan struct{}),
+		}
+		go h.run()
+		hooks = append(hooks, h)
+	}
+	return hooks
+}
+
+// send queues an accepted action for every webhook with a matching filter.
+// Actions are dead lettered rather than blocking if a webhook has fallen too
+// far behind.
+func (w webhooks) send(e ActionAccepted) {
+	action := e.Action
+	// private actions and those we can't read aren't sent
+	if len(w) == 0 || action.KeyID != "" || action.Command == nil {
+		return
+	}
+
+	topics := ast.Topics(action.Command)
+	payload := &WebhookPayload{
+		Event:      WebhookEventActionAccepted,
+		ID:         action.ID,
+		Identity:   action.Identity,
+		NodeID:     action.NodeID,
+		Statement:  action.Action,
+		Topics:     topics,
+		Timestamp:  action.Timestamp,
+		AcceptedAt: e.At,
+	}
+
+	for _, h := range w {
+		if !h.matches(topics) {
+			continue
+		}
+		select {
+		case h.queue <- payload:
+		default:
+			h.deadLetter(payload, 0, errors.New("queue full"))
+		}
+	}
+}
+
+func (w webhooks) Close() {
+	for _, h := range w {
+		close(h.done)
+	}
+	for _, h := range w {
+		<-h.stopped
+	}
+}
+
+func (h *webhook) matches(topics []string) bool {
+	if len(h.config.Filters) == 0 {
+		return true
+	}
+	for _, f := range h.config.Filters {
+		for _, t := range topics {
+			if ok, _ := path.Match(f, t); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *webhook) run() {
+	defer close(h.stopped)
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	go func() {
+		select {
+		case <-h.done:
+			cancelFn()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-h.done:
+			if n := len(h.queue); n > 0 {
+				h.logger.Warn("webhook closed with payloads queued", "count", n)
+			}
+			return
+		case p := <-h.queue:
+			h.deliver(ctx, p)
+		}
+	}
+}
+
+// deliver posts the payload until it is accepted, backing off between
+// attempts, and dead letters it if every attempt fails
+func (h *webhook) deliver(ctx context.Context, p *WebhookPayload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		h.deadLetter(p, 0, fmt.Errorf("encoding payload: %w", err))
+		return
+	}
+
+	backoff := h.config.Backoff
+	for attempt := 1; ; attempt++ {
+		err = h.post(ctx, body)
+		if err == nil {
+			h.metrics.webhookDeliveries.WithLabelValues("delivered").Inc()
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errWebhookRejected) || attempt >= h.config.MaxAttempts {
+			h.deadLetter(p, attempt, err)
+			return
+		}
+
+		h.metrics.webhookDeliveries.WithLabelValues("retried").Inc()
+		h.logger.Debug("retrying webhook", "action", p.ID, "attempt", attempt, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (h *webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookEvent, WebhookEventActionAccepted)
+	if h.config.Secret != "" {
+		req.Header.Set(HeaderWebhookSignature, "sha256="+webhookSignature(h.config.Secret, body))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending payload: %w", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	default:
+		// the receiver won't change its mind so there's no point retrying
+		return fmt.Errorf("%w: %d", errWebhookRejected, resp.StatusCode)
+	}
+}
+
+// webhookSignature is the hex encoded HMAC-SHA256 of the body
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var deadLetterMu sync.Mutex
+
+func (h *webhook) deadLetter(p *WebhookPayload, attempts int, reason error) {
+	h.metrics.webhookDeliveries.WithLabelValues("dead_letter").Inc()
+	h.logger.Error("webhook payload dead lettered", "action", p.ID, "attempts", attempts, "error", reason)
+
+	if h.config.DeadLetterFile == "" {
+		return
+	}
+
+	line, err := json.Marshal(&deadLetter{
+		Webhook:  h.config.URL,
+		Attempts: attempts,
+		Error:    reason.Error(),
+		At:       time.Now().UTC(),
+		Payload:  p,
+	})
+	if err != nil {
+		h.logger.Error("encoding dead letter", "error", err)
+		return
+	}
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	f, err := os.OpenFile(h.config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		h.logger.Error("opening dead letter file", "error", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		h.logger.Error("writing dead letter", "error", err)
+	}
+}
+
+func (n *node) sendWebhooks(e Event) {
+	accepted, ok := e.(ActionAccepted)
+	if !ok {
+		return
+	}
+
+	n.reloadMu.RLock()
+	defer n.reloadMu.RUnlock()
+	n.webhooks.send(accepted)
+}
@@ -0,0 +1,217 @@
+package node
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// newTestReceiver returns a webhook receiver answering each request with the
+// status for its attempt, the last status being repeated
+func newTestReceiver(t *testing.T, statuses ...int) (*httptest.Server, chan webhookRequest) {
+	received := make(chan webhookRequest, 16)
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- webhookRequest{header: r.Header, body: body, at: time.Now()}
+		attempt := int(attempts.Add(1))
+		w.WriteHeader(statuses[min(attempt, len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func acceptedAction(t *testing.T, id, stmt string) ActionAccepted {
+	p, err := ast.Parse(stmt)
+	require.NoError(t, err)
+	return ActionAccepted{
+		At:     time.Now().UTC(),
+		Action: graph.Action{ID: id, Identity: "alice", NodeID: "node", Action: stmt, Command: p.Command(), Timestamp: time.Now().UTC()},
+	}
+}
+
+func receive(t *testing.T, received chan webhookRequest) webhookRequest {
+	select {
+	case r := <-received:
+		return r
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "webhook not delivered")
+		return webhookRequest{}
+	}
+}
+
+func assertNotReceived(t *testing.T, received chan webhookRequest) {
+	select {
+	case r := <-received:
+		assert.Fail(t, "unexpected webhook", "%s", r.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	n := newTestNode(t)
+	posts, postsReceived := newTestReceiver(t, http.StatusOK)
+	tags, tagsReceived := newTestReceiver(t, http.StatusNoContent)
+	all, allReceived := newTestReceiver(t, http.StatusOK)
+
+	n.webhooks = newWebhooks([]WebhookConfig{
+		{URL: posts.URL, Filters: []string{"Post"}, Secret: "shh"},
+		{URL: tags.URL, Filters: []string{"Tag:value=go*"}},
+		{URL: all.URL},
+	}, n.logger, n.metrics)
+	t.Cleanup(n.webhooks.Close)
+
+	post := acceptedAction(t, "a1", "MERGE (p:Post{id:'1'})")
+	n.sendWebhooks(post)
+
+	r := receive(t, postsReceived)
+	assert.Equal(t, "application/json", r.header.Get("Content-Type"))
+	assert.Equal(t, WebhookEventActionAccepted, r.header.Get(HeaderWebhookEvent))
+	assert.Equal(t, "sha256="+webhookSignature("shh", r.body), r.header.Get(HeaderWebhookSignature))
+	assert.NotEqual(t, "sha256="+webhookSignature("other", r.body), r.header.Get(HeaderWebhookSignature))
+
+	payload := WebhookPayload{}
+	require.NoError(t, json.Unmarshal(r.body, &payload))
+	assert.Equal(t, WebhookEventActionAccepted, payload.Event)
+	assert.Equal(t, "a1", payload.ID)
+	assert.Equal(t, "alice", payload.Identity)
+	assert.Equal(t, "node", payload.NodeID)
+	assert.Equal(t, post.Action.Action, payload.Statement)
+	assert.Equal(t, []string{"Post", "Post:id=1"}, payload.Topics)
+	assert.True(t, post.At.Equal(payload.AcceptedAt))
+
+	// unsigned webhooks have no signature header
+	r = receive(t, allReceived)
+	assert.Empty(t, r.header.Get(HeaderWebhookSignature))
+	assertNotReceived(t, tagsReceived)
+
+	tag := acceptedAction(t, "a2", "MERGE (t:Tag{value:'golang'})")
+	n.sendWebhooks(tag)
+	r = receive(t, tagsReceived)
+	require.NoError(t, json.Unmarshal(r.body, &payload))
+	assert.Equal(t, "a2", payload.ID)
+	receive(t, allReceived)
+	assertNotReceived(t, postsReceived)
+
+	// private actions, those which can't be read and other events aren't sent
+	private := acceptedAction(t, "a3", "MERGE (p:Post{id:'3'})")
+	private.Action.KeyID = "key"
+	n.sendWebhooks(private)
+	unread := acceptedAction(t, "a4", "MERGE (p:Post{id:'4'})")
+	unread.Action.Command = nil
+	n.sendWebhooks(unread)
+	n.sendWebhooks(ActionRejected{At: time.Now().UTC(), Action: post.Action, Reason: RejectReasonModeration})
+	assertNotReceived(t, allReceived)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(n.metrics.webhookDeliveries.WithLabelValues("delivered")) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	backoff := 20 * time.Millisecond
+
+	tests := []struct {
+		name       string
+		statuses   []int
+		attempts   int
+		deadLetter bool
+	}{
+		{name: "delivered first time", statuses: []int{http.StatusOK}, attempts: 1},
+		{name: "retried until accepted", statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}, attempts: 3},
+		{name: "retried until given up", statuses: []int{http.StatusInternalServerError}, attempts: 3, deadLetter: true},
+		{name: "rejected", statuses: []int{http.StatusBadRequest}, attempts: 1, deadLetter: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newTestNode(t)
+			server, received := newTestReceiver(t, tt.statuses...)
+			deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+			hooks := newWebhooks([]WebhookConfig{{URL: server.URL, MaxAttempts: 3, Backoff: backoff, DeadLetterFile: deadLetters}}, n.logger, n.metrics)
+			t.Cleanup(hooks.Close)
+
+			hooks.send(acceptedAction(t, "a1", "MERGE (p:Post{id:'1'})"))
+
+			// the wait doubles after each failed attempt
+			requests := []webhookRequest{}
+			for range tt.attempts {
+				requests = append(requests, receive(t, received))
+			}
+			for i := 1; i < len(requests); i++ {
+				assert.GreaterOrEqual(t, requests[i].at.Sub(requests[i-1].at), backoff<<(i-1))
+				assert.Equal(t, requests[0].body, requests[i].body)
+			}
+			assertNotReceived(t, received)
+
+			outcome := "delivered"
+			if tt.deadLetter {
+				outcome = "dead_letter"
+			}
+			require.Eventually(t, func() bool {
+				return testutil.ToFloat64(n.metrics.webhookDeliveries.WithLabelValues(outcome)) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, float64(tt.attempts-1), testutil.ToFloat64(n.metrics.webhookDeliveries.WithLabelValues("retried")))
+
+			if !tt.deadLetter {
+				assert.NoFileExists(t, deadLetters)
+				return
+			}
+			f, err := os.Open(deadLetters)
+			require.NoError(t, err)
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			require.True(t, scanner.Scan())
+			letter := deadLetter{}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &letter))
+			assert.Equal(t, server.URL, letter.Webhook)
+			assert.Equal(t, tt.attempts, letter.Attempts)
+			assert.NotEmpty(t, letter.Error)
+			assert.Equal(t, "a1", letter.Payload.ID)
+			assert.False(t, scanner.Scan())
+		})
+	}
+}
+
+func TestWebhookFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []string
+		topics  []string
+		matches bool
+	}{
+		{name: "no filters", topics: []string{"Post"}, matches: true},
+		{name: "label", filters: []string{"Post"}, topics: []string{"Post", "Post:id=1"}, matches: true},
+		{name: "other label", filters: []string{"Tag"}, topics: []string{"Post", "Post:id=1"}},
+		{name: "attribute", filters: []string{"Tag:value=golang"}, topics: []string{"Tag", "Tag:value=golang"}, matches: true},
+		{name: "wildcard", filters: []string{"Tag:value=go*"}, topics: []string{"Tag", "Tag:value=golang"}, matches: true},
+		{name: "any of several", filters: []string{"User", "Tag"}, topics: []string{"Tag"}, matches: true},
+		{name: "wildcard mismatch", filters: []string{"Tag:value=rust*"}, topics: []string{"Tag", "Tag:value=golang"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &webhook{config: WebhookConfig{Filters: tt.filters}}
+			assert.Equal(t, tt.matches, h.matches(tt.topics))
+		})
+	}
+}
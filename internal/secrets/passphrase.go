@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	KDFArgon2id = "argon2id"
+
+	defaultKDFTime    = 3
+	defaultKDFMemory  = 64 * 1024
+	defaultKDFThreads = 4
+	kdfSaltLen        = 16
+)
+
+var (
+	ErrNoPassphrase     = errors.New("no passphrase available")
+	ErrBadKDFParameters = errors.New("bad key derivation parameters")
+)
+
+// KDFParams are the argon2id parameters used to derive a key from a
+// passphrase. They must be stored alongside whatever the key encrypts.
+type KDFParams struct {
+	Salt    []byte `json:"salt" db:"salt"`
+	Time    uint32 `json:"time" db:"time"`
+	Memory  uint32 `json:"memory" db:"memory"`
+	Threads uint8  `json:"threads" db:"threads"`
+}
+
+// PassphraseProvider supplies a passphrase, e.g. from the environment, a file
+// or the OS keychain
+type PassphraseProvider func(ctx context.Context) ([]byte, error)
+
+// NewKDFParams returns the default parameters with a random salt
+func NewKDFParams() (KDFParams, error) {
+	p := KDFParams{
+		Salt:    make([]byte, kdfSaltLen),
+		Time:    defaultKDFTime,
+		Memory:  defaultKDFMemory,
+		Threads: defaultKDFThreads,
+	}
+
+	_, err := rand.Read(p.Salt)
+	if err != nil {
+		return p, fmt.Errorf("generating salt: %w", err)
+	}
+
+	return p, nil
+}
+
+// FromPassphrase returns a Sealer using a key derived from the passphrase
+func FromPassphrase(passphrase []byte, params KDFParams) (Sealer, error) {
+	if params.Time == 0 || params.Threads == 0 || len(params.Salt) == 0 {
+		return nil, ErrBadKDFParameters
+	}
+	if len(passphrase) == 0 {
+		return nil, ErrNoPassphrase
+	}
+
+	key := argon2.IDKey(passphrase, params.Salt, params.Time, params.Memory, params.Threads, KeySize)
+	return New(key)
+}
+
+// EnvPassphrase reads the passphrase from the named environment variable
+func EnvPassphrase(name string) PassphraseProvider {
+	return func(ctx context.Context) ([]byte, error) {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil, ErrNoPassphrase
+		}
+		return []byte(v), nil
+	}
+}
+
+// FilePassphrase reads the passphrase from the first line of a file
+func FilePassphrase(path string) PassphraseProvider {
+	return func(ctx context.Context) ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase file: %w", err)
+		}
+		passphrase, _, _ := strings.Cut(string(data), "\n")
+		passphrase = strings.TrimRight(passphrase, "\r")
+		if passphrase == "" {
+			return nil, ErrNoPassphrase
+		}
+		return []byte(passphrase), nil
+	}
+}
+
+// KeychainPassphrase reads the passphrase from the OS keychain using the
+// security tool on macOS or secret-tool (libsecret) on Linux
+func KeychainPassphrase(service, account string) PassphraseProvider {
+	return func(ctx context.Context) ([]byte, error) {
+		var cmd *exec.Cmd
+		switch runtime.GOOS {
+		case "darwin":
+			cmd = exec.CommandContext(ctx, "security", "find-generic-password", "-s", service, "-a", account, "-w")
+		case "linux", "freebsd", "openbsd":
+			cmd = exec.CommandContext(ctx, "secret-tool", "lookup", "service", service, "account", account)
+		default:
+			return nil, fmt.Errorf("no keychain support on %s: %w", runtime.GOOS, ErrNoPassphrase)
+		}
+
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("reading keychain: %w", err)
+		}
+
+		passphrase := bytes.TrimRight(out, "\r\n")
+		if len(passphrase) == 0 {
+			return nil, ErrNoPassphrase
+		}
+		return passphrase, nil
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvKey is the environment variable holding the base64 encoded database key
+const EnvKey = "PROPOLIS_DB_KEY"
+
+const KeySize = 32
+
+var (
+	ErrBadKey     = errors.New("database key must be 32 bytes")
+	ErrNoKey      = errors.New("no database key available")
+	ErrDecrypting = errors.New("unable to decrypt value")
+)
+
+// sealed values are prefixed so that rows written before encryption was
+// enabled can still be read
+var sealedPrefix = []byte("pe1:")
+
+// Sealer encrypts values before they are written to a database and decrypts
+// them when they are read back
+type Sealer interface {
+	Seal(plaintext []byte) ([]byte, error)
+	Open(data []byte) ([]byte, error)
+}
+
+// KeyProvider supplies the database key, e.g. from the environment, a file or
+// a KMS
+type KeyProvider func(ctx context.Context) ([]byte, error)
+
+type aeadSealer struct {
+	aead cipher.AEAD
+}
+
+// New returns a Sealer using AES-256-GCM with the given key
+func New(key []byte) (*aeadSealer, error) {
+	if len(key) != KeySize {
+		return nil, ErrBadKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating gcm: %w", err)
+	}
+
+	return &aeadSealer{aead: aead}, nil
+}
+
+// FromProvider fetches a key from the provider and returns a Sealer for it. If
+// the provider has no key the returned Sealer stores values in plaintext.
+func FromProvider(ctx context.Context, provider KeyProvider) (Sealer, error) {
+	key, err := provider(ctx)
+	if errors.Is(err, ErrNoKey) {
+		return Plaintext(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching database key: %w", err)
+	}
+	return New(key)
+}
+
+func (s *aeadSealer) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	out := make([]byte, 0, len(sealedPrefix)+len(nonce)+len(plaintext)+s.aead.Overhead())
+	out = append(out, sealedPrefix...)
+	out = append(out, nonce...)
+	return s.aead.Seal(out, nonce, plaintext, nil), nil
+}
+
+func (s *aeadSealer) Open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, sealedPrefix) {
+		return data, nil
+	}
+
+	data = data[len(sealedPrefix):]
+	if len(data) < s.aead.NonceSize() {
+		return nil, ErrDecrypting
+	}
+
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrDecrypting
+	}
+
+	return plaintext, nil
+}
+
+type plaintextSealer struct{}
+
+// Plaintext returns a Sealer which stores values unencrypted. It refuses to
+// open encrypted values.
+func Plaintext() Sealer {
+	return plaintextSealer{}
+}
+
+func (plaintextSealer) Seal(plaintext []byte) ([]byte, error) {
+	return plaintext, nil
+}
+
+func (plaintextSealer) Open(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, sealedPrefix) {
+		return nil, fmt.Errorf("value is encrypted: %w", ErrNoKey)
+	}
+	return data, nil
+}
+
+// EnvKeyProvider reads a base64 encoded key from the named environment
+// variable
+func EnvKeyProvider(name string) KeyProvider {
+	return func(ctx context.Context) ([]byte, error) {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil, ErrNoKey
+		}
+		return decodeKey(v)
+	}
+}
+
+// FileKeyProvider reads a base64 encoded key from a file
+func FileKeyProvider(path string) KeyProvider {
+	return func(ctx context.Context) ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading key file: %w", err)
+		}
+		return decodeKey(string(data))
+	}
+}
+
+// GenerateKey returns a new random key, base64 encoded
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", fmt.Errorf("generating key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("decoding key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, ErrBadKey
+	}
+	return key, nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package secrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealer(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := GenerateKey()
+	assert.NoError(err)
+
+	t.Setenv(EnvKey, key)
+	s, err := FromProvider(context.Background(), EnvKeyProvider(EnvKey))
+	assert.NoError(err)
+
+	sealed, err := s.Seal([]byte("private key"))
+	assert.NoError(err)
+	assert.NotContains(string(sealed), "private key")
+
+	opened, err := s.Open(sealed)
+	assert.NoError(err)
+	assert.Equal("private key", string(opened))
+
+	// values written before encryption was enabled are passed through
+	opened, err = s.Open([]byte("legacy"))
+	assert.NoError(err)
+	assert.Equal("legacy", string(opened))
+
+	_, err = Plaintext().Open(sealed)
+	assert.ErrorIs(err, ErrNoKey)
+
+	other, err := GenerateKey()
+	assert.NoError(err)
+	t.Setenv(EnvKey, other)
+	s2, err := FromProvider(context.Background(), EnvKeyProvider(EnvKey))
+	assert.NoError(err)
+	_, err = s2.Open(sealed)
+	assert.ErrorIs(err, ErrDecrypting)
+}
@@ -0,0 +1,344 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+// Package simulator runs many nodes in one process connected by a simulated
+// network, so propagation, catch up and peer dropping can be tested without
+// sockets. Latency, loss and partitions are under the test's control, as are
+// duplicate and reordered deliveries through the chaos package, and the
+// random choices are made from a seed so runs are repeatable.
+package simulator
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/bloom"
+	"github.com/jdudmesh/propolis/internal/chaos"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/jdudmesh/propolis/internal/secrets"
+)
+
+// Port is the port every simulated node listens on, each node has its own IP
+const Port = 9000
+
+const (
+	defaultPingInterval = time.Second
+	listenTimeout       = 5 * time.Second
+)
+
+var (
+	ErrUnreachable = errors.New("host unreachable")
+	ErrDropped     = errors.New("dropped by simulated loss")
+	ErrNotStarted  = errors.New("node not started")
+)
+
+// Config is the initial state of a simulated network. The link settings can be
+// changed while it runs.
+type Config struct {
+	// Seed makes the random latency and loss repeatable
+	Seed int64
+	// Latency is added to each request and each response
+	Latency time.Duration
+	// Jitter is the most that is randomly added to Latency
+	Jitter time.Duration
+	// Loss is the chance a request or response is lost, from 0 to 1. Lost
+	// messages fail once their latency has passed rather than timing out.
+	Loss float64
+	// Faults, if set, are injected into the requests every node sends, on
+	// top of the latency and loss of the links. The seed is mixed with Seed
+	// and each node's address.
+	Faults *chaos.Config
+	// Logger receives every node's logs, tagged with the node's name. Logs are
+	// discarded if it is nil.
+	Logger *slog.Logger
+}
+
+// Instance is what a test can do with a simulated node
+type Instance interface {
+	Run(ctx context.Context) error
+	Close() error
+	Events() <-chan node.Event
+	AddEventHook(hook node.EventHook)
+	Subscribe(ids ...string)
+	SubscribeTopics(topics ...string)
+	PublishIdentity(ctx context.Context, id *identity.Identity) error
+	Execute(ctx context.Context, id *identity.Identity, stmt string) error
+	ExecuteIn(ctx context.Context, namespace string, id *identity.Identity, stmt string) error
+	CountOfPeers(ctx context.Context) (int, error)
+	NodeKey() string
+	VersionStatus() node.VersionStatus
+	Graph() node.Graph
+}
+
+// Node is a node in a simulated network
+type Node struct {
+	Instance
+	Name string
+	Addr string
+	Type node.NodeType
+	// Faults injects faults into the node's requests, nil unless the
+	// network's config has them
+	Faults *chaos.Transport
+
+	network *Network
+	done    chan struct{}
+	err     error
+}
+
+// Network connects simulated nodes
+type Network struct {
+	mu        sync.Mutex
+	config    Config
+	logger    *slog.Logger
+	key       []byte
+	id        string
+	nodes     []*Node
+	handlers  map[string]http.Handler
+	listening map[string]chan struct{}
+	groups    map[string]int
+	lastGroup int
+	links     map[link]*linkState
+}
+
+// New creates an empty network
+func New(config Config) (*Network, error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	// the databases are in memory and thrown away with the network
+	key := make([]byte, secrets.KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("generating database key: %w", err)
+	}
+
+	id := make([]byte, 4)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, fmt.Errorf("generating network ID: %w", err)
+	}
+
+	return &Network{
+		config:    config,
+		logger:    logger,
+		key:       key,
+		id:        fmt.Sprintf("%x", id),
+		handlers:  map[string]http.Handler{},
+		listening: map[string]chan struct{}{},
+		groups:    map[string]int{},
+		links:     map[link]*linkState{},
+	}, nil
+}
+
+// memoryDatabaseURL returns the URL of a named in memory database. The memdb
+// VFS is used rather than a shared cache so that a node's connections wait
+// for each other's locks, where with a shared cache a write made while
+// another connection holds the table fails at once.
+func memoryDatabaseURL(name string) string {
+	return fmt.Sprintf("file:/%s.db?vfs=memdb&_busy_timeout=10000", name)
+}
+
+// AddNode creates a node with in memory databases which uses the seeds already
+// in the network. configure can change the node's config before it is
+// created, by default nodes ping every second and trust a single node's word
+// for a certificate.
+func (n *Network) AddNode(name string, nodeType node.NodeType, configure ...func(*node.Config)) (*Node, error) {
+	n.mu.Lock()
+	ip := net.IPv4(10, 0, byte(len(n.nodes)/250), byte(len(n.nodes)%250+1))
+	seeds := []string{}
+	for _, other := range n.nodes {
+		if other.Type == node.NodeTypeSeed {
+			seeds = append(seeds, other.Addr)
+		}
+	}
+	n.mu.Unlock()
+
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(Port))
+	var faults *chaos.Transport
+	transport := node.Transport(n.transport(addr))
+	if n.config.Faults != nil {
+		c := n.config.Faults.ForAddr(addr)
+		c.Seed ^= n.config.Seed
+		faults = chaos.Wrap(transport, c)
+		transport = faults
+	}
+	config := node.Config{
+		Config: graph.Config{
+			Logger:           n.logger.With("node", name),
+			GraphDatabaseURL: memoryDatabaseURL(fmt.Sprintf("sim-%s-%s-graph", n.id, name)),
+		},
+		Type:              nodeType,
+		Host:              ip.String(),
+		Port:              Port,
+		NodeDatabaseURL:   memoryDatabaseURL(fmt.Sprintf("sim-%s-%s-node", n.id, name)),
+		CertificateQuorum: 1,
+		Liveness:          node.LivenessConfig{PingInterval: defaultPingInterval},
+		DatabaseKey:       func(ctx context.Context) ([]byte, error) { return n.key, nil },
+		Transports: func(string) ([]node.Transport, error) {
+			return []node.Transport{transport}, nil
+		},
+	}
+	if nodeType != node.NodeTypeSeed {
+		config.Seeds = seeds
+	}
+
+	for _, fn := range configure {
+		fn(&config)
+	}
+
+	err := config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("configuring %s: %w", name, err)
+	}
+
+	h, err := node.New(config, bloom.New())
+	if err != nil {
+		return nil, fmt.Errorf("creating %s: %w", name, err)
+	}
+
+	sim := &Node{
+		Instance: h,
+		Name:     name,
+		Addr:     addr,
+		Type:     nodeType,
+		Faults:   faults,
+		network:  n,
+	}
+
+	n.mu.Lock()
+	n.nodes = append(n.nodes, sim)
+	n.listening[addr] = make(chan struct{})
+	n.mu.Unlock()
+
+	return sim, nil
+}
+
+// Start runs the nodes in order, waiting for each to listen before starting
+// the next so that seeds are up before the nodes which join them
+func (n *Network) Start(nodes ...*Node) error {
+	for _, sim := range nodes {
+		n.mu.Lock()
+		listening := n.listening[sim.Addr]
+		n.mu.Unlock()
+
+		sim.done = make(chan struct{})
+		go func() {
+			defer close(sim.done)
+			sim.err = sim.Run(context.Background())
+		}()
+
+		select {
+		case <-listening:
+		case <-sim.done:
+			return fmt.Errorf("starting %s: %w", sim.Name, sim.err)
+		case <-time.After(listenTimeout):
+			return fmt.Errorf("starting %s: timed out waiting for it to listen", sim.Name)
+		}
+	}
+	return nil
+}
+
+// Stop closes a node and waits for it to finish, as if it had crashed. The
+// rest of the network finds it unreachable.
+func (n *Network) Stop(sim *Node) error {
+	if sim.done == nil {
+		return ErrNotStarted
+	}
+
+	err := sim.Close()
+	<-sim.done
+	return errors.Join(err, sim.err)
+}
+
+// Close stops every node which was started, most recently added first
+func (n *Network) Close() error {
+	n.mu.Lock()
+	nodes := append([]*Node{}, n.nodes...)
+	n.mu.Unlock()
+
+	errs := []error{}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		sim := nodes[i]
+		if sim.done == nil {
+			continue
+		}
+		select {
+		case <-sim.done:
+			continue
+		default:
+		}
+
+		err := n.Stop(sim)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stopping %s: %w", sim.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Partition cuts the given nodes off from the rest of the network. They can
+// still reach each other. Partitions add up, each call makes a new group.
+func (n *Network) Partition(nodes ...*Node) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.lastGroup++
+	for _, sim := range nodes {
+		n.groups[sim.Addr] = n.lastGroup
+	}
+}
+
+// Heal removes every partition
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = map[string]int{}
+}
+
+// SetLatency changes the latency and jitter of every link
+func (n *Network) SetLatency(latency, jitter time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.config.Latency = latency
+	n.config.Jitter = jitter
+}
+
+// SetLoss changes the chance of a request or response being lost on every
+// link
+func (n *Network) SetLoss(loss float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.config.Loss = loss
+}
+
+// Client returns an HTTP client which sends requests into the network from
+// addr, e.g. to fetch a cache's actions as a catching up client would
+func (n *Network) Client(addr string) *http.Client {
+	return &http.Client{Transport: n.transport(addr)}
+}
@@ -0,0 +1,1215 @@
+package simulator
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/bloom"
+	"github.com/jdudmesh/propolis/internal/chaos"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/jdudmesh/propolis/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const eventTimeout = 10 * time.Second
+
+func newIdentity(t *testing.T) *identity.Identity {
+	store, err := identity.NewStore("file:sim-identities.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	svc, err := identity.NewService(store)
+	require.NoError(t, err)
+	id, err := svc.CreateIdentity("tester", "", true)
+	require.NoError(t, err)
+	return id
+}
+
+// newNetwork starts a seed and the given number of peers, calling subscribe on
+// each peer before it starts. configure changes the peers' config.
+func newNetwork(t *testing.T, config Config, peers int, subscribe func(i int, sim *Node), configure ...func(*node.Config)) (*Network, []*Node) {
+	network, err := New(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	seed, err := network.AddNode("seed", node.NodeTypeSeed)
+	require.NoError(t, err)
+	require.NoError(t, network.Start(seed))
+
+	nodes := []*Node{}
+	for i := range peers {
+		sim, err := network.AddNode("peer"+string(rune('1'+i)), node.NodeTypePeer, append([]func(*node.Config){func(c *node.Config) {
+			c.Liveness.PingInterval = 200 * time.Millisecond
+			c.Breaker.Cooldown = 100 * time.Millisecond
+		}}, configure...)...)
+		require.NoError(t, err)
+		if subscribe != nil {
+			subscribe(i, sim)
+		}
+		require.NoError(t, network.Start(sim))
+		nodes = append(nodes, sim)
+	}
+
+	// peers only learn of the peers which joined after them when they rejoin
+	for _, sim := range nodes {
+		require.Eventually(t, func() bool {
+			count, err := sim.CountOfPeers(context.Background())
+			return err == nil && count == peers-1
+		}, eventTimeout, 50*time.Millisecond, "%s didn't find its peers", sim.Name)
+	}
+
+	return network, nodes
+}
+
+// waitFor waits for an event the match function accepts
+func waitFor(events <-chan node.Event, timeout time.Duration, match func(node.Event) bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return false
+			}
+			if match(e) {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func acceptedPost(text string) func(node.Event) bool {
+	return func(e node.Event) bool {
+		accepted, ok := e.(node.ActionAccepted)
+		return ok && accepted.Action.Action == "MERGE (:Post{text:'"+text+"'})"
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	assert := assert.New(t)
+
+	_, peers := newNetwork(t, Config{Seed: 1, Latency: time.Millisecond, Jitter: time.Millisecond}, 3, func(i int, sim *Node) {
+		if i > 0 {
+			sim.SubscribeTopics("Post")
+		}
+	})
+
+	events := []<-chan node.Event{peers[1].Events(), peers[2].Events()}
+
+	id := newIdentity(t)
+	assert.NoError(peers[0].PublishIdentity(context.Background(), id))
+	assert.NoError(peers[0].Execute(context.Background(), id, "MERGE (:Post{text:'hello'})"))
+
+	for i, ch := range events {
+		assert.True(waitFor(ch, eventTimeout, acceptedPost("hello")), "peer%d didn't accept the post", i+2)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	assert := assert.New(t)
+
+	network, peers := newNetwork(t, Config{Seed: 2}, 2, func(i int, sim *Node) {
+		if i == 1 {
+			sim.SubscribeTopics("Post")
+		}
+	})
+
+	events := peers[1].Events()
+	id := newIdentity(t)
+	assert.NoError(peers[0].PublishIdentity(context.Background(), id))
+
+	network.Partition(peers[1])
+	assert.NoError(peers[0].Execute(context.Background(), id, "MERGE (:Post{text:'lost'})"))
+	assert.False(waitFor(events, time.Second, acceptedPost("lost")))
+
+	// the cut off peer has to find the network again through the seed
+	network.Heal()
+	assert.Eventually(func() bool {
+		assert.NoError(peers[0].Execute(context.Background(), id, "MERGE (:Post{text:'found'})"))
+		return waitFor(events, time.Second, acceptedPost("found"))
+	}, eventTimeout, 100*time.Millisecond)
+}
+
+func TestPeerDropped(t *testing.T) {
+	assert := assert.New(t)
+
+	network, peers := newNetwork(t, Config{Seed: 3}, 2, nil)
+
+	events := peers[0].Events()
+	assert.NoError(network.Stop(peers[1]))
+
+	dropped := waitFor(events, eventTimeout, func(e node.Event) bool {
+		d, ok := e.(node.PeerDropped)
+		return ok && d.RemoteAddr == peers[1].Addr
+	})
+	assert.True(dropped)
+}
+
+func TestLossIsRepeatable(t *testing.T) {
+	assert := assert.New(t)
+
+	outcomes := func(seed int64) []bool {
+		network, err := New(Config{Seed: seed, Loss: 0.5})
+		assert.NoError(err)
+
+		lost := []bool{}
+		for range 64 {
+			err := network.deliver(context.Background(), "10.0.0.1:9000", "10.0.0.2:9000")
+			lost = append(lost, errors.Is(err, ErrDropped))
+		}
+		return lost
+	}
+
+	first := outcomes(42)
+	assert.Equal(first, outcomes(42))
+	assert.NotEqual(first, outcomes(43))
+	assert.Contains(first, true)
+	assert.Contains(first, false)
+}
+
+func TestUnreachable(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{})
+	assert.NoError(err)
+
+	resp, err := network.Client("10.0.0.9:9000").Get("https://10.0.0.1:9000/whoami")
+	if resp != nil {
+		resp.Body.Close()
+	}
+	assert.ErrorIs(err, ErrUnreachable)
+}
+
+func TestNamespaces(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 4})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	seed, err := network.AddNode("seed", node.NodeTypeSeed)
+	require.NoError(t, err)
+	require.NoError(t, network.Start(seed))
+
+	peers := []*Node{}
+	for _, name := range []string{"peer1", "peer2"} {
+		sim, err := network.AddNode(name, node.NodeTypePeer, func(c *node.Config) {
+			c.Liveness.PingInterval = 200 * time.Millisecond
+			c.Namespaces = map[string]node.NamespaceConfig{
+				"team": {
+					GraphDatabaseURL: memoryDatabaseURL("sim-" + network.id + "-" + name + "-team-graph"),
+					Subscriptions:    []string{"topic:Post"},
+				},
+			}
+		})
+		require.NoError(t, err)
+		require.NoError(t, network.Start(sim))
+		peers = append(peers, sim)
+	}
+	for _, sim := range peers {
+		require.Eventually(t, func() bool {
+			count, err := sim.CountOfPeers(context.Background())
+			return err == nil && count == 1
+		}, eventTimeout, 50*time.Millisecond, "%s didn't find its peer", sim.Name)
+	}
+
+	events := peers[1].Events()
+	id := newIdentity(t)
+	assert.NoError(peers[0].PublishIdentity(context.Background(), id))
+
+	// the subscription to posts is only in the namespace
+	assert.NoError(peers[0].Execute(context.Background(), id, "MERGE (:Post{text:'default'})"))
+	assert.NoError(peers[0].ExecuteIn(context.Background(), "team", id, "MERGE (:Post{text:'team'})"))
+	assert.True(waitFor(events, eventTimeout, func(e node.Event) bool {
+		accepted, ok := e.(node.ActionAccepted)
+		if ok && accepted.Action.Action == "MERGE (:Post{text:'default'})" {
+			assert.Fail("the default graph's post was sent")
+		}
+		return ok && accepted.Action.Namespace == "team" && accepted.Action.Action == "MERGE (:Post{text:'team'})"
+	}))
+}
+
+func TestDelegation(t *testing.T) {
+	assert := assert.New(t)
+
+	network, peers := newNetwork(t, Config{Seed: 5}, 2, func(i int, sim *Node) {
+		sim.SubscribeTopics("Post")
+	})
+
+	store, err := identity.NewStore("file:sim-delegation.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	svc, err := identity.NewService(store)
+	require.NoError(t, err)
+	id, err := svc.CreateIdentity("tester", "", true)
+	require.NoError(t, err)
+	for _, sim := range peers {
+		assert.NoError(sim.PublishIdentity(context.Background(), id))
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	d, err := svc.Delegate(id, publicKey, []string{"Post"}, nil, time.Hour)
+	require.NoError(t, err)
+	token, err := d.Encode()
+	require.NoError(t, err)
+
+	c, err := client.Options{
+		Transport: network.Client("10.0.0.9:9000").Transport,
+	}.Connect(context.Background(), "10.0.0.1:9000")
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	// the client publishes to either peer, which relays it to the other
+	events := make(chan node.Event, 100)
+	for _, sim := range peers {
+		sim.AddEventHook(func(e node.Event) {
+			select {
+			case events <- e:
+			default:
+			}
+		})
+	}
+
+	_, err = c.PublishDelegated(context.Background(), token, privateKey, "MERGE (:Post{text:'delegated'})")
+	assert.NoError(err)
+	assert.True(waitFor(events, eventTimeout, acceptedPost("delegated")))
+
+	// the delegate can't publish outside the delegation's labels
+	_, err = c.PublishDelegated(context.Background(), token, privateKey, "MERGE (:Person{name:'Mallory'})")
+	var statusErr *client.StatusError
+	assert.ErrorAs(err, &statusErr)
+	assert.Equal(http.StatusForbidden, statusErr.StatusCode)
+
+	// nor with a key the identity didn't delegate to
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = c.PublishDelegated(context.Background(), token, otherKey, "MERGE (:Post{text:'forged'})")
+	assert.ErrorAs(err, &statusErr)
+	assert.Equal(http.StatusUnauthorized, statusErr.StatusCode)
+}
+
+func TestReadACL(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 6})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	seed, err := network.AddNode("seed", node.NodeTypeSeed)
+	require.NoError(t, err)
+	require.NoError(t, network.Start(seed))
+
+	cache, err := network.AddNode("cache", node.NodeTypeCache, func(c *node.Config) {
+		c.ReadACL = []node.ReadRule{{Labels: []string{"Message"}, Owner: true}}
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(cache))
+
+	store, err := identity.NewStore("file:sim-acl.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	svc, err := identity.NewService(store)
+	require.NoError(t, err)
+	author, err := svc.CreateIdentity("author", "", true)
+	require.NoError(t, err)
+	other, err := svc.CreateIdentity("other", "", false)
+	require.NoError(t, err)
+	for _, id := range []*identity.Identity{author, other} {
+		assert.NoError(cache.PublishIdentity(context.Background(), id))
+	}
+	assert.NoError(cache.Execute(context.Background(), author, "MERGE (:Message{text:'dm'})"))
+	assert.NoError(cache.Execute(context.Background(), author, "MERGE (:Post{text:'hello'})"))
+
+	query := func(id *identity.Identity, stmt string) (client.Results, error) {
+		c, err := client.Options{
+			Identity:  id,
+			Transport: network.Client("10.0.0.9:9000").Transport,
+		}.Connect(context.Background(), seed.Addr)
+		require.NoError(t, err)
+		defer c.Close()
+		return c.Query(context.Background(), stmt)
+	}
+
+	for _, id := range []*identity.Identity{nil, other} {
+		res, err := query(id, "MATCH (m:Message)")
+		assert.NoError(err)
+		assert.Empty(res["m"])
+		res, err = query(id, "MATCH (p:Post)")
+		assert.NoError(err)
+		assert.Len(res["p"], 1)
+	}
+
+	res, err := query(author, "MATCH (m:Message)")
+	assert.NoError(err)
+	assert.Len(res["m"], 1)
+
+	// the cache can't check queries signed by identities it doesn't know
+	_, err = query(newIdentity(t), "MATCH (m:Message)")
+	var statusErr *client.StatusError
+	assert.ErrorAs(err, &statusErr)
+	assert.Equal(http.StatusUnauthorized, statusErr.StatusCode)
+
+	// nor does backfill hand out the statements which wrote them
+	resp, err := network.Client("10.0.0.9:9000").Get("https://" + cache.Addr + "/actions")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	backfill := node.BackfillResponse{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&backfill))
+	statements := []string{}
+	for _, a := range backfill.Actions {
+		statements = append(statements, a.Action)
+	}
+	assert.Contains(statements, "MERGE (:Post{text:'hello'})")
+	assert.NotContains(statements, "MERGE (:Message{text:'dm'})")
+}
+
+func TestConsistency(t *testing.T) {
+	assert := assert.New(t)
+
+	_, peers := newNetwork(t, Config{Seed: 9}, 2, func(i int, sim *Node) {
+		sim.SubscribeTopics("Post")
+	}, func(c *node.Config) {
+		c.Consistency.Interval = 200 * time.Millisecond
+	})
+
+	diverged := func(e node.Event) bool {
+		d, ok := e.(node.StateDiverged)
+		return ok && d.RemoteAddr == peers[1].Addr && d.Topic == "Post"
+	}
+	events := peers[0].Events()
+	accepted := peers[1].Events()
+
+	id := newIdentity(t)
+	assert.NoError(peers[0].PublishIdentity(context.Background(), id))
+	assert.NoError(peers[0].Execute(context.Background(), id, "MERGE (:Post{text:'shared'})"))
+	assert.True(waitFor(accepted, eventTimeout, acceptedPost("shared")))
+
+	// the same posts in both graphs
+	assert.False(waitFor(events, time.Second, diverged))
+
+	// a post written to one graph without publishing it
+	p, err := ast.Parse("MERGE (:Post{text:'local'})")
+	require.NoError(t, err)
+	_, err = peers[1].Graph().Execute(graph.Action{ID: "local", Identity: "local", Command: p.Command()})
+	require.NoError(t, err)
+
+	assert.True(waitFor(events, eventTimeout, diverged))
+}
+
+func TestGroups(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 10})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	seed, err := network.AddNode("seed", node.NodeTypeSeed)
+	require.NoError(t, err)
+	require.NoError(t, network.Start(seed))
+
+	members := []string{}
+	for _, name := range []string{"cache1", "cache2", "cache3"} {
+		sim, err := network.AddNode(name, node.NodeTypeCache, func(c *node.Config) {
+			if name != "cache3" {
+				c.Group = node.GroupConfig{Name: "golang", Topics: []string{"Tag:value=golang"}}
+			}
+		})
+		require.NoError(t, err)
+		require.NoError(t, network.Start(sim))
+		if name != "cache3" {
+			members = append(members, sim.Addr)
+		}
+	}
+
+	group := func() []string {
+		resp, err := network.Client("10.0.0.9:9000").Get("https://" + seed.Addr + "/groups/golang")
+		if err != nil {
+			return nil
+		}
+		defer resp.Body.Close()
+		g := model.GroupResponse{}
+		json.NewDecoder(resp.Body).Decode(&g)
+		addrs := []string{}
+		for _, m := range g.Members {
+			addrs = append(addrs, m.RemoteAddr)
+		}
+		return addrs
+	}
+	assert.Eventually(func() bool {
+		return len(group()) == len(members)
+	}, eventTimeout, 100*time.Millisecond)
+	assert.ElementsMatch(members, group())
+}
+
+func TestSeedReplication(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 11})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	// the seeds only learn about each other's peers by replication, and
+	// don't drop peers for missing pings during the test
+	replicas := []string{"10.0.0.2:9000", "10.0.0.1:9000"}
+	seeds := []*Node{}
+	for i := range replicas {
+		seed, err := network.AddNode("seed"+string(rune('1'+i)), node.NodeTypeSeed, func(c *node.Config) {
+			c.Liveness.PingInterval = time.Minute
+			c.Replication = node.ReplicationConfig{
+				Replicas: replicas[i : i+1],
+				Token:    "secret",
+				Interval: 100 * time.Millisecond,
+			}
+		})
+		require.NoError(t, err)
+		require.Equal(t, replicas[1-i], seed.Addr)
+		seeds = append(seeds, seed)
+	}
+	require.NoError(t, network.Start(seeds...))
+
+	peer, err := network.AddNode("peer", node.NodeTypePeer, func(c *node.Config) {
+		c.Seeds = []string{seeds[0].Addr}
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(peer))
+
+	countOfPeers := func(seed *Node) int {
+		count, err := seed.CountOfPeers(context.Background())
+		assert.NoError(err)
+		return count
+	}
+	assert.Eventually(func() bool { return countOfPeers(seeds[1]) == 1 }, eventTimeout, 50*time.Millisecond)
+
+	// replication needs the token
+	resp, err := network.Client("10.0.0.9:9000").Get("https://" + seeds[1].Addr + "/replication/peers")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	// the peer says goodbye to the first seed alone
+	require.NoError(t, network.Stop(peer))
+	assert.Equal(0, countOfPeers(seeds[0]))
+	assert.Eventually(func() bool { return countOfPeers(seeds[1]) == 0 }, eventTimeout, 50*time.Millisecond)
+
+	// and isn't copied back from the second seed
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(0, countOfPeers(seeds[0]))
+}
+
+func TestBandwidth(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 13})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	seed, err := network.AddNode("seed", node.NodeTypeSeed)
+	require.NoError(t, err)
+	require.NoError(t, network.Start(seed))
+
+	const rate = 1000
+	cache, err := network.AddNode("cache", node.NodeTypeCache, func(c *node.Config) {
+		c.Bandwidth = node.BandwidthConfig{MaxPeerRequests: 1, PeerBytesPerSecond: rate}
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(cache))
+
+	id := newIdentity(t)
+	assert.NoError(cache.PublishIdentity(context.Background(), id))
+	// enough posts that the backfill is well over two seconds' worth
+	for i := range 10 {
+		assert.NoError(cache.Execute(context.Background(), id, fmt.Sprintf("MERGE (:Post{text:'post %d'})", i)))
+	}
+
+	type result struct {
+		status int
+		size   int
+		took   time.Duration
+		err    error
+	}
+	backfill := func(results chan<- result) {
+		start := time.Now()
+		resp, err := network.Client("10.0.0.9:9000").Get("https://" + cache.Addr + "/actions")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		results <- result{status: resp.StatusCode, size: len(data), took: time.Since(start), err: err}
+	}
+
+	// the client gets one request at a time, so whichever of two overlapping
+	// requests comes second is turned away while the first is paced
+	results := make(chan result, 2)
+	go backfill(results)
+	time.Sleep(200 * time.Millisecond)
+	go backfill(results)
+
+	statuses := map[int]result{}
+	for range 2 {
+		r := <-results
+		require.NoError(t, r.err)
+		statuses[r.status] = r
+	}
+	require.Contains(t, statuses, http.StatusTooManyRequests)
+	require.Contains(t, statuses, http.StatusOK)
+
+	// a second's worth goes straight away, the rest is paced
+	ok := statuses[http.StatusOK]
+	require.Greater(t, ok.size, 2*rate)
+	assert.GreaterOrEqual(ok.took, time.Duration(float64(ok.size-rate)/rate*float64(time.Second))*9/10)
+}
+
+func TestControlSignatures(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 17})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	seed, err := network.AddNode("seed", node.NodeTypeSeed, func(c *node.Config) {
+		c.Liveness.PingInterval = time.Minute
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(seed))
+
+	peer, err := network.AddNode("peer", node.NodeTypePeer, func(c *node.Config) {
+		c.Seeds = []string{seed.Addr}
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(peer))
+
+	countOfPeers := func() int {
+		count, err := seed.CountOfPeers(context.Background())
+		assert.NoError(err)
+		return count
+	}
+	assert.Eventually(func() bool { return countOfPeers() == 1 }, eventTimeout, 50*time.Millisecond)
+
+	goodbye := func(from string, key ed25519.PrivateKey) int {
+		req, err := http.NewRequest("POST", "https://"+seed.Addr+"/goodbye", nil)
+		require.NoError(t, err)
+		if key != nil {
+			timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+			payload := node.ControlSigningPayload("POST", seed.Addr, "/goodbye", timestamp, nil)
+			req.Header.Set(node.HeaderNodeKey, base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+			req.Header.Set(node.HeaderTimestamp, timestamp)
+			req.Header.Set(node.HeaderSignature, base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)))
+		}
+		resp, err := network.Client(from).Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// goodbyes spoofed from the peer's address are rejected, signed or not
+	_, other, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	assert.Equal(http.StatusUnauthorized, goodbye(peer.Addr, nil))
+	assert.Equal(http.StatusUnauthorized, goodbye(peer.Addr, other))
+	assert.Equal(1, countOfPeers())
+
+	// addresses without a key bound to them can still join unsigned
+	resp, err := network.Client("10.0.0.9:9000").Post("https://"+seed.Addr+"/hello", "", strings.NewReader(bloom.New().String()))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+	assert.Equal(2, countOfPeers())
+
+	// the peer's own goodbye is signed
+	require.NoError(t, network.Stop(peer))
+	assert.Equal(1, countOfPeers())
+}
+
+func TestPeerTable(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 19})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	slow := func(c *node.Config) {
+		c.Liveness.PingInterval = time.Minute
+	}
+	seed, err := network.AddNode("seed", node.NodeTypeSeed, slow)
+	require.NoError(t, err)
+	require.NoError(t, network.Start(seed))
+
+	for i := range 2 {
+		peer, err := network.AddNode(fmt.Sprintf("peer%d", i+1), node.NodeTypePeer, slow, func(c *node.Config) {
+			c.Seeds = []string{seed.Addr}
+		})
+		require.NoError(t, err)
+		require.NoError(t, network.Start(peer))
+	}
+
+	// a seed which hands out only its own sybils
+	const sybilSeed = "10.0.0.50:9000"
+	sybils := []*model.PeerSpec{}
+	for i := range 8 {
+		sybils = append(sybils, &model.PeerSpec{
+			RemoteAddr: fmt.Sprintf("10.0.0.%d:9000", 100+i),
+			CreatedAt:  time.Now().UTC(),
+		})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /whoami", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(model.PeerSpec{NodeID: "sybil", CreatedAt: time.Now().UTC()})
+	})
+	mux.HandleFunc("POST /hello", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(model.JoinResponse{Peers: sybils})
+	})
+	require.NoError(t, network.transport(sybilSeed).Listen(mux))
+
+	victim, err := network.AddNode("victim", node.NodeTypePeer, slow, func(c *node.Config) {
+		c.Seeds = []string{seed.Addr, sybilSeed}
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(victim))
+
+	// the sybil seed's peers make up no more than half the table
+	countOfPeers := func() int {
+		count, err := victim.CountOfPeers(context.Background())
+		assert.NoError(err)
+		return count
+	}
+	assert.Eventually(func() bool { return countOfPeers() == 4 }, eventTimeout, 50*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(4, countOfPeers())
+}
+
+func TestGossipedPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 31})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	seed, err := network.AddNode("seed", node.NodeTypeSeed, func(c *node.Config) {
+		c.Liveness.PingInterval = time.Minute
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(seed))
+
+	whoami := func(addr, nodeID string) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /whoami", func(w http.ResponseWriter, req *http.Request) {
+			json.NewEncoder(w).Encode(model.PeerSpec{NodeID: nodeID, CreatedAt: time.Now().UTC()})
+		})
+		require.NoError(t, network.transport(addr).Listen(mux))
+	}
+	whoami("10.0.0.70:9000", "honest")
+	whoami("10.0.0.71:9000", "impostor")
+
+	// gossip naming a real node, one claiming to be someone else and one
+	// that isn't there
+	msg := model.GossipMessage{
+		Peers: []*model.PeerSpec{
+			{RemoteAddr: "10.0.0.70:9000", NodeID: "honest", NodeKey: "forged"},
+			{RemoteAddr: "10.0.0.71:9000", NodeID: "victim"},
+			{RemoteAddr: "10.0.0.72:9000", NodeID: "ghost"},
+		},
+	}
+	data, err := json.Marshal(msg)
+	require.NoError(t, err)
+	resp, err := network.Client("10.0.0.60:9000").Post("https://"+seed.Addr+"/gossip", node.ContentTypeJSON, bytes.NewReader(data))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// only the peer which answered as itself is added
+	countOfPeers := func() int {
+		count, err := seed.CountOfPeers(context.Background())
+		assert.NoError(err)
+		return count
+	}
+	assert.Eventually(func() bool { return countOfPeers() == 1 }, eventTimeout, 50*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(1, countOfPeers())
+}
+
+func TestJoinPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 23})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	store, err := identity.NewStore("file:sim-inviters.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	svc, err := identity.NewService(store)
+	require.NoError(t, err)
+	inviter, err := svc.CreateIdentity("inviter", "", true)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	inviterPath := filepath.Join(dir, "inviter.pem")
+	require.NoError(t, os.WriteFile(inviterPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: inviter.CertificateData}), 0o600))
+
+	slow := func(c *node.Config) {
+		c.Liveness.PingInterval = time.Minute
+	}
+	workSeed, err := network.AddNode("work-seed", node.NodeTypeSeed, slow, func(c *node.Config) {
+		c.JoinPolicy = node.JoinPolicyConfig{Require: node.JoinRequireWork, Difficulty: 8}
+	})
+	require.NoError(t, err)
+	inviteSeed, err := network.AddNode("invite-seed", node.NodeTypeSeed, slow, func(c *node.Config) {
+		c.JoinPolicy = node.JoinPolicyConfig{Require: node.JoinRequireInvitation, Inviters: []string{inviterPath}}
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(workSeed, inviteSeed))
+
+	countOfPeers := func(seed *Node) int {
+		count, err := seed.CountOfPeers(context.Background())
+		assert.NoError(err)
+		return count
+	}
+
+	// nodes do the work a seed asks for
+	worker, err := network.AddNode("worker", node.NodeTypePeer, slow, func(c *node.Config) {
+		c.Seeds = []string{workSeed.Addr}
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(worker))
+	assert.Eventually(func() bool { return countOfPeers(workSeed) == 1 }, eventTimeout, 50*time.Millisecond)
+
+	resp, err := network.Client("10.0.0.9:9000").Post("https://"+workSeed.Addr+"/hello", "", strings.NewReader(bloom.New().String()))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	assert.Equal("8", resp.Header.Get(node.HeaderJoinDifficulty))
+
+	// only invited nodes join the other seed
+	invitationPath := filepath.Join(dir, "invitation")
+	invited, err := network.AddNode("invited", node.NodeTypePeer, slow, func(c *node.Config) {
+		c.Seeds = []string{inviteSeed.Addr}
+		c.JoinPolicy.InvitationFile = invitationPath
+	})
+	require.NoError(t, err)
+	publicKey, err := base64.StdEncoding.DecodeString(invited.NodeKey())
+	require.NoError(t, err)
+	inv, err := svc.Invite(inviter, publicKey, time.Hour)
+	require.NoError(t, err)
+	token, err := inv.Encode()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(invitationPath, []byte(token), 0o600))
+	require.NoError(t, network.Start(invited))
+	assert.Eventually(func() bool { return countOfPeers(inviteSeed) == 1 }, eventTimeout, 50*time.Millisecond)
+
+	// the invitation names the invited node's key, so it is no use to others
+	uninvited, err := network.AddNode("uninvited", node.NodeTypePeer, slow, func(c *node.Config) {
+		c.Seeds = []string{inviteSeed.Addr}
+		c.JoinPolicy.InvitationFile = invitationPath
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(uninvited))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(1, countOfPeers(inviteSeed))
+}
+
+func TestProtocol(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 24})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	seed, err := network.AddNode("seed", node.NodeTypeSeed)
+	require.NoError(t, err)
+	peer, err := network.AddNode("peer", node.NodeTypePeer, func(c *node.Config) {
+		c.Seeds = []string{seed.Addr}
+	})
+	require.NoError(t, err)
+	require.NoError(t, network.Start(seed, peer))
+	assert.Eventually(func() bool {
+		count, err := seed.CountOfPeers(context.Background())
+		return err == nil && count == 1
+	}, eventTimeout, 50*time.Millisecond)
+
+	// whoami advertises the version and features
+	resp, err := network.Client("10.0.0.9:9000").Get("https://" + seed.Addr + "/whoami")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(strconv.Itoa(node.ProtocolVersion), resp.Header.Get(node.HeaderProtocol))
+	assert.Contains(strings.Split(resp.Header.Get(node.HeaderFeatures), ","), node.FeatureSignedControl)
+
+	// a hello from a version the seed no longer speaks is refused
+	req, err := http.NewRequest("POST", "https://"+seed.Addr+"/hello", strings.NewReader(bloom.New().String()))
+	require.NoError(t, err)
+	req.Header.Set(node.HeaderProtocol, "0")
+	resp, err = network.Client("10.0.0.9:9000").Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(http.StatusUpgradeRequired, resp.StatusCode)
+	assert.Equal(strconv.Itoa(node.ProtocolVersion), resp.Header.Get(node.HeaderProtocol))
+}
+
+func TestVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	network, err := New(Config{Seed: 25})
+	require.NoError(t, err)
+	t.Cleanup(func() { network.Close() })
+
+	version := func(v string) func(c *node.Config) {
+		return func(c *node.Config) {
+			c.Version = v
+			c.VersionCheck.Interval = 200 * time.Millisecond
+		}
+	}
+	seed, err := network.AddNode("seed", node.NodeTypeSeed, version("v1.5.0"))
+	require.NoError(t, err)
+	require.NoError(t, network.Start(seed))
+
+	nodes := []*Node{}
+	for i, v := range []string{"v1.5.0", "v1.5.1", "v1.4.0", "v1.1.0"} {
+		n, err := network.AddNode(fmt.Sprintf("peer-%d", i), node.NodeTypePeer, version(v), func(c *node.Config) {
+			c.Seeds = []string{seed.Addr}
+		})
+		require.NoError(t, err)
+		nodes = append(nodes, n)
+	}
+	require.NoError(t, network.Start(nodes...))
+
+	// the seed counts the versions of the nodes which joined it
+	assert.Eventually(func() bool {
+		return seed.VersionStatus().Versions["v1.1.0"] == 1
+	}, eventTimeout, 50*time.Millisecond)
+
+	// only the node more than two minor versions behind is warned
+	assert.Eventually(func() bool {
+		status := nodes[3].VersionStatus()
+		return status.Majority == "v1.5.0" && status.Outdated
+	}, eventTimeout, 50*time.Millisecond)
+	status := nodes[3].VersionStatus()
+	assert.Equal(4, status.MinorsBehind)
+	assert.Eventually(func() bool {
+		return nodes[2].VersionStatus().MinorsBehind == 1
+	}, eventTimeout, 50*time.Millisecond)
+	for _, n := range nodes[:3] {
+		assert.False(n.VersionStatus().Outdated)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	assert := assert.New(t)
+
+	_, peers := newNetwork(t, Config{Seed: 26, Faults: &chaos.Config{
+		Duplicate:    0.5,
+		Reorder:      0.5,
+		ReorderDelay: 100 * time.Millisecond,
+		Paths:        []string{"/publish"},
+	}}, 2, func(i int, sim *Node) {
+		if i == 1 {
+			sim.SubscribeTopics("Post")
+		}
+	})
+
+	events := peers[1].Events()
+	id := newIdentity(t)
+	assert.NoError(peers[0].PublishIdentity(context.Background(), id))
+
+	const posts = 20
+	for i := range posts {
+		assert.NoError(peers[0].Execute(context.Background(), id, fmt.Sprintf("MERGE (:Post{text:'post-%d'})", i)))
+	}
+
+	// duplicates are accepted once and reordered posts still arrive
+	accepted := map[string]int{}
+	count := func(e node.Event) bool {
+		if a, ok := e.(node.ActionAccepted); ok && strings.HasPrefix(a.Action.Action, "MERGE (:Post") {
+			accepted[a.Action.Action]++
+		}
+		return len(accepted) == posts
+	}
+	assert.True(waitFor(events, eventTimeout, count))
+	// late duplicates would be counted too
+	waitFor(events, time.Second, func(e node.Event) bool {
+		count(e)
+		return false
+	})
+	for action, count := range accepted {
+		assert.Equal(1, count, action)
+	}
+
+	stats := peers[0].Faults.Stats()
+	assert.Positive(stats.Duplicated)
+	assert.Positive(stats.Reordered)
+}
+
+func TestProfileUpdates(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	_, peers := newNetwork(t, Config{Seed: 10}, 3, func(i int, sim *Node) {
+		sim.SubscribeTopics(node.LabelIdentity)
+	})
+	events := []<-chan node.Event{peers[0].Events(), peers[1].Events(), peers[2].Events()}
+
+	id := newIdentity(t)
+	profile := func(handle string, after time.Duration) *identity.Identity {
+		p := *id
+		p.Handle = handle
+		updatedAt := id.CreatedAt.Add(after)
+		p.UpdatedAt = &updatedAt
+		return &p
+	}
+
+	// publish waits for the other peers to accept the statement rather than
+	// polling their graphs, which would contend with the writes
+	publish := func(from int, p *identity.Identity) {
+		stmt, err := node.IdentityStatement(p)
+		require.NoError(t, err)
+		require.NoError(t, peers[from].PublishIdentity(ctx, p))
+		for i, ch := range events {
+			if i == from {
+				continue
+			}
+			require.True(t, waitFor(ch, eventTimeout, func(e node.Event) bool {
+				accepted, ok := e.(node.ActionAccepted)
+				return ok && accepted.Action.Action == stmt
+			}), "peer%d didn't accept %s", i+1, p.Handle)
+		}
+	}
+	handles := func(handle string) bool {
+		for _, peer := range peers {
+			record, err := peer.Graph().GetNode(id.Identifier)
+			if err != nil || record.Attributes["handle"] != handle {
+				return false
+			}
+		}
+		return true
+	}
+
+	publish(0, id)
+	publish(1, profile("latest", 2*time.Minute))
+
+	// an update made earlier which reaches the network later is ignored
+	publish(2, profile("earlier", time.Minute))
+	assert.Eventually(func() bool { return handles("latest") }, eventTimeout, 50*time.Millisecond)
+
+	// only the identity can publish its profile
+	other := newIdentity(t)
+	stmt, err := node.IdentityStatement(profile("squatter", time.Hour))
+	require.NoError(t, err)
+	assert.Error(peers[0].Execute(ctx, other, stmt))
+	assert.True(handles("latest"))
+}
+
+func TestTopicRouting(t *testing.T) {
+	network, peers := newNetwork(t, Config{Seed: 27}, 1, func(i int, sim *Node) {
+		sim.SubscribeTopics("Post")
+		sim.Subscribe("ann")
+	})
+	peer := peers[0]
+
+	id := newIdentity(t)
+	require.NoError(t, peer.PublishIdentity(context.Background(), id))
+
+	// a relay could rewrite the unsigned topics and entity IDs, so the peer
+	// goes by the statement
+	publish := func(version int, stmt string, topics, entityIDs []string) int {
+		now := time.Now().UTC()
+		m := &node.ActionManifest{
+			Version:   cmp.Or(version, node.ManifestVersion),
+			ID:        id.Identifier + "." + model.NewID(),
+			Identity:  id.Identifier,
+			Statement: stmt,
+			CreatedAt: &now,
+			Topics:    topics,
+			EntityIDs: entityIDs,
+		}
+		payload, err := m.SigningPayload()
+		require.NoError(t, err)
+		signer, err := identity.NewSigner(id)
+		require.NoError(t, err)
+		signer.Add(payload)
+		m.Signature, err = signer.Sign()
+		require.NoError(t, err)
+
+		data, err := json.Marshal(m)
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, "https://"+peer.Addr+"/publish", strings.NewReader(string(data)))
+		require.NoError(t, err)
+		req.Header.Set(node.HeaderContentType, node.ContentTypeAction)
+		resp, err := network.Client("10.0.0.9:9000").Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := map[string]struct {
+		version   int
+		stmt      string
+		topics    []string
+		entityIDs []string
+		expected  int
+	}{
+		"subscribed topic":           {stmt: "MERGE (:Post{text:'one'})", expected: http.StatusAccepted},
+		"subscribed topic hidden":    {stmt: "MERGE (:Post{text:'two'})", topics: []string{"Person"}, expected: http.StatusAccepted},
+		"other topic":                {stmt: "MERGE (:Person{name:'Ann'})", expected: http.StatusMisdirectedRequest},
+		"other topic claiming ours":  {stmt: "MERGE (:Person{name:'Bob'})", topics: []string{"Post"}, expected: http.StatusMisdirectedRequest},
+		"subscribed entity":          {stmt: "MERGE (:Person{id:'ann'})", expected: http.StatusAccepted},
+		"claiming subscribed entity": {stmt: "MERGE (:Person{name:'Cy'})", entityIDs: []string{"ann"}, expected: http.StatusMisdirectedRequest},
+		// the TTL isn't signed before canonical manifests
+		"canonical manifest": {version: node.ManifestVersionCanonical, stmt: "MERGE (:Post{text:'three'})", expected: http.StatusAccepted},
+		"old manifest":       {version: node.ManifestVersionTimestamped, stmt: "MERGE (:Post{text:'four'})", expected: http.StatusBadRequest},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, publish(tt.version, tt.stmt, tt.topics, tt.entityIDs))
+		})
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	network, peers := newNetwork(t, Config{Seed: 28}, 1, func(i int, sim *Node) {
+		sim.SubscribeTopics("Post")
+	})
+
+	// a node which can't reach anyone when it starts
+	offline, err := network.AddNode("offline", node.NodeTypePeer, func(c *node.Config) {
+		c.Liveness.PingInterval = 200 * time.Millisecond
+		c.Liveness.JoinBackoff = 50 * time.Millisecond
+		c.Liveness.MaxJoinBackoff = 200 * time.Millisecond
+		c.Breaker.Cooldown = 100 * time.Millisecond
+	})
+	require.NoError(t, err)
+	network.Partition(offline)
+	require.NoError(t, network.Start(offline))
+
+	id := newIdentity(t)
+	require.NoError(t, peers[0].PublishIdentity(ctx, id))
+	require.NoError(t, offline.PublishIdentity(ctx, id))
+
+	events := make(chan node.Event, 100)
+	peers[0].AddEventHook(func(e node.Event) {
+		select {
+		case events <- e:
+		default:
+		}
+	})
+
+	// the action is kept until the node finds a peer
+	assert.NoError(offline.Execute(ctx, id, "MERGE (:Post{text:'offline'})"))
+	assert.False(waitFor(events, 200*time.Millisecond, acceptedPost("offline")))
+
+	network.Heal()
+	assert.True(waitFor(events, eventTimeout, acceptedPost("offline")))
+}
+
+func TestLocalExecution(t *testing.T) {
+	ctx := context.Background()
+
+	_, peers := newNetwork(t, Config{Seed: 29}, 2, func(i int, sim *Node) {
+		sim.SubscribeTopics("Post")
+	}, func(c *node.Config) {
+		c.Moderation.DenyPatterns = []string{"spam"}
+		c.Limits.MaxLength = 1024
+	})
+
+	id := newIdentity(t)
+	for _, sim := range peers {
+		require.NoError(t, sim.PublishIdentity(ctx, id))
+	}
+
+	events := make(chan node.Event, 100)
+	peers[1].AddEventHook(func(e node.Event) {
+		select {
+		case events <- e:
+		default:
+		}
+	})
+
+	// the action is in the local graph by the time Execute returns
+	require.NoError(t, peers[0].Execute(ctx, id, "MERGE (:Post{id:'local', text:'hello'})"))
+	record, err := peers[0].Graph().GetNode("local")
+	require.NoError(t, err)
+	require.NotNil(t, record)
+
+	// what the node's own checks refuse is neither applied nor sent
+	tests := map[string]struct {
+		stmt     string
+		expected error
+	}{
+		"moderated": {stmt: "MERGE (:Post{id:'spam', text:'spam'})", expected: model.ErrNotAcceptable},
+		"too long":  {stmt: "MERGE (:Post{id:'long', text:'" + strings.Repeat("x", 1024) + "'})", expected: node.ErrStatementLimit},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.ErrorIs(t, peers[0].Execute(ctx, id, tt.stmt), tt.expected)
+		})
+	}
+
+	_, err = peers[0].Graph().GetNode("spam")
+	assert.ErrorIs(t, err, graph.ErrNotFound)
+
+	// the accepted post still reaches the other peer, and the refused ones
+	// don't
+	assert.True(t, waitFor(events, eventTimeout, func(e node.Event) bool {
+		accepted, ok := e.(node.ActionAccepted)
+		if !ok || !strings.HasPrefix(accepted.Action.Action, "MERGE (:Post") {
+			return false
+		}
+		if accepted.Action.Action != "MERGE (:Post{id:'local', text:'hello'})" {
+			assert.Fail(t, "a refused action was sent", accepted.Action.Action)
+		}
+		return true
+	}))
+}
+
+func TestJoinBackoff(t *testing.T) {
+	network, peers := newNetwork(t, Config{Seed: 30}, 1, nil)
+
+	// a node started while it can't reach its seed keeps trying
+	late, err := network.AddNode("late", node.NodeTypePeer, func(c *node.Config) {
+		c.Liveness.PingInterval = time.Minute
+		c.Liveness.JoinBackoff = 50 * time.Millisecond
+		c.Liveness.MaxJoinBackoff = 200 * time.Millisecond
+		c.Breaker.Cooldown = 100 * time.Millisecond
+	})
+	require.NoError(t, err)
+	network.Partition(late)
+	require.NoError(t, network.Start(late))
+
+	countOfPeers := func(sim *Node) int {
+		count, err := sim.CountOfPeers(context.Background())
+		assert.NoError(t, err)
+		return count
+	}
+
+	// well past the first few attempts
+	time.Sleep(500 * time.Millisecond)
+	assert.Zero(t, countOfPeers(late))
+
+	// the ping interval is too long to be what finds the other peer
+	network.Heal()
+	assert.Eventually(t, func() bool { return countOfPeers(late) == 1 }, 2*time.Second, 50*time.Millisecond)
+	assert.Eventually(t, func() bool { return countOfPeers(peers[0]) == 1 }, 2*time.Second, 50*time.Millisecond)
+}
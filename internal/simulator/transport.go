@@ -0,0 +1,172 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// TransportSimulated is the name of the simulated transport
+const TransportSimulated = "sim"
+
+// link is one direction between two addresses
+type link struct {
+	from string
+	to   string
+}
+
+// linkState holds a link's own random source. Giving each link its own source
+// keeps the choices on one link from depending on the traffic on the others.
+type linkState struct {
+	rng *rand.Rand
+}
+
+// transport delivers requests from a node to the handler of the node they are
+// addressed to
+type transport struct {
+	network *Network
+	addr    string
+}
+
+func (n *Network) transport(addr string) *transport {
+	return &transport{network: n, addr: addr}
+}
+
+func (t *transport) Name() string {
+	return TransportSimulated
+}
+
+func (t *transport) Listen(handler http.Handler) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if _, ok := t.network.handlers[t.addr]; ok {
+		return fmt.Errorf("%s: address in use", t.addr)
+	}
+	t.network.handlers[t.addr] = handler
+
+	if listening, ok := t.network.listening[t.addr]; ok {
+		close(listening)
+		delete(t.network.listening, t.addr)
+	}
+	return nil
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	to := req.URL.Host
+
+	var body []byte
+	if req.Body != nil {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %w", err)
+		}
+		body = data
+	}
+
+	err := t.network.deliver(ctx, t.addr, to)
+	if err != nil {
+		return nil, err
+	}
+
+	t.network.mu.Lock()
+	handler := t.network.handlers[to]
+	t.network.mu.Unlock()
+	if handler == nil {
+		return nil, fmt.Errorf("%s: %w", to, ErrUnreachable)
+	}
+
+	// the receiving node sees the request as a server would
+	r := req.Clone(ctx)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.RemoteAddr = t.addr
+	r.Host = to
+	r.RequestURI = req.URL.RequestURI()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	err = t.network.deliver(ctx, to, t.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+func (t *transport) CloseIdleConnections() {}
+
+// Close stops the node receiving requests
+func (t *transport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	delete(t.network.handlers, t.addr)
+	return nil
+}
+
+// deliver decides the fate of one message on a link, waiting out its latency
+func (n *Network) deliver(ctx context.Context, from, to string) error {
+	n.mu.Lock()
+	if n.groups[from] != n.groups[to] {
+		n.mu.Unlock()
+		return fmt.Errorf("%s: %w", to, ErrUnreachable)
+	}
+
+	l := link{from: from, to: to}
+	state, ok := n.links[l]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(from + ">" + to))
+		state = &linkState{rng: rand.New(rand.NewSource(n.config.Seed ^ int64(h.Sum64())))}
+		n.links[l] = state
+	}
+
+	delay := n.config.Latency
+	if n.config.Jitter > 0 {
+		delay += time.Duration(state.rng.Int63n(int64(n.config.Jitter) + 1))
+	}
+	lost := n.config.Loss > 0 && state.rng.Float64() < n.config.Loss
+	n.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if lost {
+		return fmt.Errorf("%s: %w", to, ErrDropped)
+	}
+	return nil
+}
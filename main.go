@@ -21,13 +21,14 @@ import (
 	"os"
 
 	"github.com/jdudmesh/propolis/cmd"
+	"github.com/jdudmesh/propolis/internal/logging"
 )
 
 func main() {
-	opts := &slog.HandlerOptions{
-		Level: slog.LevelDebug,
-	}
-	logger := slog.New(slog.NewTextHandler(os.Stdout, opts))
+	// the levels and format can be changed by the config, the levels
+	// including on reload
+	handler, _ := logging.NewHandler(os.Stdout, logging.FormatText)
+	loggers := logging.New(handler, slog.LevelDebug)
 
-	cmd.Execute(logger)
+	cmd.Execute(loggers)
 }
@@ -0,0 +1,770 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package client lets applications publish to and query a propolis network
+// without running a node. The client finds peers and caches through the
+// network's seeds, publishes signed statements to peers and queries caches.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/ast"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	defaultRetries      = 3
+	defaultBackoff      = 250 * time.Millisecond
+	defaultPollInterval = 5 * time.Second
+	defaultTimeout      = 10 * time.Second
+
+	// maxSeen is how many action IDs a subscription remembers so that it
+	// doesn't deliver an action twice after switching cache
+	maxSeen = 4096
+	// groupOverlap is how far back a subscription polling a group's members
+	// in turn asks for actions, covering the difference in when each
+	// member received an action and in their clocks
+	groupOverlap = time.Minute
+)
+
+var (
+	ErrNoNodes     = errors.New("no nodes available")
+	ErrNoStatement = errors.New("no statement")
+)
+
+// Identity signs the statements a client publishes. Identities are created
+// and exported with the propolis identity command and loaded with
+// ImportIdentity.
+type Identity = identity.Identity
+
+// ImportIdentity decrypts an identity exported with the propolis identity
+// export command
+func ImportIdentity(data, passphrase []byte) (*Identity, error) {
+	return identity.Import(data, passphrase)
+}
+
+// StatusError is returned when a node answers a request with an error
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("request failed: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("request failed: %d: %s", e.StatusCode, e.Message)
+}
+
+// retryable reports whether another node might succeed where this one
+// failed. Other client errors are down to the request itself.
+func (e *StatusError) retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Options configure a client. Zero values use the defaults.
+type Options struct {
+	// Retries is how many more attempts are made, on other nodes where there
+	// are any, after a request fails
+	Retries int
+	// Backoff is the wait before the first retry, doubling for each one
+	// after that
+	Backoff time.Duration
+	// Timeout limits each request
+	Timeout time.Duration
+	// PollInterval is how often subscriptions check for new actions
+	PollInterval time.Duration
+	// Namespace is the graph published to, queried and subscribed to, the
+	// default graph if empty
+	Namespace string
+	// Group, if set, is a sharing group whose members take turns answering
+	// subscription polls, rather than each subscription sticking to a cache
+	Group string
+	// Identity, if set, signs queries so that nodes with read ACLs return
+	// what the identity can read
+	Identity *Identity
+	// Transport replaces the HTTP/3 transport
+	Transport http.RoundTripper
+	Logger    *slog.Logger
+}
+
+func (o Options) withDefaults() Options {
+	if o.Retries <= 0 {
+		o.Retries = defaultRetries
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = defaultBackoff
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultTimeout
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaultPollInterval
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	return o
+}
+
+// Client publishes to and queries the nodes it was given by the seeds
+type Client struct {
+	opts   Options
+	http   *http.Client
+	closer io.Closer
+
+	mu      sync.Mutex
+	peers   []string
+	caches  []string
+	members []string
+}
+
+// Connect asks the seeds, given as host:port, for nodes to use with the
+// default options
+func Connect(ctx context.Context, seeds ...string) (*Client, error) {
+	return Options{}.Connect(ctx, seeds...)
+}
+
+// Connect asks the seeds, given as host:port, for nodes to use
+func (o Options) Connect(ctx context.Context, seeds ...string) (*Client, error) {
+	o = o.withDefaults()
+
+	c := &Client{opts: o}
+	rt := o.Transport
+	if rt == nil {
+		h3 := &http3.RoundTripper{
+			// nodes use self signed certificates, statements are signed
+			// by their identities instead
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		c.closer = h3
+		rt = h3
+	}
+	c.http = &http.Client{Transport: rt}
+
+	err := c.Refresh(ctx, seeds...)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Refresh replaces the client's nodes with those the seeds know about
+func (c *Client) Refresh(ctx context.Context, seeds ...string) error {
+	if len(seeds) == 0 {
+		return fmt.Errorf("no seeds: %w", ErrNoNodes)
+	}
+
+	peers, caches := []string{}, []string{}
+	seen := map[string]bool{}
+	errs := []error{}
+	for _, seed := range seeds {
+		data, err := c.request(ctx, seed, http.MethodGet, "/nodes", nil, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", seed, err))
+			continue
+		}
+
+		resp := model.JoinResponse{}
+		err = json.Unmarshal(data, &resp)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: decoding nodes: %w", seed, err))
+			continue
+		}
+
+		for _, p := range resp.Peers {
+			addrs := p.DialAddresses()
+			if len(addrs) == 0 || seen[addrs[0]] {
+				continue
+			}
+			seen[addrs[0]] = true
+			if p.NodeType == node.NodeTypeCache.String() {
+				caches = append(caches, addrs[0])
+			} else {
+				peers = append(peers, addrs[0])
+			}
+		}
+	}
+
+	members := []string{}
+	if c.opts.Group != "" {
+		members, errs = c.groupMembers(ctx, seeds, errs)
+	}
+
+	if len(peers) == 0 && len(caches) == 0 && len(members) == 0 {
+		errs = append(errs, ErrNoNodes)
+		return fmt.Errorf("finding nodes: %w", errors.Join(errs...))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers, c.caches, c.members = peers, caches, members
+	return nil
+}
+
+// groupMembers asks the seeds for the members of the client's group, adding
+// any failures to errs
+func (c *Client) groupMembers(ctx context.Context, seeds []string, errs []error) ([]string, []error) {
+	members := []string{}
+	seen := map[string]bool{}
+	for _, seed := range seeds {
+		data, err := c.request(ctx, seed, http.MethodGet, "/groups/"+url.PathEscape(c.opts.Group), nil, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", seed, err))
+			continue
+		}
+
+		resp := model.GroupResponse{}
+		err = json.Unmarshal(data, &resp)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: decoding group: %w", seed, err))
+			continue
+		}
+
+		for _, m := range resp.Members {
+			addrs := m.DialAddresses()
+			if len(addrs) == 0 || seen[addrs[0]] {
+				continue
+			}
+			seen[addrs[0]] = true
+			members = append(members, addrs[0])
+		}
+	}
+	return members, errs
+}
+
+// Close releases the client's connections
+func (c *Client) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// publishNodes returns every node in a random order. Caches accept actions
+// too so they are tried after the peers.
+func (c *Client) publishNodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append(shuffled(c.peers), shuffled(c.caches)...)
+}
+
+func (c *Client) queryNodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return shuffled(c.caches)
+}
+
+// subscribeNodes returns the caches a subscription polls and whether they are
+// the members of the client's group, which take turns
+func (c *Client) subscribeNodes() ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.members) > 0 {
+		return shuffled(c.members), true
+	}
+	return shuffled(c.caches), false
+}
+
+// rotated returns the addresses starting from the i'th, wrapping around, so
+// the rest are tried in turn if it fails
+func rotated(addrs []string, i int) []string {
+	i %= len(addrs)
+	return append(slices.Clone(addrs[i:]), addrs[:i]...)
+}
+
+func shuffled(addrs []string) []string {
+	s := append([]string{}, addrs...)
+	rand.Shuffle(len(s), func(i, j int) {
+		s[i], s[j] = s[j], s[i]
+	})
+	return s
+}
+
+// Publish signs the statement as the identity and sends it to a peer,
+// returning the action's ID. Retrying a publish is safe as nodes ignore
+// actions they have already seen.
+func (c *Client) Publish(ctx context.Context, id *Identity, stmt string) (string, error) {
+	signer, err := identity.NewSigner(id)
+	if err != nil {
+		return "", fmt.Errorf("creating signer: %w", err)
+	}
+
+	return c.publish(ctx, id.Identifier, "", signer, stmt)
+}
+
+// PublishDelegated signs the statement with a key the identity delegated to,
+// e.g. with propolis identity delegate, and sends it to a peer. Nodes reject
+// it unless it only touches the labels and entities in the delegation.
+func (c *Client) PublishDelegated(ctx context.Context, token string, key ed25519.PrivateKey, stmt string) (string, error) {
+	d, err := identity.ParseDelegation(token)
+	if err != nil {
+		return "", fmt.Errorf("parsing delegation: %w", err)
+	}
+
+	return c.publish(ctx, d.Identifier, token, identity.NewDelegateSigner(key), stmt)
+}
+
+func (c *Client) publish(ctx context.Context, identifier, delegation string, signer identity.Signer, stmt string) (string, error) {
+	parser, err := ast.Parse(stmt)
+	if err != nil {
+		return "", fmt.Errorf("parsing statement: %w", err)
+	}
+	if parser.Command() == nil {
+		return "", ErrNoStatement
+	}
+
+	now := time.Now().UTC()
+	manifest := &node.ActionManifest{
+		Version:    node.ManifestVersion,
+		ID:         identifier + "." + model.NewID(),
+		Identity:   identifier,
+		Namespace:  c.opts.Namespace,
+		Statement:  stmt,
+		Delegation: delegation,
+		CreatedAt:  &now,
+	}
+
+	signed, err := manifest.SigningPayload()
+	if err != nil {
+		return "", fmt.Errorf("signing statement: %w", err)
+	}
+	signer.Add(signed)
+	manifest.Signature, err = signer.Sign()
+	if err != nil {
+		return "", fmt.Errorf("signing statement: %w", err)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", fmt.Errorf("marshalling manifest: %w", err)
+	}
+
+	header := http.Header{node.HeaderContentType: {node.ContentTypeAction}}
+	_, err = c.do(ctx, c.publishNodes(), http.MethodPost, "/publish", header, data)
+	if err != nil {
+		return "", fmt.Errorf("publishing: %w", err)
+	}
+
+	return manifest.ID, nil
+}
+
+// Entity is a node or relation matched by a query, with its labels and
+// attributes. Number attributes are float64s, everything else strings.
+// Relations have their left and right node IDs set.
+type Entity struct {
+	ID           string         `json:"ID"`
+	CreatedAt    time.Time      `json:"CreatedAt"`
+	UpdatedAt    *time.Time     `json:"UpdatedAt"`
+	OwnerID      string         `json:"OwnerID"`
+	LastActionID string         `json:"LastActionID"`
+	LeftNodeID   string         `json:"LeftNodeID"`
+	RightNodeID  string         `json:"RightNodeID"`
+	Labels       []string       `json:"Labels"`
+	Attributes   map[string]any `json:"Attributes"`
+	Relations    []*Entity      `json:"Relations"`
+}
+
+// IsRelation reports whether the entity is a relation rather than a node
+func (e *Entity) IsRelation() bool {
+	return e.LeftNodeID != "" || e.RightNodeID != ""
+}
+
+// Results maps the identifiers in a MATCH statement to the entities bound to
+// them
+type Results map[string][]*Entity
+
+// RelationDir is the direction of a relation in a path
+type RelationDir = ast.RelationDir
+
+const (
+	// RelationDirNeutral is an undirected relation
+	RelationDirNeutral = ast.RelationDirNeutral
+	// RelationDirLeft points from the node after the relation in the path
+	// back to the one before it
+	RelationDirLeft = ast.RelationDirLeft
+	// RelationDirRight points from the node before the relation in the path
+	// to the one after it
+	RelationDirRight = ast.RelationDirRight
+)
+
+// Path is one match of a MATCH statement: its nodes in the order the
+// statement lists them and the relations between consecutive nodes
+type Path struct {
+	Nodes     []*Entity       `json:"nodes"`
+	Relations []*PathRelation `json:"relations"`
+}
+
+// PathRelation is a relation in a path, with its direction along the path
+type PathRelation struct {
+	Relation  *Entity     `json:"relation"`
+	Direction RelationDir `json:"direction"`
+}
+
+// namespaceQuery returns the namespace parameter to add to a path after sep,
+// nothing for the default graph
+func (c *Client) namespaceQuery(sep string) string {
+	if c.opts.Namespace == "" {
+		return ""
+	}
+	return sep + "namespace=" + url.QueryEscape(c.opts.Namespace)
+}
+
+// queryHeader signs a query as the client's identity, if it has one
+func (c *Client) queryHeader(stmt string) (http.Header, error) {
+	if c.opts.Identity == nil {
+		return nil, nil
+	}
+
+	signer, err := identity.NewSigner(c.opts.Identity)
+	if err != nil {
+		return nil, fmt.Errorf("creating signer: %w", err)
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	signer.Add(node.QuerySigningPayload(c.opts.Namespace, timestamp, stmt))
+	signature, err := signer.Sign()
+	if err != nil {
+		return nil, fmt.Errorf("signing query: %w", err)
+	}
+
+	return http.Header{
+		node.HeaderIdentifier: {c.opts.Identity.Identifier},
+		node.HeaderTimestamp:  {timestamp},
+		node.HeaderSignature:  {signature},
+	}, nil
+}
+
+// Query runs a MATCH statement on a cache
+func (c *Client) Query(ctx context.Context, stmt string) (Results, error) {
+	header, err := c.queryHeader(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.do(ctx, c.queryNodes(), http.MethodPost, "/query"+c.namespaceQuery("?"), header, []byte(stmt))
+	if err != nil {
+		return nil, fmt.Errorf("querying: %w", err)
+	}
+
+	res := Results{}
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, fmt.Errorf("decoding results: %w", err)
+	}
+	return res, nil
+}
+
+// QueryPaths runs a MATCH statement on a cache, returning the path of each
+// match
+func (c *Client) QueryPaths(ctx context.Context, stmt string) ([]*Path, error) {
+	header, err := c.queryHeader(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/query?" + node.ResultsParam + "=" + node.ResultsPaths + c.namespaceQuery("&")
+	data, err := c.do(ctx, c.queryNodes(), http.MethodPost, path, header, []byte(stmt))
+	if err != nil {
+		return nil, fmt.Errorf("querying: %w", err)
+	}
+
+	res := []*Path{}
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, fmt.Errorf("decoding results: %w", err)
+	}
+	return res, nil
+}
+
+// QueryView reads the rows of a view registered on a cache
+func (c *Client) QueryView(ctx context.Context, name string) (Results, error) {
+	header, err := c.queryHeader(node.ViewSigningPayload(name))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.do(ctx, c.queryNodes(), http.MethodGet, "/views/"+url.PathEscape(name)+c.namespaceQuery("?"), header, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading view: %w", err)
+	}
+
+	res := Results{}
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, fmt.Errorf("decoding results: %w", err)
+	}
+	return res, nil
+}
+
+// Visualize renders the results of a MATCH statement on a cache as Graphviz
+// DOT or D3 JSON, depending on the format
+func (c *Client) Visualize(ctx context.Context, stmt, format string) ([]byte, error) {
+	header, err := c.queryHeader(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/visualize?format=" + url.QueryEscape(format) + c.namespaceQuery("&")
+	data, err := c.do(ctx, c.queryNodes(), http.MethodPost, path, header, []byte(stmt))
+	if err != nil {
+		return nil, fmt.Errorf("visualizing: %w", err)
+	}
+	return data, nil
+}
+
+// Action is a published statement delivered to a subscription
+type Action struct {
+	ID        string
+	Identity  string
+	Statement string
+	// Topics are the labels and Label:key=value pairs of the statement's
+	// entities
+	Topics []string
+	// CreatedAt is when the action was signed, if its author's node
+	// recorded it
+	CreatedAt *time.Time
+	// ReceivedAt is when the cache received the action
+	ReceivedAt time.Time
+}
+
+// Subscribe calls handler with each new public action with a topic matching
+// one of the patterns until the context is done. Patterns are topics such as
+// Tag or Tag:value=golang and can use path.Match wildcards, no patterns
+// matches everything. Actions are polled from a cache and delivered in the
+// order it received them. With a group, each poll goes to the next member and
+// actions are delivered in the order that member received them.
+func (c *Client) Subscribe(ctx context.Context, patterns []string, handler func(Action)) error {
+	for _, p := range patterns {
+		_, err := path.Match(p, "")
+		if err != nil {
+			return fmt.Errorf("pattern %q: %w", p, err)
+		}
+	}
+
+	// sticking to the same caches keeps the receive times in step, group
+	// members each received actions at slightly different times so polls
+	// of them go back far enough to cover the difference
+	caches, group := c.subscribeNodes()
+	start := time.Now().UTC()
+	since, after := start, ""
+	seen := map[string]struct{}{}
+	seenOrder := []string{}
+
+	ticker := time.NewTicker(c.opts.PollInterval)
+	defer ticker.Stop()
+
+	for poll := 0; ; poll++ {
+		nodes, from, fromAfter := caches, since, after
+		if group && len(caches) > 0 {
+			nodes, from, fromAfter = rotated(caches, poll), since.Add(-groupOverlap), ""
+			if from.Before(start) {
+				from = start
+			}
+		}
+
+		more := true
+		for more {
+			q := url.Values{"since": {from.Format(time.RFC3339Nano)}}
+			if fromAfter != "" {
+				q.Set("after", fromAfter)
+			}
+			data, err := c.do(ctx, nodes, http.MethodGet, "/actions?"+q.Encode(), nil, nil)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				c.opts.Logger.Warn("polling actions", "error", err)
+				break
+			}
+
+			resp := node.BackfillResponse{}
+			err = json.Unmarshal(data, &resp)
+			if err != nil {
+				c.opts.Logger.Warn("decoding actions", "error", err)
+				break
+			}
+
+			for _, a := range resp.Actions {
+				if a.Timestamp.After(since) {
+					since = a.Timestamp
+				}
+				if a.Timestamp.After(from) {
+					from = a.Timestamp
+				}
+				if _, ok := seen[a.ID]; ok {
+					continue
+				}
+				seen[a.ID] = struct{}{}
+				seenOrder = append(seenOrder, a.ID)
+				if len(seenOrder) > maxSeen {
+					delete(seen, seenOrder[0])
+					seenOrder = seenOrder[1:]
+				}
+
+				if a.Namespace != c.opts.Namespace {
+					continue
+				}
+				action, ok := matchAction(a, patterns)
+				if ok {
+					handler(action)
+				}
+			}
+			// caches page on the timestamp and ID of the last action they
+			// read, older ones on the timestamp of the last one served
+			if resp.Since != nil {
+				from, fromAfter = *resp.Since, resp.After
+				if !group {
+					since, after = from, fromAfter
+				}
+			}
+			more = resp.More && (resp.Since != nil || len(resp.Actions) > 0)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// matchAction returns the action if it is public and one of its topics
+// matches a pattern
+func matchAction(a *node.BackfillAction, patterns []string) (Action, bool) {
+	if a.KeyID != "" {
+		return Action{}, false
+	}
+
+	parser, err := ast.Parse(a.Action)
+	if err != nil || parser.Command() == nil {
+		return Action{}, false
+	}
+
+	action := Action{
+		ID:         a.ID,
+		Identity:   a.Identity,
+		Statement:  a.Action,
+		Topics:     ast.Topics(parser.Command()),
+		CreatedAt:  a.CreatedAt,
+		ReceivedAt: a.Timestamp,
+	}
+	if len(patterns) == 0 {
+		return action, true
+	}
+
+	for _, p := range patterns {
+		for _, t := range action.Topics {
+			if ok, _ := path.Match(p, t); ok {
+				return action, true
+			}
+		}
+	}
+	return Action{}, false
+}
+
+// do sends the request to each node in turn until one succeeds, backing off
+// between attempts. Requests the node rejected aren't retried.
+func (c *Client) do(ctx context.Context, nodes []string, method, path string, header http.Header, body []byte) ([]byte, error) {
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	backoff := c.opts.Backoff
+	errs := []error{}
+	for attempt := range c.opts.Retries + 1 {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, errors.Join(append(errs, ctx.Err())...)
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		addr := nodes[attempt%len(nodes)]
+		data, err := c.request(ctx, addr, method, path, header, body)
+		if err == nil {
+			return data, nil
+		}
+
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && !statusErr.retryable() {
+			return nil, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// request sends one request and returns the response body. Publishing an
+// action the node has already seen counts as success.
+func (c *Client) request(ctx context.Context, addr, method, path string, header http.Header, body []byte) ([]byte, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancelFn()
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("https://%s%s", addr, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, node.MaxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusFound {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Message: string(data)}
+	}
+	return data, nil
+}
@@ -0,0 +1,316 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/model"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/stretchr/testify/assert"
+)
+
+// testNetwork serves a seed and a cache from one TLS server
+type testNetwork struct {
+	srv       *httptest.Server
+	published chan *node.ActionManifest
+	failures  atomic.Int32
+	polls     atomic.Int32
+	// members are listed as the members of every group
+	members []string
+
+	mu      sync.Mutex
+	actions []*node.BackfillAction
+}
+
+func newTestNetwork(t *testing.T) *testNetwork {
+	n := &testNetwork{published: make(chan *node.ActionManifest, 1)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /nodes", func(w http.ResponseWriter, req *http.Request) {
+		addr := n.srv.Listener.Addr().String()
+		json.NewEncoder(w).Encode(model.JoinResponse{
+			Peers: []*model.PeerSpec{
+				{RemoteAddr: addr, NodeType: node.NodeTypeCache.String()},
+			},
+		})
+	})
+	mux.HandleFunc("POST /publish", func(w http.ResponseWriter, req *http.Request) {
+		if n.failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		m := &node.ActionManifest{}
+		json.NewDecoder(req.Body).Decode(m)
+		n.published <- m
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("POST /query", func(w http.ResponseWriter, req *http.Request) {
+		stmt, _ := io.ReadAll(req.Body)
+		if !strings.HasPrefix(string(stmt), "MATCH") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.URL.Query().Get(node.ResultsParam) == node.ResultsPaths {
+			w.Write([]byte(`[{"nodes":[{"ID":"node2"},{"ID":"node1","OwnerID":"owner"}],"relations":[{"relation":{"ID":"rel1","LeftNodeID":"node1","RightNodeID":"node2"},"direction":1}]}]`))
+			return
+		}
+		w.Write([]byte(`{"p":[{"ID":"node1","OwnerID":"owner"}],"r":[{"ID":"rel1","LeftNodeID":"node1","RightNodeID":"node2"}]}`))
+	})
+	mux.HandleFunc("GET /groups/{name}", func(w http.ResponseWriter, req *http.Request) {
+		resp := model.GroupResponse{Name: req.PathValue("name")}
+		for _, m := range n.members {
+			resp.Members = append(resp.Members, &model.PeerSpec{RemoteAddr: m, NodeType: node.NodeTypeCache.String(), Group: resp.Name})
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("GET /actions", func(w http.ResponseWriter, req *http.Request) {
+		n.polls.Add(1)
+		since, _ := time.Parse(time.RFC3339Nano, req.URL.Query().Get("since"))
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		resp := node.BackfillResponse{Actions: []*node.BackfillAction{}}
+		for _, a := range n.actions {
+			if a.Timestamp.After(since) {
+				resp.Actions = append(resp.Actions, a)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	n.srv = httptest.NewTLSServer(mux)
+	t.Cleanup(n.srv.Close)
+	return n
+}
+
+func (n *testNetwork) add(id, stmt, keyID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.actions = append(n.actions, &node.BackfillAction{
+		ID:        id,
+		Timestamp: time.Now().UTC(),
+		Action:    stmt,
+		KeyID:     keyID,
+	})
+}
+
+func (n *testNetwork) connect(t *testing.T) *Client {
+	c, err := Options{
+		Backoff:      time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+		Transport:    n.srv.Client().Transport,
+	}.Connect(context.Background(), n.srv.Listener.Addr().String())
+	assert.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestPublish(t *testing.T) {
+	assert := assert.New(t)
+
+	network := newTestNetwork(t)
+	c := network.connect(t)
+
+	store, err := identity.NewStore("file:client.db?mode=memory&cache=shared")
+	assert.NoError(err)
+	svc, err := identity.NewService(store)
+	assert.NoError(err)
+	created, err := svc.CreateIdentity("test user", "", true)
+	assert.NoError(err)
+	data, err := identity.Export(created, []byte("correct horse"))
+	assert.NoError(err)
+	id, err := ImportIdentity(data, []byte("correct horse"))
+	assert.NoError(err)
+
+	_, err = c.Publish(context.Background(), id, "not a statement")
+	assert.ErrorIs(err, ErrNoStatement)
+
+	network.failures.Store(2)
+	actionID, err := c.Publish(context.Background(), id, `MERGE (p:Person {name: "Alice"})`)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(actionID, id.Identifier+"."))
+
+	m := <-network.published
+	assert.Equal(actionID, m.ID)
+	assert.Equal(node.ManifestVersion, m.Version)
+
+	payload, err := m.SigningPayload()
+	assert.NoError(err)
+	v, err := identity.NewVerifier(id.Certificate)
+	assert.NoError(err)
+	v.Add(payload)
+	assert.NoError(v.Verify(m.Signature))
+
+	// reformatting the statement doesn't change what was signed, the TTL does
+	m.Statement = `MERGE (p:Person{name:'Alice'})`
+	reformatted, err := m.SigningPayload()
+	assert.NoError(err)
+	assert.Equal(payload, reformatted)
+	m.TTL = 60
+	extended, err := m.SigningPayload()
+	assert.NoError(err)
+	assert.NotEqual(payload, extended)
+
+	network.failures.Store(10)
+	_, err = c.Publish(context.Background(), id, `MERGE (p:Person {name: "Bob"})`)
+	var statusErr *StatusError
+	assert.ErrorAs(err, &statusErr)
+	assert.Equal(http.StatusServiceUnavailable, statusErr.StatusCode)
+}
+
+func TestPublishDelegated(t *testing.T) {
+	assert := assert.New(t)
+
+	network := newTestNetwork(t)
+	c := network.connect(t)
+
+	store, err := identity.NewStore("file:delegated.db?mode=memory&cache=shared")
+	assert.NoError(err)
+	svc, err := identity.NewService(store)
+	assert.NoError(err)
+	id, err := svc.CreateIdentity("test user", "", true)
+	assert.NoError(err)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(err)
+	d, err := svc.Delegate(id, publicKey, []string{"Post"}, nil, time.Hour)
+	assert.NoError(err)
+	token, err := d.Encode()
+	assert.NoError(err)
+
+	_, err = c.PublishDelegated(context.Background(), "not a token", privateKey, `MERGE (p:Post {id: "p1"})`)
+	assert.Error(err)
+
+	actionID, err := c.PublishDelegated(context.Background(), token, privateKey, `MERGE (p:Post {id: "p1"})`)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(actionID, id.Identifier+"."))
+
+	m := <-network.published
+	assert.Equal(id.Identifier, m.Identity)
+	assert.Equal(token, m.Delegation)
+
+	payload, err := m.SigningPayload()
+	assert.NoError(err)
+	v, err := d.NewVerifier()
+	assert.NoError(err)
+	v.Add(payload)
+	assert.NoError(v.Verify(m.Signature))
+}
+
+func TestQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newTestNetwork(t).connect(t)
+
+	res, err := c.Query(context.Background(), "MATCH (p)-[r]->(q) RETURN p, r")
+	assert.NoError(err)
+	assert.Len(res["p"], 1)
+	assert.Equal("owner", res["p"][0].OwnerID)
+	assert.False(res["p"][0].IsRelation())
+	assert.True(res["r"][0].IsRelation())
+
+	paths, err := c.QueryPaths(context.Background(), "MATCH (q)<-[r]-(p) RETURN p, r")
+	assert.NoError(err)
+	assert.Len(paths, 1)
+	assert.Equal(res["p"][0].ID, paths[0].Nodes[1].ID)
+	assert.Equal(RelationDirLeft, paths[0].Relations[0].Direction)
+	assert.Equal(res["r"][0].ID, paths[0].Relations[0].Relation.ID)
+
+	_, err = c.Query(context.Background(), "CREATE (p)")
+	var statusErr *StatusError
+	assert.ErrorAs(err, &statusErr)
+	assert.Equal(http.StatusBadRequest, statusErr.StatusCode)
+}
+
+func TestSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	network := newTestNetwork(t)
+	c := network.connect(t)
+
+	err := c.Subscribe(context.Background(), []string{"["}, func(Action) {})
+	assert.Error(err)
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	received := make(chan Action, 10)
+	done := make(chan error)
+	go func() {
+		done <- c.Subscribe(ctx, []string{"Tag:*"}, func(a Action) {
+			received <- a
+		})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	network.add("a1", `MERGE (p:Person {name: "Alice"})`, "")
+	network.add("a2", `MERGE (t:Tag {value: 'golang'})`, "key1")
+	network.add("a3", `MERGE (t:Tag {value: 'golang'})`, "")
+
+	select {
+	case a := <-received:
+		assert.Equal("a3", a.ID)
+		assert.Contains(a.Topics, "Tag:value=golang")
+	case <-time.After(time.Second):
+		assert.Fail("no action received")
+	}
+
+	cancelFn()
+	assert.ErrorIs(<-done, context.Canceled)
+	assert.Empty(received)
+}
+
+func TestSubscribeGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	network := newTestNetwork(t)
+	other := newTestNetwork(t)
+	network.members = []string{network.srv.Listener.Addr().String(), other.srv.Listener.Addr().String()}
+
+	c, err := Options{
+		Backoff:      time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+		Group:        "golang",
+		// the members have their own certificates
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}.Connect(context.Background(), network.srv.Listener.Addr().String())
+	assert.NoError(err)
+	t.Cleanup(func() { c.Close() })
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	received := make(chan Action, 10)
+	go c.Subscribe(ctx, []string{"Tag:*"}, func(a Action) {
+		received <- a
+	})
+
+	time.Sleep(20 * time.Millisecond)
+	// each member received one of the actions
+	network.add("a1", `MERGE (t:Tag {value: 'golang'})`, "")
+	other.add("a2", `MERGE (t:Tag {value: 'rust'})`, "")
+
+	ids := []string{}
+	for len(ids) < 2 {
+		select {
+		case a := <-received:
+			ids = append(ids, a.ID)
+		case <-time.After(time.Second):
+			assert.FailNow("actions not received", "got %v", ids)
+		}
+	}
+	assert.ElementsMatch([]string{"a1", "a2"}, ids)
+
+	// the polls are shared and neither action is delivered twice
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(received)
+	assert.Positive(network.polls.Load())
+	assert.Positive(other.polls.Load())
+}
@@ -0,0 +1,219 @@
+/*
+Copyright © 2024 John Dudmesh <john@dudmesh.co.uk>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package propolis runs a propolis node inside another Go program. The node
+// is configured in code rather than from flags and a config file, and its
+// graph can be read in process.
+package propolis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/jdudmesh/propolis/internal/bloom"
+	"github.com/jdudmesh/propolis/internal/graph"
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/jdudmesh/propolis/internal/logging"
+	"github.com/jdudmesh/propolis/internal/node"
+	"github.com/jdudmesh/propolis/internal/secrets"
+)
+
+var (
+	ErrStarted    = errors.New("node already started")
+	ErrNotStarted = errors.New("node not started")
+	// ErrClosed is returned by lifecycle methods once the node is closed
+	ErrClosed = node.ErrClosed
+	// ErrUnknownNamespace is returned for a namespace missing from
+	// Config.Namespaces
+	ErrUnknownNamespace = node.ErrUnknownNamespace
+)
+
+// Config configures an embedded node. Host, Port, node_db and graph_db must
+// be set, the zero Type is a seed.
+type Config = node.Config
+
+// GraphConfig is embedded in Config and sets the graph database and the
+// logger, which defaults to slog.Default
+type GraphConfig = graph.Config
+
+type (
+	NodeType         = node.NodeType
+	Graph            = node.Graph
+	Event            = node.Event
+	EventHook        = node.EventHook
+	SearchResults    = graph.SearchResults
+	NodeRecord       = graph.NodeRecord
+	RelationRecord   = graph.RelationRecord
+	Path             = graph.Path
+	PathRelation     = graph.PathRelation
+	UnitOfWork       = graph.UnitOfWork
+	Stats            = graph.Stats
+	State            = graph.State
+	NodeQuery        = graph.NodeQuery
+	RelationQuery    = graph.RelationQuery
+	FeedQuery        = graph.FeedQuery
+	FeedCursor       = graph.FeedCursor
+	Schema           = graph.Schema
+	ModerationPolicy = node.ModerationPolicy
+	KeyProvider      = secrets.KeyProvider
+	NamespaceConfig  = node.NamespaceConfig
+	ReadRule         = node.ReadRule
+)
+
+// Events are emitted on the channels returned by Events and passed to hooks
+type (
+	ActionAccepted      = node.ActionAccepted
+	ActionRejected      = node.ActionRejected
+	SubscriptionChanged = node.SubscriptionChanged
+	StateDiverged       = node.StateDiverged
+)
+
+const (
+	NodeTypeSeed  = node.NodeTypeSeed
+	NodeTypePeer  = node.NodeTypePeer
+	NodeTypeCache = node.NodeTypeCache
+)
+
+// Identity signs the statements a node publishes. Identities are created and
+// exported with the propolis identity command and loaded with ImportIdentity.
+type Identity = identity.Identity
+
+// Loggers give the node's modules their own log levels, set with
+// Config.LogLevels or changed at runtime. Set Config.Loggers to share them
+// with the rest of the program.
+type Loggers = logging.Loggers
+
+const (
+	LogModuleNode     = logging.ModuleNode
+	LogModuleExecutor = logging.ModuleExecutor
+	LogModuleAST      = logging.ModuleAST
+	LogModuleIdentity = logging.ModuleIdentity
+)
+
+// NewLoggers creates loggers writing to handler, which should pass every
+// level, filtered by default at level
+func NewLoggers(handler slog.Handler, level slog.Level) *Loggers {
+	return logging.New(handler, level)
+}
+
+// ImportIdentity decrypts an identity exported with the propolis identity
+// export command
+func ImportIdentity(data, passphrase []byte) (*Identity, error) {
+	return identity.Import(data, passphrase)
+}
+
+// instance is what an embedding program can do with the node
+type instance interface {
+	Run(ctx context.Context) error
+	Close() error
+	Graph() node.Graph
+	Query(stmt string) (*graph.SearchResults, error)
+	QueryIn(namespace, stmt string) (*graph.SearchResults, error)
+	Feed(namespace string, q graph.FeedQuery) ([]*graph.NodeRecord, error)
+	Execute(ctx context.Context, id *identity.Identity, stmt string) error
+	ExecuteIn(ctx context.Context, namespace string, id *identity.Identity, stmt string) error
+	PublishIdentity(ctx context.Context, id *identity.Identity) error
+	Events() <-chan node.Event
+	AddEventHook(hook node.EventHook)
+	AddModerationPolicy(policy node.ModerationPolicy)
+	Subscribe(ids ...string)
+	Unsubscribe(ids ...string)
+	SubscribeTopics(topics ...string)
+	UnsubscribeTopics(topics ...string)
+	SubscribeIn(namespace string, keys ...string) error
+	UnsubscribeIn(namespace string, keys ...string) error
+	CountOfPeers(ctx context.Context) (int, error)
+	Reload(config node.Config) error
+}
+
+// Embedded is a node running inside the calling program
+type Embedded struct {
+	instance
+
+	mu   sync.Mutex
+	done chan struct{}
+	err  error
+}
+
+// NewEmbedded validates the config and creates a node, migrating its
+// databases. The node doesn't join the network until it is started.
+func NewEmbedded(cfg Config) (*Embedded, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("validating config: %w", err)
+	}
+
+	h, err := node.New(cfg, bloom.New())
+	if err != nil {
+		return nil, fmt.Errorf("creating node: %w", err)
+	}
+
+	return &Embedded{instance: h}, nil
+}
+
+// Start runs the node in the background until ctx is cancelled or it is
+// closed. Wait returns the error it stopped with.
+func (e *Embedded) Start(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.done != nil {
+		return ErrStarted
+	}
+
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		e.err = e.instance.Run(ctx)
+	}()
+
+	return nil
+}
+
+// Wait blocks until a started node stops, returning the error it stopped with
+func (e *Embedded) Wait() error {
+	e.mu.Lock()
+	done := e.done
+	e.mu.Unlock()
+	if done == nil {
+		return ErrNotStarted
+	}
+
+	<-done
+	return e.err
+}
+
+// Close stops the node and closes its databases, returning any error the node
+// stopped with
+func (e *Embedded) Close() error {
+	err := e.instance.Close()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	done := e.done
+	e.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	<-done
+	return e.err
+}
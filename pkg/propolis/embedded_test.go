@@ -0,0 +1,118 @@
+package propolis
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jdudmesh/propolis/internal/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newConfig(t *testing.T, name string) Config {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	return Config{
+		Config: GraphConfig{
+			GraphDatabaseURL: "file:embedded-" + name + "-graph.db?mode=memory&cache=shared",
+		},
+		Type:            NodeTypePeer,
+		Host:            "127.0.0.1",
+		Port:            port,
+		NodeDatabaseURL: "file:embedded-" + name + "-node.db?mode=memory&cache=shared",
+		DatabaseKey:     func(ctx context.Context) ([]byte, error) { return key, nil },
+	}
+}
+
+func newIdentity(t *testing.T) *Identity {
+	store, err := identity.NewStore("file:embedded-identities.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	svc, err := identity.NewService(store)
+	require.NoError(t, err)
+	id, err := svc.CreateIdentity("tester", "", true)
+	require.NoError(t, err)
+	return id
+}
+
+func TestEmbedded(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := NewEmbedded(newConfig(t, "run"))
+	require.NoError(t, err)
+
+	require.NoError(t, e.Start(context.Background()))
+	assert.ErrorIs(e.Start(context.Background()), ErrStarted)
+
+	require.NoError(t, e.Execute(context.Background(), newIdentity(t), "MERGE (:Post{text:'embedded'})"))
+
+	assert.Eventually(func() bool {
+		res, err := e.Query("MATCH (p:Post)")
+		return err == nil && len(res.Bindings()["p"]) == 1
+	}, 10*time.Second, 50*time.Millisecond)
+
+	nodes, err := e.Graph().ListNodes(NodeQuery{Label: "Post", Limit: 10})
+	require.NoError(t, err)
+	if assert.Len(nodes, 1) {
+		assert.Equal("embedded", nodes[0].Attributes["text"])
+	}
+
+	assert.NoError(e.Close())
+	assert.NoError(e.Wait())
+	assert.ErrorIs(e.Close(), ErrClosed)
+}
+
+func TestEmbeddedLifecycle(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewEmbedded(Config{})
+	assert.Error(err)
+
+	e, err := NewEmbedded(newConfig(t, "lifecycle"))
+	require.NoError(t, err)
+	assert.ErrorIs(e.Wait(), ErrNotStarted)
+	assert.NoError(e.Close())
+
+	// a closed node can't be started again
+	require.NoError(t, e.Start(context.Background()))
+	assert.ErrorIs(e.Wait(), ErrClosed)
+}
+
+func TestEmbeddedNamespaces(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := newConfig(t, "namespaces")
+	cfg.Namespaces = map[string]NamespaceConfig{
+		"team": {GraphDatabaseURL: "file:embedded-namespaces-team-graph.db?mode=memory&cache=shared"},
+	}
+	e, err := NewEmbedded(cfg)
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Start(context.Background()))
+
+	id := newIdentity(t)
+	require.NoError(t, e.ExecuteIn(context.Background(), "team", id, "MERGE (:Post{text:'team'})"))
+	assert.ErrorIs(e.ExecuteIn(context.Background(), "other", id, "MERGE (:Post{text:'other'})"), ErrUnknownNamespace)
+
+	assert.Eventually(func() bool {
+		res, err := e.QueryIn("team", "MATCH (p:Post)")
+		return err == nil && len(res.Bindings()["p"]) == 1
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// the default graph doesn't see the namespace's writes
+	res, err := e.Query("MATCH (p:Post)")
+	require.NoError(t, err)
+	assert.Empty(res.Bindings()["p"])
+
+	_, err = e.QueryIn("other", "MATCH (p:Post)")
+	assert.ErrorIs(err, ErrUnknownNamespace)
+}
@@ -6,8 +6,6 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
-	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"log"
 	"log/slog"
@@ -33,10 +31,10 @@ var nodeID string
 var filter *bloom.Filter
 
 type Peer interface {
-	Run() error
-	CountOfPeers() (int, error)
-	PublishIdentity(id *identity.Identity) error
-	Execute(id *identity.Identity, action string) error
+	Run(ctx context.Context) error
+	CountOfPeers(ctx context.Context) (int, error)
+	PublishIdentity(ctx context.Context, id *identity.Identity) error
+	Execute(ctx context.Context, id *identity.Identity, action string) error
 }
 
 func main() {
@@ -96,14 +94,14 @@ func main() {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err = peer.Run()
+		err = peer.Run(context.Background())
 		if err != nil {
 			panic(err)
 		}
 	}()
 
 	// for {
-	// 	n, err := peer.CountOfPeers()
+	// 	n, err := peer.CountOfPeers(context.Background())
 	// 	if err != nil {
 	// 		panic(err)
 	// 	}
@@ -114,7 +112,7 @@ func main() {
 	// 	time.Sleep(1 * time.Second)
 	// }
 
-	err = peer.PublishIdentity(id)
+	err = peer.PublishIdentity(context.Background(), id)
 	if err != nil {
 		panic(err)
 	}
@@ -156,30 +154,12 @@ func createPeer() (Peer, error) {
 }
 
 func PublishIdentity(peer Peer, id *identity.Identity) error {
-	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: id.CertificateData}))
-	certPEMEncoded, err := json.Marshal(certPEM)
-	if err != nil {
-		panic(err)
-	}
-	fmt.Println(string(certPEMEncoded))
-
-	sb := strings.Builder{}
-	sb.WriteString("MERGE (:Identity{")
-	props := []string{
-		fmt.Sprintf("id:'%s'", id.Identifier),
-		fmt.Sprintf("handle:'%s'", id.Handle),
-		fmt.Sprintf("bio:'%s'", id.Bio),
-		fmt.Sprintf("certificate:'%s'", string(certPEMEncoded)),
-	}
-	sb.WriteString(strings.Join(props, ", "))
-	sb.WriteString("})")
-
-	err = peer.Execute(id, sb.String())
+	stmt, err := node.IdentityStatement(id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return peer.Execute(context.Background(), id, stmt)
 }
 
 func sendFolders(id *identity.Identity, db *sqlx.DB) error {